@@ -0,0 +1,69 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/check/bayes"
+	"github.com/urfave/cli"
+)
+
+func bayesLearnMsg(c *bayes.Check, r io.Reader, spam bool) error {
+	bufR := bufio.NewReader(r)
+	hdr, err := textproto.ReadHeader(bufR)
+	if err != nil {
+		return err
+	}
+	return c.Learn(context.Background(), hdr, bufR, spam)
+}
+
+func bayesLearn(c *bayes.Check, ctx *cli.Context) error {
+	if ctx.Bool("spam") == ctx.Bool("ham") {
+		return errors.New("Error: exactly one of --spam and --ham should be specified")
+	}
+	spam := ctx.Bool("spam")
+
+	if ctx.NArg() == 0 {
+		return bayesLearnMsg(c, os.Stdin, spam)
+	}
+
+	for _, path := range ctx.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Error: %w", err)
+		}
+		err = bayesLearnMsg(c, f, spam)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Error: %s: %w", path, err)
+		}
+	}
+
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintf(os.Stderr, "Learned %d message(s).\n", ctx.NArg())
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxcpp/maddy"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/endpoint/control"
+	"github.com/urfave/cli"
+)
+
+// controlSocket returns the socket path of the control endpoint defined in
+// the configuration file.
+func controlSocket(ctx *cli.Context) (string, error) {
+	if ctx.String("socket") != "" {
+		return ctx.String("socket"), nil
+	}
+
+	cfgFile, err := os.Open(ctx.GlobalString("config"))
+	if err != nil {
+		return "", fmt.Errorf("Error: failed to open config: %w", err)
+	}
+	defer cfgFile.Close()
+	cfgNodes, err := parser.Read(cfgFile, cfgFile.Name())
+	if err != nil {
+		return "", fmt.Errorf("Error: failed to parse config: %w", err)
+	}
+
+	_, cfgNodes, err = maddy.ReadGlobals(cfgNodes)
+	if err != nil {
+		return "", err
+	}
+	if err := maddy.InitDirs(); err != nil {
+		return "", err
+	}
+
+	for _, node := range cfgNodes {
+		if node.Name != "control" {
+			continue
+		}
+		if len(node.Args) == 0 {
+			break
+		}
+		endp, err := config.ParseEndpoint(node.Args[0])
+		if err != nil {
+			return "", fmt.Errorf("Error: malformed control endpoint address: %w", err)
+		}
+		return endp.Address(), nil
+	}
+
+	return control.DefaultSocket(), nil
+}
+
+func controlCommand(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return errors.New("Error: COMMAND is required")
+	}
+
+	sockPath, err := controlSocket(ctx)
+	if err != nil {
+		return err
+	}
+
+	res, err := control.SendCommand(sockPath, ctx.Args()...)
+	if err != nil {
+		return fmt.Errorf("Error: %w", err)
+	}
+	if len(res) == 0 || string(res) == "null" {
+		return nil
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, res, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
@@ -24,12 +24,15 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/foxcpp/maddy"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/check/bayes"
+	"github.com/foxcpp/maddy/internal/target/queue"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/bcrypt"
@@ -655,6 +658,203 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "imap-storage",
+			Usage: "IMAP storage maintenance",
+			Subcommands: []cli.Command{
+				{
+					Name:        "compact",
+					Usage:       "Remove orphaned message blobs and repack the database",
+					Description: "Can be run while the server is running, but SQLite database will be locked for writing while it is repacked.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return storageCompact(be, ctx)
+					},
+				},
+				{
+					Name:  "collect-blobs",
+					Usage: "Remove message blobs that are not referenced in the database",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+						cli.DurationFlag{
+							Name:  "min-age",
+							Usage: "Remove only blobs that were not modified for the specified duration",
+							Value: 24 * time.Hour,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return storageCollectBlobs(be, ctx)
+					},
+				},
+			},
+		},
+		{
+			Name:  "queue",
+			Usage: "Outbound queue management",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List queued messages",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueList(q, ctx)
+					},
+				},
+				{
+					Name:        "flush",
+					Usage:       "Retry delivery of queued messages immediately",
+					Description: "Retries all messages if no IDs are specified, requires the server to be running",
+					ArgsUsage:   "[ID...]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueFlush(q, ctx)
+					},
+				},
+				{
+					Name:        "delete",
+					Usage:       "Remove message from the queue",
+					Description: "No bounce message is generated for removed messages",
+					ArgsUsage:   "ID",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueDelete(q, ctx)
+					},
+				},
+				{
+					Name:        "status",
+					Usage:       "Show delivery status of the message",
+					Description: "Requires status_retention to be set for the queue, works for messages that already left the queue too",
+					ArgsUsage:   "ID",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.BoolFlag{
+							Name:  "events,e",
+							Usage: "Also show all recorded state changes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueStatus(q, ctx)
+					},
+				},
+			},
+		},
+		{
+			Name:  "bayes",
+			Usage: "Statistical spam classifier management",
+			Subcommands: []cli.Command{
+				{
+					Name:        "learn",
+					Usage:       "Train the classifier using messages from files",
+					Description: "Messages are read from standard input if no files are specified",
+					ArgsUsage:   "[FILE...]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "bayes",
+						},
+						cli.BoolFlag{
+							Name:  "spam",
+							Usage: "Learn messages as spam",
+						},
+						cli.BoolFlag{
+							Name:  "ham",
+							Usage: "Learn messages as ham (non-spam)",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						c, err := openBayes(ctx)
+						if err != nil {
+							return err
+						}
+						defer c.Close()
+						return bayesLearn(c, ctx)
+					},
+				},
+			},
+		},
+		{
+			Name:        "control",
+			Usage:       "Send command to the running server via the control endpoint",
+			Description: "Use 'maddyctl control help' to get the list of supported commands",
+			ArgsUsage:   "COMMAND [ARG...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "socket",
+					Usage: "Control socket to use, by default the address from the control endpoint configuration is used",
+				},
+			},
+			Action: controlCommand,
+		},
 		{
 			Name:   "hash",
 			Usage:  "Generate password hashes for use with pass_table",
@@ -773,6 +973,42 @@ func openStorage(ctx *cli.Context) (module.Storage, error) {
 	return storage, nil
 }
 
+func openQueue(ctx *cli.Context) (*queue.Queue, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q, ok := mod.Instance.(*queue.Queue)
+	if !ok {
+		return nil, fmt.Errorf("Error: configuration block %s is not a queue", ctx.String("cfg-block"))
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return q, nil
+}
+
+func openBayes(ctx *cli.Context) (*bayes.Check, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := mod.Instance.(*bayes.Check)
+	if !ok {
+		return nil, fmt.Errorf("Error: configuration block %s is not a check.bayes", ctx.String("cfg-block"))
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return c, nil
+}
+
 func openUserDB(ctx *cli.Context) (module.PlainUserDB, error) {
 	globals, mod, err := getCfgBlockModule(ctx)
 	if err != nil {
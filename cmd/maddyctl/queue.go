@@ -0,0 +1,160 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
+	"github.com/foxcpp/maddy/internal/endpoint/control"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/urfave/cli"
+)
+
+func queueList(q *queue.Queue, ctx *cli.Context) error {
+	msgs, err := q.List()
+	if err != nil {
+		return err
+	}
+
+	if len(msgs) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Queue is empty.")
+	}
+
+	for _, msg := range msgs {
+		fmt.Printf("%s: from <%s>, queued at %v\n", msg.ID, msg.From, msg.FirstAttempt.Format(time.RFC3339))
+		fmt.Printf("  Next attempt: %v\n", msg.NextAttempt.Format(time.RFC3339))
+		for _, rcpt := range msg.To {
+			rcptErr := msg.RcptErrs[rcpt]
+			if rcptErr == nil {
+				fmt.Printf("  <%s>\n", rcpt)
+				continue
+			}
+			fmt.Printf("  <%s>: %d %d.%d.%d %s\n", rcpt, rcptErr.Code,
+				rcptErr.EnhancedCode[0], rcptErr.EnhancedCode[1], rcptErr.EnhancedCode[2],
+				rcptErr.Message)
+		}
+	}
+	return nil
+}
+
+func queueFlush(q *queue.Queue, ctx *cli.Context) error {
+	sockPath, err := controlSocket(ctx)
+	if err != nil {
+		return err
+	}
+
+	res, err := control.SendCommand(sockPath, append([]string{"flush", q.ControlName()}, ctx.Args()...)...)
+	if err != nil {
+		return fmt.Errorf("Error: %w", err)
+	}
+	var flushRes struct {
+		Flushed int `json:"flushed"`
+	}
+	if err := json.Unmarshal(res, &flushRes); err != nil {
+		return fmt.Errorf("Error: %w", err)
+	}
+
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintf(os.Stderr, "Scheduled %d message(s) for delivery.\n", flushRes.Flushed)
+	}
+	return nil
+}
+
+func queueDelete(q *queue.Queue, ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return errors.New("Error: ID is required")
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools.Confirmation("Are you sure you want to delete this message without notifying the sender?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	sockPath, err := controlSocket(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = control.SendCommand(sockPath, "delete", q.ControlName(), id)
+	if !errors.Is(err, control.ErrUnavailable) {
+		if err != nil {
+			return fmt.Errorf("Error: %w", err)
+		}
+		return nil
+	}
+
+	// The server is likely not running, remove files directly. Queue
+	// directory is locked by the running server so this fails if it is
+	// running without the control endpoint.
+	err = q.Delete(id)
+	switch {
+	case errors.Is(err, queue.ErrDirLocked):
+		return errors.New("Error: queue is used by the running server, but the control endpoint is not available")
+	case err != nil:
+		return fmt.Errorf("Error: %w", err)
+	}
+	return nil
+}
+
+func queueStatus(q *queue.Queue, ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return errors.New("Error: ID is required")
+	}
+
+	status, err := q.DeliveryStatus(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: from <%s>, queued at %v\n", status.ID, status.From, status.Created.Format(time.RFC3339))
+	rcpts := make([]string, 0, len(status.Rcpts))
+	for rcpt := range status.Rcpts {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+	for _, rcpt := range rcpts {
+		rcptStatus := status.Rcpts[rcpt]
+		fmt.Printf("  <%s>: %s, %d attempt(s), updated at %v\n", rcpt, rcptStatus.State,
+			rcptStatus.Attempts, rcptStatus.Updated.Format(time.RFC3339))
+		if rcptStatus.LastError != "" {
+			fmt.Printf("    Last error: %s\n", rcptStatus.LastError)
+		}
+	}
+
+	if ctx.Bool("events") {
+		fmt.Println("Events:")
+		for _, ev := range status.Events {
+			if ev.Error != "" {
+				fmt.Printf("  %v <%s>: %s (%s)\n", ev.Time.Format(time.RFC3339), ev.Rcpt, ev.State, ev.Error)
+				continue
+			}
+			fmt.Printf("  %v <%s>: %s\n", ev.Time.Format(time.RFC3339), ev.Rcpt, ev.State)
+		}
+	}
+	return nil
+}
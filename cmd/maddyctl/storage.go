@@ -0,0 +1,64 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli"
+)
+
+func storageCompact(be module.Storage, ctx *cli.Context) error {
+	store, ok := be.(*imapsql.Storage)
+	if !ok {
+		return errors.New("Error: storage module does not support compaction")
+	}
+
+	stats, err := store.Compact(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Orphaned blobs removed:", stats.OrphanedBlobs)
+	if reclaimed := stats.Reclaimed(); reclaimed >= 0 {
+		fmt.Println("Database size before:", stats.SizeBefore)
+		fmt.Println("Database size after:", stats.SizeAfter)
+		fmt.Println("Reclaimed:", reclaimed)
+	}
+	return nil
+}
+
+func storageCollectBlobs(be module.Storage, ctx *cli.Context) error {
+	store, ok := be.(*imapsql.Storage)
+	if !ok {
+		return errors.New("Error: storage module does not support blob garbage collection")
+	}
+
+	removed, err := store.CollectBlobs(context.Background(), ctx.Duration("min-age"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Unreferenced blobs removed:", removed)
+	return nil
+}
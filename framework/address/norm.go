@@ -34,6 +34,10 @@ import (
 //
 // If Equal(addr1, addr2) == true, then ForLookup(addr1) == ForLookup(addr2).
 //
+// The domain is converted into the U-label form by dns.ForLookup, so the
+// A-label and U-label forms of the same address are looked up the same way.
+// Use dns.ToASCII on the domain if it is needed for DNS queries.
+//
 // On error, case-folded addr is also returned.
 func ForLookup(addr string) (string, error) {
 	mbox, domain, err := Split(addr)
@@ -0,0 +1,195 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// StrictOptions controls which optional RFC 5321 constructs are accepted by
+// ValidateStrict.
+type StrictOptions struct {
+	// Accept quoted local-parts, such as "john doe"@example.org.
+	AllowQuoted bool
+	// Accept address literals, such as postmaster@[192.0.2.1].
+	AllowLiteral bool
+	// Accept non-ASCII characters as permitted by RFC 6531.
+	AllowUTF8 bool
+}
+
+// Limits defined in RFC 5321, section 4.5.3.1.
+const (
+	maxLocalPartLen = 64
+	maxDomainLen    = 255
+	// 256 octets for the path, including angle brackets.
+	maxAddressLen = 254
+	maxLabelLen   = 63
+)
+
+// ValidateStrict checks whether the address follows the Mailbox grammar of
+// RFC 5321 and fits into its length limits. Unlike Valid, it checks the
+// placement of dots in the local-part and requires domain labels to consist
+// of letters, digits and hyphens.
+//
+// The returned error describes the first found violation.
+func ValidateStrict(addr string, opts StrictOptions) error {
+	if strings.EqualFold(addr, "postmaster") {
+		return nil
+	}
+	if len(addr) > maxAddressLen {
+		return errors.New("address: address is too long")
+	}
+
+	mbox, domain, err := Split(addr)
+	if err != nil {
+		return err
+	}
+
+	if err := validateLocalPart(mbox, opts); err != nil {
+		return err
+	}
+	return validateDomainStrict(domain, opts)
+}
+
+func isAtext(ch rune, allowUTF8 bool) bool {
+	switch {
+	case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		return true
+	case ch > 0x7F:
+		return allowUTF8
+	case ch == '.':
+		return false
+	}
+	return validGraphic[ch]
+}
+
+func validateLocalPart(mbox string, opts StrictOptions) error {
+	if len(mbox) > maxLocalPartLen {
+		return errors.New("address: local-part is too long")
+	}
+
+	if strings.HasPrefix(mbox, `"`) {
+		if !opts.AllowQuoted {
+			return errors.New("address: quoted local-part is not allowed")
+		}
+		return validateQuoted(mbox, opts.AllowUTF8)
+	}
+
+	for _, atom := range strings.Split(mbox, ".") {
+		if atom == "" {
+			return errors.New("address: misplaced dot in local-part")
+		}
+		for _, ch := range atom {
+			if !isAtext(ch, opts.AllowUTF8) {
+				return errors.New("address: unquoted special character in local-part")
+			}
+		}
+	}
+	return nil
+}
+
+func validateQuoted(mbox string, allowUTF8 bool) error {
+	if len(mbox) < 2 || !strings.HasSuffix(mbox, `"`) {
+		return errors.New("address: unterminated quoted local-part")
+	}
+
+	escaped := false
+	for _, ch := range mbox[1 : len(mbox)-1] {
+		switch {
+		case ch > 0x7F:
+			if !allowUTF8 {
+				return errors.New("address: non-ASCII character in local-part")
+			}
+		case ch < ' ' || ch == 0x7F:
+			return errors.New("address: control character in local-part")
+		case escaped:
+		case ch == '\\':
+			escaped = true
+			continue
+		case ch == '"':
+			return errors.New("address: unescaped quote in local-part")
+		}
+		escaped = false
+	}
+	if escaped {
+		return errors.New("address: unterminated quoted local-part")
+	}
+	return nil
+}
+
+func validateDomainStrict(domain string, opts StrictOptions) error {
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		if !opts.AllowLiteral {
+			return errors.New("address: address literal is not allowed")
+		}
+		lit := domain[1 : len(domain)-1]
+		if strings.HasPrefix(lit, "IPv6:") {
+			ip := net.ParseIP(strings.TrimPrefix(lit, "IPv6:"))
+			if ip == nil || ip.To4() != nil {
+				return errors.New("address: malformed IPv6 address literal")
+			}
+			return nil
+		}
+		ip := net.ParseIP(lit)
+		if ip == nil || ip.To4() == nil {
+			return errors.New("address: malformed address literal")
+		}
+		return nil
+	}
+
+	if !IsASCII(domain) {
+		if !opts.AllowUTF8 {
+			return errors.New("address: non-ASCII domain")
+		}
+		var err error
+		domain, err = idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return errors.New("address: malformed internationalized domain")
+		}
+	}
+
+	if len(domain) > maxDomainLen {
+		return errors.New("address: domain is too long")
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" {
+			return errors.New("address: empty domain label")
+		}
+		if len(label) > maxLabelLen {
+			return errors.New("address: domain label is too long")
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("address: domain label starts or ends with hyphen")
+		}
+		for _, ch := range label {
+			switch {
+			case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z':
+			case ch >= '0' && ch <= '9':
+			case ch == '-':
+			default:
+				return errors.New("address: invalid character in domain")
+			}
+		}
+	}
+	return nil
+}
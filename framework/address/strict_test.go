@@ -0,0 +1,76 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateStrict(t *testing.T) {
+	test := func(addr string, opts StrictOptions, fail bool) {
+		t.Helper()
+
+		err := ValidateStrict(addr, opts)
+		if err != nil && !fail {
+			t.Errorf("%s: unexpected error: %v", addr, err)
+		}
+		if err == nil && fail {
+			t.Errorf("%s: expected error", addr)
+		}
+	}
+	all := StrictOptions{AllowQuoted: true, AllowLiteral: true, AllowUTF8: true}
+	none := StrictOptions{}
+
+	test("simple@example.org", none, false)
+	test("first.last+tag@sub-domain.example.org", none, false)
+	test("postmaster", none, false)
+	test("o'brien@example.org", none, false)
+
+	test(".lead@example.org", none, true)
+	test("trail.@example.org", none, true)
+	test("dou..ble@example.org", none, true)
+	test("spe(ial@example.org", none, true)
+	test("a,b@example.org", none, true)
+	test(strings.Repeat("a", 65)+"@example.org", none, true)
+	test("user@"+strings.Repeat("a", 64)+".org", none, true)
+	test("user@"+strings.Repeat("a.", 130)+"org", none, true)
+
+	test("user@-example.org", none, true)
+	test("user@example-.org", none, true)
+	test("user@exa_mple.org", none, true)
+	test("user@example..org", none, true)
+
+	test(`"john doe"@example.org`, none, true)
+	test(`"john doe"@example.org`, all, false)
+	test(`"john\"doe"@example.org`, all, false)
+	test(`"john"doe"@example.org`, all, true)
+	test(`"john\`+"\x01"+`"@example.org`, all, true)
+
+	test("user@[192.0.2.1]", none, true)
+	test("user@[192.0.2.1]", all, false)
+	test("user@[IPv6:2001:db8::1]", all, false)
+	test("user@[IPv6:192.0.2.1]", all, true)
+	test("user@[300.0.2.1]", all, true)
+
+	test("тест@example.org", none, true)
+	test("тест@example.org", all, false)
+	test("user@тест.example", none, true)
+	test("user@тест.example", all, false)
+}
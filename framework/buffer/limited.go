@@ -0,0 +1,72 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package buffer
+
+import (
+	"io"
+)
+
+// LimitedBuffer provides the view of the first N bytes of the underlying
+// Buffer.
+//
+// Remove is a no-op, the underlying Buffer is still owned by its creator.
+type LimitedBuffer struct {
+	B Buffer
+	N int
+}
+
+// Limit returns the Buffer that contains at most n first bytes of b.
+//
+// b is returned as is if it is not longer than n bytes.
+func Limit(b Buffer, n int) Buffer {
+	if b.Len() <= n {
+		return b
+	}
+	if mb, ok := b.(MemoryBuffer); ok {
+		return MemoryBuffer{Slice: mb.Slice[:n]}
+	}
+	return LimitedBuffer{B: b, N: n}
+}
+
+type limitedReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (lb LimitedBuffer) Open() (io.ReadCloser, error) {
+	r, err := lb.B.Open()
+	if err != nil {
+		return nil, err
+	}
+	return limitedReader{
+		Reader: io.LimitReader(r, int64(lb.N)),
+		Closer: r,
+	}, nil
+}
+
+func (lb LimitedBuffer) Len() int {
+	if l := lb.B.Len(); l < lb.N {
+		return l
+	}
+	return lb.N
+}
+
+func (lb LimitedBuffer) Remove() error {
+	return nil
+}
@@ -46,10 +46,14 @@ func expandEnvironment(nodes []Node) []Node {
 	return newNodes
 }
 
-var unixEnvvarRe = regexp.MustCompile(`{env:([^\$]+)}`)
+var (
+	unixEnvvarRe  = regexp.MustCompile(`{env:([^\$]+)}`)
+	shellEnvvarRe = regexp.MustCompile(`\$\{[A-Za-z_][A-Za-z0-9_]*\}`)
+)
 
 func removeUnexpandedEnvvars(s string) string {
 	s = unixEnvvarRe.ReplaceAllString(s, "")
+	s = shellEnvvarRe.ReplaceAllString(s, "")
 	return s
 }
 
@@ -61,7 +65,7 @@ func buildEnvReplacer() *strings.Replacer {
 		key := parts[0]
 		value := parts[1]
 
-		pairs = append(pairs, "{env:"+key+"}", value)
+		pairs = append(pairs, "{env:"+key+"}", value, "${"+key+"}", value)
 	}
 	return strings.NewReplacer(pairs...)
 }
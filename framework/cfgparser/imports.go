@@ -50,7 +50,7 @@ func (ctx *parseContext) expandImports(node Node, expansionDepth int) (Node, err
 
 			containsImports = true
 			if len(child.Args) != 1 {
-				return node, ctx.Err("import directive requires exactly 1 argument")
+				return node, NodeErr(child, "import directive requires exactly 1 argument")
 			}
 
 			subtree, err := ctx.resolveImport(child, child.Args[0], expansionDepth)
@@ -79,22 +79,66 @@ func (ctx *parseContext) resolveImport(node Node, name string, expansionDepth in
 		return subtree, nil
 	}
 
-	file := filepath.Join(filepath.Dir(ctx.fileLocation), name)
-	src, err := os.Open(file)
-	if err != nil {
-		if os.IsNotExist(err) {
-			src, err = os.Open(file + ".conf")
+	file := name
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(ctx.fileLocation), name)
+	}
+
+	if strings.ContainsAny(name, "*?[") {
+		// Glob matching no files is not an error, this allows to have an
+		// "include all files from directory" directive for an empty
+		// directory.
+		matches, err := filepath.Glob(file)
+		if err != nil {
+			return nil, NodeErr(node, "malformed import pattern: %v", err)
+		}
+
+		var nodes []Node
+		for _, match := range matches {
+			subtree, err := ctx.importFile(node, match, expansionDepth)
 			if err != nil {
-				if os.IsNotExist(err) {
-					return nil, NodeErr(node, "unknown import: "+name)
-				}
 				return nil, err
 			}
-		} else {
-			return nil, err
+			nodes = append(nodes, subtree...)
+		}
+		return nodes, nil
+	}
+
+	if _, err := os.Stat(file); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, NodeErr(node, "%v", err)
+		}
+		if _, err := os.Stat(file + ".conf"); err != nil {
+			if os.IsNotExist(err) {
+				return nil, NodeErr(node, "unknown import: "+name)
+			}
+			return nil, NodeErr(node, "%v", err)
 		}
+		file += ".conf"
 	}
-	nodes, snips, macros, err := readTree(src, file, expansionDepth+1)
+
+	return ctx.importFile(node, file, expansionDepth)
+}
+
+func (ctx *parseContext) importFile(node Node, file string, expansionDepth int) ([]Node, error) {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return nil, NodeErr(node, "%v", err)
+	}
+	for i, imported := range ctx.importStack {
+		if imported == absFile {
+			cycle := append(ctx.importStack[i:len(ctx.importStack):len(ctx.importStack)], absFile)
+			return nil, NodeErr(node, "import cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	src, err := os.Open(file)
+	if err != nil {
+		return nil, NodeErr(node, "%v", err)
+	}
+	defer src.Close()
+
+	nodes, snips, macros, err := readTree(src, file, expansionDepth+1, ctx.importStack)
 	if err != nil {
 		return nodes, err
 	}
@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"path/filepath"
 	"strings"
 	"unicode"
 
@@ -69,6 +70,10 @@ type parseContext struct {
 	macros   map[string][]string
 
 	fileLocation string
+
+	// importStack contains absolute paths of files that are being read,
+	// starting from the top-level one. It is used to detect import cycles.
+	importStack []string
 }
 
 func validateNodeName(s string) error {
@@ -347,7 +352,7 @@ func (ctx *parseContext) readNodes() ([]Node, error) {
 	return res, nil
 }
 
-func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, snips map[string][]Node, macros map[string][]string, err error) {
+func readTree(r io.Reader, location string, expansionDepth int, importStack []string) (nodes []Node, snips map[string][]Node, macros map[string][]string, err error) {
 	ctx := parseContext{
 		Dispenser:    lexer.NewDispenser(location, r),
 		snippets:     make(map[string][]Node),
@@ -355,6 +360,9 @@ func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, s
 		nesting:      -1,
 		fileLocation: location,
 	}
+	if absLocation, err := filepath.Abs(location); err == nil {
+		ctx.importStack = append(importStack[:len(importStack):len(importStack)], absLocation)
+	}
 
 	root := Node{}
 	root.File = location
@@ -384,7 +392,7 @@ func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, s
 }
 
 func Read(r io.Reader, location string) (nodes []Node, err error) {
-	nodes, _, _, err = readTree(r, location, 0)
+	nodes, _, _, err = readTree(r, location, 0, nil)
 	nodes = expandEnvironment(nodes)
 	return
 }
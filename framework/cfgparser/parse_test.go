@@ -19,7 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package parser
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -328,6 +330,34 @@ var cases = []struct {
 		},
 		false,
 	},
+	{
+		"environment variable expansion (shell-like syntax)",
+		`a ${TESTING_VARIABLE} prefix-${TESTING_VARIABLE}`,
+		[]Node{
+			{
+				Name:     "a",
+				Args:     []string{"ABCDEF", "prefix-ABCDEF"},
+				Children: nil,
+				File:     "test",
+				Line:     1,
+			},
+		},
+		false,
+	},
+	{
+		"missing environment variable expansion (shell-like syntax)",
+		`a ${TESTING_VARIABLE3}`,
+		[]Node{
+			{
+				Name:     "a",
+				Args:     []string{""},
+				Children: nil,
+				File:     "test",
+				Line:     1,
+			},
+		},
+		false,
+	},
 	{
 		"incomplete environment variable syntax",
 		`a {env:TESTING_VARIABLE`,
@@ -621,3 +651,83 @@ func TestRead(t *testing.T) {
 		})
 	}
 }
+
+func TestReadImportFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-cfgparser-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) ([]Node, error) {
+		t.Helper()
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return Read(f, filepath.Join(dir, name))
+	}
+
+	t.Run("glob", func(t *testing.T) {
+		writeFile("conf.d/b.conf", "b")
+		writeFile("conf.d/a.conf", "a")
+		writeFile("glob.conf", "import conf.d/*.conf\nc")
+
+		nodes, err := read("glob.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, node := range nodes {
+			names = append(names, node.Name)
+		}
+		if !reflect.DeepEqual(names, []string{"a", "b", "c"}) {
+			t.Fatal("wrong directives:", names)
+		}
+	})
+	t.Run("empty glob", func(t *testing.T) {
+		writeFile("empty.conf", "import none.d/*.conf")
+
+		nodes, err := read("empty.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 0 {
+			t.Fatal("unexpected directives:", nodes)
+		}
+	})
+	t.Run("cycle", func(t *testing.T) {
+		writeFile("cycle1.conf", "a\nimport cycle2")
+		writeFile("cycle2.conf", "import cycle1")
+
+		_, err := read("cycle1.conf")
+		if err == nil {
+			t.Fatal("expected error for import cycle")
+		}
+		if !strings.Contains(err.Error(), "import cycle") || !strings.Contains(err.Error(), "cycle2.conf:1") {
+			t.Fatal("wrong error:", err)
+		}
+	})
+	t.Run("missing file", func(t *testing.T) {
+		writeFile("missing.conf", "a\nimport nonexistent")
+
+		_, err := read("missing.conf")
+		if err == nil {
+			t.Fatal("expected error for missing import")
+		}
+		if !strings.Contains(err.Error(), "missing.conf:2") {
+			t.Fatal("error does not contain import location:", err)
+		}
+	})
+}
@@ -43,6 +43,9 @@ func (e Endpoint) String() string {
 	if e.Scheme == "unix" {
 		return "unix://" + e.Path
 	}
+	if e.IsSystemd() {
+		return e.Scheme + "://" + e.Host
+	}
 
 	if e.Host == "" && e.Port == "" {
 		return ""
@@ -84,7 +87,14 @@ func (e Endpoint) Address() string {
 }
 
 func (e Endpoint) IsTLS() bool {
-	return e.Scheme == "tls"
+	return e.Scheme == "tls" || e.Scheme == "systemd+tls"
+}
+
+// IsSystemd reports whether the endpoint refers to sockets passed by systemd
+// (socket activation). Host contains the FileDescriptorName of the sockets
+// then.
+func (e Endpoint) IsSystemd() bool {
+	return e.Scheme == "systemd" || e.Scheme == "systemd+tls"
 }
 
 // ParseEndpoint parses an endpoint string into a structured format with separate
@@ -124,6 +134,15 @@ func ParseEndpoint(str string) (Endpoint, error) {
 		}
 
 		return Endpoint{Original: input, Scheme: u.Scheme, Path: actualPath}, err
+	case "systemd", "systemd+tls":
+		name := u.Host
+		if name == "" {
+			name = u.Opaque
+		}
+		if name == "" {
+			return Endpoint{}, fmt.Errorf("socket name is required")
+		}
+		return Endpoint{Original: input, Scheme: u.Scheme, Host: name}, nil
 	default:
 		return Endpoint{}, fmt.Errorf("unsupported scheme: %s (%+v)", input, u)
 	}
@@ -36,6 +36,9 @@ func TestStandardizeAddress(t *testing.T) {
 		{Original: "unix:///also/path", Scheme: "unix", Host: "", Path: "/also/path", Port: ""},
 		{Original: "tls://0.0.0.0:10025", Scheme: "tls", Host: "0.0.0.0", Port: "10025"},
 		{Original: "tls:0.0.0.0:10025", Scheme: "tls", Host: "0.0.0.0", Port: "10025"},
+		{Original: "systemd://smtp", Scheme: "systemd", Host: "smtp"},
+		{Original: "systemd:smtp", Scheme: "systemd", Host: "smtp"},
+		{Original: "systemd+tls://imaps", Scheme: "systemd+tls", Host: "imaps"},
 	} {
 		actual, err := ParseEndpoint(expected.Original)
 		if err != nil {
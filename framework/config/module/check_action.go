@@ -19,12 +19,14 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package modconfig
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 )
@@ -53,6 +55,14 @@ type FailAction struct {
 	Quarantine bool
 	Reject     bool
 
+	// Score is added to the message score instead of taking any action
+	// directly.
+	Score int
+
+	// DeferInternally requests the message pipeline to accept the message
+	// and retry the check later instead of rejecting it.
+	DeferInternally bool
+
 	ReasonOverride *exterrors.SMTPError
 }
 
@@ -84,6 +94,19 @@ func ParseActionDirective(args []string) (FailAction, error) {
 				return FailAction{}, err
 			}
 		}
+	case "score":
+		if len(args) != 2 {
+			return FailAction{}, errors.New("expected exactly one argument for score")
+		}
+		var err error
+		res.Score, err = strconv.Atoi(args[1])
+		if err != nil {
+			return FailAction{}, fmt.Errorf("invalid score integer: %v", err)
+		}
+	case "defer_internally":
+		if len(args) > 1 {
+			return FailAction{}, errors.New("no arguments expected for defer_internally")
+		}
 	case "ignore":
 	default:
 		return FailAction{}, errors.New("invalid action")
@@ -91,6 +114,7 @@ func ParseActionDirective(args []string) (FailAction, error) {
 
 	res.Reject = args[0] == "reject"
 	res.Quarantine = args[0] == "quarantine"
+	res.DeferInternally = args[0] == "defer_internally"
 	return res, nil
 }
 
@@ -113,9 +137,39 @@ func (cfa FailAction) Apply(originalRes module.CheckResult) module.CheckResult {
 
 	originalRes.Quarantine = cfa.Quarantine || originalRes.Quarantine
 	originalRes.Reject = cfa.Reject || originalRes.Reject
+	originalRes.Score += cfa.Score
+	originalRes.DeferInternally = cfa.DeferInternally || originalRes.DeferInternally
 	return originalRes
 }
 
+// LookupActionOverride looks up the per-domain action override in the
+// table.
+//
+// Table values use the same syntax as action directives, e.g. "ignore",
+// "quarantine", "reject 550 5.7.1" or "score 5". Domain is normalized using
+// dns.ForLookup before the lookup. If tbl is nil, no override is returned.
+func LookupActionOverride(ctx context.Context, tbl module.Table, domain string) (FailAction, bool, error) {
+	if tbl == nil || domain == "" {
+		return FailAction{}, false, nil
+	}
+
+	key, err := dns.ForLookup(domain)
+	if err != nil {
+		return FailAction{}, false, err
+	}
+
+	val, ok, err := tbl.Lookup(ctx, key)
+	if err != nil || !ok {
+		return FailAction{}, false, err
+	}
+
+	action, err := ParseActionDirective(strings.Fields(val))
+	if err != nil {
+		return FailAction{}, false, fmt.Errorf("malformed action override for %s: %v", key, err)
+	}
+	return action, true, nil
+}
+
 func ParseRejectDirective(args []string) (*exterrors.SMTPError, error) {
 	code := 554
 	enchCode := exterrors.EnhancedCode{0, 7, 0}
@@ -74,10 +74,10 @@ func initInlineModule(modObj module.Module, globals map[string]interface{}, bloc
 		return err
 	}
 
-	if closer, ok := modObj.(io.Closer); ok {
+	if _, ok := modObj.(io.Closer); ok {
 		hooks.AddHook(hooks.EventShutdown, func() {
 			log.Debugf("close %s (%s)", modObj.Name(), modObj.InstanceName())
-			if err := closer.Close(); err != nil {
+			if err := module.Shutdown(modObj); err != nil {
 				log.Printf("module %s (%s) close failed: %v", modObj.Name(), modObj.InstanceName(), err)
 			}
 		})
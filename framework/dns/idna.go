@@ -19,6 +19,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package dns
 
 import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
 	"golang.org/x/net/idna"
 	"golang.org/x/text/unicode/norm"
 )
@@ -35,3 +39,101 @@ func SelectIDNA(ulabel bool, domain string) (string, error) {
 	}
 	return idna.ToASCII(domain)
 }
+
+// ToASCII converts the domain into the A-label form suitable for DNS queries
+// and comparisons.
+//
+// Non-ASCII domains are processed according to IDNA2008 with UTS #46 mapping
+// (as done by web browsers), so equivalent U-label forms produce the same
+// result. ASCII domains are only converted to lower case, notably
+// underscores are permitted. The trailing dot is preserved.
+//
+// The lower-case domain is also returned on the error.
+func ToASCII(domain string) (string, error) {
+	if isASCII(domain) {
+		return strings.ToLower(domain), nil
+	}
+	aDomain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return strings.ToLower(domain), err
+	}
+	return aDomain, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Combinations of scripts that are commonly used together in a single label,
+// based on the "Highly Restrictive" level of UTS #39.
+var scriptSets = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+func runeScript(ch rune) string {
+	for name, table := range unicode.Scripts {
+		if name == "Common" || name == "Inherited" {
+			continue
+		}
+		if unicode.Is(table, ch) {
+			return name
+		}
+	}
+	return ""
+}
+
+// MixedScript reports whether any label of the domain mixes characters from
+// scripts that are not normally used together, such as Latin and Cyrillic.
+// Such domains are likely to be homographs crafted to look like other
+// domains, e.g. "pаypal.com" with the Cyrillic "а".
+//
+// A-labels are converted to U-labels before the check.
+func MixedScript(domain string) bool {
+	uDomain, err := idna.ToUnicode(domain)
+	if err != nil {
+		uDomain = domain
+	}
+
+	for _, label := range strings.Split(uDomain, ".") {
+		scripts := make(map[string]struct{})
+		for _, ch := range label {
+			if ch < utf8.RuneSelf {
+				if unicode.IsLetter(ch) {
+					scripts["Latin"] = struct{}{}
+				}
+				continue
+			}
+			if script := runeScript(ch); script != "" {
+				scripts[script] = struct{}{}
+			}
+		}
+		if len(scripts) <= 1 {
+			continue
+		}
+
+		allowed := false
+		for _, set := range scriptSets {
+			matched := 0
+			for _, script := range set {
+				if _, ok := scripts[script]; ok {
+					matched++
+				}
+			}
+			if matched == len(scripts) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return true
+		}
+	}
+	return false
+}
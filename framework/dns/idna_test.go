@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"testing"
+)
+
+func TestToASCII(t *testing.T) {
+	test := func(domain, want string, fail bool) {
+		t.Helper()
+
+		got, err := ToASCII(domain)
+		if err != nil && !fail {
+			t.Errorf("%s: unexpected error: %v", domain, err)
+		}
+		if err == nil && fail {
+			t.Errorf("%s: expected error", domain)
+		}
+		if got != want {
+			t.Errorf("%s: want %s, got %s", domain, want, got)
+		}
+	}
+
+	test("example.org", "example.org", false)
+	test("EXAMPLE.org.", "example.org.", false)
+	test("_dmarc.example.org", "_dmarc.example.org", false)
+	test("xn--e1aybc.example.org", "xn--e1aybc.example.org", false)
+	test("ТЕСТ.example.org", "xn--e1aybc.example.org", false)
+	test("тест.example.org.", "xn--e1aybc.example.org.", false)
+	test("ｅxample.org", "example.org", false)
+	test("тест-.example.org", "тест-.example.org", true)
+}
+
+func TestMixedScript(t *testing.T) {
+	test := func(domain string, mixed bool) {
+		t.Helper()
+		if MixedScript(domain) != mixed {
+			t.Errorf("%s: want %v, got %v", domain, mixed, !mixed)
+		}
+	}
+
+	test("example.org", false)
+	test("пример.рф", false)
+	test("пример.org", false)
+	test("xn--e1afmkfd.org", false)
+	test("例え.テスト", false)
+	test("mailテスト.jp", false)
+	test("한국abc.kr", false)
+
+	// Cyrillic 'а' in otherwise Latin label.
+	test("pаypal.com", true)
+	test("xn--pypal-4ve.com", true)
+	test("αβcd.org", true)
+}
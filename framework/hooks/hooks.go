@@ -27,8 +27,8 @@ const (
 	EventShutdown Event = iota
 
 	// EventReload is triggered when the server process receives the SIGUSR2
-	// signal (on POSIX platforms) and indicates the request to reload the
-	// server configuration from persistent storage.
+	// or SIGHUP signal (on POSIX platforms) and indicates the request to
+	// reload the server configuration from persistent storage.
 	//
 	// Since it is by design problematic to reload the modules configuration,
 	// this event only applies to secondary files such as aliases mapping and
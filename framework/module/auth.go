@@ -35,6 +35,16 @@ type PlainAuth interface {
 	AuthPlain(username, password string) error
 }
 
+// PlainAuthz is the optional interface implemented by PlainAuth providers that
+// can check whether the user is allowed to act on behalf of another user
+// (e.g. master users in Dovecot).
+//
+// authzid is the requested authorization identity, username and password
+// are credentials of the user requesting it.
+type PlainAuthz interface {
+	AuthPlainAuthz(authzid, username, password string) error
+}
+
 // PlainUserDB is a local credentials store that can be managed using maddyctl
 // utility.
 type PlainUserDB interface {
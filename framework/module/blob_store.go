@@ -3,6 +3,7 @@ package module
 import (
 	"errors"
 	"io"
+	"time"
 )
 
 type Blob interface {
@@ -13,6 +14,13 @@ type Blob interface {
 
 var ErrNoSuchBlob = errors.New("blob_store: no such object")
 
+// BlobInfo describes the object stored in BlobStore.
+type BlobInfo struct {
+	Key string
+	// Time of the last modification of the object.
+	ModTime time.Time
+}
+
 // BlobStore is the interface used by modules providing large binary object
 // storage.
 type BlobStore interface {
@@ -26,4 +34,11 @@ type BlobStore interface {
 
 	// Delete removes a set of keys from store. Non-existent keys are ignored.
 	Delete(keys []string) error
+
+	// List calls f for each object in the store. Iteration stops if f
+	// returns an error, that error is returned from List.
+	//
+	// Objects created or deleted while List is running may or may not be
+	// reported.
+	List(f func(BlobInfo) error) error
 }
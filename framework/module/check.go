@@ -106,4 +106,16 @@ type CheckResult struct {
 	// Header is the header fields that should be
 	// added to the header after all checks.
 	Header textproto.Header
+
+	// Score is the value added to the message score if scoring is
+	// enabled for the message pipeline. Unlike Reject and Quarantine, it
+	// does not cause any action on its own, thresholds configured for the
+	// pipeline are applied to the sum of all scores.
+	Score int
+
+	// DeferInternally is the flag that specifies that the check failed
+	// temporarily and the message should be accepted and checked again
+	// later. Message pipeline treats it as Reject if internal retries are
+	// not configured.
+	DeferInternally bool
 }
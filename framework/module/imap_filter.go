@@ -38,6 +38,25 @@ type IMAPFilter interface {
 	// them.
 	//
 	// Errors returned by IMAPFilter will be just logged and will not cause delivery
-	// to fail.
+	// to fail unless they are wrapped in IMAPFilterFatal.
 	IMAPFilter(accountName string, meta *MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error)
 }
+
+// IMAPFilterFatal is the error type that can be returned by IMAPFilter to
+// fail the delivery instead of just logging the error. If the delivery
+// is done using PartialDelivery.BodyNonAtomic, it is failed only for the
+// recipient the filter was called for.
+//
+// Err is returned from the delivery as is and should contain the
+// SMTP status information.
+type IMAPFilterFatal struct {
+	Err error
+}
+
+func (f IMAPFilterFatal) Error() string {
+	return f.Err.Error()
+}
+
+func (f IMAPFilterFatal) Unwrap() error {
+	return f.Err
+}
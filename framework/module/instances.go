@@ -92,10 +92,10 @@ func GetInstance(name string) (Module, error) {
 		return mod.mod, err
 	}
 
-	if closer, ok := mod.mod.(io.Closer); ok {
+	if _, ok := mod.mod.(io.Closer); ok {
 		hooks.AddHook(hooks.EventShutdown, func() {
 			log.Debugf("close %s (%s)", mod.mod.Name(), mod.mod.InstanceName())
-			if err := closer.Close(); err != nil {
+			if err := Shutdown(mod.mod); err != nil {
 				log.Printf("module %s (%s) close failed: %v", mod.mod.Name(), mod.mod.InstanceName(), err)
 			}
 		})
@@ -65,6 +65,21 @@ type Module interface {
 	InstanceName() string
 }
 
+// ReloadModule is the optional interface implemented by modules that can
+// apply the changed configuration without being re-created.
+//
+// Reload is called with the new configuration block of the module when the
+// server configuration is reloaded (SIGHUP on POSIX platforms). If Reload
+// returns an error, the module should continue to work using the previous
+// configuration.
+//
+// Reload can be called concurrently with any other module methods.
+type ReloadModule interface {
+	Module
+
+	Reload(*config.Map) error
+}
+
 // FuncNewModule is function that creates new instance of module with specified name.
 //
 // Module.InstanceName() of the returned module object should return instName.
@@ -22,6 +22,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"io"
+	"sync"
 
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/future"
@@ -61,6 +62,15 @@ type ConnState struct {
 	// If the client successfully authenticated using a username/password pair.
 	// This field should be cleaned if the ConnState object is serialized
 	AuthPassword string
+
+	// Cache is the storage for values that are valid for the whole
+	// connection. Modules can use it to reuse results of expensive
+	// operations for multiple messages sent over the same connection.
+	//
+	// Keys should be of module-specific unexported types to avoid
+	// collisions. Cache can be nil if the message source does not
+	// support it.
+	Cache *sync.Map `json:"-"`
 }
 
 // MsgMetadata structure contains all information about the origin of
@@ -99,6 +109,17 @@ type MsgMetadata struct {
 	// the message. It is set only by the message pipeline.
 	Quarantine bool
 
+	// UpstreamAuth is set by the message pipeline if the message is
+	// received from the trusted relay that verifies message authenticity on
+	// its own. Authentication results are taken from the
+	// Authentication-Results header added by the relay and checks
+	// verifying the same things (e.g. SPF, DKIM) should skip verification.
+	UpstreamAuth bool
+
+	// Allowlisted is set by the message pipeline if the message matches
+	// the pipeline allowlist. Checks are not executed for such messages.
+	Allowlisted bool
+
 	// OriginalRcpts contains the mapping from the final recipient to the
 	// recipient that was presented by the client.
 	//
@@ -129,6 +150,21 @@ type MsgMetadata struct {
 	// header. It is only meaningful if server has seen the body at least once
 	// (e.g. the message was passed via queue).
 	TLSRequireOverride bool
+
+	// CheckRetry is set by the message pipeline if the message was accepted
+	// with some checks deferred using the 'defer_internally' action and is
+	// passed to the target that will retry them.
+	CheckRetry bool
+
+	// DeliveryAttempt is the number of the current delivery attempt, starting
+	// at 1. It is set by the queue module for each attempt and is zero if the
+	// message is not delivered from the queue.
+	DeliveryAttempt int
+
+	// Priority is the delivery priority of the message, messages with
+	// higher values are delivered first by the queue. It is set by
+	// modify.priority and is zero by default.
+	Priority int `json:",omitempty"`
 }
 
 // DeepCopy creates a copy of the MsgMetadata structure, also
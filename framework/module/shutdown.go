@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// GracefulCloser is implemented by modules that can complete in-flight
+// operations before being closed.
+type GracefulCloser interface {
+	io.Closer
+
+	// Shutdown stops accepting new work and waits for in-flight operations
+	// to complete.
+	//
+	// Once ctx is done, remaining operations should be aborted and Shutdown
+	// should return as soon as possible, leaving persistent state consistent.
+	Shutdown(ctx context.Context) error
+}
+
+var (
+	shutdownCtx = context.Background()
+	shutdownLck sync.Mutex
+)
+
+// BeginShutdown starts the grace period used by Shutdown. Returned function
+// should be called once all modules are closed to release resources.
+func BeginShutdown(grace time.Duration) context.CancelFunc {
+	shutdownLck.Lock()
+	defer shutdownLck.Unlock()
+
+	var cancel context.CancelFunc
+	shutdownCtx, cancel = context.WithTimeout(context.Background(), grace)
+	return cancel
+}
+
+// Shutdown closes the module, giving it a chance to complete in-flight
+// operations within the grace period if it implements GracefulCloser.
+//
+// Module should implement io.Closer, otherwise Shutdown is no-op.
+func Shutdown(mod Module) error {
+	shutdownLck.Lock()
+	ctx := shutdownCtx
+	shutdownLck.Unlock()
+
+	switch mod := mod.(type) {
+	case GracefulCloser:
+		return mod.Shutdown(ctx)
+	case io.Closer:
+		return mod.Close()
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// SpamLearner is the interface implemented by spam classifiers that can be
+// trained using messages classified by users.
+//
+// Storage modules use it to train the classifier when messages are moved to
+// or from the spam folder.
+type SpamLearner interface {
+	// Learn trains the classifier using the message. If spam is false, the
+	// message should be learned as non-spam (ham).
+	Learn(ctx context.Context, hdr textproto.Header, body io.Reader, spam bool) error
+}
@@ -0,0 +1,237 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package netset implements sets of IP networks that can be defined
+// globally and referenced by name from module configuration blocks.
+//
+// Named sets are defined at the top level of the configuration:
+//
+//	networks internal 10.0.0.0/8 192.168.0.0/16
+//	trusted_networks 127.0.0.1 ::1 &internal
+//
+// And referenced in directives parsed using Directive:
+//
+//	ip &trusted_networks 203.0.113.1
+package netset
+
+import (
+	"net"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// globalPrefix is used for names of global configuration values containing
+// named sets.
+const globalPrefix = "networks:"
+
+// Set is a set of IP networks.
+//
+// Zero value is an empty set that contains no addresses.
+type Set struct {
+	nets []net.IPNet
+}
+
+// Parse creates the Set from the list of IP addresses and CIDR networks.
+func Parse(entries []string) (*Set, error) {
+	s := &Set{nets: make([]net.IPNet, 0, len(entries))}
+	for _, e := range entries {
+		n, err := parseNetwork(e)
+		if err != nil {
+			return nil, err
+		}
+		s.nets = append(s.nets, n)
+	}
+	return s, nil
+}
+
+// Networks creates the Set from the list of networks.
+func Networks(nets ...net.IPNet) *Set {
+	return &Set{nets: nets}
+}
+
+func parseNetwork(entry string) (net.IPNet, error) {
+	// Plain IP address.
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return net.IPNet{}, &net.ParseError{Type: "IP address", Text: entry}
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	return *ipNet, nil
+}
+
+// Len returns the amount of networks in the set.
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.nets)
+}
+
+// Contains reports whether ip belongs to any network in the set.
+func (s *Set) Contains(ip net.IP) bool {
+	if s == nil || ip == nil {
+		return false
+	}
+	for _, n := range s.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr reports whether the IP address of addr belongs to any network
+// in the set. Only *net.TCPAddr and *net.UDPAddr are supported, false is
+// returned for other address types.
+func (s *Set) ContainsAddr(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return s.Contains(addr.IP)
+	case *net.UDPAddr:
+		return s.Contains(addr.IP)
+	default:
+		return false
+	}
+}
+
+// Union returns the set containing networks from both sets. Either set can
+// be nil.
+func (s *Set) Union(other *Set) *Set {
+	res := &Set{nets: make([]net.IPNet, 0, s.Len()+other.Len())}
+	if s != nil {
+		res.nets = append(res.nets, s.nets...)
+	}
+	if other != nil {
+		res.nets = append(res.nets, other.nets...)
+	}
+	return res
+}
+
+func lookup(m *config.Map, name string) (*Set, bool) {
+	// Sets defined in the same block take precedence, this allows global
+	// definitions to reference each other.
+	if s, ok := m.Values[globalPrefix+name].(*Set); ok {
+		return s, true
+	}
+	if s, ok := m.Globals[globalPrefix+name].(*Set); ok {
+		return s, true
+	}
+	return nil, false
+}
+
+func parseArgs(m *config.Map, node config.Node, args []string) (*Set, error) {
+	s := &Set{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "&") {
+			ref, ok := lookup(m, arg[1:])
+			if !ok {
+				return nil, config.NodeErr(node, "unknown network set: %s", arg[1:])
+			}
+			s.nets = append(s.nets, ref.nets...)
+			continue
+		}
+
+		n, err := parseNetwork(arg)
+		if err != nil {
+			return nil, config.NodeErr(node, "malformed network: %v", err)
+		}
+		s.nets = append(s.nets, n)
+	}
+	return s, nil
+}
+
+// Directive is a config.Map.Custom mapper for the list of networks.
+//
+// Arguments are IP addresses, CIDR networks or references to named sets in
+// the form &name. &trusted_networks refers to the global trusted_networks
+// directive.
+func Directive(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Children) != 0 {
+		return nil, config.NodeErr(node, "no child nodes allowed")
+	}
+	return ParseNode(m, node)
+}
+
+// ParseNode creates the Set from arguments of the configuration node, using
+// the same syntax as Directive. Child nodes are not checked and can be used
+// by the caller.
+func ParseNode(m *config.Map, node config.Node) (*Set, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one network is required")
+	}
+	return parseArgs(m, node, node.Args)
+}
+
+// GlobalDirectives adds the 'networks' and 'trusted_networks' directives to
+// the global configuration map.
+//
+// 'networks name entries...' defines a named set. 'trusted_networks
+// entries...' defines the set that is inherited by directives that are
+// registered as
+//
+//	cfg.Custom("trusted_networks", true, false, nil, netset.Directive, &set)
+//
+// and can be referenced as &trusted_networks.
+func GlobalDirectives(m *config.Map) {
+	m.Callback("networks", func(m *config.Map, node config.Node) error {
+		if len(node.Children) != 0 {
+			return config.NodeErr(node, "no child nodes allowed")
+		}
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "expected at least 2 arguments")
+		}
+		name := node.Args[0]
+		if name == "trusted_networks" {
+			return config.NodeErr(node, "use trusted_networks directive to define trusted_networks")
+		}
+		if _, ok := m.Values[globalPrefix+name]; ok {
+			return config.NodeErr(node, "duplicate network set: %s", name)
+		}
+		s, err := parseArgs(m, node, node.Args[1:])
+		if err != nil {
+			return err
+		}
+		m.Values[globalPrefix+name] = s
+		return nil
+	})
+	m.Callback("trusted_networks", func(m *config.Map, node config.Node) error {
+		if _, ok := m.Values["trusted_networks"]; ok {
+			return config.NodeErr(node, "duplicate directive: trusted_networks")
+		}
+		s, err := Directive(m, node)
+		if err != nil {
+			return err
+		}
+		m.Values["trusted_networks"] = s
+		m.Values[globalPrefix+"trusted_networks"] = s
+		return nil
+	})
+}
@@ -0,0 +1,133 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package netset
+
+import (
+	"net"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip       string
+		contains bool
+	}{
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::1", true},
+	} {
+		if got := s.Contains(net.ParseIP(c.ip)); got != c.contains {
+			t.Errorf("Contains(%s) = %v, want %v", c.ip, got, c.contains)
+		}
+	}
+
+	if !s.ContainsAddr(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 25}) {
+		t.Error("ContainsAddr should match TCP address")
+	}
+	if s.ContainsAddr(&net.UnixAddr{Name: "/run/maddy.sock", Net: "unix"}) {
+		t.Error("ContainsAddr should not match Unix address")
+	}
+
+	if _, err := Parse([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected an error for malformed CIDR")
+	}
+	if _, err := Parse([]string{"not-an-ip"}); err == nil {
+		t.Error("Expected an error for malformed IP")
+	}
+}
+
+func TestNilSet(t *testing.T) {
+	var s *Set
+	if s.Contains(net.ParseIP("127.0.0.1")) {
+		t.Error("nil set should contain nothing")
+	}
+	if s.Len() != 0 {
+		t.Error("nil set should be empty")
+	}
+}
+
+func readGlobals(t *testing.T, children []config.Node) map[string]interface{} {
+	t.Helper()
+	m := config.NewMap(nil, config.Node{Children: children})
+	GlobalDirectives(m)
+	if _, err := m.Process(); err != nil {
+		t.Fatal(err)
+	}
+	return m.Values
+}
+
+func TestDirective_References(t *testing.T) {
+	globals := readGlobals(t, []config.Node{
+		{Name: "networks", Args: []string{"internal", "10.0.0.0/8"}},
+		{Name: "trusted_networks", Args: []string{"127.0.0.1", "&internal"}},
+	})
+
+	var trusted, ip *Set
+	m := config.NewMap(globals, config.Node{Children: []config.Node{
+		{Name: "ip", Args: []string{"&trusted_networks", "192.0.2.1"}},
+	}})
+	m.Custom("trusted_networks", true, true, nil, Directive, &trusted)
+	m.Custom("ip", false, true, nil, Directive, &ip)
+	if _, err := m.Process(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !trusted.Contains(net.ParseIP("10.1.1.1")) || !trusted.Contains(net.ParseIP("127.0.0.1")) {
+		t.Error("trusted_networks should be inherited from globals")
+	}
+	if trusted.Contains(net.ParseIP("192.0.2.1")) {
+		t.Error("trusted_networks should not be affected by other directives")
+	}
+	for _, addr := range []string{"10.1.1.1", "127.0.0.1", "192.0.2.1"} {
+		if !ip.Contains(net.ParseIP(addr)) {
+			t.Errorf("ip should contain %s", addr)
+		}
+	}
+}
+
+func TestDirective_UnknownReference(t *testing.T) {
+	m := config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "ip", Args: []string{"&missing"}},
+	}})
+	m.Custom("ip", false, true, nil, Directive, nil)
+	if _, err := m.Process(); err == nil {
+		t.Fatal("Expected an error for unknown network set")
+	}
+}
+
+func TestGlobalDirectives_Duplicate(t *testing.T) {
+	m := config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "networks", Args: []string{"internal", "10.0.0.0/8"}},
+		{Name: "networks", Args: []string{"internal", "192.168.0.0/16"}},
+	}})
+	GlobalDirectives(m)
+	if _, err := m.Process(); err == nil {
+		t.Fatal("Expected an error for duplicate network set")
+	}
+}
@@ -158,6 +158,24 @@ func (a *Auth) AuthPlain(username, password string) error {
 	return auth.ErrUnsupportedMech
 }
 
+// AuthPlainAuthz passes the authorization identity to the Dovecot server,
+// letting it check whether username is a master user allowed to log in
+// as authzid.
+func (a *Auth) AuthPlainAuthz(authzid, username, password string) error {
+	if _, ok := a.mechanisms[sasl.Plain]; !ok {
+		return auth.ErrUnsupportedMech
+	}
+
+	cl, err := a.getConn()
+	if err != nil {
+		return exterrors.WithTemporary(err, true)
+	}
+	defer a.returnConn(cl)
+
+	return cl.Do("SMTP", sasl.NewPlainClient(authzid, username, password),
+		dovecotsasl.Secured, dovecotsasl.NoPenalty)
+}
+
 func init() {
 	module.Register(modName, New)
 }
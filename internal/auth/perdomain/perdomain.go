@@ -0,0 +1,242 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package perdomain implements auth.per_domain module that dispatches
+// authentication requests to different providers based on the domain part
+// of the username.
+//
+// Interfaces implemented:
+// - module.PlainAuth
+// - module.PlainAuthz
+// - module.PlainUserDB
+package perdomain
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "auth.per_domain"
+
+type Auth struct {
+	instName string
+	log      log.Logger
+
+	// All unique providers in the configuration order.
+	providers []module.PlainAuth
+	domains   map[string]module.PlainAuth
+	fallback  module.PlainAuth
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Auth{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		domains:  map[string]module.PlainAuth{},
+	}, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.Callback("domain", func(m *config.Map, node config.Node) error {
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "at least one domain and the provider reference are required")
+		}
+		p, err := a.providerFromNode(m, node, node.Args[len(node.Args)-1])
+		if err != nil {
+			return err
+		}
+		for _, domain := range node.Args[:len(node.Args)-1] {
+			domain, err := dns.ForLookup(domain)
+			if err != nil {
+				return config.NodeErr(node, "invalid domain: %v", err)
+			}
+			if _, ok := a.domains[domain]; ok {
+				return config.NodeErr(node, "duplicate domain: %s", domain)
+			}
+			a.domains[domain] = p
+		}
+		return nil
+	})
+	cfg.Callback("default", func(m *config.Map, node config.Node) error {
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "exactly one argument is required")
+		}
+		if a.fallback != nil {
+			return config.NodeErr(node, "default provider is already set")
+		}
+		p, err := a.providerFromNode(m, node, node.Args[0])
+		if err != nil {
+			return err
+		}
+		a.fallback = p
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(a.providers) == 0 {
+		return fmt.Errorf("%s: at least one auth. provider is required", modName)
+	}
+	return nil
+}
+
+func (a *Auth) providerFromNode(m *config.Map, node config.Node, ref string) (module.PlainAuth, error) {
+	if !strings.HasPrefix(ref, "&") {
+		return nil, config.NodeErr(node, "auth. provider should be referenced using &name syntax")
+	}
+
+	var p module.PlainAuth
+	if err := modconfig.ModuleFromNode("auth", []string{ref}, node, m.Globals, &p); err != nil {
+		return nil, err
+	}
+
+	for _, existing := range a.providers {
+		if existing == p {
+			return p, nil
+		}
+	}
+	a.providers = append(a.providers, p)
+	return p, nil
+}
+
+// providerFor returns the auth. provider responsible for the username.
+//
+// Usernames without the domain part are handled by the default provider.
+func (a *Auth) providerFor(username string) (module.PlainAuth, error) {
+	if strings.IndexByte(username, '@') != -1 {
+		_, domain, err := address.Split(username)
+		if err != nil {
+			return nil, err
+		}
+		domain, err = dns.ForLookup(domain)
+		if err != nil {
+			return nil, err
+		}
+		if p, ok := a.domains[domain]; ok {
+			return p, nil
+		}
+	}
+	if a.fallback != nil {
+		return a.fallback, nil
+	}
+	return nil, module.ErrUnknownCredentials
+}
+
+func (a *Auth) AuthPlain(username, password string) error {
+	p, err := a.providerFor(username)
+	if err != nil {
+		a.log.DebugMsg("no provider for username", "username", username, "reason", err)
+		return module.ErrUnknownCredentials
+	}
+	return p.AuthPlain(username, password)
+}
+
+func (a *Auth) AuthPlainAuthz(authzid, username, password string) error {
+	p, err := a.providerFor(username)
+	if err != nil {
+		a.log.DebugMsg("no provider for username", "username", username, "reason", err)
+		return module.ErrUnknownCredentials
+	}
+	authz, ok := p.(module.PlainAuthz)
+	if !ok {
+		return fmt.Errorf("%s: provider %T does not support authorization identities", modName, p)
+	}
+	return authz.AuthPlainAuthz(authzid, username, password)
+}
+
+func (a *Auth) ListUsers() ([]string, error) {
+	var users []string
+	for _, p := range a.providers {
+		db, ok := p.(module.PlainUserDB)
+		if !ok {
+			return nil, fmt.Errorf("%s: provider %T does not support users listing", modName, p)
+		}
+		list, err := db.ListUsers()
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range list {
+			// Users of other domains can exist in the provider database,
+			// but they are not accessible via this module.
+			if owner, err := a.providerFor(user); err != nil || owner != p {
+				continue
+			}
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (a *Auth) userDBFor(username string) (module.PlainUserDB, error) {
+	p, err := a.providerFor(username)
+	if err != nil {
+		return nil, err
+	}
+	db, ok := p.(module.PlainUserDB)
+	if !ok {
+		return nil, fmt.Errorf("%s: provider %T does not support users management", modName, p)
+	}
+	return db, nil
+}
+
+func (a *Auth) CreateUser(username, password string) error {
+	db, err := a.userDBFor(username)
+	if err != nil {
+		return err
+	}
+	return db.CreateUser(username, password)
+}
+
+func (a *Auth) SetUserPassword(username, password string) error {
+	db, err := a.userDBFor(username)
+	if err != nil {
+		return err
+	}
+	return db.SetUserPassword(username, password)
+}
+
+func (a *Auth) DeleteUser(username string) error {
+	db, err := a.userDBFor(username)
+	if err != nil {
+		return err
+	}
+	return db.DeleteUser(username)
+}
+
+func init() {
+	module.Register(modName, New)
+}
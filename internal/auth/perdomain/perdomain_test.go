@@ -0,0 +1,66 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package perdomain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type mockAuth struct {
+	db map[string]string
+}
+
+func (m mockAuth) AuthPlain(username, password string) error {
+	if pass, ok := m.db[username]; !ok || pass != password {
+		return errors.New("invalid creds")
+	}
+	return nil
+}
+
+func TestAuth_AuthPlain(t *testing.T) {
+	a1 := mockAuth{db: map[string]string{"user@example.org": "1", "user@example.com": "1"}}
+	a2 := mockAuth{db: map[string]string{"user@example.com": "2", "user": "2"}}
+	a := &Auth{
+		providers: []module.PlainAuth{a1, a2},
+		domains: map[string]module.PlainAuth{
+			"example.org": a1,
+			"example.com": a2,
+		},
+	}
+
+	if err := a.AuthPlain("user@example.org", "1"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := a.AuthPlain("user@example.com", "1"); err == nil {
+		t.Fatal("wrong provider used for example.com")
+	}
+	if err := a.AuthPlain("user@example.com", "2"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := a.AuthPlain("user", "2"); err != module.ErrUnknownCredentials {
+		t.Fatal("unexpected error for username without domain:", err)
+	}
+
+	a.fallback = a2
+	if err := a.AuthPlain("user", "2"); err != nil {
+		t.Fatal("default provider is not used:", err)
+	}
+}
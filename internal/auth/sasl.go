@@ -22,10 +22,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 )
@@ -33,6 +36,7 @@ import (
 var (
 	ErrUnsupportedMech = errors.New("Unsupported SASL mechanism")
 	ErrInvalidAuthCred = errors.New("auth: invalid credentials")
+	ErrAuthzDenied     = errors.New("auth: not allowed to use the authorization identity")
 )
 
 // SASLAuth is a wrapper that initializes sasl.Server using authenticators that
@@ -45,9 +49,21 @@ type SASLAuth struct {
 	OnlyFirstID bool
 
 	Plain []module.PlainAuth
+
+	// MasterUsers maps authentication identities of master users to
+	// the list of authorization identities they are allowed to use.
+	//
+	// Each entry is either the exact identity, "*@domain" for all identities
+	// in the domain or "*" for any identity.
+	MasterUsers map[string][]string
+
+	// EnabledMechs restricts the set of mechanisms that are advertised and
+	// accepted. All mechanisms supported by auth. providers are enabled if it
+	// is empty.
+	EnabledMechs []string
 }
 
-func (s *SASLAuth) SASLMechanisms() []string {
+func (s *SASLAuth) supportedMechanisms() []string {
 	var mechs []string
 
 	if len(s.Plain) != 0 {
@@ -57,6 +73,55 @@ func (s *SASLAuth) SASLMechanisms() []string {
 	return mechs
 }
 
+func (s *SASLAuth) SASLMechanisms() []string {
+	supported := s.supportedMechanisms()
+	if len(s.EnabledMechs) == 0 {
+		return supported
+	}
+
+	mechs := make([]string, 0, len(supported))
+	for _, mech := range supported {
+		if s.MechEnabled(mech) {
+			mechs = append(mechs, mech)
+		}
+	}
+	return mechs
+}
+
+// MechEnabled reports whether the mechanism is allowed by EnabledMechs.
+//
+// It does not check whether the mechanism is supported by any auth. provider.
+func (s *SASLAuth) MechEnabled(mech string) bool {
+	if len(s.EnabledMechs) == 0 {
+		return true
+	}
+	for _, enabled := range s.EnabledMechs {
+		if strings.EqualFold(enabled, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckMechanisms verifies that all mechanisms listed in EnabledMechs are
+// supported by configured auth. providers.
+func (s *SASLAuth) CheckMechanisms() error {
+	supported := s.supportedMechanisms()
+	for _, enabled := range s.EnabledMechs {
+		found := false
+		for _, mech := range supported {
+			if strings.EqualFold(enabled, mech) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("sasl_mechanisms: mechanism %s is not supported by any auth. provider", enabled)
+		}
+	}
+	return nil
+}
+
 func (s *SASLAuth) AuthPlain(username, password string) error {
 	if len(s.Plain) == 0 {
 		return ErrUnsupportedMech
@@ -73,8 +138,62 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 	return fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
 }
 
+// AuthPlainAs checks the credentials and verifies whether the user is allowed
+// to act on behalf of authzid.
+//
+// The permission is granted either by the MasterUsers list or by any
+// provider implementing module.PlainAuthz.
+func (s *SASLAuth) AuthPlainAs(authzid, username, password string) error {
+	if authzid == "" || address.Equal(authzid, username) {
+		return s.AuthPlain(username, password)
+	}
+
+	if s.isMasterFor(username, authzid) {
+		return s.AuthPlain(username, password)
+	}
+
+	lastErr := ErrAuthzDenied
+	for _, p := range s.Plain {
+		authz, ok := p.(module.PlainAuthz)
+		if !ok {
+			continue
+		}
+		lastErr = authz.AuthPlainAuthz(authzid, username, password)
+		if lastErr == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no auth. provider accepted authzid, last err: %w", lastErr)
+}
+
+func (s *SASLAuth) isMasterFor(username, authzid string) bool {
+	username, _ = address.ForLookup(username)
+	authzid, _ = address.ForLookup(authzid)
+
+	for _, pattern := range s.MasterUsers[username] {
+		switch {
+		case pattern == "*":
+			return true
+		case strings.HasPrefix(pattern, "*@"):
+			_, domain, err := address.Split(authzid)
+			if err == nil && domain == pattern[2:] {
+				return true
+			}
+		case pattern == authzid:
+			return true
+		}
+	}
+	return false
+}
+
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
 func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(identity string) error) sasl.Server {
+	if !s.MechEnabled(mech) {
+		s.Log.Msg("attempt to use disabled SASL mechanism", "mech", mech, "src_ip", remoteAddr)
+		return FailingSASLServ{Err: ErrUnsupportedMech}
+	}
+
 	switch mech {
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
@@ -82,11 +201,14 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				identity = username
 			}
 
-			err := s.AuthPlain(username, password)
+			err := s.AuthPlainAs(identity, username, password)
 			if err != nil {
-				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				s.Log.Error("authentication failed", err, "username", username, "authzid", identity, "src_ip", remoteAddr)
 				return ErrInvalidAuthCred
 			}
+			if identity != username {
+				s.Log.Msg("master user login", "username", username, "authzid", identity, "src_ip", remoteAddr)
+			}
 
 			return successCb(identity)
 		})
@@ -124,6 +246,55 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 	return nil
 }
 
+// AddMasterUsers adds master users to its mapping by parsing the
+// 'master_users' configuration directive.
+//
+// Each child node defines a master user and the list of authorization
+// identities it can use:
+//
+//	master_users {
+//	    admin@example.org *
+//	    support@example.org *@example.org user@example.com
+//	}
+func (s *SASLAuth) AddMasterUsers(_ *config.Map, node config.Node) error {
+	if len(node.Args) != 0 {
+		return config.NodeErr(node, "unexpected arguments")
+	}
+
+	if s.MasterUsers == nil {
+		s.MasterUsers = make(map[string][]string, len(node.Children))
+	}
+	for _, child := range node.Children {
+		if len(child.Args) == 0 {
+			return config.NodeErr(child, "at least one allowed authorization identity is required")
+		}
+		master, err := address.ForLookup(child.Name)
+		if err != nil {
+			return config.NodeErr(child, "invalid master user name: %v", err)
+		}
+
+		for _, arg := range child.Args {
+			pattern := arg
+			switch {
+			case pattern == "*":
+			case strings.HasPrefix(pattern, "*@"):
+				domain, err := dns.ForLookup(pattern[2:])
+				if err != nil {
+					return config.NodeErr(child, "invalid domain: %v", err)
+				}
+				pattern = "*@" + domain
+			default:
+				pattern, err = address.ForLookup(pattern)
+				if err != nil {
+					return config.NodeErr(child, "invalid authorization identity: %v", err)
+				}
+			}
+			s.MasterUsers[master] = append(s.MasterUsers[master], pattern)
+		}
+	}
+	return nil
+}
+
 type FailingSASLServ struct{ Err error }
 
 func (s FailingSASLServ) Next([]byte) ([]byte, bool, error) {
@@ -23,6 +23,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -75,15 +76,102 @@ func TestCreateSASL(t *testing.T) {
 
 	t.Run("PLAIN with authorization identity", func(t *testing.T) {
 		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
-			if id != "user1a" {
-				t.Fatal("Wrong authorization identity passed:", id)
-			}
+			t.Fatal("Unexpected authorization identity accepted:", id)
 			return nil
 		})
 
 		_, _, err := srv.Next([]byte("user1a\x00user1\x00aa"))
-		if err != nil {
-			t.Error("Unexpected error:", err)
+		if err == nil {
+			t.Error("No error for authorization identity not allowed by config")
+		}
+	})
+}
+
+func TestCreateSASL_MasterUsers(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"admin@example.org":   true,
+					"support@example.org": true,
+				},
+			},
+		},
+	}
+	err := a.AddMasterUsers(nil, config.Node{
+		Name: "master_users",
+		Children: []config.Node{
+			{Name: "admin@example.org", Args: []string{"*"}},
+			{Name: "Support@example.org", Args: []string{"*@Example.org", "user@example.com"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := func(authzid, username string, ok bool) {
+		t.Helper()
+
+		var gotID string
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
+			gotID = id
+			return nil
+		})
+		_, _, err := srv.Next([]byte(authzid + "\x00" + username + "\x00aa"))
+		if ok {
+			if err != nil {
+				t.Errorf("%s as %s: unexpected error: %v", username, authzid, err)
+			}
+			if gotID != authzid {
+				t.Errorf("%s as %s: wrong identity passed to callback: %v", username, authzid, gotID)
+			}
+		} else if err == nil {
+			t.Errorf("%s as %s: no error", username, authzid)
 		}
+	}
+
+	test("user@example.org", "admin@example.org", true)
+	test("user@example.com", "admin@example.org", true)
+	test("user@example.org", "support@example.org", true)
+	test("USER@example.com", "support@example.org", true)
+	test("other@example.com", "support@example.org", false)
+	test("admin@example.org", "support@example.org", true)
+	test("user@example.org", "user1@example.org", false)
+}
+
+func TestCreateSASL_EnabledMechs(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1": true,
+				},
+			},
+		},
+		EnabledMechs: []string{"login"},
+	}
+	if err := a.CheckMechanisms(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	mechs := a.SASLMechanisms()
+	if len(mechs) != 1 || mechs[0] != "LOGIN" {
+		t.Fatal("Wrong list of mechanisms:", mechs)
+	}
+
+	srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
+		t.Fatal("Disabled mechanism passed identity to callback:", id)
+		return nil
 	})
+	_, _, err := srv.Next([]byte("\x00user1\x00aa"))
+	if err == nil {
+		t.Error("No error for disabled mechanism")
+	}
+
+	a.EnabledMechs = []string{"XWHATEVER"}
+	if err := a.CheckMechanisms(); err == nil {
+		t.Error("No error for unsupported mechanism")
+	}
 }
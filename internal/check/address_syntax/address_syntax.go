@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package address_syntax implements a check that rejects messages with
+// envelope addresses violating RFC 5321 grammar.
+//
+// Addresses are parsed leniently elsewhere in maddy to interoperate with
+// broken clients. This check can be used to reject such addresses on the
+// public MX where they are mostly used by spam.
+package address_syntax
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.address_syntax"
+
+const (
+	levelStandard = "standard"
+	levelStrict   = "strict"
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	level             string
+	checkSender       bool
+	checkRcpt         bool
+	rejectMixedScript bool
+	failAction        modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Enum("level", false, false, []string{levelStandard, levelStrict}, levelStandard, &c.level)
+	cfg.Bool("check_sender", false, true, &c.checkSender)
+	cfg.Bool("check_rcpt", false, true, &c.checkRcpt)
+	cfg.Bool("reject_mixed_script", false, false, &c.rejectMixedScript)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	_, err := cfg.Process()
+	return err
+}
+
+func (c *Check) validate(msgMeta *module.MsgMetadata, addr string) error {
+	err := address.ValidateStrict(addr, address.StrictOptions{
+		AllowQuoted:  c.level == levelStandard,
+		AllowLiteral: c.level == levelStandard,
+		AllowUTF8:    msgMeta.SMTPOpts.UTF8,
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.rejectMixedScript {
+		_, domain, _ := address.Split(addr)
+		if dns.MixedScript(domain) {
+			return errors.New("address: mixed-script domain")
+		}
+	}
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	// Null return-path.
+	if !s.c.checkSender || addr == "" {
+		return module.CheckResult{}
+	}
+
+	if err := s.c.validate(s.msgMeta, addr); err != nil {
+		return s.c.failAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         553,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 7},
+				Message:      "Malformed sender address",
+				CheckName:    modName,
+				Err:          err,
+				Misc: map[string]interface{}{
+					"addr": addr,
+				},
+			},
+		})
+	}
+	s.log.DebugMsg("sender ok", "addr", addr)
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	if !s.c.checkRcpt {
+		return module.CheckResult{}
+	}
+
+	if err := s.c.validate(s.msgMeta, addr); err != nil {
+		return s.c.failAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         553,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 3},
+				Message:      "Malformed recipient address",
+				CheckName:    modName,
+				Err:          err,
+				Misc: map[string]interface{}{
+					"addr": addr,
+				},
+			},
+		})
+	}
+	s.log.DebugMsg("recipient ok", "addr", addr)
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,81 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address_syntax
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestAddressSyntax(t *testing.T) {
+	test := func(cfg []config.Node, sender, rcpt string, utf8, failSender, failRcpt bool) {
+		t.Helper()
+
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := mod.(*Check)
+		c.log = testutils.Logger(t, modName)
+		if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			ID:       "test",
+			SMTPOpts: smtp.MailOptions{UTF8: utf8},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckSender(context.Background(), sender)
+		if failSender != (res.Reason != nil) {
+			t.Errorf("%q: unexpected sender check result: %v", sender, res.Reason)
+		}
+		res = s.CheckRcpt(context.Background(), rcpt)
+		if failRcpt != (res.Reason != nil) {
+			t.Errorf("%q: unexpected recipient check result: %v", rcpt, res.Reason)
+		}
+	}
+	strict := []config.Node{{Name: "level", Args: []string{"strict"}}}
+	noSender := []config.Node{{Name: "check_sender", Args: []string{"no"}}}
+
+	test(nil, "", "rcpt@example.org", false, false, false)
+	test(nil, "sender@example.org", "postmaster", false, false, false)
+	test(nil, "sen..der@example.org", "rcpt@example.org", false, true, false)
+	test(nil, "sender@example.org", "rcpt.@example.org", false, false, true)
+	test(noSender, "sen..der@example.org", "rcpt@example.org", false, false, false)
+
+	test(nil, `"sen der"@example.org`, "rcpt@[192.0.2.1]", false, false, false)
+	test(strict, `"sen der"@example.org`, "rcpt@[192.0.2.1]", false, true, true)
+
+	mixed := []config.Node{{Name: "reject_mixed_script", Args: []string{"yes"}}}
+	test(nil, "sender@pаypal.com", "rcpt@example.org", true, false, false)
+	test(mixed, "sender@pаypal.com", "rcpt@example.org", true, true, false)
+	test(mixed, "sender@xn--pypal-4ve.com", "rcpt@example.org", false, true, false)
+	test(mixed, "sender@пример.рф", "rcpt@example.org", true, false, false)
+
+	test(nil, "sender@example.org", "тест@example.org", false, false, true)
+	test(nil, "sender@example.org", "тест@example.org", true, false, false)
+}
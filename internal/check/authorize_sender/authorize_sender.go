@@ -22,8 +22,10 @@ import (
 	"context"
 	"fmt"
 	"net/mail"
+	"strings"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -41,9 +43,10 @@ type Check struct {
 	instName string
 	log      log.Logger
 
-	checkHeader  bool
-	emailPrepare module.Table
-	userToEmail  module.Table
+	checkHeader    bool
+	allowOwnDomain bool
+	emailPrepare   module.Table
+	userToEmail    module.Table
 
 	unauthAction  modconfig.FailAction
 	noMatchAction modconfig.FailAction
@@ -71,6 +74,7 @@ func (c *Check) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &c.log.Debug)
 
 	cfg.Bool("check_header", false, true, &c.checkHeader)
+	cfg.Bool("allow_own_domain", false, false, &c.allowOwnDomain)
 
 	cfg.Custom("prepare_email", false, false, func() (interface{}, error) {
 		return &table.Identity{}, nil
@@ -180,6 +184,9 @@ func (s *state) authzSender(ctx context.Context, authName, email string) module.
 	}
 
 	ok, err = authz.AuthorizeEmailUse(ctx, authNameNorm, preparedEmail, s.c.userToEmail)
+	if err == nil && !ok && s.c.allowOwnDomain {
+		ok = sameDomain(authNameNorm, preparedEmail)
+	}
 	if err != nil {
 		return s.c.errAction.Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
@@ -203,6 +210,20 @@ func (s *state) authzSender(ctx context.Context, authName, email string) module.
 	return module.CheckResult{}
 }
 
+// sameDomain reports whether the authorization username is an email address
+// within the same domain as the sender address.
+func sameDomain(authName, email string) bool {
+	_, authDomain, err := address.Split(authName)
+	if err != nil || authDomain == "" {
+		return false
+	}
+	_, domain, err := address.Split(email)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(authDomain, domain)
+}
+
 func (s *state) CheckConnection(_ context.Context) module.CheckResult {
 	return module.CheckResult{}
 }
@@ -0,0 +1,79 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package authorize_sender
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestAuthorizeSender_OwnDomain(t *testing.T) {
+	test := func(allowOwnDomain bool, authUser, from string, fail bool) {
+		t.Helper()
+
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := mod.(*Check)
+		allow := "no"
+		if allowOwnDomain {
+			allow = "yes"
+		}
+		if err := c.Init(config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "allow_own_domain", Args: []string{allow}},
+			},
+		})); err != nil {
+			t.Fatal(err)
+		}
+		c.log = testutils.Logger(t, modName)
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			ID:   "test",
+			Conn: &module.ConnState{AuthUser: authUser},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := s.CheckSender(context.Background(), from)
+		if res.Reason == nil {
+			hdr, body := testutils.BodyFromStr(t, "From: <"+from+">\r\n\r\nHello!\r\n")
+			res = s.CheckBody(context.Background(), hdr, body)
+		}
+		if fail && res.Reason == nil {
+			t.Error("Expected check to fail")
+		}
+		if !fail && res.Reason != nil {
+			t.Error("Unexpected failure:", res.Reason)
+		}
+	}
+
+	test(false, "alice@example.org", "alice@example.org", false)
+	test(false, "alice@example.org", "bob@example.org", true)
+	test(true, "alice@example.org", "bob@example.org", false)
+	test(true, "alice@example.org", "bob@EXAMPLE.ORG", false)
+	test(true, "alice@example.org", "bob@example.com", true)
+	test(true, "alice", "bob@example.org", true)
+}
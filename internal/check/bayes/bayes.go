@@ -0,0 +1,244 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package bayes implements a statistical spam classifier check.
+//
+// Messages are split into tokens and scored using the token database
+// trained on previously seen spam and ham messages. Scoring uses the
+// approach described in Paul Graham's "A Plan for Spam".
+//
+// Interfaces implemented:
+// - module.Check
+// - module.SpamLearner
+package bayes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/mimewalk"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.bayes"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	threshold   float64
+	minMessages int
+	spamAction  modconfig.FailAction
+	limits      mimewalk.Limits
+
+	store *store
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		driver string
+		dsn    []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("driver", false, false, "sqlite3", &driver)
+	cfg.StringList("dsn", false, false, []string{"bayes.db"}, &dsn)
+	cfg.Float("threshold", false, false, 0.9, &c.threshold)
+	cfg.Int("min_messages", false, false, 20, &c.minMessages)
+	mimewalk.Directives(cfg, &c.limits)
+	cfg.Custom("spam_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.spamAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.threshold <= 0 || c.threshold >= 1 {
+		return fmt.Errorf("%s: threshold should be between 0 and 1", modName)
+	}
+	if c.minMessages < 1 {
+		return fmt.Errorf("%s: min_messages should be at least 1", modName)
+	}
+
+	var err error
+	c.store, err = openStore(driver, strings.Join(dsn, " "))
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	return nil
+}
+
+// Learn trains the classifier using the message. If spam is false, the
+// message is learned as ham.
+//
+// Each message is learned only once. Learning the message again as the
+// other class moves its tokens between classes.
+func (c *Check) Learn(ctx context.Context, hdr textproto.Header, body io.Reader, spam bool) error {
+	digest := sha256.New()
+	if err := textproto.WriteHeader(digest, hdr); err != nil {
+		return err
+	}
+	body = io.TeeReader(body, digest)
+
+	tokens := tokenize(hdr, body, c.limits)
+	// Not all of the body might be consumed by tokenize.
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+
+	changed, err := c.store.learn(ctx, hex.EncodeToString(digest.Sum(nil)), tokens, spam)
+	if err != nil {
+		return err
+	}
+	if changed {
+		c.log.DebugMsg("learned message", "spam", spam, "tokens", len(tokens))
+	}
+	return nil
+}
+
+// Score returns the probability of the message being spam.
+//
+// ok is false if there is not enough training data for the classification.
+func (c *Check) Score(ctx context.Context, hdr textproto.Header, body io.Reader) (p float64, ok bool, err error) {
+	spamMsgs, hamMsgs, err := c.store.totals(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	if spamMsgs < c.minMessages || hamMsgs < c.minMessages {
+		return 0, false, nil
+	}
+
+	tokens := tokenize(hdr, body, c.limits)
+	counts, err := c.store.counts(ctx, tokens)
+	if err != nil {
+		return 0, false, err
+	}
+	return score(counts, tokens, spamMsgs, hamMsgs), true, nil
+}
+
+func (c *Check) Close() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Close()
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	bodyR, err := body.Open()
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+	defer bodyR.Close()
+
+	p, ok, err := s.c.Score(ctx, hdr, bodyR)
+	if err != nil {
+		s.log.Error("failed to score message", err)
+		return module.CheckResult{}
+	}
+	if !ok {
+		s.log.DebugMsg("not enough training data, skipping")
+		return module.CheckResult{}
+	}
+
+	s.log.DebugMsg("message scored", "score", p)
+	if p < s.c.threshold {
+		return module.CheckResult{}
+	}
+
+	hdrAdd := textproto.Header{}
+	hdrAdd.Add("X-Spam-Flag", "Yes")
+	hdrAdd.Add("X-Spam-Score", strconv.FormatFloat(p, 'f', 2, 64))
+	return s.c.spamAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
+			Misc:         map[string]interface{}{"score": p},
+		},
+		Header: hdrAdd,
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,152 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bayes
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/mimewalk"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestTokenize(t *testing.T) {
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Cheap Pills")
+	hdr.Add("Content-Type", "text/html")
+
+	tokens := tokenize(hdr, strings.NewReader("<p>Buy cheap <b>pills</b> now! 12345 a</p>"), mimewalk.DefaultLimits)
+	expected := []string{"buy", "cheap", "now", "pills", "subject:cheap", "subject:pills"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Fatalf("wrong tokens: %v (want %v)", tokens, expected)
+	}
+}
+
+func testMsg(subject, body string) (textproto.Header, buffer.Buffer) {
+	hdr := textproto.Header{}
+	hdr.Add("Subject", subject)
+	hdr.Add("Content-Type", "text/plain")
+	return hdr, buffer.MemoryBuffer{Slice: []byte(body)}
+}
+
+func TestCheck(t *testing.T) {
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+
+	dir, err := ioutil.TempDir("", "maddy-bayes-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := c.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "dsn", Args: []string{filepath.Join(dir, "bayes.db")}},
+			{Name: "min_messages", Args: []string{"3"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.log = testutils.Logger(t, modName)
+
+	learn := func(subject, body string, spam bool) {
+		t.Helper()
+		hdr, buf := testMsg(subject, body)
+		r, _ := buf.Open()
+		if err := c.Learn(context.Background(), hdr, r, spam); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(subject, body string, quarantine bool) {
+		t.Helper()
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, buf := testMsg(subject, body)
+		res := s.CheckBody(context.Background(), hdr, buf)
+		if res.Quarantine != quarantine {
+			t.Errorf("%q: quarantine = %v, want %v", subject, res.Quarantine, quarantine)
+		}
+	}
+
+	// Not enough training data yet.
+	check("cheap pills", "buy cheap pills now, best viagra offer", false)
+
+	for i := 0; i < 5; i++ {
+		learn(fmt.Sprint("cheap pills ", i), "buy cheap pills now, best viagra offer", true)
+		learn(fmt.Sprint("meeting notes ", i), "attached are the notes from our project meeting", false)
+	}
+	// Learning the same message twice has no effect.
+	learn("meeting notes 0", "attached are the notes from our project meeting", false)
+
+	spam, ham, err := c.store.totals(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spam != 5 || ham != 5 {
+		t.Fatalf("wrong totals: %d spam, %d ham", spam, ham)
+	}
+
+	check("cheap viagra", "best pills offer, buy now", true)
+	check("project meeting", "notes from the meeting are attached", false)
+
+	// Relearning moves the message to the other class.
+	learn("meeting notes 0", "attached are the notes from our project meeting", true)
+	spam, ham, err = c.store.totals(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spam != 6 || ham != 4 {
+		t.Fatalf("wrong totals after relearning: %d spam, %d ham", spam, ham)
+	}
+}
+
+func TestCheck_MinMessages(t *testing.T) {
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "dsn", Args: []string{"unused.db"}},
+			{Name: "min_messages", Args: []string{"0"}},
+		},
+	}))
+	if err == nil {
+		t.Fatal("Expected an error for min_messages 0")
+	}
+}
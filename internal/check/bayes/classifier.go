@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bayes
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/mimewalk"
+)
+
+const (
+	// Only the beginning of each text part is used for tokenization.
+	maxPartLen = 256 * 1024
+	// Upper limit on amount of unique tokens used for a single message.
+	maxTokens = 2000
+
+	minTokenLen = 3
+	maxTokenLen = 24
+
+	// Amount of the most "interesting" tokens used for scoring.
+	interestingTokens = 15
+	// Probability used for tokens that are not seen enough times.
+	unknownTokenProb = 0.4
+	// Minimum amount of occurrences (with ham counted twice) for the
+	// token probability to be calculated.
+	minTokenCount = 5
+)
+
+// tokenize returns the set of tokens in the message.
+//
+// Subject and From header fields are tokenized with the prefix added to
+// each token. Text parts of the body are tokenized as is, HTML tags are
+// removed before that. Parts beyond the specified limits are
+// ignored.
+func tokenize(hdr textproto.Header, body io.Reader, limits mimewalk.Limits) []string {
+	set := make(map[string]struct{})
+	add := func(prefix, text string) {
+		for _, word := range strings.FieldsFunc(text, isSeparator) {
+			if len(set) >= maxTokens {
+				return
+			}
+			if len(word) < minTokenLen || len(word) > maxTokenLen || isNumber(word) {
+				continue
+			}
+			set[prefix+strings.ToLower(word)] = struct{}{}
+		}
+	}
+
+	add("subject:", hdr.Get("Subject"))
+	add("from:", hdr.Get("From"))
+
+	w := mimewalk.Walker{Limits: limits}
+	_ = w.Walk(hdr, body, func(_ []int, part *message.Entity) error {
+		contentType, _, _ := part.Header.ContentType()
+		if !strings.HasPrefix(contentType, "text/") {
+			return nil
+		}
+		text, err := ioutil.ReadAll(io.LimitReader(part.Body, maxPartLen))
+		if err != nil {
+			return nil
+		}
+		if contentType == "text/html" {
+			add("", stripTags(string(text)))
+		} else {
+			add("", string(text))
+		}
+		return nil
+	})
+
+	return sortedTokens(set)
+}
+
+func sortedTokens(set map[string]struct{}) []string {
+	tokens := make([]string, 0, len(set))
+	for t := range set {
+		tokens = append(tokens, t)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '$' && r != '-'
+}
+
+func isNumber(word string) bool {
+	for _, r := range word {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func stripTags(html string) string {
+	var sb strings.Builder
+	inTag := false
+	for _, r := range html {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+			sb.WriteRune(' ')
+		case !inTag:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// tokenCounts contains the amount of spam and ham messages a token was seen
+// in.
+type tokenCounts struct {
+	Spam, Ham int
+}
+
+// tokenProb calculates the probability of the message containing the token
+// to be spam as described in Paul Graham's "A Plan for Spam".
+func tokenProb(c tokenCounts, spamMsgs, hamMsgs int) float64 {
+	good := 2 * float64(c.Ham)
+	bad := float64(c.Spam)
+	if good+bad < minTokenCount {
+		return unknownTokenProb
+	}
+
+	goodRatio := math.Min(1, good/float64(hamMsgs))
+	badRatio := math.Min(1, bad/float64(spamMsgs))
+	p := badRatio / (goodRatio + badRatio)
+	return math.Max(0.01, math.Min(0.99, p))
+}
+
+// score combines probabilities of the most interesting tokens into the
+// probability of the message being spam.
+func score(counts map[string]tokenCounts, tokens []string, spamMsgs, hamMsgs int) float64 {
+	probs := make([]float64, 0, len(tokens))
+	for _, t := range tokens {
+		probs = append(probs, tokenProb(counts[t], spamMsgs, hamMsgs))
+	}
+	sort.SliceStable(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > interestingTokens {
+		probs = probs[:interestingTokens]
+	}
+	if len(probs) == 0 {
+		return 0.5
+	}
+
+	prod, invProd := 1.0, 1.0
+	for _, p := range probs {
+		prod *= p
+		invProd *= 1 - p
+	}
+	return prod / (prod + invProd)
+}
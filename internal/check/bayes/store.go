@@ -0,0 +1,214 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bayes
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// store keeps token counts and digests of learned messages in the SQL
+// database.
+type store struct {
+	db     *sql.DB
+	driver string
+}
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS bayes_tokens (
+		token VARCHAR(255) PRIMARY KEY,
+		spam INTEGER NOT NULL DEFAULT 0,
+		ham INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS bayes_learned (
+		digest CHAR(64) PRIMARY KEY,
+		spam INTEGER NOT NULL
+	)`,
+}
+
+func openStore(driver, dsn string) (*store, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// Concurrent writers get "database is locked" errors otherwise.
+		db.SetMaxOpenConns(1)
+	}
+
+	for _, q := range schema {
+		if _, err := db.Exec(q); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &store{db: db, driver: driver}, nil
+}
+
+// q converts the query from the "?" placeholder syntax to the one used by
+// the driver.
+func (s *store) q(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+
+	var sb strings.Builder
+	n := 1
+	for _, ch := range query {
+		if ch == '?' {
+			sb.WriteString("$" + strconv.Itoa(n))
+			n++
+			continue
+		}
+		sb.WriteRune(ch)
+	}
+	return sb.String()
+}
+
+// totals returns the amount of learned spam and ham messages.
+func (s *store) totals(ctx context.Context) (spam, ham int, err error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT spam, COUNT(*) FROM bayes_learned GROUP BY spam`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var isSpam, count int
+		if err := rows.Scan(&isSpam, &count); err != nil {
+			return 0, 0, err
+		}
+		if isSpam != 0 {
+			spam = count
+		} else {
+			ham = count
+		}
+	}
+	return spam, ham, rows.Err()
+}
+
+func (s *store) counts(ctx context.Context, tokens []string) (map[string]tokenCounts, error) {
+	stmt, err := s.db.PrepareContext(ctx, s.q(`SELECT spam, ham FROM bayes_tokens WHERE token = ?`))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	counts := make(map[string]tokenCounts, len(tokens))
+	for _, t := range tokens {
+		var c tokenCounts
+		if err := stmt.QueryRowContext(ctx, t).Scan(&c.Spam, &c.Ham); err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return nil, err
+		}
+		counts[t] = c
+	}
+	return counts, nil
+}
+
+func (s *store) adjust(ctx context.Context, tx *sql.Tx, tokens []string, spamDelta, hamDelta int) error {
+	upd, err := tx.PrepareContext(ctx, s.q(`UPDATE bayes_tokens SET spam = spam + ?, ham = ham + ? WHERE token = ?`))
+	if err != nil {
+		return err
+	}
+	defer upd.Close()
+	ins, err := tx.PrepareContext(ctx, s.q(`INSERT INTO bayes_tokens (token, spam, ham) VALUES (?, ?, ?)`))
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	for _, t := range tokens {
+		res, err := upd.ExecContext(ctx, spamDelta, hamDelta, t)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected != 0 || spamDelta < 0 || hamDelta < 0 {
+			continue
+		}
+		if _, err := ins.ExecContext(ctx, t, spamDelta, hamDelta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// learn adds tokens of the message identified by digest to spam or ham
+// counts.
+//
+// If the message was learned before as the other class, its tokens are
+// moved between classes. If it was learned as the same class, learn is a
+// no-op.
+func (s *store) learn(ctx context.Context, digest string, tokens []string, spam bool) (changed bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	newClass := 0
+	if spam {
+		newClass = 1
+	}
+
+	var oldClass int
+	err = tx.QueryRowContext(ctx, s.q(`SELECT spam FROM bayes_learned WHERE digest = ?`), digest).Scan(&oldClass)
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := tx.ExecContext(ctx, s.q(`INSERT INTO bayes_learned (digest, spam) VALUES (?, ?)`), digest, newClass); err != nil {
+			return false, err
+		}
+		spamDelta, hamDelta := 0, 1
+		if spam {
+			spamDelta, hamDelta = 1, 0
+		}
+		if err := s.adjust(ctx, tx, tokens, spamDelta, hamDelta); err != nil {
+			return false, err
+		}
+	case err != nil:
+		return false, err
+	case oldClass == newClass:
+		return false, nil
+	default:
+		if _, err := tx.ExecContext(ctx, s.q(`UPDATE bayes_learned SET spam = ? WHERE digest = ?`), newClass, digest); err != nil {
+			return false, err
+		}
+		spamDelta, hamDelta := -1, 1
+		if spam {
+			spamDelta, hamDelta = 1, -1
+		}
+		if err := s.adjust(ctx, tx, tokens, spamDelta, hamDelta); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,366 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package block_attachments
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/mimewalk"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.block_attachments"
+
+var (
+	blockedExtsDefault = []string{
+		"exe", "com", "scr", "pif", "bat", "cmd", "cpl", "msi", "vbs", "vbe",
+		"js", "jse", "wsf", "wsh", "hta", "jar", "ps1", "lnk", "iso",
+	}
+	blockedTypesDefault = []string{
+		"application/x-msdownload",
+		"application/x-msdos-program",
+		"application/x-dosexec",
+		"application/hta",
+	}
+
+	// Signatures of executable files.
+	executableMagic = [][]byte{
+		[]byte("MZ"),                                       // DOS/PE
+		[]byte("\x7fELF"),                                  // ELF
+		{0xfe, 0xed, 0xfa, 0xce}, {0xce, 0xfa, 0xed, 0xfe}, // Mach-O 32-bit
+		{0xfe, 0xed, 0xfa, 0xcf}, {0xcf, 0xfa, 0xed, 0xfe}, // Mach-O 64-bit
+	}
+)
+
+// Check rejects messages with attachments of blocked types.
+type Check struct {
+	instName string
+	log      log.Logger
+
+	blockedExts  map[string]struct{}
+	blockedTypes map[string]struct{}
+	checkMagic   bool
+
+	inspectArchives bool
+	maxArchiveDepth int
+	maxArchiveSize  int
+
+	limits      mimewalk.Limits
+	failAction  modconfig.FailAction
+	limitAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var exts, types []string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("blocked_extensions", false, false, blockedExtsDefault, &exts)
+	cfg.StringList("blocked_types", false, false, blockedTypesDefault, &types)
+	cfg.Bool("check_magic", false, true, &c.checkMagic)
+	cfg.Bool("inspect_archives", false, true, &c.inspectArchives)
+	cfg.Int("max_archive_depth", false, false, 2, &c.maxArchiveDepth)
+	cfg.DataSize("max_archive_size", false, false, 10*1024*1024, &c.maxArchiveSize)
+	mimewalk.Directives(cfg, &c.limits)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("limit_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.limitAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.blockedExts = make(map[string]struct{}, len(exts))
+	for _, ext := range exts {
+		c.blockedExts[strings.ToLower(strings.TrimPrefix(ext, "."))] = struct{}{}
+	}
+	c.blockedTypes = make(map[string]struct{}, len(types))
+	for _, t := range types {
+		c.blockedTypes[strings.ToLower(t)] = struct{}{}
+	}
+	return nil
+}
+
+func (c *Check) blockedName(name string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if ext == "" {
+		return false
+	}
+	_, ok := c.blockedExts[ext]
+	return ok
+}
+
+func isExecutable(prefix []byte) bool {
+	for _, magic := range executableMagic {
+		if bytes.HasPrefix(prefix, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+func isZip(name, contentType string, prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte("PK\x03\x04")) ||
+		contentType == "application/zip" || contentType == "application/x-zip-compressed" ||
+		strings.EqualFold(path.Ext(name), ".zip")
+}
+
+// partFilename returns the file name of the MIME part, if any.
+func partFilename(h message.Header) string {
+	if _, params, err := h.ContentDisposition(); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := h.ContentType(); err == nil {
+		return params["name"]
+	}
+	return ""
+}
+
+// inspectZip looks for blocked files inside the ZIP archive.
+func (c *Check) inspectZip(w *mimewalk.Walker, blob []byte, depth int) (string, error) {
+	if depth > c.maxArchiveDepth {
+		return "", nil
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range zr.File {
+		if c.blockedName(f.Name) {
+			return f.Name, nil
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		nested := strings.EqualFold(path.Ext(f.Name), ".zip")
+		if !c.checkMagic && !nested {
+			continue
+		}
+		if nested && f.UncompressedSize64 > uint64(c.maxArchiveSize) {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		limit := int64(4)
+		if nested {
+			limit = int64(c.maxArchiveSize)
+		}
+		content, err := ioutil.ReadAll(w.Decompressed(io.LimitReader(rc, limit)))
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+
+		if c.checkMagic && isExecutable(content) {
+			return f.Name, nil
+		}
+		if nested {
+			name, err := c.inspectZip(w, content, depth+1)
+			if mimewalk.IsLimitErr(err) {
+				return "", err
+			}
+			if err != nil {
+				// Nested archive is damaged or is not an archive at all.
+				continue
+			}
+			if name != "" {
+				return f.Name + "/" + name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// findBlocked walks the message structure and returns the description of
+// the first blocked part found. Empty string is returned if there are no
+// blocked parts.
+func (c *Check) findBlocked(hdr textproto.Header, body io.Reader) (string, error) {
+	w := mimewalk.Walker{Limits: c.limits}
+
+	var blocked string
+	err := w.Walk(hdr, body, func(_ []int, part *message.Entity) error {
+		contentType, _, _ := part.Header.ContentType()
+		if strings.HasPrefix(contentType, "multipart/") {
+			return nil
+		}
+		name := partFilename(part.Header)
+
+		if _, ok := c.blockedTypes[contentType]; ok {
+			blocked = fmt.Sprintf("Attachments of type %s are not allowed", contentType)
+			return io.EOF
+		}
+		if c.blockedName(name) {
+			blocked = fmt.Sprintf("Attachment %s is not allowed", name)
+			return io.EOF
+		}
+
+		if name == "" || (!c.checkMagic && !c.inspectArchives) {
+			return nil
+		}
+
+		bufR := bufio.NewReader(part.Body)
+		prefix, _ := bufR.Peek(4)
+		if c.checkMagic && isExecutable(prefix) {
+			blocked = fmt.Sprintf("Attachment %s is an executable file", name)
+			return io.EOF
+		}
+		if c.inspectArchives && isZip(name, contentType, prefix) {
+			blob, err := ioutil.ReadAll(io.LimitReader(bufR, int64(c.maxArchiveSize)+1))
+			if err != nil {
+				return err
+			}
+			if len(blob) > c.maxArchiveSize {
+				return nil
+			}
+			inner, err := c.inspectZip(&w, blob, 1)
+			if mimewalk.IsLimitErr(err) {
+				return err
+			}
+			if err != nil {
+				c.log.DebugMsg("failed to inspect archive", "name", name, "reason", err)
+				return nil
+			}
+			if inner != "" {
+				blocked = fmt.Sprintf("Attachment %s contains %s which is not allowed", name, inner)
+				return io.EOF
+			}
+		}
+		return nil
+	})
+	return blocked, err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	bodyR, err := body.Open()
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+	defer bodyR.Close()
+
+	msg, err := s.c.findBlocked(hdr, bodyR)
+	if mimewalk.IsLimitErr(err) {
+		s.log.Msg("message processing limit exceeded", "reason", err)
+		return s.c.limitAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         552,
+				EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+				Message:      "Message structure is too complex",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+	if err != nil {
+		// Malformed messages are not our business, leave them to other
+		// checks.
+		s.log.Error("failed to parse message", err)
+		return module.CheckResult{}
+	}
+	if msg == "" {
+		s.log.DebugMsg("ok")
+		return module.CheckResult{}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      msg,
+			CheckName:    modName,
+		},
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,147 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package block_attachments
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func makeZip(t *testing.T, name string, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func attachmentMsg(contentType, name string, content []byte) (textproto.Header, buffer.Buffer) {
+	hdr := textproto.Header{}
+	hdr.Add("Content-Type", `multipart/mixed; boundary="BOUNDARY"`)
+
+	body := strings.Join([]string{
+		"--BOUNDARY",
+		"Content-Type: text/plain",
+		"",
+		"See attached.",
+		"--BOUNDARY",
+		"Content-Type: " + contentType,
+		`Content-Disposition: attachment; filename="` + name + `"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		base64.StdEncoding.EncodeToString(content),
+		"--BOUNDARY--",
+		"",
+	}, "\r\n")
+	return hdr, buffer.MemoryBuffer{Slice: []byte(body)}
+}
+
+func TestCheck(t *testing.T) {
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+
+	test := func(contentType, name string, content []byte, fail bool) {
+		t.Helper()
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, body := attachmentMsg(contentType, name, content)
+		res := s.CheckBody(context.Background(), hdr, body)
+		if fail && !res.Reject {
+			t.Errorf("Expected %s (%s) to be rejected", name, contentType)
+		}
+		if !fail && res.Reject {
+			t.Errorf("Unexpected rejection for %s (%s): %v", name, contentType, res.Reason)
+		}
+	}
+
+	test("application/pdf", "report.pdf", []byte("%PDF-1.4"), false)
+	test("application/octet-stream", "setup.EXE", []byte("data"), true)
+	test("application/x-msdownload", "file.bin", []byte("data"), true)
+	test("application/octet-stream", "invoice.pdf", []byte("MZ\x90\x00"), true)
+
+	inner := makeZip(t, "invoice.js", []byte("alert(1)"))
+	test("application/zip", "docs.zip", inner, true)
+	test("application/zip", "nested.zip", makeZip(t, "inner.zip", inner), true)
+	test("application/zip", "fine.zip", makeZip(t, "notes.txt", []byte("hello")), false)
+
+	c.maxArchiveDepth = 1
+	test("application/zip", "nested.zip", makeZip(t, "inner.zip", inner), false)
+}
+
+func TestCheck_Limits(t *testing.T) {
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := makeZip(t, "inner.zip", makeZip(t, "notes.txt", bytes.Repeat([]byte("A"), 4096)))
+	hdr, body := attachmentMsg("application/zip", "docs.zip", inner)
+
+	if res := s.CheckBody(context.Background(), hdr, body); res.Reject {
+		t.Fatalf("Unexpected rejection: %v", res.Reason)
+	}
+
+	c.limits.MaxDecompressedSize = 64
+	res := s.CheckBody(context.Background(), hdr, body)
+	if !res.Reject {
+		t.Fatal("Expected message to be rejected due to decompressed size limit")
+	}
+	if smtpErr, ok := res.Reason.(*exterrors.SMTPError); !ok || smtpErr.Code != 552 {
+		t.Fatalf("Wrong rejection code: %v", res.Reason)
+	}
+}
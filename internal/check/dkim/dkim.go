@@ -37,6 +37,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	maddydmarc "github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
@@ -48,6 +49,10 @@ type Check struct {
 	brokenSigAction modconfig.FailAction
 	noSigAction     modconfig.FailAction
 	failOpen        bool
+	overrideTbl     module.Table
+	minKeyBits      int
+	weakResult      authres.ResultValue
+	sha1Weak        bool
 
 	resolver dns.Resolver
 }
@@ -64,7 +69,10 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 }
 
 func (c *Check) Init(cfg *config.Map) error {
-	var requiredFields []string
+	var (
+		requiredFields []string
+		sha1Sig        string
+	)
 
 	cfg.Bool("debug", true, false, &c.log.Debug)
 	cfg.StringList("required_fields", false, false, []string{"From", "Subject"}, &requiredFields)
@@ -77,10 +85,19 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
 		}, modconfig.FailActionDirective, &c.noSigAction)
+	cfg.Custom("override_table", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &c.overrideTbl)
+	cfg.Int("min_key_bits", false, false, 1024, &c.minKeyBits)
+	cfg.Custom("weak_sig_result", false, false, func() (interface{}, error) {
+		return authres.ResultValue(authres.ResultPermError), nil
+	}, weakResultDirective, &c.weakResult)
+	cfg.Enum("sha1_sig", false, false, []string{"weak", "broken"}, "weak", &sha1Sig)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
 	}
+	c.sha1Weak = sha1Sig == "weak"
 
 	c.requiredFields = make(map[string]struct{})
 	for _, field := range requiredFields {
@@ -116,16 +133,46 @@ func (d *dkimCheckState) CheckRcpt(ctx context.Context, rcptTo string) module.Ch
 	return module.CheckResult{}
 }
 
+// action returns the action to use for the check failure, taking per-domain
+// overrides for the From header domain into account.
+func (d *dkimCheckState) action(ctx context.Context, header textproto.Header, configured modconfig.FailAction) modconfig.FailAction {
+	if d.c.overrideTbl == nil {
+		return configured
+	}
+
+	fromDomain, err := maddydmarc.ExtractFromDomain(header)
+	if err != nil {
+		return configured
+	}
+
+	override, ok, err := modconfig.LookupActionOverride(ctx, d.c.overrideTbl, fromDomain)
+	if err != nil {
+		d.log.Error("action override lookup failed", err, "domain", fromDomain)
+		return configured
+	}
+	if !ok {
+		return configured
+	}
+	d.log.DebugMsg("using action override", "domain", fromDomain)
+	return override
+}
+
 func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
 	defer trace.StartRegion(ctx, "check.dkim/CheckBody").End()
 
+	if d.msgMeta.UpstreamAuth {
+		d.log.DebugMsg("message is received from trusted relay, using upstream results")
+		return module.CheckResult{}
+	}
+
 	if !header.Has("DKIM-Signature") {
-		if d.c.noSigAction.Reject || d.c.noSigAction.Quarantine {
+		noSigAction := d.action(ctx, header, d.c.noSigAction)
+		if noSigAction.Reject || noSigAction.Quarantine {
 			d.log.Printf("no signatures present")
 		} else {
 			d.log.Debugf("no signatures present")
 		}
-		return d.c.noSigAction.Apply(module.CheckResult{
+		return noSigAction.Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
@@ -156,9 +203,14 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 		}
 	}
 
+	keys := &keyRecorder{}
 	verifications, err := dkim.VerifyWithOptions(io.MultiReader(&b, bodyRdr), &dkim.VerifyOptions{
 		LookupTXT: func(domain string) ([]string, error) {
-			return d.c.resolver.LookupTXT(ctx, domain)
+			txts, err := d.c.resolver.LookupTXT(ctx, domain)
+			if err == nil {
+				keys.record(domain, txts)
+			}
+			return txts, err
 		},
 	})
 	if err != nil {
@@ -175,11 +227,28 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 	}
 
 	goodSigs := false
+	infos := signatureInfo(header, keys)
 
 	res := module.CheckResult{AuthResult: make([]authres.Result, 0, len(verifications))}
-	for _, verif := range verifications {
+	for i, verif := range verifications {
 		val := authres.ResultValue(authres.ResultPass)
 		reason := ""
+
+		var info sigInfo
+		if i < len(infos) {
+			info = infos[i]
+		}
+		if weak := d.c.weakReason(info, verif.Err); weak != "" {
+			d.log.Msg("weak signature", "domain", verif.Domain, "identifier", verif.Identifier,
+				"key_algo", info.KeyAlgo, "hash_algo", info.HashAlgo, "key_bits", info.KeyBits)
+			res.AuthResult = append(res.AuthResult, &authres.DKIMResult{
+				Value:      d.c.weakResult,
+				Reason:     weak,
+				Domain:     verif.Domain,
+				Identifier: verif.Identifier,
+			})
+			continue
+		}
 		if verif.Err != nil {
 			val = authres.ResultFail
 
@@ -228,7 +297,8 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 
 		if val == authres.ResultPass {
 			goodSigs = true
-			d.log.DebugMsg("good signature", "domain", verif.Domain, "identifier", verif.Identifier)
+			d.log.DebugMsg("good signature", "domain", verif.Domain, "identifier", verif.Identifier,
+				"key_algo", info.KeyAlgo, "hash_algo", info.HashAlgo, "key_bits", info.KeyBits)
 		}
 
 		res.AuthResult = append(res.AuthResult, &authres.DKIMResult{
@@ -246,7 +316,7 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 			Message:      "No passing DKIM signatures",
 			CheckName:    "check.dkim",
 		}
-		return d.c.brokenSigAction.Apply(res)
+		return d.action(ctx, header, d.c.brokenSigAction).Apply(res)
 	}
 	return res
 }
@@ -22,6 +22,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/emersion/go-msgauth/authres"
@@ -362,3 +363,104 @@ func TestDkimVerify_FailOpen(t *testing.T) {
 		t.Fatal("Result is not temp. error:", resVal)
 	}
 }
+
+func TestDkimVerify_WeakSig(t *testing.T) {
+	test := func(cfg []config.Node, mail string, expected authres.ResultValue) {
+		t.Helper()
+		check := testCheck(t, testZones, cfg)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s, err := check.CheckStateForMsg(ctx, &module.MsgMetadata{
+			ID: "test_weak",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.CheckConnection(ctx)
+		s.CheckSender(ctx, "joe@football.example.com")
+		s.CheckRcpt(ctx, "suzie@shopping.example.net")
+
+		hdr, buf := testutils.BodyFromStr(t, mail)
+		result := s.CheckBody(ctx, hdr, buf)
+		t.Log("auth. result:", authres.Format("", result.AuthResult))
+
+		if len(result.AuthResult) != 1 {
+			t.Fatal("Wrong amount of auth. result fields:", len(result.AuthResult))
+		}
+		resVal := result.AuthResult[0].(*authres.DKIMResult).Value
+		if resVal != expected {
+			t.Fatalf("Wrong result: %v (want %v)", resVal, expected)
+		}
+		if expected != authres.ResultPass && result.Reason == nil {
+			t.Fatal("No check fail reason set")
+		}
+	}
+
+	// Test key is 1024 bits long.
+	test(nil, verifiedMailString, authres.ResultPass)
+	test([]config.Node{
+		{
+			Name: "min_key_bits",
+			Args: []string{"2048"},
+		},
+	}, verifiedMailString, authres.ResultPermError)
+	test([]config.Node{
+		{
+			Name: "min_key_bits",
+			Args: []string{"2048"},
+		},
+		{
+			Name: "weak_sig_result",
+			Args: []string{"neutral"},
+		},
+	}, verifiedMailString, authres.ResultNeutral)
+	test([]config.Node{
+		{
+			Name: "weak_sig_result",
+			Args: []string{"policy"},
+		},
+	}, strings.Replace(verifiedMailString, "a=rsa-sha256", "a=rsa-sha1", 1), authres.ResultPolicy)
+	test([]config.Node{
+		{
+			Name: "sha1_sig",
+			Args: []string{"broken"},
+		},
+		{
+			Name: "weak_sig_result",
+			Args: []string{"policy"},
+		},
+	}, strings.Replace(verifiedMailString, "a=rsa-sha256", "a=rsa-sha1", 1), authres.ResultPermError)
+
+	// Broken signature with the weak key is reported as broken.
+	test([]config.Node{
+		{
+			Name: "min_key_bits",
+			Args: []string{"2048"},
+		},
+		{
+			Name: "weak_sig_result",
+			Args: []string{"neutral"},
+		},
+	}, strings.Replace(verifiedMailString, "Subject: Is dinner ready?", "Subject: Is lunch ready?", 1), authres.ResultFail)
+}
+
+func TestKeyBits(t *testing.T) {
+	bits, err := keyBits(dnsPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits != 1024 {
+		t.Fatal("Wrong key size:", bits)
+	}
+
+	bits, err = keyBits("v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits != 256 {
+		t.Fatal("Wrong key size:", bits)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// sigInfo describes the parameters of a DKIM signature relevant for the
+// signature strength.
+type sigInfo struct {
+	// KeyAlgo and HashAlgo are taken from the a= tag of the signature.
+	KeyAlgo  string
+	HashAlgo string
+
+	// KeyBits is the length of the public key in bits. It is zero if the key
+	// is not available (e.g. lookup failed).
+	KeyBits int
+}
+
+// keyRecorder remembers the public key records fetched during
+// verification so their parameters can be inspected later.
+type keyRecorder struct {
+	lock    sync.Mutex
+	records map[string]string
+}
+
+func (kr *keyRecorder) record(domain string, txts []string) {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	if kr.records == nil {
+		kr.records = make(map[string]string)
+	}
+	kr.records[strings.ToLower(domain)] = strings.Join(txts, "")
+}
+
+func (kr *keyRecorder) get(domain string) (string, bool) {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	rec, ok := kr.records[strings.ToLower(domain)]
+	return rec, ok
+}
+
+// parseTags parses the tag=value list used by DKIM-Signature field and key
+// records.
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+	}
+	return tags
+}
+
+// keyBits returns the length of the public key in the DKIM key record.
+func keyBits(record string) (int, error) {
+	tags := parseTags(record)
+	b, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return 0, err
+	}
+
+	switch tags["k"] {
+	case "rsa", "":
+		pub, err := x509.ParsePKIXPublicKey(b)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(b)
+			if err != nil {
+				return 0, err
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return 0, fmt.Errorf("not an RSA public key")
+		}
+		return rsaPub.N.BitLen(), nil
+	case "ed25519":
+		return ed25519.PublicKeySize * 8, nil
+	default:
+		return 0, fmt.Errorf("unsupported key algorithm: %s", tags["k"])
+	}
+}
+
+// signatureInfo returns sigInfo for each DKIM-Signature field in the
+// header, in the same order dkim.Verify returns verification results.
+func signatureInfo(header textproto.Header, keys *keyRecorder) []sigInfo {
+	var infos []sigInfo
+	for field := header.FieldsByKey("DKIM-Signature"); field.Next(); {
+		tags := parseTags(field.Value())
+
+		info := sigInfo{}
+		algo := strings.SplitN(strings.ToLower(tags["a"]), "-", 2)
+		if len(algo) == 2 {
+			info.KeyAlgo, info.HashAlgo = algo[0], algo[1]
+		}
+
+		if rec, ok := keys.get(tags["s"] + "._domainkey." + tags["d"]); ok {
+			bits, err := keyBits(rec)
+			if err == nil {
+				info.KeyBits = bits
+			}
+		}
+
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// weakReason returns the description of the problem if the signature
+// parameters do not satisfy the configured policy, empty string is returned
+// otherwise.
+//
+// Signatures that failed verification are not weak, they are broken, except
+// for SHA-1 signatures if sha1_sig is set to 'weak': go-msgauth refuses to
+// verify them at all (RFC 8301), so it is not known whether they are otherwise
+// valid.
+func (c *Check) weakReason(info sigInfo, verifErr error) string {
+	if info.HashAlgo == "sha1" {
+		if c.sha1Weak {
+			return "hash algorithm is too weak: sha1"
+		}
+		return ""
+	}
+	if verifErr != nil {
+		return ""
+	}
+	if info.KeyAlgo == "rsa" && info.KeyBits != 0 && info.KeyBits < c.minKeyBits {
+		return fmt.Sprintf("key is too short: %d bits", info.KeyBits)
+	}
+	return ""
+}
+
+func weakResultDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+	switch val := strings.ToLower(node.Args[0]); val {
+	case authres.ResultNeutral, authres.ResultPolicy, authres.ResultFail, authres.ResultPermError:
+		return authres.ResultValue(val), nil
+	default:
+		return nil, config.NodeErr(node, "unsupported result value: %s", node.Args[0])
+	}
+}
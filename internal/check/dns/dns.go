@@ -114,6 +114,18 @@ func requireMXRecord(ctx check.StatelessCheckContext, mailFrom string) module.Ch
 		}
 	}
 
+	domain, err = dns.ToASCII(domain)
+	if err != nil {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         501,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 8},
+				Message:      "Malformed sender address",
+				CheckName:    "require_mx_record",
+			},
+		}
+	}
+
 	srcMx, err := ctx.Resolver.LookupMX(ctx, domain)
 	if err != nil {
 		reason, misc := exterrors.UnwrapDNSErr(err)
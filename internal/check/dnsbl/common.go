@@ -32,6 +32,10 @@ type ListedErr struct {
 	Identity string
 	List     string
 	Reason   string
+
+	// Score adjustment for the listing, it depends on the list
+	// configuration and the returned addresses.
+	Score int
 }
 
 func (le ListedErr) Fields() map[string]interface{} {
@@ -40,6 +44,7 @@ func (le ListedErr) Fields() map[string]interface{} {
 		"list":            le.List,
 		"listed_identity": le.Identity,
 		"reason":          le.Reason,
+		"score":           le.Score,
 		"smtp_code":       554,
 		"smtp_enchcode":   exterrors.EnhancedCode{5, 7, 0},
 		"smtp_msg":        "Client identity listed in the used DNSBL",
@@ -51,6 +56,11 @@ func (le ListedErr) Error() string {
 }
 
 func checkDomain(ctx context.Context, resolver dns.Resolver, cfg List, domain string) error {
+	// The responses filter describes IP-based lists, domain-based lists
+	// use different return codes (e.g. 127.0.1.0/24 for Spamhaus DBL) so any
+	// address is considered a listing.
+	cfg.Responses = nil
+
 	query := domain + "." + cfg.Zone
 
 	addrs, err := resolver.LookupHost(ctx, query)
@@ -62,30 +72,14 @@ func checkDomain(ctx context.Context, resolver dns.Resolver, cfg List, domain st
 		return err
 	}
 
-	if len(addrs) == 0 {
-		return nil
-	}
-
-	// Attempt to extract explanation string.
-	txts, err := resolver.LookupTXT(context.Background(), query)
-	if err != nil || len(txts) == 0 {
-		// Not significant, include addresses as reason. Usually they are
-		// mapped to some predefined 'reasons' by BL.
-		return ListedErr{
-			Identity: domain,
-			List:     cfg.Zone,
-			Reason:   strings.Join(addrs, "; "),
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
 		}
 	}
 
-	// Some BLs provide multiple reasons (meta-BLs such as Spamhaus Zen) so
-	// don't mangle them by joining with "", instead join with "; ".
-
-	return ListedErr{
-		Identity: domain,
-		List:     cfg.Zone,
-		Reason:   strings.Join(txts, "; "),
-	}
+	return listedErr(ctx, resolver, cfg, domain, query, ips)
 }
 
 func checkIP(ctx context.Context, resolver dns.Resolver, cfg List, ip net.IP) error {
@@ -113,42 +107,96 @@ func checkIP(ctx context.Context, resolver dns.Resolver, cfg List, ip net.IP) er
 		return err
 	}
 
-	filteredAddrs := make([]net.IPAddr, 0, len(addrs))
-addrsLoop:
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+
+	return listedErr(ctx, resolver, cfg, ip.String(), query, ips)
+}
+
+// matchResponses filters addresses returned by the list using configured
+// response rules and calculates the score adjustment for them.
+//
+// If there are no per-response rules, the list-wide score is used and
+// addresses are filtered using the Responses list.
+func matchResponses(cfg List, addrs []net.IP) (matched []net.IP, score int, messages []string) {
+	if len(cfg.ResponseRules) == 0 {
+		for _, addr := range addrs {
+			// No responses whitelist configured - permit all.
+			if cfg.Responses.Len() == 0 || cfg.Responses.Contains(addr) {
+				matched = append(matched, addr)
+			}
+		}
+		return matched, cfg.ScoreAdj, nil
+	}
+
 	for _, addr := range addrs {
-		// No responses whitelist configured - permit all.
-		if len(cfg.Responses) == 0 {
-			filteredAddrs = append(filteredAddrs, addr)
-			continue
+		for _, rule := range cfg.ResponseRules {
+			if rule.Networks.Contains(addr) {
+				matched = append(matched, addr)
+				break
+			}
 		}
+	}
 
-		for _, respNet := range cfg.Responses {
-			if respNet.Contains(addr.IP) {
-				filteredAddrs = append(filteredAddrs, addr)
-				continue addrsLoop
+	// Each rule is counted once, even if multiple returned addresses
+	// match it.
+	for _, rule := range cfg.ResponseRules {
+		for _, addr := range matched {
+			if rule.Networks.Contains(addr) {
+				score += rule.ScoreAdj
+				if rule.Message != "" {
+					messages = append(messages, rule.Message)
+				}
+				break
 			}
 		}
 	}
 
-	if len(filteredAddrs) == 0 {
+	return matched, score, messages
+}
+
+func listedErr(ctx context.Context, resolver dns.Resolver, cfg List, identity, query string, addrs []net.IP) error {
+	matched, score, messages := matchResponses(cfg, addrs)
+	if len(matched) == 0 {
 		return nil
 	}
 
+	// Configured messages for responses take precedence over anything the
+	// list provides itself.
+	if len(messages) != 0 {
+		return ListedErr{
+			Identity: identity,
+			List:     cfg.Zone,
+			Reason:   strings.Join(messages, "; "),
+			Score:    score,
+		}
+	}
+
 	// Attempt to extract explanation string.
-	txts, err := resolver.LookupTXT(ctx, query)
-	if err != nil || len(txts) == 0 {
+	var txts []string
+	if !cfg.SkipTXT {
+		var err error
+		txts, err = resolver.LookupTXT(ctx, query)
+		if err != nil {
+			txts = nil
+		}
+	}
+	if len(txts) == 0 {
 		// Not significant, include addresses as reason. Usually they are
 		// mapped to some predefined 'reasons' by BL.
 
-		reasonParts := make([]string, 0, len(filteredAddrs))
-		for _, addr := range filteredAddrs {
-			reasonParts = append(reasonParts, addr.IP.String())
+		reasonParts := make([]string, 0, len(matched))
+		for _, addr := range matched {
+			reasonParts = append(reasonParts, addr.String())
 		}
 
 		return ListedErr{
-			Identity: ip.String(),
+			Identity: identity,
 			List:     cfg.Zone,
 			Reason:   strings.Join(reasonParts, "; "),
+			Score:    score,
 		}
 	}
 
@@ -156,9 +204,10 @@ addrsLoop:
 	// don't mangle them by joining with "", instead join with "; ".
 
 	return ListedErr{
-		Identity: ip.String(),
+		Identity: identity,
 		List:     cfg.Zone,
 		Reason:   strings.Join(txts, "; "),
+		Score:    score,
 	}
 }
 
@@ -25,6 +25,7 @@ import (
 	"testing"
 
 	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/netset"
 )
 
 func TestQueryString(t *testing.T) {
@@ -114,6 +115,21 @@ func TestCheckDomain(t *testing.T) {
 		List:     "example.org",
 		Reason:   "127.0.0.1; 127.0.0.2",
 	})
+	// The responses filter is not used for domain lookups.
+	test(map[string]mockdns.Zone{
+		"example.com.example.org.": {
+			A: []string{"127.0.1.2"},
+		},
+	}, List{
+		Zone: "example.org",
+		Responses: netset.Networks(
+			net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(24, 32)},
+		),
+	}, "example.com", ListedErr{
+		Identity: "example.com",
+		List:     "example.org",
+		Reason:   "127.0.1.2",
+	})
 }
 
 func TestCheckIP(t *testing.T) {
@@ -144,12 +160,12 @@ func TestCheckIP(t *testing.T) {
 	}, List{
 		Zone:       "example.org",
 		ClientIPv4: true,
-		Responses: []net.IPNet{
-			{
+		Responses: netset.Networks(
+			net.IPNet{
 				IP:   net.IPv4(127, 0, 0, 1),
 				Mask: net.IPv4Mask(255, 255, 255, 0),
 			},
-		},
+		),
 	}, net.IPv4(1, 2, 3, 4), nil)
 	test(map[string]mockdns.Zone{
 		"4.3.2.1.example.org.": {
@@ -158,16 +174,16 @@ func TestCheckIP(t *testing.T) {
 	}, List{
 		Zone:       "example.org",
 		ClientIPv4: true,
-		Responses: []net.IPNet{
-			{
+		Responses: netset.Networks(
+			net.IPNet{
 				IP:   net.IPv4(127, 0, 0, 0),
 				Mask: net.IPv4Mask(255, 255, 255, 0),
 			},
-			{
+			net.IPNet{
 				IP:   net.IPv4(128, 0, 0, 0),
 				Mask: net.IPv4Mask(255, 255, 255, 0),
 			},
-		},
+		),
 	}, net.IPv4(1, 2, 3, 4), ListedErr{
 		Identity: "1.2.3.4",
 		List:     "example.org",
@@ -236,3 +252,75 @@ func TestCheckIP(t *testing.T) {
 		Reason:   "127.0.0.1",
 	})
 }
+
+func TestCheckIP_ResponseRules(t *testing.T) {
+	test := func(zones map[string]mockdns.Zone, cfg List, expectedErr error) {
+		t.Helper()
+		resolver := mockdns.Resolver{Zones: zones}
+		err := checkIP(context.Background(), &resolver, cfg, net.IPv4(1, 2, 3, 4))
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("expected err to be '%#v', got '%#v'", expectedErr, err)
+		}
+	}
+	ipNet := func(s string) net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *n
+	}
+	rules := []ResponseRule{
+		{Networks: netset.Networks(ipNet("127.0.0.2/32")), ScoreAdj: 10, Message: "SBL"},
+		{Networks: netset.Networks(ipNet("127.0.0.10/31")), ScoreAdj: 1},
+	}
+
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A:   []string{"127.0.0.2"},
+			TXT: []string{"Reason"},
+		},
+	}, List{Zone: "example.org", ClientIPv4: true, ResponseRules: rules}, ListedErr{
+		Identity: "1.2.3.4",
+		List:     "example.org",
+		Reason:   "SBL",
+		Score:    10,
+	})
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A:   []string{"127.0.0.10", "127.0.0.11"},
+			TXT: []string{"Reason"},
+		},
+	}, List{Zone: "example.org", ClientIPv4: true, ResponseRules: rules}, ListedErr{
+		Identity: "1.2.3.4",
+		List:     "example.org",
+		Reason:   "Reason",
+		Score:    1,
+	})
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A:   []string{"127.0.0.2", "127.0.0.10"},
+			TXT: []string{"Reason"},
+		},
+	}, List{Zone: "example.org", ClientIPv4: true, ResponseRules: rules}, ListedErr{
+		Identity: "1.2.3.4",
+		List:     "example.org",
+		Reason:   "SBL",
+		Score:    11,
+	})
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.3"},
+		},
+	}, List{Zone: "example.org", ClientIPv4: true, ResponseRules: rules}, nil)
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A:   []string{"127.0.0.10"},
+			TXT: []string{"Reason"},
+		},
+	}, List{Zone: "example.org", ClientIPv4: true, ResponseRules: rules, SkipTXT: true}, ListedErr{
+		Identity: "1.2.3.4",
+		List:     "example.org",
+		Reason:   "127.0.0.10",
+		Score:    1,
+	})
+}
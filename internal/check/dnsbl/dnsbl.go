@@ -35,6 +35,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netset"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/sync/errgroup"
 )
@@ -49,7 +50,20 @@ type List struct {
 	MAILFROM bool
 
 	ScoreAdj  int
-	Responses []net.IPNet
+	Responses *netset.Set
+
+	// ResponseRules, if not empty, replace ScoreAdj and Responses and
+	// allow to assign different scores to different list responses.
+	ResponseRules []ResponseRule
+
+	// Do not look up TXT records to obtain the listing reason.
+	SkipTXT bool
+}
+
+type ResponseRule struct {
+	Networks *netset.Set
+	ScoreAdj int
+	Message  string
 }
 
 var defaultBL = List{
@@ -101,12 +115,14 @@ func (bl *DNSBL) Init(cfg *config.Map) error {
 	for _, inlineBl := range bl.inlineBls {
 		cfg := defaultBL
 		cfg.Zone = inlineBl
-		go bl.testList(cfg)
+		if !module.NoRun {
+			go bl.testList(cfg)
+		}
 		bl.bls = append(bl.bls, cfg)
 	}
 
 	for _, node := range unknown {
-		if err := bl.readListCfg(node); err != nil {
+		if err := bl.readListCfg(cfg.Globals, node); err != nil {
 			return err
 		}
 	}
@@ -114,42 +130,74 @@ func (bl *DNSBL) Init(cfg *config.Map) error {
 	return nil
 }
 
-func (bl *DNSBL) readListCfg(node config.Node) error {
+// defaultResponses is used when the 'responses' directive is not specified.
+func defaultResponses() (interface{}, error) {
+	return netset.Parse([]string{"127.0.0.1/24"})
+}
+
+func readResponseRule(globals map[string]interface{}, node config.Node) (ResponseRule, error) {
+	var rule ResponseRule
+
+	cfg := config.NewMap(globals, node)
+	nets, err := netset.ParseNode(cfg, node)
+	if err != nil {
+		return rule, err
+	}
+	rule.Networks = nets
+
+	cfg.Int("score", false, false, 1, &rule.ScoreAdj)
+	cfg.String("message", false, false, "", &rule.Message)
+	if _, err := cfg.Process(); err != nil {
+		return rule, err
+	}
+
+	return rule, nil
+}
+
+func (l List) hasNegativeScore() bool {
+	if l.ScoreAdj < 0 && len(l.ResponseRules) == 0 {
+		return true
+	}
+	for _, rule := range l.ResponseRules {
+		if rule.ScoreAdj < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (bl *DNSBL) readListCfg(globals map[string]interface{}, node config.Node) error {
 	var (
-		listCfg      List
-		responseNets []string
+		listCfg   List
+		txtReason bool
 	)
 
-	cfg := config.NewMap(nil, node)
+	cfg := config.NewMap(globals, node)
 	cfg.Bool("client_ipv4", false, defaultBL.ClientIPv4, &listCfg.ClientIPv4)
 	cfg.Bool("client_ipv6", false, defaultBL.ClientIPv4, &listCfg.ClientIPv6)
 	cfg.Bool("ehlo", false, defaultBL.EHLO, &listCfg.EHLO)
 	cfg.Bool("mailfrom", false, defaultBL.EHLO, &listCfg.MAILFROM)
 	cfg.Int("score", false, false, 1, &listCfg.ScoreAdj)
-	cfg.StringList("responses", false, false, []string{"127.0.0.1/24"}, &responseNets)
-	if _, err := cfg.Process(); err != nil {
-		return err
-	}
-
-	for _, resp := range responseNets {
-		// If there is no / - it is a plain IP address, append
-		// '/32'.
-		if !strings.Contains(resp, "/") {
-			resp += "/32"
-		}
-
-		_, ipNet, err := net.ParseCIDR(resp)
+	cfg.Custom("responses", false, false, defaultResponses, netset.Directive, &listCfg.Responses)
+	cfg.Bool("txt_reason", false, true, &txtReason)
+	cfg.Callback("response", func(_ *config.Map, node config.Node) error {
+		rule, err := readResponseRule(globals, node)
 		if err != nil {
 			return err
 		}
-		listCfg.Responses = append(listCfg.Responses, *ipNet)
+		listCfg.ResponseRules = append(listCfg.ResponseRules, rule)
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
 	}
+	listCfg.SkipTXT = !txtReason
 
 	for _, zone := range append([]string{node.Name}, node.Args...) {
 		zoneCfg := listCfg
 		zoneCfg.Zone = zone
 
-		if listCfg.ScoreAdj < 0 {
+		if listCfg.hasNegativeScore() {
 			if zoneCfg.EHLO {
 				return errors.New("dnsbl: 'ehlo' should not be used with negative score")
 			}
@@ -168,7 +216,9 @@ func (bl *DNSBL) readListCfg(node config.Node) error {
 		// Sadly, however, many DNSBLs lack test records so at most we can
 		// log a warning. Also, DNS is kinda slow so we do checks
 		// asynchronously to prevent slowing down server start-up.
-		go bl.testList(zoneCfg)
+		if !module.NoRun {
+			go bl.testList(zoneCfg)
+		}
 	}
 
 	return nil
@@ -315,7 +365,7 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 				defer lck.Unlock()
 				listedOn = append(listedOn, listErr.List)
 				reasons = append(reasons, listErr.Reason)
-				score += list.ScoreAdj
+				score += listErr.Score
 			}
 			return nil
 		})
@@ -25,6 +25,9 @@ import (
 	"testing"
 
 	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/netset"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -192,6 +195,77 @@ func TestCheckLists(t *testing.T) {
 		false, false,
 	)
 
+	// Domain lists are not subject to the responses filter, DBL-style
+	// 127.0.1.x answers are listings.
+	test(map[string]mockdns.Zone{
+		"example.com.example.org.": {
+			A: []string{"127.0.1.2"},
+		},
+	}, []List{
+		{
+			Zone:     "example.org",
+			MAILFROM: true,
+			ScoreAdj: 2,
+			Responses: netset.Networks(
+				net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(24, 32)},
+			),
+		},
+	}, net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com", true, false,
+	)
+
+	// Per-response scores, 127.0.0.2 is allowlisted by the second list.
+	responseRules := []ResponseRule{
+		{
+			Networks: netset.Networks(net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}),
+			ScoreAdj: 1,
+		},
+		{
+			Networks: netset.Networks(net.IPNet{IP: net.IPv4(127, 0, 0, 2), Mask: net.CIDRMask(32, 32)}),
+			ScoreAdj: 3,
+		},
+	}
+	allowRules := []ResponseRule{
+		{
+			Networks: netset.Networks(net.IPNet{IP: net.IPv4(127, 0, 0, 2), Mask: net.CIDRMask(32, 32)}),
+			ScoreAdj: -5,
+		},
+	}
+	// Score 1 (list-wide ScoreAdj is ignored), quarantine
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+	}, []List{
+		{Zone: "example.org", ClientIPv4: true, ScoreAdj: 10, ResponseRules: responseRules},
+	}, net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com", false, true,
+	)
+	// Score 3, reject
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.2"},
+		},
+	}, []List{
+		{Zone: "example.org", ClientIPv4: true, ResponseRules: responseRules},
+	}, net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com", true, false,
+	)
+	// Score 3 - 5 < 0, no action
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.2"},
+		},
+		"4.3.2.1.example.net.": {
+			A: []string{"127.0.0.2"},
+		},
+	}, []List{
+		{Zone: "example.org", ClientIPv4: true, ResponseRules: responseRules},
+		{Zone: "example.net", ClientIPv4: true, ResponseRules: allowRules},
+	}, net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com", false, false,
+	)
+
 	// DNS error, hard-fail (reject)
 	test(map[string]mockdns.Zone{
 		"4.3.2.2.example.org.": {
@@ -211,3 +285,55 @@ func TestCheckLists(t *testing.T) {
 		true, false,
 	)
 }
+
+func TestReadListCfg_NetworkRef(t *testing.T) {
+	globals := config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "networks", Args: []string{"dbl", "127.0.1.0/24"}},
+		},
+	})
+	netset.GlobalDirectives(globals)
+	if _, err := globals.Process(); err != nil {
+		t.Fatal(err)
+	}
+
+	// List is tested asynchronously, make sure it does not hit the real DNS.
+	bl := DNSBL{resolver: &mockdns.Resolver{}, log: log.Logger{Name: "dnsbl"}}
+	err := bl.readListCfg(globals.Values, config.Node{
+		Name: "example.org",
+		Children: []config.Node{
+			{Name: "responses", Args: []string{"&dbl", "127.0.0.2"}},
+			{
+				Name: "response",
+				Args: []string{"&dbl"},
+				Children: []config.Node{
+					{Name: "score", Args: []string{"5"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := bl.bls[0]
+	if !l.Responses.Contains(net.IPv4(127, 0, 1, 5)) || !l.Responses.Contains(net.IPv4(127, 0, 0, 2)) {
+		t.Error("responses do not contain referenced networks")
+	}
+	if l.Responses.Contains(net.IPv4(127, 0, 0, 3)) {
+		t.Error("responses contain unexpected address")
+	}
+	if len(l.ResponseRules) != 1 || !l.ResponseRules[0].Networks.Contains(net.IPv4(127, 0, 1, 5)) {
+		t.Errorf("wrong response rules: %+v", l.ResponseRules)
+	}
+
+	err = bl.readListCfg(globals.Values, config.Node{
+		Name: "example.org",
+		Children: []config.Node{
+			{Name: "responses", Args: []string{"&unknown"}},
+		},
+	})
+	if err == nil {
+		t.Error("Expected an error for unknown network set")
+	}
+}
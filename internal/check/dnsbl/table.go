@@ -0,0 +1,134 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsbl
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netset"
+)
+
+const TableModName = "table.dnsbl"
+
+// Table implements module.Table interface on top of a DNS-based list.
+//
+// Keys that are IP addresses are looked up using reversed address notation,
+// anything else is considered to be a domain name. The lookup result is
+// the address returned by the list.
+type Table struct {
+	instName string
+	zone     string
+
+	responses *netset.Set
+
+	resolver dns.Resolver
+}
+
+func NewTable(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	t := &Table{
+		instName: instName,
+		resolver: dns.DefaultResolver(),
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		t.zone = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: at most one argument accepted", TableModName)
+	}
+
+	return t, nil
+}
+
+func (t *Table) Name() string {
+	return TableModName
+}
+
+func (t *Table) InstanceName() string {
+	return t.instName
+}
+
+func (t *Table) Init(cfg *config.Map) error {
+	cfg.String("zone", false, false, t.zone, &t.zone)
+	cfg.Custom("responses", false, false, defaultResponses, netset.Directive, &t.responses)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.zone == "" {
+		return fmt.Errorf("%s: zone is required", TableModName)
+	}
+
+	return nil
+}
+
+func (t *Table) lookup(ctx context.Context, key string) ([]string, error) {
+	var query string
+	if ip := net.ParseIP(key); ip != nil {
+		query = queryString(ip) + "." + t.zone
+	} else {
+		query = dns.FQDN(key) + t.zone
+	}
+
+	addrs, err := t.resolver.LookupIPAddr(ctx, query)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, exterrors.WithTemporary(
+			fmt.Errorf("%s: lookup %s: %w", TableModName, key, err),
+			true,
+		)
+	}
+
+	res := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if t.responses.Len() != 0 && !t.responses.Contains(addr.IP) {
+			continue
+		}
+		res = append(res, addr.IP.String())
+	}
+	return res, nil
+}
+
+func (t *Table) Lookup(ctx context.Context, key string) (string, bool, error) {
+	res, err := t.lookup(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(res) == 0 {
+		return "", false, nil
+	}
+	return res[0], true, nil
+}
+
+func (t *Table) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	return t.lookup(ctx, key)
+}
+
+func init() {
+	module.Register(TableModName, NewTable)
+}
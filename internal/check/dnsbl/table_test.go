@@ -0,0 +1,98 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsbl
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+func TestTable(t *testing.T) {
+	mod, err := NewTable(TableModName, "", nil, []string{"example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := mod.(*Table)
+	if err := tbl.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	tbl.resolver = &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.2", "127.0.0.3"},
+		},
+		"example.com.example.org.": {
+			A: []string{"127.0.0.4"},
+		},
+		"example.net.example.org.": {
+			A: []string{"10.0.0.1"},
+		},
+		"4.3.2.2.example.org.": {
+			Err: &net.DNSError{
+				Err:         "i/o timeout",
+				IsTimeout:   true,
+				IsTemporary: true,
+			},
+		},
+	}}
+
+	test := func(key string, expected []string) {
+		t.Helper()
+		val, ok, err := tbl.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", key, err)
+		}
+		if len(expected) == 0 {
+			if ok {
+				t.Errorf("Unexpected result for %s: %s", key, val)
+			}
+			return
+		}
+		if !ok || val != expected[0] {
+			t.Errorf("Wrong result for %s: %v %s (want %s)", key, ok, val, expected[0])
+		}
+
+		vals, err := tbl.LookupMulti(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", key, err)
+		}
+		if !reflect.DeepEqual(vals, expected) {
+			t.Errorf("Wrong results for %s: %v (want %v)", key, vals, expected)
+		}
+	}
+
+	test("1.2.3.4", []string{"127.0.0.2", "127.0.0.3"})
+	test("1.2.3.5", nil)
+	test("example.com", []string{"127.0.0.4"})
+	test("example.net", nil) // Not in responses.
+	test("example.invalid", nil)
+
+	_, _, err = tbl.Lookup(context.Background(), "2.2.3.4")
+	if err == nil {
+		t.Fatal("Expected error for failed lookup")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Error("Lookup error should be temporary")
+	}
+}
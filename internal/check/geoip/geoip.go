@@ -0,0 +1,372 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package geoip implements a check that applies policies based on the
+// country or the autonomous system of the client IP address.
+//
+// Information is looked up in MaxMind DB files, such as GeoLite2-Country
+// and GeoLite2-ASN. Database files are reloaded when they are changed.
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const modName = "check.geoip"
+
+var reloadInterval = 15 * time.Second
+
+// dbFile is a MaxMind DB file that is reloaded when changed.
+type dbFile struct {
+	path string
+
+	lck     sync.RWMutex
+	db      *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+func (f *dbFile) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.lck.RLock()
+	unchanged := f.db != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.lck.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	// The file is read into memory instead of using maxminddb.Open so
+	// lookups running concurrently with the reload do not need to be
+	// waited for before closing the old mapping.
+	buf, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	db, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.lck.Lock()
+	f.db = db
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.lck.Unlock()
+	return nil
+}
+
+// lookup decodes the record for the IP address into result. It returns
+// false if there is no record for the address.
+func (f *dbFile) lookup(ip net.IP, result interface{}) (bool, error) {
+	f.lck.RLock()
+	db := f.db
+	f.lck.RUnlock()
+	_, ok, err := db.LookupNetwork(ip, result)
+	return ok, err
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	countryDB *dbFile
+	asnDB     *dbFile
+
+	countryActions map[string]modconfig.FailAction
+	asnActions     map[uint64]modconfig.FailAction
+
+	reloaderStarted bool
+	stopReloader    chan struct{}
+	forceReload     chan struct{}
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName:       instName,
+		log:            log.Logger{Name: modName},
+		countryActions: make(map[string]modconfig.FailAction),
+		asnActions:     make(map[uint64]modconfig.FailAction),
+		stopReloader:   make(chan struct{}),
+		forceReload:    make(chan struct{}),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var countryDB, asnDB string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("country_db", false, false, "", &countryDB)
+	cfg.String("asn_db", false, false, "", &asnDB)
+	cfg.Callback("country", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "expected country code and action")
+		}
+		action, err := modconfig.ParseActionDirective(node.Args[1:])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		c.countryActions[strings.ToUpper(node.Args[0])] = action
+		return nil
+	})
+	cfg.Callback("asn", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "expected AS number and action")
+		}
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(node.Args[0]), "AS"), 10, 32)
+		if err != nil {
+			return config.NodeErr(node, "invalid AS number: %v", node.Args[0])
+		}
+		action, err := modconfig.ParseActionDirective(node.Args[1:])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		c.asnActions[asn] = action
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(c.countryActions) != 0 {
+		if countryDB == "" {
+			return fmt.Errorf("%s: country_db is required to use country actions", modName)
+		}
+		c.countryDB = &dbFile{path: countryDB}
+		if err := c.countryDB.load(); err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+	if len(c.asnActions) != 0 {
+		if asnDB == "" {
+			return fmt.Errorf("%s: asn_db is required to use asn actions", modName)
+		}
+		c.asnDB = &dbFile{path: asnDB}
+		if err := c.asnDB.load(); err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+
+	if module.NoRun {
+		return nil
+	}
+
+	c.reloaderStarted = true
+	go c.reloader()
+	hooks.AddHook(hooks.EventReload, func() {
+		c.forceReload <- struct{}{}
+	})
+	return nil
+}
+
+func (c *Check) reloader() {
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during database reload: %v\n%s", err, stack)
+		}
+	}()
+
+	t := time.NewTicker(reloadInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-c.forceReload:
+		case <-c.stopReloader:
+			c.stopReloader <- struct{}{}
+			return
+		}
+
+		for _, f := range []*dbFile{c.countryDB, c.asnDB} {
+			if f == nil {
+				continue
+			}
+			// Previous version of the database is used on errors, e.g. if
+			// the file is being replaced.
+			if err := f.load(); err != nil {
+				c.log.Error("failed to reload database", err)
+			}
+		}
+	}
+}
+
+func (c *Check) Close() error {
+	if !c.reloaderStarted {
+		return nil
+	}
+	c.stopReloader <- struct{}{}
+	<-c.stopReloader
+	return nil
+}
+
+// country returns the ISO code of the country the IP address is located in.
+func (c *Check) country(ip net.IP) (string, error) {
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	ok, err := c.countryDB.lookup(ip, &rec)
+	if err != nil || !ok {
+		return "", err
+	}
+	if rec.Country.ISOCode != "" {
+		return rec.Country.ISOCode, nil
+	}
+	return rec.RegisteredCountry.ISOCode, nil
+}
+
+// asn returns the number of the autonomous system the IP address belongs to.
+func (c *Check) asn(ip net.IP) (uint64, error) {
+	var rec struct {
+		ASN uint64 `maxminddb:"autonomous_system_number"`
+	}
+	ok, err := c.asnDB.lookup(ip, &rec)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return rec.ASN, nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally-generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.DebugMsg("non-TCP/IP source, skipping")
+		return module.CheckResult{}
+	}
+
+	var (
+		actions []modconfig.FailAction
+		misc    = map[string]interface{}{}
+	)
+	if s.c.countryDB != nil {
+		country, err := s.c.country(tcpAddr.IP)
+		if err != nil {
+			s.log.Error("country lookup failed", err, "src_ip", tcpAddr.IP.String())
+		} else if action, ok := s.c.countryActions[country]; ok {
+			misc["country"] = country
+			actions = append(actions, action)
+		}
+	}
+	if s.c.asnDB != nil {
+		asn, err := s.c.asn(tcpAddr.IP)
+		if err != nil {
+			s.log.Error("ASN lookup failed", err, "src_ip", tcpAddr.IP.String())
+		} else if action, ok := s.c.asnActions[asn]; ok {
+			misc["asn"] = asn
+			actions = append(actions, action)
+		}
+	}
+	if len(actions) == 0 {
+		return module.CheckResult{}
+	}
+
+	res := module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
+			Misc:         misc,
+		},
+	}
+	for _, action := range actions {
+		res = action.Apply(res)
+	}
+	return res
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,286 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// encodeData encodes the value using MaxMind DB data section format.
+// Only types used in tests are supported.
+func encodeData(buf *bytes.Buffer, val interface{}) {
+	switch val := val.(type) {
+	case string:
+		buf.WriteByte(2<<5 | byte(len(val)))
+		buf.WriteString(val)
+	case uint64:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], val)
+		trimmed := bytes.TrimLeft(b[:], "\x00")
+		// uint64 is an extended type.
+		buf.WriteByte(byte(len(trimmed)))
+		buf.WriteByte(9 - 7)
+		buf.Write(trimmed)
+	case map[string]interface{}:
+		buf.WriteByte(7<<5 | byte(len(val)))
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeData(buf, k)
+			encodeData(buf, val[k])
+		}
+	default:
+		panic("unsupported type")
+	}
+}
+
+type testNode struct {
+	// Either child node index (>= 0), -1 for empty record or
+	// -(dataIdx + 2) for data.
+	children [2]int
+}
+
+// buildMMDB builds the MaxMind DB file with the specified prefixes.
+func buildMMDB(t *testing.T, ipVersion, recordSize int, prefixes map[string]map[string]interface{}) []byte {
+	t.Helper()
+
+	nodes := []testNode{{children: [2]int{-1, -1}}}
+	var data bytes.Buffer
+	var dataOffsets []int
+
+	for prefix, val := range prefixes {
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		addr := []byte(ipNet.IP.To16())
+		if ipNet.IP.To4() != nil {
+			if ipVersion == 4 {
+				addr = ipNet.IP.To4()
+			} else {
+				addr = append(make([]byte, 12), ipNet.IP.To4()...)
+				ones += 96
+			}
+		}
+
+		dataOffsets = append(dataOffsets, data.Len())
+		encodeData(&data, val)
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := (addr[i/8] >> (7 - uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node].children[bit] = -(len(dataOffsets) - 1 + 2)
+				break
+			}
+			if nodes[node].children[bit] < 0 {
+				nodes = append(nodes, testNode{children: [2]int{-1, -1}})
+				nodes[node].children[bit] = len(nodes) - 1
+			}
+			node = nodes[node].children[bit]
+		}
+	}
+
+	var buf bytes.Buffer
+	nodeCount := len(nodes)
+	recordVal := func(child int) uint64 {
+		switch {
+		case child >= 0:
+			return uint64(child)
+		case child == -1:
+			return uint64(nodeCount)
+		default:
+			return uint64(nodeCount + 16 + dataOffsets[-child-2])
+		}
+	}
+	for _, n := range nodes {
+		left, right := recordVal(n.children[0]), recordVal(n.children[1])
+		switch recordSize {
+		case 24:
+			buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left),
+				byte(left>>24)<<4 | byte(right>>24)&0x0F,
+				byte(right >> 16), byte(right >> 8), byte(right)})
+		default:
+			t.Fatal("unsupported record size")
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.Write(metadataMarker)
+	encodeData(&buf, map[string]interface{}{
+		"node_count":    uint64(nodeCount),
+		"record_size":   uint64(recordSize),
+		"ip_version":    uint64(ipVersion),
+		"database_type": "Test",
+	})
+	return buf.Bytes()
+}
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": code,
+		},
+	}
+}
+
+func TestCountryLookup(t *testing.T) {
+	for _, tc := range []struct {
+		ipVersion, recordSize int
+	}{{4, 24}, {4, 28}, {6, 24}, {6, 28}} {
+		db, err := maxminddb.FromBytes(buildMMDB(t, tc.ipVersion, tc.recordSize, map[string]map[string]interface{}{
+			"192.0.2.0/24":    country("XX"),
+			"198.51.100.0/25": country("YY"),
+			"203.0.113.0/24": {
+				"registered_country": map[string]interface{}{
+					"iso_code": "ZZ",
+				},
+			},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Check{countryDB: &dbFile{db: db}}
+
+		for ip, code := range map[string]string{
+			"192.0.2.1":      "XX",
+			"192.0.2.255":    "XX",
+			"198.51.100.1":   "YY",
+			"198.51.100.200": "",
+			"203.0.113.1":    "ZZ",
+			"233.252.0.1":    "",
+		} {
+			got, err := c.country(net.ParseIP(ip))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != code {
+				t.Errorf("%d/%d: wrong country for %s: %q", tc.ipVersion, tc.recordSize, ip, got)
+			}
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	countryPath := filepath.Join(dir, "country.mmdb")
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	if err := ioutil.WriteFile(countryPath, buildMMDB(t, 6, 24, map[string]map[string]interface{}{
+		"192.0.2.0/24":    country("XX"),
+		"198.51.100.0/24": country("YY"),
+		"2001:db8::/32":   country("XX"),
+	}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(asnPath, buildMMDB(t, 4, 28, map[string]map[string]interface{}{
+		"192.0.2.0/24": {"autonomous_system_number": uint64(64496)},
+	}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	err = c.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "country_db", Args: []string{countryPath}},
+		{Name: "asn_db", Args: []string{asnPath}},
+		{Name: "country", Args: []string{"xx", "reject"}},
+		{Name: "country", Args: []string{"YY", "score", "3"}},
+		{Name: "asn", Args: []string{"AS64496", "score", "5"}},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	test := func(ip string, reject bool, score int) {
+		t.Helper()
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			ID: "test",
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckConnection(context.Background())
+		if res.Reject != reject {
+			t.Errorf("%s: Reject = %v, want %v", ip, res.Reject, reject)
+		}
+		if res.Score != score {
+			t.Errorf("%s: Score = %v, want %v", ip, res.Score, score)
+		}
+	}
+
+	test("192.0.2.1", true, 5)
+	test("198.51.100.1", false, 3)
+	test("203.0.113.1", false, 0)
+	test("2001:db8::1", true, 0)
+
+	// Replace the database, it should be reloaded.
+	if err := ioutil.WriteFile(countryPath, buildMMDB(t, 6, 24, map[string]map[string]interface{}{
+		"203.0.113.0/24": country("YY"),
+	}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(countryPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.countryDB.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	test("198.51.100.1", false, 0)
+	test("203.0.113.1", false, 3)
+}
@@ -0,0 +1,230 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package helo_syntax implements a check that rejects clients using
+// malformed or forged HELO/EHLO hostnames.
+//
+// The check does not do any DNS lookups so it is a cheap way to filter out
+// a lot of botnet traffic.
+package helo_syntax
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.helo_syntax"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	hostname          string
+	rejectBareIP      bool
+	rejectNonFQDN     bool
+	rejectOwnHostname bool
+	failAction        modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, false, "", &c.hostname)
+	cfg.Bool("reject_bare_ip", false, true, &c.rejectBareIP)
+	cfg.Bool("reject_non_fqdn", false, true, &c.rejectNonFQDN)
+	cfg.Bool("reject_own_hostname", false, true, &c.rejectOwnHostname)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.rejectOwnHostname && c.hostname == "" {
+		return fmt.Errorf("%s: hostname is required for reject_own_hostname", modName)
+	}
+	return nil
+}
+
+// violation returns the description of the problem with the HELO hostname.
+// Empty string is returned if it is fine.
+func (c *Check) violation(helo string) string {
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		if !validAddrLiteral(helo[1 : len(helo)-1]) {
+			return "Malformed address literal in EHLO"
+		}
+		return ""
+	}
+
+	if net.ParseIP(helo) != nil {
+		if c.rejectBareIP {
+			return "IP address in EHLO should be enclosed in brackets"
+		}
+		return ""
+	}
+
+	if !validHostname(helo) {
+		return "Malformed EHLO hostname"
+	}
+
+	if c.rejectNonFQDN && !strings.Contains(strings.TrimSuffix(helo, "."), ".") {
+		return "EHLO hostname should be a fully qualified domain name"
+	}
+
+	if c.rejectOwnHostname && dns.Equal(strings.TrimSuffix(helo, "."), c.hostname) {
+		return "EHLO hostname is the same as the server hostname"
+	}
+
+	return ""
+}
+
+// validAddrLiteral checks the contents of the RFC 5321 address literal.
+func validAddrLiteral(lit string) bool {
+	if strings.HasPrefix(lit, "IPv6:") {
+		ip := net.ParseIP(strings.TrimPrefix(lit, "IPv6:"))
+		return ip != nil && ip.To4() == nil
+	}
+	ip := net.ParseIP(lit)
+	return ip != nil && ip.To4() != nil
+}
+
+// validHostname checks the hostname syntax as defined by RFC 1123 with
+// underscores permitted as they are commonly seen in real-world hostnames.
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			switch {
+			case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z':
+			case ch >= '0' && ch <= '9':
+			case ch == '-', ch == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *Check) checkHELO(helo string) error {
+	msg := c.violation(helo)
+	if msg == "" {
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      msg,
+		CheckName:    modName,
+		Misc: map[string]interface{}{
+			"helo": helo,
+		},
+	}
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally-generated message, skipping")
+		return module.CheckResult{}
+	}
+	// Submission clients often use non-FQDN hostnames.
+	if s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+
+	if err := s.c.checkHELO(s.msgMeta.Conn.Hostname); err != nil {
+		return s.c.failAction.Apply(module.CheckResult{Reason: err})
+	}
+	s.log.DebugMsg("ok")
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
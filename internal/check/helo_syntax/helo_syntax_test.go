@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package helo_syntax
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestHELOSyntax(t *testing.T) {
+	test := func(cfg []config.Node, helo, authUser string, fail bool) {
+		t.Helper()
+
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := mod.(*Check)
+		c.log = testutils.Logger(t, modName)
+		cfg = append(cfg, config.Node{Name: "hostname", Args: []string{"mx.example.org"}})
+		if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			ID: "test",
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{Hostname: helo},
+				AuthUser:        authUser,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckConnection(context.Background())
+		if fail && res.Reason == nil {
+			t.Errorf("Expected check to fail for %q", helo)
+		}
+		if !fail && res.Reason != nil {
+			t.Errorf("Unexpected failure for %q: %v", helo, res.Reason)
+		}
+	}
+
+	test(nil, "mail.example.com", "", false)
+	test(nil, "mail.example.com.", "", false)
+	test(nil, "mail_1.example.com", "", false)
+	test(nil, "[192.0.2.1]", "", false)
+	test(nil, "[IPv6:2001:db8::1]", "", false)
+
+	test(nil, "192.0.2.1", "", true)
+	test(nil, "localhost", "", true)
+	test(nil, "MX.EXAMPLE.ORG", "", true)
+	test(nil, "mx.example.org.", "", true)
+	test(nil, "mail..example.com", "", true)
+	test(nil, "-mail.example.com", "", true)
+	test(nil, "mail$.example.com", "", true)
+	test(nil, "[999.0.2.1]", "", true)
+	test(nil, "[IPv6:192.0.2.1]", "", true)
+
+	// Authenticated clients are not checked.
+	test(nil, "laptop", "user", false)
+
+	cfg := []config.Node{
+		{Name: "reject_bare_ip", Args: []string{"no"}},
+		{Name: "reject_non_fqdn", Args: []string{"no"}},
+		{Name: "reject_own_hostname", Args: []string{"no"}},
+	}
+	test(cfg, "192.0.2.1", "", false)
+	test(cfg, "localhost", "", false)
+	test(cfg, "mx.example.org", "", false)
+	test(cfg, "mail$.example.com", "", true)
+}
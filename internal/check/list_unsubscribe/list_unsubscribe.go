@@ -0,0 +1,219 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package list_unsubscribe
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.list_unsubscribe"
+
+// Check verifies that bulk messages provide the unsubscription
+// mechanism as defined by RFC 2369 and RFC 8058.
+type Check struct {
+	instName string
+	log      log.Logger
+
+	requireOneClick bool
+	requireDKIM     bool
+	failAction      modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Bool("require_one_click", false, true, &c.requireOneClick)
+	cfg.Bool("require_dkim", false, true, &c.requireDKIM)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	_, err := cfg.Process()
+	return err
+}
+
+// isBulk checks whether the message looks like it is sent to a mailing
+// list or as a part of a bulk campaign.
+func isBulk(hdr textproto.Header) bool {
+	switch strings.ToLower(strings.TrimSpace(hdr.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return true
+	}
+	return hdr.Has("List-Id") || hdr.Has("List-Unsubscribe")
+}
+
+// unsubscribeURIs returns URIs listed in the List-Unsubscribe field.
+func unsubscribeURIs(value string) []string {
+	var uris []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "<") || !strings.HasSuffix(part, ">") {
+			continue
+		}
+		uris = append(uris, strings.TrimSpace(part[1:len(part)-1]))
+	}
+	return uris
+}
+
+// dkimCovers checks whether any DKIM-Signature field in the header lists
+// all specified fields in its h= tag.
+//
+// The signature itself is not verified, check.dkim is responsible for that.
+func dkimCovers(hdr textproto.Header, fields ...string) bool {
+	for sigs := hdr.FieldsByKey("DKIM-Signature"); sigs.Next(); {
+		signed := make(map[string]bool)
+		for _, tag := range strings.Split(sigs.Value(), ";") {
+			tag = strings.TrimSpace(tag)
+			if !strings.HasPrefix(tag, "h=") {
+				continue
+			}
+			for _, key := range strings.Split(tag[2:], ":") {
+				signed[strings.ToLower(strings.Join(strings.Fields(key), ""))] = true
+			}
+		}
+
+		covered := true
+		for _, f := range fields {
+			if !signed[strings.ToLower(f)] {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+// violation returns the description of the problem with the unsubscription
+// header fields. Empty string is returned if the message is fine or is not
+// a bulk message.
+func (c *Check) violation(hdr textproto.Header) string {
+	if !isBulk(hdr) {
+		return ""
+	}
+
+	var hasHTTPS, hasMailto bool
+	for _, uri := range unsubscribeURIs(hdr.Get("List-Unsubscribe")) {
+		lower := strings.ToLower(uri)
+		switch {
+		case strings.HasPrefix(lower, "https://"):
+			hasHTTPS = true
+		case strings.HasPrefix(lower, "mailto:"):
+			hasMailto = true
+		}
+	}
+	if !hasHTTPS && !hasMailto {
+		return "Bulk message without a valid List-Unsubscribe header field"
+	}
+	if !c.requireOneClick {
+		return ""
+	}
+
+	if !hasHTTPS {
+		return "List-Unsubscribe header field has no HTTPS URI"
+	}
+	if !strings.EqualFold(strings.TrimSpace(hdr.Get("List-Unsubscribe-Post")), "List-Unsubscribe=One-Click") {
+		return "Missing or invalid List-Unsubscribe-Post header field"
+	}
+	if c.requireDKIM && !dkimCovers(hdr, "List-Unsubscribe", "List-Unsubscribe-Post") {
+		return "List-Unsubscribe header fields are not covered by a DKIM signature"
+	}
+	return ""
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	msg := s.c.violation(hdr)
+	if msg == "" {
+		s.log.DebugMsg("ok")
+		return module.CheckResult{}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      msg,
+			CheckName:    modName,
+		},
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
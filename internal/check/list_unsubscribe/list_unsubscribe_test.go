@@ -0,0 +1,81 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package list_unsubscribe
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestListUnsubscribe(t *testing.T) {
+	test := func(cfg []config.Node, hdr string, fail bool) {
+		t.Helper()
+
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := mod.(*Check)
+		c.log = testutils.Logger(t, modName)
+		if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, body := testutils.BodyFromStr(t, "From: <a@example.org>\r\n"+hdr+"\r\nHello!\r\n")
+		res := s.CheckBody(context.Background(), h, body)
+		if fail && res.Reason == nil {
+			t.Error("Expected check to fail")
+		}
+		if !fail && res.Reason != nil {
+			t.Error("Unexpected failure:", res.Reason)
+		}
+	}
+
+	const (
+		unsub = "List-Unsubscribe: <mailto:u@example.org>, <https://example.org/u?id=1>\r\n"
+		post  = "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n"
+		sig   = "DKIM-Signature: v=1; a=rsa-sha256; d=example.org; s=default;\r\n" +
+			" h=From:Subject:List-Unsubscribe:\r\n List-Unsubscribe-Post; bh=AAAA; b=AAAA\r\n"
+	)
+
+	// Not a bulk message.
+	test(nil, "Subject: hi\r\n", false)
+
+	test(nil, "Precedence: bulk\r\n", true)
+	test(nil, "List-Id: <list.example.org>\r\n"+unsub+post+sig, false)
+	test(nil, "List-Id: <list.example.org>\r\n"+unsub+post, true)
+	test(nil, "List-Id: <list.example.org>\r\n"+unsub+sig, true)
+	test(nil, "List-Unsubscribe: <mailto:u@example.org>\r\n"+post+sig, true)
+	test(nil, "List-Unsubscribe: garbage\r\n", true)
+
+	cfg := []config.Node{{Name: "require_one_click", Args: []string{"no"}}}
+	test(cfg, "List-Unsubscribe: <mailto:u@example.org>\r\n", false)
+	test(cfg, "Precedence: list\r\n", true)
+
+	cfg = []config.Node{{Name: "require_dkim", Args: []string{"no"}}}
+	test(cfg, "List-Id: <list.example.org>\r\n"+unsub+post, false)
+}
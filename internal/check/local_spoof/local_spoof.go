@@ -0,0 +1,306 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package local_spoof implements a check that rejects unauthenticated
+// messages using one of the locally hosted domains as the sender.
+//
+// Such messages are accepted only if the domain usage is authenticated
+// using SPF or DKIM, in a way similar to DMARC.
+package local_spoof
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.local_spoof"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	domains    map[string]struct{}
+	checkFrom  bool
+	failAction modconfig.FailAction
+
+	resolver dns.Resolver
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var domains []string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("domains", false, true, nil, &domains)
+	cfg.Bool("check_from", false, true, &c.checkFrom)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.domains = make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		norm, err := dns.ForLookup(d)
+		if err != nil {
+			return fmt.Errorf("%s: invalid domain %s: %w", modName, d, err)
+		}
+		c.domains[norm] = struct{}{}
+	}
+	return nil
+}
+
+// localDomain returns the normalized domain of the address if it is one
+// of the protected domains.
+func (c *Check) localDomain(addr string) (string, bool) {
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return "", false
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return "", false
+	}
+	_, ok := c.domains[domain]
+	return domain, ok
+}
+
+// aligned checks whether domains are equal or one is a subdomain of another,
+// approximating DMARC relaxed alignment.
+func aligned(a, b string) bool {
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	skip bool
+
+	mailFromDomain string
+	mailFromLocal  bool
+	spfPass        bool
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally-generated message, skipping")
+		s.skip = true
+		return module.CheckResult{}
+	}
+	if s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		s.skip = true
+		return module.CheckResult{}
+	}
+
+	s.mailFromDomain, s.mailFromLocal = s.c.localDomain(addr)
+	if !s.mailFromLocal {
+		return module.CheckResult{}
+	}
+
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return module.CheckResult{}
+	}
+	res, err := spf.CheckHostWithSender(tcpAddr.IP, s.msgMeta.Conn.Hostname, addr,
+		spf.WithContext(ctx), spf.WithResolver(s.c.resolver))
+	if err != nil {
+		s.log.DebugMsg("SPF evaluation failed", "reason", err.Error())
+	}
+	s.spfPass = res == spf.Pass
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// dkimDomains returns domains of valid DKIM signatures on the message.
+func (s *state) dkimDomains(ctx context.Context, hdr textproto.Header, body buffer.Buffer) ([]string, error) {
+	if !hdr.Has("DKIM-Signature") {
+		return nil, nil
+	}
+
+	b := bytes.Buffer{}
+	_ = textproto.WriteHeader(&b, hdr)
+	bodyRdr, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyRdr.Close()
+
+	verifs, err := dkim.VerifyWithOptions(io.MultiReader(&b, bodyRdr), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return s.c.resolver.LookupTXT(ctx, domain)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make([]string, 0, len(verifs))
+	for _, verif := range verifs {
+		if verif.Err != nil {
+			continue
+		}
+		domain, err := dns.ForLookup(verif.Domain)
+		if err != nil {
+			continue
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// fromDomains returns the protected domains used in the From header field.
+func (s *state) fromDomains(hdr textproto.Header) []string {
+	list, err := mail.ParseAddressList(hdr.Get("From"))
+	if err != nil {
+		// Malformed header fields are handled by other checks.
+		return nil
+	}
+	var domains []string
+	for _, addr := range list {
+		if domain, ok := s.c.localDomain(addr.Address); ok {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	if s.skip {
+		return module.CheckResult{}
+	}
+
+	var fromDomains []string
+	if s.c.checkFrom {
+		fromDomains = s.fromDomains(hdr)
+	}
+	if (!s.mailFromLocal || s.spfPass) && len(fromDomains) == 0 {
+		return module.CheckResult{}
+	}
+
+	dkimDomains, err := s.dkimDomains(ctx, hdr, body)
+	if err != nil {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+		}
+	}
+	dkimAligned := func(domain string) bool {
+		for _, d := range dkimDomains {
+			if aligned(d, domain) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if s.mailFromLocal && !s.spfPass && !dkimAligned(s.mailFromDomain) {
+		return s.fail("MAIL FROM", s.mailFromDomain)
+	}
+	for _, domain := range fromDomains {
+		spfAligned := s.spfPass && aligned(s.mailFromDomain, domain)
+		if !spfAligned && !dkimAligned(domain) {
+			return s.fail("From", domain)
+		}
+	}
+
+	s.log.DebugMsg("ok")
+	return module.CheckResult{}
+}
+
+func (s *state) fail(field, domain string) module.CheckResult {
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Unauthenticated use of a local domain",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"field":  field,
+				"domain": domain,
+			},
+		},
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
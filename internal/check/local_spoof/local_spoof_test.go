@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package local_spoof
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestLocalSpoof(t *testing.T) {
+	test := func(checkFrom bool, ip, authUser, mailFrom, fromHdr string, fail bool) {
+		t.Helper()
+
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := mod.(*Check)
+		c.log = testutils.Logger(t, modName)
+		c.resolver = &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"example.org.": {
+				TXT: []string{"v=spf1 ip4:192.0.2.1 -all"},
+			},
+		}}
+		cfg := []config.Node{
+			{Name: "domains", Args: []string{"example.org", "EXAMPLE.NET"}},
+		}
+		if !checkFrom {
+			cfg = append(cfg, config.Node{Name: "check_from", Args: []string{"no"}})
+		}
+		if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			ID: "test",
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					Hostname:   "mx.example.com",
+					RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+				},
+				AuthUser: authUser,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		res := s.CheckConnection(context.Background())
+		if res.Reason == nil {
+			res = s.CheckSender(context.Background(), mailFrom)
+		}
+		if res.Reason == nil {
+			hdr, body := testutils.BodyFromStr(t, "From: "+fromHdr+"\r\n\r\nHello!\r\n")
+			res = s.CheckBody(context.Background(), hdr, body)
+		}
+		if fail && res.Reason == nil {
+			t.Error("Expected check to fail")
+		}
+		if !fail && res.Reason != nil {
+			t.Error("Unexpected failure:", res.Reason)
+		}
+	}
+
+	// Spoofed MAIL FROM.
+	test(true, "203.0.113.1", "", "spammer@example.org", "<spammer@example.com>", true)
+	test(true, "203.0.113.1", "", "spammer@example.net", "<spammer@example.com>", true)
+	// SPF passes.
+	test(true, "192.0.2.1", "", "user@example.org", "<user@example.org>", false)
+	// Authenticated submission.
+	test(true, "203.0.113.1", "user", "user@example.org", "<user@example.org>", false)
+	// Spoofed From.
+	test(true, "203.0.113.1", "", "spammer@example.com", "<ceo@example.org>", true)
+	test(false, "203.0.113.1", "", "spammer@example.com", "<ceo@example.org>", false)
+	// SPF passes, but for an unrelated domain.
+	test(true, "192.0.2.1", "", "user@example.org", "<ceo@example.net>", true)
+	// Not a local domain.
+	test(true, "203.0.113.1", "", "user@example.com", "<user@example.com>", false)
+	test(true, "203.0.113.1", "", "", "<user@example.com>", false)
+}
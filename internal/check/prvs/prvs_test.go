@@ -0,0 +1,74 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package prvs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCheck(t *testing.T) {
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "secret", Args: []string{"secret"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+
+	tagged, err := c.signer.Sign("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := func(mailFrom, rcpt string, fail bool) {
+		t.Helper()
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.CheckConnection(context.Background())
+		s.CheckSender(context.Background(), mailFrom)
+		res := s.CheckRcpt(context.Background(), rcpt)
+		if fail && !res.Reject {
+			t.Errorf("Expected %s -> %s to be rejected", mailFrom, rcpt)
+		}
+		if !fail && res.Reject {
+			t.Errorf("Unexpected rejection for %s -> %s: %v", mailFrom, rcpt, res.Reason)
+		}
+	}
+
+	test("", tagged, false)
+	test("", "test@example.org", false)
+	test("", "prvs=0000000000=test@example.org", true)
+	test("", "prvs=garbage=test@example.org", true)
+	// Non-bounces are not checked.
+	test("sender@example.com", "prvs=0000000000=test@example.org", false)
+}
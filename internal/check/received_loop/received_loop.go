@@ -0,0 +1,232 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package received_loop
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.received_loop"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	maxHops        int
+	matchHostnames bool
+	hostnames      map[string]struct{}
+	failAction     modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		hostname  string
+		hostnames []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.StringList("hostnames", false, false, nil, &hostnames)
+	cfg.Int("max_received_hops", false, false, 30, &c.maxHops)
+	cfg.Bool("match_hostnames", false, true, &c.matchHostnames)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.maxHops <= 0 {
+		return fmt.Errorf("%s: max_received_hops should be positive", modName)
+	}
+
+	c.hostnames = make(map[string]struct{}, len(hostnames)+1)
+	if hostname != "" {
+		hostnames = append(hostnames, hostname)
+	}
+	for _, name := range hostnames {
+		name, err := normalizeDomain(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		c.hostnames[name] = struct{}{}
+	}
+	if c.matchHostnames && len(c.hostnames) == 0 {
+		return fmt.Errorf("%s: match_hostnames requires hostname or hostnames to be set", modName)
+	}
+	return nil
+}
+
+func normalizeDomain(domain string) (string, error) {
+	domain, err := dns.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(domain), nil
+}
+
+// stripComments removes (possibly nested) comments from the header field
+// value.
+func stripComments(value string) string {
+	var (
+		sb    strings.Builder
+		depth int
+		esc   bool
+	)
+	for _, r := range value {
+		switch {
+		case esc:
+			esc = false
+		case r == '\\' && depth > 0:
+			esc = true
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+			sb.WriteRune(' ')
+		case depth == 0:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// receivedBy returns the domain from the "by" clause of the Received field
+// value. Empty string is returned if there is no such clause.
+func receivedBy(value string) string {
+	// Date is separated by ';' and never contains the clause.
+	if i := strings.LastIndexByte(value, ';'); i != -1 {
+		value = value[:i]
+	}
+	words := strings.Fields(stripComments(value))
+	for i := 0; i < len(words)-1; i++ {
+		if strings.EqualFold(words[i], "by") {
+			return words[i+1]
+		}
+	}
+	return ""
+}
+
+// violation returns the description of the problem found in the header.
+// Empty string is returned if the header is fine.
+func (c *Check) violation(hdr textproto.Header) string {
+	hops, ownHops := 0, 0
+	for field := hdr.FieldsByKey("Received"); field.Next(); {
+		hops++
+		if !c.matchHostnames {
+			continue
+		}
+		by, err := normalizeDomain(receivedBy(field.Value()))
+		if err != nil || by == "" {
+			continue
+		}
+		if _, ok := c.hostnames[by]; ok {
+			ownHops++
+		}
+	}
+
+	if hops > c.maxHops {
+		return fmt.Sprintf("Too many Received header fields (%d), possible forwarding loop", hops)
+	}
+	if ownHops > 1 {
+		return fmt.Sprintf("Message already passed through this server %d times, possible forwarding loop", ownHops)
+	}
+	return ""
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	msg := s.c.violation(hdr)
+	if msg == "" {
+		s.log.DebugMsg("ok")
+		return module.CheckResult{}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+			Message:      msg,
+			CheckName:    modName,
+		},
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,94 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package received_loop
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestReceivedBy(t *testing.T) {
+	for value, by := range map[string]string{
+		"from a.example.org (b.example.org [10.0.0.1]) by mx.example.org (envelope-sender <a@example.org>) with ESMTP id 123; Fri, 11 Jul 2003 21:00:37 -0700": "mx.example.org",
+		"from a.example.org (by fake.example.org) by mx.example.org; date":                                                                                     "mx.example.org",
+		"from a.example.org\r\n\tby\r\n\tmx.example.org with ESMTP":                                                                                            "mx.example.org",
+		"from a.example.org with ESMTP; by.example.org":                                                                                                        "",
+		"": "",
+	} {
+		if got := receivedBy(value); got != by {
+			t.Errorf("receivedBy(%q) = %q, want %q", value, got, by)
+		}
+	}
+}
+
+func TestReceivedLoop(t *testing.T) {
+	test := func(cfg []config.Node, hdr string, fail bool) {
+		t.Helper()
+
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := mod.(*Check)
+		c.log = testutils.Logger(t, modName)
+		if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, body := testutils.BodyFromStr(t, hdr+"From: <a@example.org>\r\n\r\nHello!\r\n")
+		res := s.CheckBody(context.Background(), h, body)
+		if fail && res.Reason == nil {
+			t.Error("Expected check to fail")
+		}
+		if !fail && res.Reason != nil {
+			t.Error("Unexpected failure:", res.Reason)
+		}
+	}
+
+	received := func(by string) string {
+		return "Received: from a.example.org by " + by + " with ESMTP; Fri, 11 Jul 2003 21:00:37 -0700\r\n"
+	}
+
+	cfg := []config.Node{
+		{Name: "hostname", Args: []string{"mx.example.org"}},
+		{Name: "max_received_hops", Args: []string{"3"}},
+	}
+	test(cfg, "", false)
+	test(cfg, received("a.example.com")+received("b.example.com")+received("c.example.com"), false)
+	test(cfg, strings.Repeat(received("a.example.com"), 4), true)
+	test(cfg, received("mx.example.org")+received("a.example.com"), false)
+	test(cfg, received("MX.example.org.")+received("a.example.com")+received("mx.example.org"), true)
+
+	// Additional names.
+	test(append(cfg, config.Node{Name: "hostnames", Args: []string{"mx2.example.org"}}),
+		received("mx2.example.org")+received("mx.example.org"), true)
+
+	// Hostname matching disabled.
+	test(append(cfg, config.Node{Name: "match_hostnames", Args: []string{"no"}}),
+		received("mx.example.org")+received("mx.example.org"), false)
+}
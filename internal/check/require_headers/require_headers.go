@@ -0,0 +1,173 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package require_headers
+
+import (
+	"context"
+	"fmt"
+	nettextproto "net/textproto"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.require_headers"
+
+var (
+	// RFC 5322, Section 3.6. Fields that should occur exactly once.
+	exactlyOnceDefault = []string{"From", "Date"}
+
+	// RFC 5322, Section 3.6. Fields that should occur at most once.
+	noDuplicatesDefault = []string{
+		"Sender", "Reply-To", "To", "Cc", "Bcc", "Message-Id",
+		"In-Reply-To", "References", "Subject",
+	}
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	exactlyOnce  []string
+	noDuplicates []string
+	failAction   modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("exactly_once", false, false, exactlyOnceDefault, &c.exactlyOnce)
+	cfg.StringList("no_duplicates", false, false, noDuplicatesDefault, &c.noDuplicates)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for i, field := range c.exactlyOnce {
+		c.exactlyOnce[i] = nettextproto.CanonicalMIMEHeaderKey(field)
+	}
+	for i, field := range c.noDuplicates {
+		c.noDuplicates[i] = nettextproto.CanonicalMIMEHeaderKey(field)
+	}
+	return nil
+}
+
+// violation returns the description of the first problem found in the
+// header. Empty string is returned if the header is fine.
+func (c *Check) violation(hdr textproto.Header) string {
+	count := func(key string) int {
+		n := 0
+		for field := hdr.FieldsByKey(key); field.Next(); {
+			n++
+		}
+		return n
+	}
+
+	for _, key := range c.exactlyOnce {
+		switch n := count(key); {
+		case n == 0:
+			return fmt.Sprintf("Missing %s header field", key)
+		case n > 1:
+			return fmt.Sprintf("Multiple %s header fields", key)
+		}
+	}
+	for _, key := range c.noDuplicates {
+		if count(key) > 1 {
+			return fmt.Sprintf("Multiple %s header fields", key)
+		}
+	}
+	return ""
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	msg := s.c.violation(hdr)
+	if msg == "" {
+		s.log.DebugMsg("ok")
+		return module.CheckResult{}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      msg,
+			CheckName:    modName,
+		},
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
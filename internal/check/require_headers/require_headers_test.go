@@ -0,0 +1,74 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package require_headers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestRequireHeaders(t *testing.T) {
+	test := func(cfg []config.Node, hdr string, fail bool) {
+		t.Helper()
+
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := mod.(*Check)
+		c.log = testutils.Logger(t, modName)
+		if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, body := testutils.BodyFromStr(t, hdr+"\r\nHello!\r\n")
+		res := s.CheckBody(context.Background(), h, body)
+		if fail && res.Reason == nil {
+			t.Error("Expected check to fail")
+		}
+		if !fail && res.Reason != nil {
+			t.Error("Unexpected failure:", res.Reason)
+		}
+	}
+
+	const date = "Date: Fri, 11 Jul 2003 21:00:37 -0700\r\n"
+
+	test(nil, "From: <a@example.org>\r\n"+date+"Subject: hi\r\n", false)
+	test(nil, "From: <a@example.org>\r\n"+"Subject: hi\r\n", true)
+	test(nil, date+"Subject: hi\r\n", true)
+	test(nil, "From: <a@example.org>\r\nFrom: <b@example.org>\r\n"+date, true)
+	test(nil, "From: <a@example.org>\r\n"+date+"Subject: hi\r\nSubject: hello\r\n", true)
+	test(nil, "From: <a@example.org>\r\n"+date+"Received: a\r\nReceived: b\r\n", false)
+
+	// Custom lists.
+	cfg := []config.Node{
+		{Name: "exactly_once", Args: []string{"from"}},
+		{Name: "no_duplicates", Args: []string{"x-custom"}},
+	}
+	test(cfg, "From: <a@example.org>\r\nSubject: hi\r\nSubject: hello\r\n", false)
+	test(cfg, "From: <a@example.org>\r\nX-Custom: 1\r\nX-Custom: 2\r\n", true)
+}
@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sample implements check.sample module that runs another check
+// against the beginning of the message body only.
+//
+// It allows to use content checks that are too expensive to run on whole
+// large messages. The body is not read past the sample size.
+//
+// Interfaces implemented:
+// - module.Check
+// - module.EarlyCheck (forwarded to the wrapped check)
+// - module.SpamLearner (forwarded to the wrapped check)
+package sample
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "check.sample"
+
+type Check struct {
+	instName   string
+	inlineArgs []string
+
+	size  int
+	check module.Check
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) < 2 {
+		return nil, fmt.Errorf("%s: sample size and check are required", modName)
+	}
+	return &Check{
+		instName:   instName,
+		inlineArgs: inlineArgs,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var err error
+	c.size, err = config.ParseDataSize(c.inlineArgs[0])
+	if err != nil {
+		return fmt.Errorf("%s: malformed sample size: %v", modName, err)
+	}
+	if c.size <= 0 {
+		return fmt.Errorf("%s: sample size should be positive", modName)
+	}
+
+	return modconfig.ModuleFromNode("check", c.inlineArgs[1:], cfg.Block, cfg.Globals, &c.check)
+}
+
+// CheckConnection runs the early check of the wrapped module, if it has one.
+func (c *Check) CheckConnection(ctx context.Context, state *smtp.ConnectionState) error {
+	earlyCheck, ok := c.check.(module.EarlyCheck)
+	if !ok {
+		return nil
+	}
+	return earlyCheck.CheckConnection(ctx, state)
+}
+
+// Learn trains the wrapped module using the same body prefix that is used
+// for checks.
+func (c *Check) Learn(ctx context.Context, hdr textproto.Header, body io.Reader, spam bool) error {
+	learner, ok := c.check.(module.SpamLearner)
+	if !ok {
+		return fmt.Errorf("%s: wrapped check does not support learning", modName)
+	}
+	return learner.Learn(ctx, hdr, io.LimitReader(body, int64(c.size)), spam)
+}
+
+type state struct {
+	c     *Check
+	state module.CheckState
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	s, err := c.check.CheckStateForMsg(ctx, msgMeta)
+	if err != nil {
+		return nil, err
+	}
+	return &state{
+		c:     c,
+		state: s,
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return s.state.CheckConnection(ctx)
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return s.state.CheckSender(ctx, addr)
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return s.state.CheckRcpt(ctx, addr)
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return s.state.CheckBody(ctx, hdr, buffer.Limit(body, s.c.size))
+}
+
+func (s *state) Close() error {
+	return s.state.Close()
+}
+
+func init() {
+	module.Register(modName, New)
+}
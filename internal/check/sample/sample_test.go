@@ -0,0 +1,161 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sample
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type bodyCheck struct {
+	body string
+}
+
+func (c *bodyCheck) Name() string         { return "body_check" }
+func (c *bodyCheck) InstanceName() string { return "body_check" }
+func (c *bodyCheck) CheckStateForMsg(context.Context, *module.MsgMetadata) (module.CheckState, error) {
+	return &bodyState{c: c}, nil
+}
+
+type bodyState struct {
+	c *bodyCheck
+}
+
+func (s *bodyState) CheckConnection(context.Context) module.CheckResult { return module.CheckResult{} }
+func (s *bodyState) CheckSender(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+func (s *bodyState) CheckRcpt(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+func (s *bodyState) Close() error { return nil }
+
+func (s *bodyState) CheckBody(_ context.Context, _ textproto.Header, body buffer.Buffer) module.CheckResult {
+	r, err := body.Open()
+	if err != nil {
+		panic(err)
+	}
+	defer r.Close()
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		panic(err)
+	}
+	if len(blob) != body.Len() {
+		panic("Len does not match the amount of bytes read")
+	}
+	s.c.body = string(blob)
+	return module.CheckResult{}
+}
+
+// readerBuffer is a buffer.Buffer that is not a MemoryBuffer.
+type readerBuffer struct {
+	s string
+}
+
+func (b readerBuffer) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(b.s)), nil
+}
+
+func (b readerBuffer) Len() int {
+	return len(b.s)
+}
+
+func (b readerBuffer) Remove() error {
+	return nil
+}
+
+func TestSample(t *testing.T) {
+	test := func(body buffer.Buffer, size int, expected string) {
+		t.Helper()
+
+		inner := &bodyCheck{}
+		c := &Check{size: size, check: inner}
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		s.CheckBody(context.Background(), textproto.Header{}, body)
+
+		if inner.body != expected {
+			t.Errorf("wrong body passed to the check: %q, expected %q", inner.body, expected)
+		}
+	}
+
+	test(buffer.MemoryBuffer{Slice: []byte("0123456789")}, 4, "0123")
+	test(buffer.MemoryBuffer{Slice: []byte("0123456789")}, 20, "0123456789")
+	test(readerBuffer{s: "0123456789"}, 4, "0123")
+	test(readerBuffer{s: "0123456789"}, 10, "0123456789")
+}
+
+type learnerCheck struct {
+	bodyCheck
+	connChecked bool
+	learned     string
+}
+
+func (c *learnerCheck) CheckConnection(context.Context, *smtp.ConnectionState) error {
+	c.connChecked = true
+	return nil
+}
+
+func (c *learnerCheck) Learn(_ context.Context, _ textproto.Header, body io.Reader, _ bool) error {
+	blob, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	c.learned = string(blob)
+	return nil
+}
+
+func TestSample_Forward(t *testing.T) {
+	inner := &learnerCheck{}
+	c := &Check{size: 4, check: inner}
+
+	if err := c.CheckConnection(context.Background(), &smtp.ConnectionState{}); err != nil {
+		t.Fatal(err)
+	}
+	if !inner.connChecked {
+		t.Error("CheckConnection is not forwarded")
+	}
+
+	if err := c.Learn(context.Background(), textproto.Header{}, strings.NewReader("0123456789"), true); err != nil {
+		t.Fatal(err)
+	}
+	if inner.learned != "0123" {
+		t.Errorf("wrong body passed to Learn: %q", inner.learned)
+	}
+
+	// Optional interfaces are not required from the wrapped check.
+	c = &Check{size: 4, check: &bodyCheck{}}
+	if err := c.CheckConnection(context.Background(), &smtp.ConnectionState{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Learn(context.Background(), textproto.Header{}, strings.NewReader("0123456789"), true); err == nil {
+		t.Error("Expected an error for a check without learning support")
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+var errVoidLookupLimit = errors.New("spf: void lookups limit reached")
+
+// voidLimitResolver wraps the resolver used for SPF evaluation and enforces
+// the limit on the amount of "void lookups" - lookups that returned NXDOMAIN
+// or no records (RFC 7208, Section 4.6.4).
+//
+// SPF library enforces the limit on the total amount of lookups on its own.
+type voidLimitResolver struct {
+	dns.Resolver
+
+	// Maximum amount of void lookups, 0 disables the limit.
+	max int
+
+	lck   sync.Mutex
+	count int
+}
+
+// exceeded reports whether the evaluation should end with permerror.
+func (r *voidLimitResolver) exceeded() bool {
+	if r.max == 0 {
+		return false
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	return r.count > r.max
+}
+
+func (r *voidLimitResolver) record(answers int, err error) {
+	if err == nil && answers != 0 {
+		return
+	}
+	if err != nil && !dns.IsNotFound(err) {
+		return
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.count++
+}
+
+func (r *voidLimitResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	// No point in doing any more lookups, the result will be permerror
+	// anyway.
+	if r.exceeded() {
+		return nil, errVoidLookupLimit
+	}
+	recs, err := r.Resolver.LookupTXT(ctx, name)
+	r.record(len(recs), err)
+	return recs, err
+}
+
+func (r *voidLimitResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.exceeded() {
+		return nil, errVoidLookupLimit
+	}
+	recs, err := r.Resolver.LookupMX(ctx, name)
+	r.record(len(recs), err)
+	return recs, err
+}
+
+func (r *voidLimitResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r.exceeded() {
+		return nil, errVoidLookupLimit
+	}
+	recs, err := r.Resolver.LookupIPAddr(ctx, host)
+	r.record(len(recs), err)
+	return recs, err
+}
+
+func (r *voidLimitResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if r.exceeded() {
+		return nil, errVoidLookupLimit
+	}
+	names, err := r.Resolver.LookupAddr(ctx, addr)
+	r.record(len(names), err)
+	return names, err
+}
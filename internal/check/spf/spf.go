@@ -25,6 +25,7 @@ import (
 	"net"
 	"runtime/debug"
 	"runtime/trace"
+	"strings"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/emersion/go-message/textproto"
@@ -40,7 +41,6 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 	maddydmarc "github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/target"
-	"golang.org/x/net/idna"
 )
 
 const modName = "check.spf"
@@ -56,6 +56,11 @@ type Check struct {
 	permerrAction  modconfig.FailAction
 	temperrAction  modconfig.FailAction
 
+	maxLookups     int
+	maxVoidLookups int
+
+	overrideTbl module.Table
+
 	log      log.Logger
 	resolver dns.Resolver
 }
@@ -103,19 +108,58 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{Reject: true}, nil
 		}, modconfig.FailActionDirective, &c.temperrAction)
+	cfg.Custom("override_table", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &c.overrideTbl)
+	cfg.Int("max_lookups", false, false, 10, &c.maxLookups)
+	cfg.Int("max_void_lookups", false, false, 2, &c.maxVoidLookups)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
 	}
 
+	if c.maxLookups <= 0 {
+		return fmt.Errorf("%s: max_lookups should be positive", modName)
+	}
+	if c.maxVoidLookups < 0 {
+		return fmt.Errorf("%s: max_void_lookups can't be negative", modName)
+	}
+
 	return nil
 }
 
+func (c *Check) checkHost(ctx context.Context, ip net.IP, helo, mailFrom string) (spf.Result, error) {
+	resolver := &voidLimitResolver{
+		Resolver: c.resolver,
+		max:      c.maxVoidLookups,
+	}
+
+	res, err := spf.CheckHostWithSender(ip, helo, mailFrom,
+		spf.WithContext(ctx), spf.WithResolver(resolver),
+		spf.OverrideLookupLimit(uint(c.maxLookups)))
+	if resolver.exceeded() {
+		return spf.PermError, errVoidLookupLimit
+	}
+	return res, err
+}
+
 type spfRes struct {
 	res spf.Result
 	err error
 }
 
+// cacheKey is used to store SPF evaluation results in the connection cache
+// (module.ConnState.Cache).
+//
+// Only the MAIL FROM domain is used since policies referring the local part
+// using macros are extremely rare.
+type cacheKey struct {
+	c      *Check
+	ip     string
+	helo   string
+	domain string
+}
+
 type state struct {
 	c        *Check
 	msgMeta  *module.MsgMetadata
@@ -134,7 +178,31 @@ func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadat
 	}, nil
 }
 
-func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
+// action returns the action to use for the SPF result, taking per-domain
+// overrides into account.
+func (s *state) action(ctx context.Context, configured modconfig.FailAction) modconfig.FailAction {
+	if s.c.overrideTbl == nil {
+		return configured
+	}
+
+	_, fromDomain, err := address.Split(s.msgMeta.OriginalFrom)
+	if err != nil {
+		return configured
+	}
+
+	override, ok, err := modconfig.LookupActionOverride(ctx, s.c.overrideTbl, fromDomain)
+	if err != nil {
+		s.log.Error("action override lookup failed", err, "domain", fromDomain)
+		return configured
+	}
+	if !ok {
+		return configured
+	}
+	s.log.DebugMsg("using action override", "domain", fromDomain)
+	return override
+}
+
+func (s *state) spfResult(ctx context.Context, res spf.Result, err error) module.CheckResult {
 	_, fromDomain, _ := address.Split(s.msgMeta.OriginalFrom)
 	spfAuth := &authres.SPFResult{
 		Value: authres.ResultNone,
@@ -151,7 +219,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 	switch res {
 	case spf.None:
 		spfAuth.Value = authres.ResultNone
-		return s.c.noneAction.Apply(module.CheckResult{
+		return s.action(ctx, s.c.noneAction).Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -163,7 +231,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		})
 	case spf.Neutral:
 		spfAuth.Value = authres.ResultNeutral
-		return s.c.neutralAction.Apply(module.CheckResult{
+		return s.action(ctx, s.c.neutralAction).Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -178,7 +246,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		return module.CheckResult{AuthResult: []authres.Result{spfAuth}}
 	case spf.Fail:
 		spfAuth.Value = authres.ResultFail
-		return s.c.failAction.Apply(module.CheckResult{
+		return s.action(ctx, s.c.failAction).Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -190,7 +258,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		})
 	case spf.SoftFail:
 		spfAuth.Value = authres.ResultSoftFail
-		return s.c.softfailAction.Apply(module.CheckResult{
+		return s.action(ctx, s.c.softfailAction).Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -202,7 +270,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		})
 	case spf.TempError:
 		spfAuth.Value = authres.ResultTempError
-		return s.c.temperrAction.Apply(module.CheckResult{
+		return s.action(ctx, s.c.temperrAction).Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         451,
 				EnhancedCode: exterrors.EnhancedCode{4, 7, 23},
@@ -214,7 +282,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		})
 	case spf.PermError:
 		spfAuth.Value = authres.ResultPermError
-		return s.c.permerrAction.Apply(module.CheckResult{
+		return s.action(ctx, s.c.permerrAction).Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
@@ -279,7 +347,7 @@ func prepareMailFrom(from string) (string, error) {
 			CheckName:    "spf",
 		}
 	}
-	fromDomain, err = idna.ToASCII(fromDomain)
+	fromDomain, err = dns.ToASCII(fromDomain)
 	if err != nil {
 		return "", &exterrors.SMTPError{
 			Code:         550,
@@ -307,6 +375,12 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		return module.CheckResult{}
 	}
 
+	if s.msgMeta.UpstreamAuth {
+		s.skip = true
+		s.log.DebugMsg("message is received from trusted relay, using upstream results")
+		return module.CheckResult{}
+	}
+
 	ip, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
 	if !ok {
 		s.skip = true
@@ -323,12 +397,29 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		}
 	}
 
+	key := cacheKey{
+		c:      s.c,
+		ip:     ip.IP.String(),
+		helo:   s.msgMeta.Conn.Hostname,
+		domain: strings.ToLower(mailFrom[strings.LastIndexByte(mailFrom, '@')+1:]),
+	}
+	if cache := s.msgMeta.Conn.Cache; cache != nil {
+		if cached, ok := cache.Load(key); ok {
+			res := cached.(spfRes)
+			s.log.Debugf("result: %s (%v) (cached)", res.res, res.err)
+			if s.c.enforceEarly {
+				return s.spfResult(ctx, res.res, res.err)
+			}
+			s.spfFetch <- res
+			return module.CheckResult{}
+		}
+	}
+
 	if s.c.enforceEarly {
-		res, err := spf.CheckHostWithSender(ip.IP,
-			dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom,
-			spf.WithContext(ctx), spf.WithResolver(s.c.resolver))
+		res, err := s.c.checkHost(ctx, ip.IP, dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom)
 		s.log.Debugf("result: %s (%v)", res, err)
-		return s.spfResult(res, err)
+		s.storeResult(key, spfRes{res, err})
+		return s.spfResult(ctx, res, err)
 	}
 
 	// We start evaluation in parallel to other message processing,
@@ -340,22 +431,35 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		defer func() {
 			if err := recover(); err != nil {
 				stack := debug.Stack()
-				log.Printf("panic during spf.CheckHostWithSender: %v\n%s", err, stack)
+				log.Printf("panic during SPF evaluation: %v\n%s", err, stack)
 				close(s.spfFetch)
 			}
 		}()
 
 		defer trace.StartRegion(ctx, "check.spf/CheckConnection (Async)").End()
 
-		res, err := spf.CheckHostWithSender(ip.IP, dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom,
-			spf.WithContext(ctx), spf.WithResolver(s.c.resolver))
+		res, err := s.c.checkHost(ctx, ip.IP, dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom)
 		s.log.Debugf("result: %s (%v)", res, err)
+		s.storeResult(key, spfRes{res, err})
 		s.spfFetch <- spfRes{res, err}
 	}()
 
 	return module.CheckResult{}
 }
 
+func (s *state) storeResult(key cacheKey, res spfRes) {
+	cache := s.msgMeta.Conn.Cache
+	if cache == nil {
+		return
+	}
+	// Temporary errors are not cached so evaluation will be retried for the
+	// next message.
+	if res.res == spf.TempError {
+		return
+	}
+	cache.Store(key, res)
+}
+
 func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
 	return module.CheckResult{}
 }
@@ -392,13 +496,13 @@ func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buf
 			s.log.Debugf("deferring action due to a DMARC policy")
 		}
 
-		checkRes := s.spfResult(res.res, res.err)
+		checkRes := s.spfResult(ctx, res.res, res.err)
 		checkRes.Quarantine = false
 		checkRes.Reject = false
 		return checkRes
 	}
 
-	return s.spfResult(res.res, res.err)
+	return s.spfResult(ctx, res.res, res.err)
 }
 
 func (s *state) Close() error {
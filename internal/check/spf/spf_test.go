@@ -0,0 +1,232 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// countingResolver counts TXT lookups done by the check.
+type countingResolver struct {
+	dns.Resolver
+
+	lck      sync.Mutex
+	txtCalls int
+}
+
+func (r *countingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lck.Lock()
+	r.txtCalls++
+	r.lck.Unlock()
+	return r.Resolver.LookupTXT(ctx, name)
+}
+
+func testCheck(t *testing.T, zones map[string]mockdns.Zone) (*Check, *countingResolver) {
+	resolver := &countingResolver{
+		Resolver: &mockdns.Resolver{Zones: zones},
+	}
+	return &Check{
+		enforceEarly:   true,
+		maxLookups:     10,
+		maxVoidLookups: 2,
+		log:            testutils.Logger(t, modName),
+		resolver:       resolver,
+	}, resolver
+}
+
+func checkMsg(t *testing.T, c *Check, conn *module.ConnState, mailFrom string) module.CheckResult {
+	t.Helper()
+
+	state, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		Conn:         conn,
+		OriginalFrom: mailFrom,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	res := state.CheckConnection(context.Background())
+	if bodyRes := state.CheckBody(context.Background(), textproto.Header{}, buffer.MemoryBuffer{}); bodyRes.Reason != nil {
+		return bodyRes
+	}
+	return res
+}
+
+func TestCheck_ConnCache(t *testing.T) {
+	c, resolver := testCheck(t, map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 ip4:1.2.3.4 -all"},
+		},
+		"example.com.": {
+			TXT: []string{"v=spf1 -all"},
+		},
+	})
+	c.failAction.Reject = true
+
+	conn := &module.ConnState{
+		ConnectionState: smtp.ConnectionState{
+			Hostname:   "mx.example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 25},
+		},
+		Cache: &sync.Map{},
+	}
+
+	for i := 0; i < 3; i++ {
+		if res := checkMsg(t, c, conn, "test@example.org"); res.Reason != nil {
+			t.Fatal("Unexpected failure:", res.Reason)
+		}
+	}
+	if resolver.txtCalls != 1 {
+		t.Errorf("expected 1 TXT lookup, got %d", resolver.txtCalls)
+	}
+
+	// Different local part - same domain.
+	if res := checkMsg(t, c, conn, "test2@EXAMPLE.org"); res.Reason != nil {
+		t.Fatal("Unexpected failure:", res.Reason)
+	}
+	if resolver.txtCalls != 1 {
+		t.Errorf("expected 1 TXT lookup, got %d", resolver.txtCalls)
+	}
+
+	// Different domain.
+	if res := checkMsg(t, c, conn, "test@example.com"); !res.Reject {
+		t.Fatal("Expected message to be rejected")
+	}
+	if resolver.txtCalls != 2 {
+		t.Errorf("expected 2 TXT lookups, got %d", resolver.txtCalls)
+	}
+	if res := checkMsg(t, c, conn, "test@example.com"); !res.Reject {
+		t.Fatal("Expected message to be rejected")
+	}
+	if resolver.txtCalls != 2 {
+		t.Errorf("expected 2 TXT lookups, got %d", resolver.txtCalls)
+	}
+
+	// HELO changed.
+	conn.Hostname = "mx2.example.org"
+	if res := checkMsg(t, c, conn, "test@example.org"); res.Reason != nil {
+		t.Fatal("Unexpected failure:", res.Reason)
+	}
+	if resolver.txtCalls != 3 {
+		t.Errorf("expected 3 TXT lookups, got %d", resolver.txtCalls)
+	}
+
+	// Async evaluation uses the same cache.
+	c.enforceEarly = false
+	if res := checkMsg(t, c, conn, "test@example.org"); res.Reason != nil {
+		t.Fatal("Unexpected failure:", res.Reason)
+	}
+	if resolver.txtCalls != 3 {
+		t.Errorf("expected 3 TXT lookups, got %d", resolver.txtCalls)
+	}
+}
+
+func TestCheck_LookupLimits(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"void.example.org.": {
+			TXT: []string{"v=spf1 a:nx1.example.org a:nx2.example.org a:nx3.example.org ip4:1.2.3.4 -all"},
+		},
+		"void2.example.org.": {
+			TXT: []string{"v=spf1 a:nx1.example.org a:nx2.example.org ip4:1.2.3.4 -all"},
+		},
+		"ok.example.org.": {
+			TXT: []string{"v=spf1 include:inc3.example.org -all"},
+		},
+		"deep.example.org.": {
+			TXT: []string{"v=spf1 include:inc1.example.org -all"},
+		},
+	}
+	// Chain of includes, each one causes a lookup.
+	for i := 1; i <= 11; i++ {
+		name := fmt.Sprintf("inc%d.example.org.", i)
+		if i == 11 {
+			zones[name] = mockdns.Zone{TXT: []string{"v=spf1 ip4:1.2.3.4 -all"}}
+			continue
+		}
+		zones[name] = mockdns.Zone{TXT: []string{fmt.Sprintf("v=spf1 include:inc%d.example.org -all", i+1)}}
+	}
+
+	c, _ := testCheck(t, zones)
+	ip := net.IPv4(1, 2, 3, 4)
+
+	test := func(domain string, expected spf.Result) {
+		t.Helper()
+		res, err := c.checkHost(context.Background(), ip, "mx.example.org.", "test@"+domain+".")
+		if res != expected {
+			t.Errorf("%s: expected %v, got %v (%v)", domain, expected, res, err)
+		}
+	}
+
+	test("void.example.org", spf.PermError)
+	test("void2.example.org", spf.Pass)
+	test("ok.example.org", spf.Pass)
+	test("deep.example.org", spf.PermError)
+
+	// 1 (ok) + 9 includes.
+	c.maxLookups = 9
+	test("ok.example.org", spf.PermError)
+
+	c.maxVoidLookups = 0
+	test("void.example.org", spf.Pass)
+	c.maxVoidLookups = 1
+	test("void2.example.org", spf.PermError)
+}
+
+func TestCheck_ActionOverride(t *testing.T) {
+	c, _ := testCheck(t, map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 -all"},
+		},
+		"example.com.": {
+			TXT: []string{"v=spf1 -all"},
+		},
+	})
+	c.failAction.Reject = true
+	c.overrideTbl = testutils.Table{
+		M: map[string]string{"example.org": "ignore"},
+	}
+
+	conn := &module.ConnState{
+		ConnectionState: smtp.ConnectionState{
+			Hostname:   "mx.example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 25},
+		},
+	}
+
+	if res := checkMsg(t, c, conn, "test@example.org"); res.Reject || res.Quarantine {
+		t.Error("Expected override to be used")
+	}
+	if res := checkMsg(t, c, conn, "test@example.com"); !res.Reject {
+		t.Error("Expected message to be rejected")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"context"
 	"fmt"
 	"runtime/trace"
+	"sync"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -64,7 +65,8 @@ type statelessCheck struct {
 	// One used by Init if config option is not passed by a user.
 	defaultFailAction modconfig.FailAction
 	// The actual fail action that should be applied.
-	failAction modconfig.FailAction
+	failAction    modconfig.FailAction
+	failActionLck sync.RWMutex
 
 	connCheck   FuncConnCheck
 	senderCheck FuncSenderCheck
@@ -93,7 +95,7 @@ func (s *statelessCheckState) CheckConnection(ctx context.Context) module.CheckR
 		MsgMeta:  s.msgMeta,
 		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
 	})
-	return s.c.failAction.Apply(originalRes)
+	return s.c.currentFailAction().Apply(originalRes)
 }
 
 func (s *statelessCheckState) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
@@ -108,7 +110,7 @@ func (s *statelessCheckState) CheckSender(ctx context.Context, mailFrom string)
 		MsgMeta:  s.msgMeta,
 		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
 	}, mailFrom)
-	return s.c.failAction.Apply(originalRes)
+	return s.c.currentFailAction().Apply(originalRes)
 }
 
 func (s *statelessCheckState) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
@@ -123,7 +125,7 @@ func (s *statelessCheckState) CheckRcpt(ctx context.Context, rcptTo string) modu
 		MsgMeta:  s.msgMeta,
 		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
 	}, rcptTo)
-	return s.c.failAction.Apply(originalRes)
+	return s.c.currentFailAction().Apply(originalRes)
 }
 
 func (s *statelessCheckState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
@@ -138,7 +140,7 @@ func (s *statelessCheckState) CheckBody(ctx context.Context, header textproto.He
 		MsgMeta:  s.msgMeta,
 		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
 	}, header, body)
-	return s.c.failAction.Apply(originalRes)
+	return s.c.currentFailAction().Apply(originalRes)
 }
 
 func (s *statelessCheckState) Close() error {
@@ -162,6 +164,34 @@ func (c *statelessCheck) Init(cfg *config.Map) error {
 	return err
 }
 
+// Reload changes the fail action used by the check. Debug logging can't be
+// changed without the restart.
+func (c *statelessCheck) Reload(cfg *config.Map) error {
+	var (
+		debug      bool
+		failAction modconfig.FailAction
+	)
+	cfg.Bool("debug", true, false, &debug)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return c.defaultFailAction, nil
+		}, modconfig.FailActionDirective, &failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.failActionLck.Lock()
+	c.failAction = failAction
+	c.failActionLck.Unlock()
+	return nil
+}
+
+func (c *statelessCheck) currentFailAction() modconfig.FailAction {
+	c.failActionLck.RLock()
+	defer c.failActionLck.RUnlock()
+	return c.failAction
+}
+
 func (c *statelessCheck) Name() string {
 	return c.modName
 }
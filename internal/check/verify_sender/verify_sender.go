@@ -0,0 +1,381 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package verify_sender implements the sender address verification
+// callout check.
+//
+// The check connects to the MX of the MAIL FROM domain and issues
+// MAIL FROM:<> and RCPT TO:<sender> commands to find out whether the address
+// exists. Results are cached and amount of callouts is rate-limited.
+package verify_sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.verify_sender"
+
+var smtpPort = "25"
+
+// Maximum amount of cached results, older entries are dropped first.
+const maxCacheSize = 10000
+
+type calloutResult int
+
+const (
+	// Callout failed or was not done, nothing is known about the address.
+	resultUnknown calloutResult = iota
+	resultExists
+	resultNotExists
+)
+
+type cacheEntry struct {
+	res     calloutResult
+	expires time.Time
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	hostname      string
+	timeout       time.Duration
+	cacheTTL      time.Duration
+	negCacheTTL   time.Duration
+	exemptDomains map[string]struct{}
+	failAction    modconfig.FailAction
+	errAction     modconfig.FailAction
+
+	rate     limiters.Rate
+	resolver dns.Resolver
+	dialer   func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	cacheLck sync.Mutex
+	cache    map[string]cacheEntry
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		rate:     limiters.NewRate(0, 0),
+		resolver: dns.DefaultResolver(),
+		dialer:   (&net.Dialer{}).DialContext,
+		cache:    make(map[string]cacheEntry),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		exemptDomains []string
+		rateLimit     []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, true, "", &c.hostname)
+	cfg.Duration("timeout", false, false, 30*time.Second, &c.timeout)
+	cfg.Duration("cache_ttl", false, false, 24*time.Hour, &c.cacheTTL)
+	cfg.Duration("negative_cache_ttl", false, false, 2*time.Hour, &c.negCacheTTL)
+	cfg.StringList("exempt_domains", false, false, nil, &exemptDomains)
+	cfg.StringList("rate_limit", false, false, []string{"20", "1m"}, &rateLimit)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.exemptDomains = make(map[string]struct{}, len(exemptDomains))
+	for _, d := range exemptDomains {
+		norm, err := dns.ForLookup(d)
+		if err != nil {
+			return fmt.Errorf("%s: invalid domain %s: %w", modName, d, err)
+		}
+		c.exemptDomains[norm] = struct{}{}
+	}
+
+	if len(rateLimit) != 2 {
+		return fmt.Errorf("%s: rate_limit: expected burst size and interval", modName)
+	}
+	var burst int
+	if _, err := fmt.Sscan(rateLimit[0], &burst); err != nil || burst <= 0 {
+		return fmt.Errorf("%s: rate_limit: invalid burst size: %v", modName, rateLimit[0])
+	}
+	interval, err := time.ParseDuration(rateLimit[1])
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("%s: rate_limit: invalid interval: %v", modName, rateLimit[1])
+	}
+	c.rate = limiters.NewRate(burst, interval)
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	c.rate.Close()
+	return nil
+}
+
+func (c *Check) cached(addr string, now time.Time) (calloutResult, bool) {
+	c.cacheLck.Lock()
+	defer c.cacheLck.Unlock()
+
+	entry, ok := c.cache[addr]
+	if !ok || now.After(entry.expires) {
+		return resultUnknown, false
+	}
+	return entry.res, true
+}
+
+func (c *Check) store(addr string, res calloutResult, now time.Time) {
+	var ttl time.Duration
+	switch res {
+	case resultExists:
+		ttl = c.cacheTTL
+	case resultNotExists:
+		ttl = c.negCacheTTL
+	default:
+		// Failures are not cached so the callout will be retried.
+		return
+	}
+
+	c.cacheLck.Lock()
+	defer c.cacheLck.Unlock()
+
+	if len(c.cache) >= maxCacheSize {
+		for k, entry := range c.cache {
+			if now.After(entry.expires) {
+				delete(c.cache, k)
+			}
+		}
+	}
+	if len(c.cache) >= maxCacheSize {
+		return
+	}
+	c.cache[addr] = cacheEntry{res: res, expires: now.Add(ttl)}
+}
+
+// mxHosts returns the list of hosts to use for callout in the order of
+// preference.
+func (c *Check) mxHosts(ctx context.Context, domain string) ([]string, error) {
+	aDomain, err := dns.ToASCII(domain)
+	if err != nil {
+		return nil, err
+	}
+	mxs, err := c.resolver.LookupMX(ctx, dns.FQDN(aDomain))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+	if len(mxs) == 0 {
+		// Implicit MX, RFC 5321 Section 5.1.
+		return []string{aDomain}, nil
+	}
+
+	sort.Slice(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		if mx.Host == "." {
+			// Null MX, RFC 7505.
+			return nil, nil
+		}
+		hosts = append(hosts, mx.Host)
+	}
+	return hosts, nil
+}
+
+// callout checks whether the address exists by talking to the MX of its
+// domain.
+func (c *Check) callout(ctx context.Context, addr, domain string) (calloutResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	hosts, err := c.mxHosts(ctx, domain)
+	if err != nil {
+		return resultUnknown, err
+	}
+	if len(hosts) == 0 {
+		c.log.DebugMsg("null MX", "domain", domain)
+		return resultNotExists, nil
+	}
+
+	// Try only the primary MX to keep the load on remote servers low.
+	conn := smtpconn.New()
+	conn.Dialer = c.dialer
+	conn.Hostname = c.hostname
+	conn.ConnectTimeout = c.timeout
+	conn.CommandTimeout = c.timeout
+	conn.Log = c.log
+	if _, err := conn.Connect(ctx, config.Endpoint{
+		Host: dns.FQDN(hosts[0]),
+		Port: smtpPort,
+	}, false, nil); err != nil {
+		return resultUnknown, err
+	}
+	defer conn.Close()
+
+	if err := conn.Mail(ctx, "", smtp.MailOptions{}); err != nil {
+		return resultUnknown, err
+	}
+	if err := conn.Rcpt(ctx, addr); err != nil {
+		if exterrors.IsTemporaryOrUnspec(err) {
+			return resultUnknown, err
+		}
+		c.log.DebugMsg("recipient rejected", "addr", addr, "reason", err.Error())
+		return resultNotExists, nil
+	}
+	return resultExists, nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally-generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+	if addr == "" {
+		// Null reverse-path, nothing to verify.
+		return module.CheckResult{}
+	}
+
+	normAddr, err := address.ForLookup(addr)
+	if err != nil {
+		return module.CheckResult{}
+	}
+	_, domain, err := address.Split(normAddr)
+	if err != nil || domain == "" {
+		return module.CheckResult{}
+	}
+	if _, ok := s.c.exemptDomains[domain]; ok {
+		s.log.DebugMsg("exempt domain, skipping", "domain", domain)
+		return module.CheckResult{}
+	}
+
+	now := time.Now()
+	res, ok := s.c.cached(normAddr, now)
+	if ok {
+		s.log.DebugMsg("cached result", "addr", normAddr, "exists", res == resultExists)
+	} else {
+		if !s.c.rate.TryTake() {
+			s.log.Msg("callout rate limit exceeded, skipping", "addr", normAddr)
+			return module.CheckResult{}
+		}
+
+		res, err = s.c.callout(ctx, addr, domain)
+		if err != nil {
+			s.log.Error("callout failed", err, "addr", normAddr)
+			return s.c.errAction.Apply(module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+					Message:      "Unable to verify the sender address",
+					CheckName:    modName,
+					Err:          err,
+				},
+			})
+		}
+		s.c.store(normAddr, res, now)
+	}
+
+	if res != resultNotExists {
+		return module.CheckResult{}
+	}
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 7},
+			Message:      "Sender address does not exist",
+			CheckName:    modName,
+		},
+	})
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,183 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package verify_sender
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, cfg []config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	resolver := &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+		"nullmx.invalid.": {
+			MX: []net.MX{{Host: ".", Pref: 0}},
+		},
+	}}
+	c.resolver = resolver
+	c.dialer = resolver.DialContext
+
+	cfg = append(cfg, config.Node{Name: "hostname", Args: []string{"mx.example.org"}})
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkSender(t *testing.T, c *Check, addr string) module.CheckResult {
+	t.Helper()
+
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID: "test",
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	return s.CheckSender(context.Background(), addr)
+}
+
+func TestVerifySender(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	be.RcptErr = map[string]error{
+		"nobody@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+		"greylisted@example.invalid": &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      "Try again later",
+		},
+	}
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	c := testCheck(t, []config.Node{
+		{Name: "exempt_domains", Args: []string{"exempt.invalid"}},
+	})
+	defer c.Close()
+
+	res := checkSender(t, c, "user@example.invalid")
+	if res.Reason != nil {
+		t.Fatal("Unexpected failure:", res.Reason)
+	}
+	if be.SessionCounter != 1 {
+		t.Fatal("Wrong amount of callouts:", be.SessionCounter)
+	}
+	// The result should be cached.
+	res = checkSender(t, c, "User@Example.Invalid")
+	if res.Reason != nil {
+		t.Fatal("Unexpected failure:", res.Reason)
+	}
+	if be.SessionCounter != 1 {
+		t.Fatal("Result is not cached")
+	}
+
+	res = checkSender(t, c, "nobody@example.invalid")
+	if res.Reason == nil || !res.Quarantine {
+		t.Fatal("Expected the message to be quarantined:", res)
+	}
+	if smtpErr, ok := res.Reason.(*exterrors.SMTPError); !ok || smtpErr.Code != 550 {
+		t.Fatal("Wrong error:", res.Reason)
+	}
+
+	// Temporary failures are neutral by default.
+	res = checkSender(t, c, "greylisted@example.invalid")
+	if res.Reject || res.Quarantine {
+		t.Fatal("Unexpected action for temporary failure:", res)
+	}
+
+	res = checkSender(t, c, "user@nullmx.invalid")
+	if res.Reason == nil || !res.Quarantine {
+		t.Fatal("Expected the message to be quarantined for null MX:", res)
+	}
+
+	sessions := be.SessionCounter
+	res = checkSender(t, c, "user@exempt.invalid")
+	if res.Reason != nil || be.SessionCounter != sessions {
+		t.Fatal("Callout done for exempt domain")
+	}
+	res = checkSender(t, c, "")
+	if res.Reason != nil || be.SessionCounter != sessions {
+		t.Fatal("Callout done for null sender")
+	}
+}
+
+func TestVerifySender_RateLimit(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	c := testCheck(t, []config.Node{
+		{Name: "rate_limit", Args: []string{"1", "1h"}},
+	})
+	defer c.Close()
+
+	checkSender(t, c, "user1@example.invalid")
+	checkSender(t, c, "user2@example.invalid")
+	if be.SessionCounter != 1 {
+		t.Fatal("Rate limit is not applied, callouts:", be.SessionCounter)
+	}
+}
+
+func TestMain(m *testing.M) {
+	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
+	flag.Parse()
+
+	if *remoteSmtpPort == "random" {
+		rand.Seed(time.Now().UnixNano())
+		*remoteSmtpPort = strconv.Itoa(rand.Intn(65536-10000) + 10000)
+	}
+
+	smtpPort = *remoteSmtpPort
+	os.Exit(m.Run())
+}
@@ -0,0 +1,352 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package control contains the registry of runtime state and actions
+// exposed by modules via the control endpoint.
+//
+// Modules register connection sources, queues and sinks during initialization and
+// remove them when closed. The ban list is shared by all endpoints that
+// accept connections, the read-only flag is shared by all endpoints and
+// storage modules.
+package control
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes the connection accepted by an endpoint.
+type ConnInfo struct {
+	Endpoint   string     `json:"endpoint"`
+	RemoteAddr string     `json:"remote_addr"`
+	Username   string     `json:"username,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+	TLS        bool       `json:"tls"`
+}
+
+// DomainStats contains delivery statistics for a single recipient domain.
+//
+// Delivered and failure counters are accumulated since the server start.
+type DomainStats struct {
+	Pending    int `json:"pending"`
+	Delivered  int `json:"delivered"`
+	TempFailed int `json:"temp_failed"`
+	PermFailed int `json:"perm_failed"`
+}
+
+// QueueStats describes the current state of the message queue.
+type QueueStats struct {
+	Messages int                    `json:"messages"`
+	InFlight int                    `json:"in_flight"`
+	Domains  map[string]DomainStats `json:"domains"`
+}
+
+// Delivery states of a single recipient.
+const (
+	DeliveryQueued    = "queued"
+	DeliveryDeferred  = "deferred"
+	DeliveryDelivered = "delivered"
+	DeliveryBounced   = "bounced"
+	DeliveryDeleted   = "deleted"
+)
+
+// RcptStatus is the current delivery state for a single recipient.
+type RcptStatus struct {
+	State     string    `json:"state"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// DeliveryEvent is a single recipient state transition.
+type DeliveryEvent struct {
+	Time  time.Time `json:"time"`
+	Rcpt  string    `json:"rcpt"`
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+}
+
+// DeliveryStatus describes delivery progress of a single message.
+type DeliveryStatus struct {
+	ID      string                `json:"id"`
+	From    string                `json:"from"`
+	Created time.Time             `json:"created"`
+	Rcpts   map[string]RcptStatus `json:"rcpts"`
+	Events  []DeliveryEvent       `json:"events"`
+}
+
+// Queue is the interface implemented by message queues that can be managed
+// via the control endpoint.
+type Queue interface {
+	Stats() QueueStats
+
+	// Flush schedules immediate delivery attempts for the specified
+	// messages or all messages if no IDs are given. It returns the amount
+	// of rescheduled messages.
+	Flush(ids ...string) int
+
+	// Delete removes the message from the queue without generating any
+	// bounce messages.
+	Delete(id string) error
+
+	// DeliveryStatus returns the recorded delivery status of the message,
+	// including messages that already left the queue.
+	DeliveryStatus(id string) (*DeliveryStatus, error)
+}
+
+// CapturedMessage is the message stored by a capturing delivery target.
+type CapturedMessage struct {
+	ID       string    `json:"id"`
+	Received time.Time `json:"received"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	// Full message text, including the header.
+	Data string `json:"data"`
+}
+
+// Sink is the interface implemented by delivery targets that keep received
+// messages in memory for inspection.
+type Sink interface {
+	// Captured returns the stored messages, oldest first.
+	Captured() []CapturedMessage
+
+	// ClearCaptured removes all stored messages and returns their amount.
+	ClearCaptured() int
+}
+
+var (
+	lock        sync.RWMutex
+	connSources = make(map[string]func() []ConnInfo)
+	queues      = make(map[string]Queue)
+	sinks       = make(map[string]Sink)
+	bans        = make(map[string]time.Time)
+
+	readOnly int32
+)
+
+// SetReadOnly enables or disables the read-only (maintenance) mode.
+func SetReadOnly(ro bool) {
+	var val int32
+	if ro {
+		val = 1
+	}
+	atomic.StoreInt32(&readOnly, val)
+}
+
+// ReadOnly reports whether the server is in the read-only mode.
+//
+// In this mode storage modules defer or reject deliveries and endpoints
+// reject client commands that change stored messages, read access is not
+// affected.
+func ReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
+}
+
+// RegisterConnSource adds the function that returns the list of active
+// connections for the endpoint. Registering another source with the same
+// name replaces the previous one.
+func RegisterConnSource(name string, f func() []ConnInfo) {
+	lock.Lock()
+	defer lock.Unlock()
+	connSources[name] = f
+}
+
+func UnregisterConnSource(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(connSources, name)
+}
+
+// Conns returns the list of active connections for all registered endpoints.
+func Conns() []ConnInfo {
+	lock.RLock()
+	sources := make([]func() []ConnInfo, 0, len(connSources))
+	for _, f := range connSources {
+		sources = append(sources, f)
+	}
+	lock.RUnlock()
+
+	conns := []ConnInfo{}
+	for _, f := range sources {
+		conns = append(conns, f()...)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].Endpoint != conns[j].Endpoint {
+			return conns[i].Endpoint < conns[j].Endpoint
+		}
+		return conns[i].RemoteAddr < conns[j].RemoteAddr
+	})
+	return conns
+}
+
+func RegisterQueue(name string, q Queue) {
+	lock.Lock()
+	defer lock.Unlock()
+	queues[name] = q
+}
+
+func UnregisterQueue(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(queues, name)
+}
+
+// GetQueue returns the registered queue with the specified name.
+func GetQueue(name string) (Queue, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	q, ok := queues[name]
+	return q, ok
+}
+
+// QueueNames returns sorted names of all registered queues.
+func QueueNames() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	names := make([]string, 0, len(queues))
+	for name := range queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func RegisterSink(name string, s Sink) {
+	lock.Lock()
+	defer lock.Unlock()
+	sinks[name] = s
+}
+
+func UnregisterSink(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(sinks, name)
+}
+
+// GetSink returns the registered sink with the specified name.
+func GetSink(name string) (Sink, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	s, ok := sinks[name]
+	return s, ok
+}
+
+// BanInfo describes the ban list entry.
+type BanInfo struct {
+	IP string `json:"ip"`
+	// Nil for bans that do not expire.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Ban adds the IP address to the ban list. Connections from banned
+// addresses are closed right after being accepted.
+//
+// If d is zero, the ban does not expire until the server is restarted or
+// Unban is called.
+func Ban(ip net.IP, d time.Duration) {
+	var until time.Time
+	if d != 0 {
+		until = time.Now().Add(d)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	bans[ip.String()] = until
+}
+
+// Unban removes the IP address from the ban list. It returns false if the
+// address was not banned.
+func Unban(ip net.IP) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	_, ok := bans[ip.String()]
+	delete(bans, ip.String())
+	return ok
+}
+
+// Banned reports whether the IP address is in the ban list.
+func Banned(ip net.IP) bool {
+	lock.RLock()
+	until, ok := bans[ip.String()]
+	lock.RUnlock()
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		lock.Lock()
+		// Make sure the entry was not replaced by another Ban call.
+		if bans[ip.String()] == until {
+			delete(bans, ip.String())
+		}
+		lock.Unlock()
+		return false
+	}
+	return true
+}
+
+// Bans returns the current ban list.
+func Bans() []BanInfo {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	now := time.Now()
+	list := make([]BanInfo, 0, len(bans))
+	for ip, until := range bans {
+		if !until.IsZero() && now.After(until) {
+			continue
+		}
+		info := BanInfo{IP: ip}
+		if !until.IsZero() {
+			until := until
+			info.Until = &until
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IP < list[j].IP
+	})
+	return list
+}
+
+// FilterListener wraps the listener to close connections from banned
+// addresses right after they are accepted.
+func FilterListener(l net.Listener) net.Listener {
+	return banListener{Listener: l}
+}
+
+type banListener struct {
+	net.Listener
+}
+
+func (l banListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !Banned(tcpAddr.IP) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanned(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	t.Cleanup(func() { Unban(ip) })
+
+	if Banned(ip) {
+		t.Fatal("address is banned before Ban")
+	}
+
+	Ban(ip, 0)
+	if !Banned(ip) || !Banned(net.ParseIP("::ffff:192.0.2.1")) {
+		t.Fatal("address is not banned after Ban")
+	}
+
+	Ban(ip, -time.Second)
+	if Banned(ip) {
+		t.Fatal("expired ban is in effect")
+	}
+	if len(Bans()) != 0 {
+		t.Fatal("expired ban is listed:", Bans())
+	}
+}
+
+func TestFilterListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = FilterListener(l)
+	defer l.Close()
+
+	Ban(net.ParseIP("127.0.0.1"), 0)
+	defer Unban(net.ParseIP("127.0.0.1"))
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection from banned address is not closed")
+	}
+
+	select {
+	case <-accepted:
+		t.Fatal("connection from banned address is accepted")
+	default:
+	}
+}
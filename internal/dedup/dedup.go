@@ -0,0 +1,144 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package dedup implements a persistent store of recently delivered messages
+// used to detect duplicate deliveries.
+//
+// Entries are keyed by the (account, mailbox, Message-ID) triple and expire
+// after the window specified when the store is opened.
+package dedup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/jsonfile"
+)
+
+// Key identifies the message delivered to the specific mailbox.
+type Key struct {
+	Account   string
+	Mailbox   string
+	MessageID string
+}
+
+func (k Key) String() string {
+	return k.Account + "\x00" + k.Mailbox + "\x00" + k.MessageID
+}
+
+// Store keeps delivery timestamps for recently seen keys and saves them
+// to the JSON file on each change.
+type Store struct {
+	path   string
+	window time.Duration
+
+	lock sync.Mutex
+	// Key.String() => Unix timestamp of the delivery.
+	seen map[string]int64
+}
+
+var (
+	openedStores     = map[string]*Store{}
+	openedStoresLock sync.Mutex
+)
+
+// Open loads the store from the file at path, creating it if it does not
+// exist.
+//
+// Stores are shared for the same path. Window should be the same for all
+// users of the store, otherwise the window passed to the first call is used.
+func Open(path string, window time.Duration) (*Store, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	openedStoresLock.Lock()
+	defer openedStoresLock.Unlock()
+
+	if s, ok := openedStores[path]; ok {
+		return s, nil
+	}
+
+	s := &Store{
+		path:   path,
+		window: window,
+		seen:   map[string]int64{},
+	}
+
+	if err := jsonfile.Read(path, &s.seen); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	openedStores[path] = s
+	return s, nil
+}
+
+// NormalizeMsgID converts the Message-ID header value into the form used
+// in keys.
+//
+// Empty string is returned if the value does not contain a message
+// identifier.
+func NormalizeMsgID(val string) string {
+	val = strings.TrimSpace(val)
+	val = strings.TrimPrefix(val, "<")
+	val = strings.TrimSuffix(val, ">")
+	return strings.TrimSpace(val)
+}
+
+// Seen reports whether the key was added to the store during the window
+// preceding now.
+func (s *Store) Seen(k Key, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ts, ok := s.seen[k.String()]
+	if !ok {
+		return false
+	}
+	return now.Sub(time.Unix(ts, 0)) < s.window
+}
+
+// Add records the delivery of messages identified by keys and saves the
+// store.
+//
+// Expired entries are removed. Entries are updated in memory even if saving
+// fails.
+func (s *Store) Add(now time.Time, keys ...Key) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, k := range keys {
+		s.seen[k.String()] = now.Unix()
+	}
+
+	for k, ts := range s.seen {
+		if now.Sub(time.Unix(ts, 0)) >= s.window {
+			delete(s.seen, k)
+		}
+	}
+
+	return s.save()
+}
+
+func (s *Store) save() error {
+	return jsonfile.Write(s.path, s.seen)
+}
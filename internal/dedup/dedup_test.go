@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dedup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-dedup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "dedup.json")
+
+	s, err := Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	k := Key{Account: "test@example.org", Mailbox: "INBOX", MessageID: "1@example.org"}
+	if s.Seen(k, now) {
+		t.Fatal("unknown key is seen")
+	}
+	if err := s.Add(now, k); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Seen(k, now.Add(59*time.Minute)) {
+		t.Fatal("added key is not seen")
+	}
+	if s.Seen(k, now.Add(time.Hour)) {
+		t.Fatal("expired key is seen")
+	}
+	other := k
+	other.Mailbox = "Lists"
+	if s.Seen(other, now) {
+		t.Fatal("key for a different mailbox is seen")
+	}
+
+	// Reload from the disk.
+	openedStoresLock.Lock()
+	delete(openedStores, s.path)
+	openedStoresLock.Unlock()
+	s, err = Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Seen(k, now) {
+		t.Fatal("key is lost after reload")
+	}
+
+	// Expired entries are removed on the next change.
+	if err := s.Add(now.Add(2*time.Hour), other); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.seen) != 1 {
+		t.Fatalf("expired entries are not removed: %v", s.seen)
+	}
+}
+
+func TestNormalizeMsgID(t *testing.T) {
+	for in, out := range map[string]string{
+		"<1@example.org>":     "1@example.org",
+		" <1@example.org> \t": "1@example.org",
+		"1@example.org":       "1@example.org",
+		"<>":                  "",
+		"":                    "",
+	} {
+		if got := NormalizeMsgID(in); got != out {
+			t.Errorf("NormalizeMsgID(%q) = %q, want %q", in, got, out)
+		}
+	}
+}
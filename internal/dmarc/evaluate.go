@@ -38,6 +38,7 @@ import (
 // It returns the record and the domain it was found with (may not be
 // equal to the RFC5322.From domain).
 func FetchRecord(ctx context.Context, r Resolver, fromDomain string) (policyDomain string, rec *Record, err error) {
+	fromDomain, _ = dns.ToASCII(fromDomain)
 	policyDomain = fromDomain
 
 	// 1. Lookup using From Domain.
@@ -203,6 +204,9 @@ func EvaluateAlignment(fromDomain string, record *Record, results []authres.Resu
 }
 
 func isAligned(fromDomain, authDomain string, mode AlignmentMode) bool {
+	fromDomain, _ = dns.ToASCII(fromDomain)
+	authDomain, _ = dns.ToASCII(authDomain)
+
 	if mode == dmarc.AlignmentStrict {
 		return strings.EqualFold(fromDomain, authDomain)
 	}
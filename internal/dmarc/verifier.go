@@ -28,6 +28,7 @@ import (
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/foxcpp/maddy/framework/dns"
 )
 
 type verifyData struct {
@@ -89,6 +90,8 @@ func (v *Verifier) FetchRecord(ctx context.Context, header textproto.Header) {
 		}
 		return
 	}
+	// Identifiers checked by SPF and DKIM are in the A-label form.
+	fromDomain, _ = dns.ToASCII(fromDomain)
 
 	ctx, v.fetchCancel = context.WithCancel(ctx)
 	go func() {
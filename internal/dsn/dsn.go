@@ -29,6 +29,8 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/address"
@@ -189,6 +191,14 @@ type Envelope struct {
 //
 // DSN header will be returned, body itself will be written to outWriter.
 func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	return GenerateDSNText(utf8, envelope, mtaInfo, rcptsInfo, failedHeader, nil, outWriter)
+}
+
+// GenerateDSNText is similar to GenerateDSN but uses the specified template
+// for the human-readable part of DSN. If text is nil, DefaultText is used
+// (DefaultDelayText if all recipients have ActionDelayed). The template is
+// executed with TextData.
+func GenerateDSNText(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, text *template.Template, outWriter io.Writer) (textproto.Header, error) {
 	partWriter := textproto.NewMultipartWriter(outWriter)
 
 	reportHeader := textproto.Header{}
@@ -200,11 +210,15 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	reportHeader.Add("Auto-Submitted", "auto-replied")
 	reportHeader.Add("To", envelope.To)
 	reportHeader.Add("From", envelope.From)
-	reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	if isDelayReport(rcptsInfo) {
+		reportHeader.Add("Subject", "Delayed Mail (still being retried)")
+	} else {
+		reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	}
 
 	defer partWriter.Close()
 
-	if err := writeHumanReadablePart(partWriter, mtaInfo, rcptsInfo); err != nil {
+	if err := writeHumanReadablePart(partWriter, text, mtaInfo, rcptsInfo, failedHeader); err != nil {
 		return textproto.Header{}, err
 	}
 	if err := writeMachineReadablePart(utf8, partWriter, mtaInfo, rcptsInfo); err != nil {
@@ -255,8 +269,28 @@ func writeMachineReadablePart(utf8 bool, w *textproto.MultipartWriter, mtaInfo R
 	return nil
 }
 
-// failedText is the text of the human-readable part of DSN.
-var failedText = template.Must(template.New("dsn-text").Parse(`
+// TextData is the data passed to the template of the human-readable part
+// of DSN.
+type TextData struct {
+	ReportingMTAInfo
+
+	// Subject of the original message.
+	Subject string
+
+	// Delayed is true if the DSN is a warning about delayed delivery and
+	// the message is still being retried.
+	Delayed bool
+
+	Recipients []TextRecipient
+}
+
+type TextRecipient struct {
+	Address string
+	Error   string
+}
+
+// DefaultText is the default template of the human-readable part of DSN.
+var DefaultText = template.Must(template.New("dsn-text").Parse(`
 This is the mail delivery system at {{.ReportingMTA}}.
 
 Unfortunately, your message could not be delivered to one or more
@@ -269,9 +303,41 @@ Message ID: {{.XMessageID}}
 Arrival: {{.ArrivalDate}}
 Last delivery attempt: {{.LastAttemptDate}}
 
-`))
+{{range .Recipients}}Delivery to {{.Address}} failed with error: {{.Error}}
+{{end}}`))
+
+// DefaultDelayText is the default template of the human-readable part of
+// DSN reporting the delayed delivery.
+var DefaultDelayText = template.Must(template.New("dsn-delay-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message could not be delivered to one or more recipients yet.
+Delivery will be retried, you do not have to resend the message.
 
-func writeHumanReadablePart(w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+Contact the postmaster for further assistance, provide the Message ID (below):
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+Last delivery attempt: {{.LastAttemptDate}}
+
+{{range .Recipients}}Delivery to {{.Address}} is delayed due to error: {{.Error}}
+{{end}}`))
+
+// isDelayReport reports whether the DSN is only a warning about delayed
+// delivery.
+func isDelayReport(rcptsInfo []RecipientInfo) bool {
+	if len(rcptsInfo) == 0 {
+		return false
+	}
+	for _, rcpt := range rcptsInfo {
+		if rcpt.Action != ActionDelayed {
+			return false
+		}
+	}
+	return true
+}
+
+func writeHumanReadablePart(w *textproto.MultipartWriter, text *template.Template, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header) error {
 	humanHeader := textproto.Header{}
 	humanHeader.Add("Content-Transfer-Encoding", "8bit")
 	humanHeader.Add("Content-Type", `text/plain; charset="utf-8"`)
@@ -284,15 +350,26 @@ func writeHumanReadablePart(w *textproto.MultipartWriter, mtaInfo ReportingMTAIn
 	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
 	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
 
-	if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
-		return err
+	data := TextData{
+		ReportingMTAInfo: mtaInfo,
+		Delayed:          isDelayReport(rcptsInfo),
+		Recipients:       make([]TextRecipient, 0, len(rcptsInfo)),
 	}
-
+	mailHdr := mail.Header{Header: message.Header{Header: failedHeader}}
+	data.Subject, _ = mailHdr.Subject()
 	for _, rcpt := range rcptsInfo {
-		if _, err := fmt.Fprintf(humanWriter, "Delivery to %s failed with error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode); err != nil {
-			return err
-		}
+		data.Recipients = append(data.Recipients, TextRecipient{
+			Address: rcpt.FinalRecipient,
+			Error:   fmt.Sprint(rcpt.DiagnosticCode),
+		})
 	}
 
-	return nil
+	if text == nil {
+		if data.Delayed {
+			text = DefaultDelayText
+		} else {
+			text = DefaultText
+		}
+	}
+	return text.Execute(humanWriter, data)
 }
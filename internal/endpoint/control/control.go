@@ -0,0 +1,458 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package control implements the administration endpoint that allows to
+// inspect and change the server state at runtime.
+//
+// The endpoint listens on a Unix socket and accepts commands, one per line:
+//
+//	COMMAND [ARG...]\n
+//
+// Each command gets a single-line JSON response:
+//
+//	{"ok":true,"result":...}\n
+//	{"ok":false,"error":"message"}\n
+//
+// Access control is done using socket file permissions, only the user
+// running the server can connect to it.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	ctlstate "github.com/foxcpp/maddy/internal/control"
+)
+
+const modName = "control"
+
+// ErrUnavailable is returned by SendCommand if the endpoint socket is not
+// available, e.g. the server is not running.
+var ErrUnavailable = errors.New("control: endpoint is not available")
+
+// Response is the control endpoint reply to a single command.
+type Response struct {
+	OK     bool            `json:"ok"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type command struct {
+	usage   string
+	handler func(args []string) (interface{}, error)
+}
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	commands  map[string]command
+	listeners []net.Listener
+
+	reinjectTarget module.DeliveryTarget
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]struct{}
+	connsWg   sync.WaitGroup
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		conns:  make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// DefaultSocket returns the socket path used if no address is specified in
+// the configuration.
+func DefaultSocket() string {
+	return filepath.Join(config.RuntimeDirectory, "control.sock")
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.Custom("reinject_target", false, false, nil, modconfig.DeliveryDirective, &e.reinjectTarget)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	e.registerCommands()
+
+	if len(e.addrs) == 0 {
+		e.addrs = []string{"unix://" + DefaultSocket()}
+	}
+
+	for _, a := range e.addrs {
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if endp.Network() != "unix" {
+			return fmt.Errorf("%s: only Unix sockets are supported: %s", modName, a)
+		}
+		if module.NoRun {
+			continue
+		}
+
+		// Remove the socket left from the previous run, if any.
+		os.Remove(endp.Address())
+
+		l, err := listenUnix(endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		e.listeners = append(e.listeners, l)
+
+		e.logger.Println("listening on", endp.String())
+		go e.serve(l)
+	}
+
+	return nil
+}
+
+func (e *Endpoint) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		e.connsLock.Lock()
+		e.conns[conn] = struct{}{}
+		e.connsLock.Unlock()
+
+		e.connsWg.Add(1)
+		go func() {
+			defer e.connsWg.Done()
+			e.handleConn(conn)
+
+			e.connsLock.Lock()
+			delete(e.conns, conn)
+			e.connsLock.Unlock()
+		}()
+	}
+}
+
+func (e *Endpoint) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		if err := conn.SetDeadline(time.Now().Add(5 * time.Minute)); err != nil {
+			return
+		}
+		if !scanner.Scan() {
+			return
+		}
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		e.logger.Debugln("command:", args)
+		resp := e.runCommand(args)
+		respBytes, err := json.Marshal(resp)
+		if err != nil {
+			e.logger.Error("response serialization failed", err)
+			return
+		}
+		if _, err := conn.Write(append(respBytes, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+func (e *Endpoint) runCommand(args []string) Response {
+	cmd, ok := e.commands[strings.ToLower(args[0])]
+	if !ok {
+		return Response{Error: "unknown command, use 'help' to get the list of commands"}
+	}
+	res, err := cmd.handler(args[1:])
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	return Response{OK: true, Result: resBytes}
+}
+
+func (e *Endpoint) registerCommands() {
+	e.commands = map[string]command{
+		"help": {
+			usage:   "help",
+			handler: e.cmdHelp,
+		},
+		"conns": {
+			usage: "conns",
+			handler: func(args []string) (interface{}, error) {
+				return ctlstate.Conns(), nil
+			},
+		},
+		"queues": {
+			usage:   "queues [NAME]",
+			handler: cmdQueues,
+		},
+		"flush": {
+			usage:   "flush QUEUE [ID...]",
+			handler: cmdFlush,
+		},
+		"delete": {
+			usage:   "delete QUEUE ID",
+			handler: cmdDelete,
+		},
+		"status": {
+			usage:   "status QUEUE ID",
+			handler: cmdStatus,
+		},
+		"captured": {
+			usage:   "captured SINK [clear]",
+			handler: cmdCaptured,
+		},
+		"reinject": {
+			usage:   "reinject FILE",
+			handler: e.cmdReinject,
+		},
+		"reload": {
+			usage: "reload",
+			handler: func(args []string) (interface{}, error) {
+				e.logger.Printf("reloading state")
+				hooks.RunHooks(hooks.EventReload)
+				return nil, nil
+			},
+		},
+		"ban": {
+			usage:   "ban IP [DURATION]",
+			handler: e.cmdBan,
+		},
+		"unban": {
+			usage:   "unban IP",
+			handler: e.cmdUnban,
+		},
+		"bans": {
+			usage: "bans",
+			handler: func(args []string) (interface{}, error) {
+				return ctlstate.Bans(), nil
+			},
+		},
+		"readonly": {
+			usage:   "readonly [on|off]",
+			handler: e.cmdReadOnly,
+		},
+	}
+}
+
+func (e *Endpoint) cmdHelp(args []string) (interface{}, error) {
+	usage := make([]string, 0, len(e.commands))
+	for _, cmd := range e.commands {
+		usage = append(usage, cmd.usage)
+	}
+	sort.Strings(usage)
+	return usage, nil
+}
+
+func cmdQueues(args []string) (interface{}, error) {
+	names := ctlstate.QueueNames()
+	switch len(args) {
+	case 0:
+	case 1:
+		names = []string{args[0]}
+	default:
+		return nil, errors.New("at most one queue name is expected")
+	}
+
+	stats := make(map[string]ctlstate.QueueStats, len(names))
+	for _, name := range names {
+		q, ok := ctlstate.GetQueue(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown queue: %s", name)
+		}
+		stats[name] = q.Stats()
+	}
+	return stats, nil
+}
+
+func cmdFlush(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("queue name is required")
+	}
+	q, ok := ctlstate.GetQueue(args[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown queue: %s", args[0])
+	}
+	return map[string]int{"flushed": q.Flush(args[1:]...)}, nil
+}
+
+func cmdDelete(args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("usage: delete QUEUE ID")
+	}
+	q, ok := ctlstate.GetQueue(args[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown queue: %s", args[0])
+	}
+	return nil, q.Delete(args[1])
+}
+
+func cmdStatus(args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("usage: status QUEUE ID")
+	}
+	q, ok := ctlstate.GetQueue(args[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown queue: %s", args[0])
+	}
+	return q.DeliveryStatus(args[1])
+}
+
+func cmdCaptured(args []string) (interface{}, error) {
+	if len(args) != 1 && (len(args) != 2 || args[1] != "clear") {
+		return nil, errors.New("usage: captured SINK [clear]")
+	}
+	s, ok := ctlstate.GetSink(args[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown sink: %s", args[0])
+	}
+	if len(args) == 2 {
+		return map[string]int{"cleared": s.ClearCaptured()}, nil
+	}
+	return s.Captured(), nil
+}
+
+func (e *Endpoint) cmdBan(args []string) (interface{}, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("usage: ban IP [DURATION]")
+	}
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		return nil, fmt.Errorf("malformed IP address: %s", args[0])
+	}
+	var d time.Duration
+	if len(args) == 2 {
+		var err error
+		d, err = time.ParseDuration(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("ban duration should be positive")
+		}
+	}
+
+	ctlstate.Ban(ip, d)
+	e.logger.Msg("address banned", "ip", ip.String(), "duration", d)
+	return nil, nil
+}
+
+func (e *Endpoint) cmdUnban(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("usage: unban IP")
+	}
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		return nil, fmt.Errorf("malformed IP address: %s", args[0])
+	}
+	if !ctlstate.Unban(ip) {
+		return nil, fmt.Errorf("address is not banned: %s", ip)
+	}
+	e.logger.Msg("address unbanned", "ip", ip.String())
+	return nil, nil
+}
+
+func (e *Endpoint) cmdReadOnly(args []string) (interface{}, error) {
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "on":
+		ctlstate.SetReadOnly(true)
+		e.logger.Msg("read-only mode enabled")
+	case len(args) == 1 && args[0] == "off":
+		ctlstate.SetReadOnly(false)
+		e.logger.Msg("read-only mode disabled")
+	default:
+		return nil, errors.New("usage: readonly [on|off]")
+	}
+	return map[string]bool{"read_only": ctlstate.ReadOnly()}, nil
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	for _, l := range e.listeners {
+		l.Close()
+	}
+
+	e.connsLock.Lock()
+	for conn := range e.conns {
+		conn.Close()
+	}
+	e.connsLock.Unlock()
+	e.connsWg.Wait()
+	return nil
+}
+
+// SendCommand sends the command to the control endpoint listening on the
+// specified socket and returns the command result.
+func SendCommand(sockPath string, args ...string) (json.RawMessage, error) {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(args, " ") + "\n")); err != nil {
+		return nil, err
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("%s: malformed response: %w", modName, err)
+	}
+	if !resp.OK {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,276 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	ctlstate "github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type testQueue struct {
+	stats   ctlstate.QueueStats
+	flushed []string
+	deleted []string
+	status  map[string]*ctlstate.DeliveryStatus
+}
+
+func (q *testQueue) Stats() ctlstate.QueueStats {
+	return q.stats
+}
+
+func (q *testQueue) Flush(ids ...string) int {
+	q.flushed = ids
+	return len(ids)
+}
+
+func (q *testQueue) Delete(id string) error {
+	if _, ok := q.status[id]; !ok {
+		return errors.New("no such message")
+	}
+	q.deleted = append(q.deleted, id)
+	return nil
+}
+
+func (q *testQueue) DeliveryStatus(id string) (*ctlstate.DeliveryStatus, error) {
+	status, ok := q.status[id]
+	if !ok {
+		return nil, errors.New("no such message")
+	}
+	return status, nil
+}
+
+func testEndpoint(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "maddy-control-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "control.sock")
+
+	mod, err := New(modName, []string{"unix://" + sock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endp := mod.(*Endpoint)
+	endp.logger = testutils.Logger(t, modName)
+	if err := endp.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { endp.Close() })
+
+	info, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Fatalf("socket is accessible by other users: %v", info.Mode())
+	}
+
+	return sock
+}
+
+func sendCmd(t *testing.T, sock string, out interface{}, args ...string) {
+	t.Helper()
+
+	res, err := SendCommand(sock, args...)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	if out == nil {
+		return
+	}
+	if err := json.Unmarshal(res, out); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+}
+
+func TestControl_Bans(t *testing.T) {
+	sock := testEndpoint(t)
+
+	sendCmd(t, sock, nil, "ban", "192.0.2.1")
+	sendCmd(t, sock, nil, "ban", "2001:db8::1", "1h")
+	t.Cleanup(func() {
+		for _, ban := range ctlstate.Bans() {
+			sendCmd(t, sock, nil, "unban", ban.IP)
+		}
+	})
+
+	var bans []ctlstate.BanInfo
+	sendCmd(t, sock, &bans, "bans")
+	if len(bans) != 2 || bans[0].IP != "192.0.2.1" || bans[1].IP != "2001:db8::1" {
+		t.Fatalf("wrong ban list: %+v", bans)
+	}
+	if bans[0].Until != nil || bans[1].Until == nil {
+		t.Fatalf("wrong ban expiration: %+v", bans)
+	}
+
+	sendCmd(t, sock, nil, "unban", "192.0.2.1")
+	if _, err := SendCommand(sock, "unban", "192.0.2.1"); err == nil {
+		t.Fatal("expected error for address that is not banned")
+	}
+	if _, err := SendCommand(sock, "ban", "not-an-ip"); err == nil {
+		t.Fatal("expected error for malformed address")
+	}
+}
+
+func TestControl_ReadOnly(t *testing.T) {
+	sock := testEndpoint(t)
+	t.Cleanup(func() { ctlstate.SetReadOnly(false) })
+
+	var res map[string]bool
+	sendCmd(t, sock, &res, "readonly")
+	if res["read_only"] {
+		t.Fatal("read-only mode is enabled by default")
+	}
+
+	sendCmd(t, sock, &res, "readonly", "on")
+	if !res["read_only"] || !ctlstate.ReadOnly() {
+		t.Fatal("read-only mode is not enabled")
+	}
+
+	sendCmd(t, sock, &res, "readonly", "off")
+	if res["read_only"] || ctlstate.ReadOnly() {
+		t.Fatal("read-only mode is not disabled")
+	}
+
+	if _, err := SendCommand(sock, "readonly", "maybe"); err == nil {
+		t.Fatal("expected error for invalid argument")
+	}
+}
+
+func TestControl_Queues(t *testing.T) {
+	sock := testEndpoint(t)
+
+	q := &testQueue{
+		stats: ctlstate.QueueStats{
+			Messages: 2,
+			InFlight: 1,
+			Domains: map[string]ctlstate.DomainStats{
+				"example.org": {Pending: 2, Delivered: 5, TempFailed: 1},
+			},
+		},
+		status: map[string]*ctlstate.DeliveryStatus{
+			"A": {
+				ID:   "A",
+				From: "test@example.org",
+				Rcpts: map[string]ctlstate.RcptStatus{
+					"rcpt@example.org": {State: ctlstate.DeliveryDelivered, Attempts: 1},
+				},
+			},
+		},
+	}
+	ctlstate.RegisterQueue("test_queue", q)
+	t.Cleanup(func() { ctlstate.UnregisterQueue("test_queue") })
+
+	var stats map[string]ctlstate.QueueStats
+	sendCmd(t, sock, &stats, "queues")
+	if !reflect.DeepEqual(stats, map[string]ctlstate.QueueStats{"test_queue": q.stats}) {
+		t.Fatalf("wrong queue stats: %+v", stats)
+	}
+
+	var res map[string]int
+	sendCmd(t, sock, &res, "flush", "test_queue", "A", "B")
+	if res["flushed"] != 2 || !reflect.DeepEqual(q.flushed, []string{"A", "B"}) {
+		t.Fatalf("wrong flush result: %v, flushed: %v", res, q.flushed)
+	}
+
+	if _, err := SendCommand(sock, "flush", "unknown_queue"); err == nil {
+		t.Fatal("expected error for unknown queue")
+	}
+
+	sendCmd(t, sock, nil, "delete", "test_queue", "A")
+	if !reflect.DeepEqual(q.deleted, []string{"A"}) {
+		t.Fatalf("wrong deleted messages: %v", q.deleted)
+	}
+	if _, err := SendCommand(sock, "delete", "test_queue", "B"); err == nil {
+		t.Fatal("expected error for unknown message")
+	}
+
+	var status ctlstate.DeliveryStatus
+	sendCmd(t, sock, &status, "status", "test_queue", "A")
+	if status.Rcpts["rcpt@example.org"].State != ctlstate.DeliveryDelivered {
+		t.Fatalf("wrong delivery status: %+v", status)
+	}
+	if _, err := SendCommand(sock, "status", "test_queue", "B"); err == nil {
+		t.Fatal("expected error for unknown message")
+	}
+}
+
+type testSink struct {
+	msgs []ctlstate.CapturedMessage
+}
+
+func (s *testSink) Captured() []ctlstate.CapturedMessage {
+	return s.msgs
+}
+
+func (s *testSink) ClearCaptured() int {
+	n := len(s.msgs)
+	s.msgs = nil
+	return n
+}
+
+func TestControl_Captured(t *testing.T) {
+	sink := &testSink{msgs: []ctlstate.CapturedMessage{{ID: "A", From: "sender@example.org"}}}
+	ctlstate.RegisterSink("test_sink", sink)
+	defer ctlstate.UnregisterSink("test_sink")
+
+	sock := testEndpoint(t)
+
+	var msgs []ctlstate.CapturedMessage
+	sendCmd(t, sock, &msgs, "captured", "test_sink")
+	if len(msgs) != 1 || msgs[0].ID != "A" {
+		t.Fatalf("wrong captured messages: %+v", msgs)
+	}
+
+	var res map[string]int
+	sendCmd(t, sock, &res, "captured", "test_sink", "clear")
+	if res["cleared"] != 1 || len(sink.msgs) != 0 {
+		t.Fatalf("messages are not cleared: %v", res)
+	}
+
+	if _, err := SendCommand(sock, "captured", "unknown"); err == nil {
+		t.Fatal("expected error for unknown sink")
+	}
+}
+
+func TestControl_UnknownCommand(t *testing.T) {
+	sock := testEndpoint(t)
+
+	if _, err := SendCommand(sock, "whatever"); err == nil {
+		t.Fatal("expected error for unknown command")
+	}
+
+	var usage []string
+	sendCmd(t, sock, &usage, "help")
+	if len(usage) == 0 {
+		t.Fatal("empty help output")
+	}
+}
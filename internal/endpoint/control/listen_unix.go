@@ -0,0 +1,38 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package control
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUnix creates the Unix socket at path that is only accessible by the
+// current user.
+//
+// The umask is set before the socket is created so there is no window in
+// which the socket is reachable with default permissions.
+func listenUnix(path string) (net.Listener, error) {
+	old := unix.Umask(0077)
+	defer unix.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/future"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target/dir"
+)
+
+// reinjectTimeout is the time limit for the delivery of a single re-injected
+// message.
+const reinjectTimeout = 5 * time.Minute
+
+func (e *Endpoint) cmdReinject(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("usage: reinject FILE")
+	}
+	if e.reinjectTarget == nil {
+		return nil, errors.New("reinject_target is not configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reinjectTimeout)
+	defer cancel()
+
+	id, err := e.reinject(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"msg_id": id}, nil
+}
+
+// readSidecar reads the envelope information stored by target.dir next to
+// the message file.
+func readSidecar(path string) (dir.Metadata, error) {
+	var meta dir.Metadata
+
+	f, err := os.Open(strings.TrimSuffix(path, ".eml") + ".json")
+	if err != nil {
+		return meta, fmt.Errorf("cannot read envelope: %w", err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&meta); err != nil {
+		return meta, fmt.Errorf("malformed envelope: %w", err)
+	}
+	if len(meta.RcptTo) == 0 {
+		return meta, errors.New("malformed envelope: no recipients")
+	}
+	return meta, nil
+}
+
+// connState recreates the connection information using the stored
+// envelope so checks see the message as if it was received from the original
+// client.
+func connState(ctx context.Context, meta dir.Metadata) *module.ConnState {
+	state := &module.ConnState{
+		Proto:    meta.Proto,
+		AuthUser: meta.AuthUser,
+		ConnectionState: smtp.ConnectionState{
+			Hostname: meta.Hostname,
+		},
+		RDNSName: future.New(),
+	}
+
+	host, _, err := net.SplitHostPort(meta.SrcIP)
+	if err != nil {
+		host = meta.SrcIP
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		state.RDNSName.Set(nil, nil)
+		return state
+	}
+	state.RemoteAddr = &net.TCPAddr{IP: ip}
+
+	name, err := dns.LookupAddr(ctx, dns.DefaultResolver(), ip)
+	if err != nil {
+		state.RDNSName.Set(nil, err)
+		return state
+	}
+	state.RDNSName.Set(name, nil)
+	return state
+}
+
+func isASCII(s string) bool {
+	for _, ch := range s {
+		if ch > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// reinject delivers the message stored by target.dir to the reinject_target
+// using the original envelope.
+func (e *Endpoint) reinject(ctx context.Context, path string) (string, error) {
+	meta, err := readSidecar(path)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	bufr := bufio.NewReader(f)
+	header, err := textproto.ReadHeader(bufr)
+	if err != nil {
+		return "", fmt.Errorf("malformed message: %w", err)
+	}
+	body, err := buffer.BufferInMemory(bufr)
+	if err != nil {
+		return "", err
+	}
+	defer body.Remove()
+
+	msgMeta := &module.MsgMetadata{
+		OriginalFrom: meta.MailFrom,
+		Conn:         connState(ctx, meta),
+	}
+	msgMeta.ID, err = module.GenerateMsgID()
+	if err != nil {
+		return "", err
+	}
+	msgMeta.SMTPOpts.UTF8 = !isASCII(meta.MailFrom)
+	for _, rcpt := range meta.RcptTo {
+		if !isASCII(rcpt) {
+			msgMeta.SMTPOpts.UTF8 = true
+		}
+	}
+
+	e.logger.Msg("re-injecting message", "file", path, "orig_msg_id", meta.ID,
+		"msg_id", msgMeta.ID, "sender", meta.MailFrom)
+
+	delivery, err := e.reinjectTarget.Start(ctx, msgMeta, meta.MailFrom)
+	if err != nil {
+		return msgMeta.ID, err
+	}
+	if err := e.reinjectBody(ctx, delivery, meta.RcptTo, header, body); err != nil {
+		if err := delivery.Abort(ctx); err != nil {
+			e.logger.Error("delivery abort failed", err, "msg_id", msgMeta.ID)
+		}
+		e.logger.Error("re-injection failed", err, "msg_id", msgMeta.ID)
+		return msgMeta.ID, err
+	}
+
+	e.logger.Msg("re-injected", "msg_id", msgMeta.ID)
+	return msgMeta.ID, nil
+}
+
+func (e *Endpoint) reinjectBody(ctx context.Context, delivery module.Delivery, rcpts []string, header textproto.Header, body buffer.Buffer) error {
+	for _, rcpt := range rcpts {
+		if err := delivery.AddRcpt(ctx, rcpt); err != nil {
+			return fmt.Errorf("%s: %w", rcpt, err)
+		}
+	}
+	if err := delivery.Body(ctx, header, body); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
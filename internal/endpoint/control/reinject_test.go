@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestReinject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-reinject-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	eml := filepath.Join(dir, "msg.eml")
+	if err := ioutil.WriteFile(eml, []byte("Subject: hello\r\n\r\nfoobar\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "msg.json"), []byte(`{
+		"id": "orig",
+		"mail_from": "sender@example.org",
+		"rcpt_to": ["rcpt1@example.com", "rcpt2@example.com"],
+		"proto": "ESMTP",
+		"helo": "mx.example.org",
+		"auth_user": "sender"
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := testutils.Target{}
+	e := &Endpoint{
+		logger:         testutils.Logger(t, modName),
+		reinjectTarget: &tgt,
+	}
+
+	id, err := e.reinject(context.Background(), eml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("wrong amount of delivered messages: %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MsgMeta.ID != id || id == "orig" {
+		t.Errorf("wrong message ID: %s", msg.MsgMeta.ID)
+	}
+	if msg.MailFrom != "sender@example.org" {
+		t.Errorf("wrong sender: %s", msg.MailFrom)
+	}
+	if !reflect.DeepEqual(msg.RcptTo, []string{"rcpt1@example.com", "rcpt2@example.com"}) {
+		t.Errorf("wrong recipients: %v", msg.RcptTo)
+	}
+	if msg.MsgMeta.Conn.Hostname != "mx.example.org" || msg.MsgMeta.Conn.AuthUser != "sender" {
+		t.Errorf("connection state is not restored: %+v", msg.MsgMeta.Conn)
+	}
+	if msg.Header.Get("Subject") != "hello" || string(msg.Body) != "foobar\r\n" {
+		t.Errorf("wrong message contents: %v %q", msg.Header, msg.Body)
+	}
+}
+
+func TestReinject_NoEnvelope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-reinject-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	eml := filepath.Join(dir, "msg.eml")
+	if err := ioutil.WriteFile(eml, []byte("Subject: hello\r\n\r\nfoobar\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := testutils.Target{}
+	e := &Endpoint{
+		logger:         testutils.Logger(t, modName),
+		reinjectTarget: &tgt,
+	}
+	if _, err := e.reinject(context.Background(), eml); err == nil {
+		t.Fatal("expected error for message without envelope")
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("message is delivered")
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/listen"
 )
 
 const modName = "dovecot_sasld"
@@ -67,9 +68,16 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("master_users", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.AddMasterUsers(m, node)
+	})
+	cfg.StringList("sasl_mechanisms", false, false, nil, &endp.saslAuth.EnabledMechs)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	if err := endp.saslAuth.CheckMechanisms(); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
 
 	endp.srv = dovecotsasl.NewServer()
 	endp.srv.Log = stdlog.New(endp.log, "", 0)
@@ -91,22 +99,29 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
+		if module.NoRun {
+			continue
+		}
 
-		l, err := net.Listen(parsed.Network(), parsed.Address())
+		ls, err := listen.Options{}.Endpoint(parsed)
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
-		endp.log.Printf("listening on %v", l.Addr())
-
-		endp.listenersWg.Add(1)
-		go func() {
-			defer endp.listenersWg.Done()
-			if err := endp.srv.Serve(l); err != nil {
-				if !strings.HasSuffix(err.Error(), "use of closed network connection") {
-					endp.log.Printf("failed to serve %v: %v", l.Addr(), err)
+
+		for _, l := range ls {
+			l := l
+			endp.log.Printf("listening on %v", l.Addr())
+
+			endp.listenersWg.Add(1)
+			go func() {
+				defer endp.listenersWg.Done()
+				if err := endp.srv.Serve(l); err != nil {
+					if !strings.HasSuffix(err.Error(), "use of closed network connection") {
+						endp.log.Printf("failed to serve %v: %v", l.Addr(), err)
+					}
 				}
-			}
-		}()
+			}()
+		}
 	}
 
 	return nil
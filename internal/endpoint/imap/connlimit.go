@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/limits/userconns"
+)
+
+var errTooManyConns = imapserver.ErrStatusResp(&imap.StatusResp{
+	Type: imap.StatusRespNo,
+	Code: "LIMIT",
+	Info: "Too many connections for this account",
+})
+
+// takeUserConn registers the connection for the per-user connection limit.
+// The connection is released when the client logs out or disconnects.
+func (endp *Endpoint) takeUserConn(c imapserver.Conn, username string) error {
+	max, err := endp.connLimit.ForUser(context.TODO(), username)
+	if err != nil {
+		endp.Log.Error("connection limit lookup failed", err, "username", username)
+	}
+	if !userconns.Take(username, max) {
+		endp.Log.Msg("too many connections", "username", username, "src_ip", c.Info().RemoteAddr, "max", max)
+		return errTooManyConns
+	}
+
+	go func() {
+		<-c.Context().LoggedOut
+		userconns.Release(username)
+	}()
+	return nil
+}
+
+// connLimitExtension replaces the LOGIN command handler to enforce the
+// per-user connection limit since Backend.Login does not have access to the
+// connection. It does not advertise any capabilities.
+type connLimitExtension struct {
+	endp *Endpoint
+}
+
+func (connLimitExtension) Capabilities(imapserver.Conn) []string {
+	return nil
+}
+
+func (ext connLimitExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "LOGIN" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &loginCmd{endp: ext.endp}
+	}
+}
+
+type loginCmd struct {
+	imapserver.Login
+	endp *Endpoint
+}
+
+func (h *loginCmd) Handle(conn imapserver.Conn) error {
+	err := h.Login.Handle(conn)
+	ctx := conn.Context()
+	if ctx.State != imap.AuthenticatedState || ctx.User == nil {
+		return err
+	}
+
+	if limitErr := h.endp.takeUserConn(conn, ctx.User.Username()); limitErr != nil {
+		if logoutErr := ctx.User.Logout(); logoutErr != nil {
+			h.endp.Log.Error("logout failed", logoutErr, "username", ctx.User.Username())
+		}
+		ctx.User = nil
+		ctx.State = imap.NotAuthenticatedState
+		return limitErr
+	}
+	return err
+}
@@ -0,0 +1,234 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+var (
+	errShuttingDown = imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: "UNAVAILABLE",
+		Info: "Server is shutting down, try again later",
+	})
+	byeShuttingDown = &imap.StatusResp{
+		Type: imap.StatusRespBye,
+		Info: "Server is shutting down",
+	}
+)
+
+// builtinCommands is used to look up handlers for commands not overridden
+// by any extension.
+var builtinCommands = imapserver.New(nil)
+
+// Commands that are not tracked by drainExtension.
+//
+// IDLE waits for updates indefinitely, connections in the IDLE state are
+// closed right away on shutdown. STARTTLS and COMPRESS replace the connection
+// after the command is completed. UID looks up the actual handler using
+// Server.Command so it is tracked anyway.
+var drainIgnored = map[string]bool{
+	"IDLE":     true,
+	"LOGOUT":   true,
+	"STARTTLS": true,
+	"COMPRESS": true,
+	"UID":      true,
+}
+
+// drainExtension keeps track of connections and running commands so Shutdown
+// can let running commands complete before closing sessions.
+//
+// Once shutdown is started, connections are logged out after the running
+// command is completed and new commands are rejected.
+//
+// It should be enabled before all other extensions so its handlers take
+// precedence. Extensions enabled after it should be added to next, they are
+// used to look up the actual handlers.
+type drainExtension struct {
+	endp *Endpoint
+	next []imapserver.Extension
+}
+
+func (*drainExtension) Capabilities(imapserver.Conn) []string {
+	return nil
+}
+
+func (ext *drainExtension) NewConn(c imapserver.Conn) imapserver.Conn {
+	ext.endp.cmdLock.Lock()
+	defer ext.endp.cmdLock.Unlock()
+
+	// Connections accepted after shutdown started are closed by
+	// Endpoint.Close, Shutdown does not wait for them.
+	dc := &drainConn{Conn: c, endp: ext.endp, tracked: !ext.endp.shuttingDown}
+	if dc.tracked {
+		ext.endp.connWg.Add(1)
+	}
+	return dc
+}
+
+func (ext *drainExtension) Command(name string) imapserver.HandlerFactory {
+	if drainIgnored[name] {
+		return nil
+	}
+	next := ext.nextCommand(name)
+	if next == nil {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &drainHandler{Handler: next(), endp: ext.endp}
+	}
+}
+
+func (ext *drainExtension) nextCommand(name string) imapserver.HandlerFactory {
+	for _, e := range ext.next {
+		if f := e.Command(name); f != nil {
+			return f
+		}
+	}
+	return builtinCommands.Command(name)
+}
+
+type drainConn struct {
+	imapserver.Conn
+	endp    *Endpoint
+	tracked bool
+
+	closeOnce sync.Once
+}
+
+func (c *drainConn) Close() error {
+	err := c.Conn.Close()
+	if c.tracked {
+		c.closeOnce.Do(c.endp.connWg.Done)
+	}
+	return err
+}
+
+type drainHandler struct {
+	imapserver.Handler
+	endp *Endpoint
+}
+
+func (h *drainHandler) Handle(conn imapserver.Conn) error {
+	return h.run(conn, func() error {
+		return h.Handler.Handle(conn)
+	})
+}
+
+func (h *drainHandler) UidHandle(conn imapserver.Conn) error {
+	uidHdlr, ok := h.Handler.(imapserver.UidHandler)
+	if !ok {
+		return errors.New("Command unsupported with UID")
+	}
+	return h.run(conn, func() error {
+		return uidHdlr.UidHandle(conn)
+	})
+}
+
+func (h *drainHandler) run(conn imapserver.Conn, handle func() error) error {
+	if !h.endp.beginCmd(conn) {
+		logoutShutdown(conn)
+		return errShuttingDown
+	}
+	err := handle()
+	if h.endp.endCmd(conn) {
+		logoutShutdown(conn)
+	}
+	return err
+}
+
+// logoutShutdown makes the server close the connection once the response to
+// the current command is sent. It should be called only from command
+// handlers.
+func logoutShutdown(conn imapserver.Conn) {
+	conn.WriteResp(byeShuttingDown)
+	conn.Context().State = imap.LogoutState
+}
+
+// beginCmd marks the connection as running a command. false is returned if
+// shutdown is already started.
+func (endp *Endpoint) beginCmd(conn imapserver.Conn) bool {
+	endp.cmdLock.Lock()
+	defer endp.cmdLock.Unlock()
+	if endp.shuttingDown {
+		return false
+	}
+	if endp.busyConns == nil {
+		endp.busyConns = make(map[imapserver.Conn]struct{})
+	}
+	endp.busyConns[conn] = struct{}{}
+	return true
+}
+
+// endCmd marks the command running on the connection as completed and
+// reports whether shutdown was started while it was running.
+func (endp *Endpoint) endCmd(conn imapserver.Conn) bool {
+	endp.cmdLock.Lock()
+	defer endp.cmdLock.Unlock()
+	delete(endp.busyConns, conn)
+	return endp.shuttingDown
+}
+
+// Shutdown stops accepting new connections and commands, closes idle
+// connections and waits for running commands to complete.
+func (endp *Endpoint) Shutdown(ctx context.Context) error {
+	endp.cmdLock.Lock()
+	endp.shuttingDown = true
+	busy := make(map[imapserver.Conn]struct{}, len(endp.busyConns))
+	for c := range endp.busyConns {
+		busy[c] = struct{}{}
+	}
+	endp.cmdLock.Unlock()
+
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+
+	// Connections running a command are logged out by drainHandler once the
+	// command is completed.
+	endp.serv.ForEachConn(func(c imapserver.Conn) {
+		if _, ok := busy[c]; ok {
+			return
+		}
+		// Client may not read the response, don't block there.
+		go func() {
+			c.WriteResp(byeShuttingDown)
+			c.Close()
+		}()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		endp.connWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		endp.Log.Printf("shutdown grace period expired, aborting running commands")
+	}
+
+	return endp.Close()
+}
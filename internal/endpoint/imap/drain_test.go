@@ -0,0 +1,182 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type slowExtension struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (slowExtension) Capabilities(imapserver.Conn) []string {
+	return nil
+}
+
+func (ext slowExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "SLOW" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &slowHandler{ext: ext}
+	}
+}
+
+type slowHandler struct {
+	imapserver.Noop
+	ext slowExtension
+}
+
+func (h *slowHandler) Handle(imapserver.Conn) error {
+	h.ext.started <- struct{}{}
+	<-h.ext.release
+	return nil
+}
+
+func TestShutdown_Drain(t *testing.T) {
+	slow := slowExtension{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	endp := &Endpoint{
+		Log: testutils.Logger(t, "imap"),
+	}
+	endp.serv = imapserver.New(memory.New())
+	endp.serv.AllowInsecureAuth = true
+	endp.serv.Enable(&drainExtension{endp: endp, next: []imapserver.Extension{slow}})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endp.listeners = append(endp.listeners, l)
+	go endp.serv.Serve(l)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		readLine(t, r) // greeting
+		return conn, r
+	}
+	conn1, r1 := dial()
+	_, r2 := dial()
+
+	if _, err := conn1.Write([]byte("a SLOW\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-slow.started
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- endp.Shutdown(context.Background())
+	}()
+
+	// Idle connection is closed right away.
+	if line := readLine(t, r2); !strings.HasPrefix(line, "* BYE") {
+		t.Fatal("Unexpected response:", line)
+	}
+	if _, err := r2.ReadString('\n'); err != io.EOF {
+		t.Fatal("Expected EOF, got", err)
+	}
+
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the running command completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(slow.release)
+	if line := readLine(t, r1); !strings.HasPrefix(line, "* BYE") {
+		t.Fatal("Unexpected response:", line)
+	}
+	if line := readLine(t, r1); !strings.HasPrefix(line, "a OK") {
+		t.Fatal("Unexpected response:", line)
+	}
+	if _, err := r1.ReadString('\n'); err != io.EOF {
+		t.Fatal("Expected EOF, got", err)
+	}
+
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestShutdown_GraceExpired(t *testing.T) {
+	slow := slowExtension{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	defer close(slow.release)
+	endp := &Endpoint{
+		Log: testutils.Logger(t, "imap"),
+	}
+	endp.serv = imapserver.New(memory.New())
+	endp.serv.AllowInsecureAuth = true
+	endp.serv.Enable(&drainExtension{endp: endp, next: []imapserver.Extension{slow}})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endp.listeners = append(endp.listeners, l)
+	go endp.serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readLine(t, r) // greeting
+	if _, err := conn.Write([]byte("a SLOW\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-slow.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := endp.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
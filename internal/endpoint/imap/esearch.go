@@ -0,0 +1,183 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// esearchExtension implements the ESEARCH extension (RFC 4731).
+//
+// It replaces the SEARCH command handler from go-imap. Commands without
+// the RETURN option are handled the same way as before.
+//
+// Note that go-imap does not provide the command tag to handlers, so the
+// search correlator is not included in ESEARCH responses.
+type esearchExtension struct{}
+
+func (esearchExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+	return []string{"ESEARCH"}
+}
+
+func (esearchExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "SEARCH" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &esearchHandler{}
+	}
+}
+
+type esearchHandler struct {
+	commands.Search
+
+	// nil if RETURN is not used.
+	returnOpts map[string]bool
+}
+
+func (h *esearchHandler) Parse(fields []interface{}) error {
+	if len(fields) > 0 {
+		if f, ok := fields[0].(string); ok && strings.EqualFold(f, "RETURN") {
+			if len(fields) < 2 {
+				return errors.New("Missing RETURN options")
+			}
+			opts, ok := fields[1].([]interface{})
+			if !ok {
+				return errors.New("RETURN options must be a list")
+			}
+
+			h.returnOpts = make(map[string]bool, len(opts))
+			for _, opt := range opts {
+				optStr, ok := opt.(string)
+				if !ok {
+					return errors.New("RETURN option must be an atom")
+				}
+				optStr = strings.ToUpper(optStr)
+				switch optStr {
+				case "MIN", "MAX", "ALL", "COUNT":
+					h.returnOpts[optStr] = true
+				default:
+					return errors.New("Unsupported RETURN option: " + optStr)
+				}
+			}
+			// RFC 4731, Section 3.1: "RETURN ()" is the same as "RETURN (ALL)".
+			if len(h.returnOpts) == 0 {
+				h.returnOpts["ALL"] = true
+			}
+
+			fields = fields[2:]
+		}
+	}
+
+	return h.Search.Parse(fields)
+}
+
+func (h *esearchHandler) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	ids, err := ctx.Mailbox.SearchMessages(uid, h.Criteria)
+	if err != nil {
+		return err
+	}
+
+	if h.returnOpts == nil {
+		return conn.WriteResp(&responses.Search{Ids: ids})
+	}
+	return conn.WriteResp(newESearchResponse(uid, h.returnOpts, ids))
+}
+
+func (h *esearchHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *esearchHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+// esearchResponse contains only the data requested by RETURN options,
+// the sequence set is built only if ALL is requested.
+type esearchResponse struct {
+	uid      bool
+	opts     map[string]bool
+	count    int
+	min, max uint32
+	all      *imap.SeqSet
+}
+
+func newESearchResponse(uid bool, opts map[string]bool, ids []uint32) *esearchResponse {
+	r := &esearchResponse{
+		uid:   uid,
+		opts:  opts,
+		count: len(ids),
+	}
+
+	if opts["MIN"] || opts["MAX"] {
+		// Results are not guaranteed to be sorted.
+		for _, id := range ids {
+			if r.min == 0 || id < r.min {
+				r.min = id
+			}
+			if id > r.max {
+				r.max = id
+			}
+		}
+	}
+	if opts["ALL"] && len(ids) != 0 {
+		r.all = &imap.SeqSet{}
+		r.all.AddNum(ids...)
+	}
+	return r
+}
+
+func (r *esearchResponse) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString("ESEARCH")}
+	if r.uid {
+		fields = append(fields, imap.RawString("UID"))
+	}
+
+	// RFC 4731, Section 3.1: MIN, MAX and ALL are omitted if nothing
+	// matched.
+	if r.opts["MIN"] && r.count != 0 {
+		fields = append(fields, imap.RawString("MIN"), imap.RawString(strconv.FormatUint(uint64(r.min), 10)))
+	}
+	if r.opts["MAX"] && r.count != 0 {
+		fields = append(fields, imap.RawString("MAX"), imap.RawString(strconv.FormatUint(uint64(r.max), 10)))
+	}
+	if r.all != nil {
+		fields = append(fields, imap.RawString("ALL"), imap.RawString(r.all.String()))
+	}
+	if r.opts["COUNT"] {
+		fields = append(fields, imap.RawString("COUNT"), imap.RawString(strconv.Itoa(r.count)))
+	}
+
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
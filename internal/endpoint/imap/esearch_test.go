@@ -0,0 +1,87 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestESearchParse(t *testing.T) {
+	h := esearchHandler{}
+	if err := h.Parse([]interface{}{"RETURN", []interface{}{"min", "COUNT"}, "UNSEEN"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.returnOpts) != 2 || !h.returnOpts["MIN"] || !h.returnOpts["COUNT"] {
+		t.Fatalf("wrong return options: %v", h.returnOpts)
+	}
+	if h.Criteria.WithoutFlags[0] != imap.SeenFlag {
+		t.Fatalf("wrong criteria: %+v", h.Criteria)
+	}
+
+	h = esearchHandler{}
+	if err := h.Parse([]interface{}{"RETURN", []interface{}{}, "ALL"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.returnOpts) != 1 || !h.returnOpts["ALL"] {
+		t.Fatalf("wrong return options for empty list: %v", h.returnOpts)
+	}
+
+	h = esearchHandler{}
+	if err := h.Parse([]interface{}{"ALL"}); err != nil {
+		t.Fatal(err)
+	}
+	if h.returnOpts != nil {
+		t.Fatal("return options are set for plain SEARCH")
+	}
+
+	h = esearchHandler{}
+	if err := h.Parse([]interface{}{"RETURN", []interface{}{"SAVE"}, "ALL"}); err == nil {
+		t.Fatal("unsupported option is accepted")
+	}
+}
+
+func TestESearchResponse(t *testing.T) {
+	test := func(resp *esearchResponse, expected string) {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := resp.WriteTo(imap.NewWriter(&buf)); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expected {
+			t.Errorf("wrong response: %q (want %q)", buf.String(), expected)
+		}
+	}
+
+	all := map[string]bool{"MIN": true, "MAX": true, "ALL": true, "COUNT": true}
+	test(newESearchResponse(false, all, []uint32{5, 2, 3, 4, 9}),
+		"* ESEARCH MIN 2 MAX 9 ALL 2:5,9 COUNT 5\r\n")
+	test(newESearchResponse(true, map[string]bool{"MAX": true}, []uint32{5, 2}),
+		"* ESEARCH UID MAX 5\r\n")
+	test(newESearchResponse(false, all, nil),
+		"* ESEARCH COUNT 0\r\n")
+
+	resp := newESearchResponse(false, map[string]bool{"MIN": true, "COUNT": true}, []uint32{5, 2})
+	if resp.all != nil {
+		t.Error("sequence set is built without ALL")
+	}
+	test(resp, "* ESEARCH MIN 2 COUNT 2\r\n")
+}
@@ -0,0 +1,190 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// RFC 2971, Section 3.3: field strings must not be longer than 30 octets,
+// value strings must not be longer than 1024 octets and there should be no
+// more than 30 field-value pairs.
+const (
+	idMaxFieldLen = 30
+	idMaxValueLen = 1024
+	idMaxPairs    = 30
+)
+
+// defaultIDFields is used as the ID response if the id_fields directive is
+// not specified.
+var defaultIDFields = map[string]string{
+	"name": "maddy",
+}
+
+// parseIDFields parses the id_fields block.
+//
+//	id_fields {
+//	    name "Example Mail"
+//	    support-url https://example.org/support
+//	}
+//
+// Empty block disables server identification completely.
+func parseIDFields(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "unexpected arguments")
+	}
+	if len(node.Children) > idMaxPairs {
+		return nil, config.NodeErr(node, "too many fields, at most %d are allowed", idMaxPairs)
+	}
+
+	fields := make(map[string]string, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 {
+			return nil, config.NodeErr(child, "exactly one value is required")
+		}
+		if len(child.Name) > idMaxFieldLen {
+			return nil, config.NodeErr(child, "field name is too long")
+		}
+		if len(child.Args[0]) > idMaxValueLen {
+			return nil, config.NodeErr(child, "field value is too long")
+		}
+		fields[strings.ToLower(child.Name)] = child.Args[0]
+	}
+	return fields, nil
+}
+
+// idExtension implements the ID extension (RFC 2971).
+//
+// Client-provided fields are logged to help diagnose client-specific
+// problems.
+type idExtension struct {
+	fields map[string]string
+	log    *log.Logger
+}
+
+func (ext idExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{"ID"}
+}
+
+func (ext idExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "ID" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &idHandler{ext: ext}
+	}
+}
+
+type idHandler struct {
+	ext idExtension
+
+	// nil if client sent NIL.
+	clientFields map[string]string
+}
+
+func (h *idHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("Expected exactly one argument")
+	}
+	if fields[0] == nil {
+		return nil
+	}
+
+	list, ok := fields[0].([]interface{})
+	if !ok {
+		return errors.New("Argument must be a list or NIL")
+	}
+	if len(list)%2 != 0 {
+		return errors.New("Odd number of elements in the field list")
+	}
+	if len(list)/2 > idMaxPairs {
+		return errors.New("Too many fields")
+	}
+
+	h.clientFields = make(map[string]string, len(list)/2)
+	for i := 0; i < len(list); i += 2 {
+		key, err := imap.ParseString(list[i])
+		if err != nil {
+			return errors.New("Field name must be a string")
+		}
+		if len(key) > idMaxFieldLen {
+			return errors.New("Field name is too long")
+		}
+
+		var value string
+		if list[i+1] != nil {
+			value, err = imap.ParseString(list[i+1])
+			if err != nil {
+				return errors.New("Field value must be a string or NIL")
+			}
+			if len(value) > idMaxValueLen {
+				return errors.New("Field value is too long")
+			}
+		}
+		h.clientFields[strings.ToLower(key)] = value
+	}
+	return nil
+}
+
+func (h *idHandler) Handle(conn imapserver.Conn) error {
+	if h.clientFields != nil {
+		args := []interface{}{"src_ip", conn.Info().RemoteAddr.String()}
+		if u := conn.Context().User; u != nil {
+			args = append(args, "username", u.Username())
+		}
+		for _, key := range sortedKeys(h.clientFields) {
+			args = append(args, "client_"+key, h.clientFields[key])
+		}
+		h.ext.log.Msg("client identification", args...)
+	}
+
+	return conn.WriteResp(&idResponse{fields: h.ext.fields})
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type idResponse struct {
+	fields map[string]string
+}
+
+func (r *idResponse) WriteTo(w *imap.Writer) error {
+	if len(r.fields) == 0 {
+		return imap.NewUntaggedResp([]interface{}{imap.RawString("ID"), nil}).WriteTo(w)
+	}
+
+	list := make([]interface{}, 0, len(r.fields)*2)
+	for _, key := range sortedKeys(r.fields) {
+		list = append(list, key, r.fields[key])
+	}
+	return imap.NewUntaggedResp([]interface{}{imap.RawString("ID"), list}).WriteTo(w)
+}
@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestIDParse(t *testing.T) {
+	h := idHandler{}
+	if err := h.Parse([]interface{}{nil}); err != nil {
+		t.Fatal(err)
+	}
+	if h.clientFields != nil {
+		t.Fatal("fields are set for ID NIL")
+	}
+
+	h = idHandler{}
+	if err := h.Parse([]interface{}{[]interface{}{"Name", "Thunderbird", "version", nil}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.clientFields) != 2 || h.clientFields["name"] != "Thunderbird" || h.clientFields["version"] != "" {
+		t.Fatalf("wrong fields: %v", h.clientFields)
+	}
+
+	for _, fields := range [][]interface{}{
+		{},
+		{"name"},
+		{[]interface{}{"name"}},
+		{[]interface{}{"thisfieldnameislongerthanthirtybytes", "value"}},
+	} {
+		h = idHandler{}
+		if err := h.Parse(fields); err == nil {
+			t.Errorf("invalid arguments accepted: %v", fields)
+		}
+	}
+}
+
+func TestIDResponse(t *testing.T) {
+	test := func(resp *idResponse, expected string) {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := resp.WriteTo(imap.NewWriter(&buf)); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expected {
+			t.Errorf("wrong response: %q (want %q)", buf.String(), expected)
+		}
+	}
+
+	test(&idResponse{fields: map[string]string{"support-url": "https://example.org", "name": "maddy"}},
+		"* ID (\"name\" \"maddy\" \"support-url\" \"https://example.org\")\r\n")
+	test(&idResponse{}, "* ID NIL\r\n")
+}
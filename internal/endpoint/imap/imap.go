@@ -25,6 +25,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	appendlimit "github.com/emersion/go-imap-appendlimit"
@@ -48,20 +49,38 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/limits/userconns"
+	"github.com/foxcpp/maddy/internal/listen"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 )
 
 type Endpoint struct {
-	addrs     []string
-	serv      *imapserver.Server
-	listeners []net.Listener
-	Store     module.Storage
+	addrs      []string
+	serv       *imapserver.Server
+	listeners  []net.Listener
+	listenOpts listen.Options
+	Store      module.Storage
 
 	updater     imapbackend.BackendUpdater
 	tlsConfig   *tls.Config
 	listenersWg sync.WaitGroup
 
-	saslAuth auth.SASLAuth
+	saslAuth  auth.SASLAuth
+	connLimit userconns.Limit
+
+	idleTimeout time.Duration
+	// conns contains *idleConn for each accepted connection if
+	// idle_timeout is enabled.
+	conns sync.Map
+
+	idFields map[string]string
+
+	// cmdLock protects shuttingDown flag, busyConns and connWg counter.
+	cmdLock      sync.Mutex
+	busyConns    map[imapserver.Conn]struct{}
+	connWg       sync.WaitGroup
+	shuttingDown bool
 
 	Log log.Logger
 }
@@ -88,12 +107,22 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("master_users", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.AddMasterUsers(m, node)
+	})
+	cfg.StringList("sasl_mechanisms", false, false, nil, &endp.saslAuth.EnabledMechs)
 	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &endp.Store)
 	cfg.Custom("tls", true, true, nil, tls2.TLSDirective, &endp.tlsConfig)
+	cfg.Custom("id_fields", false, false, func() (interface{}, error) {
+		return defaultIDFields, nil
+	}, parseIDFields, &endp.idFields)
 	cfg.Bool("insecure_auth", false, false, &insecureAuth)
+	cfg.Duration("idle_timeout", false, false, 30*time.Minute, &endp.idleTimeout)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("io_errors", false, false, &ioErrors)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	listen.Directives(cfg, &endp.listenOpts)
+	userconns.Directives(cfg, &endp.connLimit)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -104,16 +133,18 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		return fmt.Errorf("imap: storage module %T does not implement imapbackend.BackendUpdater", endp.Store)
 	}
 
-	if updBe, ok := endp.Store.(updatepipe.Backend); ok {
-		if err := updBe.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
-			endp.Log.Error("failed to initialize updates pipe", err)
+	if !module.NoRun {
+		if updBe, ok := endp.Store.(updatepipe.Backend); ok {
+			if err := updBe.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
+				endp.Log.Error("failed to initialize updates pipe", err)
+			}
 		}
-	}
 
-	// Call Updates once at start, some storage backends initialize update
-	// channel lazily and may not generate updates at all unless it is called.
-	if endp.updater.Updates() == nil {
-		return fmt.Errorf("imap: failed to init backend: nil update channel")
+		// Call Updates once at start, some storage backends initialize update
+		// channel lazily and may not generate updates at all unless it is called.
+		if endp.updater.Updates() == nil {
+			return fmt.Errorf("imap: failed to init backend: nil update channel")
+		}
 	}
 
 	addresses := make([]config.Endpoint, 0, len(endp.addrs))
@@ -142,6 +173,17 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		return err
 	}
 
+	if err := endp.saslAuth.CheckMechanisms(); err != nil {
+		return fmt.Errorf("imap: %w", err)
+	}
+	if !endp.saslAuth.MechEnabled(sasl.Plain) {
+		// go-imap enables PLAIN by default and provides no way to remove
+		// it, so it stays advertised but is replaced with a handler that
+		// always fails.
+		endp.serv.EnableAuth(sasl.Plain, func(imapserver.Conn) sasl.Server {
+			return auth.FailingSASLServ{Err: auth.ErrUnsupportedMech}
+		})
+	}
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		mech := mech
 		endp.serv.EnableAuth(mech, func(c imapserver.Conn) sasl.Server {
@@ -151,40 +193,52 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		})
 	}
 
+	if module.NoRun {
+		return nil
+	}
+
 	if err := endp.setupListeners(addresses); err != nil {
 		return err
 	}
+	control.RegisterConnSource(endp.controlName(), endp.controlConns)
 
 	return nil
 }
 
 func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	for _, addr := range addresses {
-		var l net.Listener
-		var err error
-		l, err = net.Listen(addr.Network(), addr.Address())
-		if err != nil {
-			return fmt.Errorf("imap: %v", err)
+		if addr.IsTLS() && endp.tlsConfig == nil {
+			return errors.New("imap: can't bind on IMAPS endpoint without TLS configuration")
 		}
-		endp.Log.Printf("listening on %v", addr)
 
-		if addr.IsTLS() {
-			if endp.tlsConfig == nil {
-				return errors.New("imap: can't bind on IMAPS endpoint without TLS configuration")
-			}
-			l = tls.NewListener(l, endp.tlsConfig)
+		ls, err := endp.listenOpts.Endpoint(addr)
+		if err != nil {
+			return fmt.Errorf("imap: %v", err)
 		}
 
-		endp.listeners = append(endp.listeners, l)
+		for _, l := range ls {
+			endp.Log.Printf("listening on %v", addr)
 
-		endp.listenersWg.Add(1)
-		addr := addr
-		go func() {
-			if err := endp.serv.Serve(l); err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
-				endp.Log.Printf("imap: failed to serve %s: %s", addr, err)
+			l = control.FilterListener(l)
+			if endp.idleTimeout != 0 {
+				l = idleListener{Listener: l, endp: endp}
 			}
-			endp.listenersWg.Done()
-		}()
+			if addr.IsTLS() {
+				l = tls.NewListener(l, endp.tlsConfig)
+			}
+
+			endp.listeners = append(endp.listeners, l)
+
+			endp.listenersWg.Add(1)
+			addr := addr
+			l := l
+			go func() {
+				if err := endp.serv.Serve(l); err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
+					endp.Log.Printf("imap: failed to serve %s: %s", addr, err)
+				}
+				endp.listenersWg.Done()
+			}()
+		}
 	}
 
 	if endp.serv.AllowInsecureAuth {
@@ -211,6 +265,7 @@ func (endp *Endpoint) InstanceName() string {
 }
 
 func (endp *Endpoint) Close() error {
+	control.UnregisterConnSource(endp.controlName())
 	for _, l := range endp.listeners {
 		l.Close()
 	}
@@ -221,11 +276,48 @@ func (endp *Endpoint) Close() error {
 	return nil
 }
 
+func (endp *Endpoint) controlName() string {
+	return "imap " + strings.Join(endp.addrs, " ")
+}
+
+// controlConns returns the list of accepted connections for the control
+// endpoint.
+func (endp *Endpoint) controlConns() []control.ConnInfo {
+	var conns []control.ConnInfo
+	endp.serv.ForEachConn(func(c imapserver.Conn) {
+		info := control.ConnInfo{
+			Endpoint:   endp.controlName(),
+			RemoteAddr: c.Info().RemoteAddr.String(),
+			TLS:        c.IsTLS(),
+		}
+		if u := c.Context().User; u != nil {
+			info.Username = u.Username()
+		}
+		conns = append(conns, info)
+	})
+	return conns
+}
+
+// getAccount returns the storage account, creating it if it does not
+// exist unless the server is in the read-only mode.
+func (endp *Endpoint) getAccount(username string) (imapbackend.User, error) {
+	if control.ReadOnly() {
+		return endp.Store.GetIMAPAcct(username)
+	}
+	return endp.Store.GetOrCreateIMAPAcct(username)
+}
+
 func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
-	u, err := endp.Store.GetOrCreateIMAPAcct(identity)
+	u, err := endp.getAccount(identity)
 	if err != nil {
 		return err
 	}
+	if err := endp.takeUserConn(c, identity); err != nil {
+		if logoutErr := u.Logout(); logoutErr != nil {
+			endp.Log.Error("logout failed", logoutErr, "username", identity)
+		}
+		return err
+	}
 	ctx := c.Context()
 	ctx.State = imap.AuthenticatedState
 	ctx.User = u
@@ -233,13 +325,19 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 }
 
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
+	// LOGIN command is the same plain-text password authentication.
+	if !endp.saslAuth.MechEnabled(sasl.Plain) && !endp.saslAuth.MechEnabled(sasl.Login) {
+		endp.Log.Msg("attempt to use disabled LOGIN command", "username", username, "src_ip", connInfo.RemoteAddr)
+		return nil, imapbackend.ErrInvalidCredentials
+	}
+
 	err := endp.saslAuth.AuthPlain(username, password)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
 		return nil, imapbackend.ErrInvalidCredentials
 	}
 
-	return endp.Store.GetOrCreateIMAPAcct(username)
+	return endp.getAccount(username)
 }
 
 func (endp *Endpoint) EnableChildrenExt() bool {
@@ -255,31 +353,61 @@ func (endp *Endpoint) I18NLevel() int {
 }
 
 func (endp *Endpoint) enableExtensions() error {
+	// Shutdown tracking should wrap all other handlers, read-only mode
+	// handlers should take precedence over all other extensions.
+	drain := &drainExtension{endp: endp}
+	endp.serv.Enable(drain)
+	readOnly := &readOnlyExtension{}
+	endp.serv.Enable(readOnly)
+	drain.next = append(drain.next, readOnly)
+	enable := func(ext imapserver.Extension) {
+		endp.serv.Enable(ext)
+		readOnly.next = append(readOnly.next, ext)
+		drain.next = append(drain.next, ext)
+	}
+
 	exts := endp.Store.IMAPExtensions()
+	// UIDPLUS overrides the MOVE command handler and so should be enabled
+	// before the MOVE extension.
+	for _, ext := range exts {
+		if ext == "UIDPLUS" {
+			enable(uidplusExtension{})
+		}
+	}
+
+	threadEnabled := false
 	for _, ext := range exts {
 		switch ext {
 		case "APPENDLIMIT":
-			endp.serv.Enable(appendlimit.NewExtension())
+			enable(appendlimit.NewExtension())
 		case "CHILDREN":
-			endp.serv.Enable(children.NewExtension())
+			enable(children.NewExtension())
 		case "MOVE":
-			endp.serv.Enable(move.NewExtension())
+			enable(move.NewExtension())
 		case "SPECIAL-USE":
-			endp.serv.Enable(specialuse.NewExtension())
+			enable(specialuse.NewExtension())
 		case "I18NLEVEL=1", "I18NLEVEL=2":
-			endp.serv.Enable(i18nlevel.NewExtension())
+			enable(i18nlevel.NewExtension())
 		case "SORT":
-			endp.serv.Enable(sortthread.NewSortExtension())
+			enable(sortthread.NewSortExtension())
+		case "PREVIEW":
+			enable(previewExtension{})
 		}
-		if strings.HasPrefix(ext, "THREAD") {
-			endp.serv.Enable(sortthread.NewThreadExtension())
+		// Storage lists each supported algorithm separately.
+		if strings.HasPrefix(ext, "THREAD") && !threadEnabled {
+			enable(threadExtension{})
+			threadEnabled = true
 		}
 	}
 
-	endp.serv.Enable(compress.NewExtension())
-	endp.serv.Enable(unselect.NewExtension())
-	endp.serv.Enable(idle.NewExtension())
-	endp.serv.Enable(namespace.NewExtension())
+	enable(compress.NewExtension())
+	enable(unselect.NewExtension())
+	enable(idleExtension{Extension: idle.NewExtension(), endp: endp})
+	enable(namespace.NewExtension())
+	enable(esearchExtension{})
+	enable(listExtension{})
+	enable(idExtension{fields: endp.idFields, log: &endp.Log})
+	enable(connLimitExtension{endp: endp})
 
 	return nil
 }
@@ -0,0 +1,365 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+const (
+	subscribedAttr  = `\Subscribed`
+	hasChildrenAttr = `\HasChildren`
+	hasNoChildAttr  = `\HasNoChildren`
+)
+
+// listExtension implements LIST-EXTENDED (RFC 5258) and LIST-STATUS
+// (RFC 5819) extensions.
+//
+// It replaces the LIST command handler from go-imap. Commands using the
+// basic syntax are passed to the original handler.
+type listExtension struct{}
+
+func (listExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+	return []string{"LIST-EXTENDED", "LIST-STATUS"}
+}
+
+func (listExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "LIST" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &listExtHandler{}
+	}
+}
+
+type listExtHandler struct {
+	ref      string
+	patterns []string
+
+	// Set if LIST-EXTENDED syntax is used.
+	extended bool
+
+	selSubscribed     bool
+	selRecursiveMatch bool
+
+	retSubscribed bool
+	retChildren   bool
+	retStatus     []imap.StatusItem
+}
+
+func parseMboxName(f interface{}) (string, error) {
+	name, err := imap.ParseString(f)
+	if err != nil {
+		return "", err
+	}
+	name, err = utf7.Encoding.NewDecoder().String(name)
+	if err != nil {
+		return "", err
+	}
+	return imap.CanonicalMailboxName(name), nil
+}
+
+func optStrings(f interface{}) ([]string, error) {
+	list, ok := f.([]interface{})
+	if !ok {
+		return nil, errors.New("Options must be a list")
+	}
+	opts := make([]string, 0, len(list))
+	for _, opt := range list {
+		optStr, ok := opt.(string)
+		if !ok {
+			return nil, errors.New("Option must be an atom")
+		}
+		opts = append(opts, strings.ToUpper(optStr))
+	}
+	return opts, nil
+}
+
+func (h *listExtHandler) parseReturn(opts []interface{}) error {
+	for i := 0; i < len(opts); i++ {
+		opt, ok := opts[i].(string)
+		if !ok {
+			return errors.New("RETURN option must be an atom")
+		}
+		switch strings.ToUpper(opt) {
+		case "SUBSCRIBED":
+			h.retSubscribed = true
+		case "CHILDREN":
+			h.retChildren = true
+		case "STATUS":
+			if i+1 >= len(opts) {
+				return errors.New("Missing STATUS items")
+			}
+			i++
+			items, err := optStrings(opts[i])
+			if err != nil {
+				return err
+			}
+			for _, item := range items {
+				h.retStatus = append(h.retStatus, imap.StatusItem(item))
+			}
+		default:
+			return errors.New("Unsupported RETURN option: " + opt)
+		}
+	}
+	return nil
+}
+
+func (h *listExtHandler) Parse(fields []interface{}) error {
+	if len(fields) > 0 {
+		if selOpts, ok := fields[0].([]interface{}); ok {
+			h.extended = true
+			opts, err := optStrings(selOpts)
+			if err != nil {
+				return err
+			}
+			for _, opt := range opts {
+				switch opt {
+				case "SUBSCRIBED":
+					h.selSubscribed = true
+				case "RECURSIVEMATCH":
+					h.selRecursiveMatch = true
+				case "REMOTE":
+					// There are no remote mailboxes.
+				default:
+					return errors.New("Unsupported selection option: " + opt)
+				}
+			}
+			// RFC 5258, Section 3.1.
+			if h.selRecursiveMatch && !h.selSubscribed {
+				return errors.New("RECURSIVEMATCH requires another selection option")
+			}
+			fields = fields[1:]
+		}
+	}
+
+	if len(fields) < 2 {
+		return errors.New("No enough arguments")
+	}
+
+	var err error
+	h.ref, err = parseMboxName(fields[0])
+	if err != nil {
+		return err
+	}
+
+	if patterns, ok := fields[1].([]interface{}); ok {
+		h.extended = true
+		for _, p := range patterns {
+			pattern, err := parseMboxName(p)
+			if err != nil {
+				return err
+			}
+			h.patterns = append(h.patterns, pattern)
+		}
+	} else {
+		pattern, err := parseMboxName(fields[1])
+		if err != nil {
+			return err
+		}
+		h.patterns = []string{pattern}
+	}
+	fields = fields[2:]
+
+	if len(fields) != 0 {
+		if ret, ok := fields[0].(string); !ok || !strings.EqualFold(ret, "RETURN") || len(fields) != 2 {
+			return errors.New("Unexpected arguments")
+		}
+		retOpts, ok := fields[1].([]interface{})
+		if !ok {
+			return errors.New("RETURN options must be a list")
+		}
+		h.extended = true
+		if err := h.parseReturn(retOpts); err != nil {
+			return err
+		}
+	}
+
+	// RFC 5258, Section 3: SUBSCRIBED selection option implies SUBSCRIBED
+	// return option.
+	if h.selSubscribed {
+		h.retSubscribed = true
+	}
+
+	return nil
+}
+
+type listExtEntry struct {
+	info      *imap.MailboxInfo
+	childInfo bool
+	status    *imap.MailboxStatus
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *listExtHandler) matches(info *imap.MailboxInfo) bool {
+	for _, pattern := range h.patterns {
+		if info.Match(h.ref, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *listExtHandler) Handle(conn imapserver.Conn) error {
+	if !h.extended {
+		basic := &imapserver.List{List: commands.List{
+			Reference: h.ref,
+			Mailbox:   h.patterns[0],
+		}}
+		return basic.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	mboxes, err := ctx.User.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	subscribed := map[string]bool{}
+	if h.retSubscribed || h.selSubscribed {
+		subMboxes, err := ctx.User.ListMailboxes(true)
+		if err != nil {
+			return err
+		}
+		for _, mbox := range subMboxes {
+			subscribed[mbox.Name()] = true
+		}
+	}
+
+	infos := make([]*imap.MailboxInfo, 0, len(mboxes))
+	for _, mbox := range mboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+
+	var entries []listExtEntry
+	for i, info := range infos {
+		if !h.matches(info) {
+			continue
+		}
+
+		entry := listExtEntry{info: info}
+		if h.selSubscribed && !subscribed[info.Name] {
+			if !h.selRecursiveMatch {
+				continue
+			}
+			// RFC 5258, Section 3.5: return parents of subscribed mailboxes
+			// with CHILDINFO extended data.
+			for _, other := range infos {
+				if info.Delimiter != "" && subscribed[other.Name] &&
+					strings.HasPrefix(other.Name, info.Name+info.Delimiter) {
+					entry.childInfo = true
+					break
+				}
+			}
+			if !entry.childInfo {
+				continue
+			}
+		}
+
+		attrs := append([]string(nil), info.Attributes...)
+		if h.retSubscribed && subscribed[info.Name] && !hasAttr(attrs, subscribedAttr) {
+			attrs = append(attrs, subscribedAttr)
+		}
+		if h.retChildren && !hasAttr(attrs, hasChildrenAttr) && !hasAttr(attrs, hasNoChildAttr) {
+			hasChildren := false
+			for j, other := range infos {
+				if j != i && info.Delimiter != "" && strings.HasPrefix(other.Name, info.Name+info.Delimiter) {
+					hasChildren = true
+					break
+				}
+			}
+			if hasChildren {
+				attrs = append(attrs, hasChildrenAttr)
+			} else {
+				attrs = append(attrs, hasNoChildAttr)
+			}
+		}
+		entryInfo := *info
+		entryInfo.Attributes = attrs
+		entry.info = &entryInfo
+
+		if len(h.retStatus) != 0 && !hasAttr(attrs, imap.NoSelectAttr) {
+			// RFC 5819, Section 2: STATUS failures for individual mailboxes
+			// are not reported.
+			if status, err := mboxes[i].Status(h.retStatus); err == nil {
+				items := make(map[imap.StatusItem]interface{}, len(h.retStatus))
+				for _, k := range h.retStatus {
+					items[k] = status.Items[k]
+				}
+				status.Items = items
+				status.Name = info.Name
+				entry.status = status
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return conn.WriteResp(listExtResponse(entries))
+}
+
+type listExtResponse []listExtEntry
+
+func (r listExtResponse) WriteTo(w *imap.Writer) error {
+	for _, entry := range r {
+		fields := []interface{}{imap.RawString("LIST")}
+		fields = append(fields, entry.info.Format()...)
+		if entry.childInfo {
+			fields = append(fields, []interface{}{
+				"CHILDINFO", []interface{}{"SUBSCRIBED"},
+			})
+		}
+		if err := imap.NewUntaggedResp(fields).WriteTo(w); err != nil {
+			return err
+		}
+
+		if entry.status != nil {
+			if err := (&responses.Status{Mailbox: entry.status}).WriteTo(w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestListExtParse(t *testing.T) {
+	h := listExtHandler{}
+	if err := h.Parse([]interface{}{"", "*"}); err != nil {
+		t.Fatal(err)
+	}
+	if h.extended {
+		t.Fatal("basic LIST is considered extended")
+	}
+
+	h = listExtHandler{}
+	err := h.Parse([]interface{}{
+		[]interface{}{"subscribed", "RECURSIVEMATCH"},
+		"", []interface{}{"INBOX", "Work/*"},
+		"RETURN", []interface{}{"CHILDREN", "STATUS", []interface{}{"MESSAGES", "unseen"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.extended || !h.selSubscribed || !h.selRecursiveMatch || !h.retSubscribed || !h.retChildren {
+		t.Fatalf("wrong options: %+v", h)
+	}
+	if !reflect.DeepEqual(h.patterns, []string{"INBOX", "Work/*"}) {
+		t.Fatalf("wrong patterns: %v", h.patterns)
+	}
+	if !reflect.DeepEqual(h.retStatus, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen}) {
+		t.Fatalf("wrong status items: %v", h.retStatus)
+	}
+
+	for _, fields := range [][]interface{}{
+		{[]interface{}{"RECURSIVEMATCH"}, "", "*"},
+		{[]interface{}{"UNKNOWN"}, "", "*"},
+		{"", "*", "RETURN", []interface{}{"STATUS"}},
+		{"", "*", "RETURN"},
+	} {
+		h = listExtHandler{}
+		if err := h.Parse(fields); err == nil {
+			t.Errorf("%v: no error", fields)
+		}
+	}
+}
+
+func TestListExtResponse(t *testing.T) {
+	status := imap.NewMailboxStatus("Work", []imap.StatusItem{imap.StatusMessages})
+	status.Messages = 5
+
+	resp := listExtResponse{
+		{
+			info:      &imap.MailboxInfo{Attributes: []string{`\HasChildren`}, Delimiter: "/", Name: "Work"},
+			childInfo: true,
+			status:    status,
+		},
+	}
+	var buf bytes.Buffer
+	if err := resp.WriteTo(imap.NewWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	expected := "* LIST (\\HasChildren) \"/\" \"Work\" (\"CHILDINFO\" (\"SUBSCRIBED\"))\r\n" +
+		"* STATUS \"Work\" (MESSAGES 5)\r\n"
+	if buf.String() != expected {
+		t.Fatalf("wrong response:\n%q\nwant:\n%q", buf.String(), expected)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// previewExtension implements the PREVIEW extension (RFC 8970).
+//
+// The PREVIEW fetch item is handled by the storage backend, the extension
+// advertises the capability and replaces the FETCH command parser so
+// modifiers of the item are accepted.
+type previewExtension struct{}
+
+func (previewExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+	return []string{"PREVIEW"}
+}
+
+func (previewExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "FETCH" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &previewFetch{}
+	}
+}
+
+type previewFetch struct {
+	imapserver.Fetch
+}
+
+func (h *previewFetch) Parse(fields []interface{}) error {
+	if len(fields) < 2 {
+		return h.Fetch.Parse(fields)
+	}
+	items, ok := fields[1].([]interface{})
+	if !ok {
+		return h.Fetch.Parse(fields)
+	}
+
+	// Previews are always generated on request, so the only defined
+	// modifier (LAZY) does not change anything.
+	cleaned := make([]interface{}, 0, len(items))
+	for i := 0; i < len(items); i++ {
+		cleaned = append(cleaned, items[i])
+		item, _ := items[i].(string)
+		if !strings.EqualFold(item, "PREVIEW") || i+1 >= len(items) {
+			continue
+		}
+		mods, ok := items[i+1].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, mod := range mods {
+			if modStr, _ := mod.(string); !strings.EqualFold(modStr, "LAZY") {
+				return errors.New("Unknown PREVIEW modifier")
+			}
+		}
+		i++
+	}
+
+	return h.Fetch.Parse(append([]interface{}{fields[0], cleaned}, fields[2:]...))
+}
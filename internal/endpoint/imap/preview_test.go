@@ -0,0 +1,56 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestPreviewFetch_Parse(t *testing.T) {
+	for _, c := range []struct {
+		items interface{}
+		want  []imap.FetchItem
+		fail  bool
+	}{
+		{"PREVIEW", []imap.FetchItem{"PREVIEW"}, false},
+		{[]interface{}{"UID", "PREVIEW"}, []imap.FetchItem{"UID", "PREVIEW"}, false},
+		{[]interface{}{"PREVIEW", []interface{}{"LAZY"}, "FLAGS"}, []imap.FetchItem{"PREVIEW", "FLAGS"}, false},
+		{[]interface{}{"preview", []interface{}{"lazy"}}, []imap.FetchItem{"PREVIEW"}, false},
+		{[]interface{}{"PREVIEW", []interface{}{"EAGER"}}, nil, true},
+	} {
+		h := &previewFetch{}
+		err := h.Parse([]interface{}{"1:*", c.items})
+		if c.fail {
+			if err == nil {
+				t.Errorf("%v: expected failure", c.items)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected failure: %v", c.items, err)
+			continue
+		}
+		if !reflect.DeepEqual(h.Items, c.want) {
+			t.Errorf("%v: wrong items: %v, want %v", c.items, h.Items, c.want)
+		}
+	}
+}
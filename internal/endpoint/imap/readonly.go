@@ -0,0 +1,176 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+var errReadOnly = imapserver.ErrStatusResp(&imap.StatusResp{
+	Type: imap.StatusRespNo,
+	Code: "UNAVAILABLE",
+	Info: "Server is in maintenance mode, changes are not allowed",
+})
+
+// Commands that are rejected in the read-only mode.
+var readOnlyRejected = map[string]bool{
+	"APPEND":      true,
+	"CREATE":      true,
+	"DELETE":      true,
+	"RENAME":      true,
+	"SUBSCRIBE":   true,
+	"UNSUBSCRIBE": true,
+	"STORE":       true,
+	"COPY":        true,
+	"MOVE":        true,
+	"EXPUNGE":     true,
+}
+
+// readOnlyExtension rejects commands that change the storage contents while
+// the server is in the read-only mode (see control.ReadOnly). FETCH is
+// changed to never set the \Seen flag and CLOSE does not expunge messages.
+//
+// It should be enabled before all other extensions so its handlers take
+// precedence. Extensions enabled after it should be added to next, they
+// are used to look up the FETCH handler.
+type readOnlyExtension struct {
+	next []imapserver.Extension
+}
+
+func (*readOnlyExtension) Capabilities(imapserver.Conn) []string {
+	return nil
+}
+
+func (ext *readOnlyExtension) Command(name string) imapserver.HandlerFactory {
+	if !control.ReadOnly() {
+		return nil
+	}
+
+	switch {
+	case readOnlyRejected[name]:
+		return func() imapserver.Handler {
+			return readOnlyReject{}
+		}
+	case name == "FETCH":
+		next := ext.nextFetch()
+		return func() imapserver.Handler {
+			return &readOnlyFetch{Handler: next()}
+		}
+	case name == "CLOSE":
+		return func() imapserver.Handler {
+			return &readOnlyClose{}
+		}
+	}
+	return nil
+}
+
+func (ext *readOnlyExtension) nextFetch() imapserver.HandlerFactory {
+	for _, e := range ext.next {
+		if f := e.Command("FETCH"); f != nil {
+			return f
+		}
+	}
+	return func() imapserver.Handler {
+		return &imapserver.Fetch{}
+	}
+}
+
+type readOnlyReject struct{}
+
+func (readOnlyReject) Parse([]interface{}) error {
+	return nil
+}
+
+func (readOnlyReject) Handle(imapserver.Conn) error {
+	return errReadOnly
+}
+
+func (readOnlyReject) UidHandle(imapserver.Conn) error {
+	return errReadOnly
+}
+
+// readOnlyFetch replaces BODY[...] items with BODY.PEEK[...] before passing
+// the command to the actual handler. RFC822 and RFC822.TEXT items that also
+// set the \Seen flag are replaced with BODY.PEEK[] and BODY.PEEK[TEXT].
+type readOnlyFetch struct {
+	imapserver.Handler
+}
+
+func peekItem(item interface{}) interface{} {
+	s, ok := item.(string)
+	if !ok {
+		return item
+	}
+	switch upper := strings.ToUpper(s); {
+	case upper == "RFC822":
+		return "BODY.PEEK[]"
+	case upper == "RFC822.TEXT":
+		return "BODY.PEEK[TEXT]"
+	case strings.HasPrefix(upper, "BODY["):
+		return "BODY.PEEK[" + s[len("BODY["):]
+	}
+	return item
+}
+
+func (cmd *readOnlyFetch) Parse(fields []interface{}) error {
+	if len(fields) >= 2 {
+		fields = append([]interface{}(nil), fields...)
+		switch items := fields[1].(type) {
+		case string:
+			fields[1] = peekItem(items)
+		case []interface{}:
+			peeked := make([]interface{}, len(items))
+			for i, item := range items {
+				peeked[i] = peekItem(item)
+			}
+			fields[1] = peeked
+		}
+	}
+	return cmd.Handler.Parse(fields)
+}
+
+func (cmd *readOnlyFetch) UidHandle(conn imapserver.Conn) error {
+	uidHdlr, ok := cmd.Handler.(imapserver.UidHandler)
+	if !ok {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespBad,
+			Info: "Command unsupported with UID",
+		})
+	}
+	return uidHdlr.UidHandle(conn)
+}
+
+// readOnlyClose unselects the mailbox without expunging messages.
+type readOnlyClose struct {
+	imapserver.Close
+}
+
+func (cmd *readOnlyClose) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	ctx.Mailbox = nil
+	ctx.MailboxReadOnly = false
+	return nil
+}
@@ -0,0 +1,246 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+func TestReadOnly(t *testing.T) {
+	serv := imapserver.New(memory.New())
+	serv.AllowInsecureAuth = true
+	serv.Enable(&readOnlyExtension{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	readLine(t, r) // greeting
+
+	// cmd sends the command and returns the tagged response.
+	cmd := func(tag, cmd string) string {
+		t.Helper()
+		if _, err := conn.Write([]byte(tag + " " + cmd + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			line := readLine(t, r)
+			if strings.HasPrefix(line, tag+" ") {
+				return line
+			}
+		}
+	}
+
+	if resp := cmd("a", "LOGIN username password"); !strings.HasPrefix(resp, "a OK") {
+		t.Fatal("Unexpected response:", resp)
+	}
+	if resp := cmd("b", "SELECT INBOX"); !strings.HasPrefix(resp, "b OK") {
+		t.Fatal("Unexpected response:", resp)
+	}
+
+	control.SetReadOnly(true)
+	defer control.SetReadOnly(false)
+
+	for i, c := range []string{
+		"CREATE Test",
+		"STORE 1 +FLAGS (\\Deleted)",
+		"UID STORE 1:* +FLAGS (\\Deleted)",
+		"COPY 1 INBOX",
+		"EXPUNGE",
+	} {
+		tag := "r" + string(rune('a'+i))
+		if resp := cmd(tag, c); !strings.HasPrefix(resp, tag+" NO [UNAVAILABLE]") {
+			t.Errorf("%s: unexpected response: %s", c, resp)
+		}
+	}
+	if resp := cmd("c", "CLOSE"); !strings.HasPrefix(resp, "c OK") {
+		t.Fatal("Unexpected response:", resp)
+	}
+	if resp := cmd("d", "STATUS INBOX (MESSAGES)"); !strings.HasPrefix(resp, "d OK") {
+		t.Fatal("Unexpected response:", resp)
+	}
+
+	control.SetReadOnly(false)
+	if resp := cmd("e", "CREATE Test"); !strings.HasPrefix(resp, "e OK") {
+		t.Fatal("Unexpected response:", resp)
+	}
+}
+
+func TestReadOnlyFetch(t *testing.T) {
+	cmd := readOnlyFetch{Handler: &imapserver.Fetch{}}
+	if err := cmd.Parse([]interface{}{"1:*", []interface{}{"FLAGS", "BODY[]", "body[HEADER]", "BODY.PEEK[TEXT]", "RFC822", "rfc822.text", "RFC822.HEADER"}}); err != nil {
+		t.Fatal(err)
+	}
+	items := cmd.Handler.(*imapserver.Fetch).Items
+	expected := []imap.FetchItem{"FLAGS", "BODY.PEEK[]", "BODY.PEEK[HEADER]", "BODY.PEEK[TEXT]", "BODY.PEEK[]", "BODY.PEEK[TEXT]", "RFC822.HEADER"}
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatalf("wrong items: %v", items)
+	}
+
+	cmd = readOnlyFetch{Handler: &imapserver.Fetch{}}
+	if err := cmd.Parse([]interface{}{"1", "BODY[1]"}); err != nil {
+		t.Fatal(err)
+	}
+	items = cmd.Handler.(*imapserver.Fetch).Items
+	if !reflect.DeepEqual(items, []imap.FetchItem{"BODY.PEEK[1]"}) {
+		t.Fatalf("wrong items: %v", items)
+	}
+}
+
+// seenBackend sets the \Seen flag on FETCH of non-peek body sections
+// like go-imap-sql does.
+type seenBackend struct {
+	backend.Backend
+}
+
+func (b seenBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := b.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return seenUser{u}, nil
+}
+
+type seenUser struct {
+	backend.User
+}
+
+func (u seenUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return seenMailbox{mbox}, nil
+}
+
+type seenMailbox struct {
+	backend.Mailbox
+}
+
+func (mbox seenMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	for _, item := range items {
+		sect, err := imap.ParseBodySectionName(item)
+		if err != nil || sect.Peek {
+			continue
+		}
+		if err := mbox.UpdateMessagesFlags(uid, seqSet, imap.AddFlags, []string{imap.SeenFlag}); err != nil {
+			return err
+		}
+		break
+	}
+	return mbox.Mailbox.ListMessages(uid, seqSet, items, ch)
+}
+
+func TestReadOnlyFetch_Seen(t *testing.T) {
+	be := memory.New()
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.(*memory.Mailbox).CreateMessage(nil, time.Now(), bytes.NewReader([]byte("Subject: Test\r\n\r\nHello\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+
+	serv := imapserver.New(seenBackend{be})
+	serv.AllowInsecureAuth = true
+	serv.Enable(&readOnlyExtension{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	readLine(t, r) // greeting
+
+	// cmd sends the command and returns all response lines.
+	cmd := func(tag, cmd string) string {
+		t.Helper()
+		if _, err := conn.Write([]byte(tag + " " + cmd + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		var resp strings.Builder
+		for {
+			line := readLine(t, r)
+			resp.WriteString(line)
+			if strings.HasPrefix(line, tag+" ") {
+				if !strings.HasPrefix(line, tag+" OK") {
+					t.Fatal("Unexpected response:", line)
+				}
+				return resp.String()
+			}
+		}
+	}
+
+	cmd("a", "LOGIN username password")
+	cmd("b", "SELECT INBOX")
+
+	control.SetReadOnly(true)
+	defer control.SetReadOnly(false)
+
+	cmd("c", "FETCH 2 RFC822")
+	cmd("d", "FETCH 2 RFC822.TEXT")
+	if resp := cmd("e", "FETCH 2 (FLAGS)"); strings.Contains(resp, imap.SeenFlag) {
+		t.Fatal("\\Seen flag set in read-only mode:", resp)
+	}
+
+	control.SetReadOnly(false)
+	cmd("f", "FETCH 2 RFC822")
+	if resp := cmd("g", "FETCH 2 (FLAGS)"); !strings.Contains(resp, imap.SeenFlag) {
+		t.Fatal("\\Seen flag is not set:", resp)
+	}
+}
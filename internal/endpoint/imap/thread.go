@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// threadExtension implements the THREAD command (RFC 5256).
+//
+// It is used instead of the go-imap-sortthread implementation since the
+// latter can't represent threads without the parent message present in the
+// mailbox, which are produced by the REFERENCES algorithm. Such threads are
+// represented by sortthread.Thread with zero Id.
+type threadExtension struct{}
+
+func (threadExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+
+	be, ok := c.Server().Backend.(sortthread.ThreadBackend)
+	if !ok {
+		return nil
+	}
+
+	algos := be.SupportedThreadAlgorithms()
+	caps := make([]string, 0, len(algos))
+	for _, algo := range algos {
+		caps = append(caps, "THREAD="+string(algo))
+	}
+	return caps
+}
+
+func (threadExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "THREAD" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &threadHandler{}
+	}
+}
+
+type threadHandler struct {
+	sortthread.ThreadCommand
+}
+
+func (h *threadHandler) handle(uid bool, conn imapserver.Conn) error {
+	if conn.Context().Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	mbox, ok := conn.Context().Mailbox.(sortthread.ThreadMailbox)
+	if !ok {
+		return sortthread.ErrUnsupportedBackend
+	}
+
+	threads, err := mbox.Thread(uid, h.Algorithm, h.SearchCriteria)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteResp(threadResponse(threads))
+}
+
+func (h *threadHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *threadHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type threadResponse []*sortthread.Thread
+
+func formatThread(t *sortthread.Thread) []interface{} {
+	f := make([]interface{}, 0, 1+len(t.Children))
+	if t.Id == 0 {
+		// Parent is not present, list children as separate threads.
+		for _, c := range t.Children {
+			f = append(f, formatThread(c))
+		}
+		return f
+	}
+
+	f = append(f, imap.RawString(strconv.FormatUint(uint64(t.Id), 10)))
+	if len(t.Children) == 1 {
+		f = append(f, formatThread(t.Children[0])...)
+	} else {
+		for _, c := range t.Children {
+			f = append(f, formatThread(c))
+		}
+	}
+	return f
+}
+
+func (r threadResponse) WriteTo(w *imap.Writer) error {
+	fields := make([]interface{}, 0, len(r)+1)
+	fields = append(fields, imap.RawString("THREAD"))
+	for _, t := range r {
+		fields = append(fields, formatThread(t))
+	}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
@@ -0,0 +1,178 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// minIdleCmdTimeout is the minimal timeout applied to connections in the IDLE
+// state. RFC 2177 requires clients to re-issue IDLE at least every 29 minutes.
+const minIdleCmdTimeout = imapserver.MinAutoLogout
+
+// idleListener wraps accepted connections to enforce idle_timeout.
+type idleListener struct {
+	net.Listener
+	endp *Endpoint
+}
+
+func (l idleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	ic := &idleConn{
+		Conn:       conn,
+		remoteAddr: conn.RemoteAddr(),
+		endp:       l.endp,
+		lastActive: time.Now(),
+	}
+	if _, ok := ic.remoteAddr.(*net.TCPAddr); !ok {
+		// Addresses of Unix sockets connections are not unique, make sure we
+		// can still find the right connection by its address.
+		ic.remoteAddr = &net.UnixAddr{Name: conn.RemoteAddr().String(), Net: "unix"}
+	}
+	// expired may run before the timer is assigned otherwise.
+	ic.lock.Lock()
+	ic.timer = time.AfterFunc(l.endp.idleTimeout, ic.expired)
+	ic.lock.Unlock()
+
+	l.endp.conns.Store(ic.remoteAddr, ic)
+	return ic, nil
+}
+
+type idleConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	endp       *Endpoint
+	timer      *time.Timer
+
+	lock       sync.Mutex
+	lastActive time.Time
+	inIdle     bool
+}
+
+func (ic *idleConn) RemoteAddr() net.Addr {
+	return ic.remoteAddr
+}
+
+func (ic *idleConn) Read(b []byte) (int, error) {
+	n, err := ic.Conn.Read(b)
+	if n != 0 {
+		ic.lock.Lock()
+		ic.lastActive = time.Now()
+		ic.lock.Unlock()
+	}
+	return n, err
+}
+
+func (ic *idleConn) setIdle(inIdle bool) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	ic.inIdle = inIdle
+}
+
+// timeout returns the timeout applicable to the current connection state.
+func (ic *idleConn) timeout() time.Duration {
+	if ic.inIdle && ic.endp.idleTimeout < minIdleCmdTimeout {
+		return minIdleCmdTimeout
+	}
+	return ic.endp.idleTimeout
+}
+
+func (ic *idleConn) expired() {
+	ic.lock.Lock()
+	left := time.Until(ic.lastActive.Add(ic.timeout()))
+	ic.lock.Unlock()
+	if left > 0 {
+		ic.timer.Reset(left)
+		return
+	}
+
+	var conn imapserver.Conn
+	ic.endp.serv.ForEachConn(func(c imapserver.Conn) {
+		if c.Info().RemoteAddr == ic.remoteAddr {
+			conn = c
+		}
+	})
+	if conn == nil {
+		ic.Close()
+		return
+	}
+
+	ic.endp.Log.DebugMsg("idle timeout, closing connection", "src_ip", ic.remoteAddr)
+
+	// Don't let the client block the logout by not reading the response.
+	if err := ic.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		ic.endp.Log.Error("failed to set write deadline", err, "src_ip", ic.remoteAddr)
+	}
+	if err := conn.WriteResp(&imap.StatusResp{
+		Type: imap.StatusRespBye,
+		Info: "Autologout; idle for too long",
+	}); err != nil {
+		ic.endp.Log.Error("failed to send BYE", err, "src_ip", ic.remoteAddr)
+	}
+	conn.Close()
+}
+
+func (ic *idleConn) Close() error {
+	ic.timer.Stop()
+	ic.endp.conns.Delete(ic.remoteAddr)
+	return ic.Conn.Close()
+}
+
+// idleExtension wraps the IDLE extension handler to apply the longer timeout
+// to connections in the IDLE state.
+type idleExtension struct {
+	imapserver.Extension
+	endp *Endpoint
+}
+
+func (ext idleExtension) Command(name string) imapserver.HandlerFactory {
+	newHandler := ext.Extension.Command(name)
+	if newHandler == nil {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &idleCmd{Handler: newHandler(), endp: ext.endp}
+	}
+}
+
+type idleCmd struct {
+	imapserver.Handler
+	endp *Endpoint
+}
+
+func (h *idleCmd) Handle(conn imapserver.Conn) error {
+	c, ok := h.endp.conns.Load(conn.Info().RemoteAddr)
+	if !ok {
+		return h.Handler.Handle(conn)
+	}
+	ic := c.(*idleConn)
+
+	ic.setIdle(true)
+	defer ic.setIdle(false)
+	return h.Handler.Handle(conn)
+}
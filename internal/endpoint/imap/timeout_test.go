@@ -0,0 +1,137 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	idle "github.com/emersion/go-imap-idle"
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testIdleEndpoint(t *testing.T, timeout time.Duration) (*Endpoint, string) {
+	t.Helper()
+
+	endp := &Endpoint{
+		idleTimeout: timeout,
+		Log:         testutils.Logger(t, "imap"),
+	}
+	endp.serv = imapserver.New(memory.New())
+	endp.serv.AllowInsecureAuth = true
+	endp.serv.Enable(idleExtension{Extension: idle.NewExtension(), endp: endp})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go endp.serv.Serve(idleListener{Listener: l, endp: endp})
+	t.Cleanup(func() { endp.serv.Close() })
+
+	return endp, l.Addr().String()
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestIdleTimeout(t *testing.T) {
+	_, addr := testIdleEndpoint(t, 50*time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	readLine(t, r) // greeting
+
+	if line := readLine(t, r); !strings.HasPrefix(line, "* BYE") {
+		t.Fatal("Expected BYE, got", line)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("Connection is not closed")
+	}
+}
+
+func TestIdleTimeout_Activity(t *testing.T) {
+	_, addr := testIdleEndpoint(t, 200*time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readLine(t, r) // greeting
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn.Write([]byte("a NOOP\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if line := readLine(t, r); !strings.HasPrefix(line, "a OK") {
+			t.Fatal("Unexpected response:", line)
+		}
+	}
+}
+
+func TestIdleTimeout_IDLE(t *testing.T) {
+	_, addr := testIdleEndpoint(t, 50*time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readLine(t, r) // greeting
+
+	if _, err := conn.Write([]byte("a LOGIN username password\r\nb IDLE\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line := readLine(t, r); !strings.HasPrefix(line, "a OK") {
+		t.Fatal("Unexpected response:", line)
+	}
+	if line := readLine(t, r); !strings.HasPrefix(line, "+") {
+		t.Fatal("Unexpected response:", line)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := conn.Write([]byte("DONE\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line := readLine(t, r); !strings.HasPrefix(line, "b OK") {
+		t.Fatal("Unexpected response:", line)
+	}
+}
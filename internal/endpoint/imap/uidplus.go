@@ -0,0 +1,275 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	move "github.com/emersion/go-imap-move"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// uidplusMailbox is implemented by storage mailboxes that can report UIDs
+// assigned to created messages.
+//
+// Zero UIDVALIDITY is returned if the UIDs are not known, in this case
+// response codes are omitted.
+type uidplusMailbox interface {
+	CreateMessageUID(flags []string, date time.Time, body imap.Literal) (validity, uid uint32, err error)
+	CopyMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (validity uint32, srcUIDs, destUIDs []uint32, err error)
+	MoveMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (validity uint32, srcUIDs, destUIDs []uint32, err error)
+	ExpungeUIDs(seqset *imap.SeqSet) error
+}
+
+// uidplusExtension implements the UIDPLUS extension (RFC 4315).
+//
+// It replaces APPEND, COPY, EXPUNGE handlers from go-imap and the MOVE
+// handler from go-imap-move, so it should be enabled before the latter.
+type uidplusExtension struct{}
+
+func (uidplusExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+	return []string{"UIDPLUS"}
+}
+
+func (uidplusExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "APPEND":
+		return func() imapserver.Handler { return &uidplusAppend{} }
+	case "COPY":
+		return func() imapserver.Handler { return &uidplusCopy{} }
+	case move.Capability:
+		return func() imapserver.Handler { return &uidplusCopy{move: true} }
+	case "EXPUNGE":
+		return func() imapserver.Handler { return &uidplusExpunge{} }
+	}
+	return nil
+}
+
+// formatUIDs formats the list of UIDs as a sequence set preserving the
+// order of elements.
+func formatUIDs(uids []uint32) string {
+	var sb strings.Builder
+	for i := 0; i < len(uids); {
+		j := i
+		for j+1 < len(uids) && uids[j+1] == uids[j]+1 {
+			j++
+		}
+
+		if sb.Len() != 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatUint(uint64(uids[i]), 10))
+		if j != i {
+			sb.WriteByte(':')
+			sb.WriteString(strconv.FormatUint(uint64(uids[j]), 10))
+		}
+		i = j + 1
+	}
+	return sb.String()
+}
+
+type uidplusAppend struct {
+	commands.Append
+}
+
+func (h *uidplusAppend) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	mbox, err := ctx.User.GetMailbox(h.Mailbox)
+	if err == backend.ErrNoSuchMailbox {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: err.Error(),
+		})
+	} else if err != nil {
+		return err
+	}
+
+	uidMbox, ok := mbox.(uidplusMailbox)
+	if !ok {
+		return mbox.CreateMessage(h.Flags, h.Date, h.Message)
+	}
+
+	validity, uid, err := uidMbox.CreateMessageUID(h.Flags, h.Date, h.Message)
+	if err != nil {
+		return err
+	}
+	if validity == 0 {
+		return nil
+	}
+
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Code: "APPENDUID",
+		Arguments: []interface{}{
+			validity, uid,
+		},
+		Info: "APPEND completed",
+	})
+}
+
+type uidplusCopy struct {
+	commands.Copy
+	move bool
+}
+
+func (h *uidplusCopy) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	uidMbox, ok := ctx.Mailbox.(uidplusMailbox)
+	if !ok {
+		if !h.move {
+			return ctx.Mailbox.CopyMessages(uid, h.SeqSet, h.Mailbox)
+		}
+		moveMbox, ok := ctx.Mailbox.(move.Mailbox)
+		if !ok {
+			return imapserver.ErrStatusResp(&imap.StatusResp{
+				Type: imap.StatusRespNo,
+				Info: "MOVE is not supported",
+			})
+		}
+		return moveMbox.MoveMessages(uid, h.SeqSet, h.Mailbox)
+	}
+
+	var (
+		validity          uint32
+		srcUIDs, destUIDs []uint32
+		err               error
+		cmdName           = "COPY"
+	)
+	if h.move {
+		cmdName = "MOVE"
+		validity, srcUIDs, destUIDs, err = uidMbox.MoveMessagesUID(uid, h.SeqSet, h.Mailbox)
+	} else {
+		validity, srcUIDs, destUIDs, err = uidMbox.CopyMessagesUID(uid, h.SeqSet, h.Mailbox)
+	}
+	if err == backend.ErrNoSuchMailbox {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: err.Error(),
+		})
+	} else if err != nil {
+		return err
+	}
+	if validity == 0 {
+		return nil
+	}
+
+	if uid {
+		cmdName = "UID " + cmdName
+	}
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Code: "COPYUID",
+		Arguments: []interface{}{
+			validity,
+			imap.RawString(formatUIDs(srcUIDs)),
+			imap.RawString(formatUIDs(destUIDs)),
+		},
+		Info: cmdName + " completed",
+	})
+}
+
+func (h *uidplusCopy) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *uidplusCopy) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type uidplusExpunge struct {
+	// nil for EXPUNGE without UID.
+	SeqSet *imap.SeqSet
+}
+
+func (h *uidplusExpunge) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields) != 1 {
+		return errors.New("Too many arguments")
+	}
+
+	seqStr, ok := fields[0].(string)
+	if !ok {
+		return errors.New("Sequence set must be an atom")
+	}
+	var err error
+	h.SeqSet, err = imap.ParseSeqSet(seqStr)
+	return err
+}
+
+func (h *uidplusExpunge) Handle(conn imapserver.Conn) error {
+	if h.SeqSet != nil {
+		return errors.New("EXPUNGE does not accept arguments")
+	}
+
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+
+	// Storage is required to implement BackendUpdater, so EXPUNGE responses
+	// are sent by the server itself.
+	return ctx.Mailbox.Expunge()
+}
+
+func (h *uidplusExpunge) UidHandle(conn imapserver.Conn) error {
+	if h.SeqSet == nil {
+		return errors.New("Missing sequence set")
+	}
+
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+
+	uidMbox, ok := ctx.Mailbox.(uidplusMailbox)
+	if !ok {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Info: "UID EXPUNGE is not supported",
+		})
+	}
+	return uidMbox.ExpungeUIDs(h.SeqSet)
+}
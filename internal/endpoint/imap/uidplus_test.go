@@ -0,0 +1,36 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import "testing"
+
+func TestFormatUIDs(t *testing.T) {
+	for _, c := range []struct {
+		uids []uint32
+		out  string
+	}{
+		{[]uint32{1}, "1"},
+		{[]uint32{1, 2, 3}, "1:3"},
+		{[]uint32{5, 6, 1, 3, 4}, "5:6,1,3:4"},
+	} {
+		if out := formatUIDs(c.uids); out != c.out {
+			t.Errorf("formatUIDs(%v) = %q, want %q", c.uids, out, c.out)
+		}
+	}
+}
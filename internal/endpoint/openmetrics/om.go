@@ -20,13 +20,13 @@ package openmetrics
 
 import (
 	"fmt"
-	"net"
 	"net/http"
 	"sync"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/listen"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -67,19 +67,25 @@ func (e *Endpoint) Init(cfg *config.Map) error {
 		if endp.IsTLS() {
 			return fmt.Errorf("%s: TLS is not supported yet", modName)
 		}
-		l, err := net.Listen(endp.Network(), endp.Address())
+		if module.NoRun {
+			continue
+		}
+		ls, err := listen.Options{}.Endpoint(endp)
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
 
-		e.listenersWg.Add(1)
-		go func() {
-			e.logger.Println("listening on", endp.String())
-			err := e.serv.Serve(l)
-			if err != nil && err != http.ErrServerClosed {
-				e.logger.Error("serve failed", err, "endpoint", a)
-			}
-		}()
+		for _, l := range ls {
+			l := l
+			e.listenersWg.Add(1)
+			go func() {
+				e.logger.Println("listening on", endp.String())
+				err := e.serv.Serve(l)
+				if err != nil && err != http.ErrServerClosed {
+					e.logger.Error("serve failed", err, "endpoint", a)
+				}
+			}()
+		}
 	}
 
 	return nil
@@ -0,0 +1,52 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"context"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/limits/userconns"
+)
+
+// takeUserConn registers the authenticated connection for the per-user
+// connection limit. It is released by Session.Logout.
+func (endp *Endpoint) takeUserConn(state *smtp.ConnectionState, username string) error {
+	max, err := endp.connLimit.ForUser(context.TODO(), username)
+	if err != nil {
+		endp.Log.Error("connection limit lookup failed", err, "username", username)
+	}
+	if !userconns.Take(username, max) {
+		endp.Log.Msg("too many connections", "username", username, "src_ip", state.RemoteAddr, "max", max)
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many connections for this account, try again later",
+		}
+	}
+	return nil
+}
+
+func (s *Session) releaseUserConn() {
+	if !s.userConnHeld {
+		return
+	}
+	userconns.Release(s.connState.AuthUser)
+	s.userConnHeld = false
+}
@@ -0,0 +1,204 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// lineNormalizer fixes line endings and long lines in the message data
+// received from the client.
+//
+// Bare LF characters are replaced with CRLF if fixLF is set. Lines longer
+// than maxLen octets (excluding CRLF) are either wrapped or cause Read to
+// return an error. Long lines in the header are wrapped by folding them at
+// existing whitespace so the header structure is preserved, Read returns an
+// error if there is no suitable whitespace to fold at.
+type lineNormalizer struct {
+	r *bufio.Reader
+
+	fixLF   bool
+	maxLen  int
+	wrapLen bool
+
+	inBody  bool
+	lineLen int
+	prevCR  bool
+
+	// line holds the current header line while it is subject to folding.
+	line []byte
+
+	out []byte
+	err error
+}
+
+func newLineNormalizer(r io.Reader, fixLF bool, maxLen int, wrap bool) *lineNormalizer {
+	return &lineNormalizer{
+		r:       bufio.NewReader(r),
+		fixLF:   fixLF,
+		maxLen:  maxLen,
+		wrapLen: wrap,
+	}
+}
+
+func (ln *lineNormalizer) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(ln.out) == 0 && ln.err == nil {
+		ln.fill(len(p))
+	}
+
+	n := copy(p, ln.out)
+	ln.out = ln.out[n:]
+	if len(ln.out) == 0 {
+		return n, ln.err
+	}
+	return n, nil
+}
+
+// fill processes up to size input octets and appends the result to
+// ln.out.
+func (ln *lineNormalizer) fill(size int) {
+	for i := 0; i < size; i++ {
+		c, err := ln.r.ReadByte()
+		if err != nil {
+			ln.out = append(ln.out, ln.line...)
+			ln.line = ln.line[:0]
+			ln.err = err
+			return
+		}
+
+		switch c {
+		case '\r':
+			if ln.prevCR {
+				// Bare CR is a regular line octet.
+				if err := ln.addOctet(); err != nil {
+					ln.err = err
+					return
+				}
+			}
+			ln.prevCR = true
+		case '\n':
+			if !ln.prevCR && ln.fixLF {
+				ln.write('\r')
+			}
+			ln.write(c)
+			ln.out = append(ln.out, ln.line...)
+			ln.line = ln.line[:0]
+			if ln.lineLen == 0 {
+				ln.inBody = true
+			}
+			ln.lineLen = 0
+			ln.prevCR = false
+			continue
+		default:
+			if ln.prevCR {
+				if err := ln.addOctet(); err != nil {
+					ln.err = err
+					return
+				}
+				ln.prevCR = false
+			}
+			if err := ln.addOctet(); err != nil {
+				ln.err = err
+				return
+			}
+		}
+		ln.write(c)
+
+		if ln.foldHeader() && ln.lineLen > ln.maxLen {
+			if err := ln.fold(); err != nil {
+				ln.err = err
+				return
+			}
+		}
+	}
+}
+
+// foldHeader reports whether long header lines should be folded.
+func (ln *lineNormalizer) foldHeader() bool {
+	return !ln.inBody && ln.wrapLen && ln.maxLen > 0
+}
+
+func (ln *lineNormalizer) write(c byte) {
+	if ln.foldHeader() {
+		ln.line = append(ln.line, c)
+		return
+	}
+	ln.out = append(ln.out, c)
+}
+
+// fold folds the current header line before the last whitespace that is
+// preceded by some other octets.
+func (ln *lineNormalizer) fold() error {
+	start := 0
+	for start < len(ln.line) && isWSP(ln.line[start]) {
+		start++
+	}
+	for i := len(ln.line) - 1; i > start; i-- {
+		if !isWSP(ln.line[i]) {
+			continue
+		}
+
+		ln.out = append(ln.out, ln.line[:i]...)
+		ln.out = append(ln.out, '\r', '\n')
+		ln.line = append(ln.line[:0], ln.line[i:]...)
+		ln.lineLen -= i
+		return nil
+	}
+
+	return &exterrors.SMTPError{
+		Code:         554,
+		EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+		Message:      fmt.Sprintf("Message header contains lines longer than %d octets that can't be folded", ln.maxLen),
+	}
+}
+
+func isWSP(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// addOctet accounts for the line octet that is going to be written,
+// wrapping the body line if necessary.
+func (ln *lineNormalizer) addOctet() error {
+	ln.lineLen++
+	if ln.maxLen <= 0 || ln.lineLen <= ln.maxLen {
+		return nil
+	}
+
+	if !ln.wrapLen {
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      fmt.Sprintf("Message contains lines longer than %d octets", ln.maxLen),
+		}
+	}
+	if !ln.inBody {
+		// Header lines are folded by fill once the octet is buffered.
+		return nil
+	}
+
+	ln.out = append(ln.out, '\r', '\n')
+	ln.lineLen = 1
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+func TestLineNormalizer(t *testing.T) {
+	test := func(in string, fixLF bool, maxLen int, wrap bool, out string, fail bool) {
+		t.Helper()
+
+		res, err := ioutil.ReadAll(newLineNormalizer(strings.NewReader(in), fixLF, maxLen, wrap))
+		if fail {
+			if _, ok := err.(*exterrors.SMTPError); !ok {
+				t.Errorf("expected SMTPError, got %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if string(res) != out {
+			t.Errorf("wrong result:\n%q\nwant:\n%q", res, out)
+		}
+	}
+
+	test("A: 1\nB: 2\r\n\nbody\n", true, 0, false, "A: 1\r\nB: 2\r\n\r\nbody\r\n", false)
+	test("A: 1\nB: 2\r\n\nbody\n", false, 0, false, "A: 1\nB: 2\r\n\nbody\n", false)
+	// Bare CR is not changed but counts towards the line length.
+	test("A: 1\r\n\r\nab\rc\r\n", true, 4, false, "A: 1\r\n\r\nab\rc\r\n", false)
+	test("A: 1\r\n\r\nab\rcd\r\n", true, 4, false, "", true)
+
+	test("A: 1\r\n\r\n1234567890\r\n", false, 10, false, "A: 1\r\n\r\n1234567890\r\n", false)
+	test("A: 1\r\n\r\n12345678901\r\n", false, 10, false, "", true)
+	test("A: 1234567890\r\n\r\nbody\r\n", false, 10, false, "", true)
+
+	test("A: 1\r\n\r\n1234567890123\r\n", false, 5, true, "A: 1\r\n\r\n12345\r\n67890\r\n123\r\n", false)
+	// Header fields are folded.
+	test("A: 1 2 345\r\n\r\nbody\r\n", false, 5, true, "A: 1\r\n 2\r\n 345\r\n\r\nbody\r\n", false)
+	test("A: 1 23\tBC\n\tC D\n\nbody\n", true, 5, true, "A: 1\r\n 23\r\n\tBC\r\n\tC D\r\n\r\nbody\r\n", false)
+	// No whitespace to fold at.
+	test("A: 12345678\r\n\r\nbody\r\n", false, 5, true, "", true)
+	test("A: 1\r\n   12345\r\n\r\nbody\r\n", false, 5, true, "", true)
+	test("A: 1\n\n1234567\n", true, 5, true, "A: 1\r\n\r\n12345\r\n67\r\n", false)
+}
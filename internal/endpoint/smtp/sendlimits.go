@@ -0,0 +1,227 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits/accounting"
+)
+
+// sendingLimits restricts the amount of messages and recipients
+// authenticated users can send per day.
+type sendingLimits struct {
+	store *accounting.Store
+	table module.Table
+
+	messages   int
+	recipients int
+}
+
+type accountLimits struct {
+	messages   int
+	recipients int
+}
+
+func sendingLimitsDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var (
+		l        = &sendingLimits{}
+		path     string
+		timezone string
+	)
+
+	cfg := config.NewMap(m.Globals, node)
+	cfg.Int("messages", false, false, 0, &l.messages)
+	cfg.Int("recipients", false, false, 0, &l.recipients)
+	cfg.Custom("table", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &l.table)
+	cfg.String("state_file", false, false,
+		filepath.Join(config.StateDirectory, "sending_limits.json"), &path)
+	cfg.String("timezone", false, false, "UTC", &timezone)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+
+	l.store, err = accounting.Open(path, loc)
+	if err != nil {
+		return nil, config.NodeErr(node, "failed to load sending limits state: %v", err)
+	}
+
+	return l, nil
+}
+
+// parseAccountLimits parses the table value in the "messages recipients"
+// format.
+func parseAccountLimits(val string) (accountLimits, error) {
+	parts := strings.Fields(val)
+	if len(parts) != 2 {
+		return accountLimits{}, fmt.Errorf("expected two values, got %d", len(parts))
+	}
+
+	var (
+		l   accountLimits
+		err error
+	)
+	l.messages, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return accountLimits{}, fmt.Errorf("malformed messages limit: %v", err)
+	}
+	l.recipients, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return accountLimits{}, fmt.Errorf("malformed recipients limit: %v", err)
+	}
+	return l, nil
+}
+
+func (l *sendingLimits) forAccount(ctx context.Context, account string) (accountLimits, error) {
+	def := accountLimits{messages: l.messages, recipients: l.recipients}
+	if l.table == nil {
+		return def, nil
+	}
+
+	val, ok, err := l.table.Lookup(ctx, account)
+	if err != nil {
+		return def, err
+	}
+	if !ok {
+		return def, nil
+	}
+	accLimits, err := parseAccountLimits(val)
+	if err != nil {
+		return def, fmt.Errorf("malformed limits for %s: %v", account, err)
+	}
+	return accLimits, nil
+}
+
+// checkSendingLimit is called when the message transaction is started by an
+// authenticated user. It reserves the message in the account usage, the
+// reservation is returned by releaseSendingLimits unless the message is
+// accepted.
+func (s *Session) checkSendingLimit(ctx context.Context) error {
+	l := s.endp.sendingLimits
+	if l == nil || s.connState.AuthUser == "" {
+		return nil
+	}
+
+	var err error
+	s.accountLimits, err = l.forAccount(ctx, s.connState.AuthUser)
+	if err != nil {
+		// Fallback to defaults. Default limits are usually tighter so that
+		// is safer than not enforcing any limits.
+		s.log.Error("sending limits lookup failed", err, "username", s.connState.AuthUser)
+	}
+
+	usage, err := l.store.Reserve(s.connState.AuthUser, now(), 1, 0, s.accountLimits.messages, 0)
+	if err == accounting.ErrLimitExceeded {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Daily limit of sent messages is reached for this account, try again tomorrow",
+			Misc: map[string]interface{}{
+				"username": s.connState.AuthUser,
+				"messages": usage.Messages,
+			},
+		}
+	}
+	if err != nil {
+		s.log.Error("failed to save sending limits state", err, "username", s.connState.AuthUser)
+	}
+	s.limitsDay = usage.Day
+	s.reservedMsgs = 1
+	return nil
+}
+
+// checkRcptLimit is called for each recipient of the message sent by an
+// authenticated user. It reserves the recipient in the account usage, the
+// caller should call releaseRcptLimit if the recipient is not accepted.
+func (s *Session) checkRcptLimit() error {
+	l := s.endp.sendingLimits
+	if l == nil || s.connState.AuthUser == "" {
+		return nil
+	}
+
+	usage, err := l.store.Reserve(s.connState.AuthUser, now(), 0, 1, 0, s.accountLimits.recipients)
+	if err == accounting.ErrLimitExceeded {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 5, 3},
+			Message:      "Daily limit of recipients is reached for this account, try again tomorrow",
+			Misc: map[string]interface{}{
+				"username":   s.connState.AuthUser,
+				"recipients": usage.Recipients,
+			},
+		}
+	}
+	if err != nil {
+		s.log.Error("failed to save sending limits state", err, "username", s.connState.AuthUser)
+	}
+	s.limitsDay = usage.Day
+	s.reservedRcpts++
+	return nil
+}
+
+// releaseRcptLimit returns the recipient reserved by checkRcptLimit.
+func (s *Session) releaseRcptLimit() {
+	l := s.endp.sendingLimits
+	if l == nil || s.reservedRcpts == 0 {
+		return
+	}
+
+	if err := l.store.Release(s.connState.AuthUser, s.limitsDay, 0, 1); err != nil {
+		s.log.Error("failed to save sending limits state", err, "username", s.connState.AuthUser)
+	}
+	s.reservedRcpts--
+}
+
+// releaseSendingLimits returns everything reserved for the current message.
+// It is called when the transaction ends.
+func (s *Session) releaseSendingLimits() {
+	l := s.endp.sendingLimits
+	if l == nil || (s.reservedMsgs == 0 && s.reservedRcpts == 0) {
+		return
+	}
+
+	if err := l.store.Release(s.connState.AuthUser, s.limitsDay, s.reservedMsgs, s.reservedRcpts); err != nil {
+		s.log.Error("failed to save sending limits state", err, "username", s.connState.AuthUser)
+	}
+	s.reservedMsgs = 0
+	s.reservedRcpts = 0
+}
+
+// accountSent is called when the message is accepted for delivery, it keeps
+// the reservation made for it.
+func (s *Session) accountSent() {
+	s.reservedMsgs = 0
+	s.reservedRcpts = 0
+}
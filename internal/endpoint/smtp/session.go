@@ -38,6 +38,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/i18n"
 )
 
 func limitReader(r io.Reader, n int64, err error) *limitedReader {
@@ -90,6 +91,20 @@ type Session struct {
 	delivery    module.Delivery
 	deliveryErr error
 
+	// Set if the transaction is registered using endp.beginTx.
+	inTx bool
+
+	// Limits for the authenticated user and the usage reserved for the
+	// current message, see sendlimits.go.
+	accountLimits accountLimits
+	limitsDay     string
+	reservedMsgs  int
+	reservedRcpts int
+
+	// Set if the connection is registered for the per-user connection
+	// limit, see connlimit.go.
+	userConnHeld bool
+
 	log log.Logger
 }
 
@@ -100,6 +115,7 @@ func (s *Session) Reset() {
 	if s.delivery != nil {
 		s.abort(s.msgCtx)
 	}
+	s.endTx()
 	s.endp.Log.DebugMsg("reset")
 }
 
@@ -124,14 +140,25 @@ func (s *Session) abort(ctx context.Context) {
 	s.cleanSession()
 }
 
+func (s *Session) endTx() {
+	if s.inTx {
+		s.inTx = false
+		s.endp.txWg.Done()
+	}
+}
+
 func (s *Session) cleanSession() {
 	s.releaseLimits()
+	s.releaseSendingLimits()
+	s.endTx()
 
 	s.mailFrom = ""
 	s.opts = smtp.MailOptions{}
 	s.msgMeta = nil
 	s.delivery = nil
 	s.deliveryErr = nil
+	s.accountLimits = accountLimits{}
+	s.limitsDay = ""
 	s.msgCtx = nil
 	s.msgTask.End()
 }
@@ -202,7 +229,16 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	if !ok {
 		remoteIP = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 	}
+	if s.endp.relayPolicy != nil {
+		if err := s.endp.relayPolicy.CheckSender(ctx, msgMeta.Conn, cleanFrom); err != nil {
+			return msgMeta.ID, err
+		}
+	}
+	if err := s.checkSendingLimit(ctx); err != nil {
+		return msgMeta.ID, err
+	}
 	if err := s.endp.limits.TakeMsg(context.Background(), remoteIP.IP, domain); err != nil {
+		s.releaseSendingLimits()
 		return "", err
 	}
 
@@ -216,6 +252,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 		s.msgCtx = nil
 		s.msgTask.End()
 		s.endp.limits.ReleaseMsg(remoteIP.IP, domain)
+		s.releaseSendingLimits()
 		return msgMeta.ID, err
 	}
 
@@ -232,6 +269,13 @@ func (s *Session) Mail(from string, opts smtp.MailOptions) error {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
+	if !s.inTx {
+		if err := s.endp.beginTx(); err != nil {
+			return s.endp.wrapErr("", !opts.UTF8, "MAIL", err)
+		}
+		s.inTx = true
+	}
+
 	if !s.endp.deferServerReject {
 		// Will initialize s.msgCtx.
 		msgID, err := s.startDelivery(s.sessionCtx, from, opts)
@@ -239,6 +283,7 @@ func (s *Session) Mail(from string, opts smtp.MailOptions) error {
 			if err != context.DeadlineExceeded {
 				s.log.Error("MAIL FROM error", err, "msg_id", msgID)
 			}
+			s.endTx()
 			return s.endp.wrapErr(msgID, !opts.UTF8, "MAIL", err)
 		}
 	}
@@ -319,13 +364,25 @@ func (s *Session) Rcpt(to string) error {
 				s.log.Msg("too many RCPT errors, possible dictonary attack", "src_ip", s.connState.RemoteAddr, "msg_id", s.msgMeta.ID)
 			}
 		}
-		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "RCPT", err)
+		return s.endp.wrapRcptErr(rcptCtx, to, s.msgMeta.ID, !s.opts.UTF8, "RCPT", err)
 	}
 	s.endp.Log.Msg("RCPT ok", "rcpt", to, "msg_id", s.msgMeta.ID)
 	return nil
 }
 
 func (s *Session) rcpt(ctx context.Context, to string) error {
+	if err := s.checkRcptLimit(); err != nil {
+		return err
+	}
+	if err := s.addRcpt(ctx, to); err != nil {
+		s.releaseRcptLimit()
+		return err
+	}
+	return nil
+}
+
+func (s *Session) addRcpt(ctx context.Context, to string) error {
+
 	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
 	// used.
 	if !address.IsASCII(to) && !s.opts.UTF8 {
@@ -344,6 +401,12 @@ func (s *Session) rcpt(ctx context.Context, to string) error {
 		}
 	}
 
+	if s.endp.relayPolicy != nil {
+		if err := s.endp.relayPolicy.CheckRcpt(ctx, s.msgMeta.Conn, cleanTo); err != nil {
+			return err
+		}
+	}
+
 	return s.delivery.AddRcpt(ctx, cleanTo)
 }
 
@@ -358,6 +421,8 @@ func (s *Session) Logout() error {
 			s.log.Msg("MAIL FROM repeated error a lot of times, possible dictonary attack", "count", s.repeatedMailErrs, "src_ip", s.connState.RemoteAddr)
 		}
 	}
+	s.endTx()
+	s.releaseUserConn()
 	if s.cancelRDNS != nil {
 		s.cancelRDNS()
 	}
@@ -365,6 +430,10 @@ func (s *Session) Logout() error {
 }
 
 func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, error) {
+	if s.endp.fixLineEndings || s.endp.maxLineLength > 0 {
+		r = newLineNormalizer(r, s.endp.fixLineEndings, s.endp.maxLineLength, s.endp.wrapLongLines)
+	}
+
 	limitr := limitReader(r, int64(s.endp.maxHeaderBytes), &exterrors.SMTPError{
 		Code:         552,
 		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
@@ -407,9 +476,11 @@ func (s *Session) Data(r io.Reader) error {
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
+	resetDataLimit := s.limitData()
 	header, buf, err := s.prepareBody(r)
+	resetDataLimit()
 	if err != nil {
-		return wrapErr(err)
+		return wrapErr(s.timeoutErr(err))
 	}
 	defer func() {
 		if err := buf.Remove(); err != nil {
@@ -436,6 +507,7 @@ func (s *Session) Data(r io.Reader) error {
 		return wrapErr(err)
 	}
 
+	s.accountSent()
 	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
 
 	return nil
@@ -447,7 +519,7 @@ type statusWrapper struct {
 }
 
 func (sw statusWrapper) SetStatus(rcpt string, err error) {
-	sw.sc.SetStatus(rcpt, sw.s.endp.wrapErr(sw.s.msgMeta.ID, !sw.s.opts.UTF8, "DATA", err))
+	sw.sc.SetStatus(rcpt, sw.s.endp.wrapRcptErr(sw.s.msgCtx, rcpt, sw.s.msgMeta.ID, !sw.s.opts.UTF8, "DATA", err))
 }
 
 func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
@@ -462,9 +534,11 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
+	resetDataLimit := s.limitData()
 	header, buf, err := s.prepareBody(r)
+	resetDataLimit()
 	if err != nil {
-		return wrapErr(err)
+		return wrapErr(s.timeoutErr(err))
 	}
 	defer func() {
 		if err := buf.Remove(); err != nil {
@@ -517,6 +591,16 @@ func (s *Session) checkRoutingLoops(header textproto.Header) error {
 }
 
 func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err error) error {
+	return endp.wrapErrLocale(endp.locales.Locale(context.Background(), ""), msgId, mangleUTF8, command, err)
+}
+
+// wrapRcptErr is similar to wrapErr, but uses the locale selected for the
+// recipient.
+func (endp *Endpoint) wrapRcptErr(ctx context.Context, rcpt, msgId string, mangleUTF8 bool, command string, err error) error {
+	return endp.wrapErrLocale(endp.locales.Locale(ctx, rcpt), msgId, mangleUTF8, command, err)
+}
+
+func (endp *Endpoint) wrapErrLocale(locale, msgId string, mangleUTF8 bool, command string, err error) error {
 	if err == nil {
 		return nil
 	}
@@ -563,6 +647,11 @@ func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err
 		res.Message = smtpErr.Message
 	}
 
+	// Translated text is not used if it can't be sent as is.
+	if translated := i18n.Message(locale, res.Message); !mangleUTF8 || address.IsASCII(translated) {
+		res.Message = translated
+	}
+
 	if msgId != "" {
 		res.Message += " (msg ID = " + msgId + ")"
 	}
@@ -44,30 +44,58 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/i18n"
 	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/limits/userconns"
+	"github.com/foxcpp/maddy/internal/listen"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/relaypolicy"
 	"golang.org/x/net/idna"
 )
 
 type Endpoint struct {
-	saslAuth  auth.SASLAuth
-	serv      *smtp.Server
-	name      string
-	addrs     []string
-	listeners []net.Listener
-	pipeline  *msgpipeline.MsgPipeline
-	resolver  dns.Resolver
-	limits    *limits.Group
+	saslAuth   auth.SASLAuth
+	serv       *smtp.Server
+	name       string
+	addrs      []string
+	listeners  []net.Listener
+	listenOpts listen.Options
+	pipeline   *msgpipeline.MsgPipeline
+	resolver   dns.Resolver
+	limits     *limits.Group
+
+	sendingLimits *sendingLimits
+	relayPolicy   *relaypolicy.Policy
+	connLimit     userconns.Limit
+
+	// Locale used for SMTP response messages.
+	locales i18n.Selector
 
 	buffer func(r io.Reader) (buffer.Buffer, error)
 
 	authAlwaysRequired  bool
+	requireTLS          bool
 	submission          bool
 	lmtp                bool
 	deferServerReject   bool
 	maxLoggedRcptErrors int
 	maxReceived         int
 	maxHeaderBytes      int
+	fixLineEndings      bool
+	maxLineLength       int
+	wrapLongLines       bool
+	sessionTimeout      time.Duration
+	dataTimeout         time.Duration
+
+	// txLock protects shuttingDown flag and txWg counter.
+	txLock       sync.Mutex
+	txWg         sync.WaitGroup
+	shuttingDown bool
+
+	// conns contains *timeoutConn for each accepted connection,
+	// indexed by its RemoteAddr value.
+	conns sync.Map
 
 	listenersWg sync.WaitGroup
 
@@ -118,12 +146,17 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		addresses = append(addresses, saddr)
 	}
 
+	if module.NoRun {
+		return nil
+	}
+
 	if err := endp.setupListeners(addresses); err != nil {
 		for _, l := range endp.listeners {
 			l.Close()
 		}
 		return err
 	}
+	control.RegisterConnSource(endp.controlName(), endp.controlConns)
 
 	allLocal := true
 	for _, addr := range addresses {
@@ -234,21 +267,31 @@ func bufferModeDirective(_ *config.Map, node config.Node) (interface{}, error) {
 
 func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	var (
-		hostname string
-		err      error
-		ioDebug  bool
+		hostname  string
+		err       error
+		ioDebug   bool
+		longLines string
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("master_users", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.AddMasterUsers(m, node)
+	})
+	cfg.StringList("sasl_mechanisms", false, false, nil, &endp.saslAuth.EnabledMechs)
 	cfg.String("hostname", true, true, "", &hostname)
 	cfg.Duration("write_timeout", false, false, 1*time.Minute, &endp.serv.WriteTimeout)
 	cfg.Duration("read_timeout", false, false, 10*time.Minute, &endp.serv.ReadTimeout)
+	cfg.Duration("data_timeout", false, false, 0, &endp.dataTimeout)
+	cfg.Duration("session_timeout", false, false, 0, &endp.sessionTimeout)
 	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &endp.serv.MaxMessageBytes)
 	cfg.DataSize("max_header_size", false, false, 1*1024*1024, &endp.maxHeaderBytes)
 	cfg.Int("max_recipients", false, false, 20000, &endp.serv.MaxRecipients)
 	cfg.Int("max_received", false, false, 50, &endp.maxReceived)
+	cfg.Bool("normalize_line_endings", false, false, &endp.fixLineEndings)
+	cfg.Int("max_line_length", false, false, 0, &endp.maxLineLength)
+	cfg.Enum("long_lines", false, false, []string{"reject", "wrap"}, "reject", &longLines)
 	cfg.Custom("buffer", false, false, func() (interface{}, error) {
 		path := filepath.Join(config.StateDirectory, "buffer")
 		if err := os.MkdirAll(path, 0700); err != nil {
@@ -258,11 +301,15 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	}, bufferModeDirective, &endp.buffer)
 	cfg.Custom("tls", true, endp.name != "lmtp", nil, tls2.TLSDirective, &endp.serv.TLSConfig)
 	cfg.Bool("insecure_auth", endp.name == "lmtp", false, &endp.serv.AllowInsecureAuth)
+	cfg.Bool("require_tls", false, false, &endp.requireTLS)
 	cfg.Int("smtp_max_line_length", false, false, 4000, &endp.serv.MaxLineLength)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
 	cfg.Bool("defer_sender_reject", false, true, &endp.deferServerReject)
 	cfg.Int("max_logged_rcpt_errors", false, false, 5, &endp.maxLoggedRcptErrors)
+	i18n.Directives(cfg, &endp.locales)
+	listen.Directives(cfg, &endp.listenOpts)
+	userconns.Directives(cfg, &endp.connLimit)
 	cfg.Custom("limits", false, false, func() (interface{}, error) {
 		return &limits.Group{}, nil
 	}, func(cfg *config.Map, n config.Node) (interface{}, error) {
@@ -272,12 +319,30 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &endp.limits)
+	cfg.Custom("sending_limits", false, false, func() (interface{}, error) {
+		return (*sendingLimits)(nil), nil
+	}, sendingLimitsDirective, &endp.sendingLimits)
+	cfg.Custom("relay_policy", false, false, func() (interface{}, error) {
+		return (*relaypolicy.Policy)(nil), nil
+	}, func(cfg *config.Map, n config.Node) (interface{}, error) {
+		var p *relaypolicy.Policy
+		if err := modconfig.GroupFromNode("relay_policy", n.Args, n, cfg.Globals, &p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}, &endp.relayPolicy)
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
 	if err != nil {
 		return err
 	}
 
+	endp.wrapLongLines = longLines == "wrap"
+
+	if endp.requireTLS && endp.serv.TLSConfig == nil {
+		return fmt.Errorf("%s: require_tls can't be used without TLS configuration", endp.name)
+	}
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.3.
 	endp.serv.Domain, err = idna.ToASCII(hostname)
 	if err != nil {
@@ -293,6 +358,9 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug}
 	endp.pipeline.FirstPipeline = true
 
+	if err := endp.saslAuth.CheckMechanisms(); err != nil {
+		return fmt.Errorf("%s: %w", endp.name, err)
+	}
 	endp.serv.AuthDisabled = len(endp.saslAuth.SASLMechanisms()) == 0
 	if endp.submission {
 		endp.authAlwaysRequired = true
@@ -300,10 +368,23 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 			return fmt.Errorf("%s: auth. provider must be set for submission endpoint", endp.name)
 		}
 	}
+	if !endp.saslAuth.MechEnabled(sasl.Plain) {
+		// go-smtp enables PLAIN by default and provides no way to remove
+		// it, so it stays advertised but is replaced with a handler that
+		// always fails.
+		endp.serv.EnableAuth(sasl.Plain, func(c *smtp.Conn) sasl.Server {
+			return auth.FailingSASLServ{Err: &smtp.SMTPError{
+				Code:         504,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 4},
+				Message:      "Unsupported authentication mechanism",
+			}}
+		})
+	}
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
-		// The code below lacks handling to set AuthPassword. Don't
-		// override sasl.Plain handler so Login() will be called as usual.
+		// The code below lacks handling to set AuthPassword. sasl.Plain
+		// handler is set up separately below.
 		if mech == sasl.Plain {
+			endp.enablePlainAuth()
 			continue
 		}
 
@@ -311,12 +392,20 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 
 		endp.serv.EnableAuth(mech, func(c *smtp.Conn) sasl.Server {
 			state := c.State()
+			if err := endp.checkTLS(&state); err != nil {
+				return auth.FailingSASLServ{Err: err}
+			}
 			if err := endp.pipeline.RunEarlyChecks(context.TODO(), &state); err != nil {
 				return auth.FailingSASLServ{Err: endp.wrapErr("", true, "AUTH", err)}
 			}
 
 			return endp.saslAuth.CreateSASL(mech, state.RemoteAddr, func(id string) error {
-				c.SetSession(endp.newSession(id, "", &state))
+				if err := endp.takeUserConn(&state, id); err != nil {
+					return err
+				}
+				sess := endp.newSession(id, "", &state)
+				sess.userConnHeld = true
+				c.SetSession(sess)
 				return nil
 			})
 		})
@@ -332,49 +421,77 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 
 func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	for _, addr := range addresses {
-		var l net.Listener
-		var err error
-		l, err = net.Listen(addr.Network(), addr.Address())
+		if addr.IsTLS() && endp.serv.TLSConfig == nil {
+			return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
+		}
+
+		ls, err := endp.listenOpts.Endpoint(addr)
 		if err != nil {
 			return fmt.Errorf("%s: %w", endp.name, err)
 		}
-		endp.Log.Printf("listening on %v", addr)
 
-		if addr.IsTLS() {
-			if endp.serv.TLSConfig == nil {
-				return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
+		for _, l := range ls {
+			endp.Log.Printf("listening on %v", addr)
+
+			l = timeoutListener{Listener: control.FilterListener(l), endp: endp}
+			if addr.IsTLS() {
+				l = tls.NewListener(l, endp.serv.TLSConfig)
 			}
-			l = tls.NewListener(l, endp.serv.TLSConfig)
+
+			endp.listeners = append(endp.listeners, l)
+
+			endp.listenersWg.Add(1)
+			addr := addr
+			l := l
+			go func() {
+				if err := endp.serv.Serve(l); err != nil && !endp.isShuttingDown() {
+					endp.Log.Printf("failed to serve %s: %s", addr, err)
+				}
+				endp.listenersWg.Done()
+			}()
 		}
+	}
 
-		endp.listeners = append(endp.listeners, l)
+	return nil
+}
 
-		endp.listenersWg.Add(1)
-		addr := addr
-		go func() {
-			if err := endp.serv.Serve(l); err != nil {
-				endp.Log.Printf("failed to serve %s: %s", addr, err)
+// enablePlainAuth replaces the default go-smtp PLAIN handler with one that
+// supports authorization identities (used by master users).
+func (endp *Endpoint) enablePlainAuth() {
+	endp.serv.EnableAuth(sasl.Plain, func(c *smtp.Conn) sasl.Server {
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			state := c.State()
+			session, err := endp.login(&state, identity, username, password)
+			if err != nil {
+				return err
 			}
-			endp.listenersWg.Done()
-		}()
-	}
 
-	return nil
+			c.SetSession(session)
+			return nil
+		})
+	})
 }
 
 func (endp *Endpoint) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return endp.login(state, "", username, password)
+}
+
+func (endp *Endpoint) login(state *smtp.ConnectionState, authzid, username, password string) (smtp.Session, error) {
 	if endp.serv.AuthDisabled {
 		return nil, smtp.ErrAuthUnsupported
 	}
+	if err := endp.checkTLS(state); err != nil {
+		return nil, err
+	}
 
 	// Executed before authentication and session initialization.
 	if err := endp.pipeline.RunEarlyChecks(context.TODO(), state); err != nil {
 		return nil, endp.wrapErr("", true, "AUTH", err)
 	}
 
-	err := endp.saslAuth.AuthPlain(username, password)
+	err := endp.saslAuth.AuthPlainAs(authzid, username, password)
 	if err != nil {
-		endp.Log.Error("authentication failed", err, "username", username, "src_ip", state.RemoteAddr)
+		endp.Log.Error("authentication failed", err, "username", username, "authzid", authzid, "src_ip", state.RemoteAddr)
 
 		failedLogins.WithLabelValues(endp.name).Inc()
 
@@ -393,10 +510,27 @@ func (endp *Endpoint) Login(state *smtp.ConnectionState, username, password stri
 		}
 	}
 
-	return endp.newSession(username, password, state), nil
+	identity := username
+	if authzid != "" && authzid != username {
+		endp.Log.Msg("master user login", "username", username, "authzid", authzid, "src_ip", state.RemoteAddr)
+
+		// Password belongs to the master user and is not usable for the
+		// authorization identity.
+		identity, password = authzid, ""
+	}
+
+	if err := endp.takeUserConn(state, identity); err != nil {
+		return nil, err
+	}
+	sess := endp.newSession(identity, password, state)
+	sess.userConnHeld = true
+	return sess, nil
 }
 
 func (endp *Endpoint) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if err := endp.checkTLS(state); err != nil {
+		return nil, err
+	}
 	if endp.authAlwaysRequired {
 		return nil, smtp.ErrAuthRequired
 	}
@@ -409,7 +543,22 @@ func (endp *Endpoint) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session,
 	return endp.newSession("", "", state), nil
 }
 
-func (endp *Endpoint) newSession(username, password string, state *smtp.ConnectionState) smtp.Session {
+// checkTLS rejects the session if require_tls is enabled and the client did
+// not establish TLS (either using STARTTLS or implicit TLS).
+func (endp *Endpoint) checkTLS(state *smtp.ConnectionState) error {
+	if !endp.requireTLS || state.TLS.HandshakeComplete {
+		return nil
+	}
+
+	endp.Log.Msg("plaintext session rejected", "src_ip", state.RemoteAddr)
+	return &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Must issue a STARTTLS command first",
+	}
+}
+
+func (endp *Endpoint) newSession(username, password string, state *smtp.ConnectionState) *Session {
 	s := &Session{
 		endp: endp,
 		log:  endp.Log,
@@ -417,6 +566,7 @@ func (endp *Endpoint) newSession(username, password string, state *smtp.Connecti
 			ConnectionState: *state,
 			AuthUser:        username,
 			AuthPassword:    password,
+			Cache:           &sync.Map{},
 		},
 		sessionCtx: context.Background(),
 	}
@@ -433,6 +583,10 @@ func (endp *Endpoint) newSession(username, password string, state *smtp.Connecti
 		}
 	}
 
+	if c, ok := endp.conns.Load(state.RemoteAddr); ok {
+		c.(*timeoutConn).setSession(username, state.TLS.HandshakeComplete)
+	}
+
 	if endp.resolver != nil {
 		rdnsCtx, cancelRDNS := context.WithCancel(s.sessionCtx)
 		s.connState.RDNSName = future.New()
@@ -443,7 +597,54 @@ func (endp *Endpoint) newSession(username, password string, state *smtp.Connecti
 	return s
 }
 
+// Shutdown stops accepting new connections and waits for running SMTP
+// transactions to complete before closing the endpoint.
+func (endp *Endpoint) Shutdown(ctx context.Context) error {
+	endp.txLock.Lock()
+	endp.shuttingDown = true
+	endp.txLock.Unlock()
+
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		endp.txWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		endp.Log.Printf("shutdown grace period expired, aborting running transactions")
+	}
+
+	return endp.Close()
+}
+
+func (endp *Endpoint) isShuttingDown() bool {
+	endp.txLock.Lock()
+	defer endp.txLock.Unlock()
+	return endp.shuttingDown
+}
+
+// beginTx registers the running SMTP transaction so Shutdown can wait for it.
+func (endp *Endpoint) beginTx() error {
+	endp.txLock.Lock()
+	defer endp.txLock.Unlock()
+	if endp.shuttingDown {
+		return &exterrors.SMTPError{
+			Code:         421,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
+			Message:      "Server is shutting down, try again later",
+		}
+	}
+	endp.txWg.Add(1)
+	return nil
+}
+
 func (endp *Endpoint) Close() error {
+	control.UnregisterConnSource(endp.controlName())
 	endp.serv.Close()
 	endp.listenersWg.Wait()
 	return nil
@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"math/rand"
 	"net"
@@ -35,6 +37,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/limits/userconns"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -253,6 +256,45 @@ func TestSMTPDelivery_EarlyCheck_Fail(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_Locale(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			EarlyErr: &exterrors.SMTPError{
+				Code:    550,
+				Message: "Message rejected due to local policy",
+			},
+		},
+	}, []config.Node{
+		{
+			Name: "locale",
+			Args: []string{"de"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Mail("sender@example.org", nil)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned")
+	}
+	if smtpErr.Code != 550 {
+		t.Fatal("Wrong SMTP code:", smtpErr.Code)
+	}
+	if smtpErr.Message != "Nachricht aufgrund lokaler Richtlinien abgelehnt" {
+		t.Fatal("Wrong SMTP message:", smtpErr.Message)
+	}
+}
+
 func TestSMTPDeliver_CheckError(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
@@ -418,6 +460,180 @@ func TestSMTPDelivery_AbortData(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_DataTimeout(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "data_timeout",
+			Args: []string{"200ms"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Hello("mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rcpt("test@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := cl.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	err = data.Close()
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 421 {
+		t.Fatal("Wrong SMTP code:", smtpErr.Code)
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Expected no messages, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_DataTimeout_Close(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "data_timeout",
+			Args: []string{"200ms"},
+		},
+	})
+	defer endp.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+
+	expect := func(cmd, code string) {
+		t.Helper()
+		if cmd != "" {
+			if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(line, code) {
+				t.Fatalf("Unexpected response to %s: %s", cmd, line)
+			}
+			if line[3] == ' ' {
+				return
+			}
+		}
+	}
+
+	expect("", "220")
+	expect("EHLO mx.example.org", "250")
+	expect("MAIL FROM:<sender@example.org>", "250")
+	expect("RCPT TO:<test@example.com>", "250")
+	expect("DATA", "354")
+	if _, err := conn.Write([]byte("Subject: Hello\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("", "421")
+
+	// The connection is closed after the reply, the rest of the message is
+	// not interpreted as commands.
+	if _, err := conn.Write([]byte("NOOP\r\n")); err != nil {
+		return
+	}
+	if line, err := r.ReadString('\n'); err == nil {
+		t.Fatal("Expected the connection to be closed, got", line)
+	}
+}
+
+func TestSMTPDelivery_Shutdown(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Hello("mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rcpt("test@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- endp.Shutdown(context.Background())
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the transaction is completed")
+	default:
+	}
+
+	if _, err := net.Dial("tcp", "127.0.0.1:"+testPort); err == nil {
+		t.Fatal("Expected new connections to be refused")
+	}
+
+	data, err := cl.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after the transaction is completed")
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
 func TestSMTPDelivery_EmptyMessage(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
@@ -581,6 +797,170 @@ func TestSMTPDelivery_SubmissionAuthOK(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_RequireTLS(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, nil)
+	defer endp.Close()
+	// Can't be enabled using the configuration since TLS is off.
+	endp.requireTLS = true
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Auth(sasl.NewPlainClient("", "user", "password"))
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 530 {
+		t.Fatal("Wrong error:", err)
+	}
+
+	err = cl.Mail("sender@example.org", nil)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 530 {
+		t.Fatal("Wrong error:", err)
+	}
+
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Unexpected message delivered")
+	}
+}
+
+func TestSMTPDelivery_MaxConnsPerUser(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "max_conns_per_user",
+			Args: []string{"1"},
+		},
+	})
+	defer endp.Close()
+
+	cl1, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl1.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+
+	cl2, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl2.Close()
+	err = cl2.Auth(sasl.NewPlainClient("", "user", "password"))
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 421 {
+		t.Fatal("Wrong error:", err)
+	}
+
+	// Other users are not affected.
+	cl3, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl3.Close()
+	if err := cl3.Auth(sasl.NewPlainClient("", "user2", "password")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cl1.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	// Connection is released asynchronously after QUIT.
+	for i := 0; i < 100 && userconns.Count("user") != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cl4, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl4.Close()
+	if err := cl4.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSMTPDelivery_RelayPolicy(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "relay_policy",
+			Children: []config.Node{
+				{Name: "local_domains", Args: []string{"example.org"}},
+			},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = submitMsg(t, cl, "sender@example.com", []string{"rcpt@example.com"}, testMsg)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 {
+		t.Fatal("Wrong error:", err)
+	}
+	if err := cl.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := submitMsg(t, cl, "sender@example.com", []string{"rcpt@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_RelayPolicy_Authenticated(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "relay_policy",
+			Children: []config.Node{
+				{Name: "local_domains", Args: []string{"example.org"}},
+				{Name: "allow_relay", Args: []string{"authenticated"}},
+			},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Auth(sasl.NewPlainClient("", "sender@example.org", "password")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+
+	// MAIL FROM errors are deferred until RCPT TO by default.
+	err = submitMsg(t, cl, "other@example.org", []string{"rcpt@example.com"}, testMsg)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 553 {
+		t.Fatal("Wrong error:", err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
 	flag.Parse()
@@ -19,13 +19,19 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
 )
 
 func init() {
@@ -163,3 +169,128 @@ func TestSubmissionPrepare(t *testing.T) {
 		"Date":       {"Thu, 1 Jan 1970 00:00:00 +0000"},
 	})
 }
+
+func TestSubmission_SendingLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "sending_limits",
+			Children: []config.Node{
+				{Name: "messages", Args: []string{"2"}},
+				{Name: "recipients", Args: []string{"3"}},
+				{Name: "state_file", Args: []string{filepath.Join(dir, "limits.json")}},
+			},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCode := func(err error, code int) {
+		t.Helper()
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok {
+			t.Fatalf("expected SMTPError, got %v", err)
+		}
+		if smtpErr.Code != code {
+			t.Fatalf("wrong error code: %d (%s)", smtpErr.Code, smtpErr.Message)
+		}
+	}
+
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rcpt("rcpt1@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	expectCode(cl.Rcpt("rcpt2@example.org"), 451)
+	data, err := cl.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// MAIL FROM errors are deferred until RCPT TO by default.
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	expectCode(cl.Rcpt("rcpt1@example.org"), 451)
+
+	if len(tgt.Messages) != 2 {
+		t.Fatal("Expected 2 messages, got", len(tgt.Messages))
+	}
+	testutils.CheckMsgID(t, &tgt.Messages[1], "sender@example.org", []string{"rcpt1@example.org"}, "")
+}
+
+func TestSubmission_SendingLimits_Reset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "sending_limits",
+			Children: []config.Node{
+				{Name: "messages", Args: []string{"1"}},
+				{Name: "recipients", Args: []string{"1"}},
+				{Name: "state_file", Args: []string{filepath.Join(dir, "limits.json")}},
+			},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Aborted transaction does not use the limits.
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rcpt("rcpt1@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected 1 message, got", len(tgt.Messages))
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+// timeoutListener wraps accepted connections to enforce session_timeout and
+// data_timeout limits on top of per-command deadlines set by go-smtp.
+type timeoutListener struct {
+	net.Listener
+	endp *Endpoint
+}
+
+func (l timeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &timeoutConn{
+		Conn:       conn,
+		remoteAddr: conn.RemoteAddr(),
+		endp:       l.endp,
+		accepted:   time.Now(),
+	}
+	if _, ok := tc.remoteAddr.(*net.TCPAddr); !ok {
+		// Addresses of Unix sockets connections are not unique, make sure we
+		// can still find the right connection by its address.
+		tc.remoteAddr = &net.UnixAddr{Name: conn.RemoteAddr().String(), Net: "unix"}
+	}
+	if l.endp.sessionTimeout != 0 {
+		tc.sessionLimit = time.Now().Add(l.endp.sessionTimeout)
+		if err := conn.SetDeadline(tc.sessionLimit); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	l.endp.conns.Store(tc.remoteAddr, tc)
+	return tc, nil
+}
+
+type timeoutConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	endp       *Endpoint
+	accepted   time.Time
+
+	lock         sync.Mutex
+	sessionLimit time.Time
+	readLimit    time.Time
+
+	// Set to 1 if the connection should be closed after the reply is sent.
+	closing int32
+
+	// Set once the session is started, used to report the connection state
+	// via the control endpoint.
+	username string
+	tls      bool
+}
+
+// Read returns io.EOF once closeAfterReply is called so go-smtp stops
+// reading the message body and closes the connection after sending the
+// reply.
+func (tc *timeoutConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&tc.closing) == 1 {
+		return 0, io.EOF
+	}
+	return tc.Conn.Read(b)
+}
+
+func (tc *timeoutConn) closeAfterReply() {
+	atomic.StoreInt32(&tc.closing, 1)
+}
+
+func (tc *timeoutConn) RemoteAddr() net.Addr {
+	return tc.remoteAddr
+}
+
+func earliest(t time.Time, limits ...time.Time) time.Time {
+	for _, limit := range limits {
+		if limit.IsZero() {
+			continue
+		}
+		if t.IsZero() || limit.Before(t) {
+			t = limit
+		}
+	}
+	return t
+}
+
+func (tc *timeoutConn) SetDeadline(t time.Time) error {
+	if err := tc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return tc.SetWriteDeadline(t)
+}
+
+func (tc *timeoutConn) SetReadDeadline(t time.Time) error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return tc.Conn.SetReadDeadline(earliest(t, tc.sessionLimit, tc.readLimit))
+}
+
+func (tc *timeoutConn) SetWriteDeadline(t time.Time) error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return tc.Conn.SetWriteDeadline(earliest(t, tc.sessionLimit))
+}
+
+// limitRead makes sure no data is read after the specified moment until
+// limitRead is called again with zero time.Time.
+func (tc *timeoutConn) limitRead(t time.Time) error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.readLimit = t
+	if t.IsZero() {
+		return nil
+	}
+	return tc.Conn.SetReadDeadline(earliest(t, tc.sessionLimit))
+}
+
+func (tc *timeoutConn) setSession(username string, tls bool) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.username = username
+	tc.tls = tls
+}
+
+func (tc *timeoutConn) Close() error {
+	tc.endp.conns.Delete(tc.remoteAddr)
+	return tc.Conn.Close()
+}
+
+// limitData applies data_timeout to the connection of the session. The
+// returned function should be called once the message body is received.
+func (s *Session) limitData() func() {
+	if s.endp.dataTimeout == 0 {
+		return func() {}
+	}
+	c, ok := s.endp.conns.Load(s.connState.RemoteAddr)
+	if !ok {
+		return func() {}
+	}
+	tc := c.(*timeoutConn)
+	if err := tc.limitRead(time.Now().Add(s.endp.dataTimeout)); err != nil {
+		s.log.Error("failed to set data deadline", err)
+	}
+	return func() {
+		if err := tc.limitRead(time.Time{}); err != nil {
+			s.log.Error("failed to reset data deadline", err)
+		}
+	}
+}
+
+// timeoutErr replaces I/O timeout errors with the 421 SMTP error and
+// makes sure the connection is closed after the reply is sent.
+func (s *Session) timeoutErr(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		if c, ok := s.endp.conns.Load(s.connState.RemoteAddr); ok {
+			c.(*timeoutConn).closeAfterReply()
+		}
+		return &exterrors.SMTPError{
+			Code:         421,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 2},
+			Message:      "Timeout while receiving the message, closing connection",
+			Err:          err,
+		}
+	}
+	return err
+}
+
+func (endp *Endpoint) controlName() string {
+	return endp.name + " " + strings.Join(endp.addrs, " ")
+}
+
+// controlConns returns the list of accepted connections for the control
+// endpoint.
+func (endp *Endpoint) controlConns() []control.ConnInfo {
+	var conns []control.ConnInfo
+	endp.conns.Range(func(_, c interface{}) bool {
+		tc := c.(*timeoutConn)
+		tc.lock.Lock()
+		defer tc.lock.Unlock()
+
+		accepted := tc.accepted
+		conns = append(conns, control.ConnInfo{
+			Endpoint:   endp.controlName(),
+			RemoteAddr: tc.remoteAddr.String(),
+			Username:   tc.username,
+			Since:      &accepted,
+			TLS:        tc.tls,
+		})
+		return true
+	})
+	return conns
+}
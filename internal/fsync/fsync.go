@@ -0,0 +1,217 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package fsync implements the configurable policy for flushing written
+// files to the stable storage.
+//
+// Three modes are supported:
+//   - always: files are flushed before the write is reported as complete.
+//   - interval: files are remembered and flushed in batches periodically.
+//   - never: flushing is left to the OS.
+package fsync
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+type Mode string
+
+const (
+	Always   Mode = "always"
+	Interval Mode = "interval"
+	Never    Mode = "never"
+)
+
+// DefaultInterval is the default value of fsync_interval directive.
+const DefaultInterval = 1 * time.Second
+
+// Policy controls when written files are flushed to disk.
+//
+// Zero value is the Always policy.
+type Policy struct {
+	Mode     Mode
+	Interval time.Duration
+	Log      log.Logger
+
+	dirtyLck sync.Mutex
+	dirty    map[string]bool // path -> is directory
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Directives adds fsync and fsync_interval directives to cfg.
+func Directives(cfg *config.Map, p *Policy) {
+	cfg.Custom("fsync", false, false, func() (interface{}, error) {
+		return Always, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "expected exactly one argument")
+		}
+		switch mode := Mode(node.Args[0]); mode {
+		case Always, Interval, Never:
+			return mode, nil
+		default:
+			return nil, config.NodeErr(node, "unknown fsync mode: %s", node.Args[0])
+		}
+	}, &p.Mode)
+	cfg.Duration("fsync_interval", false, false, DefaultInterval, &p.Interval)
+}
+
+// Start starts the background flushing if Interval mode is used.
+func (p *Policy) Start() error {
+	if p.Mode != Interval {
+		return nil
+	}
+	if p.Interval <= 0 {
+		return fmt.Errorf("fsync: fsync_interval should be positive")
+	}
+
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+	go func() {
+		defer close(p.stopped)
+		t := time.NewTicker(p.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := p.Flush(); err != nil {
+					p.Log.Error("flush failed", err)
+				}
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops the background flushing and flushes remaining files.
+func (p *Policy) Close() error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	<-p.stopped
+	p.stop = nil
+	return p.Flush()
+}
+
+// File flushes f or schedules it to be flushed later, depending on the
+// mode.
+//
+// In Interval mode file is reopened by name when flushed so f can be
+// closed immediately after the call.
+func (p *Policy) File(f *os.File) error {
+	switch p.Mode {
+	case Interval:
+		p.markDirty(f.Name(), false)
+		return nil
+	case Never:
+		return nil
+	default:
+		return f.Sync()
+	}
+}
+
+// Rename flushes f and renames it to newPath or schedules newPath to be
+// flushed later, depending on the mode.
+//
+// File() should not be used for files that are renamed after writing since
+// in Interval mode the old name would be flushed.
+func (p *Policy) Rename(f *os.File, newPath string) error {
+	switch p.Mode {
+	case Interval:
+		if err := os.Rename(f.Name(), newPath); err != nil {
+			return err
+		}
+		p.markDirty(newPath, false)
+		return nil
+	case Never:
+		return os.Rename(f.Name(), newPath)
+	default:
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), newPath)
+	}
+}
+
+// Dir flushes the directory entries (e.g. created or renamed files) or
+// schedules it to be flushed later, depending on the mode.
+func (p *Policy) Dir(path string) error {
+	switch p.Mode {
+	case Interval:
+		p.markDirty(path, true)
+		return nil
+	case Never:
+		return nil
+	default:
+		return syncPath(path)
+	}
+}
+
+func (p *Policy) markDirty(path string, dir bool) {
+	p.dirtyLck.Lock()
+	defer p.dirtyLck.Unlock()
+	if p.dirty == nil {
+		p.dirty = make(map[string]bool)
+	}
+	p.dirty[path] = dir
+}
+
+// Flush flushes all files scheduled in Interval mode.
+//
+// Files removed since they were scheduled are ignored. Files are flushed
+// before directories so renames done after the write are not persisted
+// before the file contents.
+func (p *Policy) Flush() error {
+	p.dirtyLck.Lock()
+	dirty := p.dirty
+	p.dirty = nil
+	p.dirtyLck.Unlock()
+
+	var firstErr error
+	for _, wantDir := range []bool{false, true} {
+		for path, isDir := range dirty {
+			if isDir != wantDir {
+				continue
+			}
+			if err := syncPath(path); err != nil && !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
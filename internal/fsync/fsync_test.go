@@ -0,0 +1,162 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package fsync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDirectives(t *testing.T) {
+	parse := func(args ...string) (*Policy, error) {
+		p := &Policy{}
+		var children []config.Node
+		if len(args) != 0 {
+			children = []config.Node{{Name: "fsync", Args: args}}
+		}
+		m := config.NewMap(nil, config.Node{Children: children})
+		Directives(m, p)
+		_, err := m.Process()
+		return p, err
+	}
+
+	p, err := parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != Always || p.Interval != DefaultInterval {
+		t.Errorf("wrong defaults: %v, %v", p.Mode, p.Interval)
+	}
+
+	p, err = parse("interval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != Interval {
+		t.Errorf("wrong mode: %v", p.Mode)
+	}
+
+	if _, err := parse("sometimes"); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
+
+func TestPolicy_Interval(t *testing.T) {
+	dir := testutils.Dir(t)
+	p := Policy{Mode: Interval, Interval: time.Hour, Log: testutils.Logger(t, "fsync")}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.File(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := p.Dir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removed files should not cause Flush to fail.
+	f, err = os.Create(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.File(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.dirty) != 3 {
+		t.Fatalf("expected 3 pending entries, got %d", len(p.dirty))
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.dirty) != 0 {
+		t.Fatalf("pending entries left after Close: %v", p.dirty)
+	}
+}
+
+func TestPolicy_StartInvalidInterval(t *testing.T) {
+	p := Policy{Mode: Interval}
+	if err := p.Start(); err == nil {
+		t.Fatal("expected error for zero interval")
+	}
+}
+
+func TestPolicy_IntervalRename(t *testing.T) {
+	dir := testutils.Dir(t)
+
+	p := Policy{Mode: Interval, Interval: time.Hour, Log: testutils.Logger(t, "fsync")}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	f, err := os.Create(filepath.Join(dir, "a.new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := p.Rename(f, filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file should be flushed using the final name.
+	if _, ok := p.dirty[filepath.Join(dir, "a")]; !ok || len(p.dirty) != 1 {
+		t.Fatalf("wrong pending entries: %v", p.dirty)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.new")); !os.IsNotExist(err) {
+		t.Fatal("file is not renamed:", err)
+	}
+}
+
+func TestPolicy_Rename(t *testing.T) {
+	for _, mode := range []Mode{Always, Never} {
+		dir := testutils.Dir(t)
+		p := Policy{Mode: mode}
+
+		f, err := os.Create(filepath.Join(dir, "a.new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Rename(f, filepath.Join(dir, "a")); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if _, err := os.Stat(filepath.Join(dir, "a")); err != nil {
+			t.Fatal(mode, "file is not renamed:", err)
+		}
+		if len(p.dirty) != 0 {
+			t.Fatal(mode, "unexpected pending entries:", p.dirty)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package i18n contains translations of human-readable texts sent to
+// remote parties, such as SMTP response messages and DSN explanations.
+//
+// Only the free-form text is translated, SMTP codes, enhanced status codes
+// and machine-readable DSN parts stay the same for all locales.
+package i18n
+
+import (
+	"sort"
+	"text/template"
+)
+
+// Default is the locale used if nothing else is configured. Texts in the
+// code base are written using it so it needs no catalog.
+const Default = "en"
+
+type locale struct {
+	// Translations of SMTP response messages, keyed by the English text.
+	messages map[string]string
+	// Human-readable part of DSN, executed with dsn.TextData.
+	dsnText *template.Template
+	// Human-readable part of DSN reporting the delayed delivery.
+	dsnDelayText *template.Template
+}
+
+var locales = map[string]locale{
+	"de": {
+		messages: map[string]string{
+			"Internal server error":                                   "Interner Serverfehler",
+			"High load, try again later":                              "Hohe Last, bitte später erneut versuchen",
+			"Message rejected due to local policy":                    "Nachricht aufgrund lokaler Richtlinien abgelehnt",
+			"Message rejected due to a local policy":                  "Nachricht aufgrund lokaler Richtlinien abgelehnt",
+			"Internal error during policy check":                      "Interner Fehler bei der Richtlinienprüfung",
+			"DNS error during policy check":                           "DNS-Fehler bei der Richtlinienprüfung",
+			"Unauthorized use of sender address":                      "Unberechtigte Verwendung der Absenderadresse",
+			"Malformed sender address":                                "Ungültige Absenderadresse",
+			"Malformed address":                                       "Ungültige Adresse",
+			"User does not exist":                                     "Benutzer existiert nicht",
+			"Client identity is listed in the used DNSBL":             "Client ist in der verwendeten DNSBL gelistet",
+			"Server is shutting down, try again later":                "Server wird heruntergefahren, bitte später erneut versuchen",
+			"SPF authentication failed":                               "SPF-Authentifizierung fehlgeschlagen",
+			"No passing DKIM signatures":                              "Keine gültigen DKIM-Signaturen",
+			"Temporary authentication failure":                        "Vorübergehender Authentifizierungsfehler",
+			"Timeout while receiving the message, closing connection": "Zeitüberschreitung beim Empfang der Nachricht, Verbindung wird geschlossen",
+		},
+		dsnText: template.Must(template.New("dsn-text-de").Parse(`
+Dies ist das Mailsystem von {{.ReportingMTA}}.
+
+Leider konnte Ihre Nachricht an einen oder mehrere Empfänger nicht
+zugestellt werden. Die häufigste Ursache ist eine ungültige
+Empfängeradresse oder eine Wartung auf der Empfängerseite.
+
+Wenden Sie sich für weitere Hilfe an den Postmaster und geben Sie die
+folgende Nachrichten-ID an:
+
+Nachrichten-ID: {{.XMessageID}}
+Eingang: {{.ArrivalDate}}
+Letzter Zustellversuch: {{.LastAttemptDate}}
+
+{{range .Recipients}}Zustellung an {{.Address}} fehlgeschlagen: {{.Error}}
+{{end}}`)),
+		dsnDelayText: template.Must(template.New("dsn-delay-text-de").Parse(`
+Dies ist das Mailsystem von {{.ReportingMTA}}.
+
+Ihre Nachricht konnte an einen oder mehrere Empfänger noch nicht
+zugestellt werden. Die Zustellung wird erneut versucht, Sie müssen die
+Nachricht nicht erneut senden.
+
+Wenden Sie sich für weitere Hilfe an den Postmaster und geben Sie die
+folgende Nachrichten-ID an:
+
+Nachrichten-ID: {{.XMessageID}}
+Eingang: {{.ArrivalDate}}
+Letzter Zustellversuch: {{.LastAttemptDate}}
+
+{{range .Recipients}}Zustellung an {{.Address}} verzögert: {{.Error}}
+{{end}}`)),
+	},
+	"fr": {
+		messages: map[string]string{
+			"Internal server error":                                   "Erreur interne du serveur",
+			"High load, try again later":                              "Charge élevée, réessayez plus tard",
+			"Message rejected due to local policy":                    "Message rejeté en raison de la politique locale",
+			"Message rejected due to a local policy":                  "Message rejeté en raison de la politique locale",
+			"Internal error during policy check":                      "Erreur interne lors de la vérification de la politique",
+			"DNS error during policy check":                           "Erreur DNS lors de la vérification de la politique",
+			"Unauthorized use of sender address":                      "Utilisation non autorisée de l'adresse d'expéditeur",
+			"Malformed sender address":                                "Adresse d'expéditeur invalide",
+			"Malformed address":                                       "Adresse invalide",
+			"User does not exist":                                     "L'utilisateur n'existe pas",
+			"Client identity is listed in the used DNSBL":             "Le client est listé dans la DNSBL utilisée",
+			"Server is shutting down, try again later":                "Le serveur s'arrête, réessayez plus tard",
+			"SPF authentication failed":                               "Échec de l'authentification SPF",
+			"No passing DKIM signatures":                              "Aucune signature DKIM valide",
+			"Temporary authentication failure":                        "Échec temporaire de l'authentification",
+			"Timeout while receiving the message, closing connection": "Délai dépassé lors de la réception du message, fermeture de la connexion",
+		},
+		dsnText: template.Must(template.New("dsn-text-fr").Parse(`
+Ceci est le système de messagerie de {{.ReportingMTA}}.
+
+Malheureusement, votre message n'a pas pu être remis à un ou plusieurs
+destinataires. La cause habituelle est une adresse de destinataire
+invalide ou une maintenance du côté du destinataire.
+
+Contactez le postmaster pour obtenir de l'aide en indiquant l'identifiant
+du message (ci-dessous) :
+
+Identifiant du message : {{.XMessageID}}
+Arrivée : {{.ArrivalDate}}
+Dernière tentative de remise : {{.LastAttemptDate}}
+
+{{range .Recipients}}La remise à {{.Address}} a échoué avec l'erreur : {{.Error}}
+{{end}}`)),
+		dsnDelayText: template.Must(template.New("dsn-delay-text-fr").Parse(`
+Ceci est le système de messagerie de {{.ReportingMTA}}.
+
+Votre message n'a pas encore pu être remis à un ou plusieurs
+destinataires. La remise sera retentée, vous n'avez pas besoin de
+renvoyer le message.
+
+Contactez le postmaster pour obtenir de l'aide en indiquant l'identifiant
+du message (ci-dessous) :
+
+Identifiant du message : {{.XMessageID}}
+Arrivée : {{.ArrivalDate}}
+Dernière tentative de remise : {{.LastAttemptDate}}
+
+{{range .Recipients}}La remise à {{.Address}} est retardée en raison de l'erreur : {{.Error}}
+{{end}}`)),
+	},
+}
+
+// Locales returns the list of supported locales, including Default.
+func Locales() []string {
+	res := make([]string, 0, len(locales)+1)
+	res = append(res, Default)
+	for name := range locales {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Supported reports whether there is a catalog for the locale.
+func Supported(name string) bool {
+	if name == Default {
+		return true
+	}
+	_, ok := locales[name]
+	return ok
+}
+
+// Message returns the translation of the SMTP response message.
+//
+// msg is returned as is if the locale is not supported or there is no
+// translation for it.
+func Message(name, msg string) string {
+	translated, ok := locales[name].messages[msg]
+	if !ok {
+		return msg
+	}
+	return translated
+}
+
+// DSNText returns the template of the human-readable part of DSN for the
+// locale.
+//
+// nil is returned for the Default locale or if the locale is not
+// supported, the default DSN text should be used then.
+func DSNText(name string) *template.Template {
+	return locales[name].dsnText
+}
+
+// DSNDelayText returns the template of the human-readable part of DSN
+// reporting the delayed delivery for the locale.
+//
+// nil is returned for the Default locale or if the locale is not
+// supported, the default text should be used then.
+func DSNDelayText(name string) *template.Template {
+	return locales[name].dsnDelayText
+}
@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package i18n
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMessage(t *testing.T) {
+	if msg := Message("de", "Internal server error"); msg != "Interner Serverfehler" {
+		t.Error("wrong translation:", msg)
+	}
+	if msg := Message("de", "Not translated"); msg != "Not translated" {
+		t.Error("untranslated message changed:", msg)
+	}
+	if msg := Message("xx", "Internal server error"); msg != "Internal server error" {
+		t.Error("message changed for unknown locale:", msg)
+	}
+	if DSNText(Default) != nil || DSNText("fr") == nil {
+		t.Error("wrong DSN text templates")
+	}
+	if DSNDelayText(Default) != nil || DSNDelayText("de") == nil {
+		t.Error("wrong DSN delay text templates")
+	}
+}
+
+func TestSelector(t *testing.T) {
+	s := Selector{
+		Default: "fr",
+		Domains: testutils.Table{M: map[string]string{
+			"example.de":  "de",
+			"example.org": "xx",
+		}},
+	}
+
+	for addr, locale := range map[string]string{
+		"":                 "fr",
+		"test@example.de":  "de",
+		"test@EXAMPLE.DE":  "de",
+		"test@example.org": "fr",
+		"test@example.com": "fr",
+		"postmaster":       "fr",
+	} {
+		if got := s.Locale(context.Background(), addr); got != locale {
+			t.Errorf("Locale(%q) = %q, want %q", addr, got, locale)
+		}
+	}
+
+	if got := (Selector{}).Locale(context.Background(), "test@example.org"); got != Default {
+		t.Error("wrong locale for empty selector:", got)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package i18n
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Selector picks the locale to use for texts sent to a certain address.
+type Selector struct {
+	// Locale used if there is no domain-specific one.
+	Default string
+	// Optional mapping of domains to locales.
+	Domains module.Table
+}
+
+// Directives registers locale and locale_map configuration directives that
+// fill s.
+func Directives(cfg *config.Map, s *Selector) {
+	cfg.Enum("locale", true, false, Locales(), Default, &s.Default)
+	cfg.Custom("locale_map", false, false, nil, modconfig.TableDirective, &s.Domains)
+}
+
+// Locale returns the locale for the address. addr may be empty, the default
+// locale is returned then.
+func (s Selector) Locale(ctx context.Context, addr string) string {
+	if s.Domains != nil && addr != "" {
+		_, domain, err := address.Split(addr)
+		if err == nil && domain != "" {
+			domain, _ = dns.ForLookup(domain)
+			name, ok, err := s.Domains.Lookup(ctx, domain)
+			if err == nil && ok && Supported(name) {
+				return name
+			}
+		}
+	}
+	if s.Default == "" {
+		return Default
+	}
+	return s.Default
+}
@@ -21,17 +21,22 @@ package command
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 )
@@ -46,6 +51,10 @@ type Check struct {
 
 	cmd     string
 	cmdArgs []string
+
+	timeout    time.Duration
+	failOpen   bool
+	directives bool
 }
 
 func (c *Check) IMAPFilter(accountName string, msgMeta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error) {
@@ -57,8 +66,23 @@ func (c *Check) IMAPFilter(accountName string, msgMeta *module.MsgMetadata, hdr
 	if err != nil {
 		return "", nil, err
 	}
+	defer bR.Close()
 
-	return c.run(cmd, args, io.MultiReader(bytes.NewReader(buf.Bytes()), bR))
+	folder, flags, err = c.run(cmd, args, io.MultiReader(bytes.NewReader(buf.Bytes()), bR))
+	if err != nil {
+		var fatal module.IMAPFilterFatal
+		if c.failOpen || errors.As(err, &fatal) {
+			return "", nil, err
+		}
+		return "", nil, module.IMAPFilterFatal{Err: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 0, 0},
+			Message:      "Internal error during message filtering",
+			Err:          err,
+			ModifierName: modName,
+		}}
+	}
+	return folder, flags, nil
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -91,8 +115,16 @@ func (c *Check) Init(cfg *config.Map) error {
 		return fmt.Errorf("command: %w", err)
 	}
 
-	_, err := cfg.Process()
-	return err
+	var output string
+	cfg.Duration("timeout", false, false, time.Minute, &c.timeout)
+	cfg.Bool("fail_open", false, true, &c.failOpen)
+	cfg.Enum("output", false, false, []string{"lines", "directives"}, "lines", &output)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	c.directives = output == "directives"
+
+	return nil
 }
 
 func (c *Check) expandCommand(msgMeta *module.MsgMetadata, accountName string) (string, []string) {
@@ -149,7 +181,14 @@ func (c *Check) expandCommand(msgMeta *module.MsgMetadata, accountName string) (
 func (c *Check) run(cmdName string, args []string, stdin io.Reader) (string, []string, error) {
 	c.log.Debugln("running", cmdName, args)
 
-	cmd := exec.Command(cmdName, args...)
+	ctx := context.Background()
+	if c.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, cmdName, args...)
 	cmd.Stdin = stdin
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -160,30 +199,37 @@ func (c *Check) run(cmdName string, args []string, stdin io.Reader) (string, []s
 		return "", nil, err
 	}
 
-	scnr := bufio.NewScanner(stdout)
 	var (
 		folder string
 		flags  []string
 	)
-	if scnr.Scan() {
-		folder = scnr.Text()
-	}
-	for scnr.Scan() {
-		flags = append(flags, scnr.Text())
+	scnr := bufio.NewScanner(stdout)
+	if c.directives {
+		folder, flags, err = parseDirectives(scnr)
+	} else {
+		folder, flags = parseLines(scnr)
+		err = scnr.Err()
 	}
-	if err := scnr.Err(); err != nil {
-		return "", nil, err
+	if err != nil {
+		// Unblock the command if it is still writing to stdout.
+		_, _ = io.Copy(ioutil.Discard, stdout)
 	}
 
-	err = cmd.Wait()
-	if err != nil {
-		if _, ok := err.(*exec.ExitError); !ok {
+	waitErr := cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", nil, fmt.Errorf("command: timed out after %v", c.timeout)
+	}
+	if waitErr != nil {
+		if _, ok := waitErr.(*exec.ExitError); !ok {
 			// If that's not ExitError, the process may still be running. We do
 			// not want this.
 			if err := cmd.Process.Signal(os.Interrupt); err != nil {
 				c.log.Error("failed to kill process", err)
 			}
 		}
+		return "", nil, waitErr
+	}
+	if err != nil {
 		return "", nil, err
 	}
 
@@ -192,6 +238,66 @@ func (c *Check) run(cmdName string, args []string, stdin io.Reader) (string, []s
 	return folder, flags, nil
 }
 
+// parseLines parses the command output where the first line is the
+// destination folder and all other lines are additional flags.
+func parseLines(scnr *bufio.Scanner) (string, []string) {
+	var (
+		folder string
+		flags  []string
+	)
+	if scnr.Scan() {
+		folder = scnr.Text()
+	}
+	for scnr.Scan() {
+		flags = append(flags, scnr.Text())
+	}
+	return folder, flags
+}
+
+// parseDirectives parses the command output consisting of the 'mailbox',
+// 'flags' and 'reject' directives, one per line.
+//
+// The 'reject' directive is reported by returning IMAPFilterFatal error.
+func parseDirectives(scnr *bufio.Scanner) (string, []string, error) {
+	var (
+		folder string
+		flags  []string
+	)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" {
+			continue
+		}
+		name, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i != -1 {
+			name, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch name {
+		case "mailbox":
+			if value == "" {
+				return "", nil, errors.New("command: mailbox directive requires an argument")
+			}
+			folder = value
+		case "flags":
+			flags = append(flags, strings.Fields(value)...)
+		case "reject":
+			if value == "" {
+				value = "Message rejected due to local policy"
+			}
+			return "", nil, module.IMAPFilterFatal{Err: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      value,
+				ModifierName: modName,
+			}}
+		default:
+			return "", nil, fmt.Errorf("command: unknown output directive: %s", name)
+		}
+	}
+	return folder, flags, scnr.Err()
+}
+
 func init() {
 	module.Register(modName, New)
 }
@@ -0,0 +1,77 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package command
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestParseDirectives(t *testing.T) {
+	test := func(output, folder string, flags []string, fail bool) {
+		t.Helper()
+
+		f, fl, err := parseDirectives(bufio.NewScanner(strings.NewReader(output)))
+		if fail {
+			if err == nil {
+				t.Errorf("expected error for %q", output)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", output, err)
+			return
+		}
+		if f != folder {
+			t.Errorf("wrong folder for %q: %q", output, f)
+		}
+		if !reflect.DeepEqual(fl, flags) {
+			t.Errorf("wrong flags for %q: %v", output, fl)
+		}
+	}
+
+	test("", "", nil, false)
+	test("mailbox Junk\n", "Junk", nil, false)
+	test("mailbox Lists/maddy dev\n", "Lists/maddy dev", nil, false)
+	test("flags $Label1 \\Flagged\nflags $Label2\n", "", []string{"$Label1", "\\Flagged", "$Label2"}, false)
+	test("\nmailbox A\n\nmailbox B\n", "B", nil, false)
+	test("mailbox\n", "", nil, true)
+	test("folder Junk\n", "", nil, true)
+}
+
+func TestParseDirectives_Reject(t *testing.T) {
+	_, _, err := parseDirectives(bufio.NewScanner(strings.NewReader("flags $A\nreject Go away\nmailbox Junk\n")))
+	var fatal module.IMAPFilterFatal
+	if !errors.As(err, &fatal) {
+		t.Fatalf("expected IMAPFilterFatal, got %v", err)
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(fatal.Err, &smtpErr) {
+		t.Fatalf("expected SMTPError, got %v", fatal.Err)
+	}
+	if smtpErr.Code != 550 || smtpErr.Message != "Go away" {
+		t.Errorf("wrong error: %d %s", smtpErr.Code, smtpErr.Message)
+	}
+}
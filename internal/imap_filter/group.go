@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imap_filter
 
 import (
+	"errors"
+
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
@@ -55,6 +57,10 @@ func (g *Group) IMAPFilter(accountName string, meta *module.MsgMetadata, hdr tex
 	for _, f := range g.Filters {
 		folder, flags, err := f.IMAPFilter(accountName, meta, hdr, body)
 		if err != nil {
+			var fatal module.IMAPFilterFatal
+			if errors.As(err, &fatal) {
+				return "", nil, err
+			}
 			g.log.Error("IMAP filter failed", err)
 			continue
 		}
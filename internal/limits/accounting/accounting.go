@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package accounting implements persistent per-account accounting of sent
+// messages using daily windows.
+//
+// Days are calendar days in the location specified when the store is opened,
+// counters are reset when the first message is accounted after the midnight.
+package accounting
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/jsonfile"
+)
+
+const dayFormat = "2006-01-02"
+
+// Usage is the amount of mail sent by the account during a single day.
+type Usage struct {
+	// Day in YYYY-MM-DD format.
+	Day        string
+	Messages   int
+	Recipients int
+}
+
+// Store keeps Usage values for accounts and saves them to the JSON file on
+// each change.
+type Store struct {
+	path string
+	loc  *time.Location
+
+	lock  sync.Mutex
+	usage map[string]Usage
+}
+
+var (
+	openedStores     = map[string]*Store{}
+	openedStoresLock sync.Mutex
+)
+
+// Open loads the store from the file at path, creating it if it does not
+// exist.
+//
+// Stores are shared for the same path so multiple endpoints can use the
+// same accounting data. Location should be the same for all users of the
+// store, otherwise the location passed to the first call is used.
+func Open(path string, loc *time.Location) (*Store, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	openedStoresLock.Lock()
+	defer openedStoresLock.Unlock()
+
+	if s, ok := openedStores[path]; ok {
+		return s, nil
+	}
+
+	s := &Store{
+		path:  path,
+		loc:   loc,
+		usage: map[string]Usage{},
+	}
+
+	if err := jsonfile.Read(path, &s.usage); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	openedStores[path] = s
+	return s, nil
+}
+
+func (s *Store) day(now time.Time) string {
+	return now.In(s.loc).Format(dayFormat)
+}
+
+// Usage returns the usage of the account for the day containing now.
+func (s *Store) Usage(account string, now time.Time) Usage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	day := s.day(now)
+	u := s.usage[account]
+	if u.Day != day {
+		return Usage{Day: day}
+	}
+	return u
+}
+
+// ErrLimitExceeded is returned by Reserve if the reservation would exceed
+// the limits.
+var ErrLimitExceeded = errors.New("accounting: limit exceeded")
+
+// Reserve checks that the account can send the specified amount of messages
+// and recipients without exceeding maxMessages and maxRecipients and
+// accounts them. Limits that are zero or negative are not checked.
+//
+// The check and the update are done atomically so concurrent transactions
+// of the same account cannot exceed the limits together. The returned Usage
+// includes the reservation. If a limit would be exceeded, the usage is not
+// changed and ErrLimitExceeded is returned along with the current usage.
+//
+// Counters are updated in memory even if saving fails.
+func (s *Store) Reserve(account string, now time.Time, messages, recipients, maxMessages, maxRecipients int) (Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	day := s.day(now)
+	u := s.usage[account]
+	if u.Day != day {
+		u = Usage{Day: day}
+	}
+	if maxMessages > 0 && u.Messages+messages > maxMessages {
+		return u, ErrLimitExceeded
+	}
+	if maxRecipients > 0 && u.Recipients+recipients > maxRecipients {
+		return u, ErrLimitExceeded
+	}
+	u.Messages += messages
+	u.Recipients += recipients
+	s.usage[account] = u
+
+	// Do not keep values for previous days.
+	for acct, u := range s.usage {
+		if u.Day != day {
+			delete(s.usage, acct)
+		}
+	}
+
+	return u, s.save()
+}
+
+// Release returns the messages and recipients reserved using Reserve for the
+// specified day. It does nothing if counters were reset since then.
+func (s *Store) Release(account, day string, messages, recipients int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, ok := s.usage[account]
+	if !ok || u.Day != day {
+		return nil
+	}
+	u.Messages -= messages
+	if u.Messages < 0 {
+		u.Messages = 0
+	}
+	u.Recipients -= recipients
+	if u.Recipients < 0 {
+		u.Recipients = 0
+	}
+	s.usage[account] = u
+
+	return s.save()
+}
+
+func (s *Store) save() error {
+	return jsonfile.Write(s.path, s.usage)
+}
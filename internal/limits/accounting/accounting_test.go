@@ -0,0 +1,174 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package accounting
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, loc *time.Location) (*Store, string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "maddy-accounting-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "usage.json")
+	s, err := Open(path, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, path
+}
+
+func TestStore(t *testing.T) {
+	s, path := testStore(t, time.UTC)
+
+	now := time.Date(2020, 5, 1, 23, 0, 0, 0, time.UTC)
+	if _, err := s.Reserve("test@example.org", now, 1, 5, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve("test@example.org", now.Add(30*time.Minute), 1, 2, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	u := s.Usage("test@example.org", now.Add(59*time.Minute))
+	if u.Messages != 2 || u.Recipients != 7 {
+		t.Fatalf("wrong usage: %+v", u)
+	}
+	if u := s.Usage("other@example.org", now); u.Messages != 0 || u.Recipients != 0 {
+		t.Fatalf("wrong usage for unknown account: %+v", u)
+	}
+
+	// Next day.
+	if u := s.Usage("test@example.org", now.Add(time.Hour)); u.Messages != 0 || u.Recipients != 0 {
+		t.Fatalf("usage is not reset: %+v", u)
+	}
+
+	// Reload from the disk.
+	openedStoresLock.Lock()
+	delete(openedStores, s.path)
+	openedStoresLock.Unlock()
+	s, err := Open(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u = s.Usage("test@example.org", now)
+	if u.Messages != 2 || u.Recipients != 7 {
+		t.Fatalf("wrong usage after reload: %+v", u)
+	}
+}
+
+func TestStore_Location(t *testing.T) {
+	s, _ := testStore(t, time.FixedZone("UTC+3", 3*60*60))
+
+	// 2020-05-01 22:30 UTC is 2020-05-02 01:30 in UTC+3.
+	now := time.Date(2020, 5, 1, 22, 30, 0, 0, time.UTC)
+	if _, err := s.Reserve("test@example.org", now, 1, 1, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := s.Usage("test@example.org", time.Date(2020, 5, 1, 20, 30, 0, 0, time.UTC)); u.Messages != 0 {
+		t.Fatalf("usage is counted for the previous day: %+v", u)
+	}
+	u := s.Usage("test@example.org", time.Date(2020, 5, 2, 20, 59, 0, 0, time.UTC))
+	if u.Messages != 1 || u.Day != "2020-05-02" {
+		t.Fatalf("wrong usage: %+v", u)
+	}
+	if u := s.Usage("test@example.org", time.Date(2020, 5, 2, 21, 0, 0, 0, time.UTC)); u.Messages != 0 {
+		t.Fatalf("usage is not reset at the midnight: %+v", u)
+	}
+}
+
+func TestStore_Reserve(t *testing.T) {
+	s, _ := testStore(t, time.UTC)
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	u, err := s.Reserve("test@example.org", now, 1, 0, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Messages != 1 || u.Day != "2020-05-01" {
+		t.Fatalf("wrong usage: %+v", u)
+	}
+	if _, err := s.Reserve("test@example.org", now, 0, 3, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve("test@example.org", now, 0, 1, 2, 3); err != ErrLimitExceeded {
+		t.Fatal("Expected ErrLimitExceeded for recipients, got", err)
+	}
+	if _, err := s.Reserve("test@example.org", now, 1, 0, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve("test@example.org", now, 1, 0, 2, 3); err != ErrLimitExceeded {
+		t.Fatal("Expected ErrLimitExceeded for messages, got", err)
+	}
+
+	// Failed reservations do not change the usage.
+	if u := s.Usage("test@example.org", now); u.Messages != 2 || u.Recipients != 3 {
+		t.Fatalf("wrong usage: %+v", u)
+	}
+
+	if err := s.Release("test@example.org", "2020-05-01", 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if u := s.Usage("test@example.org", now); u.Messages != 1 || u.Recipients != 1 {
+		t.Fatalf("wrong usage after release: %+v", u)
+	}
+
+	// Release for the previous day is ignored.
+	if err := s.Release("test@example.org", "2020-04-30", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if u := s.Usage("test@example.org", now); u.Messages != 1 || u.Recipients != 1 {
+		t.Fatalf("wrong usage after release for other day: %+v", u)
+	}
+}
+
+func TestStore_ReserveConcurrent(t *testing.T) {
+	s, _ := testStore(t, time.UTC)
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var (
+		wg       sync.WaitGroup
+		reserved int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Reserve("test@example.org", now, 1, 0, 5, 0); err == nil {
+				atomic.AddInt32(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 5 {
+		t.Fatal("Expected 5 successful reservations, got", reserved)
+	}
+}
@@ -95,6 +95,21 @@ func (r Rate) Take() bool {
 	return ok
 }
 
+// TryTake is similar to Take, but returns false immediately instead of
+// blocking if there are no tokens left.
+func (r Rate) TryTake() bool {
+	if cap(r.bucket) == 0 {
+		return true
+	}
+
+	select {
+	case _, ok := <-r.bucket:
+		return ok
+	default:
+		return false
+	}
+}
+
 func (r Rate) TakeContext(ctx context.Context) error {
 	if cap(r.bucket) == 0 {
 		return nil
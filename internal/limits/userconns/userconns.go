@@ -0,0 +1,118 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package userconns tracks the amount of concurrent connections of each
+// authenticated user.
+//
+// The counter is shared by all endpoints so the limit applies to the total
+// amount of connections the user has open, regardless of the protocol.
+package userconns
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+var (
+	connsLck sync.Mutex
+	conns    = make(map[string]int)
+)
+
+// Limit is the per-user connection limit configured for an endpoint.
+type Limit struct {
+	// Max is the default maximum amount of connections for a user.
+	// 0 or negative value means no limit.
+	Max int
+
+	// Table, if set, is used to look up the user-specific limit. The value
+	// should be a single integer.
+	Table module.Table
+}
+
+// Directives adds max_conns_per_user and max_conns_per_user_table
+// directives to the config.Map.
+func Directives(cfg *config.Map, l *Limit) {
+	cfg.Int("max_conns_per_user", false, false, 0, &l.Max)
+	cfg.Custom("max_conns_per_user_table", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &l.Table)
+}
+
+// ForUser returns the maximum amount of connections for the user.
+//
+// If the table lookup fails, the default limit is returned together with
+// the error.
+func (l *Limit) ForUser(ctx context.Context, username string) (int, error) {
+	if l.Table == nil {
+		return l.Max, nil
+	}
+
+	val, ok, err := l.Table.Lookup(ctx, username)
+	if err != nil {
+		return l.Max, err
+	}
+	if !ok {
+		return l.Max, nil
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil {
+		return l.Max, fmt.Errorf("malformed connection limit for %s: %v", username, err)
+	}
+	return max, nil
+}
+
+// Take registers a new connection for the user.
+//
+// It returns false if the user already has max connections open. If max is 0
+// or negative, the connection is always registered.
+func Take(username string, max int) bool {
+	connsLck.Lock()
+	defer connsLck.Unlock()
+
+	if max > 0 && conns[username] >= max {
+		return false
+	}
+	conns[username]++
+	return true
+}
+
+// Release removes the connection registered using Take.
+func Release(username string) {
+	connsLck.Lock()
+	defer connsLck.Unlock()
+
+	conns[username]--
+	if conns[username] <= 0 {
+		delete(conns, username)
+	}
+}
+
+// Count returns the amount of connections the user has open.
+func Count(username string) int {
+	connsLck.Lock()
+	defer connsLck.Unlock()
+
+	return conns[username]
+}
@@ -0,0 +1,79 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package userconns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestTakeRelease(t *testing.T) {
+	const user = "test-take@example.org"
+
+	if !Take(user, 2) || !Take(user, 2) {
+		t.Fatal("Take failed below the limit")
+	}
+	if Take(user, 2) {
+		t.Fatal("Take succeeded above the limit")
+	}
+	if !Take(user, 0) {
+		t.Fatal("Take failed without a limit")
+	}
+	if c := Count(user); c != 3 {
+		t.Fatal("Wrong count:", c)
+	}
+
+	Release(user)
+	Release(user)
+	if !Take(user, 2) {
+		t.Fatal("Take failed after Release")
+	}
+	Release(user)
+	Release(user)
+	if c := Count(user); c != 0 {
+		t.Fatal("Wrong count after releasing all connections:", c)
+	}
+}
+
+func TestLimitForUser(t *testing.T) {
+	l := Limit{
+		Max: 5,
+		Table: testutils.Table{M: map[string]string{
+			"a@example.org": "10",
+			"b@example.org": "x",
+		}},
+	}
+
+	test := func(user string, expected int, expectErr bool) {
+		t.Helper()
+		max, err := l.ForUser(context.Background(), user)
+		if (err != nil) != expectErr {
+			t.Errorf("%s: unexpected error state: %v", user, err)
+		}
+		if max != expected {
+			t.Errorf("%s: wrong limit: %d", user, max)
+		}
+	}
+
+	test("a@example.org", 10, false)
+	test("b@example.org", 5, true)
+	test("c@example.org", 5, false)
+}
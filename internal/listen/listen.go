@@ -0,0 +1,88 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package listen implements creation of endpoint listeners with
+// configurable socket options.
+package listen
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// Options contains socket options applied to listening sockets.
+type Options struct {
+	// ReusePort enables SO_REUSEPORT, allowing multiple processes to bind to
+	// the same address. This makes it possible to start a new server process
+	// before the old one exits.
+	ReusePort bool
+
+	// Freebind enables IP_FREEBIND, allowing to bind to addresses that are
+	// not (yet) configured on the host. Supported only on Linux.
+	Freebind bool
+}
+
+// Directives adds configuration directives for socket options to cfg.
+func Directives(cfg *config.Map, opts *Options) {
+	cfg.Bool("reuse_port", false, false, &opts.ReusePort)
+	cfg.Bool("freebind", false, false, &opts.Freebind)
+}
+
+// Endpoint creates listeners for the endpoint.
+//
+// If the endpoint refers to sockets passed by systemd, all sockets with the
+// matching name are returned. Options are not applied to them, they should be
+// set in the systemd socket unit instead.
+func (opts Options) Endpoint(e config.Endpoint) ([]net.Listener, error) {
+	if e.IsSystemd() {
+		return systemdListeners(e.Host)
+	}
+
+	l, err := opts.Listen(e.Network(), e.Address())
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// Listen is similar to net.Listen but applies socket options from opts.
+//
+// Options are ignored for non-IP networks (e.g. Unix sockets).
+func (opts Options) Listen(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if opts.ReusePort || opts.Freebind {
+		lc.Control = func(network, _ string, c syscall.RawConn) error {
+			if network == "unix" || network == "unixpacket" {
+				return nil
+			}
+
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = opts.apply(network, fd)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(context.Background(), network, address)
+}
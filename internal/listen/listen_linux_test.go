@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package listen
+
+import (
+	"testing"
+)
+
+func TestListen_ReusePort(t *testing.T) {
+	opts := Options{ReusePort: true}
+
+	l1, err := opts.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+
+	l2, err := opts.Listen("tcp", l1.Addr().String())
+	if err != nil {
+		t.Fatal("Second bind failed:", err)
+	}
+	l2.Close()
+
+	l3, err := Options{}.Listen("tcp", l1.Addr().String())
+	if err == nil {
+		l3.Close()
+		t.Fatal("Expected bind without reuse_port to fail")
+	}
+}
+
+func TestListen_Freebind(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation and is not expected to be
+	// configured on the test host.
+	l, err := Options{}.Listen("tcp", "192.0.2.1:0")
+	if err == nil {
+		l.Close()
+		t.Skip("192.0.2.1 is configured on the host")
+	}
+
+	l, err = Options{Freebind: true}.Listen("tcp", "192.0.2.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
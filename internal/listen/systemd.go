@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package listen
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The first file descriptor passed by systemd, see sd_listen_fds(3).
+const sdListenFdsStart = 3
+
+var (
+	sdListenersLck  sync.Mutex
+	sdListenersRead bool
+	// Listeners passed by systemd and not yet used by any endpoint, by
+	// FileDescriptorName.
+	sdListeners map[string][]net.Listener
+)
+
+// readSystemdListeners reads sockets passed by systemd using the
+// LISTEN_FDS protocol.
+//
+// Environment variables are removed so they are not inherited by child
+// processes.
+func readSystemdListeners() (map[string][]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	listeners := make(map[string][]net.Listener, count)
+	for i := 0; i < count; i++ {
+		// Default name used by systemd if FileDescriptorName is not set.
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(sdListenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listen: systemd socket %d (%s): %w", i, name, err)
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
+
+// systemdListeners returns the listeners passed by systemd with the
+// specified FileDescriptorName.
+//
+// Each socket can be used only once, the second call with the same
+// name returns an error.
+func systemdListeners(name string) ([]net.Listener, error) {
+	sdListenersLck.Lock()
+	defer sdListenersLck.Unlock()
+
+	if !sdListenersRead {
+		var err error
+		sdListeners, err = readSystemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		sdListenersRead = true
+	}
+
+	ls := sdListeners[name]
+	if len(ls) == 0 {
+		return nil, fmt.Errorf("listen: no sockets named %s passed by systemd", name)
+	}
+	delete(sdListeners, name)
+	return ls, nil
+}
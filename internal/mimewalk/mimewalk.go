@@ -0,0 +1,136 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mimewalk implements walking of the MIME structure of messages
+// with limits on resources used for processing.
+//
+// It is intended to be used by checks that inspect message contents to
+// make sure pathological messages (deeply nested multiparts, decompression
+// bombs) can't consume excessive amounts of CPU time or memory.
+package mimewalk
+
+import (
+	"errors"
+	"io"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+var (
+	ErrTooDeep      = errors.New("mimewalk: MIME nesting depth limit exceeded")
+	ErrTooManyParts = errors.New("mimewalk: MIME parts count limit exceeded")
+	ErrTooBig       = errors.New("mimewalk: decompressed size limit exceeded")
+)
+
+// IsLimitErr reports whether err indicates that one of limits was exceeded.
+func IsLimitErr(err error) bool {
+	return errors.Is(err, ErrTooDeep) || errors.Is(err, ErrTooManyParts) || errors.Is(err, ErrTooBig)
+}
+
+// Limits restricts resources used to process the message. Zero value
+// means no limit.
+type Limits struct {
+	// Maximum nesting level of multipart entities. Top-level entity has
+	// level 0.
+	MaxDepth int
+	// Maximum amount of MIME parts, including multipart entities.
+	MaxParts int
+	// Maximum total size of data decompressed from all archives found in
+	// the message.
+	MaxDecompressedSize int
+}
+
+// DefaultLimits are the values used if the corresponding configuration
+// directives are not specified.
+var DefaultLimits = Limits{
+	MaxDepth:            20,
+	MaxParts:            1000,
+	MaxDecompressedSize: 100 * 1024 * 1024,
+}
+
+// Directives adds configuration directives for limits to cfg.
+//
+// Directives can be specified globally to apply them to all checks.
+func Directives(cfg *config.Map, l *Limits) {
+	cfg.Int("max_mime_depth", true, false, DefaultLimits.MaxDepth, &l.MaxDepth)
+	cfg.Int("max_parts", true, false, DefaultLimits.MaxParts, &l.MaxParts)
+	cfg.DataSize("max_decompressed_size", true, false, DefaultLimits.MaxDecompressedSize, &l.MaxDecompressedSize)
+}
+
+// Walker tracks resource usage for a single message.
+type Walker struct {
+	Limits Limits
+
+	parts        int
+	decompressed int
+}
+
+// Walk calls fn for each MIME part of the message, including the
+// top-level one and multipart entities, stopping when a limit is exceeded.
+//
+// Errors caused by unknown charsets and transfer encodings are ignored. If
+// fn returns io.EOF, Walk stops and returns nil.
+func (w *Walker) Walk(hdr textproto.Header, body io.Reader, fn func(path []int, part *message.Entity) error) error {
+	ent, err := message.New(message.Header{Header: hdr}, body)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return err
+	}
+
+	err = ent.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return err
+		}
+
+		w.parts++
+		if w.Limits.MaxParts != 0 && w.parts > w.Limits.MaxParts {
+			return ErrTooManyParts
+		}
+		if w.Limits.MaxDepth != 0 && len(path) > w.Limits.MaxDepth {
+			return ErrTooDeep
+		}
+		return fn(path, part)
+	})
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+type decompressedReader struct {
+	w *Walker
+	r io.Reader
+}
+
+func (r decompressedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.w.decompressed += n
+	if r.w.Limits.MaxDecompressedSize != 0 && r.w.decompressed > r.w.Limits.MaxDecompressedSize {
+		return n, ErrTooBig
+	}
+	return n, err
+}
+
+// Decompressed wraps the reader that returns data decompressed from an
+// archive so it is counted against the MaxDecompressedSize limit.
+//
+// ErrTooBig is returned by the reader once the limit is exceeded.
+func (w *Walker) Decompressed(r io.Reader) io.Reader {
+	return decompressedReader{w: w, r: r}
+}
@@ -0,0 +1,96 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mimewalk
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// nestedMsg builds the message with multipart entities nested depth times.
+func nestedMsg(depth int) string {
+	var sb strings.Builder
+	sb.WriteString("Content-Type: multipart/mixed; boundary=b0\r\n\r\n")
+	for i := 1; i <= depth; i++ {
+		sb.WriteString("--b" + strconv.Itoa(i-1) + "\r\n")
+		sb.WriteString("Content-Type: multipart/mixed; boundary=b" + strconv.Itoa(i) + "\r\n\r\n")
+	}
+	sb.WriteString("--b" + strconv.Itoa(depth) + "\r\nContent-Type: text/plain\r\n\r\nhello\r\n")
+	for i := depth; i >= 0; i-- {
+		sb.WriteString("--b" + strconv.Itoa(i) + "--\r\n")
+	}
+	return sb.String()
+}
+
+func walk(t *testing.T, l Limits, msg string) (int, error) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := Walker{Limits: l}
+	parts := 0
+	err = w.Walk(hdr, br, func(_ []int, _ *message.Entity) error {
+		parts++
+		return nil
+	})
+	return parts, err
+}
+
+func TestWalker(t *testing.T) {
+	msg := nestedMsg(5)
+
+	parts, err := walk(t, Limits{}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts != 7 {
+		t.Fatal("Wrong amount of parts:", parts)
+	}
+
+	if _, err := walk(t, Limits{MaxDepth: 6}, msg); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if _, err := walk(t, Limits{MaxDepth: 5}, msg); err != ErrTooDeep {
+		t.Fatal("Expected ErrTooDeep, got", err)
+	}
+	if _, err := walk(t, Limits{MaxParts: 6}, msg); err != ErrTooManyParts {
+		t.Fatal("Expected ErrTooManyParts, got", err)
+	}
+}
+
+func TestWalker_Decompressed(t *testing.T) {
+	w := Walker{Limits: Limits{MaxDecompressedSize: 10}}
+
+	if _, err := io.Copy(ioutil.Discard, w.Decompressed(strings.NewReader("12345"))); err != nil {
+		t.Fatal(err)
+	}
+	_, err := io.Copy(ioutil.Discard, w.Decompressed(strings.NewReader("123456")))
+	if !IsLimitErr(err) {
+		t.Fatal("Expected limit error, got", err)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// traceFields are header fields that are prepended to the message by
+// each server it passes through.
+//
+// Relative order of fields is preserved when they are moved to the top so
+// Authentication-Results stays above the corresponding Received field and
+// DKIM signatures covering multiple instances of a field remain valid.
+var traceFields = map[string]struct{}{
+	"Return-Path":                {},
+	"Received":                   {},
+	"Received-Spf":               {},
+	"Authentication-Results":     {},
+	"Arc-Seal":                   {},
+	"Arc-Message-Signature":      {},
+	"Arc-Authentication-Results": {},
+	"Dkim-Signature":             {},
+}
+
+// cleanHeaders rewrites the message header in a consistently folded form.
+type cleanHeaders struct {
+	instName string
+	log      log.Logger
+
+	relaxed    bool
+	traceFirst bool
+}
+
+func NewCleanHeaders(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("modify.clean_headers: inline arguments are not used")
+	}
+	return &cleanHeaders{
+		instName: instName,
+		log:      log.Logger{Name: "modify.clean_headers"},
+	}, nil
+}
+
+func (m *cleanHeaders) Init(cfg *config.Map) error {
+	var mode string
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Enum("mode", false, false, []string{"simple", "relaxed"}, "relaxed", &mode)
+	cfg.Bool("trace_first", false, true, &m.traceFirst)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	m.relaxed = mode == "relaxed"
+	return nil
+}
+
+func (m *cleanHeaders) Name() string {
+	return "modify.clean_headers"
+}
+
+func (m *cleanHeaders) InstanceName() string {
+	return m.instName
+}
+
+type cleanHeadersState struct {
+	m       *cleanHeaders
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *cleanHeaders) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &cleanHeadersState{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *cleanHeadersState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *cleanHeadersState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+// hasSimpleSignature checks whether the header contains a DKIM signature
+// using the simple header canonicalization. Such signatures are broken by
+// any change in the whitespace.
+func hasSimpleSignature(h textproto.Header) bool {
+	for field := h.FieldsByKey("DKIM-Signature"); field.Next(); {
+		canon := "simple"
+		for _, tag := range strings.Split(field.Value(), ";") {
+			tag = strings.TrimSpace(tag)
+			if strings.HasPrefix(tag, "c=") {
+				canon = strings.TrimSpace(strings.TrimPrefix(tag, "c="))
+				break
+			}
+		}
+		if !strings.HasPrefix(canon, "relaxed") {
+			return true
+		}
+	}
+	return false
+}
+
+type headerField struct {
+	key, value string
+	raw        []byte
+}
+
+// cleanValue returns the value as it should be written. ok is false if the
+// value can't be written without the original folding.
+func (s *cleanHeadersState) cleanValue(value string) (string, bool) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", false
+	}
+	if s.m.relaxed {
+		value = strings.Join(strings.Fields(value), " ")
+	}
+	return value, true
+}
+
+func (s *cleanHeadersState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if hasSimpleSignature(*h) {
+		s.log.Msg("message has a DKIM signature with simple canonicalization, not rewriting header")
+		return nil
+	}
+
+	fields := make([]headerField, 0, h.Len())
+	for field := h.Fields(); field.Next(); {
+		raw, err := field.Raw()
+		if err != nil {
+			return err
+		}
+		fields = append(fields, headerField{key: field.Key(), value: field.Value(), raw: raw})
+	}
+
+	if s.m.traceFirst {
+		trace := make([]headerField, 0, len(fields))
+		other := make([]headerField, 0, len(fields))
+		for _, f := range fields {
+			if _, ok := traceFields[f.key]; ok {
+				trace = append(trace, f)
+			} else {
+				other = append(other, f)
+			}
+		}
+		fields = append(trace, other...)
+	}
+
+	// textproto.Header.Add inserts fields at the top, so we go backwards.
+	cleaned := textproto.Header{}
+	for i := len(fields) - 1; i >= 0; i-- {
+		f := fields[i]
+		value, ok := s.cleanValue(f.value)
+		if !ok {
+			cleaned.AddRaw(f.raw)
+			continue
+		}
+		cleaned.Add(f.key, value)
+	}
+
+	*h = cleaned
+	s.log.DebugMsg("header rewritten", "fields", len(fields))
+	return nil
+}
+
+func (s *cleanHeadersState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.clean_headers", NewCleanHeaders)
+}
@@ -0,0 +1,155 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const messyHeader = "Subject:   Hello,\r\n" +
+	"\t   world  \r\n" +
+	"From: <a@example.org>\r\n" +
+	"Received: from a.example.org by b.example.org; Fri, 11 Jul 2003 21:00:37 -0700\r\n" +
+	"To:\r\n" +
+	" <b@example.org>\r\n" +
+	"Received: from c.example.org by a.example.org; Fri, 11 Jul 2003 20:00:37 -0700\r\n" +
+	"\r\n"
+
+func testCleanHeaders(t *testing.T, cfg []config.Node, header string) string {
+	t.Helper()
+
+	mod, err := NewCleanHeaders("modify.clean_headers", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*cleanHeaders)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	m.log = testutils.Logger(t, "modify.clean_headers")
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(header)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := textproto.WriteHeader(&out, hdr); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestCleanHeaders(t *testing.T) {
+	test := func(cfg []config.Node, expected string) {
+		t.Helper()
+		if out := testCleanHeaders(t, cfg, messyHeader); out != expected {
+			t.Errorf("wrong result:\n%s\nwant:\n%s", out, expected)
+		}
+	}
+
+	test(nil, "Received: from a.example.org by b.example.org; Fri, 11 Jul 2003 21:00:37\r\n -0700\r\n"+
+		"Received: from c.example.org by a.example.org; Fri, 11 Jul 2003 20:00:37\r\n -0700\r\n"+
+		"Subject: Hello, world\r\n"+
+		"From: <a@example.org>\r\n"+
+		"To: <b@example.org>\r\n"+
+		"\r\n")
+	test([]config.Node{
+		{Name: "mode", Args: []string{"simple"}},
+		{Name: "trace_first", Args: []string{"no"}},
+	}, "Subject: Hello, world\r\n"+
+		"From: <a@example.org>\r\n"+
+		"Received: from a.example.org by b.example.org; Fri, 11 Jul 2003 21:00:37\r\n -0700\r\n"+
+		"To: <b@example.org>\r\n"+
+		"Received: from c.example.org by a.example.org; Fri, 11 Jul 2003 20:00:37\r\n -0700\r\n"+
+		"\r\n")
+
+	long := "Subject: " + strings.Repeat("word ", 30) + "\r\n\r\n"
+	for _, line := range strings.Split(testCleanHeaders(t, nil, long), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("line is not folded: %q", line)
+		}
+	}
+
+	// Signatures with simple canonicalization are broken by any change.
+	simple := "DKIM-Signature: v=1; a=ed25519-sha256; d=example.org; s=default;\r\n" +
+		" h=From; bh=AAAA; b=AAAA\r\n" + messyHeader
+	if out := testCleanHeaders(t, nil, simple); out != simple {
+		t.Errorf("header with simple signature modified:\n%s", out)
+	}
+}
+
+func TestCleanHeaders_RelaxedDKIM(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed bytes.Buffer
+	err = dkim.Sign(&signed, strings.NewReader(messyHeader+"Hello!\r\n"), &dkim.SignOptions{
+		Domain:                 "example.org",
+		Selector:               "default",
+		Signer:                 priv,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             []string{"From", "To", "Subject", "Received"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := strings.TrimSuffix(signed.String(), "Hello!\r\n")
+
+	out := testCleanHeaders(t, nil, header)
+
+	verifs, err := dkim.VerifyWithOptions(strings.NewReader(out+"Hello!\r\n"), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifs) != 1 {
+		t.Fatal("Expected exactly one verification, got", len(verifs))
+	}
+	if verifs[0].Err != nil {
+		t.Error("Signature broken:", verifs[0].Err)
+	}
+}
@@ -24,9 +24,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/mail"
 	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -34,6 +36,7 @@ import (
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
@@ -75,6 +78,7 @@ var (
 		"List-Id",
 		"List-Help",
 		"List-Unsubscribe",
+		"List-Unsubscribe-Post",
 		"List-Post",
 		"List-Owner",
 		"List-Archive",
@@ -109,14 +113,22 @@ type Modifier struct {
 	multipleFromOk bool
 	signSubdomains bool
 
+	// Keys for domains from key_table are loaded on first use.
+	keyTable        module.Table
+	keyPathTemplate string
+	newKeyAlgo      string
+	tableSigners    map[string]crypto.Signer
+	tableSignersLck sync.Mutex
+
 	log log.Logger
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	m := &Modifier{
-		instName: instName,
-		signers:  map[string]crypto.Signer{},
-		log:      log.Logger{Name: "modify.dkim"},
+		instName:     instName,
+		signers:      map[string]crypto.Signer{},
+		tableSigners: map[string]crypto.Signer{},
+		log:          log.Logger{Name: "modify.dkim"},
 	}
 
 	if len(inlineArgs) == 0 {
@@ -142,16 +154,17 @@ func (m *Modifier) InstanceName() string {
 
 func (m *Modifier) Init(cfg *config.Map) error {
 	var (
-		hashName        string
-		keyPathTemplate string
-		newKeyAlgo      string
-		senderMatch     []string
+		hashName    string
+		senderMatch []string
 	)
 
 	cfg.Bool("debug", true, false, &m.log.Debug)
 	cfg.StringList("domains", false, false, m.domains, &m.domains)
 	cfg.String("selector", false, false, m.selector, &m.selector)
-	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &m.keyPathTemplate)
+	cfg.Custom("key_table", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &m.keyTable)
 	cfg.StringList("oversign_fields", false, false, oversignDefault, &m.oversignHeader)
 	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
 	cfg.Enum("header_canon", false, false,
@@ -164,9 +177,9 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	cfg.Enum("hash", false, false,
 		[]string{"sha256"}, "sha256", &hashName)
 	cfg.Enum("newkey_algo", false, false,
-		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &m.newKeyAlgo)
 	cfg.EnumList("require_sender_match", false, false,
-		[]string{"envelope", "auth_domain", "auth_user", "off"}, []string{"envelope", "auth"}, &senderMatch)
+		[]string{"envelope", "auth", "auth_domain", "off"}, []string{"envelope", "auth"}, &senderMatch)
 	cfg.Bool("allow_multiple_from", false, false, &m.multipleFromOk)
 	cfg.Bool("sign_subdomains", false, false, &m.signSubdomains)
 
@@ -174,10 +187,10 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		return err
 	}
 
-	if len(m.domains) == 0 {
-		return errors.New("sign_domain: at least one domain is needed")
+	if len(m.domains) == 0 && m.keyTable == nil {
+		return errors.New("sign_domain: at least one domain or key_table is needed")
 	}
-	if m.selector == "" {
+	if len(m.domains) != 0 && m.selector == "" {
 		return errors.New("sign_domain: selector is not specified")
 	}
 	if m.signSubdomains && len(m.domains) > 1 {
@@ -202,24 +215,11 @@ func (m *Modifier) Init(cfg *config.Map) error {
 			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
 		}
 
-		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-		keyPath := keyValues.Replace(keyPathTemplate)
-
-		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
+		signer, err := m.loadKey(domain, m.selector)
 		if err != nil {
 			return err
 		}
 
-		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
-			}
-			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
-		}
-
 		normDomain, err := dns.ForLookup(domain)
 		if err != nil {
 			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
@@ -230,6 +230,86 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	return nil
 }
 
+// loadKey loads the key for the domain and selector using the key_path
+// template. The new key is generated if it does not exist.
+func (m *Modifier) loadKey(domain, selector string) (crypto.Signer, error) {
+	keyValues := strings.NewReplacer("{domain}", domain, "{selector}", selector)
+	keyPath := keyValues.Replace(m.keyPathTemplate)
+
+	signer, newKey, err := m.loadOrGenerateKey(keyPath, m.newKeyAlgo)
+	if err != nil {
+		return nil, err
+	}
+
+	if newKey {
+		dnsPath := keyPath + ".dns"
+		if filepath.Ext(keyPath) == ".key" {
+			dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		}
+		m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+			"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
+			m.newKeyAlgo, keyPath, dnsPath, selector, domain)
+	}
+
+	return signer, nil
+}
+
+// tableKey looks up the signing domain and selector for the domain of the
+// From header field in key_table.
+//
+// ok is false if key_table is not configured, From field is malformed or
+// there is no entry for the domain.
+func (m *Modifier) tableKey(ctx context.Context, h *textproto.Header) (domain, selector string, signer crypto.Signer, ok bool, err error) {
+	if m.keyTable == nil {
+		return "", "", nil, false, nil
+	}
+
+	from, err := mail.ParseAddressList(h.Get("From"))
+	if err != nil || len(from) != 1 {
+		return "", "", nil, false, nil
+	}
+	_, fromDomain, err := address.Split(from[0].Address)
+	if err != nil || fromDomain == "" {
+		return "", "", nil, false, nil
+	}
+	normDomain, err := dns.ForLookup(fromDomain)
+	if err != nil {
+		return "", "", nil, false, nil
+	}
+
+	val, ok, err := m.keyTable.Lookup(ctx, normDomain)
+	if err != nil {
+		return "", "", nil, false, err
+	}
+	if !ok {
+		return "", "", nil, false, nil
+	}
+
+	// Value is either "selector" or "domain selector".
+	parts := strings.Fields(val)
+	switch len(parts) {
+	case 1:
+		domain, selector = normDomain, parts[0]
+	case 2:
+		domain, selector = parts[0], parts[1]
+	default:
+		return "", "", nil, false, fmt.Errorf("modify.dkim: malformed key_table entry for %s: %s", normDomain, val)
+	}
+
+	m.tableSignersLck.Lock()
+	defer m.tableSignersLck.Unlock()
+	signer = m.tableSigners[domain+" "+selector]
+	if signer == nil {
+		signer, err = m.loadKey(domain, selector)
+		if err != nil {
+			return "", "", nil, false, err
+		}
+		m.tableSigners[domain+" "+selector] = signer
+	}
+
+	return domain, selector, signer, true, nil
+}
+
 func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
 	// Filter out duplicated fields from configs so they
 	// will not cause panic() in go-msgauth internals.
@@ -287,22 +367,19 @@ func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
 	return rcptTo, nil
 }
 
-func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
-	defer trace.StartRegion(ctx, "modify.dkim/RewriteBody").End()
-
-	var domain string
+// envelopeKey selects the key from statically configured domains using the
+// envelope sender. nil signer is returned if there is no suitable key.
+func (s *state) envelopeKey() (domain, selector string, keySigner crypto.Signer, err error) {
 	if s.from != "" {
-		var err error
 		_, domain, err = address.Split(s.from)
 		if err != nil {
-			return err
+			return "", "", nil, err
 		}
 	}
 	// Use first key for null return path (<>) and postmaster (<postmaster>)
 	if domain == "" {
 		domain = s.m.domains[0]
 	}
-	selector := s.m.selector
 
 	if s.m.signSubdomains {
 		topDomain := s.m.domains[0]
@@ -313,14 +390,106 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 	normDomain, err := dns.ForLookup(domain)
 	if err != nil {
 		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
-		return nil
+		return "", "", nil, nil
 	}
-	keySigner := s.m.signers[normDomain]
+	keySigner = s.m.signers[normDomain]
 	if keySigner == nil {
 		s.log.Msg("no key for domain", "domain", normDomain)
+		return "", "", nil, nil
+	}
+	return domain, s.m.selector, keySigner, nil
+}
+
+// senderMatches reports whether the From header field matches identifiers
+// configured using require_sender_match. Messages that do not match are not
+// signed since the From domain is controlled by the sender.
+func (s *state) senderMatches(h *textproto.Header) bool {
+	if _, off := s.m.senderMatch["off"]; off {
+		return true
+	}
+	// The message is generated by the server itself (e.g. DSN).
+	if s.meta.Conn == nil {
+		return true
+	}
+
+	from, err := mail.ParseAddressList(h.Get("From"))
+	if err != nil || len(from) == 0 {
+		s.log.Msg("malformed From field, not signing", "from", h.Get("From"))
+		return false
+	}
+	if len(from) > 1 && !s.m.multipleFromOk {
+		s.log.Msg("multiple addresses in From field, not signing")
+		return false
+	}
+	fromAddr, err := address.ForLookup(from[0].Address)
+	if err != nil {
+		s.log.Msg("malformed From field, not signing", "from", from[0].Address)
+		return false
+	}
+	fromUser, fromDomain, err := address.Split(fromAddr)
+	if err != nil {
+		s.log.Msg("malformed From field, not signing", "from", from[0].Address)
+		return false
+	}
+
+	if _, ok := s.m.senderMatch["envelope"]; ok {
+		envFrom, err := address.ForLookup(s.from)
+		if err != nil || envFrom != fromAddr {
+			s.log.Msg("From field does not match envelope sender, not signing", "from", fromAddr, "envelope_from", s.from)
+			return false
+		}
+	}
+
+	// ForLookup returns the case-folded username on error, that is fine
+	// for usernames without a domain.
+	authUser, _ := address.ForLookup(s.meta.Conn.AuthUser)
+	if _, ok := s.m.senderMatch["auth"]; ok {
+		compareWith := fromAddr
+		if !strings.Contains(authUser, "@") {
+			compareWith = fromUser
+		}
+		if authUser == "" || authUser != compareWith {
+			s.log.Msg("From field does not match authorization identity, not signing", "from", fromAddr, "auth_user", s.meta.Conn.AuthUser)
+			return false
+		}
+	}
+	if _, ok := s.m.senderMatch["auth_domain"]; ok {
+		_, authDomain, err := address.Split(authUser)
+		if err != nil || authDomain == "" || authDomain != fromDomain {
+			s.log.Msg("From domain does not match authorization identity, not signing", "from", fromAddr, "auth_user", s.meta.Conn.AuthUser)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.dkim/RewriteBody").End()
+
+	if !s.senderMatches(h) {
 		return nil
 	}
 
+	domain, selector, keySigner, ok, err := s.m.tableKey(ctx, h)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+	}
+	if !ok {
+		if len(s.m.domains) == 0 {
+			s.log.Msg("no key_table entry for From domain, not signing")
+			return nil
+		}
+
+		domain, selector, keySigner, err = s.envelopeKey()
+		if err != nil {
+			return err
+		}
+		if keySigner == nil {
+			return nil
+		}
+	}
+
 	// If the message is non-EAI, we are not allowed to use domains in U-labels,
 	// attempt to convert.
 	if !s.meta.SMTPOpts.UTF8 {
@@ -231,6 +231,30 @@ func TestGenerateSignVerify(t *testing.T) {
 		"ed25519", dkim.CanonicalizationRelaxed, dkim.CanonicalizationRelaxed, false)
 }
 
+func TestKeyTable(t *testing.T) {
+	test := func(domains []string, entries map[string]string, envelopeFrom string, expectDomain []string) {
+		t.Helper()
+
+		dir, err := ioutil.TempDir("", "maddy-tests-dkim-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		m := newTestModifier(t, dir, "ed25519", domains)
+		m.keyTable = testutils.Table{M: entries}
+
+		testHdr, body := signTestMsg(t, m, envelopeFrom)
+		verifyTestMsg(t, dir, expectDomain, testHdr, body)
+	}
+
+	// From domain is "hello".
+	test([]string{"maddy.test"}, map[string]string{"hello": "default"}, "test@maddy.test", []string{"hello"})
+	test([]string{"maddy.test"}, map[string]string{"hello": "parent.test default"}, "test@maddy.test", []string{"parent.test"})
+	// No entry, fallback to envelope-based selection.
+	test([]string{"maddy.test"}, map[string]string{"other": "default"}, "test@maddy.test", []string{"maddy.test"})
+}
+
 func TestFieldsToSign(t *testing.T) {
 	h := textproto.Header{}
 	h.Add("A", "1")
@@ -252,3 +276,98 @@ func TestFieldsToSign(t *testing.T) {
 		t.Errorf("incorrect set of fields to sign\nwant: %v\ngot:  %v", expected, fields)
 	}
 }
+
+func TestOversignedFields(t *testing.T) {
+	test := func(oversign bool) error {
+		t.Helper()
+
+		dir, err := ioutil.TempDir("", "maddy-tests-dkim-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+		if !oversign {
+			m.oversignHeader = nil
+			m.signHeader = []string{"From", "Subject", "To"}
+		}
+		hdr, body := signTestMsg(t, m, "test@maddy.test")
+
+		// Prepend another Subject field. Verifiers select fields from the
+		// bottom so the original signature still covers the original field.
+		hdr.Add("Subject", "injected")
+
+		dnsRecord, err := ioutil.ReadFile(filepath.Join(dir, "maddy.test.dns"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolver := &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"default._domainkey.maddy.test.": {TXT: []string{string(dnsRecord)}},
+		}}
+
+		var fullBody bytes.Buffer
+		if err := textproto.WriteHeader(&fullBody, hdr); err != nil {
+			t.Fatal(err)
+		}
+		fullBody.Write(body)
+
+		verifs, err := dkim.VerifyWithOptions(&fullBody, &dkim.VerifyOptions{
+			LookupTXT: func(domain string) ([]string, error) {
+				return resolver.LookupTXT(context.Background(), domain)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(verifs) != 1 {
+			t.Fatal("Wrong amount of verifications:", len(verifs))
+		}
+		return verifs[0].Err
+	}
+
+	if err := test(false); err != nil {
+		t.Fatal("Unexpected verification error without oversigning:", err)
+	}
+	if err := test(true); err == nil {
+		t.Fatal("Signature is still valid with a duplicate oversigned field")
+	}
+}
+
+func TestSenderMatch(t *testing.T) {
+	test := func(methods []string, from, envelopeFrom string, conn *module.ConnState, ok bool) {
+		t.Helper()
+
+		m := &Modifier{senderMatch: map[string]struct{}{}, log: testutils.Logger(t, "modify.dkim")}
+		for _, method := range methods {
+			m.senderMatch[method] = struct{}{}
+		}
+		s := &state{m: m, meta: &module.MsgMetadata{Conn: conn}, from: envelopeFrom, log: m.log}
+
+		h := textproto.Header{}
+		h.Add("From", from)
+		if res := s.senderMatches(&h); res != ok {
+			t.Errorf("%v, From %s, MAIL FROM %s: expected %v, got %v", methods, from, envelopeFrom, ok, res)
+		}
+	}
+
+	user := &module.ConnState{AuthUser: "user"}
+	email := &module.ConnState{AuthUser: "User@Example.org"}
+	defaults := []string{"envelope", "auth"}
+
+	test([]string{"off"}, "<evil@example.com>", "test@example.org", user, true)
+	test(defaults, "<evil@example.com>", "test@example.org", nil, true)
+
+	test(defaults, "<user@example.org>", "user@example.org", user, true)
+	test(defaults, "<USER@example.org>", "user@EXAMPLE.org", email, true)
+	test(defaults, "<user@example.com>", "user@example.org", user, false)
+	test(defaults, "<user@example.com>", "user@example.com", email, false)
+	test(defaults, "<admin@example.org>", "admin@example.org", user, false)
+	test(defaults, "<user@example.org>", "user@example.org", &module.ConnState{}, false)
+	test(defaults, "<user@example.org>, <user2@example.org>", "user@example.org", user, false)
+	test(defaults, "malformed", "user@example.org", user, false)
+
+	test([]string{"auth_domain"}, "<other@example.org>", "", email, true)
+	test([]string{"auth_domain"}, "<other@example.com>", "", email, false)
+	test([]string{"auth_domain"}, "<other@example.org>", "", user, false)
+}
@@ -0,0 +1,198 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const oneClickValue = "List-Unsubscribe=One-Click"
+
+// listUnsubscribe adds List-Unsubscribe (RFC 2369) and
+// List-Unsubscribe-Post (RFC 8058) header fields to outgoing messages.
+type listUnsubscribe struct {
+	instName string
+	log      log.Logger
+
+	url      string
+	mailto   string
+	oneClick bool
+	replace  bool
+}
+
+func NewListUnsubscribe(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("modify.list_unsubscribe: inline arguments are not used")
+	}
+	return &listUnsubscribe{
+		instName: instName,
+		log:      log.Logger{Name: "modify.list_unsubscribe"},
+	}, nil
+}
+
+func (m *listUnsubscribe) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("url", false, false, "", &m.url)
+	cfg.String("mailto", false, false, "", &m.mailto)
+	cfg.Bool("one_click", false, true, &m.oneClick)
+	cfg.Bool("replace", false, false, &m.replace)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.url == "" && m.mailto == "" {
+		return fmt.Errorf("modify.list_unsubscribe: at least one of url and mailto should be specified")
+	}
+	if m.url != "" && !strings.HasPrefix(m.url, "https://") {
+		return fmt.Errorf("modify.list_unsubscribe: url should use https scheme")
+	}
+	if strings.HasPrefix(m.mailto, "mailto:") {
+		m.mailto = strings.TrimPrefix(m.mailto, "mailto:")
+	}
+	if m.url == "" {
+		// RFC 8058 requires the HTTPS URI to be present.
+		m.oneClick = false
+	}
+
+	return nil
+}
+
+func (m *listUnsubscribe) Name() string {
+	return "modify.list_unsubscribe"
+}
+
+func (m *listUnsubscribe) InstanceName() string {
+	return m.instName
+}
+
+type listUnsubscribeState struct {
+	m       *listUnsubscribe
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	sender string
+	rcpts  []string
+}
+
+func (m *listUnsubscribe) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &listUnsubscribeState{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *listUnsubscribeState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	s.sender = mailFrom
+	return mailFrom, nil
+}
+
+func (s *listUnsubscribeState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	s.rcpts = append(s.rcpts, rcptTo)
+	return rcptTo, nil
+}
+
+// expand replaces placeholders in the template. escape is used to encode
+// substituted values.
+//
+// ok is false if the template refers to the recipient address but the
+// message has more than one recipient.
+func (s *listUnsubscribeState) expand(template string, escape func(string) string) (string, bool) {
+	rcpt := ""
+	if strings.Contains(template, "{rcpt}") {
+		if len(s.rcpts) != 1 {
+			return "", false
+		}
+		rcpt = s.rcpts[0]
+	}
+	return strings.NewReplacer(
+		"{rcpt}", escape(rcpt),
+		"{sender}", escape(s.sender),
+		"{msg_id}", escape(s.msgMeta.ID),
+	).Replace(template), true
+}
+
+// hasHTTPS checks whether the List-Unsubscribe field value contains
+// HTTPS URI.
+func hasHTTPS(value string) bool {
+	for _, uri := range strings.Split(value, ",") {
+		uri = strings.TrimSpace(uri)
+		if strings.HasPrefix(uri, "<https://") && strings.HasSuffix(uri, ">") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *listUnsubscribeState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if h.Has("List-Unsubscribe") && !s.m.replace {
+		// Fields are already provided by the message author, only make sure
+		// one-click unsubscription is advertised if possible.
+		if s.m.oneClick && !h.Has("List-Unsubscribe-Post") && hasHTTPS(h.Get("List-Unsubscribe")) {
+			h.Set("List-Unsubscribe-Post", oneClickValue)
+		}
+		return nil
+	}
+
+	uris := make([]string, 0, 2)
+	if s.m.url != "" {
+		uri, ok := s.expand(s.m.url, url.QueryEscape)
+		if !ok {
+			s.log.Msg("multiple recipients, not adding List-Unsubscribe")
+			return nil
+		}
+		uris = append(uris, "<"+uri+">")
+	}
+	if s.m.mailto != "" {
+		uri, ok := s.expand(s.m.mailto, url.PathEscape)
+		if !ok {
+			s.log.Msg("multiple recipients, not adding List-Unsubscribe")
+			return nil
+		}
+		uris = append(uris, "<mailto:"+uri+">")
+	}
+
+	h.Set("List-Unsubscribe", strings.Join(uris, ", "))
+	if s.m.oneClick {
+		h.Set("List-Unsubscribe-Post", oneClickValue)
+	} else {
+		h.Del("List-Unsubscribe-Post")
+	}
+
+	s.log.DebugMsg("added List-Unsubscribe", "value", h.Get("List-Unsubscribe"))
+	return nil
+}
+
+func (s *listUnsubscribeState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.list_unsubscribe", NewListUnsubscribe)
+}
@@ -0,0 +1,89 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestListUnsubscribe(t *testing.T) {
+	test := func(cfg []config.Node, rcpts []string, existing, expect, expectPost string) {
+		t.Helper()
+
+		mod, err := NewListUnsubscribe("modify.list_unsubscribe", "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mod.(*listUnsubscribe)
+		if err := m.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+		m.log = testutils.Logger(t, "modify.list_unsubscribe")
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.RewriteSender(context.Background(), "news@example.org"); err != nil {
+			t.Fatal(err)
+		}
+		for _, rcpt := range rcpts {
+			if _, err := state.RewriteRcpt(context.Background(), rcpt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hdr := textproto.Header{}
+		if existing != "" {
+			hdr.Add("List-Unsubscribe", existing)
+		}
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := hdr.Get("List-Unsubscribe"); got != expect {
+			t.Errorf("wrong List-Unsubscribe: %q (want %q)", got, expect)
+		}
+		if got := hdr.Get("List-Unsubscribe-Post"); got != expectPost {
+			t.Errorf("wrong List-Unsubscribe-Post: %q (want %q)", got, expectPost)
+		}
+	}
+
+	cfg := []config.Node{
+		{Name: "url", Args: []string{"https://example.org/unsub?r={rcpt}&id={msg_id}"}},
+		{Name: "mailto", Args: []string{"unsub@example.org?subject=unsubscribe"}},
+	}
+	test(cfg, []string{"user+tag@example.com"}, "",
+		"<https://example.org/unsub?r=user%2Btag%40example.com&id=abc>, <mailto:unsub@example.org?subject=unsubscribe>",
+		oneClickValue)
+	test(cfg, []string{"a@example.com", "b@example.com"}, "", "", "")
+	test(cfg, nil, "<https://example.com/u>", "<https://example.com/u>", oneClickValue)
+	test(cfg, nil, "<mailto:u@example.com>", "<mailto:u@example.com>", "")
+
+	cfg = []config.Node{
+		{Name: "mailto", Args: []string{"unsub@example.org"}},
+	}
+	test(cfg, []string{"a@example.com"}, "", "<mailto:unsub@example.org>", "")
+}
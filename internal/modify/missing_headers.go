@@ -0,0 +1,148 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// missingHeaders adds Message-ID and Date header fields if they are not
+// present in the message (RFC 5322, Section 3.6).
+type missingHeaders struct {
+	instName string
+	log      log.Logger
+
+	messageID bool
+	date      bool
+	domain    string
+}
+
+func NewMissingHeaders(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("modify.missing_headers: inline arguments are not used")
+	}
+	return &missingHeaders{
+		instName: instName,
+		log:      log.Logger{Name: "modify.missing_headers"},
+	}, nil
+}
+
+func (m *missingHeaders) Init(cfg *config.Map) error {
+	var hostname string
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Bool("message_id", false, true, &m.messageID)
+	cfg.Bool("date", false, true, &m.date)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.String("message_id_domain", false, false, "", &m.domain)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if m.domain == "" {
+		m.domain = hostname
+	}
+
+	if m.messageID {
+		if m.domain == "" {
+			return fmt.Errorf("modify.missing_headers: message_id_domain is required")
+		}
+		domain, err := dns.ToASCII(m.domain)
+		if err != nil {
+			return fmt.Errorf("modify.missing_headers: invalid message_id_domain: %w", err)
+		}
+		m.domain = domain
+	}
+
+	return nil
+}
+
+func (m *missingHeaders) Name() string {
+	return "modify.missing_headers"
+}
+
+func (m *missingHeaders) InstanceName() string {
+	return m.instName
+}
+
+type missingHeadersState struct {
+	m       *missingHeaders
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *missingHeaders) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &missingHeadersState{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *missingHeadersState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *missingHeadersState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+func (s *missingHeadersState) generateMessageID() (string, error) {
+	rawID := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, rawID); err != nil {
+		return "", err
+	}
+	return "<" + hex.EncodeToString(rawID) + "@" + s.m.domain + ">", nil
+}
+
+func (s *missingHeadersState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if s.m.messageID && !h.Has("Message-Id") {
+		msgID, err := s.generateMessageID()
+		if err != nil {
+			return err
+		}
+		h.Add("Message-Id", msgID)
+		s.log.DebugMsg("added Message-Id", "value", msgID)
+	}
+	if s.m.date && !h.Has("Date") {
+		date := time.Now().Format(time.RFC1123Z)
+		h.Add("Date", date)
+		s.log.DebugMsg("added Date", "value", date)
+	}
+	return nil
+}
+
+func (s *missingHeadersState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.missing_headers", NewMissingHeaders)
+}
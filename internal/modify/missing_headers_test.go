@@ -0,0 +1,97 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMissingHeaders(t *testing.T) {
+	test := func(cfg []config.Node, hdr textproto.Header) textproto.Header {
+		t.Helper()
+
+		mod, err := NewMissingHeaders("modify.missing_headers", "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mod.(*missingHeaders)
+		if err := m.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+		m.log = testutils.Logger(t, "modify.missing_headers")
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+			t.Fatal(err)
+		}
+		return hdr
+	}
+
+	cfg := []config.Node{
+		{Name: "hostname", Args: []string{"mx.example.org"}},
+	}
+
+	hdr := test(cfg, textproto.Header{})
+	msgID := hdr.Get("Message-Id")
+	if !strings.HasPrefix(msgID, "<") || !strings.HasSuffix(msgID, "@mx.example.org>") {
+		t.Errorf("wrong Message-Id: %q", msgID)
+	}
+	if _, err := time.Parse(time.RFC1123Z, hdr.Get("Date")); err != nil {
+		t.Errorf("wrong Date: %q: %v", hdr.Get("Date"), err)
+	}
+
+	existing := textproto.Header{}
+	existing.Add("Message-Id", "<original@example.com>")
+	existing.Add("Date", "Fri, 11 Jul 2003 21:00:37 -0700")
+	hdr = test(cfg, existing)
+	if got := hdr.Values("Message-Id"); len(got) != 1 || got[0] != "<original@example.com>" {
+		t.Errorf("Message-Id modified: %v", got)
+	}
+	if got := hdr.Values("Date"); len(got) != 1 || got[0] != "Fri, 11 Jul 2003 21:00:37 -0700" {
+		t.Errorf("Date modified: %v", got)
+	}
+
+	hdr = test(append(cfg,
+		config.Node{Name: "message_id_domain", Args: []string{"example.com"}},
+		config.Node{Name: "date", Args: []string{"no"}},
+	), textproto.Header{})
+	if msgID := hdr.Get("Message-Id"); !strings.HasSuffix(msgID, "@example.com>") {
+		t.Errorf("wrong Message-Id: %q", msgID)
+	}
+	if hdr.Has("Date") {
+		t.Error("Date added while disabled")
+	}
+
+	hdr = test([]config.Node{{Name: "message_id", Args: []string{"no"}}}, textproto.Header{})
+	if hdr.Has("Message-Id") {
+		t.Error("Message-Id added while disabled")
+	}
+}
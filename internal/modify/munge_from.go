@@ -0,0 +1,215 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// mungeFrom replaces the From header field with the address of the
+// forwarder so the re-signed message passes the DMARC check of the recipient.
+// Original address is preserved in the Reply-To field.
+type mungeFrom struct {
+	instName   string
+	inlineArgs []string
+	log        log.Logger
+
+	address     string
+	domain      string
+	displayName string
+	domains     module.Table
+	dmarcOnly   bool
+
+	resolver dns.Resolver
+}
+
+func NewMungeFrom(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) > 1 {
+		return nil, fmt.Errorf("modify.munge_from: at most one argument is expected")
+	}
+	return &mungeFrom{
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: "modify.munge_from"},
+		resolver:   dns.DefaultResolver(),
+	}, nil
+}
+
+func (m *mungeFrom) Init(cfg *config.Map) error {
+	var defaultAddr string
+	if len(m.inlineArgs) == 1 {
+		defaultAddr = m.inlineArgs[0]
+	}
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("address", false, defaultAddr == "", defaultAddr, &m.address)
+	cfg.String("display_name", false, false, "{name} via {domain}", &m.displayName)
+	cfg.Custom("domains", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &m.domains)
+	cfg.Bool("dmarc_only", false, true, &m.dmarcOnly)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if !address.Valid(m.address) {
+		return fmt.Errorf("modify.munge_from: invalid address: %s", m.address)
+	}
+	_, domain, err := address.Split(m.address)
+	if err != nil || domain == "" {
+		return fmt.Errorf("modify.munge_from: invalid address: %s", m.address)
+	}
+	m.domain = domain
+
+	return nil
+}
+
+func (m *mungeFrom) Name() string {
+	return "modify.munge_from"
+}
+
+func (m *mungeFrom) InstanceName() string {
+	return m.instName
+}
+
+type mungeFromState struct {
+	m   *mungeFrom
+	log log.Logger
+}
+
+func (m *mungeFrom) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return mungeFromState{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s mungeFromState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s mungeFromState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+// shouldMunge checks whether From field with the address within domain should
+// be rewritten.
+func (m *mungeFrom) shouldMunge(ctx context.Context, domain string) (bool, error) {
+	if m.domains != nil {
+		_, ok, err := m.domains.Lookup(ctx, domain)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	if !m.dmarcOnly {
+		return true, nil
+	}
+
+	_, rec, err := dmarc.FetchRecord(ctx, m.resolver, domain)
+	if err != nil {
+		// Better be safe than sorry since message will likely be rejected by
+		// the recipient if its DMARC check fails.
+		m.log.Error("DMARC record lookup failed, rewriting From anyway", err, "domain", domain)
+		return true, nil
+	}
+	return rec != nil && rec.Policy != dmarc.PolicyNone, nil
+}
+
+func (m *mungeFrom) expandName(orig *mail.Address) string {
+	name := orig.Name
+	if name == "" {
+		name = orig.Address
+	}
+	return strings.NewReplacer(
+		"{name}", name,
+		"{address}", orig.Address,
+		"{domain}", m.domain,
+	).Replace(m.displayName)
+}
+
+func (s mungeFromState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	fromHdr := h.Get("From")
+	if fromHdr == "" {
+		return nil
+	}
+	list, err := mail.ParseAddressList(fromHdr)
+	if err != nil || len(list) != 1 {
+		s.log.Msg("malformed From field, not rewriting", "from", fromHdr)
+		return nil
+	}
+	orig := list[0]
+
+	addr, err := address.ForLookup(orig.Address)
+	if err != nil {
+		s.log.Msg("malformed From address, not rewriting", "from", orig.Address)
+		return nil
+	}
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		s.log.Msg("malformed From address, not rewriting", "from", orig.Address)
+		return nil
+	}
+	if strings.EqualFold(domain, s.m.domain) {
+		return nil
+	}
+
+	ok, err := s.m.shouldMunge(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		s.log.DebugMsg("not rewriting From", "from", orig.Address)
+		return nil
+	}
+
+	if !h.Has("Reply-To") {
+		h.Set("Reply-To", orig.String())
+	}
+	munged := mail.Address{Name: s.m.expandName(orig), Address: s.m.address}
+	h.Set("From", munged.String())
+
+	s.log.DebugMsg("rewritten From", "from", orig.Address, "new_from", s.m.address)
+	return nil
+}
+
+func (s mungeFromState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.munge_from", NewMungeFrom)
+}
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMungeFrom(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"_dmarc.strict.example.": {
+			TXT: []string{"v=DMARC1; p=reject"},
+		},
+		"_dmarc.relaxed.example.": {
+			TXT: []string{"v=DMARC1; p=none"},
+		},
+	}
+
+	test := func(cfg []config.Node, domains module.Table, from, replyTo, expectFrom, expectReplyTo string) {
+		t.Helper()
+
+		mod, err := NewMungeFrom("modify.munge_from", "", nil, []string{"forwarder@example.org"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mod.(*mungeFrom)
+		m.resolver = &mockdns.Resolver{Zones: zones}
+		if err := m.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+		m.log = testutils.Logger(t, "modify.munge_from")
+		m.domains = domains
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", from)
+		if replyTo != "" {
+			hdr.Add("Reply-To", replyTo)
+		}
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := hdr.Get("From"); got != expectFrom {
+			t.Errorf("wrong From: %q (want %q)", got, expectFrom)
+		}
+		if got := hdr.Get("Reply-To"); got != expectReplyTo {
+			t.Errorf("wrong Reply-To: %q (want %q)", got, expectReplyTo)
+		}
+	}
+
+	test(nil, nil, `"Joe" <joe@strict.example>`, "",
+		`"Joe via example.org" <forwarder@example.org>`, `"Joe" <joe@strict.example>`)
+	test(nil, nil, `joe@strict.example`, `<list@strict.example>`,
+		`"joe@strict.example via example.org" <forwarder@example.org>`, `<list@strict.example>`)
+	// p=none and no policy => no changes.
+	test(nil, nil, `"Joe" <joe@relaxed.example>`, "", `"Joe" <joe@relaxed.example>`, "")
+	test(nil, nil, `"Joe" <joe@nopolicy.example>`, "", `"Joe" <joe@nopolicy.example>`, "")
+	// Own domain.
+	test(nil, nil, `"Joe" <joe@example.org>`, "", `"Joe" <joe@example.org>`, "")
+
+	test([]config.Node{
+		{Name: "dmarc_only", Args: []string{"no"}},
+		{Name: "display_name", Args: []string{"{address} (forwarded)"}},
+	}, nil, `"Joe" <joe@relaxed.example>`, "",
+		`"joe@relaxed.example (forwarded)" <forwarder@example.org>`, `"Joe" <joe@relaxed.example>`)
+
+	// Table restricts the set of domains.
+	test([]config.Node{
+		{Name: "dmarc_only", Args: []string{"no"}},
+	}, testutils.Table{M: map[string]string{"strict.example": ""}}, `"Joe" <joe@relaxed.example>`, "", `"Joe" <joe@relaxed.example>`, "")
+}
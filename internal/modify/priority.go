@@ -0,0 +1,132 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// priority sets the delivery priority used by the queue for the message.
+//
+// The priority is taken from the configured header field if it is present
+// and contains a valid value, otherwise the default value is used.
+type priority struct {
+	instName string
+	log      log.Logger
+
+	level  int
+	header string
+}
+
+func NewPriority(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &priority{
+		instName: instName,
+		log:      log.Logger{Name: "modify.priority"},
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		level, err := strconv.Atoi(inlineArgs[0])
+		if err != nil {
+			return nil, fmt.Errorf("modify.priority: malformed priority: %v", err)
+		}
+		m.level = level
+	default:
+		return nil, fmt.Errorf("modify.priority: at most one argument is expected")
+	}
+	return m, nil
+}
+
+func (m *priority) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Int("level", false, false, m.level, &m.level)
+	cfg.String("header", false, false, "", &m.header)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if m.level < 0 {
+		return fmt.Errorf("modify.priority: priority should not be negative")
+	}
+	return nil
+}
+
+func (m *priority) Name() string {
+	return "modify.priority"
+}
+
+func (m *priority) InstanceName() string {
+	return m.instName
+}
+
+type priorityState struct {
+	m       *priority
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *priority) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &priorityState{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *priorityState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *priorityState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+func (s *priorityState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	level := s.m.level
+	if s.m.header != "" && h.Has(s.m.header) {
+		value := strings.TrimSpace(h.Get(s.m.header))
+		headerLevel, err := strconv.Atoi(value)
+		if err != nil || headerLevel < 0 {
+			s.log.Msg("malformed priority header field, using default", "value", value)
+		} else {
+			level = headerLevel
+		}
+	}
+
+	s.log.DebugMsg("priority set", "priority", level)
+	s.msgMeta.Priority = level
+	return nil
+}
+
+func (s *priorityState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.priority", NewPriority)
+}
@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestPriority(t *testing.T) {
+	test := func(inlineArgs []string, cfg []config.Node, headerValue string, expect int) {
+		t.Helper()
+
+		mod, err := NewPriority("modify.priority", "", nil, inlineArgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mod.(*priority)
+		if err := m.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+		m.log = testutils.Logger(t, "modify.priority")
+
+		msgMeta := &module.MsgMetadata{ID: "abc"}
+		state, err := m.ModStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		if headerValue != "" {
+			hdr.Add("X-Priority-Level", headerValue)
+		}
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+			t.Fatal(err)
+		}
+		if msgMeta.Priority != expect {
+			t.Errorf("wrong priority: %d, expected %d", msgMeta.Priority, expect)
+		}
+	}
+
+	headerCfg := []config.Node{{Name: "header", Args: []string{"X-Priority-Level"}}}
+
+	test(nil, nil, "", 0)
+	test([]string{"2"}, nil, "", 2)
+	test([]string{"2"}, nil, "5", 2)
+	test([]string{"1"}, headerCfg, "", 1)
+	test([]string{"1"}, headerCfg, "3", 3)
+	test([]string{"1"}, headerCfg, " 0 ", 0)
+	test([]string{"1"}, headerCfg, "high", 1)
+	test([]string{"1"}, headerCfg, "-1", 1)
+}
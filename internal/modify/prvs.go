@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/prvs"
+)
+
+// prvsMod implements BATV signing using the PRVS scheme.
+//
+// If created with modName = "modify.prvs", it adds the tag to the sender
+// address. If created with modName = "modify.prvs_reverse", it removes valid
+// tags from recipient addresses.
+type prvsMod struct {
+	modName  string
+	instName string
+
+	reverse bool
+	signer  *prvs.Signer
+}
+
+func NewPRVS(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &prvsMod{
+		modName:  modName,
+		instName: instName,
+		reverse:  modName == "modify.prvs_reverse",
+	}, nil
+}
+
+func (m *prvsMod) Init(cfg *config.Map) error {
+	var (
+		keys    []string
+		signKey int
+		maxAge  time.Duration
+	)
+	cfg.StringList("secret", false, true, nil, &keys)
+	cfg.Int("sign_key", false, false, 0, &signKey)
+	cfg.Duration("max_age", false, false, 7*24*time.Hour, &maxAge)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	m.signer, err = prvs.New(keys, signKey, maxAge)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.modName, err)
+	}
+	return nil
+}
+
+func (m *prvsMod) Name() string {
+	return m.modName
+}
+
+func (m *prvsMod) InstanceName() string {
+	return m.instName
+}
+
+func (m *prvsMod) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return m, nil
+}
+
+func (m *prvsMod) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if m.reverse || mailFrom == "" {
+		return mailFrom, nil
+	}
+	return m.signer.Sign(mailFrom)
+}
+
+func (m *prvsMod) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	if !m.reverse {
+		return rcptTo, nil
+	}
+	orig, tagged, err := m.signer.Verify(rcptTo)
+	if !tagged || err != nil {
+		// Invalid tags are rejected by check.prvs, if it is used.
+		return rcptTo, nil
+	}
+	return orig, nil
+}
+
+func (m *prvsMod) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (m *prvsMod) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.prvs", NewPRVS)
+	module.Register("modify.prvs_reverse", NewPRVS)
+}
@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestPRVS(t *testing.T) {
+	newMod := func(modName string) *prvsMod {
+		t.Helper()
+		mod, err := NewPRVS(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mod.(*prvsMod)
+		if err := m.Init(config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "secret", Args: []string{"secret"}},
+			},
+		})); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	sign := newMod("modify.prvs")
+	rev := newMod("modify.prvs_reverse")
+
+	tagged, err := sign.RewriteSender(context.Background(), "test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tagged, "prvs=") {
+		t.Fatal("Address is not tagged:", tagged)
+	}
+	if null, _ := sign.RewriteSender(context.Background(), ""); null != "" {
+		t.Fatal("Null sender is tagged:", null)
+	}
+	if rcpt, _ := sign.RewriteRcpt(context.Background(), tagged); rcpt != tagged {
+		t.Fatal("Recipient is changed by modify.prvs:", rcpt)
+	}
+
+	if orig, _ := rev.RewriteRcpt(context.Background(), tagged); orig != "test@example.org" {
+		t.Fatal("Tag is not removed:", orig)
+	}
+	const forged = "prvs=0000000000=test@example.org"
+	if orig, _ := rev.RewriteRcpt(context.Background(), forged); orig != forged {
+		t.Fatal("Invalid tag is removed:", orig)
+	}
+	if sender, _ := rev.RewriteSender(context.Background(), "test@example.org"); sender != "test@example.org" {
+		t.Fatal("Sender is changed by modify.prvs_reverse:", sender)
+	}
+}
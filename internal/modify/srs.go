@@ -0,0 +1,292 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	srsHashLen = 4
+	// Timestamp is the amount of days since the epoch encoded using
+	// 2 base32 characters.
+	srsTimePrecision = 24 * time.Hour
+	srsTimeSlots     = 1024
+	srsBase32        = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+)
+
+// srs implements the Sender Rewriting Scheme as described in
+// https://www.libsrs2.org/srs/srs.pdf.
+//
+// If created with modName = "modify.srs", it rewrites the sender address into
+// SRS0 or SRS1 form. If created with modName = "modify.srs_reverse", it
+// decodes SRS recipient addresses (bounces) back to the original address.
+type srs struct {
+	modName    string
+	instName   string
+	inlineArgs []string
+
+	reverse bool
+	domain  string
+	secrets [][]byte
+	hashNew func() hash.Hash
+	maxAge  time.Duration
+
+	now func() time.Time
+}
+
+func NewSRS(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) > 1 {
+		return nil, fmt.Errorf("%s: at most one argument is expected", modName)
+	}
+	return &srs{
+		modName:    modName,
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		reverse:    modName == "modify.srs_reverse",
+		now:        time.Now,
+	}, nil
+}
+
+func (s *srs) Init(cfg *config.Map) error {
+	var (
+		defaultDomain string
+		secrets       []string
+		hashName      string
+	)
+	if len(s.inlineArgs) == 1 {
+		defaultDomain = s.inlineArgs[0]
+	}
+
+	cfg.String("domain", false, defaultDomain == "", defaultDomain, &s.domain)
+	cfg.StringList("secret", false, true, nil, &secrets)
+	cfg.Enum("hash", false, false, []string{"sha1", "sha256"}, "sha1", &hashName)
+	cfg.Duration("max_age", false, false, 21*srsTimePrecision, &s.maxAge)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	s.domain, err = dns.ForLookup(s.domain)
+	if err != nil {
+		return fmt.Errorf("%s: invalid domain: %v", s.modName, err)
+	}
+	for _, secret := range secrets {
+		s.secrets = append(s.secrets, []byte(secret))
+	}
+	switch hashName {
+	case "sha1":
+		s.hashNew = sha1.New
+	case "sha256":
+		s.hashNew = sha256.New
+	}
+	if s.maxAge < srsTimePrecision {
+		return fmt.Errorf("%s: max_age should be at least one day", s.modName)
+	}
+	if s.maxAge >= srsTimeSlots*srsTimePrecision {
+		return fmt.Errorf("%s: max_age is too big", s.modName)
+	}
+
+	return nil
+}
+
+func (s *srs) Name() string {
+	return s.modName
+}
+
+func (s *srs) InstanceName() string {
+	return s.instName
+}
+
+func (s *srs) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return s, nil
+}
+
+func (s *srs) hash(secret []byte, parts ...string) string {
+	mac := hmac.New(s.hashNew, secret)
+	for _, part := range parts {
+		mac.Write([]byte(strings.ToLower(part)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:srsHashLen]
+}
+
+func (s *srs) checkHash(hash string, parts ...string) bool {
+	for _, secret := range s.secrets {
+		if hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(s.hash(secret, parts...)))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *srs) timestamp() string {
+	slot := int(s.now().Unix()/int64(srsTimePrecision/time.Second)) % srsTimeSlots
+	return string([]byte{srsBase32[slot>>5], srsBase32[slot&31]})
+}
+
+func (s *srs) checkTimestamp(ts string) bool {
+	if len(ts) != 2 {
+		return false
+	}
+	ts = strings.ToUpper(ts)
+	hi, lo := strings.IndexByte(srsBase32, ts[0]), strings.IndexByte(srsBase32, ts[1])
+	if hi == -1 || lo == -1 {
+		return false
+	}
+	slot := hi<<5 | lo
+
+	now := int(s.now().Unix()/int64(srsTimePrecision/time.Second)) % srsTimeSlots
+	age := (now - slot + srsTimeSlots) % srsTimeSlots
+	return time.Duration(age)*srsTimePrecision <= s.maxAge
+}
+
+// forward returns the SRS form of the address.
+func (s *srs) forward(addr string) (string, error) {
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return "", err
+	}
+	if domain == "" {
+		// postmaster
+		return addr, nil
+	}
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return "", err
+	}
+	if normDomain == s.domain {
+		return addr, nil
+	}
+
+	switch {
+	case hasPrefixFold(mbox, "SRS0="):
+		// Address rewritten by the previous forwarder, make it point to it
+		// and not to ourselves.
+		user := mbox[4:]
+		return "SRS1=" + s.hash(s.secrets[0], domain, user) + "=" + domain + "=" + user + "@" + s.domain, nil
+	case hasPrefixFold(mbox, "SRS1="):
+		// Already SRS1, just rewrite the signature so we can validate it on
+		// bounce.
+		parts := strings.SplitN(mbox[5:], "=", 3)
+		if len(parts) == 3 {
+			host, user := parts[1], parts[2]
+			return "SRS1=" + s.hash(s.secrets[0], host, user) + "=" + host + "=" + user + "@" + s.domain, nil
+		}
+	}
+
+	ts := s.timestamp()
+	return "SRS0=" + s.hash(s.secrets[0], ts, domain, mbox) + "=" + ts + "=" + domain + "=" + mbox + "@" + s.domain, nil
+}
+
+// reversePath decodes the SRS address. Addresses that are not in SRS form are
+// returned as is.
+func (s *srs) reversePath(addr string) (string, error) {
+	mbox, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return addr, nil
+	}
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil || normDomain != s.domain {
+		return addr, nil
+	}
+
+	switch {
+	case hasPrefixFold(mbox, "SRS0="):
+		parts := strings.SplitN(mbox[5:], "=", 4)
+		if len(parts) != 4 {
+			return "", errInvalidSRS("Malformed SRS address")
+		}
+		hash, ts, origDomain, origMbox := parts[0], parts[1], parts[2], parts[3]
+		if !s.checkHash(hash, ts, origDomain, origMbox) {
+			return "", errInvalidSRS("Invalid SRS signature")
+		}
+		if !s.checkTimestamp(ts) {
+			return "", errInvalidSRS("SRS address is expired")
+		}
+		return origMbox + "@" + origDomain, nil
+	case hasPrefixFold(mbox, "SRS1="):
+		parts := strings.SplitN(mbox[5:], "=", 3)
+		if len(parts) != 3 {
+			return "", errInvalidSRS("Malformed SRS address")
+		}
+		hash, host, user := parts[0], parts[1], parts[2]
+		if !s.checkHash(hash, host, user) {
+			return "", errInvalidSRS("Invalid SRS signature")
+		}
+		return "SRS0" + user + "@" + host, nil
+	}
+
+	return addr, nil
+}
+
+func errInvalidSRS(msg string) error {
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+		Message:      msg,
+		CheckName:    "modify.srs",
+	}
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+func (s *srs) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if s.reverse || mailFrom == "" {
+		return mailFrom, nil
+	}
+	return s.forward(mailFrom)
+}
+
+func (s *srs) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	if !s.reverse {
+		return rcptTo, nil
+	}
+	return s.reversePath(rcptTo)
+}
+
+func (s *srs) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s *srs) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.srs", NewSRS)
+	module.Register("modify.srs_reverse", NewSRS)
+}
@@ -0,0 +1,178 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func testSRS(t *testing.T, modName, domain string, now time.Time, secrets ...string) *srs {
+	t.Helper()
+
+	mod, err := NewSRS(modName, "", nil, []string{domain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := mod.(*srs)
+	if err := s.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "secret", Args: secrets},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestSRS(t *testing.T) {
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	fwd := testSRS(t, "modify.srs", "forward.example.org", now, "secret")
+	rev := testSRS(t, "modify.srs_reverse", "forward.example.org", now, "secret")
+
+	rewritten, err := fwd.RewriteSender(context.Background(), "Joe@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("SRS0:", rewritten)
+	if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "=example.com=Joe@forward.example.org") {
+		t.Fatal("Unexpected SRS0 address:", rewritten)
+	}
+
+	orig, err := rev.RewriteRcpt(context.Background(), rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "Joe@example.com" {
+		t.Fatal("Wrong reverse path:", orig)
+	}
+	// Reverse path is case-insensitive.
+	orig, err = rev.RewriteRcpt(context.Background(), strings.ToLower(rewritten))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "joe@example.com" {
+		t.Fatal("Wrong reverse path:", orig)
+	}
+
+	// Forwarder is a no-op for null sender and own addresses.
+	for _, addr := range []string{"", "test@forward.example.org", "postmaster"} {
+		res, err := fwd.RewriteSender(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != addr {
+			t.Errorf("Address %q is rewritten to %q", addr, res)
+		}
+	}
+
+	// Unrelated recipients are not touched.
+	for _, addr := range []string{"SRS0=AAAA=AA=example.com=joe@other.example.org", "test@forward.example.org"} {
+		res, err := rev.RewriteRcpt(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != addr {
+			t.Errorf("Address %q is rewritten to %q", addr, res)
+		}
+	}
+
+	// Forged signature.
+	forged := strings.Replace(rewritten, "=example.com=Joe@", "=example.com=Jane@", 1)
+	if _, err := rev.RewriteRcpt(context.Background(), forged); err == nil {
+		t.Error("Forged SRS address is accepted")
+	}
+	// Different secret.
+	other := testSRS(t, "modify.srs_reverse", "forward.example.org", now, "other")
+	if _, err := other.RewriteRcpt(context.Background(), rewritten); err == nil {
+		t.Error("SRS address signed with different secret is accepted")
+	}
+	// Secret rotation.
+	rotated := testSRS(t, "modify.srs_reverse", "forward.example.org", now, "new", "secret")
+	if _, err := rotated.RewriteRcpt(context.Background(), rewritten); err != nil {
+		t.Error("SRS address signed with old secret is rejected:", err)
+	}
+	// Expired address.
+	late := testSRS(t, "modify.srs_reverse", "forward.example.org", now.Add(30*24*time.Hour), "secret")
+	if _, err := late.RewriteRcpt(context.Background(), rewritten); err == nil {
+		t.Error("Expired SRS address is accepted")
+	}
+	if _, err := rev.RewriteRcpt(context.Background(), "SRS0=garbage@forward.example.org"); err == nil {
+		t.Error("Malformed SRS address is accepted")
+	}
+}
+
+func TestSRS_Chain(t *testing.T) {
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	fwd1 := testSRS(t, "modify.srs", "first.example.org", now, "secret1")
+	rev1 := testSRS(t, "modify.srs_reverse", "first.example.org", now, "secret1")
+	fwd2 := testSRS(t, "modify.srs", "second.example.org", now, "secret2")
+	rev2 := testSRS(t, "modify.srs_reverse", "second.example.org", now, "secret2")
+	fwd3 := testSRS(t, "modify.srs", "third.example.org", now, "secret3")
+	rev3 := testSRS(t, "modify.srs_reverse", "third.example.org", now, "secret3")
+
+	srs0, err := fwd1.RewriteSender(context.Background(), "joe@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs1, err := fwd2.RewriteSender(context.Background(), srs0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("SRS1:", srs1)
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=first.example.org==") {
+		t.Fatal("Unexpected SRS1 address:", srs1)
+	}
+	srs1Again, err := fwd3.RewriteSender(context.Background(), srs1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("SRS1 (third hop):", srs1Again)
+	if !strings.HasPrefix(srs1Again, "SRS1=") || !strings.Contains(srs1Again, "=first.example.org==") {
+		t.Fatal("Unexpected SRS1 address:", srs1Again)
+	}
+
+	// Third forwarder bounces directly to the first one.
+	back, err := rev3.RewriteRcpt(context.Background(), srs1Again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back != srs0 {
+		t.Fatalf("Wrong reverse path: %s (want %s)", back, srs0)
+	}
+	back, err = rev2.RewriteRcpt(context.Background(), srs1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back != srs0 {
+		t.Fatalf("Wrong reverse path: %s (want %s)", back, srs0)
+	}
+	orig, err := rev1.RewriteRcpt(context.Background(), back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "joe@example.com" {
+		t.Fatal("Wrong reverse path:", orig)
+	}
+}
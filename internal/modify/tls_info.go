@@ -0,0 +1,170 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// tlsInfo records TLS parameters of the connection the message was
+// received over in a header field.
+type tlsInfo struct {
+	instName string
+	log      log.Logger
+
+	header   string
+	template string
+	noTLS    string
+}
+
+func NewTLSInfo(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &tlsInfo{
+		instName: instName,
+		log:      log.Logger{Name: "modify.tls_info"},
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		m.header = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("modify.tls_info: at most one argument is expected")
+	}
+	return m, nil
+}
+
+func (m *tlsInfo) Init(cfg *config.Map) error {
+	defaultHeader := m.header
+	if defaultHeader == "" {
+		defaultHeader = "X-Inbound-TLS"
+	}
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("header", false, false, defaultHeader, &m.header)
+	cfg.String("format", false, false, "{version} with cipher {cipher}", &m.template)
+	cfg.String("no_tls", false, false, "none", &m.noTLS)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.header == "" {
+		return fmt.Errorf("modify.tls_info: header can't be empty")
+	}
+	return nil
+}
+
+func (m *tlsInfo) Name() string {
+	return "modify.tls_info"
+}
+
+func (m *tlsInfo) InstanceName() string {
+	return m.instName
+}
+
+type tlsInfoState struct {
+	m       *tlsInfo
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *tlsInfo) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &tlsInfoState{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *tlsInfoState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *tlsInfoState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// formatTLSInfo expands the template using the connection state.
+func formatTLSInfo(template string, state *tls.ConnectionState) string {
+	clientCert := "none"
+	if len(state.PeerCertificates) != 0 {
+		clientCert = state.PeerCertificates[0].Subject.String()
+	}
+	sni := state.ServerName
+	if sni == "" {
+		sni = "none"
+	}
+
+	return strings.NewReplacer(
+		"{version}", tlsVersionName(state.Version),
+		"{cipher}", tls.CipherSuiteName(state.CipherSuite),
+		"{sni}", sni,
+		"{client_cert}", clientCert,
+	).Replace(template)
+}
+
+func (s *tlsInfoState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if s.msgMeta.Conn == nil {
+		// Generated locally.
+		return nil
+	}
+
+	// Fields with the same name might be added by the sender to
+	// impersonate a secure connection.
+	h.Del(s.m.header)
+
+	value := s.m.noTLS
+	if s.msgMeta.Conn.TLS.HandshakeComplete {
+		value = formatTLSInfo(s.m.template, &s.msgMeta.Conn.TLS)
+	}
+	value = strings.Replace(target.SanitizeForHeader(value), "\r", "", -1)
+
+	h.Add(s.m.header, value)
+	s.log.DebugMsg("added TLS information", "value", value)
+	return nil
+}
+
+func (s *tlsInfoState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.tls_info", NewTLSInfo)
+}
@@ -0,0 +1,91 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestTLSInfo(t *testing.T) {
+	test := func(cfg []config.Node, conn *module.ConnState, expect string) {
+		t.Helper()
+
+		mod, err := NewTLSInfo("modify.tls_info", "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mod.(*tlsInfo)
+		if err := m.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+			t.Fatal(err)
+		}
+		m.log = testutils.Logger(t, "modify.tls_info")
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "abc", Conn: conn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("X-Inbound-TLS", "forged")
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+			t.Fatal(err)
+		}
+
+		values := hdr.Values("X-Inbound-TLS")
+		if expect == "" {
+			if len(values) != 1 || values[0] != "forged" {
+				t.Errorf("header modified: %v", values)
+			}
+			return
+		}
+		if len(values) != 1 || values[0] != expect {
+			t.Errorf("wrong header values: %q (want %q)", values, expect)
+		}
+	}
+
+	tlsConn := &module.ConnState{}
+	tlsConn.TLS = tls.ConnectionState{
+		HandshakeComplete: true,
+		Version:           tls.VersionTLS13,
+		CipherSuite:       tls.TLS_AES_128_GCM_SHA256,
+		ServerName:        "mx.example.org",
+		PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: "client.example.org"}},
+		},
+	}
+
+	test(nil, nil, "")
+	test(nil, &module.ConnState{}, "none")
+	test(nil, tlsConn, "TLSv1.3 with cipher TLS_AES_128_GCM_SHA256")
+	test([]config.Node{
+		{Name: "format", Args: []string{"{version}; sni={sni}; cert={client_cert}"}},
+	}, tlsConn, "TLSv1.3; sni=mx.example.org; cert=CN=client.example.org")
+	test([]config.Node{
+		{Name: "no_tls", Args: []string{"plaintext"}},
+	}, &module.ConnState{}, "plaintext")
+}
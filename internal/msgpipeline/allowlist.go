@@ -0,0 +1,101 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"net"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netset"
+)
+
+// allowlist contains the conditions that make the pipeline skip all checks
+// for the message.
+type allowlist struct {
+	nets          *netset.Set
+	senderDomains module.Table
+	authUsers     module.Table
+}
+
+func parseAllowlist(globals map[string]interface{}, node config.Node) (*allowlist, error) {
+	a := &allowlist{}
+
+	cfg := config.NewMap(globals, node)
+	cfg.Custom("ip", false, false, nil, netset.Directive, &a.nets)
+	cfg.Custom("sender_domain", false, false, nil, modconfig.TableDirective, &a.senderDomains)
+	cfg.Custom("auth_user", false, false, nil, modconfig.TableDirective, &a.authUsers)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if a.nets.Len() == 0 && a.senderDomains == nil && a.authUsers == nil {
+		return nil, config.NodeErr(node, "at least one allowlist condition is required")
+	}
+	return a, nil
+}
+
+// matchIP reports whether the client IP is in the allowlist.
+func (a *allowlist) matchIP(addr net.Addr) bool {
+	return a.nets.ContainsAddr(addr)
+}
+
+// match reports whether the message matches any of allowlist conditions.
+// The returned string describes the matched condition.
+//
+// Lookup errors are logged and the corresponding condition is considered
+// not matched.
+func (a *allowlist) match(ctx context.Context, l log.Logger, msgMeta *module.MsgMetadata, mailFrom string) (bool, string) {
+	if msgMeta.Conn != nil && a.matchIP(msgMeta.Conn.RemoteAddr) {
+		return true, "ip"
+	}
+
+	if a.authUsers != nil && msgMeta.Conn != nil && msgMeta.Conn.AuthUser != "" {
+		_, ok, err := a.authUsers.Lookup(ctx, msgMeta.Conn.AuthUser)
+		if err != nil {
+			l.Error("allowlist auth_user lookup failed", err, "key", msgMeta.Conn.AuthUser)
+		} else if ok {
+			return true, "auth_user"
+		}
+	}
+
+	if a.senderDomains != nil && mailFrom != "" {
+		_, domain, err := address.Split(mailFrom)
+		if err != nil || domain == "" {
+			return false, ""
+		}
+		domain, err = dns.ForLookup(domain)
+		if err != nil {
+			return false, ""
+		}
+		_, ok, err := a.senderDomains.Lookup(ctx, domain)
+		if err != nil {
+			l.Error("allowlist sender_domain lookup failed", err, "key", domain)
+		} else if ok {
+			return true, "sender_domain"
+		}
+	}
+
+	return false, ""
+}
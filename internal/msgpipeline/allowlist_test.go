@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netset"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_Allowlist(t *testing.T) {
+	test := func(remoteIP, authUser, mailFrom string, allowlisted bool) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		check := testutils.Check{
+			SenderRes: module.CheckResult{
+				Reject: true,
+				Reason: exterrors.WithTemporary(errors.New("rejected"), false),
+			},
+		}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{&check},
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+				doDMARC: true,
+				allowlist: &allowlist{
+					nets:          netset.Networks(net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}),
+					senderDomains: testutils.Table{M: map[string]string{"trusted.example.org": ""}},
+					authUsers:     testutils.Table{M: map[string]string{"trusted-user": ""}},
+				},
+			},
+			Log: testutils.Logger(t, "msgpipeline"),
+		}
+
+		_, err := testutils.DoTestDeliveryErrMeta(t, &d, mailFrom, []string{"rcpt@example.com"}, &module.MsgMetadata{
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: &net.TCPAddr{IP: net.ParseIP(remoteIP), Port: 25},
+				},
+				AuthUser: authUser,
+			},
+		})
+		if allowlisted {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if check.SenderCalls != 0 || check.BodyCalls != 0 {
+				t.Fatal("checks were executed for the allowlisted message")
+			}
+			if !tgt.Messages[0].MsgMeta.Allowlisted {
+				t.Fatal("Allowlisted flag is not set")
+			}
+		} else if err == nil {
+			t.Fatal("expected the message to be rejected")
+		}
+	}
+
+	test("10.1.2.3", "", "sender@example.org", true)
+	test("192.0.2.1", "trusted-user", "sender@example.org", true)
+	test("192.0.2.1", "", "sender@Trusted.Example.org", true)
+	test("192.0.2.1", "other-user", "sender@example.org", false)
+	test("192.0.2.1", "", "sender@untrusted.example.org", false)
+	test("192.0.2.1", "", "", false)
+}
@@ -0,0 +1,128 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// authResultRule selects the configuration block for recipients based on
+// the results of authentication checks (SPF, DKIM, DMARC, etc).
+type authResultRule struct {
+	method string
+	values []authres.ResultValue
+	block  *rcptBlock
+}
+
+func (r authResultRule) String() string {
+	values := make([]string, 0, len(r.values))
+	for _, val := range r.values {
+		values = append(values, string(val))
+	}
+	return r.method + "=" + strings.Join(values, "|")
+}
+
+func resultMethod(res authres.Result) (string, authres.ResultValue) {
+	switch res := res.(type) {
+	case *authres.AuthResult:
+		return "auth", res.Value
+	case *authres.DKIMResult:
+		return "dkim", res.Value
+	case *authres.DomainKeysResult:
+		return "domainkeys", res.Value
+	case *authres.IPRevResult:
+		return "iprev", res.Value
+	case *authres.SenderIDResult:
+		return "sender-id", res.Value
+	case *authres.SPFResult:
+		return "spf", res.Value
+	case *authres.DMARCResult:
+		return "dmarc", res.Value
+	case *authres.GenericResult:
+		return strings.ToLower(res.Method), res.Value
+	default:
+		return "", ""
+	}
+}
+
+func (r authResultRule) match(_ textproto.Header, authRes []authres.Result) bool {
+	found := false
+	for _, res := range authRes {
+		method, value := resultMethod(res)
+		if method != r.method {
+			continue
+		}
+		found = true
+		for _, val := range r.values {
+			if value == val {
+				return true
+			}
+		}
+	}
+
+	// No results for the method is handled as "none".
+	if !found {
+		for _, val := range r.values {
+			if val == authres.ResultNone {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r authResultRule) targetBlock() *rcptBlock {
+	return r.block
+}
+
+func parseAuthResultRule(globals map[string]interface{}, node config.Node) (authResultRule, error) {
+	if len(node.Args) < 2 {
+		return authResultRule{}, config.NodeErr(node, "expected at least two arguments: method and result values")
+	}
+	if len(node.Children) == 0 {
+		return authResultRule{}, config.NodeErr(node, "missing or empty %s block", node.Name)
+	}
+
+	rule := authResultRule{
+		method: strings.ToLower(node.Args[0]),
+	}
+	for _, val := range node.Args[1:] {
+		val := authres.ResultValue(strings.ToLower(val))
+		switch val {
+		case authres.ResultNone, authres.ResultPass, authres.ResultFail,
+			authres.ResultPolicy, authres.ResultNeutral, authres.ResultTempError,
+			authres.ResultPermError, authres.ResultHardFail, authres.ResultSoftFail:
+		default:
+			return authResultRule{}, config.NodeErr(node, "unknown result value: %s", val)
+		}
+		rule.values = append(rule.values, val)
+	}
+
+	var err error
+	rule.block, err = parseRuleBlock(globals, node)
+	if err != nil {
+		return authResultRule{}, err
+	}
+
+	return rule, nil
+}
@@ -0,0 +1,174 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_AuthResult(t *testing.T) {
+	passTarget, failTarget := testutils.Target{InstName: "pass"}, testutils.Target{InstName: "fail"}
+	spfCheck := testutils.Check{
+		InstName: "spf",
+		BodyRes: module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.SPFResult{Value: authres.ResultFail, From: "sender@example.com"},
+			},
+		},
+	}
+	extraCheck := testutils.Check{
+		InstName: "extra",
+		BodyRes: module.CheckResult{
+			Quarantine: true,
+			Reason:     errors.New("suspicious"),
+			AuthResult: []authres.Result{
+				&authres.GenericResult{Method: "x-extra", Value: authres.ResultFail},
+			},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&spfCheck},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					rejectErr: policyError(550),
+					rules: []rule{
+						authResultRule{
+							method: "spf",
+							values: []authres.ResultValue{authres.ResultPass},
+							block:  &rcptBlock{targets: []module.DeliveryTarget{&passTarget}},
+						},
+						authResultRule{
+							method: "spf",
+							values: []authres.ResultValue{authres.ResultSoftFail, authres.ResultFail},
+							block: &rcptBlock{
+								checks:  []module.Check{&extraCheck},
+								targets: []module.DeliveryTarget{&failTarget},
+							},
+						},
+					},
+				},
+			},
+		},
+		Hostname: "mx.example.com",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+
+	if len(passTarget.Messages) != 0 {
+		t.Fatalf("wrong amount of messages received for passTarget, want %d, got %d", 0, len(passTarget.Messages))
+	}
+	if len(failTarget.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received for failTarget, want %d, got %d", 1, len(failTarget.Messages))
+	}
+	testutils.CheckTestMessage(t, &failTarget, 0, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+
+	if extraCheck.BodyCalls != 1 {
+		t.Errorf("extra check called %d times (want 1)", extraCheck.BodyCalls)
+	}
+	msg := failTarget.Messages[0]
+	if !msg.MsgMeta.Quarantine {
+		t.Error("message is not quarantined by the extra check")
+	}
+	if !strings.Contains(msg.Header.Get("Authentication-Results"), "x-extra=fail") {
+		t.Error("missing result of the extra check:", msg.Header.Get("Authentication-Results"))
+	}
+}
+
+func TestAuthResultRule_Match(t *testing.T) {
+	cases := []struct {
+		rule    authResultRule
+		results []authres.Result
+		match   bool
+	}{
+		{
+			rule:    authResultRule{method: "dmarc", values: []authres.ResultValue{authres.ResultPass}},
+			results: []authres.Result{&authres.DMARCResult{Value: authres.ResultPass}},
+			match:   true,
+		},
+		{
+			rule:    authResultRule{method: "dmarc", values: []authres.ResultValue{authres.ResultPass}},
+			results: []authres.Result{&authres.SPFResult{Value: authres.ResultPass}},
+			match:   false,
+		},
+		{
+			rule:    authResultRule{method: "dkim", values: []authres.ResultValue{authres.ResultNone}},
+			results: []authres.Result{&authres.SPFResult{Value: authres.ResultPass}},
+			match:   true,
+		},
+		{
+			rule: authResultRule{method: "dkim", values: []authres.ResultValue{authres.ResultPass}},
+			results: []authres.Result{
+				&authres.DKIMResult{Value: authres.ResultFail},
+				&authres.DKIMResult{Value: authres.ResultPass},
+			},
+			match: true,
+		},
+	}
+
+	for _, case_ := range cases {
+		if match := case_.rule.match(textproto.Header{}, case_.results); match != case_.match {
+			t.Errorf("%v: wrong match result: %v (want %v)", case_.rule, match, case_.match)
+		}
+	}
+}
+
+func TestMsgPipelineCfg_AuthResult(t *testing.T) {
+	str := `
+		auth_result dmarc fail none {
+			check {
+				test_check
+			}
+			deliver_to dummy
+		}
+		auth_result spf bad {
+			reject 550
+		}
+		reject 550`
+
+	cfg, _ := parser.Read(strings.NewReader(str), "literal")
+	if _, err := parseMsgPipelineRootCfg(nil, cfg); err == nil {
+		t.Fatal("unexpected parse success for unknown result value")
+	}
+
+	str = strings.Replace(str, "spf bad", "spf pass", 1)
+	cfg, _ = parser.Read(strings.NewReader(str), "literal")
+	parsed, err := parseMsgPipelineRootCfg(nil, cfg)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	rules := parsed.defaultSource.defaultRcpt.rules
+	if len(rules) != 2 {
+		t.Fatal("wrong amount of rules:", len(rules))
+	}
+	if rule := rules[0].(authResultRule); rule.String() != "dmarc=fail|none" || len(rule.block.checks) != 1 {
+		t.Error("wrong rule:", rule)
+	}
+}
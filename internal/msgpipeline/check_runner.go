@@ -26,6 +26,7 @@ import (
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
 	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
@@ -48,6 +49,19 @@ type checkRunner struct {
 	doDMARC       bool
 	didDMARCFetch bool
 	dmarcVerify   *dmarc.Verifier
+	dmarcOverride module.Table
+	mailingLists  *mailingLists
+
+	scoring *scoring
+	score   int
+
+	upstreamAuthres    *upstreamAuthres
+	didUpstreamAuthres bool
+
+	deferInternally *deferInternally
+	// The reason of the first check that requested the internal retry.
+	// If set, the message should be passed to the defer_internally target.
+	deferErr error
 
 	log log.Logger
 
@@ -164,6 +178,9 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 		authResLock sync.Mutex
 		headerLock  sync.Mutex
 
+		scoreLock sync.Mutex
+		score     int
+
 		quarantineErr    error
 		quarantineCheck  string
 		setQuarantineErr sync.Once
@@ -172,6 +189,9 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 		rejectCheck  string
 		setRejectErr sync.Once
 
+		deferErr    error
+		setDeferErr sync.Once
+
 		wg sync.WaitGroup
 	}{}
 
@@ -208,7 +228,17 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				data.headerLock.Unlock()
 			}
 
-			if subCheckRes.Quarantine {
+			if subCheckRes.Score != 0 {
+				data.scoreLock.Lock()
+				data.score += subCheckRes.Score
+				data.scoreLock.Unlock()
+			}
+
+			if subCheckRes.DeferInternally {
+				data.setDeferErr.Do(func() {
+					data.deferErr = subCheckRes.Reason
+				})
+			} else if subCheckRes.Quarantine {
 				data.setQuarantineErr.Do(func() {
 					data.quarantineErr = subCheckRes.Reason
 				})
@@ -216,6 +246,12 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				data.setRejectErr.Do(func() {
 					data.rejectErr = subCheckRes.Reason
 				})
+			} else if subCheckRes.Score != 0 {
+				if subCheckRes.Reason != nil {
+					cr.log.Error("score adjusted", subCheckRes.Reason, "score", subCheckRes.Score)
+				} else {
+					cr.log.Msg("score adjusted", "score", subCheckRes.Score)
+				}
 			} else if subCheckRes.Reason != nil {
 				// 'action ignore' case. There is Reason, but action.Apply set
 				// both Reject and Quarantine to false. Log the reason for
@@ -229,6 +265,18 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 	if data.rejectErr != nil {
 		return data.rejectErr
 	}
+	if data.deferErr != nil {
+		if err := cr.deferCheck(data.deferErr); err != nil {
+			return err
+		}
+	}
+
+	if cr.scoring != nil {
+		cr.score += data.score
+		if err := cr.scoring.checkReject(cr.msgMeta, cr.mailFrom, cr.score); err != nil {
+			return err
+		}
+	}
 
 	if data.quarantineErr != nil {
 		cr.log.Error("quarantined", data.quarantineErr)
@@ -241,6 +289,9 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 func (cr *checkRunner) checkConnSender(ctx context.Context, checks []module.Check, mailFrom string) error {
 	cr.mailFrom = mailFrom
 	cr.mailFromReceived = true
+	if cr.msgMeta.Allowlisted {
+		return nil
+	}
 
 	// checkStates will run CheckConnection and CheckSender.
 	_, err := cr.checkStates(ctx, checks)
@@ -248,6 +299,9 @@ func (cr *checkRunner) checkConnSender(ctx context.Context, checks []module.Chec
 }
 
 func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcptTo string) error {
+	if cr.msgMeta.Allowlisted {
+		return nil
+	}
 	states, err := cr.checkStates(ctx, checks)
 	if err != nil {
 		return err
@@ -274,11 +328,19 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 }
 
 func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, header textproto.Header, body buffer.Buffer) error {
+	if cr.msgMeta.Allowlisted {
+		return nil
+	}
 	states, err := cr.checkStates(ctx, checks)
 	if err != nil {
 		return err
 	}
 
+	if cr.upstreamAuthres != nil && !cr.didUpstreamAuthres {
+		cr.useUpstreamAuthres(header)
+		cr.didUpstreamAuthres = true
+	}
+
 	if cr.doDMARC && !cr.didDMARCFetch {
 		cr.dmarcVerify.FetchRecord(ctx, header)
 		cr.didDMARCFetch = true
@@ -290,14 +352,61 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 	})
 }
 
+// checkBodyLate runs body checks after results of other checks are applied
+// to the message header. The results of these checks are applied
+// immediately.
+func (cr *checkRunner) checkBodyLate(ctx context.Context, checks []module.Check, hostname string, header *textproto.Header, body buffer.Buffer) error {
+	authResCount := len(cr.mergedRes.AuthResult)
+	headerCount := cr.mergedRes.Header.Len()
+
+	if err := cr.checkBody(ctx, checks, *header, body); err != nil {
+		return err
+	}
+
+	if cr.mergedRes.Quarantine {
+		cr.msgMeta.Quarantine = true
+	}
+	if cr.scoring != nil && cr.scoring.quarantine(cr.score) && !cr.msgMeta.Quarantine {
+		cr.msgMeta.Quarantine = true
+		cr.log.Msg("quarantined", "score", cr.score, "check", "scoring")
+	}
+
+	if newRes := cr.mergedRes.AuthResult[authResCount:]; len(newRes) != 0 {
+		header.Add("Authentication-Results", authres.Format(hostname, newRes))
+	}
+
+	i := 0
+	for field := cr.mergedRes.Header.Fields(); field.Next(); i++ {
+		if i < headerCount {
+			continue
+		}
+		formatted, err := field.Raw()
+		if err != nil {
+			cr.log.Error("malformed header field added by check", err)
+		}
+		header.AddRaw(formatted)
+	}
+	return nil
+}
+
 func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) error {
 	if cr.mergedRes.Quarantine {
 		cr.msgMeta.Quarantine = true
 	}
 
-	if cr.doDMARC {
+	// The DMARC record is not fetched for allowlisted messages.
+	if cr.doDMARC && cr.didDMARCFetch {
 		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
 		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
+		if policy != dmarc.PolicyNone && dmarcRes.Authres.Value != authres.ResultTempError {
+			policy = cr.dmarcPolicyOverride(dmarcRes.Authres.From, policy)
+		}
+		if policy != dmarc.PolicyNone && dmarcRes.Authres.Value == authres.ResultFail &&
+			cr.mailingLists != nil && cr.mailingLists.isList(*header) &&
+			cr.mailingLists.relaxedPass(cr.mergedRes.AuthResult) {
+			cr.log.Msg("DMARC policy relaxed for mailing list", "from_domain", dmarcRes.Authres.From, "list_id", listID(*header))
+			policy = dmarc.PolicyNone
+		}
 		switch policy {
 		case dmarc.PolicyReject:
 			code := 550
@@ -327,6 +436,18 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 		}
 	}
 
+	// Thresholds are checked again since the DMARC policy override can
+	// adjust the score.
+	if cr.scoring != nil {
+		if err := cr.scoring.checkReject(cr.msgMeta, cr.mailFrom, cr.score); err != nil {
+			return err
+		}
+		if cr.scoring.quarantine(cr.score) {
+			cr.msgMeta.Quarantine = true
+			cr.log.Msg("quarantined", "score", cr.score, "check", "scoring")
+		}
+	}
+
 	// After results for all checks are checked, authRes will be populated with values
 	// we should put into Authentication-Results header.
 	if len(cr.mergedRes.AuthResult) != 0 {
@@ -343,9 +464,56 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	return nil
 }
 
+// dmarcPolicyOverride applies the per-domain override for the DMARC policy.
+// Override table values use the check action syntax, 'reject' and
+// 'quarantine' actions are mapped to the corresponding policies, score is
+// added to the message score.
+func (cr *checkRunner) dmarcPolicyOverride(fromDomain string, policy dmarc.Policy) dmarc.Policy {
+	action, ok, err := modconfig.LookupActionOverride(context.TODO(), cr.dmarcOverride, fromDomain)
+	if err != nil {
+		cr.log.Error("DMARC override lookup failed", err, "from_domain", fromDomain)
+		return policy
+	}
+	if !ok {
+		return policy
+	}
+
+	cr.log.Msg("DMARC policy overridden", "from_domain", fromDomain, "policy", policy)
+
+	cr.score += action.Score
+	switch {
+	case action.Reject:
+		return dmarc.PolicyReject
+	case action.Quarantine:
+		return dmarc.PolicyQuarantine
+	default:
+		return dmarc.PolicyNone
+	}
+}
+
 func (cr *checkRunner) close() {
 	cr.dmarcVerify.Close()
 	for _, state := range cr.states {
 		state.Close()
 	}
 }
+
+// useUpstreamAuthres adds authentication results reported by the trusted relay
+// to the results of the message checks.
+func (cr *checkRunner) useUpstreamAuthres(header textproto.Header) {
+	results := cr.upstreamAuthres.results(header)
+	if results == nil {
+		cr.log.Msg("no Authentication-Results from trusted relay")
+		return
+	}
+
+	for _, res := range results {
+		// DMARC is evaluated using upstream results, don't let the relay
+		// result confuse it.
+		if _, ok := res.(*authres.DMARCResult); ok && cr.doDMARC {
+			continue
+		}
+		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, res)
+	}
+	cr.log.DebugMsg("using upstream authentication results", "count", len(results))
+}
@@ -44,6 +44,13 @@ type msgpipelineCfg struct {
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+	dmarcOverride   module.Table
+	scoring         *scoring
+	upstreamAuthres *upstreamAuthres
+	mailingLists    *mailingLists
+	deferInternally *deferInternally
+	journal         *journal
+	allowlist       *allowlist
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
@@ -129,7 +136,65 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
-		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject":
+		case "dmarc_override_table":
+			if err := modconfig.ModuleFromNode("table", node.Args, node, globals, &cfg.dmarcOverride); err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "scoring":
+			if cfg.scoring != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'scoring' block")
+			}
+			var err error
+			cfg.scoring, err = parseScoring(node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "upstream_authres":
+			if cfg.upstreamAuthres != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'upstream_authres' block")
+			}
+			var err error
+			cfg.upstreamAuthres, err = parseUpstreamAuthres(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "mailing_lists":
+			if cfg.mailingLists != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'mailing_lists' block")
+			}
+			var err error
+			cfg.mailingLists, err = parseMailingLists(node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "defer_internally":
+			if cfg.deferInternally != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'defer_internally' block")
+			}
+			var err error
+			cfg.deferInternally, err = parseDeferInternally(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "allowlist":
+			if cfg.allowlist != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'allowlist' block")
+			}
+			var err error
+			cfg.allowlist, err = parseAllowlist(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "journal":
+			if cfg.journal != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'journal' block")
+			}
+			var err error
+			cfg.journal, err = parseJournal(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject", "header_match", "header_regexp", "auth_result":
 			othersRaw = append(othersRaw, node)
 		default:
 			return msgpipelineCfg{}, config.NodeErr(node, "unknown pipeline directive: %s", node.Name)
@@ -227,7 +292,7 @@ func parseMsgPipelineSrcCfg(globals map[string]interface{}, nodes []config.Node)
 				return sourceBlock{}, config.NodeErr(node, "duplicate 'default_destination' block")
 			}
 			defaultRcptRaw = node.Children
-		case "deliver_to", "reroute", "reject":
+		case "deliver_to", "reroute", "reject", "header_match", "header_regexp", "auth_result":
 			othersRaw = append(othersRaw, node)
 		default:
 			return sourceBlock{}, config.NodeErr(node, "unknown pipeline directive: %s", node.Name)
@@ -308,6 +373,20 @@ func parseMsgPipelineRcptCfg(globals map[string]interface{}, nodes []config.Node
 			if err != nil {
 				return nil, err
 			}
+		case "header_match", "header_regexp":
+			rule, err := parseHeaderRule(globals, node)
+			if err != nil {
+				return nil, err
+			}
+
+			rcpt.rules = append(rcpt.rules, rule)
+		case "auth_result":
+			rule, err := parseAuthResultRule(globals, node)
+			if err != nil {
+				return nil, err
+			}
+
+			rcpt.rules = append(rcpt.rules, rule)
 		default:
 			return nil, config.NodeErr(node, "invalid directive")
 		}
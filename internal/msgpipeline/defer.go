@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// deferInternally contains the configuration for internal retries of checks
+// that returned results with the 'defer_internally' action.
+//
+// The message is accepted and passed to the configured target (usually, a
+// queue that delivers to the pipeline running the same checks). Failed
+// checks in that pipeline cause temporary delivery errors so the queue
+// retries the delivery with its usual delays. After maxAttempts, the message
+// is either accepted or permanently rejected, depending on failOpen.
+type deferInternally struct {
+	target      module.DeliveryTarget
+	maxAttempts int
+	failOpen    bool
+}
+
+func parseDeferInternally(globals map[string]interface{}, node config.Node) (*deferInternally, error) {
+	d := &deferInternally{}
+
+	cfg := config.NewMap(globals, node)
+	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &d.target)
+	cfg.Int("max_attempts", false, false, 5, &d.maxAttempts)
+	cfg.Bool("fail_open", false, false, &d.failOpen)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if d.maxAttempts < 1 {
+		return nil, config.NodeErr(node, "max_attempts should be positive")
+	}
+
+	return d, nil
+}
+
+// deferCheck decides what to do with the check result that requested the
+// internal retry. A non-nil error is returned if the message should be
+// rejected.
+func (cr *checkRunner) deferCheck(reason error) error {
+	if cr.deferInternally == nil {
+		return reason
+	}
+
+	if !cr.msgMeta.CheckRetry {
+		if cr.deferErr == nil {
+			cr.deferErr = reason
+		}
+		return nil
+	}
+
+	if cr.msgMeta.DeliveryAttempt < cr.deferInternally.maxAttempts {
+		return exterrors.WithTemporary(reason, true)
+	}
+
+	if cr.deferInternally.failOpen {
+		cr.log.Error("deferred check failed too many times, accepting the message", reason,
+			"attempt", cr.msgMeta.DeliveryAttempt)
+		return nil
+	}
+	return exterrors.WithTemporary(reason, false)
+}
+
+// deferToTarget aborts deliveries to the selected targets and passes the
+// message to the defer_internally target instead.
+//
+// The original envelope is used since the pipeline handling the retry runs
+// modifiers on its own.
+func (dd *msgpipelineDelivery) deferToTarget(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	dd.log.Error("deferring message for internal retry", dd.checkRunner.deferErr)
+
+	for _, delivery := range dd.deliveries {
+		if err := delivery.Abort(ctx); err != nil {
+			dd.log.Debugf("delivery.Abort failure, Delivery object = %T: %v", delivery, err)
+		}
+	}
+	dd.deliveries = make(map[module.DeliveryTarget]*delivery)
+	dd.deferredRcpts = nil
+
+	msgMeta := dd.msgMeta.DeepCopy()
+	msgMeta.CheckRetry = true
+	msgMeta.OriginalRcpts = map[string]string{}
+
+	tgt := dd.d.deferInternally.target
+	tgtDelivery, err := tgt.Start(ctx, msgMeta, dd.originalFrom)
+	if err != nil {
+		return err
+	}
+	d := &delivery{Delivery: tgtDelivery}
+	dd.deliveries[tgt] = d
+
+	for _, rcpt := range dd.acceptedRcpts {
+		if err := d.AddRcpt(ctx, rcpt); err != nil {
+			return err
+		}
+		d.recipients = append(d.recipients, rcpt)
+	}
+
+	return d.Body(ctx, header, body)
+}
@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_DeferInternally(t *testing.T) {
+	target, retryTarget := testutils.Target{}, testutils.Target{}
+	check_ := testutils.Check{
+		BodyRes: module.CheckResult{
+			DeferInternally: true,
+			Reason:          errors.New("scanner is down"),
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check_},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	t.Run("not configured", func(t *testing.T) {
+		_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if len(target.Messages) != 0 {
+			t.Fatal("message delivered to the target")
+		}
+	})
+
+	d.deferInternally = &deferInternally{
+		target:      &retryTarget,
+		maxAttempts: 3,
+	}
+
+	t.Run("deferred", func(t *testing.T) {
+		testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+		if len(target.Messages) != 0 {
+			t.Fatal("message delivered to the target")
+		}
+		testutils.CheckTestMessage(t, &retryTarget, 0, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+		if !retryTarget.Messages[0].MsgMeta.CheckRetry {
+			t.Fatal("CheckRetry is not set")
+		}
+	})
+
+	retryMeta := func(attempt int) *module.MsgMetadata {
+		return &module.MsgMetadata{
+			OriginalFrom:    "sender@example.com",
+			CheckRetry:      true,
+			DeliveryAttempt: attempt,
+		}
+	}
+
+	t.Run("retry", func(t *testing.T) {
+		_, err := testutils.DoTestDeliveryErrMeta(t, &d, "sender@example.com", []string{"rcpt1@example.com"}, retryMeta(2))
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if !exterrors.IsTemporary(err) {
+			t.Fatal("expected temporary error, got", err)
+		}
+		if len(retryTarget.Messages) != 1 {
+			t.Fatal("message deferred again")
+		}
+	})
+
+	t.Run("fail closed", func(t *testing.T) {
+		_, err := testutils.DoTestDeliveryErrMeta(t, &d, "sender@example.com", []string{"rcpt1@example.com"}, retryMeta(3))
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if exterrors.IsTemporary(err) {
+			t.Fatal("expected permanent error, got", err)
+		}
+	})
+
+	d.deferInternally.failOpen = true
+
+	t.Run("fail open", func(t *testing.T) {
+		testutils.DoTestDeliveryMeta(t, &d, "sender@example.com", []string{"rcpt1@example.com"}, retryMeta(3))
+		testutils.CheckTestMessage(t, &target, 0, "sender@example.com", []string{"rcpt1@example.com"})
+	})
+
+	if check_.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, counters: %d", check_.UnclosedStates)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -32,6 +33,7 @@ import (
 	"github.com/emersion/go-msgauth/authres"
 	"github.com/foxcpp/go-mockdns"
 	"github.com/foxcpp/maddy/framework/buffer"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -221,3 +223,193 @@ func TestDMARC(t *testing.T) {
 		&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
 	}, false, true, authres.ResultFail)
 }
+
+func TestDMARC_Override(t *testing.T) {
+	test := func(override string, reject, quarantine bool) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		p := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{
+					&testutils.Check{
+						BodyRes: module.CheckResult{
+							AuthResult: []authres.Result{
+								&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.org"},
+								&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
+							},
+						},
+					},
+				},
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+				doDMARC: true,
+				dmarcOverride: testutils.Table{
+					M: map[string]string{"example.com": override},
+				},
+				scoring: &scoring{
+					quarantineThres: 5,
+					rejectThres:     10,
+				},
+			},
+			Log: testutils.Logger(t, "pipeline"),
+			Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+				"_dmarc.example.com.": {
+					TXT: []string{"v=DMARC1; p=reject"},
+				},
+			}},
+		}
+
+		_, err := doTestDelivery(t, &p, "test@example.org", []string{"test@example.com"}, "From: hello@EXAMPLE.com\r\n\r\n")
+		if reject {
+			if err == nil {
+				t.Errorf("expected message to be rejected")
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v %+v", err, exterrors.Fields(err))
+			return
+		}
+		if len(tgt.Messages) != 1 {
+			t.Errorf("got %d messages", len(tgt.Messages))
+			return
+		}
+		if tgt.Messages[0].MsgMeta.Quarantine != quarantine {
+			t.Errorf("msg.MsgMeta.Quarantine (%v) != quarantine (%v)", tgt.Messages[0].MsgMeta.Quarantine, quarantine)
+		}
+		// Override does not change the result itself.
+		if res := dmarcResult(t, tgt.Messages[0].Header); res != authres.ResultFail {
+			t.Errorf("expected DMARC result to be 'fail', got '%v'", res)
+		}
+	}
+
+	test("ignore", false, false)
+	test("quarantine", false, true)
+	test("reject", true, false)
+	// Score added by the override alone crosses the thresholds.
+	test("score 5", false, true)
+	test("score 10", true, false)
+}
+
+func TestDMARC_MailingLists(t *testing.T) {
+	test := func(ml *mailingLists, hdr string, dkimDomain string, reject bool) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		p := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{
+					&testutils.Check{
+						BodyRes: module.CheckResult{
+							AuthResult: []authres.Result{
+								&authres.DKIMResult{Value: authres.ResultPass, Domain: dkimDomain},
+								&authres.SPFResult{Value: authres.ResultFail, From: "lists.example.org", Helo: "mx.example.org"},
+							},
+						},
+					},
+				},
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+				doDMARC:      true,
+				mailingLists: ml,
+			},
+			Log: testutils.Logger(t, "pipeline"),
+			Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+				"_dmarc.example.com.": {
+					TXT: []string{"v=DMARC1; p=reject"},
+				},
+			}},
+		}
+
+		_, err := doTestDelivery(t, &p, "list-bounces@lists.example.org", []string{"test@example.net"}, hdr)
+		if reject {
+			if err == nil {
+				t.Errorf("expected message to be rejected")
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v %+v", err, exterrors.Fields(err))
+			return
+		}
+		// The relaxed policy does not change the result itself.
+		if res := dmarcResult(t, tgt.Messages[0].Header); res != authres.ResultFail {
+			t.Errorf("expected DMARC result to be 'fail', got '%v'", res)
+		}
+	}
+
+	listHdr := "From: hello@example.com\r\nList-Id: Test list <test.lists.example.org>\r\n\r\n"
+	precedenceHdr := "From: hello@example.com\r\nPrecedence: list\r\n\r\n"
+	plainHdr := "From: hello@example.com\r\n\r\n"
+
+	relaxed := &mailingLists{
+		detect:         []string{listDetectListID, listDetectPrecedence},
+		trustedDomains: map[string]struct{}{"lists.example.org": {}},
+	}
+	test(nil, listHdr, "lists.example.org", true)
+	test(relaxed, listHdr, "lists.example.org", false)
+	test(relaxed, listHdr, "Test.Lists.example.org.", false)
+	test(relaxed, precedenceHdr, "lists.example.org", false)
+	test(relaxed, plainHdr, "lists.example.org", true)
+	// List-Id is controlled by the sender and does not make the signing
+	// domain trusted.
+	test(relaxed, listHdr, "example.net", true)
+	test(relaxed, "From: hello@example.com\r\nList-Id: <list.example.net>\r\n\r\n", "example.net", true)
+	test(relaxed, listHdr, "example.org", true)
+	test(relaxed, listHdr, "evillists.example.org", true)
+}
+
+func TestListID(t *testing.T) {
+	for hdr, id := range map[string]string{
+		"List-Id: Test list <Test.Lists.example.org>\r\n\r\n": "test.lists.example.org",
+		"List-Id: <test.lists.example.org>\r\n\r\n":           "test.lists.example.org",
+		"List-Id: test.lists.example.org\r\n\r\n":             "test.lists.example.org",
+		"Subject: test\r\n\r\n":                               "",
+	} {
+		hdrParsed, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdr)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := listID(hdrParsed); got != id {
+			t.Errorf("listID(%q) = %q, want %q", hdr, got, id)
+		}
+	}
+}
+
+func TestMsgPipelineCfg_MailingLists(t *testing.T) {
+	cfg, _ := parser.Read(strings.NewReader(`
+		mailing_lists {
+			detect list_id
+			trusted_domains Lists.Example.org googlegroups.com.
+		}
+		reject`), "literal")
+	parsed, err := parseMsgPipelineRootCfg(nil, cfg)
+	if err != nil {
+		t.Fatal("unexpected parse error:", err)
+	}
+	want := map[string]struct{}{"lists.example.org": {}, "googlegroups.com": {}}
+	if !reflect.DeepEqual(parsed.mailingLists.trustedDomains, want) {
+		t.Fatal("wrong trusted domains:", parsed.mailingLists.trustedDomains)
+	}
+
+	// Trusted domains should be listed explicitly.
+	cfg, _ = parser.Read(strings.NewReader(`
+		mailing_lists {
+			detect list_id
+		}
+		reject`), "literal")
+	if _, err := parseMsgPipelineRootCfg(nil, cfg); err == nil {
+		t.Fatal("unexpected parse success")
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// headerRule selects the delivery targets for recipients of a destination
+// block based on the message header.
+type headerRule struct {
+	field string
+	value string
+	re    *regexp.Regexp
+	block *rcptBlock
+}
+
+func (r headerRule) String() string {
+	if r.re != nil {
+		return r.field + " ~ " + r.re.String()
+	}
+	return r.field + " = " + r.value
+}
+
+func (r headerRule) match(header textproto.Header, _ []authres.Result) bool {
+	fields := header.FieldsByKey(r.field)
+	for fields.Next() {
+		val := strings.TrimSpace(fields.Value())
+		if r.re != nil {
+			if r.re.MatchString(val) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(val, r.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHeaderRule(globals map[string]interface{}, node config.Node) (headerRule, error) {
+	if len(node.Args) != 2 {
+		return headerRule{}, config.NodeErr(node, "expected two arguments: header field name and value")
+	}
+	if len(node.Children) == 0 {
+		return headerRule{}, config.NodeErr(node, "missing or empty %s block", node.Name)
+	}
+
+	rule := headerRule{
+		field: node.Args[0],
+		value: node.Args[1],
+	}
+	if node.Name == "header_regexp" {
+		var err error
+		rule.re, err = regexp.Compile("(?i)" + node.Args[1])
+		if err != nil {
+			return headerRule{}, config.NodeErr(node, "%v", err)
+		}
+	}
+
+	var err error
+	rule.block, err = parseRuleBlock(globals, node)
+	if err != nil {
+		return headerRule{}, err
+	}
+
+	return rule, nil
+}
+
+func (r headerRule) targetBlock() *rcptBlock {
+	return r.block
+}
@@ -0,0 +1,258 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/modify"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_HeaderMatch(t *testing.T) {
+	matchTarget, reTarget, defaultTarget := testutils.Target{InstName: "match"}, testutils.Target{InstName: "re"}, testutils.Target{InstName: "default"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.org": {
+						targets: []module.DeliveryTarget{&defaultTarget},
+						rules: []rule{
+							headerRule{
+								field: "B",
+								re:    regexp.MustCompile("(?i)^3$"),
+								block: &rcptBlock{rejectErr: policyError(550)},
+							},
+							headerRule{
+								field: "a",
+								value: "1",
+								block: &rcptBlock{targets: []module.DeliveryTarget{&matchTarget}},
+							},
+						},
+					},
+					"example.net": {
+						targets: []module.DeliveryTarget{&defaultTarget},
+						rules: []rule{
+							headerRule{
+								field: "B",
+								re:    regexp.MustCompile("(?i)^[0-9]$"),
+								block: &rcptBlock{targets: []module.DeliveryTarget{&reTarget}},
+							},
+						},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&defaultTarget},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.org", "rcpt2@example.net", "rcpt3@example.com"})
+
+	if len(matchTarget.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received for matchTarget, want %d, got %d", 1, len(matchTarget.Messages))
+	}
+	testutils.CheckTestMessage(t, &matchTarget, 0, "sender@example.com", []string{"rcpt1@example.org"})
+
+	if len(reTarget.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received for reTarget, want %d, got %d", 1, len(reTarget.Messages))
+	}
+	testutils.CheckTestMessage(t, &reTarget, 0, "sender@example.com", []string{"rcpt2@example.net"})
+
+	if len(defaultTarget.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received for defaultTarget, want %d, got %d", 1, len(defaultTarget.Messages))
+	}
+	testutils.CheckTestMessage(t, &defaultTarget, 0, "sender@example.com", []string{"rcpt3@example.com"})
+}
+
+func TestMsgPipeline_HeaderMatch_Reject(t *testing.T) {
+	target := testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+					rules: []rule{
+						headerRule{
+							field: "A",
+							value: "1",
+							block: &rcptBlock{rejectErr: policyError(550)},
+						},
+					},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatal("wrong error:", err)
+	}
+	if len(target.Messages) != 0 {
+		t.Fatal("message delivered despite the reject")
+	}
+}
+
+func TestMsgPipeline_HeaderMatch_NonAtomicModifiers(t *testing.T) {
+	// Rules should not see fields added by modifiers, same as for Body.
+	var addHdr textproto.Header
+	addHdr.Add("X-Added", "1")
+
+	matchTarget, defaultTarget := testutils.Target{InstName: "match"}, testutils.Target{InstName: "default"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{
+					testutils.Modifier{
+						InstName: "test_modifier",
+						AddHdr:   addHdr,
+					},
+				},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&defaultTarget},
+					rules: []rule{
+						headerRule{
+							field: "X-Added",
+							value: "1",
+							block: &rcptBlock{targets: []module.DeliveryTarget{&matchTarget}},
+						},
+					},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	c := multipleErrs{}
+	testutils.DoTestDeliveryNonAtomic(t, c, &d, "sender@example.com", []string{"rcpt@example.com"})
+	if err := c["rcpt@example.com"]; err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(matchTarget.Messages) != 0 {
+		t.Fatal("rule matched the field added by modifier")
+	}
+	if len(defaultTarget.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received for defaultTarget, want %d, got %d", 1, len(defaultTarget.Messages))
+	}
+}
+
+func TestMsgPipelineCfg_HeaderMatch(t *testing.T) {
+	cases := []struct {
+		name string
+		str  string
+		fail bool
+	}{
+		{
+			name: "ok",
+			str: `
+				header_match List-Id "<list.example.org>" {
+					check {
+						test_check
+					}
+					reject 410
+				}
+				header_regexp X-Route "relay-[0-9]+" {
+					reject 420
+				}
+				reject 430`,
+		},
+		{
+			name: "regexp error",
+			str: `
+				header_regexp X-Route "(" {
+					reject 420
+				}
+				reject 430`,
+			fail: true,
+		},
+		{
+			name: "missing value",
+			str: `
+				header_match X-Route {
+					reject 420
+				}
+				reject 430`,
+			fail: true,
+		},
+		{
+			name: "modifiers in block",
+			str: `
+				header_match X-Route a {
+					modify {
+						test_modifier
+					}
+					reject 420
+				}
+				reject 430`,
+			fail: true,
+		},
+	}
+
+	for _, case_ := range cases {
+		case_ := case_
+		t.Run(case_.name, func(t *testing.T) {
+			cfg, _ := parser.Read(strings.NewReader(case_.str), "literal")
+			parsed, err := parseMsgPipelineRootCfg(nil, cfg)
+			if err != nil && !case_.fail {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if err == nil && case_.fail {
+				t.Fatalf("unexpected parse success")
+			}
+			if case_.fail {
+				t.Log(err)
+				return
+			}
+
+			rules := parsed.defaultSource.defaultRcpt.rules
+			if len(rules) != 2 {
+				t.Fatal("wrong amount of rules:", len(rules))
+			}
+			rule0, rule1 := rules[0].(headerRule), rules[1].(headerRule)
+			if rule0.field != "List-Id" || rule0.value != "<list.example.org>" || rule0.re != nil {
+				t.Error("wrong first rule:", rule0)
+			}
+			if rule1.field != "X-Route" || rule1.re == nil || !rule1.re.MatchString("RELAY-1") {
+				t.Error("wrong second rule:", rule1)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// journal contains the configuration for the archive copy of all messages
+// handled by the pipeline.
+//
+// The copy is delivered using the null reverse-path to the configured
+// address. Envelope of the original message is preserved in X-Envelope-From
+// and X-Envelope-To header fields. Journal delivery failures are logged and
+// never affect the primary delivery status.
+type journal struct {
+	target       module.DeliveryTarget
+	rcpt         string
+	inbound      bool
+	outbound     bool
+	includeRcpts bool
+}
+
+func parseJournal(globals map[string]interface{}, node config.Node) (*journal, error) {
+	j := &journal{}
+
+	var messages []string
+	cfg := config.NewMap(globals, node)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &j.target)
+	cfg.String("rcpt", false, true, "", &j.rcpt)
+	cfg.StringList("messages", false, false, []string{"inbound", "outbound"}, &messages)
+	cfg.Bool("include_rcpts", false, true, &j.includeRcpts)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	for _, kind := range messages {
+		switch kind {
+		case "inbound":
+			j.inbound = true
+		case "outbound":
+			j.outbound = true
+		default:
+			return nil, config.NodeErr(node, "unknown message direction: %s", kind)
+		}
+	}
+
+	return j, nil
+}
+
+// direction returns the message direction used in the journal copy. Messages
+// submitted by authenticated clients are considered outbound.
+func direction(msgMeta *module.MsgMetadata) string {
+	if msgMeta.Conn != nil && msgMeta.Conn.AuthUser != "" {
+		return "outbound"
+	}
+	return "inbound"
+}
+
+// startJournal delivers the copy of the message to the journal target. The
+// copy is committed right away so it is kept regardless of whether primary
+// deliveries succeed.
+func (dd *msgpipelineDelivery) startJournal(ctx context.Context, header textproto.Header, body buffer.Buffer) {
+	j := dd.d.journal
+	if j == nil {
+		return
+	}
+
+	dir := direction(dd.msgMeta)
+	if dir == "inbound" && !j.inbound || dir == "outbound" && !j.outbound {
+		return
+	}
+
+	msgMeta := dd.msgMeta.DeepCopy()
+	// The journal target may be the same as one used for the primary
+	// delivery (e.g. a queue), so make sure IDs do not collide.
+	var err error
+	msgMeta.ID, err = module.GenerateMsgID()
+	if err != nil {
+		dd.log.Error("journal delivery failed", err)
+		return
+	}
+	msgMeta.OriginalFrom = ""
+	msgMeta.OriginalRcpts = map[string]string{}
+
+	header = header.Copy()
+	header.Add("X-Journal-Direction", dir)
+	if j.includeRcpts {
+		for i := len(dd.acceptedRcpts) - 1; i >= 0; i-- {
+			header.Add("X-Envelope-To", "<"+dd.acceptedRcpts[i]+">")
+		}
+	}
+	header.Add("X-Envelope-From", "<"+dd.originalFrom+">")
+
+	journalDelivery, err := j.target.Start(ctx, msgMeta, "")
+	if err != nil {
+		dd.log.Error("journal delivery failed", err)
+		return
+	}
+	if err := journalDelivery.AddRcpt(ctx, j.rcpt); err != nil {
+		dd.log.Error("journal delivery failed", err)
+		dd.abortJournal(ctx, journalDelivery)
+		return
+	}
+	if err := journalDelivery.Body(ctx, header, body); err != nil {
+		dd.log.Error("journal delivery failed", err)
+		dd.abortJournal(ctx, journalDelivery)
+		return
+	}
+
+	if err := journalDelivery.Commit(ctx); err != nil {
+		dd.log.Error("journal delivery failed", err)
+		return
+	}
+
+	dd.log.Msg("journal copy created", "journal_msg_id", msgMeta.ID)
+}
+
+func (dd *msgpipelineDelivery) abortJournal(ctx context.Context, d module.Delivery) {
+	if err := d.Abort(ctx); err != nil {
+		dd.log.Debugf("journal delivery.Abort failure, Delivery object = %T: %v", d, err)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_Journal(t *testing.T) {
+	target, archive := testutils.Target{}, testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+			journal: &journal{
+				target:       &archive,
+				rcpt:         "archive@example.org",
+				inbound:      true,
+				includeRcpts: true,
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	id := testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+	testutils.CheckTestMessage(t, &target, 0, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+	if len(archive.Messages) != 1 {
+		t.Fatal("expected one journal copy, got", len(archive.Messages))
+	}
+	msg := archive.Messages[0]
+	if msg.MailFrom != "" || !reflect.DeepEqual(msg.RcptTo, []string{"archive@example.org"}) {
+		t.Fatalf("wrong journal envelope: %q, %v", msg.MailFrom, msg.RcptTo)
+	}
+	if msg.MsgMeta.ID == id {
+		t.Fatal("journal copy uses the original message ID")
+	}
+	if from := msg.Header.Get("X-Envelope-From"); from != "<sender@example.com>" {
+		t.Fatal("wrong X-Envelope-From:", from)
+	}
+	if to := msg.Header.Values("X-Envelope-To"); !reflect.DeepEqual(to, []string{"<rcpt1@example.com>", "<rcpt2@example.com>"}) {
+		t.Fatal("wrong X-Envelope-To:", to)
+	}
+	if dir := msg.Header.Get("X-Journal-Direction"); dir != "inbound" {
+		t.Fatal("wrong X-Journal-Direction:", dir)
+	}
+	if target.Messages[0].Header.Has("X-Envelope-From") {
+		t.Fatal("journal fields are added to the original message")
+	}
+
+	// Outbound messages are not journaled.
+	testutils.DoTestDeliveryMeta(t, &d, "sender@example.com", []string{"rcpt1@example.com"}, &module.MsgMetadata{
+		Conn: &module.ConnState{AuthUser: "sender@example.com"},
+	})
+	if len(archive.Messages) != 1 {
+		t.Fatal("outbound message is journaled")
+	}
+
+	// Journal failures do not affect the primary delivery.
+	archive.BodyErr = errors.New("archive is down")
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+	if len(target.Messages) != 3 {
+		t.Fatal("message is not delivered to the primary target")
+	}
+
+	// The copy is committed even if the primary delivery fails.
+	archive.BodyErr = nil
+	target.CommitErr = errors.New("primary target is down")
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt1@example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(archive.Messages) != 2 {
+		t.Fatal("journal copy is not committed")
+	}
+	// ... or is aborted.
+	target.CommitErr = nil
+	target.BodyErr = errors.New("primary target is down")
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt1@example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(archive.Messages) != 3 {
+		t.Fatal("journal copy is not committed")
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package msgpipeline
+
+import (
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+const (
+	listDetectListID     = "list_id"
+	listDetectListPost   = "list_post"
+	listDetectPrecedence = "precedence"
+)
+
+// mailingLists contains the relaxed DMARC policy for mailing list traffic.
+//
+// Mailing lists resend messages from their own servers and often modify
+// them, so list mail legitimately fails SPF and DKIM alignment with the
+// From domain. Instead, the message is required to have a valid DKIM
+// signature of one of explicitly trusted list operators. Header fields
+// identifying the list are controlled by the sender and are used only to
+// detect list traffic.
+type mailingLists struct {
+	detect         []string
+	trustedDomains map[string]struct{}
+}
+
+func parseMailingLists(node config.Node) (*mailingLists, error) {
+	ml := &mailingLists{}
+
+	var trustedDomains []string
+	cfg := config.NewMap(nil, node)
+	cfg.EnumList("detect", false, false,
+		[]string{listDetectListID, listDetectListPost, listDetectPrecedence},
+		[]string{listDetectListID, listDetectPrecedence}, &ml.detect)
+	cfg.StringList("trusted_domains", false, true, nil, &trustedDomains)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	ml.trustedDomains = make(map[string]struct{}, len(trustedDomains))
+	for _, domain := range trustedDomains {
+		domain, err := dns.ForLookup(domain)
+		if err != nil {
+			return nil, config.NodeErr(node, "invalid trusted domain: %v", err)
+		}
+		ml.trustedDomains[domain] = struct{}{}
+	}
+
+	return ml, nil
+}
+
+// isList reports whether the message looks like mailing list traffic.
+func (ml *mailingLists) isList(header textproto.Header) bool {
+	for _, method := range ml.detect {
+		switch method {
+		case listDetectListID:
+			if header.Has("List-Id") {
+				return true
+			}
+		case listDetectListPost:
+			if header.Has("List-Post") {
+				return true
+			}
+		case listDetectPrecedence:
+			if strings.EqualFold(strings.TrimSpace(header.Get("Precedence")), "list") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listID returns the list identifier from the List-Id field (RFC 2919) in
+// lower case. Empty string is returned if there is no such field.
+func listID(header textproto.Header) string {
+	value := header.Get("List-Id")
+	if start := strings.LastIndexByte(value, '<'); start != -1 {
+		value = value[start+1:]
+		if end := strings.IndexByte(value, '>'); end != -1 {
+			value = value[:end]
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// relaxedPass reports whether the list message satisfies the relaxed
+// authentication policy.
+func (ml *mailingLists) relaxedPass(authRes []authres.Result) bool {
+	for _, res := range authRes {
+		dkimRes, ok := res.(*authres.DKIMResult)
+		if !ok || dkimRes.Value != authres.ResultPass {
+			continue
+		}
+		if ml.trusted(dkimRes.Domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// trusted reports whether the domain is one of trusted list domains or its
+// subdomain.
+func (ml *mailingLists) trusted(domain string) bool {
+	domain, err := dns.ForLookup(domain)
+	if err != nil || domain == "" {
+		return false
+	}
+	for {
+		if _, ok := ml.trustedDomains[domain]; ok {
+			return true
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot == -1 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
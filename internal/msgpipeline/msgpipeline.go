@@ -83,6 +83,7 @@ type rcptBlock struct {
 	modifiers modify.Group
 	rejectErr error
 	targets   []module.DeliveryTarget
+	rules     []rule
 }
 
 func New(globals map[string]interface{}, cfg []config.Node) (*MsgPipeline, error) {
@@ -94,6 +95,10 @@ func New(globals map[string]interface{}, cfg []config.Node) (*MsgPipeline, error
 }
 
 func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *smtp.ConnectionState) error {
+	if d.allowlist != nil && d.allowlist.matchIP(state.RemoteAddr) {
+		return nil
+	}
+
 	eg, checkCtx := errgroup.WithContext(ctx)
 
 	// TODO: See if there is some point in parallelization of this
@@ -127,6 +132,21 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.dmarcOverride = d.dmarcOverride
+	dd.checkRunner.mailingLists = d.mailingLists
+	dd.checkRunner.scoring = d.scoring
+	dd.checkRunner.deferInternally = d.deferInternally
+	if d.upstreamAuthres != nil && d.upstreamAuthres.trusted(msgMeta) {
+		msgMeta.UpstreamAuth = true
+		dd.checkRunner.upstreamAuthres = d.upstreamAuthres
+	}
+
+	if d.allowlist != nil {
+		if ok, cond := d.allowlist.match(ctx, dd.log, msgMeta, mailFrom); ok {
+			msgMeta.Allowlisted = true
+			dd.log.Msg("allowlisted, skipping checks", "condition", cond)
+		}
+	}
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
@@ -143,6 +163,8 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 func (dd *msgpipelineDelivery) start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) error {
 	var err error
 
+	dd.originalFrom = mailFrom
+
 	if err := dd.checkRunner.checkConnSender(ctx, dd.d.globalChecks, mailFrom); err != nil {
 		return err
 	}
@@ -272,9 +294,15 @@ type msgpipelineDelivery struct {
 	sourceAddr  string
 	sourceBlock sourceBlock
 
-	deliveries  map[module.DeliveryTarget]*delivery
-	msgMeta     *module.MsgMetadata
-	checkRunner *checkRunner
+	deliveries    map[module.DeliveryTarget]*delivery
+	deferredRcpts []deferredRcpt
+	msgMeta       *module.MsgMetadata
+	checkRunner   *checkRunner
+
+	// Envelope as it was received by the pipeline, used if checks are
+	// deferred using the defer_internally action and for journal copies.
+	originalFrom  string
+	acceptedRcpts []string
 }
 
 func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
@@ -311,7 +339,9 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 		return wrapErr(err)
 	}
 
-	if rcptBlock.rejectErr != nil {
+	// If there are routing rules, reject directive applies only if none
+	// of them match.
+	if rcptBlock.rejectErr != nil && len(rcptBlock.rules) == 0 {
 		return wrapErr(rcptBlock.rejectErr)
 	}
 
@@ -332,22 +362,40 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 	dd.log.Debugln("per-rcpt modifiers:", to, "=>", newTo)
 	to = newTo
 
-	wrapErr = func(err error) error {
-		return exterrors.WithFields(err, map[string]interface{}{
-			"effective_rcpt": to,
+	if originalTo != to {
+		dd.msgMeta.OriginalRcpts[to] = originalTo
+	}
+
+	if len(rcptBlock.rules) != 0 {
+		dd.deferredRcpts = append(dd.deferredRcpts, deferredRcpt{
+			block:      rcptBlock,
+			to:         to,
+			originalTo: originalTo,
 		})
+		dd.acceptedRcpts = append(dd.acceptedRcpts, originalTo)
+		return nil
 	}
 
-	if originalTo != to {
-		dd.msgMeta.OriginalRcpts[to] = originalTo
+	if err := dd.addRcptToTargets(ctx, rcptBlock.targets, to, originalTo); err != nil {
+		return err
 	}
+	dd.acceptedRcpts = append(dd.acceptedRcpts, originalTo)
+	return nil
+}
+
+func wrapRcptErr(err error, to string) error {
+	return exterrors.WithFields(err, map[string]interface{}{
+		"effective_rcpt": to,
+	})
+}
 
-	for _, tgt := range rcptBlock.targets {
+func (dd *msgpipelineDelivery) addRcptToTargets(ctx context.Context, targets []module.DeliveryTarget, to, originalTo string) error {
+	for _, tgt := range targets {
 		// Do not wrap errors coming from nested pipeline target delivery since
 		// that pipeline itself will insert effective_rcpt field and could do
 		// its own rewriting - we do not want to hide it from the admin in
 		// error messages.
-		wrapErr := wrapErr
+		wrapErr := func(err error) error { return wrapRcptErr(err, to) }
 		if _, ok := tgt.(*MsgPipeline); ok {
 			wrapErr = func(err error) error { return err }
 		}
@@ -391,10 +439,24 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		header.Add("Received", received)
 	}
 
+	if dd.checkRunner.deferErr != nil {
+		return dd.deferToTarget(ctx, header, body)
+	}
+
 	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header); err != nil {
 		return err
 	}
 
+	deferredBlocks, err := dd.selectDeferred(ctx, &header, body)
+	if err != nil {
+		return err
+	}
+	for i, rcpt := range dd.deferredRcpts {
+		if err := dd.routeDeferred(ctx, deferredBlocks[i], rcpt); err != nil {
+			return err
+		}
+	}
+
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
 	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
@@ -409,6 +471,8 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		}
 	}
 
+	dd.startJournal(ctx, header, body)
+
 	for _, delivery := range dd.deliveries {
 		if err := delivery.Body(ctx, header, body); err != nil {
 			return err
@@ -446,6 +510,9 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 				c.SetStatus(rcpt, err)
 			}
 		}
+		for _, rcpt := range dd.deferredRcpts {
+			c.SetStatus(rcpt.originalTo, err)
+		}
 	}
 
 	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
@@ -457,6 +524,29 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		return
 	}
 
+	if dd.checkRunner.deferErr != nil {
+		err := dd.deferToTarget(ctx, header, body)
+		for _, rcpt := range dd.acceptedRcpts {
+			c.SetStatus(rcpt, err)
+		}
+		return
+	}
+
+	// Rules and late checks should see the message the same way as in Body,
+	// before modifiers are applied.
+	deferredBlocks, err := dd.selectDeferred(ctx, &header, body)
+	if err != nil {
+		for _, rcpt := range dd.deferredRcpts {
+			c.SetStatus(rcpt.originalTo, err)
+		}
+		dd.deferredRcpts = nil
+	}
+	for i, rcpt := range dd.deferredRcpts {
+		if err := dd.routeDeferred(ctx, deferredBlocks[i], rcpt); err != nil {
+			c.SetStatus(rcpt.originalTo, err)
+		}
+	}
+
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
 	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
@@ -474,6 +564,8 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		}
 	}
 
+	dd.startJournal(ctx, header, body)
+
 	for _, delivery := range dd.deliveries {
 		partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
 		if ok {
@@ -0,0 +1,106 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// rule is a condition that selects the configuration block to use for
+// recipients once the message header and check results are available.
+type rule interface {
+	match(header textproto.Header, authRes []authres.Result) bool
+	targetBlock() *rcptBlock
+	String() string
+}
+
+// parseRuleBlock parses the configuration block used if the rule matches.
+func parseRuleBlock(globals map[string]interface{}, node config.Node) (*rcptBlock, error) {
+	blk, err := parseMsgPipelineRcptCfg(globals, node.Children)
+	if err != nil {
+		return nil, err
+	}
+	if len(blk.modifiers.Modifiers) != 0 || len(blk.rules) != 0 {
+		return nil, config.NodeErr(node, "only check, deliver_to, reroute and reject directives can be used in %s block", node.Name)
+	}
+	return blk, nil
+}
+
+// deferredRcpt is a recipient that is matched by a destination block with
+// routing rules. Targets for it are selected once the message header is
+// available.
+type deferredRcpt struct {
+	block      *rcptBlock
+	to         string
+	originalTo string
+}
+
+// selectDeferred selects the configuration block for each deferred recipient
+// and runs checks from the selected blocks.
+func (dd *msgpipelineDelivery) selectDeferred(ctx context.Context, header *textproto.Header, body buffer.Buffer) ([]*rcptBlock, error) {
+	blocks := make([]*rcptBlock, len(dd.deferredRcpts))
+	seenBlocks := map[*rcptBlock]struct{}{}
+	seenChecks := map[module.Check]struct{}{}
+	var checks []module.Check
+
+	for i, rcpt := range dd.deferredRcpts {
+		blk := rcpt.block
+		for _, rule := range rcpt.block.rules {
+			if rule.match(*header, dd.checkRunner.mergedRes.AuthResult) {
+				dd.log.Debugf("recipient %s matched by rule '%s'", rcpt.to, rule)
+				blk = rule.targetBlock()
+				break
+			}
+		}
+		blocks[i] = blk
+
+		if _, ok := seenBlocks[blk]; ok || blk == rcpt.block {
+			continue
+		}
+		seenBlocks[blk] = struct{}{}
+		for _, check := range blk.checks {
+			if _, ok := seenChecks[check]; ok {
+				continue
+			}
+			seenChecks[check] = struct{}{}
+			checks = append(checks, check)
+		}
+	}
+
+	if len(checks) != 0 {
+		if err := dd.checkRunner.checkBodyLate(ctx, checks, dd.d.Hostname, header, body); err != nil {
+			return nil, err
+		}
+	}
+
+	return blocks, nil
+}
+
+func (dd *msgpipelineDelivery) routeDeferred(ctx context.Context, blk *rcptBlock, rcpt deferredRcpt) error {
+	if blk.rejectErr != nil {
+		return wrapRcptErr(blk.rejectErr, rcpt.to)
+	}
+	return dd.addRcptToTargets(ctx, blk.targets, rcpt.to, rcpt.originalTo)
+}
@@ -0,0 +1,163 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	// How long greylisting entries are kept. If the message is not retried
+	// during this time, it will be deferred again.
+	greylistExpiry = 24 * time.Hour
+
+	// Maximum amount of greylisting entries, expired entries are removed
+	// once it is reached.
+	greylistMaxEntries = 100000
+)
+
+// scoring is the coordinator for score-based check actions.
+//
+// Checks contribute scores via module.CheckResult.Score (usually set using
+// the 'score' check action) and thresholds configured for the pipeline are
+// applied to the sum of all scores.
+//
+// Thresholds set to zero are disabled.
+type scoring struct {
+	greylistThres   int
+	quarantineThres int
+	rejectThres     int
+
+	greylistDelay time.Duration
+
+	greylistLck sync.Mutex
+	greylisted  map[string]time.Time
+}
+
+func parseScoring(node config.Node) (*scoring, error) {
+	s := &scoring{
+		greylisted: make(map[string]time.Time),
+	}
+
+	cfg := config.NewMap(nil, node)
+	cfg.Int("greylist", false, false, 0, &s.greylistThres)
+	cfg.Int("quarantine", false, false, 0, &s.quarantineThres)
+	cfg.Int("reject", false, false, 0, &s.rejectThres)
+	cfg.Duration("greylist_delay", false, false, 5*time.Minute, &s.greylistDelay)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if s.greylistThres == 0 && s.quarantineThres == 0 && s.rejectThres == 0 {
+		return nil, config.NodeErr(node, "at least one threshold should be set")
+	}
+
+	return s, nil
+}
+
+// checkReject applies the reject and greylist thresholds. It is called after
+// each stage of the message processing so the message can be rejected as
+// early as possible.
+func (s *scoring) checkReject(msgMeta *module.MsgMetadata, mailFrom string, score int) error {
+	if s.rejectThres != 0 && score >= s.rejectThres {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to a local policy",
+			CheckName:    "scoring",
+			Misc: map[string]interface{}{
+				"score": score,
+			},
+		}
+	}
+
+	if s.greylistThres != 0 && score >= s.greylistThres {
+		if s.greylist(msgMeta, mailFrom) {
+			return &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+				Message:      "Greylisted, please try again later",
+				CheckName:    "scoring",
+				Misc: map[string]interface{}{
+					"score": score,
+				},
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *scoring) quarantine(score int) bool {
+	return s.quarantineThres != 0 && score >= s.quarantineThres
+}
+
+// greylist reports whether the message should be deferred.
+//
+// The client IP (/24 for IPv4, /64 for IPv6 to handle server pools) and
+// the sender address are used as a key. The message is accepted if it is
+// retried after greylistDelay passes.
+func (s *scoring) greylist(msgMeta *module.MsgMetadata, mailFrom string) bool {
+	if msgMeta.Conn == nil {
+		// Locally generated message, no point in greylisting it.
+		return false
+	}
+	tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	var ipNet net.IP
+	if ipv4 := tcpAddr.IP.To4(); ipv4 != nil {
+		ipNet = ipv4.Mask(net.CIDRMask(24, 32))
+	} else {
+		ipNet = tcpAddr.IP.Mask(net.CIDRMask(64, 128))
+	}
+	key := ipNet.String() + " " + mailFrom
+
+	now := time.Now()
+
+	s.greylistLck.Lock()
+	defer s.greylistLck.Unlock()
+
+	firstSeen, ok := s.greylisted[key]
+	if ok && now.Sub(firstSeen) < greylistExpiry {
+		return now.Sub(firstSeen) < s.greylistDelay
+	}
+
+	if len(s.greylisted) >= greylistMaxEntries {
+		for k, t := range s.greylisted {
+			if now.Sub(t) >= greylistExpiry {
+				delete(s.greylisted, k)
+			}
+		}
+		if len(s.greylisted) >= greylistMaxEntries {
+			s.greylisted = make(map[string]time.Time)
+		}
+	}
+	s.greylisted[key] = now
+
+	return true
+}
@@ -0,0 +1,155 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func scoringPipeline(t *testing.T, s *scoring, target *testutils.Target, checks ...module.Check) *MsgPipeline {
+	return &MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: checks,
+			scoring:      s,
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+}
+
+func TestMsgPipeline_Scoring(t *testing.T) {
+	test := func(connScore, bodyScore int, reject, quarantine bool) {
+		t.Helper()
+
+		target := testutils.Target{}
+		check1 := testutils.Check{
+			ConnRes: module.CheckResult{
+				Reason: errors.New("check1"),
+				Score:  connScore,
+			},
+		}
+		check2 := testutils.Check{
+			BodyRes: module.CheckResult{
+				Reason: errors.New("check2"),
+				Score:  bodyScore,
+			},
+		}
+		d := scoringPipeline(t, &scoring{
+			quarantineThres: 5,
+			rejectThres:     10,
+		}, &target, &check1, &check2)
+
+		_, err := testutils.DoTestDeliveryErr(t, d, "whatever@whatever", []string{"whatever@whatever"})
+		if reject {
+			if err == nil {
+				t.Fatal("Expected message to be rejected")
+			}
+			if exterrors.IsTemporaryOrUnspec(err) {
+				t.Error("Rejection should be permanent")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if len(target.Messages) != 1 {
+			t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+		}
+		if target.Messages[0].MsgMeta.Quarantine != quarantine {
+			t.Errorf("wrong quarantine status: %v (want %v)", target.Messages[0].MsgMeta.Quarantine, quarantine)
+		}
+	}
+
+	test(0, 0, false, false)
+	test(2, 2, false, false)
+	test(3, 2, false, true)
+	test(4, 8, true, false)
+	test(10, 0, true, false)
+	test(8, -4, false, false)
+}
+
+func TestMsgPipeline_ScoringGreylist(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		SenderRes: module.CheckResult{
+			Reason: errors.New("check"),
+			Score:  5,
+		},
+	}
+	s := &scoring{
+		greylistThres: 5,
+		greylistDelay: time.Minute,
+		greylisted:    map[string]time.Time{},
+	}
+	d := scoringPipeline(t, s, &target, &check)
+
+	meta := func(ip net.IP) *module.MsgMetadata {
+		return &module.MsgMetadata{
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: &net.TCPAddr{IP: ip, Port: 25},
+				},
+			},
+		}
+	}
+
+	_, err := testutils.DoTestDeliveryErrMeta(t, d, "test@example.org", []string{"rcpt@example.com"}, meta(net.IPv4(1, 2, 3, 4)))
+	if err == nil || !exterrors.IsTemporary(err) {
+		t.Fatal("Expected message to be deferred, got", err)
+	}
+
+	// Retry too early.
+	_, err = testutils.DoTestDeliveryErrMeta(t, d, "test@example.org", []string{"rcpt@example.com"}, meta(net.IPv4(1, 2, 3, 5)))
+	if err == nil || !exterrors.IsTemporary(err) {
+		t.Fatal("Expected message to be deferred, got", err)
+	}
+
+	for k := range s.greylisted {
+		s.greylisted[k] = time.Now().Add(-2 * time.Minute)
+	}
+
+	// Retry from the different IP from the same /24 network.
+	_, err = testutils.DoTestDeliveryErrMeta(t, d, "test@example.org", []string{"rcpt@example.com"}, meta(net.IPv4(1, 2, 3, 5)))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+
+	// Different sender is greylisted separately.
+	_, err = testutils.DoTestDeliveryErrMeta(t, d, "test2@example.org", []string{"rcpt@example.com"}, meta(net.IPv4(1, 2, 3, 4)))
+	if err == nil || !exterrors.IsTemporary(err) {
+		t.Fatal("Expected message to be deferred, got", err)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netset"
+)
+
+// upstreamAuthres contains the configuration for consuming authentication
+// results from trusted relays.
+type upstreamAuthres struct {
+	nets *netset.Set
+	ids  map[string]struct{}
+}
+
+func parseUpstreamAuthres(globals map[string]interface{}, node config.Node) (*upstreamAuthres, error) {
+	var (
+		u   = &upstreamAuthres{ids: map[string]struct{}{}}
+		ids []string
+	)
+
+	cfg := config.NewMap(globals, node)
+	cfg.Custom("trusted_networks", true, true, nil, netset.Directive, &u.nets)
+	cfg.StringList("authserv_id", false, true, nil, &ids)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		u.ids[strings.ToLower(id)] = struct{}{}
+	}
+
+	return u, nil
+}
+
+// trusted reports whether the message is received from one of trusted
+// relays.
+func (u *upstreamAuthres) trusted(msgMeta *module.MsgMetadata) bool {
+	if msgMeta.Conn == nil {
+		return false
+	}
+	return u.nets.ContainsAddr(msgMeta.Conn.RemoteAddr)
+}
+
+// results extracts the authentication results from the topmost
+// Authentication-Results field added by the trusted relay. Fields with other
+// authserv-id values are ignored.
+func (u *upstreamAuthres) results(header textproto.Header) []authres.Result {
+	for field := header.FieldsByKey("Authentication-Results"); field.Next(); {
+		id, results, err := authres.Parse(field.Value())
+		if err != nil {
+			// Probably added by the relay as well, but we can't be sure.
+			continue
+		}
+		if _, ok := u.ids[strings.ToLower(id)]; !ok {
+			continue
+		}
+		return results
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netset"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestUpstreamAuthres(t *testing.T) {
+	const hdr = "Authentication-Results: mx.example.com; dkim=fail header.d=example.org\r\n" +
+		"Authentication-Results: relay.example.net; spf=fail smtp.mailfrom=example.org;\r\n" +
+		" dkim=pass header.d=example.org; dmarc=fail header.from=example.org\r\n" +
+		"From: hello@example.org\r\n\r\n"
+
+	test := func(remoteIP string, trusted bool, dmarcRes authres.ResultValue) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		p := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+				doDMARC: true,
+				upstreamAuthres: &upstreamAuthres{
+					nets: netset.Networks(net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}),
+					ids:  map[string]struct{}{"relay.example.net": {}},
+				},
+			},
+			Log: testutils.Logger(t, "pipeline"),
+			Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+				"_dmarc.example.org.": {
+					TXT: []string{"v=DMARC1; p=reject"},
+				},
+			}},
+		}
+
+		msgMeta := &module.MsgMetadata{
+			ID: "upstream_authres",
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: &net.TCPAddr{IP: net.ParseIP(remoteIP), Port: 25},
+				},
+			},
+		}
+		hdrParsed, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdr)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		delivery, err := p.Start(context.Background(), msgMeta, "test@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.AddRcpt(context.Background(), "test@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.Body(context.Background(), hdrParsed, buffer.MemoryBuffer{Slice: []byte("foobar")}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if err := delivery.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if msgMeta.UpstreamAuth != trusted {
+			t.Errorf("msgMeta.UpstreamAuth (%v) != trusted (%v)", msgMeta.UpstreamAuth, trusted)
+		}
+		if len(tgt.Messages) != 1 {
+			t.Fatalf("got %d messages", len(tgt.Messages))
+		}
+		if res := dmarcResult(t, tgt.Messages[0].Header); res != dmarcRes {
+			t.Errorf("expected DMARC result to be '%v', got '%v'", dmarcRes, res)
+		}
+	}
+
+	// Relay results are used, DKIM aligns => DMARC 'pass', relay DMARC result
+	// is ignored.
+	test("10.1.2.3", true, authres.ResultPass)
+	// Untrusted client, header is ignored.
+	test("192.0.2.1", false, authres.ResultNone)
+}
@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package prvs implements Bounce Address Tag Validation (BATV) using the
+// Pseudo-Random Value Signing (PRVS) scheme.
+//
+// Tagged address has the following form:
+//
+//	prvs=KDDDSSSSSS=local-part@domain
+//
+// Where K is the key number, DDD is the expiration day (days since the epoch
+// modulo 1000) and SSSSSS is the first 3 bytes of HMAC-SHA1 of K, DDD and the
+// original address.
+package prvs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+const (
+	day       = 24 * time.Hour
+	daySlots  = 1000
+	maxKeys   = 10
+	tagPrefix = "prvs="
+)
+
+var (
+	ErrMalformed    = errors.New("prvs: malformed tag")
+	ErrBadSignature = errors.New("prvs: invalid signature")
+	ErrExpired      = errors.New("prvs: tag is expired")
+)
+
+type Signer struct {
+	keys    [][]byte
+	signKey int
+	maxAge  time.Duration
+
+	Now func() time.Time
+}
+
+// New creates the Signer using specified keys. signKey is the index of the key
+// used to sign new addresses. Tagged addresses are valid for maxAge.
+func New(keys []string, signKey int, maxAge time.Duration) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("prvs: at least one key is required")
+	}
+	if len(keys) > maxKeys {
+		return nil, fmt.Errorf("prvs: at most %d keys can be used", maxKeys)
+	}
+	if signKey < 0 || signKey >= len(keys) {
+		return nil, fmt.Errorf("prvs: key %d is not defined", signKey)
+	}
+	if maxAge < day {
+		return nil, errors.New("prvs: validity period should be at least one day")
+	}
+	if maxAge >= daySlots/2*day {
+		return nil, errors.New("prvs: validity period is too long")
+	}
+
+	s := &Signer{
+		signKey: signKey,
+		maxAge:  maxAge,
+		Now:     time.Now,
+	}
+	for _, key := range keys {
+		s.keys = append(s.keys, []byte(key))
+	}
+	return s, nil
+}
+
+func (s *Signer) today() int {
+	return int(s.Now().Unix() / int64(day/time.Second))
+}
+
+func (s *Signer) hash(key int, expiry, addr string) string {
+	mac := hmac.New(sha1.New, s.keys[key])
+	mac.Write([]byte(strconv.Itoa(key)))
+	mac.Write([]byte(expiry))
+	mac.Write([]byte(addr))
+	return hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+// isTagged reports whether the address has the PRVS tag.
+func isTagged(addr string) bool {
+	return len(addr) >= len(tagPrefix) && strings.EqualFold(addr[:len(tagPrefix)], tagPrefix)
+}
+
+// split splits the tagged address into the tag value and the original
+// address.
+func split(addr string) (tag, orig string, err error) {
+	if !isTagged(addr) {
+		return "", addr, nil
+	}
+	parts := strings.SplitN(addr[len(tagPrefix):], "=", 2)
+	if len(parts) != 2 || len(parts[0]) != 10 {
+		return "", "", ErrMalformed
+	}
+	return parts[0], parts[1], nil
+}
+
+// Sign adds the PRVS tag to the address. Addresses that are already tagged
+// are returned as is.
+func (s *Signer) Sign(addr string) (string, error) {
+	if isTagged(addr) {
+		return addr, nil
+	}
+	if _, _, err := address.Split(addr); err != nil {
+		return "", err
+	}
+
+	expiry := fmt.Sprintf("%03d", (s.today()+int(s.maxAge/day))%daySlots)
+	return tagPrefix + strconv.Itoa(s.signKey) + expiry + s.hash(s.signKey, expiry, addr) + "=" + addr, nil
+}
+
+// Verify checks the PRVS tag of the address and returns the original address.
+// Addresses without a tag are returned as is with tagged = false.
+func (s *Signer) Verify(addr string) (orig string, tagged bool, err error) {
+	tag, orig, err := split(addr)
+	if err != nil {
+		return "", true, err
+	}
+	if tag == "" {
+		return addr, false, nil
+	}
+
+	key := int(tag[0] - '0')
+	if key < 0 || key >= len(s.keys) {
+		return "", true, ErrBadSignature
+	}
+	expiry := tag[1:4]
+	expiryDay, err := strconv.Atoi(expiry)
+	if err != nil {
+		return "", true, ErrMalformed
+	}
+
+	if !hmac.Equal([]byte(strings.ToLower(tag[4:])), []byte(s.hash(key, expiry, orig))) {
+		return "", true, ErrBadSignature
+	}
+
+	// Days left until expiration. Values beyond the validity period mean the
+	// expiration day is in the past.
+	left := (expiryDay - s.today()%daySlots + daySlots) % daySlots
+	if time.Duration(left)*day > s.maxAge {
+		return "", true, ErrExpired
+	}
+
+	return orig, true, nil
+}
@@ -0,0 +1,90 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package prvs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSigner(t *testing.T, now time.Time, signKey int, keys ...string) *Signer {
+	t.Helper()
+	s, err := New(keys, signKey, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Now = func() time.Time { return now }
+	return s
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := testSigner(t, now, 0, "secret")
+
+	tagged, err := s.Sign("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("Tagged address:", tagged)
+	if !strings.HasPrefix(tagged, "prvs=0") || !strings.HasSuffix(tagged, "=test@example.org") {
+		t.Fatal("Unexpected tagged address:", tagged)
+	}
+	if again, _ := s.Sign(tagged); again != tagged {
+		t.Fatal("Tagged address is signed again:", again)
+	}
+
+	check := func(s *Signer, addr, expectOrig string, expectTagged bool, expectErr error) {
+		t.Helper()
+		orig, isTagged, err := s.Verify(addr)
+		if err != expectErr {
+			t.Fatalf("Unexpected error: %v (want %v)", err, expectErr)
+		}
+		if isTagged != expectTagged {
+			t.Fatalf("Unexpected tagged flag: %v", isTagged)
+		}
+		if orig != expectOrig {
+			t.Fatalf("Unexpected original address: %q (want %q)", orig, expectOrig)
+		}
+	}
+
+	check(s, tagged, "test@example.org", true, nil)
+	check(s, strings.ToUpper(tagged[:14])+tagged[14:], "test@example.org", true, nil)
+	check(s, "test@example.org", "test@example.org", false, nil)
+	check(s, strings.Replace(tagged, "=test@", "=admin@", 1), "", true, ErrBadSignature)
+	check(s, "prvs=garbage=test@example.org", "", true, ErrMalformed)
+	check(testSigner(t, now, 0, "other"), tagged, "", true, ErrBadSignature)
+
+	// Validity window.
+	check(testSigner(t, now.Add(6*24*time.Hour), 0, "secret"), tagged, "test@example.org", true, nil)
+	check(testSigner(t, now.Add(8*24*time.Hour), 0, "secret"), tagged, "", true, ErrExpired)
+
+	// Key rotation: old key is still accepted.
+	rotated := testSigner(t, now, 1, "secret", "new")
+	check(rotated, tagged, "test@example.org", true, nil)
+	tagged, err = rotated.Sign("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tagged, "prvs=1") {
+		t.Fatal("Unexpected tagged address:", tagged)
+	}
+	check(rotated, tagged, "test@example.org", true, nil)
+	check(s, tagged, "", true, ErrBadSignature)
+}
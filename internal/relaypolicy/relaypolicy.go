@@ -0,0 +1,268 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package relaypolicy implements the module that decides whether the SMTP
+// client is permitted to relay messages to the specified recipients.
+//
+// Policy is evaluated independently of the message pipeline, so mistakes in
+// destination rules do not turn the server into an open relay. Messages for
+// local domains are always accepted. Messages for other domains are accepted
+// only if one of explicitly configured conditions is satisfied.
+package relaypolicy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netset"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/table"
+)
+
+const modName = "relay_policy"
+
+type Policy struct {
+	instName string
+	log      log.Logger
+
+	localDomains map[string]struct{}
+
+	relayAuthenticated bool
+	relayNets          *netset.Set
+
+	authorizeSender bool
+	userToEmail     module.Table
+	authNorm        func(string) (string, error)
+	fromNorm        func(string) (string, error)
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Policy{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (p *Policy) Name() string {
+	return modName
+}
+
+func (p *Policy) InstanceName() string {
+	return p.instName
+}
+
+func (p *Policy) Init(cfg *config.Map) error {
+	var (
+		localDomains  []string
+		authNormalize string
+		fromNormalize string
+		ok            bool
+	)
+
+	cfg.Bool("debug", true, false, &p.log.Debug)
+	cfg.StringList("local_domains", false, true, nil, &localDomains)
+	cfg.Callback("allow_relay", func(m *config.Map, node config.Node) error {
+		return p.addRelayCondition(m, node)
+	})
+	cfg.Bool("authorize_sender", false, true, &p.authorizeSender)
+	cfg.Custom("user_to_email", false, false, func() (interface{}, error) {
+		return &table.Identity{}, nil
+	}, modconfig.TableDirective, &p.userToEmail)
+	cfg.String("auth_normalize", false, false,
+		"precis_casefold_email", &authNormalize)
+	cfg.String("from_normalize", false, false,
+		"precis_casefold_email", &fromNormalize)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	p.localDomains = make(map[string]struct{}, len(localDomains))
+	for _, d := range localDomains {
+		dNorm, err := dns.ForLookup(d)
+		if err != nil {
+			return fmt.Errorf("%s: malformed domain %s: %w", modName, d, err)
+		}
+		p.localDomains[dNorm] = struct{}{}
+	}
+
+	p.authNorm, ok = authz.NormalizeFuncs[authNormalize]
+	if !ok {
+		return fmt.Errorf("%s: unknown normalization function: %v", modName, authNormalize)
+	}
+	p.fromNorm, ok = authz.NormalizeFuncs[fromNormalize]
+	if !ok {
+		return fmt.Errorf("%s: unknown normalization function: %v", modName, fromNormalize)
+	}
+
+	return nil
+}
+
+func (p *Policy) addRelayCondition(m *config.Map, node config.Node) error {
+	if len(node.Args) == 0 {
+		return config.NodeErr(node, "relay condition is required")
+	}
+
+	switch node.Args[0] {
+	case "authenticated":
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "unexpected arguments for 'authenticated' condition")
+		}
+		p.relayAuthenticated = true
+	case "ip":
+		netNode := node
+		netNode.Args = node.Args[1:]
+		nets, err := netset.Directive(m, netNode)
+		if err != nil {
+			return err
+		}
+		p.relayNets = p.relayNets.Union(nets.(*netset.Set))
+	default:
+		return config.NodeErr(node, "unknown relay condition: %s", node.Args[0])
+	}
+	return nil
+}
+
+// relayAllowed reports whether the client is permitted to send messages to
+// non-local domains. The returned string describes the matched condition.
+func (p *Policy) relayAllowed(conn *module.ConnState) (bool, string) {
+	if conn == nil {
+		return false, ""
+	}
+	if p.relayAuthenticated && conn.AuthUser != "" {
+		return true, "authenticated"
+	}
+	if p.relayNets.ContainsAddr(conn.RemoteAddr) {
+		return true, "ip"
+	}
+	return false, ""
+}
+
+// IsLocal reports whether the recipient address belongs to one of local
+// domains.
+func (p *Policy) IsLocal(rcpt string) (bool, error) {
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return false, err
+	}
+	// RFC 5321 postmaster address without the domain.
+	if domain == "" {
+		return true, nil
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return false, err
+	}
+	_, ok := p.localDomains[domain]
+	return ok, nil
+}
+
+// CheckSender checks whether the client is authorized to use the sender
+// address. nil is returned if it is.
+//
+// Only authenticated clients are checked. Null return-path is always
+// permitted.
+func (p *Policy) CheckSender(ctx context.Context, conn *module.ConnState, from string) error {
+	if !p.authorizeSender || from == "" || conn == nil || conn.AuthUser == "" {
+		return nil
+	}
+
+	fromNorm, err := p.fromNorm(from)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 7},
+			Message:      "Unable to normalize sender address",
+			Err:          err,
+		}
+	}
+	authNorm, err := p.authNorm(conn.AuthUser)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         535,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 8},
+			Message:      "Unable to normalize authorization username",
+			Err:          err,
+		}
+	}
+
+	ok, err := authz.AuthorizeEmailUse(ctx, authNorm, fromNorm, p.userToEmail)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         454,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during policy check",
+			Err:          err,
+		}
+	}
+	if !ok {
+		return &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+			Message:      "Unauthorized use of sender address",
+			Misc: map[string]interface{}{
+				"username": conn.AuthUser,
+			},
+		}
+	}
+	return nil
+}
+
+// CheckRcpt checks whether the message can be accepted for the recipient.
+// nil is returned if it can.
+//
+// Recipients in local domains are always accepted. Other recipients are
+// accepted only if the client satisfies one of allow_relay conditions.
+func (p *Policy) CheckRcpt(ctx context.Context, conn *module.ConnState, rcpt string) error {
+	local, err := p.IsLocal(rcpt)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         501,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 3},
+			Message:      "Malformed recipient address",
+			Err:          err,
+		}
+	}
+	if local {
+		return nil
+	}
+
+	if ok, cond := p.relayAllowed(conn); ok {
+		p.log.DebugMsg("relay allowed", "rcpt", rcpt, "condition", cond)
+		return nil
+	}
+
+	return &exterrors.SMTPError{
+		Code:         554,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Relay access denied",
+	}
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,169 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package relaypolicy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netset"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testPolicy(t *testing.T, globals map[string]interface{}, children []config.Node) *Policy {
+	t.Helper()
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := mod.(*Policy)
+	if err := p.Init(config.NewMap(globals, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	p.log = testutils.Logger(t, modName)
+	return p
+}
+
+func conn(ip, authUser string) *module.ConnState {
+	return &module.ConnState{
+		ConnectionState: smtp.ConnectionState{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345},
+		},
+		AuthUser: authUser,
+	}
+}
+
+func expectCode(t *testing.T, err error, code int) {
+	t.Helper()
+	if code == 0 {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	smtpErr, ok := err.(*exterrors.SMTPError)
+	if !ok {
+		t.Fatalf("expected SMTPError with code %d, got %v", code, err)
+	}
+	if smtpErr.Code != code {
+		t.Fatalf("wrong error code: %d (%s)", smtpErr.Code, smtpErr.Message)
+	}
+}
+
+func TestCheckRcpt(t *testing.T) {
+	globalsMap := config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "trusted_networks", Args: []string{"10.0.0.0/8"}},
+	}})
+	netset.GlobalDirectives(globalsMap)
+	if _, err := globalsMap.Process(); err != nil {
+		t.Fatal(err)
+	}
+	p := testPolicy(t, globalsMap.Values, []config.Node{
+		{Name: "local_domains", Args: []string{"example.org", "EXAMPLE.net"}},
+		{Name: "allow_relay", Args: []string{"authenticated"}},
+		{Name: "allow_relay", Args: []string{"ip", "&trusted_networks", "192.0.2.1"}},
+	})
+
+	for _, c := range []struct {
+		name string
+		conn *module.ConnState
+		rcpt string
+		code int
+	}{
+		{"local", conn("203.0.113.1", ""), "user@example.org", 0},
+		{"local case", conn("203.0.113.1", ""), "user@Example.NET", 0},
+		{"postmaster", conn("203.0.113.1", ""), "postmaster", 0},
+		{"open relay", conn("203.0.113.1", ""), "user@example.com", 554},
+		{"authenticated", conn("203.0.113.1", "user"), "user@example.com", 0},
+		{"trusted network", conn("10.1.2.3", ""), "user@example.com", 0},
+		{"listed ip", conn("192.0.2.1", ""), "user@example.com", 0},
+		{"no conn", nil, "user@example.com", 554},
+		{"malformed", conn("203.0.113.1", ""), "@example.org", 501},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			expectCode(t, p.CheckRcpt(context.Background(), c.conn, c.rcpt), c.code)
+		})
+	}
+}
+
+func TestCheckRcpt_NoConditions(t *testing.T) {
+	p := testPolicy(t, nil, []config.Node{
+		{Name: "local_domains", Args: []string{"example.org"}},
+	})
+
+	expectCode(t, p.CheckRcpt(context.Background(), conn("127.0.0.1", "user"), "user@example.com"), 554)
+	expectCode(t, p.CheckRcpt(context.Background(), conn("127.0.0.1", ""), "user@example.org"), 0)
+}
+
+func TestCheckSender(t *testing.T) {
+	p := testPolicy(t, nil, []config.Node{
+		{Name: "local_domains", Args: []string{"example.org"}},
+		{Name: "allow_relay", Args: []string{"authenticated"}},
+	})
+
+	expectCode(t, p.CheckSender(context.Background(), conn("127.0.0.1", "user@example.org"), "user@example.org"), 0)
+	expectCode(t, p.CheckSender(context.Background(), conn("127.0.0.1", "user@example.org"), "USER@example.org"), 0)
+	expectCode(t, p.CheckSender(context.Background(), conn("127.0.0.1", "user@example.org"), "other@example.org"), 553)
+	expectCode(t, p.CheckSender(context.Background(), conn("127.0.0.1", "user@example.org"), ""), 0)
+	// Unauthenticated senders are not checked.
+	expectCode(t, p.CheckSender(context.Background(), conn("127.0.0.1", ""), "other@example.org"), 0)
+
+	p.authorizeSender = false
+	expectCode(t, p.CheckSender(context.Background(), conn("127.0.0.1", "user@example.org"), "other@example.org"), 0)
+}
+
+func TestInit_Errors(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		children []config.Node
+	}{
+		{"no local_domains", nil},
+		{"unknown condition", []config.Node{
+			{Name: "local_domains", Args: []string{"example.org"}},
+			{Name: "allow_relay", Args: []string{"everyone"}},
+		}},
+		{"missing condition", []config.Node{
+			{Name: "local_domains", Args: []string{"example.org"}},
+			{Name: "allow_relay"},
+		}},
+		{"no networks", []config.Node{
+			{Name: "local_domains", Args: []string{"example.org"}},
+			{Name: "allow_relay", Args: []string{"ip"}},
+		}},
+		{"unknown network set", []config.Node{
+			{Name: "local_domains", Args: []string{"example.org"}},
+			{Name: "allow_relay", Args: []string{"ip", "&missing"}},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			mod, err := New(modName, "", nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mod.Init(config.NewMap(nil, config.Node{Children: c.children})); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
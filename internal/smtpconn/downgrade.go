@@ -0,0 +1,216 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtpconn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// maxDowngradeDepth is the maximum nesting level of MIME entities
+// processed by downgrade8Bit.
+const maxDowngradeDepth = 20
+
+var errCannotDowngrade = errors.New("smtpconn: message cannot be converted to 7-bit form")
+
+// has8Bit reports whether b contains any bytes outside of the US-ASCII range.
+func has8Bit(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// readerHas8Bit reports whether r contains any bytes outside of the US-ASCII
+// range. It stops reading at the first such byte.
+func readerHas8Bit(r io.Reader) (bool, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if has8Bit(buf[:n]) {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// headerHas8Bit reports whether any of the header fields contains bytes
+// outside of the US-ASCII range.
+func headerHas8Bit(hdr textproto.Header) bool {
+	fields := hdr.Fields()
+	for fields.Next() {
+		if has8Bit([]byte(fields.Key())) || has8Bit([]byte(fields.Value())) {
+			return true
+		}
+	}
+	return false
+}
+
+// downgrade8Bit converts the message body into the 7-bit form by applying
+// the quoted-printable (for text/*) or base64 (for everything else)
+// transfer encoding to the MIME parts containing 8-bit data, as
+// described in RFC 6152, Section 3.
+//
+// hdr is modified in-place if the top-level entity needs a different
+// Content-Transfer-Encoding. Preamble and epilogue of multipart entities
+// are not preserved.
+func downgrade8Bit(hdr *textproto.Header, body []byte) ([]byte, error) {
+	return downgradeEntity(hdr, body, 0)
+}
+
+func downgradeEntity(hdr *textproto.Header, body []byte, depth int) ([]byte, error) {
+	if depth > maxDowngradeDepth {
+		return nil, fmt.Errorf("%w: MIME nesting is too deep", errCannotDowngrade)
+	}
+	// Header fields cannot be converted without applying RFC 2047 encoding
+	// and that is not something we can do reliably for arbitrary fields.
+	if headerHas8Bit(*hdr) {
+		return nil, fmt.Errorf("%w: 8-bit data in the header", errCannotDowngrade)
+	}
+	if !has8Bit(body) {
+		return body, nil
+	}
+
+	mhdr := message.Header{Header: *hdr}
+	mediaType, params, _ := mhdr.ContentType()
+	enc := strings.ToLower(strings.TrimSpace(hdr.Get("Content-Transfer-Encoding")))
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		out, err := downgradeMultipart(body, params["boundary"], depth)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Del("Content-Transfer-Encoding")
+		return out, nil
+	case mediaType == "message/rfc822":
+		br := bufio.NewReader(bytes.NewReader(body))
+		innerHdr, err := textproto.ReadHeader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errCannotDowngrade, err)
+		}
+		innerBody, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		innerBody, err = downgradeEntity(&innerHdr, innerBody, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := textproto.WriteHeader(&buf, innerHdr); err != nil {
+			return nil, err
+		}
+		buf.Write(innerBody)
+		hdr.Del("Content-Transfer-Encoding")
+		return buf.Bytes(), nil
+	}
+
+	switch enc {
+	case "", "7bit", "8bit", "binary":
+	default:
+		return nil, fmt.Errorf("%w: 8-bit data with %s encoding", errCannotDowngrade, enc)
+	}
+
+	var buf bytes.Buffer
+	if strings.HasPrefix(mediaType, "text/") || mediaType == "" {
+		qpw := quotedprintable.NewWriter(&buf)
+		if _, err := qpw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := qpw.Close(); err != nil {
+			return nil, err
+		}
+		hdr.Set("Content-Transfer-Encoding", "quoted-printable")
+	} else {
+		encoded := base64.StdEncoding.EncodeToString(body)
+		for len(encoded) > 76 {
+			buf.WriteString(encoded[:76])
+			buf.WriteString("\r\n")
+			encoded = encoded[76:]
+		}
+		buf.WriteString(encoded)
+		buf.WriteString("\r\n")
+		hdr.Set("Content-Transfer-Encoding", "base64")
+	}
+	return buf.Bytes(), nil
+}
+
+func downgradeMultipart(body []byte, boundary string, depth int) ([]byte, error) {
+	if boundary == "" {
+		return nil, fmt.Errorf("%w: multipart entity without boundary", errCannotDowngrade)
+	}
+
+	var buf bytes.Buffer
+	mr := textproto.NewMultipartReader(bytes.NewReader(body), boundary)
+	mw := textproto.NewMultipartWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCannotDowngrade, err)
+	}
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errCannotDowngrade, err)
+		}
+
+		partBody, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errCannotDowngrade, err)
+		}
+		partHdr := p.Header
+		partBody, err = downgradeEntity(&partHdr, partBody, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		pw, err := mw.CreatePart(partHdr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(partBody); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
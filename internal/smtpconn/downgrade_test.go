@@ -0,0 +1,231 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtpconn
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+func doDowngrade(t *testing.T, msg string) (textproto.Header, []byte) {
+	t.Helper()
+
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := downgrade8Bit(&hdr, body)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if has8Bit(out) {
+		t.Fatalf("8-bit data left after downgrade:\n%s", out)
+	}
+	return hdr, out
+}
+
+func TestDowngrade8Bit_Text(t *testing.T) {
+	hdr, body := doDowngrade(t, "Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Transfer-Encoding: 8bit\r\n"+
+		"\r\n"+
+		"Привет, мир!\r\n")
+
+	if enc := hdr.Get("Content-Transfer-Encoding"); enc != "quoted-printable" {
+		t.Fatal("wrong encoding:", enc)
+	}
+	ent, err := message.New(message.Header{Header: hdr}, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ioutil.ReadAll(ent.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != "Привет, мир!\r\n" {
+		t.Fatalf("wrong decoded body: %q", decoded)
+	}
+}
+
+func TestDowngrade8Bit_7Bit(t *testing.T) {
+	const body = "Hello!\r\n"
+	hdr, out := doDowngrade(t, "Content-Type: text/plain\r\n"+
+		"\r\n"+
+		body)
+
+	if hdr.Has("Content-Transfer-Encoding") {
+		t.Fatal("Content-Transfer-Encoding should not be added")
+	}
+	if string(out) != body {
+		t.Fatalf("body changed: %q", out)
+	}
+}
+
+func TestDowngrade8Bit_Multipart(t *testing.T) {
+	hdr, body := doDowngrade(t, "Content-Type: multipart/mixed; boundary=BOUNDARY\r\n"+
+		"Content-Transfer-Encoding: 8bit\r\n"+
+		"\r\n"+
+		"--BOUNDARY\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"Текст\r\n"+
+		"--BOUNDARY\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"ASCII text\r\n"+
+		"--BOUNDARY\r\n"+
+		"Content-Type: application/octet-stream\r\n"+
+		"Content-Transfer-Encoding: binary\r\n"+
+		"\r\n"+
+		"\xff\xfe\xfd\r\n"+
+		"--BOUNDARY--\r\n")
+
+	if hdr.Has("Content-Transfer-Encoding") {
+		t.Fatal("Content-Transfer-Encoding should be removed for multipart")
+	}
+
+	ent, err := message.New(message.Header{Header: hdr}, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		encodings []string
+		bodies    []string
+	)
+	err = ent.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(path) == 0 {
+			return nil
+		}
+		b, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		encodings = append(encodings, part.Header.Get("Content-Transfer-Encoding"))
+		bodies = append(bodies, string(b))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantEnc := []string{"quoted-printable", "", "base64"}
+	wantBodies := []string{"Текст", "ASCII text", "\xff\xfe\xfd"}
+	if len(encodings) != len(wantEnc) {
+		t.Fatalf("wrong amount of parts: %d", len(encodings))
+	}
+	for i := range wantEnc {
+		if encodings[i] != wantEnc[i] {
+			t.Errorf("part %d: wrong encoding: %q", i, encodings[i])
+		}
+		if bodies[i] != wantBodies[i] {
+			t.Errorf("part %d: wrong body: %q", i, bodies[i])
+		}
+	}
+}
+
+func TestDowngrade8Bit_EmbeddedMessage(t *testing.T) {
+	_, body := doDowngrade(t, "Content-Type: message/rfc822\r\n"+
+		"\r\n"+
+		"Subject: test\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"Текст\r\n")
+
+	if !strings.Contains(string(body), "Content-Transfer-Encoding: quoted-printable") {
+		t.Fatalf("embedded message is not converted:\n%s", body)
+	}
+}
+
+func TestDowngrade8Bit_Impossible(t *testing.T) {
+	for _, msg := range []string{
+		// 8-bit data in the already encoded part.
+		"Content-Type: text/plain\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Текст\r\n",
+		// 8-bit header of the multipart body part.
+		"Content-Type: multipart/mixed; boundary=BOUND\r\n" +
+			"\r\n" +
+			"--BOUND\r\n" +
+			"Content-Type: text/plain; name=\"Тест.txt\"\r\n" +
+			"\r\n" +
+			"Text\r\n" +
+			"--BOUND--\r\n",
+		// 8-bit top-level header.
+		"Subject: Тест\r\n" +
+			"\r\n" +
+			"Text\r\n",
+		// 8-bit header of the embedded message.
+		"Content-Type: message/rfc822\r\n" +
+			"\r\n" +
+			"Subject: Тест\r\n" +
+			"\r\n" +
+			"Текст\r\n",
+	} {
+		br := bufio.NewReader(strings.NewReader(msg))
+		hdr, err := textproto.ReadHeader(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := downgrade8Bit(&hdr, body); !errors.Is(err, errCannotDowngrade) {
+			t.Errorf("expected errCannotDowngrade, got %v", err)
+		}
+	}
+}
+
+func TestSeekerHas8Bit(t *testing.T) {
+	for _, case_ := range []struct {
+		body   string
+		is8Bit bool
+	}{
+		{"Text\r\n", false},
+		{"Text\r\nТекст\r\n", true},
+		{strings.Repeat("a", 64*1024) + "Т", true},
+	} {
+		r := strings.NewReader(case_.body)
+		is8Bit, err := seekerHas8Bit(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if is8Bit != case_.is8Bit {
+			t.Errorf("expected %v, got %v", case_.is8Bit, is8Bit)
+		}
+		if r.Len() != len(case_.body) {
+			t.Errorf("reader position is not restored")
+		}
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtpconn
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc is the signature of the function used to establish connections,
+// such as net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ProxyDialer returns the function that establishes connections through the
+// proxy specified by the URL.
+//
+// Supported schemes are socks5 and http (HTTP CONNECT method). Credentials
+// for the proxy are taken from the URL userinfo.
+//
+// If remoteDNS is true, host names are passed to the proxy as is. Otherwise
+// they are resolved locally using the resolver and the proxy is given only
+// IP addresses.
+func ProxyDialer(proxyURL *url.URL, forward DialFunc, remoteDNS bool, resolver dns.Resolver) (DialFunc, error) {
+	var dial DialFunc
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			pass, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{
+				User:     proxyURL.User.Username(),
+				Password: pass,
+			}
+		}
+		d, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, forwardDialer(forward))
+		if err != nil {
+			return nil, err
+		}
+		dial = d.(proxy.ContextDialer).DialContext
+	case "http":
+		dial = (&httpConnectDialer{
+			proxyAddr: proxyURL.Host,
+			user:      proxyURL.User,
+			forward:   forward,
+		}).DialContext
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+
+	if remoteDNS {
+		return dial, nil
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialResolved(ctx, resolver, dial, network, addr)
+	}, nil
+}
+
+// dialResolved resolves the host name locally and tries to connect to each
+// of the resulting addresses in order.
+func dialResolved(ctx context.Context, resolver dns.Resolver, dial DialFunc, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dial(ctx, network, addr)
+	}
+
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dial(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+type forwardDialer DialFunc
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// httpConnectDialer establishes connections using HTTP CONNECT method
+// (RFC 7231 Section 4.3.6).
+type httpConnectDialer struct {
+	proxyAddr string
+	user      *url.Userinfo
+	forward   DialFunc
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.user != nil {
+		pass, _ := d.user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Server might have sent the greeting already and it might be buffered
+	// in br.
+	return bufferedConn{Conn: conn, r: br}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ProxyDirective is a config.Map.Custom callback that parses the proxy URL
+// for use with ProxyDialer.
+func ProxyDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+	u, err := url.Parse(node.Args[0])
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, config.NodeErr(node, "unsupported proxy scheme: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, config.NodeErr(node, "proxy address is required")
+	}
+	if u.Port() == "" {
+		return nil, config.NodeErr(node, "proxy port is required")
+	}
+	return u, nil
+}
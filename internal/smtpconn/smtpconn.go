@@ -24,14 +24,17 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 // - Logging of certain errors (e.g. QUIT command errors)
 // - Wrapping of returned errors using the exterrors package.
 // - SMTPUTF8/IDNA support.
+// - 8BITMIME downgrade.
 // - TLS support mode (don't use, attempt, require).
 package smtpconn
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net"
 	"runtime/trace"
 	"time"
@@ -78,6 +81,11 @@ type C struct {
 	// "ADDRESS said: ..."
 	AddrInSMTPMsg bool
 
+	// Convert message bodies containing 8-bit data into the 7-bit form if
+	// the remote server does not support 8BITMIME. If false, such messages
+	// are rejected with a temporary error. Set to true by New.
+	Downgrade8Bit bool
+
 	serverName string
 	cl         *smtp.Client
 	rcpts      []string
@@ -93,6 +101,7 @@ func New() *C {
 		SubmissionTimeout: 12 * time.Minute,
 		TLSConfig:         &tls.Config{},
 		Hostname:          "localhost.localdomain",
+		Downgrade8Bit:     true,
 	}
 }
 
@@ -304,6 +313,9 @@ func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error
 		}
 	}
 
+	// The connection may be reused for multiple transactions.
+	c.rcpts = nil
+
 	if err := c.cl.Mail(from, &outOpts); err != nil {
 		return c.wrapClientErr(err, c.serverName)
 	}
@@ -366,6 +378,11 @@ func (c *C) Rcpt(ctx context.Context, to string) error {
 func (c *C) Data(ctx context.Context, hdr textproto.Header, body io.Reader) error {
 	defer trace.StartRegion(ctx, "smtpconn/DATA").End()
 
+	hdr, body, err := c.prepareBody(hdr, body)
+	if err != nil {
+		return err
+	}
+
 	wc, err := c.cl.Data()
 	if err != nil {
 		return c.wrapClientErr(err, c.serverName)
@@ -386,9 +403,87 @@ func (c *C) Data(ctx context.Context, hdr textproto.Header, body io.Reader) erro
 	return nil
 }
 
+// prepareBody converts the message body into the 7-bit form if the remote
+// server does not support 8BITMIME and the message contains 8-bit data.
+//
+// If body implements io.Seeker, it is scanned in place and the message is
+// loaded into memory only if the conversion is actually needed.
+func (c *C) prepareBody(hdr textproto.Header, body io.Reader) (textproto.Header, io.Reader, error) {
+	if ok, _ := c.cl.Extension("8BITMIME"); ok {
+		return hdr, body, nil
+	}
+
+	hdr8Bit := headerHas8Bit(hdr)
+	if rs, ok := body.(io.ReadSeeker); ok && !hdr8Bit {
+		is8Bit, err := seekerHas8Bit(rs)
+		if err != nil {
+			return hdr, nil, err
+		}
+		if !is8Bit {
+			return hdr, body, nil
+		}
+	}
+
+	blob, err := ioutil.ReadAll(body)
+	if err != nil {
+		return hdr, nil, err
+	}
+	if !hdr8Bit && !has8Bit(blob) {
+		return hdr, bytes.NewReader(blob), nil
+	}
+
+	if !c.Downgrade8Bit {
+		return hdr, nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 6, 3},
+			Message:      "Remote server does not support 8BITMIME, message conversion is disabled",
+			Misc: map[string]interface{}{
+				"remote_server": c.serverName,
+			},
+		}
+	}
+
+	hdr = hdr.Copy()
+	blob, err = downgrade8Bit(&hdr, blob)
+	if err != nil {
+		return hdr, nil, &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 3},
+			Message:      "Remote server does not support 8BITMIME, message cannot be converted",
+			Misc: map[string]interface{}{
+				"remote_server": c.serverName,
+			},
+			Err: err,
+		}
+	}
+	c.Log.DebugMsg("message body converted to 7-bit form", "remote_server", c.serverName)
+	return hdr, bytes.NewReader(blob), nil
+}
+
+// seekerHas8Bit is readerHas8Bit that restores the rs position afterwards.
+func seekerHas8Bit(rs io.ReadSeeker) (bool, error) {
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	is8Bit, err := readerHas8Bit(rs)
+	if err != nil {
+		return false, err
+	}
+	if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+		return false, err
+	}
+	return is8Bit, nil
+}
+
 func (c *C) LMTPData(ctx context.Context, hdr textproto.Header, body io.Reader, statusCb func(string, *smtp.SMTPError)) error {
 	defer trace.StartRegion(ctx, "smtpconn/LMTPDATA").End()
 
+	hdr, body, err := c.prepareBody(hdr, body)
+	if err != nil {
+		return err
+	}
+
 	wc, err := c.cl.LMTPData(statusCb)
 	if err != nil {
 		return c.wrapClientErr(err, c.serverName)
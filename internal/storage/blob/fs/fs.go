@@ -7,13 +7,27 @@ import (
 	"path/filepath"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/fsync"
 )
 
 // FSStore struct represents directory on FS used to store blobs.
 type FSStore struct {
 	instName string
 	root     string
+	fsync    fsync.Policy
+}
+
+// fsBlob is the module.Blob implementation that flushes the file according to
+// the configured fsync policy.
+type fsBlob struct {
+	*os.File
+	fsync *fsync.Policy
+}
+
+func (b fsBlob) Sync() error {
+	return b.fsync.File(b.File)
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -27,16 +41,17 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	}
 }
 
-func (s FSStore) Name() string {
+func (s *FSStore) Name() string {
 	return "storage.blob.fs"
 }
 
-func (s FSStore) InstanceName() string {
+func (s *FSStore) InstanceName() string {
 	return s.instName
 }
 
 func (s *FSStore) Init(cfg *config.Map) error {
 	cfg.String("root", false, false, s.root, &s.root)
+	fsync.Directives(cfg, &s.fsync)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -49,7 +64,12 @@ func (s *FSStore) Init(cfg *config.Map) error {
 		return err
 	}
 
-	return nil
+	s.fsync.Log = log.Logger{Name: "storage.blob.fs/fsync"}
+	return s.fsync.Start()
+}
+
+func (s *FSStore) Close() error {
+	return s.fsync.Close()
 }
 
 func (s *FSStore) Open(key string) (io.ReadCloser, error) {
@@ -68,7 +88,7 @@ func (s *FSStore) Create(key string) (module.Blob, error) {
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	return fsBlob{File: f, fsync: &s.fsync}, nil
 }
 
 func (s *FSStore) Delete(keys []string) error {
@@ -83,7 +103,33 @@ func (s *FSStore) Delete(keys []string) error {
 	return nil
 }
 
+func (s *FSStore) List(f func(module.BlobInfo) error) error {
+	dir, err := os.Open(s.root)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		infos, err := dir.Readdir(1024)
+		for _, info := range infos {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			if err := f(module.BlobInfo{Key: info.Name(), ModTime: info.ModTime()}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func init() {
 	var _ module.BlobStore = &FSStore{}
-	module.Register(FSStore{}.Name(), New)
+	module.Register((&FSStore{}).Name(), New)
 }
@@ -3,8 +3,10 @@ package fs
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/fsync"
 	"github.com/foxcpp/maddy/internal/storage/blob"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -17,3 +19,21 @@ func TestFS(t *testing.T) {
 		os.RemoveAll(store.(*FSStore).root)
 	})
 }
+
+func TestFS_FsyncInterval(t *testing.T) {
+	blob.TestStore(t, func() module.BlobStore {
+		dir := testutils.Dir(t)
+		s := &FSStore{instName: "test", root: dir}
+		s.fsync.Mode = fsync.Interval
+		s.fsync.Interval = 10 * time.Millisecond
+		if err := s.fsync.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}, func(store module.BlobStore) {
+		if err := store.(*FSStore).Close(); err != nil {
+			t.Error(err)
+		}
+		os.RemoveAll(store.(*FSStore).root)
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
@@ -143,6 +144,29 @@ func (s *Store) Delete(keys []string) error {
 	return lastErr
 }
 
+func (s *Store) List(f func(module.BlobInfo) error) error {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	objs := s.cl.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{
+		Prefix:    s.objectPrefix,
+		Recursive: true,
+	})
+	for obj := range objs {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		err := f(module.BlobInfo{
+			Key:     strings.TrimPrefix(obj.Key, s.objectPrefix),
+			ModTime: obj.LastModified,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
 	module.Register(modName, New)
 }
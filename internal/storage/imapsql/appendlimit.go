@@ -0,0 +1,106 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"time"
+
+	"github.com/emersion/go-imap"
+	appendlimit "github.com/emersion/go-imap-appendlimit"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func (store *Storage) parseMboxAppendLimit(_ *config.Map, node config.Node) error {
+	if len(node.Args) != 2 {
+		return config.NodeErr(node, "expected 2 arguments")
+	}
+	size, err := config.ParseDataSize(node.Args[1])
+	if err != nil {
+		return config.NodeErr(node, "%v", err)
+	}
+	if int(uint32(size)) != size {
+		return config.NodeErr(node, "value is too big")
+	}
+
+	name := normalizeMboxName(node.Args[0])
+	if store.mboxLimits == nil {
+		store.mboxLimits = make(map[string]uint32)
+	}
+	store.mboxLimits[name] = uint32(size)
+	return nil
+}
+
+// configLimit returns the APPENDLIMIT value that applies to the mailbox
+// according to the configuration, if it is lower than the one enforced by
+// go-imap-sql.
+func (m *Mailbox) configLimit(dbLimit *uint32) *uint32 {
+	lim, ok := m.store.mboxLimits[m.Name()]
+	if !ok {
+		return nil
+	}
+	if dbLimit != nil && *dbLimit <= lim {
+		return nil
+	}
+	return &lim
+}
+
+// effectiveLimit returns the limit enforced by go-imap-sql for the mailbox.
+// It uses the same precedence: mailbox limit, user limit, global limit.
+func (m *Mailbox) effectiveLimit() *uint32 {
+	if lim := m.Mailbox.CreateMessageLimit(); lim != nil {
+		return lim
+	}
+	if lim := m.user.User.CreateMessageLimit(); lim != nil {
+		return lim
+	}
+	return m.store.Back.Opts.MaxMsgBytes
+}
+
+func (m *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := m.Mailbox.Status(items)
+	if err != nil {
+		return nil, err
+	}
+	status.Name = m.store.extName(status.Name)
+
+	for _, item := range items {
+		if item != appendlimit.StatusAppendLimit {
+			continue
+		}
+		lim := m.effectiveLimit()
+		if cfgLim := m.configLimit(lim); cfgLim != nil {
+			lim = cfgLim
+		}
+		if lim != nil {
+			appendlimit.StatusSetAppendLimit(status, lim)
+		}
+		break
+	}
+	return status, nil
+}
+
+func (m *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	// Explicit mailbox limit stored in the DB overrides the configuration.
+	if m.Mailbox.CreateMessageLimit() == nil {
+		if lim := m.configLimit(nil); lim != nil && uint32(body.Len()) > *lim {
+			return appendlimit.ErrTooBig
+		}
+	}
+	return m.Mailbox.CreateMessage(flags, date, body)
+}
@@ -0,0 +1,81 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	appendlimit "github.com/emersion/go-imap-appendlimit"
+)
+
+func TestMailboxAppendLimit(t *testing.T) {
+	store := sqliteTestStorage(t)
+	store.mboxLimits = map[string]uint32{"Small": 50, "Large": 1000}
+	limit := uint32(100)
+	store.Back.Opts.MaxMsgBytes = &limit
+
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Small", "Large"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := "Subject: test\r\n\r\n" + strings.Repeat("A", 60) + "\r\n"
+	check := func(mboxName string, expectedLimit uint32, tooBig bool) {
+		t.Helper()
+
+		mbox, err := u.GetMailbox(mboxName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := mbox.Status([]imap.StatusItem{appendlimit.StatusAppendLimit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lim := appendlimit.MailboxStatusAppendLimit(status); lim == nil || *lim != expectedLimit {
+			t.Errorf("%s: wrong limit in STATUS: %v (want %d)", mboxName, lim, expectedLimit)
+		}
+
+		err = mbox.CreateMessage(nil, time.Now(), bytes.NewReader([]byte(msg)))
+		if tooBig && err != appendlimit.ErrTooBig {
+			t.Errorf("%s: expected ErrTooBig, got %v", mboxName, err)
+		}
+		if !tooBig && err != nil {
+			t.Errorf("%s: unexpected error: %v", mboxName, err)
+		}
+	}
+	check("INBOX", 100, false)
+	check("Small", 50, true)
+	// Per-mailbox limit can't raise the global one.
+	check("Large", 100, false)
+
+	if store.CreateMessageLimit() != nil {
+		t.Error("fixed limit is advertised while mailbox limits are configured")
+	}
+}
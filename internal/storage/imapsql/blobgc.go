@@ -0,0 +1,109 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// collectBlobsBatch is the maximum amount of keys passed to a single
+// BlobStore.Delete call.
+const collectBlobsBatch = 100
+
+// CollectBlobs removes objects from the message store that are not
+// referenced in the database and were not modified for at least minAge.
+//
+// Message blobs are written before the corresponding database transaction
+// is committed, so minAge should be big enough for any delivery to complete.
+// Otherwise, blobs of deliveries in progress will be removed.
+func (store *Storage) CollectBlobs(ctx context.Context, minAge time.Duration) (int, error) {
+	db, err := store.openMaintDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	cutoff := time.Now().Add(-minAge)
+	var candidates []string
+	err = store.blobStore.List(func(info module.BlobInfo) error {
+		if info.ModTime.After(cutoff) {
+			return nil
+		}
+		candidates = append(candidates, info.Key)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: blob gc: %w", err)
+	}
+
+	query := `SELECT 1 FROM extKeys WHERE id = ` + store.placeholder(1)
+	removed := 0
+	batch := make([]string, 0, collectBlobsBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := store.blobStore.Delete(batch); err != nil {
+			return err
+		}
+		removed += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for _, key := range candidates {
+		var dummy int
+		err := db.QueryRowContext(ctx, query, key).Scan(&dummy)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return removed, fmt.Errorf("imapsql: blob gc: %w", err)
+		}
+
+		store.Log.DebugMsg("removing unreferenced blob", "key", key)
+		batch = append(batch, key)
+		if len(batch) == collectBlobsBatch {
+			if err := flush(); err != nil {
+				return removed, fmt.Errorf("imapsql: blob gc: %w", err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return removed, fmt.Errorf("imapsql: blob gc: %w", err)
+	}
+
+	return removed, nil
+}
+
+// collectBlobs runs CollectBlobs and logs the results.
+func (store *Storage) collectBlobs(minAge time.Duration) {
+	start := time.Now()
+	removed, err := store.CollectBlobs(context.Background(), minAge)
+	if err != nil {
+		store.Log.Error("blob garbage collection failed", err, "removed", removed)
+		return
+	}
+	store.Log.Msg("blob garbage collection done", "removed", removed, "took", time.Since(start))
+}
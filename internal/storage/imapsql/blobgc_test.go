@@ -0,0 +1,84 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCollectBlobs(t *testing.T) {
+	store, _, msgsDir := blobTestStorage(t)
+
+	if _, err := store.GetOrCreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	// Simulate blobs left by interrupted deliveries.
+	for _, key := range []string{"old-orphan", "new-orphan"} {
+		blob, err := store.blobStore.Create(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob.Close()
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(msgsDir, "old-orphan"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.CollectBlobs(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatal("Wrong amount of removed blobs:", removed)
+	}
+	if _, err := os.Stat(filepath.Join(msgsDir, "old-orphan")); !os.IsNotExist(err) {
+		t.Fatal("Old orphaned blob is not removed:", err)
+	}
+	if _, err := os.Stat(filepath.Join(msgsDir, "new-orphan")); err != nil {
+		t.Fatal("Blob within the safety window is removed:", err)
+	}
+
+	// Referenced blobs are kept regardless of their age.
+	removed, err = store.CollectBlobs(context.Background(), -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatal("Wrong amount of removed blobs:", removed)
+	}
+	files, err := ioutil.ReadDir(msgsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("Wrong amount of remaining blobs:", len(files))
+	}
+}
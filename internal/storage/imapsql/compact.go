@@ -0,0 +1,225 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CompactStats contains the results of the Compact call.
+type CompactStats struct {
+	// Amount of removed message blobs that were not referenced by any
+	// message.
+	OrphanedBlobs int
+
+	// Database size before and after compaction. Both are -1 if the
+	// database driver does not support reporting it.
+	SizeBefore, SizeAfter int64
+}
+
+// Reclaimed returns the amount of bytes freed in the database.
+func (s CompactStats) Reclaimed() int64 {
+	if s.SizeBefore < 0 || s.SizeAfter < 0 {
+		return -1
+	}
+	return s.SizeBefore - s.SizeAfter
+}
+
+// openMaintDB opens the separate database connection used for maintenance
+// operations that are not exposed by go-imap-sql.
+func (store *Storage) openMaintDB() (*sql.DB, error) {
+	return sql.Open(store.driver, strings.Join(store.dsn, " "))
+}
+
+// placeholder returns the query parameter placeholder for the n-th argument
+// (starting at 1).
+func (store *Storage) placeholder(n int) string {
+	if store.driver == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// Compact removes message blobs that are not referenced by any message and
+// repacks the database to reclaim unused space.
+//
+// It is safe to call Compact while the server is running. However, SQLite
+// databases are locked for writing while VACUUM is running, so deliveries
+// and IMAP commands modifying messages might be delayed. Database repacking
+// is not done for MySQL.
+func (store *Storage) Compact(ctx context.Context) (CompactStats, error) {
+	stats := CompactStats{SizeBefore: -1, SizeAfter: -1}
+
+	db, err := store.openMaintDB()
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+
+	stats.SizeBefore, err = store.dbSize(ctx, db)
+	if err != nil {
+		return stats, fmt.Errorf("imapsql: compact: %w", err)
+	}
+
+	stats.OrphanedBlobs, err = store.removeOrphanedKeys(ctx, db)
+	if err != nil {
+		return stats, fmt.Errorf("imapsql: compact: %w", err)
+	}
+
+	switch store.driver {
+	case "sqlite3":
+		if _, err := db.ExecContext(ctx, `VACUUM`); err != nil {
+			return stats, fmt.Errorf("imapsql: compact: %w", err)
+		}
+		if _, err := db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+			return stats, fmt.Errorf("imapsql: compact: %w", err)
+		}
+	case "postgres":
+		if _, err := db.ExecContext(ctx, `VACUUM`); err != nil {
+			return stats, fmt.Errorf("imapsql: compact: %w", err)
+		}
+	default:
+		store.Log.DebugMsg("database repacking is not supported for the driver", "driver", store.driver)
+	}
+
+	stats.SizeAfter, err = store.dbSize(ctx, db)
+	if err != nil {
+		return stats, fmt.Errorf("imapsql: compact: %w", err)
+	}
+
+	return stats, nil
+}
+
+func (store *Storage) dbSize(ctx context.Context, db *sql.DB) (int64, error) {
+	var size int64
+	switch store.driver {
+	case "sqlite3":
+		var pageCount, pageSize int64
+		if err := db.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&pageCount); err != nil {
+			return -1, err
+		}
+		if err := db.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err != nil {
+			return -1, err
+		}
+		size = pageCount * pageSize
+	case "postgres":
+		if err := db.QueryRowContext(ctx, `SELECT pg_database_size(current_database())`).Scan(&size); err != nil {
+			return -1, err
+		}
+	default:
+		return -1, nil
+	}
+	return size, nil
+}
+
+// removeOrphanedKeys deletes message blobs (and corresponding extKeys rows)
+// that are not referenced by any message.
+//
+// Such keys are normally removed together with messages, but can be left
+// behind if the removal is interrupted.
+func (store *Storage) removeOrphanedKeys(ctx context.Context, db *sql.DB) (int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id
+		FROM extKeys
+		WHERE NOT EXISTS (
+			SELECT 1 FROM msgs WHERE msgs.extBodyKey = extKeys.id
+		)`)
+	if err != nil {
+		return 0, err
+	}
+	var candidates []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		candidates = append(candidates, key)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	// Message referencing the key might be added after the SELECT above
+	// (e.g. by COPY), so check again when deleting.
+	deleteQuery := `
+		DELETE FROM extKeys
+		WHERE id = ` + store.placeholder(1) + `
+		AND NOT EXISTS (
+			SELECT 1 FROM msgs WHERE msgs.extBodyKey = extKeys.id
+		)`
+	removed := make([]string, 0, len(candidates))
+	for _, key := range candidates {
+		res, err := db.ExecContext(ctx, deleteQuery, key)
+		if err != nil {
+			return 0, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if affected != 0 {
+			removed = append(removed, key)
+		}
+	}
+
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	if err := store.blobStore.Delete(removed); err != nil {
+		return 0, err
+	}
+	return len(removed), nil
+}
+
+// compact runs Compact and logs the results.
+func (store *Storage) compact() {
+	start := time.Now()
+	stats, err := store.Compact(context.Background())
+	if err != nil {
+		store.Log.Error("compaction failed", err)
+		return
+	}
+	store.Log.Msg("compaction done",
+		"orphaned_blobs", stats.OrphanedBlobs,
+		"reclaimed_bytes", stats.Reclaimed(),
+		"took", time.Since(start))
+}
+
+// runPeriodically calls f each interval until a value is sent to stop.
+func runPeriodically(interval time.Duration, stop chan struct{}, f func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			f()
+		case <-stop:
+			stop <- struct{}{}
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// blobTestStorage creates the SQLite-based storage with the message store
+// that is also accessible directly.
+func blobTestStorage(t *testing.T) (store *Storage, dbPath, msgsDir string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "maddy-imapsql-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	msgsDir = filepath.Join(dir, "messages")
+	dbPath = filepath.Join(dir, "imapsql.db")
+
+	mod, err := fs.New("", "", nil, []string{msgsDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	blobStore := mod.(module.BlobStore)
+
+	db, err := imapsql.New("sqlite3", dbPath, ExtBlobStore{Base: blobStore}, imapsql.Opts{
+		LazyUpdatesInit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store = &Storage{
+		Back:      db,
+		Log:       testutils.Logger(t, "imapsql"),
+		delimiter: imapsql.MailboxPathSep,
+		driver:    "sqlite3",
+		dsn:       []string{dbPath},
+		blobStore: blobStore,
+	}
+	store.authNormalize = func(_ context.Context, s string) (string, error) { return s, nil }
+	store.deliveryNormalize = store.authNormalize
+	return store, dbPath, msgsDir
+}
+
+func TestCompact(t *testing.T) {
+	store, dbPath, msgsDir := blobTestStorage(t)
+	blobStore := store.blobStore
+
+	if _, err := store.GetOrCreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	// Simulate the key left behind by an interrupted expunge.
+	orphan, err := blobStore.Create("orphan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan.Close()
+	sqlDB, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if _, err := sqlDB.Exec(`INSERT INTO extKeys(id, uid, refs) VALUES ('orphan', 1, 0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.OrphanedBlobs != 1 {
+		t.Fatal("Wrong amount of removed blobs:", stats.OrphanedBlobs)
+	}
+	if stats.SizeBefore <= 0 || stats.SizeAfter <= 0 {
+		t.Fatal("Database size is not reported:", stats.SizeBefore, stats.SizeAfter)
+	}
+	if _, err := os.Stat(filepath.Join(msgsDir, "orphan")); !os.IsNotExist(err) {
+		t.Fatal("Orphaned blob is not removed:", err)
+	}
+
+	var keys int
+	if err := sqlDB.QueryRow(`SELECT count(*) FROM extKeys`).Scan(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if keys != 1 {
+		t.Fatal("Wrong amount of remaining keys:", keys)
+	}
+	checkMsgCount(t, store, "test@example.org", "INBOX", 1)
+
+	// Nothing to remove on the second run.
+	stats, err = store.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.OrphanedBlobs != 0 {
+		t.Fatal("Wrong amount of removed blobs:", stats.OrphanedBlobs)
+	}
+}
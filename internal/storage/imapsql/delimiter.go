@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// go-imap-sql always uses "." as a hierarchy separator for stored mailbox
+// names. If a different separator is configured, mailbox names are
+// translated by swapping the configured separator and "." characters. This
+// makes the translation reversible and keeps names containing the
+// "." character (e.g. "john.doe") valid.
+
+func validDelimiter(delim string) error {
+	if len(delim) != 1 {
+		return fmt.Errorf("imapsql: delimiter should be exactly one character")
+	}
+	ch := delim[0]
+	if ch <= 0x20 || ch >= 0x7F || strings.ContainsRune(`"\*%`, rune(ch)) {
+		return fmt.Errorf("imapsql: delimiter can't be used as a hierarchy separator: %q", delim)
+	}
+	if ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' {
+		return fmt.Errorf("imapsql: delimiter can't be an alphanumeric character: %q", delim)
+	}
+	return nil
+}
+
+func (store *Storage) swapDelim(name string) string {
+	if store.delimiter == "" || store.delimiter == imapsql.MailboxPathSep {
+		return name
+	}
+
+	delim := store.delimiter[0]
+	sep := imapsql.MailboxPathSep[0]
+
+	b := []byte(name)
+	for i, ch := range b {
+		switch ch {
+		case delim:
+			b[i] = sep
+		case sep:
+			b[i] = delim
+		}
+	}
+	return string(b)
+}
+
+// intName converts the mailbox name as seen by clients to the name stored by
+// go-imap-sql.
+func (store *Storage) intName(name string) string {
+	return store.swapDelim(name)
+}
+
+// extName converts the mailbox name stored by go-imap-sql to the name
+// visible to clients.
+func (store *Storage) extName(name string) string {
+	return store.swapDelim(name)
+}
+
+// Mailbox wraps the go-imap-sql Mailbox object to translate mailbox names
+// according to the configured hierarchy separator.
+type Mailbox struct {
+	*imapsql.Mailbox
+	user  *User
+	store *Storage
+}
+
+func (m *Mailbox) Name() string {
+	return m.store.extName(m.Mailbox.Name())
+}
+
+func (m *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info, err := m.Mailbox.Info()
+	if err != nil {
+		return nil, err
+	}
+	info.Name = m.store.extName(info.Name)
+	info.Delimiter = m.store.delimiter
+	return info, nil
+}
+
+func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	// UIDs of copied messages are needed to learn them.
+	if m.store.learnsInto(dest) {
+		_, _, _, err := m.CopyMessagesUID(uid, seqset, dest)
+		return err
+	}
+	return m.copyMessages(uid, seqset, dest)
+}
+
+func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if m.store.learnsInto(dest) {
+		_, _, _, err := m.MoveMessagesUID(uid, seqset, dest)
+		return err
+	}
+	return m.moveMessages(uid, seqset, dest)
+}
+
+func (m *Mailbox) copyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	return m.Mailbox.CopyMessages(uid, seqset, m.store.intName(dest))
+}
+
+func (m *Mailbox) moveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	return m.Mailbox.MoveMessages(uid, seqset, m.store.intName(dest))
+}
+
+func (store *Storage) wrapMailbox(u *User, mbox backend.Mailbox) backend.Mailbox {
+	return &Mailbox{Mailbox: mbox.(*imapsql.Mailbox), user: u, store: store}
+}
+
+func (store *Storage) translateUpdate(upd backend.Update) backend.Update {
+	if upd.Mailbox() == "" {
+		return upd
+	}
+	base := backend.NewUpdate(upd.Username(), store.extName(upd.Mailbox()))
+
+	switch upd := upd.(type) {
+	case *backend.StatusUpdate:
+		return &backend.StatusUpdate{Update: base, StatusResp: upd.StatusResp}
+	case *backend.MailboxUpdate:
+		// MailboxStatus can't be copied since it contains a mutex. The update
+		// object is not referenced by anybody else at this point, so it is
+		// safe to modify it in-place.
+		upd.MailboxStatus.Name = store.extName(upd.MailboxStatus.Name)
+		return &backend.MailboxUpdate{Update: base, MailboxStatus: upd.MailboxStatus}
+	case *backend.MailboxInfoUpdate:
+		info := *upd.MailboxInfo
+		info.Name = store.extName(info.Name)
+		info.Delimiter = store.delimiter
+		return &backend.MailboxInfoUpdate{Update: base, MailboxInfo: &info}
+	case *backend.MessageUpdate:
+		return &backend.MessageUpdate{Update: base, Message: upd.Message}
+	case *backend.ExpungeUpdate:
+		return &backend.ExpungeUpdate{Update: base, SeqNum: upd.SeqNum}
+	default:
+		store.Log.Printf("unknown update type %T, mailbox name is not translated", upd)
+		return upd
+	}
+}
+
+// translateUpdates returns the channel that carries updates from upds with
+// mailbox names translated to the client-visible form.
+func (store *Storage) translateUpdates(upds <-chan backend.Update) <-chan backend.Update {
+	if store.delimiter == "" || store.delimiter == imapsql.MailboxPathSep {
+		return upds
+	}
+
+	translated := make(chan backend.Update, cap(upds))
+	go func() {
+		defer func() {
+			close(translated)
+
+			if err := recover(); err != nil {
+				stack := debug.Stack()
+				log.Printf("panic during imapsql update translation: %v\n%s", err, stack)
+			}
+		}()
+
+		for upd := range upds {
+			translated <- store.translateUpdate(upd)
+		}
+	}()
+	return translated
+}
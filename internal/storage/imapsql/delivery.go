@@ -20,8 +20,11 @@ package imapsql
 
 import (
 	"context"
+	"errors"
 	"runtime/trace"
+	"time"
 
+	"github.com/emersion/go-imap"
 	specialuse "github.com/emersion/go-imap-specialuse"
 	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-message/textproto"
@@ -29,6 +32,8 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/dedup"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
@@ -39,6 +44,19 @@ type delivery struct {
 	mailFrom string
 
 	addedRcpts map[string]struct{}
+	// Recipient addresses as passed to AddRcpt, keyed by account name.
+	rcptAddrs map[string][]string
+
+	// Mailbox overrides set for recipients, kept so they can be applied
+	// again if the delivery is restarted to drop duplicates.
+	userMboxes map[string]userMbox
+	// Keys to record in the dedup store on commit.
+	dedupKeys []dedup.Key
+}
+
+type userMbox struct {
+	name  string
+	flags []string
 }
 
 func (d *delivery) String() string {
@@ -55,6 +73,25 @@ func userDoesNotExist(actual error) error {
 	}
 }
 
+func (store *Storage) readOnlyErr() error {
+	if store.readOnlyReject {
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 2},
+			Message:      "Mail storage is not accepting messages",
+			TargetName:   "imapsql",
+			Reason:       "read-only mode",
+		}
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
+		Message:      "Mail storage is temporarily not accepting messages, try again later",
+		TargetName:   "imapsql",
+		Reason:       "read-only mode",
+	}
+}
+
 func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 	defer trace.StartRegion(ctx, "sql/AddRcpt").End()
 
@@ -64,9 +101,20 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 	}
 
 	if _, ok := d.addedRcpts[accountName]; ok {
+		d.rcptAddrs[accountName] = append(d.rcptAddrs[accountName], rcptTo)
 		return nil
 	}
 
+	if err := d.addRcpt(accountName); err != nil {
+		return err
+	}
+
+	d.addedRcpts[accountName] = struct{}{}
+	d.rcptAddrs[accountName] = []string{rcptTo}
+	return nil
+}
+
+func (d *delivery) addRcpt(accountName string) error {
 	// This header is added to the message only for that recipient.
 	// go-imap-sql does certain optimizations to store the message
 	// with small amount of per-recipient data in a efficient way.
@@ -88,40 +136,118 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 		}
 		return err
 	}
-
-	d.addedRcpts[accountName] = struct{}{}
 	return nil
 }
 
+func (d *delivery) userMailbox(accountName, mbox string, flags []string) {
+	d.userMboxes[accountName] = userMbox{name: mbox, flags: flags}
+	d.d.UserMailbox(accountName, mbox, flags)
+}
+
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
 
+	return d.body(ctx, header, body, nil)
+}
+
+// BodyNonAtomic is similar to Body, but fails the delivery only for
+// recipients rejected by IMAP filters.
+func (d *delivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	defer trace.StartRegion(ctx, "sql/BodyNonAtomic").End()
+
+	if err := d.body(ctx, header, body, c); err != nil {
+		for _, addrs := range d.rcptAddrs {
+			for _, rcptTo := range addrs {
+				c.SetStatus(rcptTo, err)
+			}
+		}
+	}
+}
+
+// body stores the message for all added recipients.
+//
+// If c is nil, rejection of any recipient by IMAP filters fails the whole
+// delivery. Otherwise, statuses of the rejected recipients are reported
+// using c and the message is stored only for remaining ones.
+func (d *delivery) body(ctx context.Context, header textproto.Header, body buffer.Buffer, c module.StatusCollector) error {
 	if !d.msgMeta.Quarantine && d.store.filters != nil {
+		var rejected []string
 		for rcpt := range d.addedRcpts {
 			folder, flags, err := d.store.filters.IMAPFilter(rcpt, d.msgMeta, header, body)
 			if err != nil {
+				var fatal module.IMAPFilterFatal
+				if errors.As(err, &fatal) {
+					if c == nil {
+						return fatal.Err
+					}
+					for _, rcptTo := range d.rcptAddrs[rcpt] {
+						c.SetStatus(rcptTo, fatal.Err)
+					}
+					rejected = append(rejected, rcpt)
+					continue
+				}
 				d.store.Log.Error("IMAPFilter failed", err, "rcpt", rcpt)
 				continue
 			}
-			d.d.UserMailbox(rcpt, folder, flags)
+			if attr, ok := specialUseAttr(folder); ok {
+				// Empty name makes the message go to the default mailbox,
+				// flags set by the filter are still applied.
+				folder, err = d.store.resolveSpecialUse(rcpt, attr)
+				if err != nil {
+					d.store.Log.Error("failed to resolve special-use mailbox, delivering to INBOX", err, "rcpt", rcpt, "attr", attr)
+					folder = ""
+				} else if folder == "" {
+					d.store.Log.Msg("special-use mailbox does not exist and special_use_autocreate is disabled, delivering to INBOX", "rcpt", rcpt, "attr", attr)
+				}
+				d.userMailbox(rcpt, folder, flags)
+				continue
+			}
+			d.userMailbox(rcpt, d.store.intName(folder), flags)
+		}
+
+		if len(rejected) != 0 {
+			for _, rcpt := range rejected {
+				delete(d.addedRcpts, rcpt)
+				delete(d.rcptAddrs, rcpt)
+				delete(d.userMboxes, rcpt)
+			}
+			keep := make([]string, 0, len(d.addedRcpts))
+			for rcpt := range d.addedRcpts {
+				keep = append(keep, rcpt)
+			}
+			if err := d.restart(keep); err != nil {
+				return err
+			}
+			if len(keep) == 0 {
+				return nil
+			}
 		}
 	}
 
 	if d.msgMeta.Quarantine {
-		if err := d.d.SpecialMailbox(specialuse.Junk, d.store.junkMbox); err != nil {
-			if _, ok := err.(imapsql.SerializationError); ok {
-				return &exterrors.SMTPError{
-					Code:         453,
-					EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
-					Message:      "Storage access serialiation problem, try again later",
-					TargetName:   "imapsql",
-					Err:          err,
+		if d.store.junkMap != nil {
+			for rcpt := range d.addedRcpts {
+				if err := d.userJunkMailbox(ctx, rcpt); err != nil {
+					d.store.Log.Error("failed to use junk_mailbox_map for recipient", err, "rcpt", rcpt)
 				}
 			}
+		}
+
+		if err := d.specialMailbox(); err != nil {
 			return err
 		}
 	}
 
+	if d.store.dedup != nil {
+		deliver, err := d.dropDuplicates(header)
+		if err != nil {
+			return err
+		}
+		if !deliver {
+			return nil
+		}
+	}
+
 	header = header.Copy()
 	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
 	err := d.d.BodyParsed(header, body.Len(), body)
@@ -137,6 +263,128 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	return err
 }
 
+func (d *delivery) specialMailbox() error {
+	if err := d.d.SpecialMailbox(specialuse.Junk, d.store.intName(d.store.junkMbox)); err != nil {
+		if _, ok := err.(imapsql.SerializationError); ok {
+			return &exterrors.SMTPError{
+				Code:         453,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
+				Message:      "Storage access serialiation problem, try again later",
+				TargetName:   "imapsql",
+				Err:          err,
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// dropDuplicates removes recipients that recently got the message with the
+// same Message-ID in the target mailbox from the delivery.
+//
+// It returns false if there are no recipients left and the message should
+// not be stored at all.
+func (d *delivery) dropDuplicates(header textproto.Header) (bool, error) {
+	msgID := dedup.NormalizeMsgID(header.Get("Message-Id"))
+	if msgID == "" {
+		return true, nil
+	}
+
+	now := time.Now()
+	var (
+		keep []string
+		dups []string
+	)
+	d.dedupKeys = d.dedupKeys[:0]
+	for rcpt := range d.addedRcpts {
+		k := dedup.Key{
+			Account:   rcpt,
+			Mailbox:   d.targetMailbox(rcpt),
+			MessageID: msgID,
+		}
+		if d.store.dedup.Seen(k, now) {
+			dups = append(dups, rcpt)
+			continue
+		}
+		keep = append(keep, rcpt)
+		d.dedupKeys = append(d.dedupKeys, k)
+	}
+	if len(dups) == 0 {
+		return true, nil
+	}
+
+	d.store.Log.Msg("skipping duplicate delivery", "msg_id", d.msgMeta.ID,
+		"message_id", msgID, "rcpts", dups)
+
+	if err := d.restart(keep); err != nil {
+		return false, err
+	}
+	return len(keep) != 0, nil
+}
+
+// restart starts the delivery over with the specified recipients since
+// go-imap-sql does not allow to remove recipients from the delivery.
+func (d *delivery) restart(rcpts []string) error {
+	if err := d.d.Abort(); err != nil {
+		return err
+	}
+	d.d = d.store.Back.NewDelivery()
+	if len(rcpts) == 0 {
+		return nil
+	}
+	for _, rcpt := range rcpts {
+		if err := d.addRcpt(rcpt); err != nil {
+			return err
+		}
+		if mbox, ok := d.userMboxes[rcpt]; ok {
+			d.d.UserMailbox(rcpt, mbox.name, mbox.flags)
+		}
+	}
+	if d.msgMeta.Quarantine {
+		if err := d.specialMailbox(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// targetMailbox returns the name of the mailbox the message is going to be
+// stored in for the recipient.
+func (d *delivery) targetMailbox(accountName string) string {
+	if mbox, ok := d.userMboxes[accountName]; ok && mbox.name != "" {
+		return mbox.name
+	}
+	if d.msgMeta.Quarantine {
+		return d.store.intName(d.store.junkMbox)
+	}
+	return imap.InboxName
+}
+
+// userJunkMailbox configures go-imap-sql to put the quarantined message into
+// the mailbox specified in junk_mailbox_map for the account (if any).
+func (d *delivery) userJunkMailbox(ctx context.Context, accountName string) error {
+	mbox, ok, err := d.store.junkMap.Lookup(ctx, accountName)
+	if err != nil {
+		return err
+	}
+	if !ok || mbox == "" {
+		return nil
+	}
+	mbox = d.store.intName(mbox)
+
+	// go-imap-sql ignores the per-user mailbox if it does not exist.
+	u, err := d.store.Back.GetUser(accountName)
+	if err != nil {
+		return err
+	}
+	if err := u.CreateMailbox(mbox); err != nil && err != backend.ErrMailboxAlreadyExists {
+		return err
+	}
+
+	d.userMailbox(accountName, mbox, nil)
+	return nil
+}
+
 func (d *delivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Abort").End()
 
@@ -146,17 +394,32 @@ func (d *delivery) Abort(ctx context.Context) error {
 func (d *delivery) Commit(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Commit").End()
 
-	return d.d.Commit()
+	if err := d.d.Commit(); err != nil {
+		return err
+	}
+
+	if d.store.dedup != nil && len(d.dedupKeys) != 0 {
+		if err := d.store.dedup.Add(time.Now(), d.dedupKeys...); err != nil {
+			d.store.Log.Error("failed to save dedup state", err, "msg_id", d.msgMeta.ID)
+		}
+	}
+	return nil
 }
 
 func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
 	defer trace.StartRegion(ctx, "sql/Start").End()
 
+	if control.ReadOnly() {
+		return nil, store.readOnlyErr()
+	}
+
 	return &delivery{
 		store:      store,
 		msgMeta:    msgMeta,
 		mailFrom:   mailFrom,
 		d:          store.Back.NewDelivery(),
 		addedRcpts: map[string]struct{}{},
+		rcptAddrs:  map[string][]string{},
+		userMboxes: map[string]userMbox{},
 	}, nil
 }
@@ -0,0 +1,235 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/dedup"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func checkMsgCount(t *testing.T, store *Storage, username, mboxName string, expected uint32) {
+	t.Helper()
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(mboxName)
+	if err != nil {
+		t.Fatal(username, mboxName, err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != expected {
+		t.Errorf("%s/%s: wrong messages count: %d (want %d)", username, mboxName, status.Messages, expected)
+	}
+}
+
+func TestDelivery_Quarantine(t *testing.T) {
+	store := sqliteTestStorage(t)
+	store.junkMbox = "Junk"
+	store.deliveryNormalize = store.authNormalize
+	store.junkMap = testutils.Table{M: map[string]string{
+		"test2@example.org": "Quarantine",
+	}}
+
+	for _, name := range []string{"test1@example.org", "test2@example.org"} {
+		if _, err := store.GetOrCreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org",
+		[]string{"test1@example.org", "test2@example.org"},
+		&module.MsgMetadata{Quarantine: true})
+
+	checkMsgCount(t, store, "test1@example.org", "INBOX", 0)
+	checkMsgCount(t, store, "test1@example.org", "Junk", 1)
+	checkMsgCount(t, store, "test2@example.org", "INBOX", 0)
+	checkMsgCount(t, store, "test2@example.org", "Quarantine", 1)
+}
+
+func TestDelivery_Dedup(t *testing.T) {
+	store := sqliteTestStorage(t)
+	store.deliveryNormalize = store.authNormalize
+
+	dir, err := ioutil.TempDir("", "maddy-imapsql-dedup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store.dedup, err = dedup.Open(filepath.Join(dir, "dedup.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"test1@example.org", "test2@example.org"} {
+		if _, err := store.GetOrCreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver := func(msgID string, rcpts ...string) {
+		t.Helper()
+
+		ctx := context.Background()
+		delivery, err := store.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rcpt := range rcpts {
+			if err := delivery.AddRcpt(ctx, rcpt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hdr := textproto.Header{}
+		if msgID != "" {
+			hdr.Add("Message-ID", msgID)
+		}
+		if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver("<1@example.org>", "test1@example.org")
+	deliver("<1@example.org>", "test1@example.org", "test2@example.org")
+	checkMsgCount(t, store, "test1@example.org", "INBOX", 1)
+	checkMsgCount(t, store, "test2@example.org", "INBOX", 1)
+
+	// All recipients are duplicates.
+	deliver("<1@example.org>", "test1@example.org", "test2@example.org")
+	checkMsgCount(t, store, "test1@example.org", "INBOX", 1)
+	checkMsgCount(t, store, "test2@example.org", "INBOX", 1)
+
+	deliver("<2@example.org>", "test1@example.org")
+	checkMsgCount(t, store, "test1@example.org", "INBOX", 2)
+
+	// Messages without Message-ID are never considered duplicates.
+	deliver("", "test1@example.org")
+	deliver("", "test1@example.org")
+	checkMsgCount(t, store, "test1@example.org", "INBOX", 4)
+}
+
+type rejectFilter string
+
+func (f rejectFilter) IMAPFilter(accountName string, _ *module.MsgMetadata, _ textproto.Header, _ buffer.Buffer) (string, []string, error) {
+	if accountName == string(f) {
+		return "", nil, module.IMAPFilterFatal{Err: &exterrors.SMTPError{Code: 550}}
+	}
+	return "", nil, nil
+}
+
+type statusCollector map[string]error
+
+func (c statusCollector) SetStatus(rcptTo string, err error) {
+	c[rcptTo] = err
+}
+
+func TestDelivery_FilterReject(t *testing.T) {
+	store := sqliteTestStorage(t)
+	store.deliveryNormalize = store.authNormalize
+	store.filters = rejectFilter("test2@example.org")
+
+	for _, name := range []string{"test1@example.org", "test2@example.org"} {
+		if _, err := store.GetOrCreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver := func(rcpts ...string) statusCollector {
+		t.Helper()
+
+		ctx := context.Background()
+		delivery, err := store.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rcpt := range rcpts {
+			if err := delivery.AddRcpt(ctx, rcpt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c := statusCollector{}
+		delivery.(module.PartialDelivery).BodyNonAtomic(ctx, c, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")})
+		if err := delivery.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := deliver("test1@example.org", "test2@example.org")
+	if len(c) != 1 || c["test2@example.org"] == nil {
+		t.Fatal("Wrong statuses:", c)
+	}
+	checkMsgCount(t, store, "test1@example.org", "INBOX", 1)
+	checkMsgCount(t, store, "test2@example.org", "INBOX", 0)
+
+	// All recipients are rejected.
+	c = deliver("test2@example.org")
+	if len(c) != 1 || c["test2@example.org"] == nil {
+		t.Fatal("Wrong statuses:", c)
+	}
+	checkMsgCount(t, store, "test2@example.org", "INBOX", 0)
+}
+
+func TestDelivery_ReadOnly(t *testing.T) {
+	store := sqliteTestStorage(t)
+	store.deliveryNormalize = store.authNormalize
+	if _, err := store.GetOrCreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	control.SetReadOnly(true)
+	defer control.SetReadOnly(false)
+
+	_, err := testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"test@example.org"})
+	if err == nil || !exterrors.IsTemporary(err) {
+		t.Fatalf("expected temporary error, got %v", err)
+	}
+
+	store.readOnlyReject = true
+	_, err = testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"test@example.org"})
+	if err == nil || exterrors.IsTemporary(err) {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+	checkMsgCount(t, store, "test@example.org", "INBOX", 0)
+
+	control.SetReadOnly(false)
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	checkMsgCount(t, store, "test@example.org", "INBOX", 1)
+}
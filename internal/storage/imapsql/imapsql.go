@@ -35,9 +35,9 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
-	sortthread "github.com/emersion/go-imap-sortthread"
 	"github.com/emersion/go-imap/backend"
 	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/framework/config"
@@ -46,7 +46,9 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/dedup"
 	"github.com/foxcpp/maddy/internal/updatepipe"
+	"github.com/foxcpp/maddy/internal/updatepipe/pubsub"
 
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
@@ -57,10 +59,24 @@ type Storage struct {
 	instName string
 	Log      log.Logger
 
-	junkMbox string
+	junkMbox  string
+	junkMap   module.Table
+	delimiter string
 
-	driver string
-	dsn    []string
+	// Create missing mailboxes with special-use attributes requested by
+	// IMAP filters.
+	specialUseCreate bool
+
+	// Reject deliveries with a permanent error instead of deferring them
+	// while the server is in the read-only mode.
+	readOnlyReject bool
+
+	driver    string
+	dsn       []string
+	blobStore module.BlobStore
+
+	compactStop chan struct{}
+	blobGCStop  chan struct{}
 
 	resolver dns.Resolver
 
@@ -70,6 +86,20 @@ type Storage struct {
 
 	filters module.IMAPFilter
 
+	dedup *dedup.Store
+
+	// Per-mailbox APPENDLIMIT values, keyed by mailbox name.
+	mboxLimits map[string]uint32
+
+	// Maximum length of message previews in characters, 0 if previews are
+	// disabled.
+	previewLen int
+
+	spamLearner module.SpamLearner
+	// Mailbox names mapped to the class used for learning messages copied
+	// or moved into them (true for spam).
+	learnMboxes map[string]bool
+
 	deliveryMap       module.Table
 	deliveryNormalize func(context.Context, string) (string, error)
 	authMap           module.Table
@@ -109,6 +139,16 @@ func (store *Storage) Init(cfg *config.Map) error {
 		compression       []string
 		authNormalize     string
 		deliveryNormalize string
+		dedupEnabled      bool
+		dedupWindow       time.Duration
+		previewEnabled    bool
+		previewLen        int
+		learnSpam         []string
+		learnHam          []string
+		compactInterval   time.Duration
+		blobGCInterval    time.Duration
+		blobGCWindow      time.Duration
+		readOnlyDelivery  string
 
 		blobStore module.BlobStore
 	)
@@ -138,11 +178,17 @@ func (store *Storage) Init(cfg *config.Map) error {
 	}, &blobStore)
 	cfg.StringList("compression", false, false, []string{"off"}, &compression)
 	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
+	cfg.Callback("mailbox_appendlimit", store.parseMboxAppendLimit)
 	cfg.Bool("debug", true, false, &store.Log.Debug)
 	cfg.Int("sqlite3_cache_size", false, false, 0, &opts.CacheSize)
 	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
 	cfg.Bool("sqlite3_exclusive_lock", false, false, &opts.ExclusiveLock)
 	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.Custom("junk_mailbox_map", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.junkMap)
+	cfg.String("delimiter", false, false, imapsql.MailboxPathSep, &store.delimiter)
+	cfg.Bool("special_use_autocreate", false, true, &store.specialUseCreate)
 	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
@@ -158,14 +204,35 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	cfg.Custom("spam_learner", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var learner module.SpamLearner
+		err := modconfig.ModuleFromNode("check", node.Args, node, m.Globals, &learner)
+		return learner, err
+	}, &store.spamLearner)
+	cfg.StringList("learn_spam_mailboxes", false, false, []string{"Junk"}, &learnSpam)
+	cfg.StringList("learn_ham_mailboxes", false, false, nil, &learnHam)
+	cfg.Bool("dedup", false, false, &dedupEnabled)
+	cfg.Duration("dedup_window", false, false, 24*time.Hour, &dedupWindow)
+	cfg.Bool("preview", false, false, &previewEnabled)
+	cfg.Int("preview_length", false, false, 200, &previewLen)
+	cfg.Duration("compact_interval", false, false, 0, &compactInterval)
+	cfg.Duration("blob_gc_interval", false, false, 0, &blobGCInterval)
+	cfg.Duration("blob_gc_window", false, false, 24*time.Hour, &blobGCWindow)
+	cfg.Enum("read_only_delivery", false, false, []string{"defer", "reject"}, "defer", &readOnlyDelivery)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	store.readOnlyReject = readOnlyDelivery == "reject"
 
 	if dsn == nil {
 		return errors.New("imapsql: dsn is required")
 	}
+	if err := validDelimiter(store.delimiter); err != nil {
+		return err
+	}
 	if driver == "" {
 		return errors.New("imapsql: driver is required")
 	}
@@ -212,6 +279,37 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 	}
 
+	if store.spamLearner != nil {
+		store.learnMboxes = make(map[string]bool, len(learnSpam)+len(learnHam))
+		for _, name := range learnSpam {
+			store.learnMboxes[normalizeMboxName(name)] = true
+		}
+		for _, name := range learnHam {
+			name = normalizeMboxName(name)
+			if store.learnMboxes[name] {
+				return fmt.Errorf("imapsql: mailbox %s is used for both spam and ham learning", name)
+			}
+			store.learnMboxes[name] = false
+		}
+	}
+
+	if dedupEnabled {
+		var err error
+		store.dedup, err = dedup.Open(filepath.Join(config.StateDirectory,
+			"imapsql_dedup_"+store.instName+".json"), dedupWindow)
+		if err != nil {
+			return fmt.Errorf("imapsql: failed to load dedup state: %v", err)
+		}
+	}
+
+	if previewEnabled {
+		// RFC 8970, Section 3.
+		if previewLen <= 0 || previewLen > maxPreviewLen {
+			return fmt.Errorf("imapsql: preview_length should be between 1 and %d", maxPreviewLen)
+		}
+		store.previewLen = previewLen
+	}
+
 	opts.Log = &store.Log
 
 	if appendlimitVal == -1 {
@@ -260,10 +358,22 @@ func (store *Storage) Init(cfg *config.Map) error {
 
 	store.driver = driver
 	store.dsn = dsn
+	store.blobStore = blobStore
 
 	store.Back.EnableChildrenExt()
 	store.Back.EnableSpecialUseExt()
 
+	if compactInterval != 0 && !module.NoRun {
+		store.compactStop = make(chan struct{})
+		go runPeriodically(compactInterval, store.compactStop, store.compact)
+	}
+	if blobGCInterval != 0 && !module.NoRun {
+		store.blobGCStop = make(chan struct{})
+		go runPeriodically(blobGCInterval, store.blobGCStop, func() {
+			store.collectBlobs(blobGCWindow)
+		})
+	}
+
 	return nil
 }
 
@@ -286,6 +396,16 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 				fmt.Sprintf("sql-%s.sock", hex.EncodeToString(dbId[:]))),
 			Log: log.Logger{Name: "sql/updpipe", Debug: store.Log.Debug},
 		}
+	case "postgres":
+		ps, err := pubsub.NewPQ(strings.Join(store.dsn, " "),
+			log.Logger{Name: "sql/updpipe/pubsub", Debug: store.Log.Debug})
+		if err != nil {
+			return fmt.Errorf("imapsql: update pipe: %w", err)
+		}
+		store.updPipe = &updatepipe.PubSubPipe{
+			PubSub: ps,
+			Log:    log.Logger{Name: "sql/updpipe", Debug: store.Log.Debug},
+		}
 	default:
 		return errors.New("imapsql: driver does not have an update pipe implementation")
 	}
@@ -294,12 +414,14 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 
 	if mode == updatepipe.ModeReplicate {
 		if err := store.updPipe.Listen(wrapped); err != nil {
+			store.updPipe.Close()
 			store.updPipe = nil
 			return err
 		}
 	}
 
 	if err := store.updPipe.InitPush(); err != nil {
+		store.updPipe.Close()
 		store.updPipe = nil
 		return err
 	}
@@ -338,7 +460,7 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 		}
 	}()
 
-	store.updates = wrapped
+	store.updates = store.translateUpdates(wrapped)
 	return nil
 }
 
@@ -347,10 +469,19 @@ func (store *Storage) I18NLevel() int {
 }
 
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	exts := []string{"APPENDLIMIT", "MOVE", "UIDPLUS", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT", "THREAD=REFERENCES"}
+	if store.previewLen != 0 {
+		exts = append(exts, "PREVIEW")
+	}
+	return exts
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
+	// RFC 7889, Section 3: do not advertise the fixed limit if mailboxes may
+	// have different ones.
+	if len(store.mboxLimits) != 0 {
+		return nil
+	}
 	return store.Back.CreateMessageLimit()
 }
 
@@ -359,7 +490,7 @@ func (store *Storage) Updates() <-chan backend.Update {
 		return store.updates
 	}
 
-	store.updates = store.Back.Updates()
+	store.updates = store.translateUpdates(store.Back.Updates())
 	return store.updates
 }
 
@@ -373,7 +504,7 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	return store.wrapUser(store.Back.GetOrCreateUser(accountName))
 }
 
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
@@ -397,6 +528,15 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 }
 
 func (store *Storage) Close() error {
+	if store.compactStop != nil {
+		store.compactStop <- struct{}{}
+		<-store.compactStop
+	}
+	if store.blobGCStop != nil {
+		store.blobGCStop <- struct{}{}
+		<-store.blobGCStop
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
@@ -417,10 +557,6 @@ func (store *Storage) Login(_ *imap.ConnInfo, usenrame, password string) (backen
 	panic("This method should not be called and is added only to satisfy backend.Backend interface")
 }
 
-func (store *Storage) SupportedThreadAlgorithms() []sortthread.ThreadAlgorithm {
-	return []sortthread.ThreadAlgorithm{sortthread.OrderedSubject}
-}
-
 func init() {
 	module.Register("storage.imapsql", New)
 	module.Register("target.imapsql", New)
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"context"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+func normalizeMboxName(name string) string {
+	if strings.EqualFold(name, imap.InboxName) {
+		return imap.InboxName
+	}
+	return name
+}
+
+// learnsInto reports whether messages copied or moved to the mailbox are
+// used to train the spam learner.
+func (store *Storage) learnsInto(mbox string) bool {
+	if store.spamLearner == nil {
+		return false
+	}
+	_, ok := store.learnMboxes[normalizeMboxName(mbox)]
+	return ok
+}
+
+// learnCopied trains the spam learner using messages copied or moved to
+// the dest mailbox if it is configured for learning.
+//
+// Learning is done in background so it does not delay the IMAP command.
+// Errors are only logged.
+func (m *Mailbox) learnCopied(dest string, destUIDs []uint32) {
+	if !m.store.learnsInto(dest) || len(destUIDs) == 0 {
+		return
+	}
+	spam := m.store.learnMboxes[normalizeMboxName(dest)]
+
+	go func() {
+		destMbox, err := m.user.User.GetMailbox(m.store.intName(dest))
+		if err != nil {
+			m.store.Log.Error("failed to open mailbox for learning", err, "username", m.user.Username(), "mbox", dest)
+			return
+		}
+
+		seq := &imap.SeqSet{}
+		seq.AddNum(destUIDs...)
+		section := &imap.BodySectionName{Peek: true}
+
+		ch := make(chan *imap.Message, len(destUIDs))
+		if err := destMbox.ListMessages(true, seq, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+			m.store.Log.Error("failed to fetch messages for learning", err, "username", m.user.Username(), "mbox", dest)
+			return
+		}
+
+		for msg := range ch {
+			// go-imap-sql keys the body by the requested section (with
+			// .PEEK), so msg.GetBody can't be used.
+			var body imap.Literal
+			for _, l := range msg.Body {
+				body = l
+			}
+			if body == nil {
+				continue
+			}
+			bufR := bufio.NewReader(body)
+			hdr, err := textproto.ReadHeader(bufR)
+			if err != nil {
+				m.store.Log.Error("failed to parse message for learning", err, "username", m.user.Username(), "mbox", dest, "uid", msg.Uid)
+				continue
+			}
+			if err := m.store.spamLearner.Learn(context.Background(), hdr, bufR, spam); err != nil {
+				m.store.Log.Error("failed to learn message", err, "username", m.user.Username(), "mbox", dest, "uid", msg.Uid)
+				continue
+			}
+		}
+
+		m.store.Log.DebugMsg("learned messages", "username", m.user.Username(), "mbox", dest, "spam", spam, "count", len(destUIDs))
+	}()
+}
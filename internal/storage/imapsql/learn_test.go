@@ -0,0 +1,115 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+type learnedMsg struct {
+	subject string
+	body    string
+	spam    bool
+}
+
+type testLearner chan learnedMsg
+
+func (l testLearner) Learn(_ context.Context, hdr textproto.Header, body io.Reader, spam bool) error {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	l <- learnedMsg{subject: hdr.Get("Subject"), body: string(b), spam: spam}
+	return nil
+}
+
+func TestLearnOnMove(t *testing.T) {
+	learner := make(testLearner, 10)
+	store := sqliteTestStorage(t)
+	store.spamLearner = learner
+	store.learnMboxes = map[string]bool{"Junk": true, imap.InboxName: false}
+
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Junk", "Archive"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subj := range []string{"first", "second"} {
+		msg := "Subject: " + subj + "\r\n\r\nHello!\r\n"
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewReader([]byte(msg))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(subject string, spam bool) {
+		t.Helper()
+		select {
+		case msg := <-learner:
+			if msg.subject != subject || msg.spam != spam || msg.body != "Hello!\r\n" {
+				t.Errorf("wrong message learned: %+v (want %s, spam=%v)", msg, subject, spam)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %s is not learned", subject)
+		}
+	}
+
+	seq, _ := imap.ParseSeqSet("1")
+	if err := mbox.(*Mailbox).MoveMessages(false, seq, "Junk"); err != nil {
+		t.Fatal(err)
+	}
+	expect("first", true)
+
+	// Archive is not used for learning.
+	if err := mbox.(*Mailbox).CopyMessages(false, seq, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	junk, err := u.GetMailbox("Junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := junk.(*Mailbox).CopyMessages(false, seq, imap.InboxName); err != nil {
+		t.Fatal(err)
+	}
+	expect("first", false)
+
+	select {
+	case msg := <-learner:
+		t.Errorf("unexpected message learned: %+v", msg)
+	default:
+	}
+}
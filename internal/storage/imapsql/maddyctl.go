@@ -38,5 +38,5 @@ func (store *Storage) DeleteIMAPAcct(accountName string) error {
 }
 
 func (store *Storage) GetIMAPAcct(accountName string) (backend.User, error) {
-	return store.Back.GetUser(accountName)
+	return store.wrapUser(store.Back.GetUser(accountName))
 }
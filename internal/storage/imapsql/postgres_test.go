@@ -0,0 +1,243 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/foxcpp/maddy/internal/updatepipe"
+	"github.com/foxcpp/maddy/internal/updatepipe/pubsub"
+)
+
+// Tests in this file check concurrency-sensitive operations against a real
+// PostgreSQL server. Run them using
+//	go test -sql.testdb postgres -sql.testdsn 'dbname=maddy_test ...'
+
+func postgresTestStorage(t *testing.T) (*Storage, string) {
+	t.Helper()
+
+	if testDB != "postgres" || testDSN == "" {
+		t.Skip("-sql.testdb=postgres and -sql.testdsn should be specified to run this test")
+	}
+
+	db, err := imapsql.New("postgres", testDSN,
+		&imapsql.FSStore{Root: testutils.Dir(t)}, imapsql.Opts{
+			LazyUpdatesInit: true,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store := &Storage{
+		Back:      db,
+		Log:       testutils.Logger(t, "imapsql"),
+		delimiter: imapsql.MailboxPathSep,
+		driver:    "postgres",
+		dsn:       []string{testDSN},
+	}
+
+	// Database is shared between runs, use unique account name.
+	username := "pgtest-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "@example.org"
+	if err := store.CreateIMAPAcct(username); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.DeleteIMAPAcct(username); err != nil {
+			t.Error(err)
+		}
+	})
+	return store, username
+}
+
+func pgMailbox(t *testing.T, store *Storage, username, name string) *Mailbox {
+	t.Helper()
+
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mbox.(*Mailbox)
+}
+
+func TestPostgres_ConcurrentAppend(t *testing.T) {
+	store, username := postgresTestStorage(t)
+
+	const (
+		workers   = 8
+		perWorker = 25
+	)
+
+	var (
+		uidsLck sync.Mutex
+		uids    = make(map[uint32]bool, workers*perWorker)
+		wg      sync.WaitGroup
+	)
+	msg := []byte("Subject: test\r\n\r\nHello!\r\n")
+	for i := 0; i < workers; i++ {
+		// Each worker uses its own mailbox handle, like separate IMAP
+		// connections do.
+		inbox := pgMailbox(t, store, username, imap.InboxName)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				_, uid, err := inbox.CreateMessageUID(nil, time.Now(), bytes.NewReader(msg))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				uidsLck.Lock()
+				if uids[uid] {
+					t.Errorf("UID %d assigned twice", uid)
+				}
+				uids[uid] = true
+				uidsLck.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for uid := uint32(1); uid <= workers*perWorker; uid++ {
+		if !uids[uid] {
+			t.Errorf("UID %d is not assigned", uid)
+		}
+	}
+
+	status, err := pgMailbox(t, store, username, imap.InboxName).Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != workers*perWorker || status.UidNext != workers*perWorker+1 {
+		t.Fatalf("wrong mailbox status: MESSAGES %d, UIDNEXT %d", status.Messages, status.UidNext)
+	}
+}
+
+func TestPostgres_ConcurrentMove(t *testing.T) {
+	store, username := postgresTestStorage(t)
+
+	const msgsCount = 50
+
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Target"); err != nil {
+		t.Fatal(err)
+	}
+	inbox := pgMailbox(t, store, username, imap.InboxName)
+	msg := []byte("Subject: test\r\n\r\nHello!\r\n")
+	for i := 0; i < msgsCount; i++ {
+		if err := inbox.CreateMessage(nil, time.Now(), bytes.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Multiple clients moving the same messages at once. Each message
+	// should end up in Target exactly once, no matter which client moved it.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		mbox := pgMailbox(t, store, username, imap.InboxName)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq, _ := imap.ParseSeqSet("1:*")
+			if _, _, _, err := mbox.MoveMessagesUID(true, seq, "Target"); err != nil {
+				// Conflicting transactions may be aborted, that's fine
+				// as long as the result is consistent.
+				t.Log("MOVE failed:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for name, expected := range map[string]uint32{imap.InboxName: 0, "Target": msgsCount} {
+		mbox := pgMailbox(t, store, username, name)
+		uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint32(len(uids)) != expected || status.Messages != expected {
+			t.Errorf("%s: expected %d messages, got %d (MESSAGES %d)", name, expected, len(uids), status.Messages)
+		}
+	}
+}
+
+func TestPostgres_UpdatePipe(t *testing.T) {
+	if testDB != "postgres" || testDSN == "" {
+		t.Skip("-sql.testdb=postgres and -sql.testdsn should be specified to run this test")
+	}
+
+	newPipe := func() *updatepipe.PubSubPipe {
+		ps, err := pubsub.NewPQ(testDSN, testutils.Logger(t, "pubsub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &updatepipe.PubSubPipe{
+			PubSub:  ps,
+			Log:     testutils.Logger(t, "updpipe"),
+			Channel: "maddy_test_" + strconv.FormatInt(time.Now().UnixNano(), 10),
+		}
+		t.Cleanup(func() { p.Close() })
+		return p
+	}
+	listener := newPipe()
+	sender := newPipe()
+	sender.Channel = listener.Channel
+
+	upds := make(chan backend.Update, 1)
+	if err := listener.Listen(upds); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := &backend.MailboxUpdate{
+		Update:        backend.NewUpdate("test@example.org", "INBOX"),
+		MailboxStatus: &imap.MailboxStatus{Messages: 5},
+	}
+	if err := sender.Push(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case upd := <-upds:
+		mboxUpd, ok := upd.(*backend.MailboxUpdate)
+		if !ok || upd.Username() != "test@example.org" || upd.Mailbox() != "INBOX" || mboxUpd.Messages != 5 {
+			t.Fatalf("wrong update received: %#v", upd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update is not received")
+	}
+}
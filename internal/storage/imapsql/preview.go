@@ -0,0 +1,226 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"html"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/mimewalk"
+)
+
+const (
+	// FetchPreview is the FETCH data item defined by RFC 8970.
+	FetchPreview imap.FetchItem = "PREVIEW"
+
+	// Maximum preview length permitted by RFC 8970, Section 3.
+	maxPreviewLen = 256
+
+	// Only the beginning of the message is used to generate the preview.
+	previewReadLen = 64 * 1024
+)
+
+var previewLimits = mimewalk.Limits{
+	MaxDepth: 10,
+	MaxParts: 100,
+}
+
+// previewSection is the body section fetched to generate previews.
+var previewSection = &imap.BodySectionName{
+	Peek:    true,
+	Partial: []int{0, previewReadLen},
+}
+
+// ListMessages implements the PREVIEW fetch item (RFC 8970) on top of
+// go-imap-sql.
+//
+// go-imap-sql has no place to store previews, so they are generated when
+// requested from the first part of the message.
+func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	wantPreview := false
+	for _, item := range items {
+		if item == FetchPreview {
+			wantPreview = true
+			break
+		}
+	}
+	if !wantPreview || m.store.previewLen == 0 {
+		return m.Mailbox.ListMessages(uid, seqset, items, ch)
+	}
+
+	sectItem := previewSection.FetchItem()
+	hasSect := false
+	innerItems := make([]imap.FetchItem, 0, len(items)+1)
+	for _, item := range items {
+		switch item {
+		case FetchPreview:
+			continue
+		case sectItem:
+			hasSect = true
+		}
+		innerItems = append(innerItems, item)
+	}
+	if !hasSect {
+		innerItems = append(innerItems, sectItem)
+	}
+
+	innerCh := make(chan *imap.Message, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- m.Mailbox.ListMessages(uid, seqset, innerItems, innerCh)
+	}()
+
+	defer close(ch)
+	for msg := range innerCh {
+		var body imap.Literal
+		for sect, l := range msg.Body {
+			if sect.FetchItem() != sectItem {
+				continue
+			}
+			body = l
+			if !hasSect {
+				delete(msg.Body, sect)
+			}
+		}
+		if !hasSect {
+			delete(msg.Items, sectItem)
+		}
+
+		var preview string
+		if body != nil {
+			preview = m.store.messagePreview(body)
+			if preview == "" {
+				m.store.Log.DebugMsg("no text for preview", "username", m.user.Username(), "mbox", m.Name(), "uid", msg.Uid)
+			}
+		}
+		msg.Items[FetchPreview] = preview
+		ch <- msg
+	}
+
+	return <-errCh
+}
+
+// messagePreview generates the preview for the message.
+//
+// The first text/plain part is preferred, text/html is used if there is no
+// such part. Attachments are ignored. Empty string is returned if there
+// is no suitable text.
+func (store *Storage) messagePreview(body io.Reader) string {
+	bufR := bufio.NewReader(body)
+	hdr, err := textproto.ReadHeader(bufR)
+	if err != nil {
+		return ""
+	}
+
+	var plain, htmlText string
+	w := mimewalk.Walker{Limits: previewLimits}
+	// The message might be truncated, so MIME errors are expected and the
+	// text collected so far is still used.
+	_ = w.Walk(hdr, bufR, func(_ []int, part *message.Entity) error {
+		if disp, _, _ := part.Header.ContentDisposition(); disp == "attachment" {
+			return nil
+		}
+		contentType, _, _ := part.Header.ContentType()
+		if contentType == "" {
+			contentType = "text/plain"
+		}
+		if contentType != "text/plain" && contentType != "text/html" {
+			return nil
+		}
+
+		// Partial text is fine, so read errors are ignored.
+		text, _ := ioutil.ReadAll(io.LimitReader(part.Body, previewReadLen))
+		switch {
+		case contentType == "text/plain" && plain == "":
+			plain = collapseSpace(string(text))
+			if plain != "" {
+				return io.EOF
+			}
+		case contentType == "text/html" && htmlText == "":
+			htmlText = collapseSpace(htmlToText(string(text)))
+		}
+		return nil
+	})
+
+	preview := plain
+	if preview == "" {
+		preview = htmlText
+	}
+	return truncateRunes(preview, store.previewLen)
+}
+
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// htmlToText removes tags, comments, scripts and styles from the HTML text
+// and decodes character references.
+func htmlToText(s string) string {
+	var sb strings.Builder
+	for len(s) != 0 {
+		start := strings.IndexByte(s, '<')
+		if start == -1 {
+			sb.WriteString(s)
+			break
+		}
+		sb.WriteString(s[:start])
+		s = s[start:]
+
+		end := ">"
+		lower := strings.ToLower(s)
+		switch {
+		case strings.HasPrefix(lower, "<!--"):
+			end = "-->"
+		case strings.HasPrefix(lower, "<script"):
+			end = "</script>"
+		case strings.HasPrefix(lower, "<style"):
+			end = "</style>"
+		case strings.HasPrefix(lower, "<head"):
+			end = "</head>"
+		}
+		idx := strings.Index(lower, end)
+		if idx == -1 {
+			break
+		}
+		s = s[idx+len(end):]
+		sb.WriteByte(' ')
+	}
+	return html.UnescapeString(sb.String())
+}
+
+func truncateRunes(s string, maxLen int) string {
+	if utf8.RuneCountInString(s) <= maxLen {
+		return s
+	}
+	runes := 0
+	for i := range s {
+		if runes == maxLen {
+			return s[:i]
+		}
+		runes++
+	}
+	return s
+}
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestMessagePreview(t *testing.T) {
+	store := &Storage{previewLen: 20}
+	for _, c := range []struct {
+		name, msg, preview string
+	}{
+		{"plain", "Subject: a\r\n\r\nHello,\r\n  world!\r\n", "Hello, world!"},
+		{"truncated", "\r\n" + strings.Repeat("ж", 30), strings.Repeat("ж", 20)},
+		{"html", "Content-Type: text/html\r\n\r\n<html><head><title>X</title></head><body><p>Hi&amp;bye</p><script>x()</script></body></html>", "Hi&bye"},
+		{"alternative",
+			"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<b>HTML</b>\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nPlain\r\n" +
+				"--b--\r\n",
+			"Plain"},
+		{"attachment",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment\r\n\r\nFile\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nBody\r\n" +
+				"--b--\r\n",
+			"Body"},
+		{"no text", "Content-Type: image/png\r\n\r\nAAAA", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := store.messagePreview(strings.NewReader(c.msg)); got != c.preview {
+				t.Errorf("wrong preview: %q, want %q", got, c.preview)
+			}
+		})
+	}
+}
+
+func TestListMessages_Preview(t *testing.T) {
+	store := sqliteTestStorage(t)
+	store.previewLen = 200
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := bytes.NewBufferString("Subject: Hello\r\n\r\nHello, world!\r\n")
+	if err := mbox.CreateMessage(nil, time.Now(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	seq, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 1)
+	if err := mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, FetchPreview}, ch); err != nil {
+		t.Fatal(err)
+	}
+	res := <-ch
+	if res == nil {
+		t.Fatal("No message returned")
+	}
+	if preview := res.Items[FetchPreview]; preview != "Hello, world!" {
+		t.Errorf("wrong preview: %v", preview)
+	}
+	if len(res.Body) != 0 {
+		t.Error("Body section used for preview is returned")
+	}
+	if _, ok := res.Items[previewSection.FetchItem()]; ok {
+		t.Error("Body section used for preview is returned")
+	}
+	fields := res.Format()
+	if len(fields) != 4 {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}
@@ -0,0 +1,589 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-message/textproto"
+)
+
+// headerMetaFields is the set of header fields used by SORT and THREAD
+// implementations. All of them are in the go-imap-sql cached header, so they
+// are retrieved without reading message bodies.
+var headerMetaFields = []string{
+	"Date", "Subject", "Message-Id", "References", "In-Reply-To", "From", "To", "Cc",
+}
+
+type msgHeaderMeta struct {
+	// UID or sequence number, depending on the command used.
+	id       uint32
+	seqNum   uint32
+	arrival  time.Time
+	size     uint32
+	header   textproto.Header
+	sentDate time.Time
+}
+
+// headerMeta loads information about messages with specified ids.
+func (m *Mailbox) headerMeta(uid bool, ids []uint32) ([]*msgHeaderMeta, error) {
+	seqSet := &imap.SeqSet{}
+	seqSet.AddNum(ids...)
+
+	sect := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields:    headerMetaFields,
+		},
+		Peek: true,
+	}
+	items := []imap.FetchItem{
+		imap.FetchUid, imap.FetchInternalDate, imap.FetchRFC822Size, sect.FetchItem(),
+	}
+
+	ch := make(chan *imap.Message, 32)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- m.Mailbox.ListMessages(uid, seqSet, items, ch)
+	}()
+
+	res := make([]*msgHeaderMeta, 0, len(ids))
+	for msg := range ch {
+		meta := &msgHeaderMeta{
+			id:      msg.SeqNum,
+			seqNum:  msg.SeqNum,
+			arrival: msg.InternalDate,
+			size:    msg.Size,
+		}
+		if uid {
+			meta.id = msg.Uid
+		}
+		// msg.GetBody can't be used since it expects the section name from
+		// the response (without PEEK).
+		for _, lit := range msg.Body {
+			hdr, err := textproto.ReadHeader(bufio.NewReader(lit))
+			if err != nil {
+				m.store.Log.Error("malformed cached header", err, "mbox", m.Name(), "seq", msg.SeqNum)
+				continue
+			}
+			meta.header = hdr
+		}
+		meta.sentDate = meta.arrival
+		if date, err := mail.ParseDate(meta.header.Get("Date")); err == nil {
+			meta.sentDate = date
+		}
+		res = append(res, meta)
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// parseMsgIDs extracts all message identifiers from the Message-ID,
+// References or In-Reply-To field value.
+func parseMsgIDs(val string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(val, '<')
+		if start == -1 {
+			return ids
+		}
+		end := strings.IndexByte(val[start:], '>')
+		if end == -1 {
+			return ids
+		}
+		if id := strings.TrimSpace(val[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		val = val[start+end+1:]
+	}
+}
+
+// firstMailbox returns the addr-mailbox (local part) of the first address in
+// the header field, as used by SORT (RFC 5256, Section 3).
+func firstMailbox(hdr textproto.Header, field string) string {
+	list, err := mail.ParseAddressList(hdr.Get(field))
+	if err != nil || len(list) == 0 {
+		return ""
+	}
+	addr := list[0].Address
+	if at := strings.LastIndexByte(addr, '@'); at != -1 {
+		addr = addr[:at]
+	}
+	return strings.ToLower(addr)
+}
+
+func sortSubject(hdr textproto.Header) string {
+	subj, _ := sortthread.GetBaseSubject(hdr.Get("Subject"))
+	return strings.ToLower(subj)
+}
+
+// sortKey is the value of a single SORT criterion for a message. Depending
+// on the criterion, either str or num is used.
+type sortKey struct {
+	str string
+	num int64
+}
+
+func (k sortKey) compare(other sortKey) int {
+	switch {
+	case k.num < other.num:
+		return -1
+	case k.num > other.num:
+		return 1
+	}
+	return strings.Compare(k.str, other.str)
+}
+
+// msgSortKey computes the value of the SORT criterion for the message.
+func msgSortKey(msg *msgHeaderMeta, field sortthread.SortField) sortKey {
+	switch field {
+	case sortthread.SortArrival:
+		return sortKey{num: msg.arrival.Unix()}
+	case sortthread.SortCc:
+		return sortKey{str: firstMailbox(msg.header, "Cc")}
+	case sortthread.SortDate:
+		return sortKey{num: msg.sentDate.Unix()}
+	case sortthread.SortFrom:
+		return sortKey{str: firstMailbox(msg.header, "From")}
+	case sortthread.SortSize:
+		return sortKey{num: int64(msg.size)}
+	case sortthread.SortSubject:
+		return sortKey{str: sortSubject(msg.header)}
+	case sortthread.SortTo:
+		return sortKey{str: firstMailbox(msg.header, "To")}
+	}
+	return sortKey{}
+}
+
+// sortOrderBy returns the ORDER BY clause implementing the SORT criteria if
+// all of them correspond to the msgs table columns so messages can be sorted
+// by the database without loading their headers.
+func sortOrderBy(sortCrit []sortthread.SortCriterion) (string, bool) {
+	cols := make([]string, 0, len(sortCrit)+1)
+	for _, crit := range sortCrit {
+		var col string
+		switch crit.Field {
+		case sortthread.SortArrival:
+			col = "msgs.date"
+		case sortthread.SortSize:
+			col = "msgs.bodyLen"
+		default:
+			return "", false
+		}
+		if crit.Reverse {
+			col += " DESC"
+		}
+		cols = append(cols, col)
+	}
+	// Sequence number order is used if all criteria are equal.
+	cols = append(cols, "msgs.msgId")
+	return strings.Join(cols, ", "), true
+}
+
+// sortInDB implements the SORT command using the ORDER BY clause returned by
+// sortOrderBy.
+func (m *Mailbox) sortInDB(uid bool, orderBy string, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	uids, err := m.Mailbox.SearchMessages(true, searchCrit)
+	if err != nil {
+		return nil, err
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	matched := make(map[uint32]struct{}, len(uids))
+	for _, id := range uids {
+		matched[id] = struct{}{}
+	}
+
+	rows, err := m.store.Back.DB.Query(`
+		SELECT msgs.msgId FROM msgs
+		INNER JOIN mboxes ON mboxes.id = msgs.mboxId
+		INNER JOIN users ON users.id = mboxes.uid
+		WHERE users.username = `+m.store.placeholder(1)+` AND mboxes.name = `+m.store.placeholder(2)+`
+		ORDER BY `+orderBy, m.user.Username(), m.Mailbox.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all, res []uint32
+	for rows.Next() {
+		var id uint32
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		all = append(all, id)
+		if _, ok := matched[id]; ok {
+			res = append(res, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if !uid {
+		// Sequence number of the message is its position in the UID order.
+		sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+		seqNums := make(map[uint32]uint32, len(all))
+		for i, id := range all {
+			seqNums[id] = uint32(i + 1)
+		}
+		for i, id := range res {
+			res[i] = seqNums[id]
+		}
+	}
+	return res, nil
+}
+
+// Sort implements the SORT command (RFC 5256).
+//
+// It replaces the go-imap-sql implementation that handles REVERSE and
+// address-based keys incorrectly and limits the amount of sorted messages.
+func (m *Mailbox) Sort(uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	if orderBy, ok := sortOrderBy(sortCrit); ok {
+		return m.sortInDB(uid, orderBy, searchCrit)
+	}
+
+	ids, err := m.Mailbox.SearchMessages(uid, searchCrit)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	msgs, err := m.headerMeta(uid, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are computed once for each message since extracting them
+	// involves header parsing.
+	type sortedMsg struct {
+		*msgHeaderMeta
+		keys []sortKey
+	}
+	sorted := make([]sortedMsg, len(msgs))
+	for i, msg := range msgs {
+		keys := make([]sortKey, len(sortCrit))
+		for j, crit := range sortCrit {
+			keys[j] = msgSortKey(msg, crit.Field)
+		}
+		sorted[i] = sortedMsg{msgHeaderMeta: msg, keys: keys}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		for k, crit := range sortCrit {
+			res := sorted[i].keys[k].compare(sorted[j].keys[k])
+			if crit.Reverse {
+				res = -res
+			}
+			if res != 0 {
+				return res < 0
+			}
+		}
+		// Sequence number order is used if all criteria are equal.
+		return sorted[i].seqNum < sorted[j].seqNum
+	})
+
+	res := make([]uint32, len(sorted))
+	for i, msg := range sorted {
+		res[i] = msg.id
+	}
+	return res, nil
+}
+
+func (store *Storage) SupportedThreadAlgorithms() []sortthread.ThreadAlgorithm {
+	return []sortthread.ThreadAlgorithm{sortthread.OrderedSubject, sortthread.References}
+}
+
+// Thread implements the THREAD command. ORDEREDSUBJECT algorithm is provided
+// by go-imap-sql, REFERENCES is implemented here.
+func (m *Mailbox) Thread(uid bool, threading sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	if threading != sortthread.References {
+		return m.Mailbox.Thread(uid, threading, searchCrit)
+	}
+
+	ids, err := m.Mailbox.SearchMessages(uid, searchCrit)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	msgs, err := m.headerMeta(uid, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return referencesThread(msgs), nil
+}
+
+// threadContainer is a node of the threads tree built by the REFERENCES
+// algorithm. Containers without the message are "dummies" for messages
+// that are referenced but not present in the mailbox.
+type threadContainer struct {
+	msg      *msgHeaderMeta
+	parent   *threadContainer
+	children []*threadContainer
+}
+
+func (c *threadContainer) isAncestorOf(other *threadContainer) bool {
+	for p := other; p != nil; p = p.parent {
+		if p == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *threadContainer) addChild(child *threadContainer) {
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+func (c *threadContainer) removeChild(child *threadContainer) {
+	for i, ch := range c.children {
+		if ch == child {
+			c.children = append(c.children[:i], c.children[i+1:]...)
+			break
+		}
+	}
+	child.parent = nil
+}
+
+// firstMsg returns the message used to sort and group the container.
+func (c *threadContainer) firstMsg() *msgHeaderMeta {
+	for c.msg == nil {
+		if len(c.children) == 0 {
+			return nil
+		}
+		c = c.children[0]
+	}
+	return c.msg
+}
+
+// referencesThread implements the REFERENCES threading algorithm as
+// described in RFC 5256, Section 3.
+func referencesThread(msgs []*msgHeaderMeta) []*sortthread.Thread {
+	var (
+		idTable    = make(map[string]*threadContainer, len(msgs))
+		containers = make([]*threadContainer, 0, len(msgs))
+	)
+	getContainer := func(id string) *threadContainer {
+		c := idTable[id]
+		if c == nil {
+			c = &threadContainer{}
+			idTable[id] = c
+			containers = append(containers, c)
+		}
+		return c
+	}
+
+	// (1) Link messages together using the Message-ID, References and
+	// In-Reply-To fields.
+	for _, msg := range msgs {
+		var c *threadContainer
+		if ids := parseMsgIDs(msg.header.Get("Message-Id")); len(ids) != 0 {
+			c = getContainer(ids[0])
+		}
+		if c == nil || c.msg != nil {
+			// No Message-ID or duplicate Message-ID, treat the message as
+			// having a unique one.
+			c = &threadContainer{}
+			containers = append(containers, c)
+		}
+		c.msg = msg
+
+		refs := parseMsgIDs(msg.header.Get("References"))
+		if len(refs) == 0 {
+			refs = parseMsgIDs(msg.header.Get("In-Reply-To"))
+			if len(refs) > 1 {
+				refs = refs[:1]
+			}
+		}
+
+		var prev *threadContainer
+		for _, ref := range refs {
+			refC := getContainer(ref)
+			// Do not change existing links and do not introduce loops.
+			if prev != nil && refC.parent == nil && !refC.isAncestorOf(prev) {
+				prev.addChild(refC)
+			}
+			prev = refC
+		}
+
+		if prev != nil && c.isAncestorOf(prev) {
+			prev = nil
+		}
+		if c.parent != nil {
+			c.parent.removeChild(c)
+		}
+		if prev != nil {
+			prev.addChild(c)
+		}
+	}
+
+	// (2) Gather the root set.
+	var roots []*threadContainer
+	for _, c := range containers {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+
+	// (3) Prune dummy containers.
+	roots = pruneThreads(roots, true)
+
+	// (4) Sort the root set and all children by sent date.
+	sortThreads(roots)
+
+	// (5) Group threads with the same base subject.
+	roots = groupBySubject(roots)
+
+	// (6) Sort again to account for containers added in (5).
+	sortThreads(roots)
+
+	return convertThreads(roots)
+}
+
+func pruneThreads(cs []*threadContainer, root bool) []*threadContainer {
+	res := make([]*threadContainer, 0, len(cs))
+	for _, c := range cs {
+		c.children = pruneThreads(c.children, false)
+		if c.msg == nil {
+			if len(c.children) == 0 {
+				continue
+			}
+			// Children of the dummy are promoted to its level, unless that
+			// would make multiple root-level threads out of one.
+			if !root || len(c.children) == 1 {
+				for _, ch := range c.children {
+					ch.parent = c.parent
+				}
+				res = append(res, c.children...)
+				continue
+			}
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+func sortThreads(cs []*threadContainer) {
+	for _, c := range cs {
+		sortThreads(c.children)
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		iMsg, jMsg := cs[i].firstMsg(), cs[j].firstMsg()
+		if !iMsg.sentDate.Equal(jMsg.sentDate) {
+			return iMsg.sentDate.Before(jMsg.sentDate)
+		}
+		return iMsg.seqNum < jMsg.seqNum
+	})
+}
+
+func containerSubject(c *threadContainer) (string, bool) {
+	return sortthread.GetBaseSubject(c.firstMsg().header.Get("Subject"))
+}
+
+func groupBySubject(roots []*threadContainer) []*threadContainer {
+	subjTable := make(map[string]*threadContainer, len(roots))
+	for _, c := range roots {
+		subj, isReply := containerSubject(c)
+		if subj == "" {
+			continue
+		}
+		old := subjTable[subj]
+		if old == nil {
+			subjTable[subj] = c
+			continue
+		}
+		_, oldIsReply := containerSubject(old)
+		if c.msg == nil && old.msg != nil || old.msg != nil && oldIsReply && c.msg != nil && !isReply {
+			subjTable[subj] = c
+		}
+	}
+
+	res := make([]*threadContainer, 0, len(roots))
+	for _, c := range roots {
+		subj, isReply := containerSubject(c)
+		t := subjTable[subj]
+		if subj == "" || t == c {
+			res = append(res, c)
+			continue
+		}
+		_, tIsReply := containerSubject(t)
+
+		switch {
+		case t.msg == nil && c.msg == nil:
+			for _, ch := range c.children {
+				t.addChild(ch)
+			}
+		case t.msg == nil:
+			t.addChild(c)
+		case c.msg != nil && !tIsReply && isReply:
+			t.addChild(c)
+		default:
+			// Make both containers children of a new dummy. Container in
+			// the table is turned into the dummy in-place so it keeps its
+			// position in the root set.
+			moved := &threadContainer{msg: t.msg, children: t.children}
+			for _, ch := range moved.children {
+				ch.parent = moved
+			}
+			t.msg = nil
+			t.children = nil
+			t.addChild(moved)
+			if c.msg == nil {
+				for _, ch := range c.children {
+					t.addChild(ch)
+				}
+			} else {
+				t.addChild(c)
+			}
+		}
+	}
+	return res
+}
+
+func convertThreads(cs []*threadContainer) []*sortthread.Thread {
+	res := make([]*sortthread.Thread, 0, len(cs))
+	for _, c := range cs {
+		t := &sortthread.Thread{
+			Children: convertThreads(c.children),
+		}
+		// Dummy containers are represented by threads with zero Id.
+		if c.msg != nil {
+			t.Id = c.msg.id
+		}
+		res = append(res, t)
+	}
+	return res
+}
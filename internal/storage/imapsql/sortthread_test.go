@@ -0,0 +1,170 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+)
+
+func threadsStr(threads []*sortthread.Thread) []interface{} {
+	res := make([]interface{}, 0, len(threads))
+	for _, t := range threads {
+		res = append(res, []interface{}{t.Id, threadsStr(t.Children)})
+	}
+	return res
+}
+
+func TestThread_References(t *testing.T) {
+	store := sqliteTestStorage(t)
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, hdr := range []string{
+		"Message-ID: <1@example.org>\r\nSubject: Hello\r\n",
+		"Message-ID: <2@example.org>\r\nReferences: <1@example.org>\r\nSubject: Re: Hello\r\n",
+		"Message-ID: <3@example.org>\r\nSubject: Other\r\n",
+		"Message-ID: <4@example.org>\r\nIn-Reply-To: <missing@example.org>\r\nSubject: Lost\r\n",
+		"Message-ID: <5@example.org>\r\nIn-Reply-To: <missing@example.org>\r\nSubject: Re: Lost\r\n",
+		"Message-ID: <6@example.org>\r\nReferences: <1@example.org> <2@example.org>\r\nSubject: Re: Hello\r\n",
+		"Message-ID: <7@example.org>\r\nSubject: Re: Other\r\n",
+	} {
+		date := base.Add(time.Duration(i) * time.Hour)
+		msg := bytes.NewBufferString("Date: " + date.Format(time.RFC1123Z) + "\r\n" + hdr + "\r\nHello!\r\n")
+		if err := mbox.CreateMessage(nil, date, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	threads, err := mbox.(sortthread.ThreadMailbox).Thread(true, sortthread.References, imap.NewSearchCriteria())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []interface{}{
+		[]interface{}{uint32(1), []interface{}{
+			[]interface{}{uint32(2), []interface{}{
+				[]interface{}{uint32(6), []interface{}{}},
+			}},
+		}},
+		[]interface{}{uint32(3), []interface{}{
+			[]interface{}{uint32(7), []interface{}{}},
+		}},
+		[]interface{}{uint32(0), []interface{}{
+			[]interface{}{uint32(4), []interface{}{}},
+			[]interface{}{uint32(5), []interface{}{}},
+		}},
+	}
+	if got := threadsStr(threads); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong threads:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestParseMsgIDs(t *testing.T) {
+	got := parseMsgIDs(" <a@example.org>\r\n\t<b@example.org> garbage <> <c@example.org")
+	want := []string{"a@example.org", "b@example.org"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong ids: %v", got)
+	}
+}
+
+func TestSort(t *testing.T) {
+	store := sqliteTestStorage(t)
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, msg := range []struct {
+		hdr     string
+		date    time.Time
+		arrival time.Time
+	}{
+		{"From: Zed <a@example.org>\r\nSubject: Re: banana\r\n", base.Add(2 * time.Hour), base},
+		{"From: <c@example.org>\r\nSubject: apple\r\n", base, base.Add(time.Hour)},
+		{"From: Alice <B@example.org>\r\nSubject: Fwd: Cherry\r\n", base.Add(time.Hour), base.Add(2 * time.Hour)},
+	} {
+		body := bytes.NewBufferString("Date: " + msg.date.Format(time.RFC1123Z) + "\r\n" + msg.hdr + "\r\nHello!\r\n")
+		if err := mbox.CreateMessage(nil, msg.arrival, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sortMbox := mbox.(sortthread.SortMailbox)
+	for _, c := range []struct {
+		crit []sortthread.SortCriterion
+		want []uint32
+	}{
+		{[]sortthread.SortCriterion{{Field: sortthread.SortArrival}}, []uint32{1, 2, 3}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortArrival, Reverse: true}}, []uint32{3, 2, 1}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortDate}}, []uint32{2, 3, 1}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortSize}}, []uint32{2, 1, 3}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortSize, Reverse: true}}, []uint32{3, 1, 2}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortFrom}}, []uint32{1, 3, 2}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortFrom, Reverse: true}}, []uint32{2, 3, 1}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortSubject}}, []uint32{2, 1, 3}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortTo}, {Field: sortthread.SortDate, Reverse: true}}, []uint32{1, 3, 2}},
+	} {
+		for _, uid := range []bool{true, false} {
+			got, err := sortMbox.Sort(uid, c.crit, imap.NewSearchCriteria())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%+v (uid = %v): got %v, want %v", c.crit, uid, got, c.want)
+			}
+		}
+	}
+
+	// Sequence numbers no longer match UIDs.
+	seq := &imap.SeqSet{}
+	seq.AddNum(1)
+	if err := mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := sortMbox.Sort(false, []sortthread.SortCriterion{{Field: sortthread.SortSize, Reverse: true}}, imap.NewSearchCriteria())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"strings"
+
+	specialuse "github.com/emersion/go-imap-specialuse"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+// specialUseNames contains special-use attributes that can be used as
+// delivery targets and names of mailboxes created for them if missing.
+//
+// \All and \Flagged are not included since they denote virtual mailboxes.
+var specialUseNames = map[string]string{
+	specialuse.Archive:   "Archive",
+	specialuse.Drafts:    "Drafts",
+	specialuse.Junk:      "Junk",
+	specialuse.Sent:      "Sent",
+	specialuse.Trash:     "Trash",
+	specialuse.Important: "Important",
+}
+
+// specialUseAttr returns the canonical form of the special-use attribute
+// if folder refers to a mailbox using it (e.g. "\Junk").
+func specialUseAttr(folder string) (string, bool) {
+	if !strings.HasPrefix(folder, `\`) {
+		return "", false
+	}
+	for attr := range specialUseNames {
+		if strings.EqualFold(attr, folder) {
+			return attr, true
+		}
+	}
+	return "", false
+}
+
+// resolveSpecialUse returns the internal name of the account mailbox with
+// the special-use attribute.
+//
+// If there is no such mailbox and special_use_autocreate is enabled, it is
+// created. Empty string is returned if the mailbox is missing and is not
+// created.
+//
+// Attributes are reported by go-imap-sql only if the SPECIAL-USE extension
+// is enabled, which is done in Init.
+func (store *Storage) resolveSpecialUse(accountName, attr string) (string, error) {
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return "", err
+	}
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return "", err
+	}
+	for _, mbox := range mboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return "", err
+		}
+		for _, a := range info.Attributes {
+			if a == attr {
+				return info.Name, nil
+			}
+		}
+	}
+
+	if !store.specialUseCreate {
+		return "", nil
+	}
+
+	name := specialUseNames[attr]
+	if attr == specialuse.Junk {
+		name = store.junkMbox
+	}
+	name = store.intName(name)
+	if err := u.(*imapsql.User).CreateMailboxSpecial(name, attr); err != nil && err != backend.ErrMailboxAlreadyExists {
+		return "", err
+	}
+	store.Log.Msg("created special-use mailbox", "username", accountName, "mbox", name, "attr", attr)
+	return name, nil
+}
@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type folderFilter string
+
+func (f folderFilter) IMAPFilter(string, *module.MsgMetadata, textproto.Header, buffer.Buffer) (string, []string, error) {
+	return string(f), nil, nil
+}
+
+type flagsFilter struct {
+	folder string
+	flags  []string
+}
+
+func (f flagsFilter) IMAPFilter(string, *module.MsgMetadata, textproto.Header, buffer.Buffer) (string, []string, error) {
+	return f.folder, f.flags, nil
+}
+
+func TestDelivery_SpecialUse(t *testing.T) {
+	store := sqliteTestStorage(t)
+	store.junkMbox = "Junk"
+	store.deliveryNormalize = store.authNormalize
+	store.specialUseCreate = true
+	store.Back.EnableSpecialUseExt()
+
+	for _, name := range []string{"test1@example.org", "test2@example.org", "test3@example.org"} {
+		if _, err := store.GetOrCreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := store.Back.GetUser("test1@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.(*imapsql.User).CreateMailboxSpecial("Spam", `\Junk`); err != nil {
+		t.Fatal(err)
+	}
+
+	store.filters = folderFilter(`\junk`)
+	t.Run("existing", func(t *testing.T) {
+		testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test1@example.org"})
+	})
+	t.Run("created", func(t *testing.T) {
+		testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test2@example.org"})
+	})
+	checkMsgCount(t, store, "test1@example.org", "Spam", 1)
+	checkMsgCount(t, store, "test1@example.org", "INBOX", 0)
+	checkMsgCount(t, store, "test2@example.org", "Junk", 1)
+
+	store.filters = folderFilter(`\Sent`)
+	t.Run("sent", func(t *testing.T) {
+		testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test2@example.org"})
+	})
+	checkMsgCount(t, store, "test2@example.org", "Sent", 1)
+
+	store.specialUseCreate = false
+	store.filters = folderFilter(`\Archive`)
+	t.Run("not created", func(t *testing.T) {
+		testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test3@example.org"})
+	})
+	checkMsgCount(t, store, "test3@example.org", "INBOX", 1)
+
+	// Flags are kept if the message is delivered to INBOX instead.
+	store.filters = flagsFilter{folder: `\Archive`, flags: []string{"$Filtered"}}
+	t.Run("not created, flags", func(t *testing.T) {
+		testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test3@example.org"})
+	})
+	checkMsgCount(t, store, "test3@example.org", "INBOX", 2)
+
+	u, err = store.GetIMAPAcct("test3@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("2")
+	ch := make(chan *imap.Message, 1)
+	if err := mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchFlags}, ch); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-ch
+	if msg == nil {
+		t.Fatal("Message is missing")
+	}
+	found := false
+	for _, f := range msg.Flags {
+		if f == "$Filtered" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Flags set by the filter are not applied: %v", msg.Flags)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// go-imap-sql does not return UIDs assigned to created messages. However, it
+// allocates them sequentially starting at UIDNEXT, so they can be derived by
+// comparing UIDNEXT values before and after the operation. If UIDNEXT
+// advanced by more than the amount of messages we created, somebody else
+// added messages concurrently and assigned UIDs are not known for sure. In
+// this case, zero UIDVALIDITY and nil UIDs are returned and the caller is
+// expected to omit UIDPLUS response codes.
+
+func uidState(mbox interface {
+	Status([]imap.StatusItem) (*imap.MailboxStatus, error)
+}) (validity, next uint32, err error) {
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext})
+	if err != nil {
+		return 0, 0, err
+	}
+	return status.UidValidity, status.UidNext, nil
+}
+
+// CreateMessageUID creates the message and returns the UIDVALIDITY of the
+// mailbox and UID assigned to the message.
+func (m *Mailbox) CreateMessageUID(flags []string, date time.Time, body imap.Literal) (validity, uid uint32, err error) {
+	validity, before, err := uidState(m.Mailbox)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := m.CreateMessage(flags, date, body); err != nil {
+		return 0, 0, err
+	}
+
+	_, after, err := uidState(m.Mailbox)
+	if err != nil {
+		m.store.Log.Error("failed to read UIDNEXT after APPEND", err, "username", m.user.Username(), "mbox", m.Name())
+		return 0, 0, nil
+	}
+	if after-before != 1 {
+		return 0, 0, nil
+	}
+	return validity, before, nil
+}
+
+// resolveUIDs returns UIDs of messages in seqset in the same order
+// go-imap-sql processes them during COPY and MOVE.
+func (m *Mailbox) resolveUIDs(uid bool, seqset *imap.SeqSet) ([]uint32, error) {
+	var uids []uint32
+	for _, seq := range seqset.Set {
+		set := &imap.SeqSet{Set: []imap.Seq{seq}}
+		criteria := &imap.SearchCriteria{}
+		if uid {
+			criteria.Uid = set
+		} else {
+			criteria.SeqNum = set
+		}
+
+		res, err := m.Mailbox.SearchMessages(true, criteria)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+		uids = append(uids, res...)
+	}
+	return uids, nil
+}
+
+func (m *Mailbox) copyUID(uid bool, seqset *imap.SeqSet, dest string, op func(bool, *imap.SeqSet, string) error) (validity uint32, srcUIDs, destUIDs []uint32, err error) {
+	destMbox, err := m.user.User.GetMailbox(m.store.intName(dest))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	srcUIDs, err = m.resolveUIDs(uid, seqset)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	validity, before, err := uidState(destMbox)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	if err := op(uid, seqset, dest); err != nil {
+		return 0, nil, nil, err
+	}
+
+	_, after, err := uidState(destMbox)
+	if err != nil {
+		m.store.Log.Error("failed to read UIDNEXT after COPY", err, "username", m.user.Username(), "mbox", dest)
+		return 0, nil, nil, nil
+	}
+	if len(srcUIDs) == 0 || int(after-before) != len(srcUIDs) {
+		if m.store.learnsInto(dest) {
+			m.store.Log.Msg("target mailbox changed concurrently, messages are not learned", "username", m.user.Username(), "mbox", dest)
+		}
+		return 0, nil, nil, nil
+	}
+
+	destUIDs = make([]uint32, len(srcUIDs))
+	for i := range destUIDs {
+		destUIDs[i] = before + uint32(i)
+	}
+	m.learnCopied(dest, destUIDs)
+	return validity, srcUIDs, destUIDs, nil
+}
+
+// CopyMessagesUID copies messages and returns the UIDVALIDITY of the
+// destination mailbox, source UIDs and corresponding UIDs of created
+// messages.
+func (m *Mailbox) CopyMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (validity uint32, srcUIDs, destUIDs []uint32, err error) {
+	return m.copyUID(uid, seqset, dest, m.copyMessages)
+}
+
+// MoveMessagesUID is the same as CopyMessagesUID but moves messages instead.
+func (m *Mailbox) MoveMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (validity uint32, srcUIDs, destUIDs []uint32, err error) {
+	return m.copyUID(uid, seqset, dest, m.moveMessages)
+}
+
+// ExpungeUIDs permanently removes messages that have the \Deleted flag set
+// and have UIDs from the specified set.
+func (m *Mailbox) ExpungeUIDs(seqset *imap.SeqSet) error {
+	uids, err := m.Mailbox.SearchMessages(true, &imap.SearchCriteria{
+		Uid:       seqset,
+		WithFlags: []string{imap.DeletedFlag},
+	})
+	if err != nil {
+		return err
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+
+	set := &imap.SeqSet{}
+	set.AddNum(uids...)
+	return m.Mailbox.DelMessages(true, set)
+}
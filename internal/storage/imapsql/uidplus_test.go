@@ -0,0 +1,91 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestUIDPlus(t *testing.T) {
+	store := sqliteTestStorage(t)
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Target"); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := mbox.(*Mailbox)
+
+	msg := []byte("Subject: test\r\n\r\nHello!\r\n")
+	for i := uint32(1); i <= 4; i++ {
+		validity, uid, err := inbox.CreateMessageUID(nil, time.Now(), bytes.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if validity == 0 || uid != i {
+			t.Fatalf("wrong APPENDUID: %d %d (want UID %d)", validity, uid, i)
+		}
+	}
+
+	seq, _ := imap.ParseSeqSet("3:4,1")
+	_, src, dest, err := inbox.CopyMessagesUID(true, seq, "Target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src, []uint32{1, 3, 4}) || !reflect.DeepEqual(dest, []uint32{1, 2, 3}) {
+		t.Fatalf("wrong COPYUID: %v %v", src, dest)
+	}
+
+	seq, _ = imap.ParseSeqSet("2")
+	_, src, dest, err = inbox.MoveMessagesUID(false, seq, "Target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src, []uint32{2}) || !reflect.DeepEqual(dest, []uint32{4}) {
+		t.Fatalf("wrong COPYUID for MOVE: %v %v", src, dest)
+	}
+
+	seq, _ = imap.ParseSeqSet("1:3")
+	if err := inbox.UpdateMessagesFlags(true, seq, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	seq, _ = imap.ParseSeqSet("3:4")
+	if err := inbox.ExpungeUIDs(seq); err != nil {
+		t.Fatal(err)
+	}
+	uids, err := inbox.SearchMessages(true, &imap.SearchCriteria{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(uids, []uint32{1, 4}) {
+		t.Fatalf("wrong UIDs after UID EXPUNGE: %v", uids)
+	}
+}
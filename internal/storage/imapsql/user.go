@@ -0,0 +1,173 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	namespace "github.com/foxcpp/go-imap-namespace"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+var (
+	ErrRenameToInbox   = errors.New("imapsql: INBOX can't be used as a rename target")
+	ErrRenameIntoChild = errors.New("imapsql: mailbox can't be moved into its own hierarchy")
+)
+
+// User wraps the go-imap-sql User object and adjusts the behavior of
+// certain operations to match RFC 3501 requirements more closely. It also
+// translates mailbox names according to the configured hierarchy separator.
+//
+// Embedding the concrete type keeps all extension interfaces implemented by
+// go-imap-sql (SPECIAL-USE, NAMESPACE, APPENDLIMIT, etc) available.
+type User struct {
+	*imapsql.User
+	store *Storage
+}
+
+func (store *Storage) wrapUser(u backend.User, err error) (backend.User, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &User{User: u.(*imapsql.User), store: store}, nil
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mboxes, err := u.User.ListMailboxes(subscribed)
+	if err != nil {
+		return nil, err
+	}
+	for i, mbox := range mboxes {
+		mboxes[i] = u.store.wrapMailbox(u, mbox)
+	}
+	return mboxes, nil
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(u.store.intName(name))
+	if err != nil {
+		return nil, err
+	}
+	return u.store.wrapMailbox(u, mbox), nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	return u.User.CreateMailbox(u.store.intName(name))
+}
+
+func (u *User) CreateMailboxSpecial(name, specialUseAttr string) error {
+	return u.User.CreateMailboxSpecial(u.store.intName(name), specialUseAttr)
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	return u.User.DeleteMailbox(u.store.intName(name))
+}
+
+func (u *User) Namespaces() (personal, other, shared []namespace.Namespace, err error) {
+	return []namespace.Namespace{
+		{
+			Prefix:    "",
+			Delimiter: u.store.delimiter,
+		},
+	}, nil, nil, nil
+}
+
+// RenameMailbox renames the mailbox with all its children.
+//
+// Special-use attributes and subscription status are kept by the
+// corresponding mailboxes. The whole subtree is renamed within a single
+// transaction, so either all mailboxes are renamed or none of them are.
+//
+// Renaming INBOX is a special case described in RFC 3501, Section 6.3.5:
+// messages are moved to the newly created mailbox and INBOX is left empty.
+// Children of INBOX (if any) are not affected.
+func (u *User) RenameMailbox(existingName, newName string) error {
+	// RFC 3501, Section 6.3.5: trailing hierarchy separator is not a part of the
+	// name.
+	newName = strings.TrimSuffix(newName, u.store.delimiter)
+
+	existingName = u.store.intName(existingName)
+	newName = u.store.intName(newName)
+
+	if strings.EqualFold(existingName, imap.InboxName) {
+		existingName = imap.InboxName
+	}
+	if strings.EqualFold(newName, imap.InboxName) {
+		return ErrRenameToInbox
+	}
+	if existingName == newName {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if existingName != imap.InboxName && strings.HasPrefix(newName, existingName+imapsql.MailboxPathSep) {
+		return ErrRenameIntoChild
+	}
+
+	if _, err := u.User.GetMailbox(existingName); err != nil {
+		return err
+	}
+	if _, err := u.User.GetMailbox(newName); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	} else if err != backend.ErrNoSuchMailbox {
+		return err
+	}
+
+	if existingName == imap.InboxName {
+		return u.renameInbox(newName)
+	}
+
+	// go-imap-sql renames children in the same transaction. UNIQUE constraint
+	// on the mailbox name makes sure the transaction is rolled back if any
+	// child name conflicts with an existing mailbox.
+	return u.User.RenameMailbox(existingName, newName)
+}
+
+func (u *User) renameInbox(newName string) error {
+	if err := u.User.CreateMailbox(newName); err != nil {
+		return err
+	}
+
+	inbox, err := u.User.GetMailbox(imap.InboxName)
+	if err != nil {
+		return err
+	}
+	status, err := inbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		return err
+	}
+	if status.Messages == 0 {
+		return nil
+	}
+
+	seq := &imap.SeqSet{}
+	seq.AddRange(1, 0)
+
+	// MoveMessages is atomic on its own, so if it fails, INBOX is left
+	// untouched and we need to only clean up the created mailbox.
+	if err := inbox.(*imapsql.Mailbox).MoveMessages(true, seq, newName); err != nil {
+		if delErr := u.User.DeleteMailbox(newName); delErr != nil {
+			u.store.Log.Error("failed to remove mailbox after failed INBOX rename", delErr, "username", u.Username(), "mbox", newName)
+		}
+		return err
+	}
+
+	return nil
+}
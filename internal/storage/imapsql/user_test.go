@@ -0,0 +1,254 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func sqliteTestStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "maddy-imapsql-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Mkdir(filepath.Join(dir, "messages"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := imapsql.New("sqlite3", filepath.Join(dir, "imapsql.db"),
+		&imapsql.FSStore{Root: filepath.Join(dir, "messages")}, imapsql.Opts{
+			LazyUpdatesInit: true,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store := &Storage{
+		Back:      db,
+		Log:       testutils.Logger(t, "imapsql"),
+		delimiter: imapsql.MailboxPathSep,
+	}
+	store.authNormalize = func(_ context.Context, s string) (string, error) { return s, nil }
+	return store
+}
+
+func listMboxes(t *testing.T, u backend.User) []string {
+	t.Helper()
+
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(mboxes))
+	for _, mbox := range mboxes {
+		names = append(names, mbox.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRenameMailbox_Subtree(t *testing.T) {
+	store := sqliteTestStorage(t)
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Work", "Work.A", "Work.A.B", "Workshop"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := u.RenameMailbox("Work", "Projects"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"INBOX", "Projects", "Projects.A", "Projects.A.B", "Workshop"}
+	if got := listMboxes(t, u); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong mailboxes after rename: %v (want %v)", got, want)
+	}
+}
+
+func TestRenameMailbox_Conflicts(t *testing.T) {
+	store := sqliteTestStorage(t)
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"A", "A.Child", "B", "C.Child"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := u.RenameMailbox("A", "B"); err != backend.ErrMailboxAlreadyExists {
+		t.Fatal("expected ErrMailboxAlreadyExists, got", err)
+	}
+	if err := u.RenameMailbox("A", "A.Child.Sub"); err != ErrRenameIntoChild {
+		t.Fatal("expected ErrRenameIntoChild, got", err)
+	}
+	if err := u.RenameMailbox("B", "inbox"); err != ErrRenameToInbox {
+		t.Fatal("expected ErrRenameToInbox, got", err)
+	}
+	if err := u.RenameMailbox("Z", "Y"); err != backend.ErrNoSuchMailbox {
+		t.Fatal("expected ErrNoSuchMailbox, got", err)
+	}
+
+	if err := u.RenameMailbox("A", "C"); err != backend.ErrMailboxAlreadyExists {
+		t.Fatal("expected ErrMailboxAlreadyExists for implicitly created parent, got", err)
+	}
+
+	want := []string{"A", "A.Child", "B", "C", "C.Child", "INBOX"}
+	if got := listMboxes(t, u); !reflect.DeepEqual(got, want) {
+		t.Fatalf("mailboxes changed after failed renames: %v (want %v)", got, want)
+	}
+}
+
+func TestRenameMailbox_Inbox(t *testing.T) {
+	store := sqliteTestStorage(t)
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.CreateMailbox("INBOX.Child"); err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := bytes.NewBufferString("Subject: test\r\n\r\nHello!\r\n")
+	if err := inbox.CreateMessage(nil, time.Now(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.RenameMailbox("INBOX", "Old"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"INBOX", "INBOX.Child", "Old"}
+	if got := listMboxes(t, u); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong mailboxes after rename: %v (want %v)", got, want)
+	}
+
+	checkCount := func(name string, expected uint32) {
+		t.Helper()
+		mbox, err := u.GetMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != expected {
+			t.Errorf("%s: wrong messages count: %d (want %d)", name, status.Messages, expected)
+		}
+	}
+	checkCount("INBOX", 0)
+	checkCount("Old", 1)
+}
+
+func TestDelimiter(t *testing.T) {
+	store := sqliteTestStorage(t)
+	store.delimiter = "/"
+
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Work/Reports", "john.doe"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"INBOX", "Work", "Work/Reports", "john.doe"}
+	if got := listMboxes(t, u); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong mailboxes: %v (want %v)", got, want)
+	}
+
+	// Stored names use go-imap-sql separator.
+	rawUser, err := store.Back.GetUser("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"INBOX", "Work", "Work.Reports", "john/doe"}
+	if got := listMboxes(t, rawUser); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong stored mailboxes: %v (want %v)", got, want)
+	}
+
+	mbox, err := u.GetMailbox("Work/Reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := mbox.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "Work/Reports" || info.Delimiter != "/" {
+		t.Fatalf("wrong mailbox info: name %q, delimiter %q", info.Name, info.Delimiter)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Name != "Work/Reports" {
+		t.Fatalf("wrong mailbox status name: %q", status.Name)
+	}
+
+	if err := u.RenameMailbox("Work", "Projects/"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"INBOX", "Projects", "Projects/Reports", "john.doe"}
+	if got := listMboxes(t, u); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong mailboxes after rename: %v (want %v)", got, want)
+	}
+
+	personal, _, _, err := u.(*User).Namespaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(personal) != 1 || personal[0].Delimiter != "/" {
+		t.Fatalf("wrong personal namespace: %+v", personal)
+	}
+}
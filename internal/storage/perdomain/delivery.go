@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package perdomain
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// backendDelivery is the delivery state for a single backend.
+type backendDelivery struct {
+	name     string
+	delivery module.Delivery
+	rcpts    []string
+}
+
+type delivery struct {
+	s        *Storage
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+
+	// Deliveries are started lazily when the first recipient for the
+	// backend is added.
+	deliveries []*backendDelivery
+	byBackend  map[module.Storage]*backendDelivery
+}
+
+func (s *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		s:         s,
+		log:       target.DeliveryLogger(s.log, msgMeta),
+		msgMeta:   msgMeta,
+		mailFrom:  mailFrom,
+		byBackend: map[module.Storage]*backendDelivery{},
+	}, nil
+}
+
+func backendName(be module.Storage) string {
+	if mod, ok := be.(module.Module); ok {
+		return mod.Name() + ":" + mod.InstanceName()
+	}
+	return fmt.Sprintf("%T", be)
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	be, err := d.s.backendFor(rcptTo)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "User does not exist",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+
+	bd, ok := d.byBackend[be]
+	if !ok {
+		tgt, ok := be.(module.DeliveryTarget)
+		if !ok {
+			return exterrors.WithFields(
+				fmt.Errorf("%s: storage %T cannot be used for delivery", modName, be),
+				map[string]interface{}{"target": modName})
+		}
+		del, err := tgt.Start(ctx, d.msgMeta, d.mailFrom)
+		if err != nil {
+			return err
+		}
+		bd = &backendDelivery{
+			name:     backendName(be),
+			delivery: del,
+		}
+		d.byBackend[be] = bd
+		d.deliveries = append(d.deliveries, bd)
+	}
+
+	if err := bd.delivery.AddRcpt(ctx, rcptTo); err != nil {
+		return err
+	}
+	bd.rcpts = append(bd.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	for _, bd := range d.deliveries {
+		if len(bd.rcpts) == 0 {
+			continue
+		}
+		if err := bd.delivery.Body(ctx, header.Copy(), body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BodyNonAtomic stores the body in all backends and reports errors only for
+// recipients handled by the failed backend.
+//
+// Deliveries for failed backends are aborted so Commit affects only the
+// remaining ones.
+func (d *delivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	for _, bd := range d.deliveries {
+		if bd.delivery == nil || len(bd.rcpts) == 0 {
+			continue
+		}
+		if partial, ok := bd.delivery.(module.PartialDelivery); ok {
+			partial.BodyNonAtomic(ctx, c, header.Copy(), body)
+			continue
+		}
+
+		if err := bd.delivery.Body(ctx, header.Copy(), body); err != nil {
+			for _, rcpt := range bd.rcpts {
+				c.SetStatus(rcpt, err)
+			}
+			if err := bd.delivery.Abort(ctx); err != nil {
+				d.log.Error("delivery abort failed", err, "storage", bd.name)
+			}
+			bd.delivery = nil
+		}
+	}
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	var firstErr error
+	for _, bd := range d.deliveries {
+		if bd.delivery == nil {
+			continue
+		}
+		if err := bd.delivery.Abort(ctx); err != nil {
+			d.log.Error("delivery abort failed", err, "storage", bd.name)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	for i, bd := range d.deliveries {
+		if bd.delivery == nil {
+			continue
+		}
+		if len(bd.rcpts) == 0 {
+			if err := bd.delivery.Abort(ctx); err != nil {
+				d.log.Error("delivery abort failed", err, "storage", bd.name)
+			}
+			continue
+		}
+		if err := bd.delivery.Commit(ctx); err != nil {
+			// Messages already committed to other backends cannot be
+			// reverted, so only abort the remaining ones.
+			for _, rest := range d.deliveries[i+1:] {
+				if rest.delivery == nil {
+					continue
+				}
+				if err := rest.delivery.Abort(ctx); err != nil {
+					d.log.Error("delivery abort failed", err, "storage", rest.name)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
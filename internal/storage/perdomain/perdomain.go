@@ -0,0 +1,379 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package perdomain implements storage.per_domain module that dispatches
+// mailbox access and local delivery to different storage backends based on
+// the domain part of the account name or recipient address.
+//
+// Interfaces implemented:
+// - module.Storage
+// - module.ManageableStorage
+// - module.DeliveryTarget
+// - module.Table
+// - children.Backend
+// - i18nlevel.Backend
+// - sortthread.ThreadBackend
+// - backend.BackendUpdater
+// - updatepipe.Backend
+package perdomain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	sortthread "github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-imap/backend"
+	i18nlevel "github.com/foxcpp/go-imap-i18nlevel"
+	"github.com/foxcpp/go-imap-sql/children"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/updatepipe"
+)
+
+const modName = "storage.per_domain"
+
+var ErrNoBackend = errors.New("per_domain: no storage configured for the domain")
+
+type Storage struct {
+	instName string
+	log      log.Logger
+
+	// All unique backends in the configuration order.
+	backends []module.Storage
+	domains  map[string]module.Storage
+	fallback module.Storage
+
+	updatesOnce sync.Once
+	updates     chan backend.Update
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Storage{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		domains:  map[string]module.Storage{},
+	}, nil
+}
+
+func (s *Storage) Name() string {
+	return modName
+}
+
+func (s *Storage) InstanceName() string {
+	return s.instName
+}
+
+func (s *Storage) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &s.log.Debug)
+	cfg.Callback("domain", func(m *config.Map, node config.Node) error {
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "at least one domain and the storage reference are required")
+		}
+		be, err := s.backendFromNode(m, node, node.Args[len(node.Args)-1])
+		if err != nil {
+			return err
+		}
+		for _, domain := range node.Args[:len(node.Args)-1] {
+			domain, err := dns.ForLookup(domain)
+			if err != nil {
+				return config.NodeErr(node, "invalid domain: %v", err)
+			}
+			if _, ok := s.domains[domain]; ok {
+				return config.NodeErr(node, "duplicate domain: %s", domain)
+			}
+			s.domains[domain] = be
+		}
+		return nil
+	})
+	cfg.Callback("default", func(m *config.Map, node config.Node) error {
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "exactly one argument is required")
+		}
+		if s.fallback != nil {
+			return config.NodeErr(node, "default storage is already set")
+		}
+		be, err := s.backendFromNode(m, node, node.Args[0])
+		if err != nil {
+			return err
+		}
+		s.fallback = be
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(s.backends) == 0 {
+		return fmt.Errorf("%s: at least one storage backend is required", modName)
+	}
+	return nil
+}
+
+func (s *Storage) backendFromNode(m *config.Map, node config.Node, ref string) (module.Storage, error) {
+	if !strings.HasPrefix(ref, "&") {
+		return nil, config.NodeErr(node, "storage should be referenced using &name syntax")
+	}
+
+	var be module.Storage
+	if err := modconfig.ModuleFromNode("storage", []string{ref}, node, m.Globals, &be); err != nil {
+		return nil, err
+	}
+
+	for _, existing := range s.backends {
+		if existing == be {
+			return be, nil
+		}
+	}
+	s.backends = append(s.backends, be)
+	return be, nil
+}
+
+// backendFor returns the storage backend responsible for the account name
+// or address.
+//
+// Names without the domain part are handled by the default backend.
+func (s *Storage) backendFor(name string) (module.Storage, error) {
+	if strings.IndexByte(name, '@') != -1 {
+		_, domain, err := address.Split(name)
+		if err != nil {
+			return nil, err
+		}
+		domain, err = dns.ForLookup(domain)
+		if err != nil {
+			return nil, err
+		}
+		if be, ok := s.domains[domain]; ok {
+			return be, nil
+		}
+	}
+	if s.fallback != nil {
+		return s.fallback, nil
+	}
+	return nil, ErrNoBackend
+}
+
+func (s *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error) {
+	be, err := s.backendFor(username)
+	if err != nil {
+		s.log.DebugMsg("no backend for account", "username", username, "reason", err)
+		return nil, backend.ErrInvalidCredentials
+	}
+	return be.GetOrCreateIMAPAcct(username)
+}
+
+func (s *Storage) GetIMAPAcct(username string) (backend.User, error) {
+	be, err := s.backendFor(username)
+	if err != nil {
+		s.log.DebugMsg("no backend for account", "username", username, "reason", err)
+		return nil, backend.ErrInvalidCredentials
+	}
+	return be.GetIMAPAcct(username)
+}
+
+// IMAPExtensions returns the list of extensions supported by all backends.
+func (s *Storage) IMAPExtensions() []string {
+	exts := s.backends[0].IMAPExtensions()
+	for _, be := range s.backends[1:] {
+		supported := make(map[string]struct{})
+		for _, ext := range be.IMAPExtensions() {
+			supported[ext] = struct{}{}
+		}
+
+		common := exts[:0:0]
+		for _, ext := range exts {
+			if _, ok := supported[ext]; ok {
+				common = append(common, ext)
+			}
+		}
+		exts = common
+	}
+	return exts
+}
+
+func (s *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
+	for _, be := range s.backends {
+		updBe, ok := be.(updatepipe.Backend)
+		if !ok {
+			continue
+		}
+		if err := updBe.EnableUpdatePipe(mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Updates returns the channel with updates from all backends.
+func (s *Storage) Updates() <-chan backend.Update {
+	s.updatesOnce.Do(func() {
+		s.updates = make(chan backend.Update, 20)
+
+		var wg sync.WaitGroup
+		for _, be := range s.backends {
+			updBe, ok := be.(backend.BackendUpdater)
+			if !ok {
+				continue
+			}
+			upds := updBe.Updates()
+			if upds == nil {
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for u := range upds {
+					s.updates <- u
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(s.updates)
+		}()
+	})
+	return s.updates
+}
+
+func (s *Storage) EnableChildrenExt() bool {
+	for _, be := range s.backends {
+		childrenBe, ok := be.(children.Backend)
+		if !ok || !childrenBe.EnableChildrenExt() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Storage) I18NLevel() int {
+	level := -1
+	for _, be := range s.backends {
+		i18nBe, ok := be.(i18nlevel.Backend)
+		if !ok {
+			return 0
+		}
+		if l := i18nBe.I18NLevel(); level == -1 || l < level {
+			level = l
+		}
+	}
+	return level
+}
+
+// SupportedThreadAlgorithms returns the list of algorithms supported by all
+// backends.
+func (s *Storage) SupportedThreadAlgorithms() []sortthread.ThreadAlgorithm {
+	var algos []sortthread.ThreadAlgorithm
+	for i, be := range s.backends {
+		threadBe, ok := be.(sortthread.ThreadBackend)
+		if !ok {
+			return nil
+		}
+		if i == 0 {
+			algos = threadBe.SupportedThreadAlgorithms()
+			continue
+		}
+
+		common := algos[:0:0]
+		for _, algo := range algos {
+			for _, other := range threadBe.SupportedThreadAlgorithms() {
+				if algo == other {
+					common = append(common, algo)
+					break
+				}
+			}
+		}
+		algos = common
+	}
+	return algos
+}
+
+func (s *Storage) ListIMAPAccts() ([]string, error) {
+	var accts []string
+	for _, be := range s.backends {
+		mngBe, ok := be.(module.ManageableStorage)
+		if !ok {
+			return nil, fmt.Errorf("%s: storage %T does not support accounts listing", modName, be)
+		}
+		list, err := mngBe.ListIMAPAccts()
+		if err != nil {
+			return nil, err
+		}
+		for _, acct := range list {
+			// Accounts of other domains can exist in the backend storage,
+			// but they are not accessible via this module.
+			if owner, err := s.backendFor(acct); err != nil || owner != be {
+				continue
+			}
+			accts = append(accts, acct)
+		}
+	}
+	return accts, nil
+}
+
+func (s *Storage) manageableFor(username string) (module.ManageableStorage, error) {
+	be, err := s.backendFor(username)
+	if err != nil {
+		return nil, err
+	}
+	mngBe, ok := be.(module.ManageableStorage)
+	if !ok {
+		return nil, fmt.Errorf("%s: storage %T does not support accounts management", modName, be)
+	}
+	return mngBe, nil
+}
+
+func (s *Storage) CreateIMAPAcct(username string) error {
+	be, err := s.manageableFor(username)
+	if err != nil {
+		return err
+	}
+	return be.CreateIMAPAcct(username)
+}
+
+func (s *Storage) DeleteIMAPAcct(username string) error {
+	be, err := s.manageableFor(username)
+	if err != nil {
+		return err
+	}
+	return be.DeleteIMAPAcct(username)
+}
+
+func (s *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
+	be, err := s.backendFor(key)
+	if err != nil {
+		return "", false, nil
+	}
+	tbl, ok := be.(module.Table)
+	if !ok {
+		return "", false, fmt.Errorf("%s: storage %T cannot be used as a table", modName, be)
+	}
+	return tbl.Lookup(ctx, key)
+}
+
+func init() {
+	module.Register(modName, New)
+}
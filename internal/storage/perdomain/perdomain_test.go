@@ -0,0 +1,205 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package perdomain
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mockStorage struct {
+	*testutils.Target
+	exts  []string
+	accts []string
+
+	lastAcct string
+}
+
+func (m *mockStorage) GetOrCreateIMAPAcct(username string) (backend.User, error) {
+	m.lastAcct = username
+	return nil, nil
+}
+
+func (m *mockStorage) GetIMAPAcct(username string) (backend.User, error) {
+	m.lastAcct = username
+	return nil, nil
+}
+
+func (m *mockStorage) IMAPExtensions() []string {
+	return m.exts
+}
+
+func (m *mockStorage) ListIMAPAccts() ([]string, error) {
+	return m.accts, nil
+}
+
+func (m *mockStorage) CreateIMAPAcct(username string) error {
+	m.accts = append(m.accts, username)
+	return nil
+}
+
+func (m *mockStorage) DeleteIMAPAcct(username string) error {
+	return errors.New("not implemented")
+}
+
+func testStorage(fallback bool) (*Storage, *mockStorage, *mockStorage) {
+	a := &mockStorage{Target: &testutils.Target{InstName: "a"}, exts: []string{"MOVE", "CHILDREN", "PREVIEW"}}
+	b := &mockStorage{Target: &testutils.Target{InstName: "b"}, exts: []string{"CHILDREN", "MOVE"}}
+	s := &Storage{
+		backends: []module.Storage{a, b},
+		domains: map[string]module.Storage{
+			"example.org": a,
+			"example.com": b,
+			"example.net": b,
+		},
+	}
+	if fallback {
+		s.fallback = a
+	}
+	return s, a, b
+}
+
+func TestStorage_Accounts(t *testing.T) {
+	s, a, b := testStorage(false)
+
+	if _, err := s.GetIMAPAcct("user@EXAMPLE.org"); err != nil {
+		t.Fatal(err)
+	}
+	if a.lastAcct != "user@EXAMPLE.org" || b.lastAcct != "" {
+		t.Fatal("wrong backend used for example.org:", a.lastAcct, b.lastAcct)
+	}
+	if _, err := s.GetOrCreateIMAPAcct("user@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if b.lastAcct != "user@example.net" {
+		t.Fatal("wrong backend used for example.net:", b.lastAcct)
+	}
+
+	if _, err := s.GetIMAPAcct("user@example.invalid"); err != backend.ErrInvalidCredentials {
+		t.Fatal("unexpected error for unknown domain:", err)
+	}
+	if _, err := s.GetIMAPAcct("user"); err != backend.ErrInvalidCredentials {
+		t.Fatal("unexpected error for account without domain:", err)
+	}
+}
+
+func TestStorage_Default(t *testing.T) {
+	s, a, _ := testStorage(true)
+
+	if _, err := s.GetIMAPAcct("user"); err != nil {
+		t.Fatal(err)
+	}
+	if a.lastAcct != "user" {
+		t.Fatal("default backend is not used:", a.lastAcct)
+	}
+	if _, err := s.GetIMAPAcct("user@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	if a.lastAcct != "user@example.invalid" {
+		t.Fatal("default backend is not used:", a.lastAcct)
+	}
+}
+
+func TestStorage_IMAPExtensions(t *testing.T) {
+	s, _, _ := testStorage(false)
+
+	exts := s.IMAPExtensions()
+	if !reflect.DeepEqual(exts, []string{"MOVE", "CHILDREN"}) {
+		t.Fatal("wrong extensions list:", exts)
+	}
+}
+
+func TestStorage_ListIMAPAccts(t *testing.T) {
+	s, a, b := testStorage(false)
+	a.accts = []string{"a@example.org", "a@example.com"}
+	b.accts = []string{"b@example.com", "b@example.net", "b@example.org"}
+
+	if err := s.CreateIMAPAcct("c@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateIMAPAcct("c@example.invalid"); err == nil {
+		t.Fatal("expected error for unknown domain")
+	}
+
+	accts, err := s.ListIMAPAccts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(accts)
+	want := []string{"a@example.org", "b@example.com", "b@example.net", "c@example.com"}
+	if !reflect.DeepEqual(accts, want) {
+		t.Fatal("wrong accounts list:", accts)
+	}
+}
+
+func TestStorage_Delivery(t *testing.T) {
+	s, a, b := testStorage(false)
+
+	testutils.DoTestDelivery(t, s, "sender@example.invalid",
+		[]string{"a@example.org", "b@example.com", "c@example.org"})
+
+	if len(a.Messages) != 1 || len(b.Messages) != 1 {
+		t.Fatal("wrong amount of messages:", len(a.Messages), len(b.Messages))
+	}
+	testutils.CheckTestMessage(t, a.Target, 0, "sender@example.invalid", []string{"a@example.org", "c@example.org"})
+	testutils.CheckTestMessage(t, b.Target, 0, "sender@example.invalid", []string{"b@example.com"})
+}
+
+func TestStorage_Delivery_UnknownDomain(t *testing.T) {
+	s, a, b := testStorage(false)
+
+	_, err := testutils.DoTestDeliveryErr(t, s, "sender@example.invalid",
+		[]string{"a@example.org", "a@example.invalid"})
+	if err == nil {
+		t.Fatal("expected error for unknown domain")
+	}
+	if len(a.Messages) != 0 || len(b.Messages) != 0 {
+		t.Fatal("message should not be delivered")
+	}
+}
+
+type statusCollector map[string]error
+
+func (c statusCollector) SetStatus(rcptTo string, err error) {
+	c[rcptTo] = err
+}
+
+func TestStorage_Delivery_NonAtomic(t *testing.T) {
+	s, a, b := testStorage(false)
+	b.BodyErr = errors.New("b failed")
+
+	c := statusCollector{}
+	testutils.DoTestDeliveryNonAtomic(t, c, s, "sender@example.invalid",
+		[]string{"a@example.org", "b@example.com"})
+
+	if c["a@example.org"] != nil {
+		t.Fatal("unexpected error for a@example.org:", c["a@example.org"])
+	}
+	if c["b@example.com"] == nil {
+		t.Fatal("expected error for b@example.com")
+	}
+	if len(a.Messages) != 1 || len(b.Messages) != 0 {
+		t.Fatal("wrong amount of messages:", len(a.Messages), len(b.Messages))
+	}
+}
@@ -37,8 +37,9 @@ import (
 const FileModName = "table.file"
 
 type File struct {
-	instName string
-	file     string
+	instName   string
+	inlineFile string
+	file       string
 
 	m      map[string][]string
 	mLck   sync.RWMutex
@@ -61,6 +62,7 @@ func NewFile(_, instName string, _, inlineArgs []string) (module.Module, error)
 
 	switch len(inlineArgs) {
 	case 1:
+		m.inlineFile = inlineArgs[0]
 		m.file = inlineArgs[0]
 	case 0:
 	default:
@@ -100,6 +102,10 @@ func (f *File) Init(cfg *config.Map) error {
 		f.log.Printf("ignoring non-existent file: %s", f.file)
 	}
 
+	if module.NoRun {
+		return nil
+	}
+
 	go f.reloader()
 	hooks.AddHook(hooks.EventReload, func() {
 		f.forceReload <- struct{}{}
@@ -108,6 +114,42 @@ func (f *File) Init(cfg *config.Map) error {
 	return nil
 }
 
+// Reload changes the file used by the table. Debug logging
+// can't be changed without the restart.
+func (f *File) Reload(cfg *config.Map) error {
+	var (
+		file  string
+		debug bool
+	)
+	cfg.Bool("debug", true, false, &debug)
+	cfg.String("file", false, false, "", &file)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if file != "" && f.inlineFile != "" {
+		return fmt.Errorf("%s: file path specified both in directive and in argument, do it once", FileModName)
+	}
+	if file == "" {
+		file = f.inlineFile
+	}
+	if file == "" {
+		return fmt.Errorf("%s: file path is required", FileModName)
+	}
+
+	f.mLck.Lock()
+	f.file = file
+	f.mLck.Unlock()
+
+	f.forceReload <- struct{}{}
+	return nil
+}
+
+func (f *File) currentFile() string {
+	f.mLck.RLock()
+	defer f.mLck.RUnlock()
+	return f.file
+}
+
 var reloadInterval = 15 * time.Second
 
 func (f *File) reloader() {
@@ -124,7 +166,7 @@ func (f *File) reloader() {
 		select {
 		case <-t.C:
 			var latestStamp time.Time
-			info, err := os.Stat(f.file)
+			info, err := os.Stat(f.currentFile())
 			if err != nil {
 				if os.IsNotExist(err) {
 					f.mLck.Lock()
@@ -146,10 +188,13 @@ func (f *File) reloader() {
 
 		f.log.Debugf("reloading")
 
+		file := f.currentFile()
+		f.mLck.RLock()
 		newm := make(map[string][]string, len(f.m)+5)
-		if err := readFile(f.file, newm); err != nil {
+		f.mLck.RUnlock()
+		if err := readFile(file, newm); err != nil {
 			if os.IsNotExist(err) {
-				f.log.Printf("ignoring non-existent file: %s", f.file)
+				f.log.Printf("ignoring non-existent file: %s", file)
 				continue
 			}
 
@@ -165,6 +210,9 @@ func (f *File) reloader() {
 }
 
 func (f *File) Close() error {
+	if module.NoRun {
+		return nil
+	}
 	f.stopReloader <- struct{}{}
 	<-f.stopReloader
 	return nil
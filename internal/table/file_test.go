@@ -134,6 +134,59 @@ func TestFileReload(t *testing.T) {
 	}
 }
 
+func TestFile_ConfigReload_Inline(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "maddy-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("cat: dog"); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	f.Close()
+
+	mod, err := NewFile("", "", nil, []string{f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*File)
+	m.log = testutils.Logger(t, FileModName)
+	defer m.Close()
+
+	if err := mod.Init(&config.Map{Block: config.Node{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("dog: cat"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(&config.Map{Block: config.Node{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(50 * time.Millisecond)
+		m.mLck.RLock()
+		if m.m["dog"] != nil {
+			m.mLck.RUnlock()
+			break
+		}
+		m.mLck.RUnlock()
+	}
+
+	m.mLck.RLock()
+	defer m.mLck.RUnlock()
+	if m.m["dog"] == nil {
+		t.Fatal("New m were not loaded")
+	}
+	if m.file != f.Name() {
+		t.Fatal("File path changed:", m.file)
+	}
+}
+
 func TestFileReload_Broken(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,231 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	HTTPModName = "table.http"
+
+	// Maximum size of the response body used as a lookup result.
+	httpMaxBodySize = 64 * 1024
+	// Maximum amount of cached lookup results, cache is cleaned up once
+	// it is reached.
+	httpMaxCacheSize = 10000
+)
+
+type httpCacheEntry struct {
+	value   string
+	ok      bool
+	expires time.Time
+}
+
+type HTTP struct {
+	modName  string
+	instName string
+
+	urlTemplate string
+	authHeader  string
+	cacheTTL    time.Duration
+
+	cl *http.Client
+
+	cache    map[string]httpCacheEntry
+	cacheLck sync.Mutex
+
+	log log.Logger
+}
+
+func NewHTTP(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	h := &HTTP{
+		modName:  modName,
+		instName: instName,
+		cache:    make(map[string]httpCacheEntry),
+		log:      log.Logger{Name: HTTPModName},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		h.urlTemplate = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: at most one argument accepted", HTTPModName)
+	}
+
+	return h, nil
+}
+
+func (h *HTTP) Name() string {
+	return h.modName
+}
+
+func (h *HTTP) InstanceName() string {
+	return h.instName
+}
+
+func (h *HTTP) Init(cfg *config.Map) error {
+	var timeout time.Duration
+	cfg.Bool("debug", true, false, &h.log.Debug)
+	cfg.String("url", false, false, h.urlTemplate, &h.urlTemplate)
+	cfg.Duration("timeout", false, false, 5*time.Second, &timeout)
+	cfg.Duration("cache_ttl", false, false, 0, &h.cacheTTL)
+	cfg.String("auth_header", false, false, "", &h.authHeader)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if h.urlTemplate == "" {
+		return fmt.Errorf("%s: url is required", HTTPModName)
+	}
+	if !strings.Contains(h.urlTemplate, "{key}") {
+		return fmt.Errorf("%s: url should contain {key} placeholder", HTTPModName)
+	}
+	u, err := url.Parse(strings.Replace(h.urlTemplate, "{key}", "", -1))
+	if err != nil {
+		return fmt.Errorf("%s: malformed url: %v", HTTPModName, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s: unsupported url scheme: %s", HTTPModName, u.Scheme)
+	}
+
+	h.cl = &http.Client{
+		Timeout: timeout,
+	}
+
+	return nil
+}
+
+func (h *HTTP) Lookup(ctx context.Context, key string) (string, bool, error) {
+	if h.cacheTTL != 0 {
+		h.cacheLck.Lock()
+		entry, ok := h.cache[key]
+		h.cacheLck.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			return entry.value, entry.ok, nil
+		}
+	}
+
+	value, ok, err := h.lookup(ctx, key)
+	if err != nil {
+		// Errors are not cached so failed lookup will be retried on
+		// the next attempt.
+		return "", false, exterrors.WithTemporary(err, true)
+	}
+
+	if h.cacheTTL != 0 {
+		h.storeCache(key, httpCacheEntry{
+			value:   value,
+			ok:      ok,
+			expires: time.Now().Add(h.cacheTTL),
+		})
+	}
+
+	return value, ok, nil
+}
+
+func (h *HTTP) storeCache(key string, entry httpCacheEntry) {
+	h.cacheLck.Lock()
+	defer h.cacheLck.Unlock()
+
+	if len(h.cache) >= httpMaxCacheSize {
+		now := time.Now()
+		for k, v := range h.cache {
+			if now.After(v.expires) {
+				delete(h.cache, k)
+			}
+		}
+		if len(h.cache) >= httpMaxCacheSize {
+			h.cache = make(map[string]httpCacheEntry)
+		}
+	}
+
+	h.cache[key] = entry
+}
+
+// expandURL substitutes the key into the URL template. The key is escaped
+// according to the part of the URL it is placed in.
+func expandURL(template, key string) string {
+	path, query := template, ""
+	if i := strings.IndexByte(template, '?'); i != -1 {
+		path, query = template[:i], template[i:]
+	}
+	path = strings.Replace(path, "{key}", url.PathEscape(key), -1)
+	query = strings.Replace(query, "{key}", url.QueryEscape(key), -1)
+	return path + query
+}
+
+func (h *HTTP) lookup(ctx context.Context, key string) (string, bool, error) {
+	reqURL := expandURL(h.urlTemplate, key)
+
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: lookup %s: %w", HTTPModName, key, err)
+	}
+	req = req.WithContext(ctx)
+	if h.authHeader != "" {
+		req.Header.Set("Authorization", h.authHeader)
+	}
+
+	resp, err := h.cl.Do(req)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: lookup %s: %w", HTTPModName, key, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		h.log.Debugf("lookup %s: not found", key)
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("%s: lookup %s: unexpected status: %s", HTTPModName, key, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpMaxBodySize+1))
+	if err != nil {
+		return "", false, fmt.Errorf("%s: lookup %s: %w", HTTPModName, key, err)
+	}
+	if len(body) > httpMaxBodySize {
+		return "", false, fmt.Errorf("%s: lookup %s: %w", HTTPModName, key, errors.New("response is too big"))
+	}
+
+	value := strings.TrimRight(string(body), "\r\n")
+	h.log.Debugf("lookup %s: %s", key, value)
+	return value, true, nil
+}
+
+func init() {
+	module.Register(HTTPModName, NewHTTP)
+}
@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+func TestHTTP(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch key := strings.TrimPrefix(r.URL.Path, "/lookup/"); key {
+		case "a@example.org":
+			w.Write([]byte("b@example.org\n"))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	mod, err := NewHTTP(HTTPModName, "", nil, []string{srv.URL + "/lookup/{key}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mod.(*HTTP)
+	err = h.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "auth_header", Args: []string{"Bearer secret"}},
+			{Name: "cache_ttl", Args: []string{"1m"}},
+			{Name: "timeout", Args: []string{"1s"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val, ok, err := h.Lookup(context.Background(), "a@example.org")
+	if err != nil || !ok || val != "b@example.org" {
+		t.Errorf("lookup a@example.org: %v, %v, %v", val, ok, err)
+	}
+	_, ok, err = h.Lookup(context.Background(), "missing@example.org")
+	if err != nil || ok {
+		t.Errorf("lookup missing@example.org: %v, %v", ok, err)
+	}
+	_, _, err = h.Lookup(context.Background(), "broken")
+	if err == nil {
+		t.Error("lookup broken: no error")
+	} else if !exterrors.IsTemporary(err) {
+		t.Error("lookup broken: error is not temporary:", err)
+	}
+
+	// Hits and misses are cached, errors are not.
+	hitsBefore := atomic.LoadInt32(&hits)
+	h.Lookup(context.Background(), "a@example.org")
+	h.Lookup(context.Background(), "missing@example.org")
+	if hitsAfter := atomic.LoadInt32(&hits); hitsAfter != hitsBefore {
+		t.Errorf("cached results are not used, %d requests made", hitsAfter-hitsBefore)
+	}
+	h.Lookup(context.Background(), "broken")
+	if hitsAfter := atomic.LoadInt32(&hits); hitsAfter != hitsBefore+1 {
+		t.Errorf("failed lookup is cached")
+	}
+
+	// Cache expiration.
+	h.cacheLck.Lock()
+	entry := h.cache["a@example.org"]
+	entry.expires = time.Now().Add(-time.Second)
+	h.cache["a@example.org"] = entry
+	h.cacheLck.Unlock()
+	h.Lookup(context.Background(), "a@example.org")
+	if hitsAfter := atomic.LoadInt32(&hits); hitsAfter != hitsBefore+2 {
+		t.Errorf("expired cache entry is used")
+	}
+}
+
+func TestHTTPExpandURL(t *testing.T) {
+	for _, c := range []struct {
+		template string
+		key      string
+		want     string
+	}{
+		{"https://example.org/lookup/{key}", "a b/c+d@example.org", "https://example.org/lookup/a%20b%2Fc+d@example.org"},
+		{"https://example.org/lookup?address={key}", "a b/c+d@example.org", "https://example.org/lookup?address=a+b%2Fc%2Bd%40example.org"},
+		{"https://example.org/{key}?address={key}", "a b", "https://example.org/a%20b?address=a+b"},
+	} {
+		if got := expandURL(c.template, c.key); got != c.want {
+			t.Errorf("expandURL(%q, %q) = %q, want %q", c.template, c.key, got, c.want)
+		}
+	}
+}
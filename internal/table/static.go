@@ -20,6 +20,7 @@ package table
 
 import (
 	"context"
+	"sync"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
@@ -29,7 +30,8 @@ type Static struct {
 	modName  string
 	instName string
 
-	m map[string][]string
+	m    map[string][]string
+	mLck sync.RWMutex
 }
 
 func NewStatic(modName, instName string, _, _ []string) (module.Module, error) {
@@ -41,15 +43,26 @@ func NewStatic(modName, instName string, _, _ []string) (module.Module, error) {
 }
 
 func (s *Static) Init(cfg *config.Map) error {
+	return s.Reload(cfg)
+}
+
+func (s *Static) Reload(cfg *config.Map) error {
+	newM := map[string][]string{}
 	cfg.Callback("entry", func(m *config.Map, node config.Node) error {
 		if len(node.Args) < 2 {
 			return config.NodeErr(node, "expected at least one value")
 		}
-		s.m[node.Args[0]] = node.Args[1:]
+		newM[node.Args[0]] = node.Args[1:]
 		return nil
 	})
-	_, err := cfg.Process()
-	return err
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	s.mLck.Lock()
+	s.m = newM
+	s.mLck.Unlock()
+	return nil
 }
 
 func (s *Static) Name() string {
@@ -57,11 +70,13 @@ func (s *Static) Name() string {
 }
 
 func (s *Static) InstanceName() string {
-	return s.modName
+	return s.instName
 }
 
 func (s *Static) Lookup(ctx context.Context, key string) (string, bool, error) {
+	s.mLck.RLock()
 	val := s.m[key]
+	s.mLck.RUnlock()
 	if len(val) == 0 {
 		return "", false, nil
 	}
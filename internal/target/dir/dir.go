@@ -0,0 +1,333 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package dir implements target.dir module that stores received messages
+// as files in a directory.
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package dir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.dir"
+
+// Metadata is the content of the sidecar file written next to each message.
+type Metadata struct {
+	ID       string    `json:"id"`
+	Received time.Time `json:"received"`
+	MailFrom string    `json:"mail_from"`
+	RcptTo   []string  `json:"rcpt_to"`
+
+	Proto    string `json:"proto,omitempty"`
+	SrcIP    string `json:"src_ip,omitempty"`
+	Hostname string `json:"helo,omitempty"`
+	AuthUser string `json:"auth_user,omitempty"`
+
+	Quarantine  bool     `json:"quarantine"`
+	AuthResults []string `json:"authentication_results,omitempty"`
+}
+
+type Target struct {
+	modName  string
+	instName string
+
+	dir           string
+	filename      string
+	perDaySubdirs bool
+	fsync         bool
+
+	log log.Logger
+}
+
+func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	t := &Target{
+		modName:  modName,
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		t.dir = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: at most one argument accepted", modName)
+	}
+
+	return t, nil
+}
+
+func (t *Target) Name() string {
+	return t.modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.String("directory", false, false, t.dir, &t.dir)
+	cfg.String("filename", false, false, "{timestamp}-{id}", &t.filename)
+	cfg.Bool("per_day_subdirs", false, false, &t.perDaySubdirs)
+	cfg.Bool("fsync", false, true, &t.fsync)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.dir == "" {
+		return fmt.Errorf("%s: directory is required", t.modName)
+	}
+	if !filepath.IsAbs(t.dir) {
+		t.dir = filepath.Join(config.StateDirectory, t.dir)
+	}
+	if !strings.Contains(t.filename, "{id}") {
+		return fmt.Errorf("%s: filename should contain {id} placeholder", t.modName)
+	}
+
+	if module.NoRun {
+		return nil
+	}
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return fmt.Errorf("%s: %w", t.modName, err)
+	}
+
+	return nil
+}
+
+// expandFilename returns the file name (without extension) for the message.
+func (t *Target) expandFilename(id string, received time.Time) string {
+	name := strings.NewReplacer(
+		"{id}", id,
+		"{timestamp}", received.UTC().Format("20060102T150405Z"),
+		"{date}", received.UTC().Format("2006-01-02"),
+		"{unix}", strconv.FormatInt(received.Unix(), 10),
+	).Replace(t.filename)
+
+	// Message ID is generated by maddy, but make sure the template can't
+	// escape the directory anyway.
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(name)
+}
+
+type delivery struct {
+	t   *Target
+	log log.Logger
+
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	rcpts    []string
+	received time.Time
+
+	dir string
+	// Files written by Body, renamed to their final names in Commit.
+	tmpFiles   []string
+	finalFiles []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	d := &delivery{
+		t:        t,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+		received: time.Now(),
+		dir:      t.dir,
+	}
+	if t.perDaySubdirs {
+		d.dir = filepath.Join(t.dir, d.received.UTC().Format("2006-01-02"))
+	}
+	return d, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+// writeErr converts the file system error into the SMTP error.
+func (t *Target) writeErr(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return &exterrors.SMTPError{
+			Code:         452,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 1},
+			Message:      "Insufficient system storage",
+			TargetName:   t.modName,
+			Err:          err,
+		}
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Internal server error",
+		TargetName:   t.modName,
+		Err:          err,
+	}
+}
+
+func (d *delivery) writeFile(name string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(d.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	d.tmpFiles = append(d.tmpFiles, f.Name())
+	d.finalFiles = append(d.finalFiles, filepath.Join(d.dir, name))
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if d.t.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if err := d.body(header, body); err != nil {
+		d.removeTemp()
+		return d.t.writeErr(err)
+	}
+	return nil
+}
+
+func (d *delivery) body(header textproto.Header, body buffer.Buffer) error {
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		return err
+	}
+
+	name := d.t.expandFilename(d.msgMeta.ID, d.received)
+
+	err := d.writeFile(name+".eml", func(w io.Writer) error {
+		if err := textproto.WriteHeader(w, header); err != nil {
+			return err
+		}
+		r, err := body.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	meta := Metadata{
+		ID:          d.msgMeta.ID,
+		Received:    d.received,
+		MailFrom:    d.mailFrom,
+		RcptTo:      d.rcpts,
+		Quarantine:  d.msgMeta.Quarantine,
+		AuthResults: header.Values("Authentication-Results"),
+	}
+	if conn := d.msgMeta.Conn; conn != nil {
+		meta.Proto = conn.Proto
+		meta.Hostname = conn.Hostname
+		meta.AuthUser = conn.AuthUser
+		if conn.RemoteAddr != nil {
+			meta.SrcIP = conn.RemoteAddr.String()
+		}
+	}
+	return d.writeFile(name+".json", func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(meta)
+	})
+}
+
+func (d *delivery) removeTemp() {
+	for _, name := range d.tmpFiles {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			d.log.Error("failed to remove temporary file", err, "file", name)
+		}
+	}
+	d.tmpFiles = nil
+	d.finalFiles = nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	d.removeTemp()
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	if len(d.tmpFiles) == 0 {
+		return nil
+	}
+
+	for i, tmpName := range d.tmpFiles {
+		if err := os.Rename(tmpName, d.finalFiles[i]); err != nil {
+			// Remove already renamed files so the message is not stored
+			// partially.
+			for _, name := range d.finalFiles[:i] {
+				os.Remove(name)
+			}
+			d.tmpFiles = d.tmpFiles[i:]
+			d.removeTemp()
+			return d.t.writeErr(err)
+		}
+	}
+
+	if d.t.fsync {
+		if err := syncDir(d.dir); err != nil {
+			d.log.Error("directory fsync failed", err, "dir", d.dir)
+		}
+	}
+
+	d.log.Msg("stored", "file", d.finalFiles[0])
+	return nil
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-target-dir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mod, err := New(modName, "", nil, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt := mod.(*Target)
+	err = tgt.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "filename", Args: []string{"msg-{id}"}},
+			{Name: "per_day_subdirs", Args: []string{"yes"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt.log = testutils.Logger(t, modName)
+
+	id := testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.com", "rcpt2@example.com"})
+
+	days, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 1 || !days[0].IsDir() {
+		t.Fatalf("expected a single per-day directory, got %v", days)
+	}
+	dayDir := filepath.Join(dir, days[0].Name())
+
+	files, err := ioutil.ReadDir(dayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "msg-"+id+".eml" || names[1] != "msg-"+id+".json" {
+		t.Fatalf("wrong files: %v", names)
+	}
+
+	msg, err := ioutil.ReadFile(filepath.Join(dayDir, names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "A: 1\r\nB: 2\r\n\r\nfoobar\r\n" {
+		t.Fatalf("wrong message contents: %q", msg)
+	}
+
+	metaBlob, err := ioutil.ReadFile(filepath.Join(dayDir, names[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta Metadata
+	if err := json.Unmarshal(metaBlob, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID != id || meta.MailFrom != "sender@example.org" || len(meta.RcptTo) != 2 {
+		t.Fatalf("wrong metadata: %+v", meta)
+	}
+}
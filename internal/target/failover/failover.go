@@ -0,0 +1,252 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package failover implements target.failover module that delivers
+// messages to the first of the listed targets that accepts them.
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.failover"
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	targets []module.DeliveryTarget
+	// If true, the next target is used only for temporary errors (e.g.
+	// the backend being unavailable). Otherwise any error causes failover.
+	temporaryOnly bool
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var failoverOn string
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Callback("target", func(m *config.Map, node config.Node) error {
+		tgt, err := modconfig.DeliveryTarget(m.Globals, node.Args, node)
+		if err != nil {
+			return err
+		}
+		t.targets = append(t.targets, tgt)
+		return nil
+	})
+	cfg.Enum("failover_on", false, false, []string{"temporary", "any"}, "temporary", &failoverOn)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(t.targets) == 0 {
+		return fmt.Errorf("%s: at least one target is required", modName)
+	}
+	t.temporaryOnly = failoverOn == "temporary"
+	return nil
+}
+
+func (t *Target) shouldFailover(err error) bool {
+	if t.temporaryOnly {
+		return exterrors.IsTemporaryOrUnspec(err)
+	}
+	return true
+}
+
+func targetName(tgt module.DeliveryTarget) string {
+	if mod, ok := tgt.(module.Module); ok {
+		return mod.Name() + ":" + mod.InstanceName()
+	}
+	return fmt.Sprintf("%T", tgt)
+}
+
+type delivery struct {
+	t       *Target
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	// Everything that was accepted so far, replayed to the next target on
+	// failover.
+	mailFrom string
+	rcpts    []string
+	header   textproto.Header
+	body     buffer.Buffer
+
+	idx      int
+	delivery module.Delivery
+	err      error
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	d := &delivery{
+		t:        t,
+		msgMeta:  msgMeta,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		mailFrom: mailFrom,
+		idx:      -1,
+	}
+	d.failover(ctx)
+	if d.delivery == nil {
+		return nil, d.err
+	}
+	return d, nil
+}
+
+// replay starts the delivery using the current target and passes all
+// accepted data to it.
+func (d *delivery) replay(ctx context.Context) (module.Delivery, error) {
+	del, err := d.t.targets[d.idx].Start(ctx, d.msgMeta, d.mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	for _, rcpt := range d.rcpts {
+		if err := del.AddRcpt(ctx, rcpt); err != nil {
+			d.abort(ctx, del)
+			return nil, err
+		}
+	}
+	if d.body != nil {
+		if err := del.Body(ctx, d.header.Copy(), d.body); err != nil {
+			d.abort(ctx, del)
+			return nil, err
+		}
+	}
+	return del, nil
+}
+
+func (d *delivery) abort(ctx context.Context, del module.Delivery) {
+	if err := del.Abort(ctx); err != nil {
+		d.log.Error("delivery abort failed", err, "target", targetName(d.t.targets[d.idx]))
+	}
+}
+
+// failover switches to the next usable target. If there is none, d.delivery
+// is nil and d.err contains the last error.
+func (d *delivery) failover(ctx context.Context) {
+	for d.idx+1 < len(d.t.targets) {
+		d.idx++
+		if d.idx != 0 {
+			d.log.Msg("failing over to the next target", "target", targetName(d.t.targets[d.idx]), "reason", d.err)
+		}
+
+		del, err := d.replay(ctx)
+		if err == nil {
+			d.delivery = del
+			d.err = nil
+			return
+		}
+		d.err = err
+		if !d.t.shouldFailover(err) {
+			return
+		}
+	}
+}
+
+// try calls fn for the current delivery, switching to the next target if
+// it fails.
+func (d *delivery) try(ctx context.Context, fn func(module.Delivery) error) error {
+	for {
+		if d.delivery == nil {
+			if d.err == nil {
+				return errors.New("failover: no usable targets")
+			}
+			return d.err
+		}
+
+		err := fn(d.delivery)
+		if err == nil || !d.t.shouldFailover(err) {
+			return err
+		}
+
+		d.abort(ctx, d.delivery)
+		d.delivery = nil
+		d.err = err
+		d.failover(ctx)
+	}
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	err := d.try(ctx, func(del module.Delivery) error {
+		return del.AddRcpt(ctx, rcptTo)
+	})
+	if err != nil {
+		return err
+	}
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	err := d.try(ctx, func(del module.Delivery) error {
+		return del.Body(ctx, header.Copy(), body)
+	})
+	if err != nil {
+		return err
+	}
+	d.header = header
+	d.body = body
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	if d.delivery == nil {
+		return nil
+	}
+	return d.delivery.Abort(ctx)
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	if d.delivery == nil {
+		return d.err
+	}
+	return d.delivery.Commit(ctx)
+}
+
+func init() {
+	module.Register(modName, New)
+}
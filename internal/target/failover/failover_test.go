@@ -0,0 +1,121 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package failover
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTarget(t *testing.T, temporaryOnly bool, targets ...module.DeliveryTarget) *Target {
+	return &Target{
+		log:           testutils.Logger(t, modName),
+		targets:       targets,
+		temporaryOnly: temporaryOnly,
+	}
+}
+
+var (
+	tempErr = exterrors.WithTemporary(errors.New("unavailable"), true)
+	permErr = exterrors.WithTemporary(errors.New("no such user"), false)
+)
+
+func TestFailover_Primary(t *testing.T) {
+	primary, secondary := &testutils.Target{}, &testutils.Target{}
+	tgt := testTarget(t, true, primary, secondary)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+
+	if len(primary.Messages) != 1 || len(secondary.Messages) != 0 {
+		t.Fatal("Message should be delivered to the primary target only")
+	}
+	testutils.CheckTestMessage(t, primary, 0, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+}
+
+func TestFailover_Start(t *testing.T) {
+	primary, secondary := &testutils.Target{StartErr: tempErr}, &testutils.Target{}
+	tgt := testTarget(t, true, primary, secondary)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org"})
+
+	if len(primary.Messages) != 0 || len(secondary.Messages) != 1 {
+		t.Fatal("Message should be delivered to the secondary target only")
+	}
+	testutils.CheckTestMessage(t, secondary, 0, "sender@example.org", []string{"rcpt1@example.org"})
+}
+
+func TestFailover_Replay(t *testing.T) {
+	primary := &testutils.Target{
+		RcptErr: map[string]error{"rcpt2@example.org": tempErr},
+	}
+	secondary := &testutils.Target{}
+	tgt := testTarget(t, true, primary, secondary)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+
+	if len(primary.Messages) != 0 || len(secondary.Messages) != 1 {
+		t.Fatal("Message should be delivered to the secondary target only")
+	}
+	testutils.CheckTestMessage(t, secondary, 0, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+}
+
+func TestFailover_Body(t *testing.T) {
+	primary, secondary := &testutils.Target{BodyErr: tempErr}, &testutils.Target{}
+	tgt := testTarget(t, true, primary, secondary)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org"})
+
+	if len(primary.Messages) != 0 || len(secondary.Messages) != 1 {
+		t.Fatal("Message should be delivered to the secondary target only")
+	}
+}
+
+func TestFailover_Permanent(t *testing.T) {
+	primary := &testutils.Target{
+		RcptErr: map[string]error{"rcpt1@example.org": permErr},
+	}
+	secondary := &testutils.Target{}
+
+	tgt := testTarget(t, true, primary, secondary)
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.org", []string{"rcpt1@example.org"}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if len(secondary.Messages) != 0 {
+		t.Fatal("Permanent error should not cause failover")
+	}
+
+	tgt = testTarget(t, false, primary, secondary)
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org"})
+	if len(secondary.Messages) != 1 {
+		t.Fatal("Message should be delivered to the secondary target")
+	}
+}
+
+func TestFailover_AllFail(t *testing.T) {
+	primary, secondary := &testutils.Target{StartErr: tempErr}, &testutils.Target{BodyErr: tempErr}
+	tgt := testTarget(t, false, primary, secondary)
+
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.org", []string{"rcpt1@example.org"}); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
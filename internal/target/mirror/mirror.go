@@ -0,0 +1,358 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mirror implements target.mirror module that delivers copies of
+// the message to multiple targets concurrently.
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.mirror"
+
+const (
+	requireAll     = "all"
+	requireAny     = "any"
+	requirePrimary = "primary"
+)
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	targets []module.DeliveryTarget
+	require string
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Callback("target", func(m *config.Map, node config.Node) error {
+		tgt, err := modconfig.DeliveryTarget(m.Globals, node.Args, node)
+		if err != nil {
+			return err
+		}
+		t.targets = append(t.targets, tgt)
+		return nil
+	})
+	cfg.Enum("require", false, false, []string{requireAll, requireAny, requirePrimary}, requireAll, &t.require)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(t.targets) == 0 {
+		return fmt.Errorf("%s: at least one target is required", modName)
+	}
+	return nil
+}
+
+func targetName(tgt module.DeliveryTarget) string {
+	if mod, ok := tgt.(module.Module); ok {
+		return mod.Name() + ":" + mod.InstanceName()
+	}
+	return fmt.Sprintf("%T", tgt)
+}
+
+// targetDelivery is the delivery state for a single target.
+type targetDelivery struct {
+	primary bool
+	name    string
+	tgt     module.DeliveryTarget
+
+	delivery module.Delivery
+	// Recipients accepted by the target.
+	rcpts []string
+	// Error returned by the last operation.
+	err error
+}
+
+type delivery struct {
+	t        *Target
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+
+	deliveries []*targetDelivery
+}
+
+// forEach calls fn for each active delivery concurrently and saves
+// returned errors.
+func (d *delivery) forEach(fn func(*targetDelivery) error) {
+	var wg sync.WaitGroup
+	for _, td := range d.deliveries {
+		if td.delivery == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(td *targetDelivery) {
+			defer wg.Done()
+			td.err = fn(td)
+		}(td)
+	}
+	wg.Wait()
+}
+
+// check verifies that the last operation succeeded for the required subset
+// of targets. Only deliveries for which use returns true are considered.
+func (d *delivery) check(use func(*targetDelivery) bool) error {
+	var (
+		firstErr  error
+		succeeded int
+		failed    int
+	)
+	for _, td := range d.deliveries {
+		if !use(td) {
+			continue
+		}
+		if td.err != nil {
+			failed++
+			if firstErr == nil || td.primary {
+				firstErr = td.err
+			}
+			if td.primary && d.t.require == requirePrimary {
+				return td.err
+			}
+			continue
+		}
+		succeeded++
+	}
+
+	switch d.t.require {
+	case requireAll:
+		if failed != 0 {
+			return firstErr
+		}
+	case requireAny:
+		if succeeded == 0 && firstErr != nil {
+			return firstErr
+		}
+	}
+	if succeeded == 0 && firstErr == nil {
+		return errors.New("mirror: no usable targets")
+	}
+	return nil
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	d := &delivery{
+		t:          t,
+		log:        target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:    msgMeta,
+		mailFrom:   mailFrom,
+		deliveries: make([]*targetDelivery, len(t.targets)),
+	}
+
+	var wg sync.WaitGroup
+	for i, tgt := range t.targets {
+		td := &targetDelivery{
+			primary: i == 0,
+			name:    targetName(tgt),
+			tgt:     tgt,
+		}
+		d.deliveries[i] = td
+
+		wg.Add(1)
+		go func(tgt module.DeliveryTarget) {
+			defer wg.Done()
+			del, err := tgt.Start(ctx, msgMeta, mailFrom)
+			if err != nil {
+				td.err = err
+				return
+			}
+			td.delivery = del
+		}(tgt)
+	}
+	wg.Wait()
+
+	for _, td := range d.deliveries {
+		if td.err != nil {
+			d.log.Error("target failed, dropping", td.err, "target", td.name)
+		}
+	}
+	if err := d.check(func(*targetDelivery) bool { return true }); err != nil {
+		_ = d.Abort(ctx)
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	d.forEach(func(td *targetDelivery) error {
+		if err := td.delivery.AddRcpt(ctx, rcptTo); err != nil {
+			return err
+		}
+		td.rcpts = append(td.rcpts, rcptTo)
+		return nil
+	})
+
+	for _, td := range d.deliveries {
+		if td.delivery != nil && td.err != nil {
+			d.log.Msg("recipient rejected by target", "target", td.name, "rcpt", rcptTo, "reason", td.err)
+		}
+	}
+	if err := d.check(func(td *targetDelivery) bool { return td.delivery != nil }); err != nil {
+		// The recipient is rejected as a whole so it should not be delivered
+		// to targets that accepted it.
+		for _, td := range d.deliveries {
+			if td.delivery != nil && td.err == nil {
+				d.removeLastRcpt(ctx, td)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// removeLastRcpt removes the last added recipient from the target delivery.
+//
+// Since module.Delivery does not allow to remove recipients, the delivery is
+// aborted and started again with remaining recipients. If that fails, the
+// target is dropped.
+func (d *delivery) removeLastRcpt(ctx context.Context, td *targetDelivery) {
+	if err := td.delivery.Abort(ctx); err != nil {
+		d.log.Error("delivery abort failed", err, "target", td.name)
+	}
+	td.delivery = nil
+	td.rcpts = td.rcpts[:len(td.rcpts)-1]
+
+	del, err := td.tgt.Start(ctx, d.msgMeta, d.mailFrom)
+	if err != nil {
+		d.log.Error("target failed, dropping", err, "target", td.name)
+		td.rcpts = nil
+		return
+	}
+	for _, rcpt := range td.rcpts {
+		if err := del.AddRcpt(ctx, rcpt); err != nil {
+			d.log.Error("target failed, dropping", err, "target", td.name, "rcpt", rcpt)
+			if err := del.Abort(ctx); err != nil {
+				d.log.Error("delivery abort failed", err, "target", td.name)
+			}
+			td.rcpts = nil
+			return
+		}
+	}
+	td.delivery = del
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	// Targets without any accepted recipients are not interesting anymore.
+	for _, td := range d.deliveries {
+		if td.delivery != nil && len(td.rcpts) == 0 {
+			if err := td.delivery.Abort(ctx); err != nil {
+				d.log.Error("delivery abort failed", err, "target", td.name)
+			}
+			td.delivery = nil
+			td.err = nil
+		}
+	}
+
+	d.forEach(func(td *targetDelivery) error {
+		return td.delivery.Body(ctx, header.Copy(), body)
+	})
+	err := d.check(func(td *targetDelivery) bool { return td.delivery != nil })
+	d.dropFailed(ctx)
+	return err
+}
+
+// dropFailed aborts deliveries that failed the last operation.
+func (d *delivery) dropFailed(ctx context.Context) {
+	for _, td := range d.deliveries {
+		if td.delivery == nil || td.err == nil {
+			continue
+		}
+		d.log.Error("target failed, dropping", td.err, "target", td.name)
+		if err := td.delivery.Abort(ctx); err != nil {
+			d.log.Error("delivery abort failed", err, "target", td.name)
+		}
+		td.delivery = nil
+	}
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	d.forEach(func(td *targetDelivery) error {
+		return td.delivery.Abort(ctx)
+	})
+	var firstErr error
+	for _, td := range d.deliveries {
+		if td.delivery != nil && td.err != nil {
+			d.log.Error("delivery abort failed", td.err, "target", td.name)
+			if firstErr == nil {
+				firstErr = td.err
+			}
+		}
+		td.delivery = nil
+	}
+	return firstErr
+}
+
+// Commit commits deliveries for all targets concurrently.
+//
+// Commit can't be undone for targets that succeeded, so if the required
+// targets fail and the sender retries the delivery later, targets that
+// succeeded get a duplicate copy of the message.
+func (d *delivery) Commit(ctx context.Context) error {
+	d.forEach(func(td *targetDelivery) error {
+		return td.delivery.Commit(ctx)
+	})
+	for _, td := range d.deliveries {
+		if td.delivery != nil && td.err != nil {
+			d.log.Error("delivery commit failed", td.err, "target", td.name)
+		}
+	}
+	err := d.check(func(td *targetDelivery) bool { return td.delivery != nil })
+	for _, td := range d.deliveries {
+		td.delivery = nil
+	}
+	return err
+}
+
+func init() {
+	module.Register(modName, New)
+}
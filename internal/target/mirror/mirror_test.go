@@ -0,0 +1,150 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTarget(t *testing.T, require string, targets ...module.DeliveryTarget) *Target {
+	return &Target{
+		log:     testutils.Logger(t, modName),
+		targets: targets,
+		require: require,
+	}
+}
+
+func TestMirror(t *testing.T) {
+	a, b, c := &testutils.Target{}, &testutils.Target{}, &testutils.Target{}
+	tgt := testTarget(t, requireAll, a, b, c)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+
+	for _, tgt := range []*testutils.Target{a, b, c} {
+		if len(tgt.Messages) != 1 {
+			t.Fatal("Message should be delivered to all targets")
+		}
+		testutils.CheckTestMessage(t, tgt, 0, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+	}
+}
+
+func TestMirror_Require(t *testing.T) {
+	testErr := errors.New("test error")
+
+	test := func(require string, primaryErr, secondaryErr, fail bool) {
+		t.Helper()
+
+		primary, secondary := &testutils.Target{}, &testutils.Target{}
+		if primaryErr {
+			primary.BodyErr = testErr
+		}
+		if secondaryErr {
+			secondary.StartErr = testErr
+		}
+		tgt := testTarget(t, require, primary, secondary)
+
+		_, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.org", []string{"rcpt1@example.org"})
+		if fail && err == nil {
+			t.Error("Expected delivery to fail")
+		}
+		if !fail && err != nil {
+			t.Error("Unexpected failure:", err)
+		}
+		if !fail && !primaryErr && len(primary.Messages) != 1 {
+			t.Error("Message should be delivered to the primary target")
+		}
+		if !fail && !secondaryErr && len(secondary.Messages) != 1 {
+			t.Error("Message should be delivered to the secondary target")
+		}
+	}
+
+	test(requireAll, false, false, false)
+	test(requireAll, true, false, true)
+	test(requireAll, false, true, true)
+
+	test(requireAny, false, true, false)
+	test(requireAny, true, false, false)
+	test(requireAny, true, true, true)
+
+	test(requirePrimary, false, true, false)
+	test(requirePrimary, true, false, true)
+}
+
+func TestMirror_RcptRejected(t *testing.T) {
+	primary := &testutils.Target{
+		RcptErr: map[string]error{"rcpt2@example.org": errors.New("no such user")},
+	}
+	archive := &testutils.Target{}
+	tgt := testTarget(t, requireAny, primary, archive)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+
+	testutils.CheckTestMessage(t, primary, 0, "sender@example.org", []string{"rcpt1@example.org"})
+	testutils.CheckTestMessage(t, archive, 0, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+}
+
+func TestMirror_RcptRejectedRequired(t *testing.T) {
+	primary := &testutils.Target{}
+	archive := &testutils.Target{
+		RcptErr: map[string]error{"rcpt2@example.org": errors.New("no such user")},
+	}
+	tgt := testTarget(t, requireAll, primary, archive)
+
+	ctx := context.Background()
+	delivery, err := tgt.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "rcpt1@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "rcpt2@example.org"); err == nil {
+		t.Fatal("Expected recipient to be rejected")
+	}
+	if err := delivery.AddRcpt(ctx, "rcpt3@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("B", "2")
+	hdr.Add("A", "1")
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejected recipient should not be delivered to the primary target.
+	for _, tgt := range []*testutils.Target{primary, archive} {
+		if len(tgt.Messages) != 1 {
+			t.Fatal("Message should be delivered to all targets")
+		}
+		if rcpts := tgt.Messages[0].RcptTo; !reflect.DeepEqual(rcpts, []string{"rcpt1@example.org", "rcpt3@example.org"}) {
+			t.Fatal("Wrong recipients:", rcpts)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+// Queue management interface.
+//
+// The running queue is registered in the control endpoint registry (see
+// internal/control) and is managed by maddyctl through the control
+// endpoint.
+//
+// Queue listing does not need the running server and is done by reading
+// the queue directory directly. Messages can also be deleted without the
+// running server, the queue directory lock is used to make sure that no
+// server is using the directory at the same time.
+
+// lockFileName is the name of the file in the queue directory used to lock
+// it, see lockDir.
+const lockFileName = "queue.lock"
+
+var (
+	ErrNoSuchMessage = errors.New("queue: no such message")
+	// ErrDirLocked is returned if the queue directory is used by
+	// another process.
+	ErrDirLocked = errors.New("queue: directory is used by another process")
+
+	errDirLockUnsupported = errors.New("queue: directory locking is not supported on this platform")
+)
+
+// MessageInfo is the summary of the queued message state.
+type MessageInfo struct {
+	ID           string
+	From         string
+	To           []string
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+	NextAttempt  time.Time
+	// Last errors for recipients that are not delivered yet.
+	RcptErrs map[string]*smtp.SMTPError
+}
+
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`) && !strings.ContainsAny(id, " \t\r\n")
+}
+
+func (q *Queue) nextAttempt(meta *QueueMetadata) time.Time {
+	smallestTriesCount := 999999
+	for _, count := range meta.TriesCount {
+		if smallestTriesCount > count {
+			smallestTriesCount = count
+		}
+	}
+	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
+	return meta.LastAttempt.Add(q.initialRetryTime * scaleFactor)
+}
+
+// List returns information about messages stored in the queue directory.
+//
+// It can be used without the queue being started.
+func (q *Queue) List() ([]MessageInfo, error) {
+	dirInfo, err := ioutil.ReadDir(q.location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	msgs := make([]MessageInfo, 0, len(dirInfo))
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".meta")
+
+		meta, err := q.readMessageMeta(id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+
+		info := MessageInfo{
+			ID:           id,
+			From:         meta.From,
+			To:           meta.To,
+			FirstAttempt: meta.FirstAttempt,
+			LastAttempt:  meta.LastAttempt,
+			NextAttempt:  q.nextAttempt(meta),
+			RcptErrs:     map[string]*smtp.SMTPError{},
+		}
+		for _, rcpt := range meta.To {
+			if rcptErr := meta.RcptErrs[rcpt]; rcptErr != nil {
+				info.RcptErrs[rcpt] = rcptErr
+			}
+		}
+		msgs = append(msgs, info)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].FirstAttempt.Before(msgs[j].FirstAttempt)
+	})
+	return msgs, nil
+}
+
+// schedule adds the next delivery attempt for the message. Any previously
+// scheduled attempts for the same message are canceled.
+func (q *Queue) schedule(t time.Time, slot queueSlot) {
+	q.schedLock.Lock()
+	q.scheduled[slot.ID] = t
+	slot.Priority = q.priorities[slot.ID]
+	q.schedLock.Unlock()
+
+	q.wheel.Add(t, slot)
+}
+
+// setPriority saves the message priority, it is limited to the configured
+// amount of priority levels.
+func (q *Queue) setPriority(id string, prio int) {
+	if prio >= q.priorityLevels {
+		prio = q.priorityLevels - 1
+	}
+	if prio < 0 {
+		prio = 0
+	}
+
+	q.schedLock.Lock()
+	defer q.schedLock.Unlock()
+	if prio == 0 {
+		delete(q.priorities, id)
+		return
+	}
+	q.priorities[id] = prio
+}
+
+// claim marks the message as being delivered if the time slot is not stale.
+func (q *Queue) claim(id string, t time.Time) bool {
+	q.schedLock.Lock()
+	defer q.schedLock.Unlock()
+
+	scheduled, ok := q.scheduled[id]
+	if !ok || !scheduled.Equal(t) {
+		return false
+	}
+	delete(q.scheduled, id)
+	q.inFlight[id] = false
+	return true
+}
+
+// release is called when the delivery attempt is complete. It returns true
+// if the message was deleted during the attempt.
+func (q *Queue) release(id string) bool {
+	q.schedLock.Lock()
+	defer q.schedLock.Unlock()
+
+	deleted := q.inFlight[id]
+	delete(q.inFlight, id)
+	return deleted
+}
+
+// Flush schedules immediate delivery attempts for the specified messages or
+// all messages if ids is empty. Messages that are being delivered right now
+// are not affected.
+//
+// The amount of rescheduled messages is returned.
+func (q *Queue) Flush(ids ...string) int {
+	q.schedLock.Lock()
+	var toFlush []string
+	if len(ids) == 0 {
+		for id := range q.scheduled {
+			toFlush = append(toFlush, id)
+		}
+	} else {
+		for _, id := range ids {
+			if _, ok := q.scheduled[id]; ok {
+				toFlush = append(toFlush, id)
+			}
+		}
+	}
+	q.schedLock.Unlock()
+
+	now := time.Now()
+	for _, id := range toFlush {
+		q.Log.Msg("flushing message", "msg_id", id)
+		q.schedule(now, queueSlot{ID: id})
+	}
+	return len(toFlush)
+}
+
+// Delete removes the message from the queue without generating any bounce
+// messages.
+//
+// If the queue is not started, message files are just removed from the
+// queue directory. ErrDirLocked is returned in this case if the directory
+// is used by the running server.
+func (q *Queue) Delete(id string) error {
+	if !validID(id) {
+		return ErrNoSuchMessage
+	}
+
+	if q.wheel != nil {
+		q.schedLock.Lock()
+		if _, ok := q.inFlight[id]; ok {
+			// Will be removed once the attempt is complete.
+			q.inFlight[id] = true
+			q.schedLock.Unlock()
+			return nil
+		}
+		_, ok := q.scheduled[id]
+		delete(q.scheduled, id)
+		q.schedLock.Unlock()
+
+		if !ok {
+			return ErrNoSuchMessage
+		}
+	} else {
+		lock, err := lockDir(q.location)
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+
+		if _, err := os.Stat(filepath.Join(q.location, id+".meta")); err != nil {
+			if os.IsNotExist(err) {
+				return ErrNoSuchMessage
+			}
+			return err
+		}
+	}
+
+	q.Log.Msg("deleting message", "msg_id", id)
+	if meta, err := q.readMessageMeta(id); err == nil {
+		q.recordDeleted(meta)
+	}
+	q.removeFromDisk(&module.MsgMetadata{ID: id})
+	return nil
+}
+
+// Stats returns the amount of queued messages and delivery statistics for
+// each recipient domain.
+func (q *Queue) Stats() control.QueueStats {
+	stats := control.QueueStats{
+		Domains: map[string]control.DomainStats{},
+	}
+
+	q.schedLock.Lock()
+	stats.Messages = len(q.scheduled) + len(q.inFlight)
+	stats.InFlight = len(q.inFlight)
+	ids := make([]string, 0, stats.Messages)
+	for id := range q.scheduled {
+		ids = append(ids, id)
+	}
+	for id := range q.inFlight {
+		ids = append(ids, id)
+	}
+	q.schedLock.Unlock()
+
+	for _, id := range ids {
+		meta, err := q.readMessageMeta(id)
+		if err != nil {
+			// Likely removed after the delivery attempt.
+			continue
+		}
+		for _, rcpt := range meta.To {
+			domain := rcptDomain(rcpt)
+			domStats := stats.Domains[domain]
+			domStats.Pending++
+			stats.Domains[domain] = domStats
+		}
+	}
+
+	q.statsLock.Lock()
+	defer q.statsLock.Unlock()
+	for domain, counters := range q.domainStats {
+		domStats := stats.Domains[domain]
+		domStats.Delivered = counters.Delivered
+		domStats.TempFailed = counters.TempFailed
+		domStats.PermFailed = counters.PermFailed
+		stats.Domains[domain] = domStats
+	}
+
+	return stats
+}
+
+func rcptDomain(rcpt string) string {
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(domain)
+}
+
+func (q *Queue) countDelivery(rcpt string, update func(*control.DomainStats)) {
+	domain := rcptDomain(rcpt)
+
+	q.statsLock.Lock()
+	defer q.statsLock.Unlock()
+	domStats := q.domainStats[domain]
+	if domStats == nil {
+		domStats = &control.DomainStats{}
+		q.domainStats[domain] = domStats
+	}
+	update(domStats)
+}
+
+// ControlName returns the name used for the queue by the control endpoint.
+func (q *Queue) ControlName() string {
+	if q.name != "" {
+		return q.name
+	}
+	return q.location
+}
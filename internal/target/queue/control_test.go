@@ -0,0 +1,111 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func waitScheduled(t *testing.T, q *Queue, id string) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		q.schedLock.Lock()
+		_, ok := q.scheduled[id]
+		q.schedLock.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("message is not scheduled for retry")
+}
+
+func TestQueueControl(t *testing.T) {
+	t.Parallel()
+
+	tempErr := exterrors.WithTemporary(errors.New("you shall not pass"), true)
+	dt := unreliableTarget{
+		bodyFailures: []error{tempErr, tempErr},
+		aborted:      make(chan testutils.Msg, 10),
+		committed:    make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.initialRetryTime = time.Hour
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	waitScheduled(t, q, id)
+
+	msgs, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatal("expected one queued message, got", len(msgs))
+	}
+	if msgs[0].ID != id || msgs[0].From != "tester@example.com" {
+		t.Fatalf("wrong message info: %+v", msgs[0])
+	}
+	if time.Until(msgs[0].NextAttempt) < 50*time.Minute {
+		t.Fatal("wrong next attempt time:", msgs[0].NextAttempt)
+	}
+	if rcptErr := msgs[0].RcptErrs["tester1@example.org"]; rcptErr == nil {
+		t.Fatal("missing recipient error")
+	}
+
+	stats := q.Stats()
+	if stats.Messages != 1 || stats.InFlight != 0 {
+		t.Fatalf("wrong queue stats: %+v", stats)
+	}
+	if domStats := stats.Domains["example.org"]; domStats.Pending != 1 || domStats.TempFailed != 1 {
+		t.Fatalf("wrong domain stats: %+v", domStats)
+	}
+
+	if n := q.Flush(); n != 1 {
+		t.Fatal("wrong flushed messages count:", n)
+	}
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	waitScheduled(t, q, id)
+
+	if err := q.Delete("nonexistent"); !errors.Is(err, ErrNoSuchMessage) {
+		t.Fatal("expected ErrNoSuchMessage for an unknown message, got", err)
+	}
+	if err := q.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stale slots should not cause delivery of the removed message.
+	if n := q.Flush(id); n != 0 {
+		t.Fatal("deleted message is flushed")
+	}
+	checkQueueDir(t, q, []string{})
+	select {
+	case <-dt.committed:
+		t.Fatal("deleted message is delivered")
+	case <-dt.aborted:
+		t.Fatal("deleted message is delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,61 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestQueueDelete_Offline(t *testing.T) {
+	t.Parallel()
+
+	tempErr := exterrors.WithTemporary(errors.New("you shall not pass"), true)
+	dt := unreliableTarget{
+		bodyFailures: []error{tempErr},
+		aborted:      make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.initialRetryTime = time.Hour
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	waitScheduled(t, q, id)
+
+	// Queue instance used by maddyctl, it is not started.
+	offline := &Queue{location: q.location, Log: q.Log}
+	if err := offline.Delete(id); !errors.Is(err, ErrDirLocked) {
+		t.Fatal("expected ErrDirLocked while the queue is running, got", err)
+	}
+	checkQueueDir(t, q, []string{id})
+
+	q.Close()
+	if err := offline.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	checkQueueDir(t, q, []string{})
+}
@@ -0,0 +1,148 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+type errorAction int
+
+const (
+	// Delivery is retried as if the error was temporary.
+	actionRetry errorAction = iota
+	// Recipient is failed immediately as if the error was permanent.
+	actionBounce
+	// Delivery is retried without counting the attempt towards max_tries.
+	actionDefer
+)
+
+func (a errorAction) String() string {
+	switch a {
+	case actionRetry:
+		return "retry"
+	case actionBounce:
+		return "bounce"
+	case actionDefer:
+		return "defer"
+	}
+	return "unknown"
+}
+
+// errorRule overrides the default temporary/permanent classification of
+// delivery errors for responses matching the code range and the regular
+// expression.
+type errorRule struct {
+	action           errorAction
+	minCode, maxCode int
+	// May be nil, matches any message then.
+	re *regexp.Regexp
+}
+
+func (r errorRule) match(code int, msg string) bool {
+	if code < r.minCode || code > r.maxCode {
+		return false
+	}
+	return r.re == nil || r.re.MatchString(msg)
+}
+
+func parseCodeRange(s string) (int, int, error) {
+	if s == "*" {
+		return 0, 999, nil
+	}
+
+	parts := strings.SplitN(s, "-", 2)
+	minCode, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed code range: %v", s)
+	}
+	maxCode := minCode
+	if len(parts) == 2 {
+		maxCode, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("malformed code range: %v", s)
+		}
+	}
+	if minCode < 200 || maxCode > 599 || minCode > maxCode {
+		return 0, 0, fmt.Errorf("invalid code range: %v", s)
+	}
+	return minCode, maxCode, nil
+}
+
+func parseErrorRules(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	rules := make([]errorRule, 0, len(node.Children))
+	for _, child := range node.Children {
+		var rule errorRule
+		switch child.Name {
+		case "retry":
+			rule.action = actionRetry
+		case "bounce":
+			rule.action = actionBounce
+		case "defer":
+			rule.action = actionDefer
+		default:
+			return nil, config.NodeErr(child, "unknown action: %v", child.Name)
+		}
+
+		if len(child.Args) != 1 && len(child.Args) != 2 {
+			return nil, config.NodeErr(child, "expected code range and optional regexp")
+		}
+
+		var err error
+		rule.minCode, rule.maxCode, err = parseCodeRange(child.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+		if len(child.Args) == 2 {
+			rule.re, err = regexp.Compile(child.Args[1])
+			if err != nil {
+				return nil, config.NodeErr(child, "%v", err)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// classifyError returns the action of the first rule matching the error.
+// ok is false if there is no such rule and the default classification
+// should be used.
+func (q *Queue) classifyError(err error) (action errorAction, ok bool) {
+	if len(q.errorRules) == 0 {
+		return 0, false
+	}
+
+	smtpErr := toSMTPErr(err)
+	for _, rule := range q.errorRules {
+		if rule.match(smtpErr.Code, smtpErr.Message) {
+			return rule.action, true
+		}
+	}
+	return 0, false
+}
@@ -30,6 +30,39 @@ var queuedMsgs = prometheus.NewGaugeVec(
 	[]string{"module", "location"},
 )
 
+var queueWorkers = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "workers",
+		Help:      "Amount of delivery workers",
+	},
+	[]string{"module", "location"},
+)
+
+var busyWorkers = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "busy_workers",
+		Help:      "Amount of delivery workers doing a delivery attempt right now",
+	},
+	[]string{"module", "location"},
+)
+
+var pendingDeliveries = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "pending_deliveries",
+		Help:      "Amount of due delivery attempts waiting for a free worker",
+	},
+	[]string{"module", "location"},
+)
+
 func init() {
 	prometheus.MustRegister(queuedMsgs)
+	prometheus.MustRegister(queueWorkers)
+	prometheus.MustRegister(busyWorkers)
+	prometheus.MustRegister(pendingDeliveries)
 }
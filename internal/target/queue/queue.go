@@ -39,7 +39,9 @@ Failure status is determined on per-recipient basis:
 
 For each failure check is done to see if it is a permanent failure
 or a temporary one. This is done using exterrors.IsTemporaryOrUnspec.
-That is, errors are assumed to be temporary by default.
+That is, errors are assumed to be temporary by default. The error_rules
+directive can override that for errors with matching SMTP code and message,
+these can also be "deferred" - retried without counting the attempt.
 All errors are converted to SMTPError then due to a storage limitations.
 
 If there are any *temporary* failed recipients, delivery will be retried
@@ -58,6 +60,7 @@ package queue
 import (
 	"bufio"
 	"bytes"
+	"container/list"
 	"context"
 	"encoding/json"
 	"errors"
@@ -73,6 +76,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -83,7 +88,10 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
 	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/fsync"
+	"github.com/foxcpp/maddy/internal/i18n"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
 	"github.com/foxcpp/maddy/internal/target"
 )
@@ -127,6 +135,12 @@ type Queue struct {
 	wheel            *TimeWheel
 
 	dsnPipeline module.DeliveryTarget
+	// Template for the human-readable part of generated DSNs, nil to use
+	// the default text.
+	dsnText *template.Template
+	// Locale of the human-readable part of generated DSNs if dsnText is
+	// not set, selected using the sender address.
+	dsnLocales i18n.Selector
 
 	// Retry delay is calculated using the following formula:
 	// initialRetryTime * retryTimeScale ^ (TriesCount - 1)
@@ -135,6 +149,17 @@ type Queue struct {
 	retryTimeScale   float64
 	maxTries         int
 
+	// Messages that are not delivered in maxLifetime after they are
+	// queued are bounced, zero disables the limit.
+	maxLifetime time.Duration
+	// Delayed delivery DSN is sent once if the message is not delivered
+	// in delayWarningAfter, zero disables warnings.
+	delayWarningAfter time.Duration
+
+	// Rules overriding the default classification of delivery errors,
+	// checked in order.
+	errorRules []errorRule
+
 	// If any delivery is scheduled in less than postInitDelay
 	// after Init, its delay will be increased by postInitDelay.
 	//
@@ -147,13 +172,82 @@ type Queue struct {
 	// after start-up for whatever reason it will not affect the queue.
 	postInitDelay time.Duration
 
+	// Controls flushing of message files and meta-data to disk.
+	fsync fsync.Policy
+
 	Log    log.Logger
 	Target module.DeliveryTarget
 
-	deliveryWg sync.WaitGroup
-	// Buffered channel used to restrict count of deliveries attempted
-	// in parallel.
-	deliverySemaphore chan struct{}
+	// Context used for all delivery attempts, cancelled if the shutdown
+	// grace period expires.
+	deliveryCtx     context.Context
+	abortDeliveries context.CancelFunc
+	// Set to 1 by Shutdown, deliveries that are not started yet are
+	// postponed until the next start.
+	shuttingDown uint32
+
+	// Delivery attempts are done by the fixed amount of workers that take
+	// due time slots from the pending list.
+	//
+	// pendingLock protects pending, pendingCount and workersStopped.
+	// Workers exit once workersStopped is set and there are no pending slots
+	// left.
+	//
+	// pending contains a FIFO list of pending slots for each message
+	// priority, pendingCount is the total amount of slots in all lists.
+	workers        int
+	workersWg      sync.WaitGroup
+	pendingLock    sync.Mutex
+	pendingCond    *sync.Cond
+	pending        []*list.List
+	pendingCount   int
+	workersStopped bool
+	// New messages are rejected with a temporary error if there are more
+	// than maxPending time slots waiting for a worker, zero disables
+	// the limit.
+	maxPending int
+
+	// Workers pick pending slots with the highest priority first. Message
+	// priority is limited to priorityLevels-1 and the effective priority
+	// of the pending slot is increased by one for each priorityAging
+	// interval it waits for a worker so low-priority messages are not
+	// starved. Zero priorityAging disables aging.
+	priorityLevels int
+	priorityAging  time.Duration
+
+	// schedLock protects scheduled and inFlight maps.
+	//
+	// scheduled contains the time of the next delivery attempt for each
+	// queued message. Time wheel slots that do not match it are stale (e.g.
+	// the message was flushed or deleted) and are ignored.
+	//
+	// inFlight contains messages that are being delivered right now. The
+	// value is set to true if the message was deleted during the attempt.
+	//
+	// priorities contains the priority of each queued message.
+	schedLock  sync.Mutex
+	scheduled  map[string]time.Time
+	inFlight   map[string]bool
+	priorities map[string]int
+
+	// dirLock is the lock file held while the queue is started, see lockDir.
+	dirLock *os.File
+
+	// statsLock protects domainStats, delivery counters for each recipient
+	// domain accumulated since the queue start.
+	statsLock   sync.Mutex
+	domainStats map[string]*control.DomainStats
+
+	// How long to keep delivery status records, status tracking is
+	// disabled if zero.
+	statusRetention time.Duration
+	// statusLock serializes updates of status records.
+	statusLock sync.Mutex
+	statusStop chan struct{}
+	statusDone chan struct{}
+
+	// Webhook notified about delivery events, nil if not configured.
+	webhook *eventWebhook
 }
 
 type QueueMetadata struct {
@@ -174,14 +268,23 @@ type QueueMetadata struct {
 
 	// Amount of times delivery *already tried*.
 	TriesCount map[string]int
+	// Amount of attempts deferred by error rules, these are not included
+	// in TriesCount.
+	DeferCount map[string]int `json:",omitempty"`
 
 	FirstAttempt time.Time
 	LastAttempt  time.Time
+
+	// Set when the delayed delivery DSN is sent.
+	DelayWarned bool `json:",omitempty"`
 }
 
 type queueSlot struct {
 	ID string
 
+	// Message priority, set by schedule.
+	Priority int
+
 	// If nil - Hdr and Body are invalid, all values should be read from
 	// disk.
 	Meta *QueueMetadata
@@ -195,6 +298,7 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 		initialRetryTime: 15 * time.Minute,
 		retryTimeScale:   1.25,
 		postInitDelay:    10 * time.Second,
+		priorityLevels:   1,
 		Log:              log.Logger{Name: "queue"},
 	}
 	switch len(inlineArgs) {
@@ -209,10 +313,14 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 }
 
 func (q *Queue) Init(cfg *config.Map) error {
-	var maxParallelism int
 	cfg.Bool("debug", true, false, &q.Log.Debug)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
-	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
+	cfg.Duration("max_lifetime", false, false, 5*24*time.Hour, &q.maxLifetime)
+	cfg.Duration("delay_warning_after", false, false, 0, &q.delayWarningAfter)
+	cfg.Int("max_parallelism", false, false, 16, &q.workers)
+	cfg.Int("max_pending", false, false, 10000, &q.maxPending)
+	cfg.Int("priority_levels", false, false, 1, &q.priorityLevels)
+	cfg.Duration("priority_aging", false, false, 5*time.Minute, &q.priorityAging)
 	cfg.String("location", false, false, q.location, &q.location)
 	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &q.Target)
 	cfg.String("hostname", true, true, "", &q.hostname)
@@ -220,6 +328,17 @@ func (q *Queue) Init(cfg *config.Map) error {
 	cfg.Custom("bounce", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
 		return msgpipeline.New(m.Globals, node.Children)
 	}, &q.dsnPipeline)
+	cfg.Custom("bounce_template", false, false, nil, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "expected exactly one argument")
+		}
+		return template.ParseFiles(node.Args[0])
+	}, &q.dsnText)
+	i18n.Directives(cfg, &q.dsnLocales)
+	cfg.Custom("error_rules", false, false, nil, parseErrorRules, &q.errorRules)
+	cfg.Duration("status_retention", false, false, 0, &q.statusRetention)
+	cfg.Custom("event_webhook", false, false, nil, eventWebhookDirective, &q.webhook)
+	fsync.Directives(cfg, &q.fsync)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -239,17 +358,72 @@ func (q *Queue) Init(cfg *config.Map) error {
 		q.location = filepath.Join(config.StateDirectory, q.name)
 	}
 
+	if module.NoRun {
+		return nil
+	}
+
 	// TODO: Check location write permissions.
 	if err := os.MkdirAll(q.location, os.ModePerm); err != nil {
 		return err
 	}
 
-	return q.start(maxParallelism)
+	if q.workers <= 0 {
+		return errors.New("queue: max_parallelism should be positive")
+	}
+	if q.maxPending < 0 {
+		return errors.New("queue: max_pending should not be negative")
+	}
+	if q.priorityLevels <= 0 {
+		return errors.New("queue: priority_levels should be positive")
+	}
+
+	q.fsync.Log = log.Logger{Name: "queue/fsync", Debug: q.Log.Debug}
+	if err := q.fsync.Start(); err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+
+	if err := q.start(q.workers); err != nil {
+		return err
+	}
+
+	if q.statusRetention != 0 {
+		if err := q.startStatusCleanup(); err != nil {
+			return err
+		}
+	}
+	if q.webhook != nil {
+		q.webhook.start(q.Log)
+	}
+
+	control.RegisterQueue(q.ControlName(), q)
+	return nil
 }
 
-func (q *Queue) start(maxParallelism int) error {
+func (q *Queue) start(workers int) error {
+	lock, err := lockDir(q.location)
+	switch {
+	case errors.Is(err, errDirLockUnsupported):
+	case err != nil:
+		return fmt.Errorf("queue: %w", err)
+	default:
+		q.dirLock = lock
+	}
+
+	q.deliveryCtx, q.abortDeliveries = context.WithCancel(context.Background())
+	q.scheduled = make(map[string]time.Time)
+	q.inFlight = make(map[string]bool)
+	q.priorities = make(map[string]int)
+	q.domainStats = make(map[string]*control.DomainStats)
+	q.pending = nil
+	q.pendingCount = 0
+	q.pendingCond = sync.NewCond(&q.pendingLock)
+	q.workers = workers
+	queueWorkers.WithLabelValues(q.name, q.location).Set(float64(workers))
+	for i := 0; i < workers; i++ {
+		q.workersWg.Add(1)
+		go q.worker()
+	}
 	q.wheel = NewTimeWheel(q.dispatch)
-	q.deliverySemaphore = make(chan struct{}, maxParallelism)
 
 	if err := q.readDiskQueue(); err != nil {
 		return err
@@ -261,12 +435,73 @@ func (q *Queue) start(maxParallelism int) error {
 }
 
 func (q *Queue) Close() error {
+	if q.wheel == nil {
+		return nil
+	}
+	control.UnregisterQueue(q.ControlName())
 	q.wheel.Close()
-	q.deliveryWg.Wait()
+	q.stopWorkers()
+	q.workersWg.Wait()
+	q.abortDeliveries()
+	q.stopStatusCleanup()
+	if q.webhook != nil {
+		q.webhook.stop()
+	}
+	if err := q.fsync.Close(); err != nil {
+		q.Log.Error("failed to flush queue files", err)
+	}
+	q.unlockDir()
 
 	return nil
 }
 
+// Shutdown stops the queue, waiting for running delivery attempts to
+// complete. Messages that are not being delivered right now stay in the
+// queue directory and will be picked up on the next start.
+//
+// If ctx is done before running deliveries complete, they are aborted and
+// the results of the attempt are recorded in the message metadata as usual.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	if q.wheel == nil {
+		return nil
+	}
+	atomic.StoreUint32(&q.shuttingDown, 1)
+	control.UnregisterQueue(q.ControlName())
+	q.wheel.Close()
+
+	q.stopWorkers()
+	done := make(chan struct{})
+	go func() {
+		q.workersWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		q.Log.Printf("shutdown grace period expired, aborting running deliveries")
+		q.abortDeliveries()
+		<-done
+	}
+	q.abortDeliveries()
+	q.stopStatusCleanup()
+	if q.webhook != nil {
+		q.webhook.stop()
+	}
+	if err := q.fsync.Close(); err != nil {
+		q.Log.Error("failed to flush queue files", err)
+	}
+	q.unlockDir()
+
+	return nil
+}
+
+func (q *Queue) unlockDir() {
+	if q.dirLock != nil {
+		q.dirLock.Close()
+		q.dirLock = nil
+	}
+}
+
 // discardBroken changes the name of metadata file to have .meta_broken
 // extension.
 //
@@ -282,54 +517,153 @@ func (q *Queue) discardBroken(id string) {
 	}
 }
 
+// dispatch is called by the time wheel for each due time slot, it adds the
+// slot to the pending list to be picked up by a worker.
 func (q *Queue) dispatch(value TimeSlot) {
 	slot := value.Value.(queueSlot)
 
 	q.Log.Debugln("starting delivery for", slot.ID)
 
-	q.deliveryWg.Add(1)
-	go func() {
-		q.Log.Debugln("waiting on delivery semaphore for", slot.ID)
-		q.deliverySemaphore <- struct{}{}
-		defer func() {
-			<-q.deliverySemaphore
-			q.deliveryWg.Done()
-
-			if dontRecover {
-				return
-			}
+	prio := slot.Priority
+	if prio < 0 {
+		prio = 0
+	}
 
-			if err := recover(); err != nil {
-				stack := debug.Stack()
-				log.Printf("panic during queue dispatch %s: %v\n%s", slot.ID, err, stack)
-				q.discardBroken(slot.ID)
-			}
-		}()
-
-		q.Log.Debugln("delivery semaphore acquired for", slot.ID)
-		var (
-			meta *QueueMetadata
-			hdr  textproto.Header
-			body buffer.Buffer
-		)
-		if slot.Meta == nil {
-			var err error
-			meta, hdr, body, err = q.openMessage(slot.ID)
-			if err != nil {
-				q.Log.Error("read message", err, slot.ID)
-				return
-			}
-			if meta == nil {
-				panic("wtf")
-			}
-		} else {
-			meta = slot.Meta
-			hdr = *slot.Hdr
-			body = slot.Body
+	q.pendingLock.Lock()
+	for len(q.pending) <= prio {
+		q.pending = append(q.pending, list.New())
+	}
+	q.pending[prio].PushBack(pendingSlot{TimeSlot: value, since: time.Now()})
+	q.pendingCount++
+	pendingDeliveries.WithLabelValues(q.name, q.location).Set(float64(q.pendingCount))
+	q.pendingLock.Unlock()
+	q.pendingCond.Signal()
+}
+
+// stopWorkers makes workers exit once all pending time slots are processed.
+func (q *Queue) stopWorkers() {
+	q.pendingLock.Lock()
+	q.workersStopped = true
+	q.pendingLock.Unlock()
+	q.pendingCond.Broadcast()
+}
+
+// pendingLen returns the amount of due time slots waiting for a worker.
+func (q *Queue) pendingLen() int {
+	q.pendingLock.Lock()
+	defer q.pendingLock.Unlock()
+	return q.pendingCount
+}
+
+// pendingSlot is the due time slot waiting for a worker.
+type pendingSlot struct {
+	TimeSlot
+	since time.Time
+}
+
+// popPending removes and returns the pending slot that should be delivered
+// next: the one with the highest effective priority, the oldest one if there
+// are several.
+//
+// Slots in each priority list are ordered by the waiting time so only the
+// first slot of each list needs to be considered.
+//
+// pendingLock should be held and there should be at least one pending slot.
+func (q *Queue) popPending() TimeSlot {
+	var (
+		now      = time.Now()
+		best     *list.List
+		bestSlot pendingSlot
+		bestPrio int64
+	)
+	for level, l := range q.pending {
+		e := l.Front()
+		if e == nil {
+			continue
+		}
+		slot := e.Value.(pendingSlot)
+		prio := int64(level)
+		if q.priorityAging != 0 {
+			prio += int64(now.Sub(slot.since) / q.priorityAging)
+		}
+		if best == nil || prio > bestPrio || (prio == bestPrio && slot.since.Before(bestSlot.since)) {
+			best, bestSlot, bestPrio = l, slot, prio
+		}
+	}
+	best.Remove(best.Front())
+	q.pendingCount--
+	return bestSlot.TimeSlot
+}
+
+func (q *Queue) worker() {
+	defer q.workersWg.Done()
+
+	for {
+		q.pendingLock.Lock()
+		for q.pendingCount == 0 && !q.workersStopped {
+			q.pendingCond.Wait()
+		}
+		if q.pendingCount == 0 {
+			q.pendingLock.Unlock()
+			return
+		}
+		value := q.popPending()
+		pendingDeliveries.WithLabelValues(q.name, q.location).Set(float64(q.pendingCount))
+		q.pendingLock.Unlock()
+
+		busyWorkers.WithLabelValues(q.name, q.location).Inc()
+		q.deliverSlot(value)
+		busyWorkers.WithLabelValues(q.name, q.location).Dec()
+	}
+}
+
+func (q *Queue) deliverSlot(value TimeSlot) {
+	slot := value.Value.(queueSlot)
+
+	defer func() {
+		if dontRecover {
+			return
 		}
 
-		q.tryDelivery(meta, hdr, body)
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during queue dispatch %s: %v\n%s", slot.ID, err, stack)
+			q.release(slot.ID)
+			q.discardBroken(slot.ID)
+		}
 	}()
+
+	if atomic.LoadUint32(&q.shuttingDown) == 1 {
+		q.Log.Debugln("shutting down, delivery postponed for", slot.ID)
+		return
+	}
+	if !q.claim(slot.ID, value.Time) {
+		q.Log.Debugln("stale time slot, skipping", slot.ID)
+		return
+	}
+	var (
+		meta *QueueMetadata
+		hdr  textproto.Header
+		body buffer.Buffer
+	)
+	if slot.Meta == nil {
+		var err error
+		meta, hdr, body, err = q.openMessage(slot.ID)
+		if err != nil {
+			q.release(slot.ID)
+			q.Log.Error("read message", err, slot.ID)
+			return
+		}
+		if meta == nil {
+			panic("wtf")
+		}
+	} else {
+		meta = slot.Meta
+		hdr = *slot.Hdr
+		body = slot.Body
+	}
+
+	q.tryDelivery(meta, hdr, body)
 }
 
 func toSMTPErr(err error) *smtp.SMTPError {
@@ -378,6 +712,13 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	partialErr := q.deliver(meta, header, body)
 	dl.Debugf("errors: %v", partialErr.Errs)
 
+	if deleted := q.release(meta.MsgMeta.ID); deleted {
+		dl.Msg("message deleted during the delivery attempt")
+		q.recordDeleted(meta)
+		q.removeFromDisk(meta.MsgMeta)
+		return
+	}
+
 	// While iterating the list of recipients we also pick the smallest tries count
 	// and use it to calculate the delay for the next attempt.
 	smallestTriesCount := 999999
@@ -386,15 +727,20 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		meta.TriesCount = make(map[string]int)
 	}
 
+	expired := q.maxLifetime != 0 && time.Since(meta.FirstAttempt) >= q.maxLifetime
+
 	// Check attempted recipients and corresponding errors.
 	// Split list into two parts: recipients that should be retried (newRcpts)
 	// and recipients DSN will be generated for.
 	newRcpts := make([]string, 0, len(partialErr.Errs))
 	failedRcpts := make([]string, 0, len(partialErr.Errs))
+	events := make([]control.DeliveryEvent, 0, len(meta.To))
 	for _, rcpt := range meta.To {
 		rcptErr, ok := partialErr.Errs[rcpt]
 		if !ok {
 			dl.Msg("delivered", "rcpt", rcpt, "attempt", meta.TriesCount[rcpt]+1)
+			q.countDelivery(rcpt, func(s *control.DomainStats) { s.Delivered++ })
+			events = append(events, statusEvent(rcpt, control.DeliveryDelivered, nil))
 			continue
 		}
 
@@ -403,14 +749,54 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		meta.RcptErrs[rcpt] = toSMTPErr(rcptErr)
 
 		temporary := exterrors.IsTemporaryOrUnspec(rcptErr)
+		deferred := false
+		if action, ok := q.classifyError(rcptErr); ok {
+			dl.DebugMsg("error classified by rule", "rcpt", rcpt, "action", action.String())
+			temporary = action != actionBounce
+			// Deferred attempts are limited by max_tries too so the message
+			// will not stay in the queue forever.
+			deferred = action == actionDefer && meta.DeferCount[rcpt]+1 < q.maxTries
+		}
+		if expired && temporary {
+			dl.Msg("message expired", "rcpt", rcpt, "queued_for", time.Since(meta.FirstAttempt))
+			temporary = false
+			deferred = false
+		}
+
+		if deferred {
+			if meta.DeferCount == nil {
+				meta.DeferCount = make(map[string]int)
+			}
+			q.countDelivery(rcpt, func(s *control.DomainStats) { s.TempFailed++ })
+			events = append(events, statusEvent(rcpt, control.DeliveryDeferred, meta.RcptErrs[rcpt]))
+			meta.DeferCount[rcpt]++
+			newRcpts = append(newRcpts, rcpt)
+
+			// Tries counter is not increased, but the delay should not be
+			// less than the initial one.
+			count := meta.TriesCount[rcpt]
+			if count == 0 {
+				count = 1
+			}
+			if count < smallestTriesCount {
+				smallestTriesCount = count
+			}
+			continue
+		}
+
 		if !temporary || meta.TriesCount[rcpt]+1 == q.maxTries {
 			delete(meta.TriesCount, rcpt)
+			delete(meta.DeferCount, rcpt)
 			dl.Msg("not delivered, permanent error", "rcpt", rcpt)
+			q.countDelivery(rcpt, func(s *control.DomainStats) { s.PermFailed++ })
+			events = append(events, statusEvent(rcpt, control.DeliveryBounced, meta.RcptErrs[rcpt]))
 			failedRcpts = append(failedRcpts, rcpt)
 			continue
 		}
 
 		// Temporary error, increase tries counter and requeue.
+		q.countDelivery(rcpt, func(s *control.DomainStats) { s.TempFailed++ })
+		events = append(events, statusEvent(rcpt, control.DeliveryDeferred, meta.RcptErrs[rcpt]))
 		meta.TriesCount[rcpt]++
 		newRcpts = append(newRcpts, rcpt)
 
@@ -420,9 +806,11 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		}
 	}
 
+	q.recordStatus(meta, events)
+
 	// Generate DSN for recipients that failed permanently this time.
 	if len(failedRcpts) != 0 {
-		q.emitDSN(meta, header, failedRcpts)
+		q.emitDSN(meta, header, failedRcpts, dsn.ActionFailed)
 	}
 	// No recipients to try, either all failed or all succeeded.
 	if len(newRcpts) == 0 {
@@ -433,6 +821,11 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	meta.To = newRcpts
 	meta.LastAttempt = time.Now()
 
+	if q.delayWarningAfter != 0 && !meta.DelayWarned && time.Since(meta.FirstAttempt) >= q.delayWarningAfter {
+		q.emitDSN(meta, header, newRcpts, dsn.ActionDelayed)
+		meta.DelayWarned = true
+	}
+
 	if err := q.updateMetadataOnDisk(meta); err != nil {
 		dl.Error("meta-data update", err)
 	}
@@ -443,12 +836,24 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
 	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
 	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+	// Make sure the delay warning and expiration are not postponed too much
+	// by the growing delay.
+	if q.delayWarningAfter != 0 && !meta.DelayWarned {
+		if warnTime := meta.FirstAttempt.Add(q.delayWarningAfter); warnTime.Before(nextTryTime) {
+			nextTryTime = warnTime
+		}
+	}
+	if q.maxLifetime != 0 {
+		if expireTime := meta.FirstAttempt.Add(q.maxLifetime); expireTime.Before(nextTryTime) {
+			nextTryTime = expireTime
+		}
+	}
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
 		"next_try_delay", time.Until(nextTryTime),
 		"rcpts", meta.To)
 
-	q.wheel.Add(nextTryTime, queueSlot{
+	q.schedule(nextTryTime, queueSlot{
 		ID: meta.MsgMeta.ID,
 
 		// Do not keep (meta-)data in memory to reduce usage.  At this point,
@@ -468,9 +873,15 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 
 	msgMeta := meta.MsgMeta.DeepCopy()
 	msgMeta.ID = msgMeta.ID + "-" + strconv.FormatInt(time.Now().Unix(), 16)
+	msgMeta.DeliveryAttempt = 1
+	for _, rcpt := range meta.To {
+		if tries := meta.TriesCount[rcpt] + 1; tries > msgMeta.DeliveryAttempt {
+			msgMeta.DeliveryAttempt = tries
+		}
+	}
 	dl.Debugf("using message ID = %s", msgMeta.ID)
 
-	msgCtx, msgTask := trace.NewTask(context.Background(), "Queue delivery")
+	msgCtx, msgTask := trace.NewTask(q.deliveryCtx, "Queue delivery")
 	defer msgTask.End()
 
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
@@ -595,7 +1006,14 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
-	qd.q.wheel.Add(time.Time{}, queueSlot{
+	events := make([]control.DeliveryEvent, 0, len(qd.meta.To))
+	for _, rcpt := range qd.meta.To {
+		events = append(events, statusEvent(rcpt, control.DeliveryQueued, nil))
+	}
+	qd.q.recordStatus(qd.meta, events)
+
+	qd.q.setPriority(qd.meta.MsgMeta.ID, qd.meta.MsgMeta.Priority)
+	qd.q.schedule(time.Time{}, queueSlot{
 		ID:   qd.meta.MsgMeta.ID,
 		Meta: qd.meta,
 		Hdr:  &qd.header,
@@ -607,6 +1025,17 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 }
 
 func (q *Queue) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	if q.maxPending != 0 && q.pendingLen() >= q.maxPending {
+		target.DeliveryLogger(q.Log, msgMeta).Msg("too many pending deliveries, message rejected")
+		return nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 5},
+			Message:      "High load, try again later",
+			Reason:       "Too many pending deliveries",
+			TargetName:   "queue",
+		}
+	}
+
 	meta := &QueueMetadata{
 		MsgMeta:      msgMeta,
 		From:         mailFrom,
@@ -622,8 +1051,13 @@ func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
 	dl := target.DeliveryLogger(q.Log, msgMeta)
 
 	// Order is important.
-	// If we remove header and body but can't remove meta now - readDiskQueue
-	// will detect and report it.
+	// Meta-data file is removed first so the message becomes invisible
+	// before its contents are gone. If we can't remove header or body
+	// now - readDiskQueue will clean them up on the next start.
+	metaPath := filepath.Join(q.location, id+".meta")
+	if err := os.Remove(metaPath); err != nil {
+		dl.Error("failed to remove meta-data from disk", err)
+	}
 	headerPath := filepath.Join(q.location, id+".header")
 	if err := os.Remove(headerPath); err != nil {
 		dl.Error("failed to remove header from disk", err)
@@ -632,10 +1066,9 @@ func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
 	if err := os.Remove(bodyPath); err != nil {
 		dl.Error("failed to remove body from disk", err)
 	}
-	metaPath := filepath.Join(q.location, id+".meta")
-	if err := os.Remove(metaPath); err != nil {
-		dl.Error("failed to remove meta-data from disk", err)
-	}
+	q.schedLock.Lock()
+	delete(q.priorities, id)
+	q.schedLock.Unlock()
 	dl.Debugf("removed message from disk")
 }
 
@@ -645,7 +1078,7 @@ func (q *Queue) readDiskQueue() error {
 		return err
 	}
 
-	// TODO(GH #209): Rewrite this function to pass all sub-tests in TestQueueDelivery_DeserializationCleanUp/NoMeta.
+	q.removeIncompleteEntries(dirInfo)
 
 	loadedCount := 0
 	for _, entry := range dirInfo {
@@ -686,22 +1119,14 @@ func (q *Queue) readDiskQueue() error {
 			continue
 		}
 
-		smallestTriesCount := 999999
-		for _, count := range meta.TriesCount {
-			if smallestTriesCount > count {
-				smallestTriesCount = count
-			}
-		}
-		nextTryTime := meta.LastAttempt
-		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
-
+		nextTryTime := q.nextAttempt(meta)
 		if time.Until(nextTryTime) < q.postInitDelay {
 			nextTryTime = time.Now().Add(q.postInitDelay)
 		}
 
 		q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, time.Until(nextTryTime), nextTryTime)
-		q.wheel.Add(nextTryTime, queueSlot{
+		q.setPriority(id, meta.MsgMeta.Priority)
+		q.schedule(nextTryTime, queueSlot{
 			ID: id,
 		})
 		loadedCount++
@@ -714,56 +1139,103 @@ func (q *Queue) readDiskQueue() error {
 	return nil
 }
 
+// removeIncompleteEntries removes files left by enqueue operations that
+// were interrupted before the meta-data file was written.
+//
+// Message is considered to be in the queue only if ID.meta exists, see
+// storeNewMessage. Header and body files without it and temporary
+// meta-data files are never visible and can be safely removed.
+func (q *Queue) removeIncompleteEntries(dirInfo []os.FileInfo) {
+	hasMeta := make(map[string]bool, len(dirInfo)/3)
+	for _, entry := range dirInfo {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".meta") {
+			hasMeta[strings.TrimSuffix(entry.Name(), ".meta")] = true
+		}
+	}
+
+	for _, entry := range dirInfo {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, ".meta.new"):
+			q.tryRemoveDanglingFile(name)
+		case strings.HasSuffix(name, ".header"):
+			if !hasMeta[strings.TrimSuffix(name, ".header")] {
+				q.tryRemoveDanglingFile(name)
+			}
+		case strings.HasSuffix(name, ".body"):
+			if !hasMeta[strings.TrimSuffix(name, ".body")] {
+				q.tryRemoveDanglingFile(name)
+			}
+		}
+	}
+}
+
+// storeNewMessage writes the message to the queue directory.
+//
+// Header and body are written and flushed to disk first, then the
+// meta-data file is atomically created. Its existence is what makes
+// the message visible to readDiskQueue so a crash at any point leaves
+// either the complete entry or files that will be removed on the next
+// start.
 func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
 	id := meta.MsgMeta.ID
 
 	headerPath := filepath.Join(q.location, id+".header")
+	bodyPath := filepath.Join(q.location, id+".body")
+
+	if err := q.writeMessageData(headerPath, bodyPath, header, body); err != nil {
+		q.tryRemoveDanglingFile(id + ".body")
+		q.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	if err := q.updateMetadataOnDisk(meta); err != nil {
+		// The meta-data file is already in place if only the directory
+		// sync failed. Remove it first, otherwise the message would be
+		// loaded on restart without header and body.
+		q.tryRemoveDanglingFile(id + ".meta")
+		q.tryRemoveDanglingFile(id + ".meta.new")
+		q.tryRemoveDanglingFile(id + ".body")
+		q.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	return buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}, nil
+}
+
+func (q *Queue) writeMessageData(headerPath, bodyPath string, header textproto.Header, body buffer.Buffer) error {
 	headerFile, err := os.Create(headerPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer headerFile.Close()
 
 	if err := textproto.WriteHeader(headerFile, header); err != nil {
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
+		return err
+	}
+	if err := q.fsync.File(headerFile); err != nil {
+		return err
 	}
 
 	bodyReader, err := body.Open()
 	if err != nil {
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
+		return err
 	}
 	defer bodyReader.Close()
 
-	bodyPath := filepath.Join(q.location, id+".body")
 	bodyFile, err := os.Create(bodyPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer bodyFile.Close()
 
 	if _, err := io.Copy(bodyFile, bodyReader); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	if err := q.updateMetadataOnDisk(meta); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	if err := headerFile.Sync(); err != nil {
-		return nil, err
-	}
-
-	if err := bodyFile.Sync(); err != nil {
-		return nil, err
+		return err
 	}
-
-	return buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}, nil
+	return q.fsync.File(bodyFile)
 }
 
 func (q *Queue) updateMetadataOnDisk(meta *QueueMetadata) error {
@@ -792,17 +1264,17 @@ func (q *Queue) updateMetadataOnDisk(meta *QueueMetadata) error {
 		return err
 	}
 
-	if err := file.Sync(); err != nil {
-		return err
+	if runtime.GOOS == "windows" {
+		return q.fsync.File(file)
 	}
 
-	if runtime.GOOS != "windows" {
-		if err := os.Rename(metaPath+".new", metaPath); err != nil {
-			return err
-		}
+	if err := q.fsync.Rename(file, metaPath); err != nil {
+		return err
 	}
 
-	return nil
+	// Make sure the rename (and creation of header and body files
+	// before it) is persisted.
+	return q.fsync.Dir(q.location)
 }
 
 func (q *Queue) readMessageMeta(id string) (*QueueMetadata, error) {
@@ -836,6 +1308,9 @@ type BufferedReadCloser struct {
 
 func (q *Queue) tryRemoveDanglingFile(name string) {
 	if err := os.Remove(filepath.Join(q.location, name)); err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
 		q.Log.Error("dangling file remove failed", err)
 		return
 	}
@@ -885,7 +1360,7 @@ func (q *Queue) Name() string {
 	return "queue"
 }
 
-func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpts []string) {
+func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, rcpts []string, action dsn.Action) {
 	// If, apparently, we have no DSN msgpipeline configured - do nothing.
 	if q.dsnPipeline == nil {
 		return
@@ -919,7 +1394,7 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 	}
 
 	rcptInfo := make([]dsn.RecipientInfo, 0, len(meta.RcptErrs))
-	for _, rcpt := range failedRcpts {
+	for _, rcpt := range rcpts {
 		rcptErr := meta.RcptErrs[rcpt]
 		// rcptErr is stored in RcptErrs using the effective recipient address,
 		// not the original one.
@@ -931,17 +1406,27 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 
 		rcptInfo = append(rcptInfo, dsn.RecipientInfo{
 			FinalRecipient: rcpt,
-			Action:         dsn.ActionFailed,
+			Action:         action,
 			Status:         rcptErr.EnhancedCode,
 			DiagnosticCode: rcptErr,
 		})
 	}
 
+	text := q.dsnText
+	if text == nil {
+		locale := q.dsnLocales.Locale(context.Background(), meta.MsgMeta.OriginalFrom)
+		if action == dsn.ActionDelayed {
+			text = i18n.DSNDelayText(locale)
+		} else {
+			text = i18n.DSNText(locale)
+		}
+	}
+
 	var dsnBodyBlob bytes.Buffer
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
-	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, &dsnBodyBlob)
+	dsnHeader, err := dsn.GenerateDSNText(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, text, &dsnBodyBlob)
 	if err != nil {
-		dl.Error("failed to generate fail DSN", err)
+		dl.Error("failed to generate DSN", err, "action", action)
 		return
 	}
 	dsnBody := buffer.MemoryBuffer{Slice: dsnBodyBlob.Bytes()}
@@ -953,7 +1438,7 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 			RequireTLS: meta.MsgMeta.SMTPOpts.RequireTLS,
 		},
 	}
-	dl.Msg("generated failed DSN", "dsn_id", dsnID)
+	dl.Msg("generated DSN", "dsn_id", dsnID, "action", action)
 
 	msgCtx, msgTask := trace.NewTask(context.Background(), "DSN Delivery")
 	defer msgTask.End()
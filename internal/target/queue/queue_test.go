@@ -20,6 +20,7 @@ package queue
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
@@ -28,15 +29,19 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -128,6 +133,7 @@ func (utd *unreliableTargetDelivery) Body(ctx context.Context, header textproto.
 		return errors.New("partial failure occurred, no additional information available")
 	}
 
+	utd.msg.Header = header
 	r, _ := body.Open()
 	utd.msg.Body, _ = ioutil.ReadAll(r)
 
@@ -219,6 +225,10 @@ func checkQueueDir(t *testing.T, q *Queue, expectedIDs []string) {
 			t.Fatalf("queue should not create subdirectories in the store, but there is %s dir in it", file.Name())
 		}
 
+		if file.Name() == lockFileName {
+			continue
+		}
+
 		nameParts := strings.Split(file.Name(), ".")
 		if len(nameParts) != 2 {
 			t.Fatalf("did the queue files name format changed? got %s", file.Name())
@@ -465,6 +475,104 @@ func TestQueueDelivery_TemporaryRcptReject(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_ErrorRules(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": &exterrors.SMTPError{Code: 550, Message: "Greylisted, try again later"},
+				"tester2@example.org": &exterrors.SMTPError{Code: 452, Message: "Mailbox full"},
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.errorRules = []errorRule{
+		{action: actionRetry, minCode: 550, maxCode: 550, re: regexp.MustCompile("(?i)greylist")},
+		{action: actionBounce, minCode: 450, maxCode: 459, re: regexp.MustCompile("(?i)mailbox full")},
+	}
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org", "tester3@example.org"})
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester3@example.org"}, "")
+
+	// tester1 is retried despite the 5xx code, tester2 is not retried
+	// despite the 4xx code.
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDelivery_ErrorRules_Defer(t *testing.T) {
+	t.Parallel()
+
+	greylisted := &exterrors.SMTPError{Code: 451, Message: "Greylisted"}
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{"tester1@example.org": greylisted},
+			{"tester1@example.org": greylisted},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.maxTries = 2
+	q.errorRules = []errorRule{
+		{action: actionDefer, minCode: 451, maxCode: 451},
+	}
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester2@example.org"}, "")
+
+	// The first attempt is deferred and is not counted, so the message is
+	// not bounced after the second one.
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestParseErrorRules(t *testing.T) {
+	rules, err := parseErrorRules(nil, config.Node{
+		Name: "error_rules",
+		Children: []config.Node{
+			{Name: "retry", Args: []string{"500-599", "greylist"}},
+			{Name: "bounce", Args: []string{"421"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := rules.([]errorRule)
+	if len(parsed) != 2 {
+		t.Fatal("wrong amount of rules:", len(parsed))
+	}
+	if !parsed[0].match(550, "greylisted") || parsed[0].match(550, "no such user") || parsed[0].match(450, "greylisted") {
+		t.Error("wrong matching for the first rule")
+	}
+	if !parsed[1].match(421, "anything") || parsed[1].match(420, "anything") {
+		t.Error("wrong matching for the second rule")
+	}
+
+	for _, args := range [][]string{{"600"}, {"599-500"}, {"5xx"}, {"550", "("}, {}} {
+		_, err := parseErrorRules(nil, config.Node{
+			Name:     "error_rules",
+			Children: []config.Node{{Name: "retry", Args: args}},
+		})
+		if err == nil {
+			t.Error("no error for", args)
+		}
+	}
+}
+
 func TestQueueDelivery_SerializationRoundtrip(t *testing.T) {
 	t.Parallel()
 
@@ -556,7 +664,6 @@ func TestQueueDelivery_DeserlizationCleanUp(t *testing.T) {
 	}
 
 	t.Run("NoMeta", func(t *testing.T) {
-		t.Skip("Not implemented")
 		test(t, ".meta")
 	})
 	t.Run("NoBody", func(t *testing.T) {
@@ -567,6 +674,37 @@ func TestQueueDelivery_DeserlizationCleanUp(t *testing.T) {
 	})
 }
 
+func TestQueueDelivery_IncompleteEnqueue(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.Close()
+
+	// Files left by the process crashing before (or while) the meta-data
+	// file is written.
+	for _, name := range []string{
+		"incomplete1.header", "incomplete1.body",
+		"incomplete2.header",
+		"incomplete3.header", "incomplete3.body", "incomplete3.meta.new",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(q.location, name), []byte("foobar\r\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q = newTestQueueDir(t, &dt, q.location)
+	q.Close()
+
+	checkQueueDir(t, q, []string{})
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("incomplete message was delivered: %+v", msg)
+	default:
+	}
+}
+
 func TestQueueDelivery_AbortIfNoRecipients(t *testing.T) {
 	t.Parallel()
 
@@ -671,6 +809,137 @@ func TestQueueDSN(t *testing.T) {
 	}
 }
 
+func TestQueueDSN_Template(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": &exterrors.SMTPError{Code: 550, Message: "No such user"},
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.dsnText = template.Must(template.New("dsn").Parse(
+		"Nachricht von {{.ReportingMTA}}.\n{{range .Recipients}}{{.Address}}: {{.Error}}\n{{end}}"))
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+
+	body := string(msg.Body)
+	if !strings.Contains(body, "Nachricht von mx.example.org.") {
+		t.Error("custom text is not used:", body)
+	}
+	if !strings.Contains(body, "tester1@example.org: No such user") {
+		t.Error("recipient error is missing:", body)
+	}
+	if !strings.Contains(body, "Content-Type: message/delivery-status") {
+		t.Error("machine-readable part is missing:", body)
+	}
+}
+
+func TestQueueDSN_DelayWarning(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("try later"), true),
+			},
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("try later"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.delayWarningAfter = time.Nanosecond
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong RCPT TO address in DSN: %v", msg.RcptTo)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "Delayed Mail (still being retried)" {
+		t.Error("wrong DSN subject:", subject)
+	}
+	if body := string(msg.Body); !strings.Contains(body, "Action: delayed") {
+		t.Error("DSN does not report delayed delivery:", body)
+	}
+
+	// Message is still delivered after the warning.
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	// Warning is sent only once.
+	time.Sleep(500 * time.Millisecond)
+	if len(dsnTarget.committed) != 0 {
+		t.Error("more than one DSN is sent")
+	}
+}
+
+func TestQueueDelivery_MaxLifetime(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("try later"), true),
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.maxLifetime = time.Nanosecond
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if body := string(msg.Body); !strings.Contains(body, "Action: failed") {
+		t.Error("DSN does not report failed delivery:", body)
+	}
+
+	// No more retries after the message is expired.
+	time.Sleep(500 * time.Millisecond)
+	if len(dt.committed) != 0 || len(dt.aborted) != 0 {
+		t.Error("delivery is retried after expiration")
+	}
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
 func TestQueueDSN_FromEmptyAddr(t *testing.T) {
 	t.Parallel()
 
@@ -829,6 +1098,264 @@ func TestQueueDSN_RcptRewrite(t *testing.T) {
 	}
 }
 
+type blockingTarget struct {
+	started chan struct{}
+}
+
+type blockingDelivery struct {
+	bt *blockingTarget
+}
+
+func (bt *blockingTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return blockingDelivery{bt: bt}, nil
+}
+
+func (bd blockingDelivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	return nil
+}
+
+func (bd blockingDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	bd.bt.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (bd blockingDelivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func (bd blockingDelivery) Commit(ctx context.Context) error {
+	return nil
+}
+
+func TestQueueShutdown_GraceExpired(t *testing.T) {
+	t.Parallel()
+
+	dt := blockingTarget{started: make(chan struct{}, 1)}
+	q := newTestQueue(t, &dt)
+	defer os.RemoveAll(q.location)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	select {
+	case <-dt.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery is not started")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Message should be kept for the next start.
+	checkQueueDir(t, q, []string{id})
+}
+
 func init() {
 	dontRecover = true
 }
+
+func TestQueueDelivery_Status(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": &exterrors.SMTPError{Code: 451, Message: "Try again later"},
+				"tester2@example.org": &exterrors.SMTPError{Code: 550, Message: "No such user"},
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.statusRetention = time.Hour
+	defer cleanQueue(t, q)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org", "tester3@example.org"})
+
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	// Wait for the status to be recorded.
+	q.Close()
+
+	status, err := q.DeliveryStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.From != "tester@example.com" {
+		t.Error("Wrong sender:", status.From)
+	}
+
+	expected := map[string]struct {
+		state    string
+		attempts int
+		err      string
+	}{
+		"tester1@example.org": {control.DeliveryDelivered, 2, "451 4.0.0 Try again later"},
+		"tester2@example.org": {control.DeliveryBounced, 1, "550 5.0.0 No such user"},
+		"tester3@example.org": {control.DeliveryDelivered, 1, ""},
+	}
+	for rcpt, exp := range expected {
+		rcptStatus := status.Rcpts[rcpt]
+		if rcptStatus.State != exp.state || rcptStatus.Attempts != exp.attempts || rcptStatus.LastError != exp.err {
+			t.Errorf("Wrong status for %s: %+v", rcpt, rcptStatus)
+		}
+	}
+	// 3 queued, 3 for the first attempt, 1 for the second one.
+	if len(status.Events) != 7 {
+		t.Errorf("Wrong amount of events: %+v", status.Events)
+	}
+
+	if _, err := q.DeliveryStatus("nonexistent"); err != ErrNoSuchMessage {
+		t.Error("Expected ErrNoSuchMessage, got", err)
+	}
+}
+
+func TestQueueDelivery_MaxPending(t *testing.T) {
+	t.Parallel()
+
+	dt := blockingTarget{started: make(chan struct{}, 1)}
+	q := newTestQueue(t, &dt)
+	q.maxPending = 1
+	defer os.RemoveAll(q.location)
+
+	// Takes the only worker.
+	id1 := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	select {
+	case <-dt.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery is not started")
+	}
+
+	// Waits for the worker.
+	id2 := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	for i := 0; q.pendingLen() != 1; i++ {
+		if i == 50 {
+			t.Fatal("message is not dispatched")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, q, "tester@example.com", []string{"tester1@example.org"}); err == nil {
+		t.Fatal("expected message to be rejected")
+	} else if !exterrors.IsTemporary(err) {
+		t.Fatal("expected temporary error, got", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkQueueDir(t, q, []string{id1, id2})
+}
+
+// gatedTarget blocks all deliveries until gate is closed.
+type gatedTarget struct {
+	testutils.Target
+	started chan struct{}
+	gate    chan struct{}
+}
+
+func (gt *gatedTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	gt.started <- struct{}{}
+	<-gt.gate
+	return gt.Target.Start(ctx, msgMeta, mailFrom)
+}
+
+func TestQueueDelivery_Priority(t *testing.T) {
+	t.Parallel()
+
+	test := func(t *testing.T, aging, lowHeadStart time.Duration, expectOrder []string) {
+		dt := gatedTarget{started: make(chan struct{}, 3), gate: make(chan struct{})}
+		q := newTestQueue(t, &dt)
+		q.priorityLevels = 3
+		q.priorityAging = aging
+		defer os.RemoveAll(q.location)
+
+		waitPending := func(n int) {
+			t.Helper()
+			for i := 0; q.pendingLen() != n; i++ {
+				if i == 50 {
+					t.Fatal("message is not dispatched")
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		// Message ID used by DoTestDelivery depends on the test name.
+		deliver := func(from string, prio int) {
+			t.Run(from, func(t *testing.T) {
+				testutils.DoTestDeliveryMeta(t, q, from, []string{"tester@example.org"},
+					&module.MsgMetadata{Priority: prio})
+			})
+		}
+
+		// Takes the only worker until the gate is open.
+		deliver("first@example.com", 0)
+		select {
+		case <-dt.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("delivery is not started")
+		}
+
+		deliver("low@example.com", 0)
+		waitPending(1)
+		time.Sleep(lowHeadStart)
+		deliver("high@example.com", 5)
+		waitPending(2)
+
+		close(dt.gate)
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		order := make([]string, 0, len(dt.Messages))
+		for _, msg := range dt.Messages {
+			order = append(order, msg.MailFrom)
+		}
+		if !reflect.DeepEqual(order, expectOrder) {
+			t.Errorf("wrong delivery order: %v", order)
+		}
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		test(t, 0, 0, []string{"first@example.com", "high@example.com", "low@example.com"})
+	})
+	t.Run("aging", func(t *testing.T) {
+		// low@ waits long enough to get priority 3 > 2.
+		test(t, 50*time.Millisecond, 500*time.Millisecond, []string{"first@example.com", "low@example.com", "high@example.com"})
+	})
+}
+
+func TestQueue_PopPending(t *testing.T) {
+	q := &Queue{priorityAging: time.Minute}
+
+	now := time.Now()
+	push := func(id string, prio int, age time.Duration) {
+		for len(q.pending) <= prio {
+			q.pending = append(q.pending, list.New())
+		}
+		q.pending[prio].PushBack(pendingSlot{
+			TimeSlot: TimeSlot{Value: queueSlot{ID: id, Priority: prio}},
+			since:    now.Add(-age),
+		})
+		q.pendingCount++
+	}
+	push("low-old", 0, 150*time.Second)
+	push("low-new", 0, 0)
+	push("mid", 1, 10*time.Second)
+	push("high", 2, 0)
+
+	// low-old has effective priority 2 and waits longer than high.
+	var order []string
+	for q.pendingCount != 0 {
+		order = append(order, q.popPending().Value.(queueSlot).ID)
+	}
+	expected := []string{"low-old", "high", "mid", "low-new"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("wrong order: %v", order)
+	}
+}
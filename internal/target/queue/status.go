@@ -0,0 +1,211 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/jsonfile"
+)
+
+// Delivery status tracking.
+//
+// If status_retention is set, state transitions of each recipient are
+// recorded in status/ID.json files in the queue directory. Records are kept
+// for status_retention after the last update, so status can be queried even
+// after the message leaves the queue.
+
+const statusCleanupInterval = time.Hour
+
+var ErrStatusDisabled = errors.New("queue: delivery status tracking is disabled")
+
+func (q *Queue) statusDir() string {
+	return filepath.Join(q.location, "status")
+}
+
+// DeliveryStatus returns the recorded delivery status of the message.
+//
+// It can be used without the queue being started.
+func (q *Queue) DeliveryStatus(id string) (*control.DeliveryStatus, error) {
+	if q.statusRetention == 0 {
+		return nil, ErrStatusDisabled
+	}
+	if !validID(id) {
+		return nil, ErrNoSuchMessage
+	}
+
+	q.statusLock.Lock()
+	defer q.statusLock.Unlock()
+	status, err := q.readStatus(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoSuchMessage
+		}
+		return nil, err
+	}
+	return status, nil
+}
+
+func (q *Queue) readStatus(id string) (*control.DeliveryStatus, error) {
+	status := &control.DeliveryStatus{}
+	if err := jsonfile.Read(filepath.Join(q.statusDir(), id+".json"), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (q *Queue) writeStatus(status *control.DeliveryStatus) error {
+	return jsonfile.Write(filepath.Join(q.statusDir(), status.ID+".json"), status)
+}
+
+// recordStatus records state transitions for the message recipients.
+//
+// Errors are logged and otherwise ignored, status tracking failure should not
+// affect the delivery.
+//
+// Events are also passed to the event webhook, if configured.
+func (q *Queue) recordStatus(meta *QueueMetadata, events []control.DeliveryEvent) {
+	if q.webhook != nil && q.webhook.pending != nil {
+		q.webhook.notify(meta, events)
+	}
+	if q.statusRetention == 0 || len(events) == 0 {
+		return
+	}
+
+	q.statusLock.Lock()
+	defer q.statusLock.Unlock()
+
+	id := meta.MsgMeta.ID
+	status, err := q.readStatus(id)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			q.Log.Error("failed to read delivery status", err, "msg_id", id)
+		}
+		status = &control.DeliveryStatus{
+			ID:      id,
+			From:    meta.From,
+			Created: meta.FirstAttempt,
+			Rcpts:   map[string]control.RcptStatus{},
+		}
+	}
+
+	for _, ev := range events {
+		rcptStatus := status.Rcpts[ev.Rcpt]
+		rcptStatus.State = ev.State
+		rcptStatus.Updated = ev.Time
+		if ev.State != control.DeliveryQueued && ev.State != control.DeliveryDeleted {
+			rcptStatus.Attempts++
+		}
+		if ev.Error != "" {
+			rcptStatus.LastError = ev.Error
+		}
+		status.Rcpts[ev.Rcpt] = rcptStatus
+		status.Events = append(status.Events, ev)
+	}
+
+	if err := q.writeStatus(status); err != nil {
+		q.Log.Error("failed to write delivery status", err, "msg_id", id)
+	}
+}
+
+func (q *Queue) recordDeleted(meta *QueueMetadata) {
+	events := make([]control.DeliveryEvent, 0, len(meta.To))
+	for _, rcpt := range meta.To {
+		events = append(events, statusEvent(rcpt, control.DeliveryDeleted, nil))
+	}
+	q.recordStatus(meta, events)
+}
+
+func statusEvent(rcpt, state string, err *smtp.SMTPError) control.DeliveryEvent {
+	ev := control.DeliveryEvent{
+		Time:  time.Now(),
+		Rcpt:  rcpt,
+		State: state,
+	}
+	if err != nil {
+		ev.Error = fmt.Sprintf("%d %d.%d.%d %s", err.Code,
+			err.EnhancedCode[0], err.EnhancedCode[1], err.EnhancedCode[2], err.Message)
+	}
+	return ev
+}
+
+// cleanupStatus removes status records not updated for longer than
+// status_retention.
+func (q *Queue) cleanupStatus() {
+	dirInfo, err := ioutil.ReadDir(q.statusDir())
+	if err != nil {
+		q.Log.Error("failed to read the status directory", err)
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		if now.Sub(entry.ModTime()) < q.statusRetention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(q.statusDir(), entry.Name())); err != nil {
+			q.Log.Error("failed to remove expired delivery status", err)
+		}
+	}
+}
+
+func (q *Queue) startStatusCleanup() error {
+	if err := os.MkdirAll(q.statusDir(), 0700); err != nil {
+		return err
+	}
+
+	q.cleanupStatus()
+
+	q.statusStop = make(chan struct{})
+	q.statusDone = make(chan struct{})
+	go func() {
+		defer close(q.statusDone)
+		t := time.NewTicker(statusCleanupInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				q.cleanupStatus()
+			case <-q.statusStop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (q *Queue) stopStatusCleanup() {
+	if q.statusStop == nil {
+		return
+	}
+	close(q.statusStop)
+	<-q.statusDone
+	q.statusStop = nil
+}
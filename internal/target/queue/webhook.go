@@ -0,0 +1,231 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+// Amount of events waiting to be sent, events are dropped if the webhook
+// can't keep up.
+const webhookBacklog = 1024
+
+// WebhookEvent is the JSON document sent to the event webhook.
+type WebhookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	MsgID string    `json:"msg_id"`
+	From  string    `json:"from"`
+	Rcpt  string    `json:"rcpt"`
+	Error string    `json:"error,omitempty"`
+}
+
+// eventWebhook sends delivery events to an HTTP endpoint.
+//
+// Events are sent asynchronously by a single goroutine so the delivery is
+// never blocked by the webhook.
+type eventWebhook struct {
+	url        string
+	events     map[string]bool
+	secret     string
+	maxTries   int
+	retryDelay time.Duration
+	cl         *http.Client
+	log        log.Logger
+
+	pending chan WebhookEvent
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func eventWebhookDirective(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+	w := &eventWebhook{
+		url:    node.Args[0],
+		events: map[string]bool{},
+	}
+	u, err := url.Parse(w.url)
+	if err != nil {
+		return nil, config.NodeErr(node, "malformed url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, config.NodeErr(node, "unsupported url scheme: %s", u.Scheme)
+	}
+
+	var (
+		events  []string
+		timeout time.Duration
+	)
+	cfg := config.NewMap(m.Globals, node)
+	cfg.StringList("events", false, false, []string{
+		control.DeliveryDelivered, control.DeliveryBounced, control.DeliveryDeferred,
+	}, &events)
+	cfg.String("secret", false, false, "", &w.secret)
+	cfg.Int("max_tries", false, false, 5, &w.maxTries)
+	cfg.Duration("retry_delay", false, false, 5*time.Second, &w.retryDelay)
+	cfg.Duration("timeout", false, false, 10*time.Second, &timeout)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	for _, ev := range events {
+		switch ev {
+		case control.DeliveryQueued, control.DeliveryDeferred, control.DeliveryDelivered,
+			control.DeliveryBounced, control.DeliveryDeleted:
+			w.events[ev] = true
+		default:
+			return nil, config.NodeErr(node, "unknown event: %s", ev)
+		}
+	}
+	if w.maxTries < 1 {
+		return nil, config.NodeErr(node, "max_tries should be at least 1")
+	}
+	w.cl = &http.Client{Timeout: timeout}
+
+	return w, nil
+}
+
+func (w *eventWebhook) start(l log.Logger) {
+	w.log = log.Logger{Name: l.Name + "/webhook", Debug: l.Debug}
+	w.pending = make(chan WebhookEvent, webhookBacklog)
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for {
+			select {
+			case ev := <-w.pending:
+				w.send(ev)
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the sender goroutine, events that are not sent yet are lost.
+func (w *eventWebhook) stop() {
+	if w.cancel == nil {
+		return
+	}
+	w.cancel()
+	w.wg.Wait()
+	w.cancel = nil
+
+	if len(w.pending) != 0 {
+		w.log.Printf("%d events were not sent", len(w.pending))
+	}
+}
+
+func (w *eventWebhook) notify(meta *QueueMetadata, events []control.DeliveryEvent) {
+	for _, ev := range events {
+		if !w.events[ev.State] {
+			continue
+		}
+		select {
+		case w.pending <- WebhookEvent{
+			Event: ev.State,
+			Time:  ev.Time,
+			MsgID: meta.MsgMeta.ID,
+			From:  meta.From,
+			Rcpt:  ev.Rcpt,
+			Error: ev.Error,
+		}:
+		default:
+			w.log.Msg("too many pending events, event dropped", "msg_id", meta.MsgMeta.ID,
+				"rcpt", ev.Rcpt, "event", ev.State)
+		}
+	}
+}
+
+func (w *eventWebhook) send(ev WebhookEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		w.log.Error("event serialization failed", err)
+		return
+	}
+
+	delay := w.retryDelay
+	for i := 1; ; i++ {
+		err := w.post(body)
+		if err == nil {
+			return
+		}
+		if i >= w.maxTries {
+			w.log.Error("webhook request failed, event dropped", err, "msg_id", ev.MsgID,
+				"rcpt", ev.Rcpt, "event", ev.Event)
+			return
+		}
+		w.log.Error("webhook request failed, retrying", err, "attempt", i)
+
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return
+		}
+		delay *= 2
+	}
+}
+
+func (w *eventWebhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(w.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(body)
+		req.Header.Set("X-Maddy-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read some of the body to allow connection reuse.
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
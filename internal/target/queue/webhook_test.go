@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestQueueDelivery_EventWebhook(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan WebhookEvent, 10)
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if sig := r.Header.Get("X-Maddy-Signature"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("Wrong signature:", sig)
+		}
+
+		// Fail the first request to check retries.
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var ev WebhookEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Error(err)
+			return
+		}
+		received <- ev
+	}))
+	defer srv.Close()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": &exterrors.SMTPError{Code: 550, Message: "No such user"},
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	wh, err := eventWebhookDirective(config.NewMap(nil, config.Node{}), config.Node{
+		Name: "event_webhook",
+		Args: []string{srv.URL},
+		Children: []config.Node{
+			{Name: "events", Args: []string{"delivered", "bounced"}},
+			{Name: "secret", Args: []string{"s3cret"}},
+			{Name: "retry_delay", Args: []string{"10ms"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.webhook = wh.(*eventWebhook)
+	q.webhook.start(q.Log)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	var events []WebhookEvent
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-received:
+			events = append(events, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook is not called")
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Rcpt < events[j].Rcpt })
+
+	if events[0].Event != control.DeliveryBounced || events[0].Rcpt != "tester1@example.org" ||
+		events[0].Error != "550 5.0.0 No such user" {
+		t.Error("Wrong event for tester1:", events[0])
+	}
+	if events[1].Event != control.DeliveryDelivered || events[1].Rcpt != "tester2@example.org" {
+		t.Error("Wrong event for tester2:", events[1])
+	}
+	for _, ev := range events {
+		if ev.MsgID != id || ev.From != "tester@example.com" {
+			t.Error("Wrong message info:", ev)
+		}
+	}
+}
+
+func TestEventWebhookDirective(t *testing.T) {
+	for _, node := range []config.Node{
+		{Name: "event_webhook"},
+		{Name: "event_webhook", Args: []string{"ftp://example.org"}},
+		{Name: "event_webhook", Args: []string{"https://example.org"}, Children: []config.Node{
+			{Name: "events", Args: []string{"exploded"}},
+		}},
+		{Name: "event_webhook", Args: []string{"https://example.org"}, Children: []config.Node{
+			{Name: "max_tries", Args: []string{"0"}},
+		}},
+	} {
+		if _, err := eventWebhookDirective(config.NewMap(nil, config.Node{}), node); err == nil {
+			t.Errorf("Expected failure for %+v", node)
+		}
+	}
+}
@@ -24,7 +24,6 @@ import (
 	"crypto/x509"
 	"net"
 	"runtime/trace"
-	"sort"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/dns"
@@ -94,6 +93,12 @@ func (rd *remoteDelivery) connect(ctx context.Context, conn mxConn, host string,
 		tlsCfg = rd.rt.tlsConfig.Clone()
 		tlsCfg.ServerName = host
 	}
+	if tlsCfg != nil && isOnion(host) {
+		// Onion services commonly use self-signed certificates, see
+		// onionTLSLevel.
+		tlsCfg.InsecureSkipVerify = true
+		tlsLevel = module.TLSEncrypted
+	}
 
 	rd.Log.DebugMsg("trying", "remote_server", host, "domain", conn.domain)
 
@@ -147,6 +152,15 @@ retry:
 }
 
 func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *net.MX) error {
+	onion := isOnion(record.Host)
+	if onion {
+		if err := rd.prepareOnionMX(conn, record); err != nil {
+			return err
+		}
+	} else {
+		conn.Dialer = rd.rt.mxDialer()
+	}
+
 	mxLevel := module.MXNone
 
 	connCtx, cancel := context.WithCancel(ctx)
@@ -169,6 +183,9 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	if err != nil {
 		return err
 	}
+	if onion {
+		tlsLevel = onionTLSLevel(tlsLevel, conn.dnssecOk)
+	}
 
 	// Make decision based on the policy and connection state.
 	//
@@ -281,7 +298,7 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 		domain:     domain,
 	}
 
-	conn.Dialer = rd.rt.dialer
+	conn.Dialer = rd.rt.mxDialer()
 	conn.Log = rd.Log
 	conn.Hostname = rd.rt.hostname
 	conn.AddrInSMTPMsg = true
@@ -306,6 +323,7 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 		return nil, err
 	}
 	conn.dnssecOk = dnssecOk
+	records = rd.rt.filterOnionMX(records)
 
 	var lastErr error
 	region = trace.StartRegion(ctx, "remote/Connect+TLS")
@@ -365,9 +383,7 @@ func (rd *remoteDelivery) lookupMX(ctx context.Context, domain string) (dnssecOk
 		}
 	}
 
-	sort.Slice(records, func(i, j int) bool {
-		return records[i].Pref < records[j].Pref
-	})
+	shuffleMX(records)
 
 	// Fallback to A/AAA RR when no MX records are present as
 	// required by RFC 5321 Section 5.1.
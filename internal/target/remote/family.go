@@ -0,0 +1,197 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	familySystem     = "system"
+	familyIPv4       = "ipv4"
+	familyIPv6       = "ipv6"
+	familyRoundRobin = "round_robin"
+)
+
+// shuffleMX sorts MX records by preference, randomizing the order of
+// records with equal preference as required by RFC 5321 Section 5.1.
+func shuffleMX(records []*net.MX) {
+	rand.Shuffle(len(records), func(i, j int) {
+		records[i], records[j] = records[j], records[i]
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+}
+
+// orderAddrs orders MX host addresses according to the address family
+// preference and removes IPv6 addresses if they are disabled.
+//
+// first is used in round-robin mode to select the family to start with.
+func orderAddrs(addrs []net.IPAddr, preference string, disableIPv6 bool, first uint32) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	if disableIPv6 {
+		v6 = nil
+	}
+
+	switch preference {
+	case familyIPv4:
+		return append(v4, v6...)
+	case familyIPv6:
+		return append(v6, v4...)
+	case familyRoundRobin:
+		primary, secondary := v4, v6
+		if first%2 == 1 {
+			primary, secondary = v6, v4
+		}
+		res := make([]net.IPAddr, 0, len(v4)+len(v6))
+		for i := 0; i < len(primary) || i < len(secondary); i++ {
+			if i < len(primary) {
+				res = append(res, primary[i])
+			}
+			if i < len(secondary) {
+				res = append(res, secondary[i])
+			}
+		}
+		return res
+	default:
+		// Keep the resolver order.
+		res := make([]net.IPAddr, 0, len(addrs))
+		for _, addr := range addrs {
+			if disableIPv6 && addr.IP.To4() == nil {
+				continue
+			}
+			res = append(res, addr)
+		}
+		return res
+	}
+}
+
+// connAttemptDelay is the time to wait for the connection attempt to
+// complete before starting the attempt for the next address. Same as
+// the default fallback delay used by net.Dialer.
+var connAttemptDelay = 300 * time.Millisecond
+
+// mxDialer returns the function used to connect to non-onion MX hosts.
+func (rt *Target) mxDialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if rt.preferFamily != familySystem || rt.disableIPv6 {
+		return rt.dialMX
+	}
+	return rt.dialer
+}
+
+// dialMX connects to the MX host, trying its addresses in the order defined
+// by prefer_family and disable_ipv6 directives.
+//
+// As in RFC 8305, the next address is tried if the connection attempt fails
+// or does not complete in connAttemptDelay, without waiting for previous
+// attempts to time out. The first established connection is used.
+func (rt *Target) dialMX(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return rt.dialer(ctx, network, addr)
+	}
+
+	ips, err := rt.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = orderAddrs(ips, rt.preferFamily, rt.disableIPv6, atomic.AddUint32(&rt.familyCounter, 1))
+	if len(ips) == 0 {
+		return nil, errors.New("remote: no usable addresses for the MX")
+	}
+
+	return rt.dialAddrs(ctx, network, host, port, ips)
+}
+
+type dialResult struct {
+	conn net.Conn
+	ip   net.IPAddr
+	err  error
+}
+
+func (rt *Target) dialAddrs(ctx context.Context, network, host, port string, ips []net.IPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered so attempts that complete after we return do not block.
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	var delay <-chan time.Time
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := rt.dialer(ctx, network, net.JoinHostPort(ip.String(), port))
+			results <- dialResult{conn: conn, ip: ip, err: err}
+		}()
+		delay = nil
+		if next < len(ips) {
+			delay = time.After(connAttemptDelay)
+		}
+	}
+
+	start()
+	var lastErr error
+	for pending != 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go closeLateConns(results, pending)
+				return res.conn, nil
+			}
+			rt.Log.DebugMsg("connection failed, trying next address", "remote_server", host, "ip", res.ip.String(), "reason", res.err)
+			lastErr = res.err
+			if next < len(ips) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, lastErr
+}
+
+// closeLateConns closes connections established by the attempts that were
+// still pending when another one succeeded.
+func closeLateConns(results <-chan dialResult, pending int) {
+	for ; pending != 0; pending-- {
+		if res := <-results; res.err == nil {
+			res.conn.Close()
+		}
+	}
+}
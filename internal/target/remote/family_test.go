@@ -0,0 +1,148 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestOrderAddrs(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("2001:db8::2")},
+		{IP: net.ParseIP("192.0.2.2")},
+	}
+	test := func(preference string, disableIPv6 bool, first uint32, expected ...string) {
+		t.Helper()
+		res := orderAddrs(addrs, preference, disableIPv6, first)
+		strs := make([]string, 0, len(res))
+		for _, addr := range res {
+			strs = append(strs, addr.IP.String())
+		}
+		if !reflect.DeepEqual(strs, expected) {
+			t.Errorf("Wrong order for %s (disable_ipv6=%v): %v", preference, disableIPv6, strs)
+		}
+	}
+
+	test(familySystem, false, 0, "2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2")
+	test(familySystem, true, 0, "192.0.2.1", "192.0.2.2")
+	test(familyIPv4, false, 0, "192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2")
+	test(familyIPv6, false, 0, "2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2")
+	test(familyIPv6, true, 0, "192.0.2.1", "192.0.2.2")
+	test(familyRoundRobin, false, 0, "192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2")
+	test(familyRoundRobin, false, 1, "2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2")
+}
+
+func TestShuffleMX(t *testing.T) {
+	records := []*net.MX{
+		{Host: "c", Pref: 20},
+		{Host: "a1", Pref: 10},
+		{Host: "b", Pref: 15},
+		{Host: "a2", Pref: 10},
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		shuffleMX(records)
+		if records[0].Pref != 10 || records[1].Pref != 10 || records[2].Host != "b" || records[3].Host != "c" {
+			t.Fatal("Records are not sorted by preference")
+		}
+		seen[records[0].Host] = true
+	}
+	if !seen["a1"] || !seen["a2"] {
+		t.Fatal("Records with equal preference are not randomized")
+	}
+}
+
+func TestDialMX_Blackhole(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	blackholeDone := make(chan struct{})
+	rt := &Target{
+		resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"mx.example.invalid.": {
+				AAAA: []string{"2001:db8::1"},
+				A:    []string{"127.0.0.1"},
+			},
+		}},
+		dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == net.JoinHostPort("2001:db8::1", port) {
+				// Does not answer.
+				<-ctx.Done()
+				close(blackholeDone)
+				return nil, ctx.Err()
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+		preferFamily: familyIPv6,
+		Log:          testutils.Logger(t, "remote"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := rt.dialMX(ctx, "tcp", net.JoinHostPort("mx.example.invalid", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 5*connAttemptDelay {
+		t.Fatal("Connection took too long:", elapsed)
+	}
+
+	select {
+	case <-blackholeDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pending connection attempt was not cancelled")
+	}
+}
+
+func TestDialMX_AllFailed(t *testing.T) {
+	dialErr := errors.New("connection refused")
+	rt := &Target{
+		resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"mx.example.invalid.": {
+				A: []string{"192.0.2.1", "192.0.2.2"},
+			},
+		}},
+		dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, dialErr
+		},
+		preferFamily: familyIPv4,
+		Log:          testutils.Logger(t, "remote"),
+	}
+
+	_, err := rt.dialMX(context.Background(), "tcp", "mx.example.invalid:25")
+	if !errors.Is(err, dialErr) {
+		t.Fatal("Unexpected error:", err)
+	}
+}
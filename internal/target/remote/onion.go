@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"net"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// isOnion reports whether the host is a Tor onion service address.
+func isOnion(host string) bool {
+	return strings.HasSuffix(strings.ToLower(dns.FQDN(host)), ".onion.")
+}
+
+// filterOnionMX removes non-onion MX records if the domain has any onion
+// MX records and onion_require_tor is enabled so the message is never sent
+// over the clearnet.
+func (rt *Target) filterOnionMX(records []*net.MX) []*net.MX {
+	if !rt.onionRequireTor {
+		return records
+	}
+
+	onion := make([]*net.MX, 0, len(records))
+	for _, record := range records {
+		if isOnion(record.Host) {
+			onion = append(onion, record)
+		}
+	}
+	if len(onion) == 0 {
+		return records
+	}
+	return onion
+}
+
+// prepareOnionMX makes conn use the Tor proxy to connect to the onion MX.
+//
+// MX authentication policies are applied to onion MXs the same way as to
+// any other MX since the MX record itself can be spoofed.
+func (rd *remoteDelivery) prepareOnionMX(conn *mxConn, record *net.MX) error {
+	if rd.rt.torDialer == nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 4},
+			Message:      "Tor is not configured, unable to connect to the onion MX",
+			TargetName:   "remote",
+			Misc: map[string]interface{}{
+				"remote_server": record.Host,
+			},
+		}
+	}
+
+	conn.Dialer = rd.rt.torDialer
+	return nil
+}
+
+// onionTLSLevel returns the TLS level for the connection to the onion MX.
+//
+// Certificates of onion services are not verified. Instead, the server is
+// authenticated by Tor using the onion address, but only if the MX record
+// pointing to it is authenticated using DNSSEC.
+func onionTLSLevel(tlsLevel module.TLSLevel, dnssecOk bool) module.TLSLevel {
+	if tlsLevel == module.TLSEncrypted && dnssecOk {
+		return module.TLSAuthenticated
+	}
+	return tlsLevel
+}
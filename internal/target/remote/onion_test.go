@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testOnionHost = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion."
+
+func TestRemoteDelivery_Onion(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	tarpit := testutils.FailOnConn(t, "127.0.0.2:"+smtpPort)
+	defer tarpit.Close()
+
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{
+				{Host: "mx.example.invalid.", Pref: 10},
+				{Host: testOnionHost, Pref: 20},
+			},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.2"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+	tgt.onionRequireTor = true
+
+	var torAddrs []string
+	tgt.torDialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		torAddrs = append(torAddrs, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, "127.0.0.1:"+smtpPort)
+	}
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	if len(torAddrs) != 1 || torAddrs[0] != net.JoinHostPort(testOnionHost, smtpPort) {
+		t.Fatal("Onion MX is not used via Tor:", torAddrs)
+	}
+}
+
+func TestRemoteDelivery_OnionNoTor(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{
+				{Host: testOnionHost, Pref: 10},
+				{Host: "mx.example.invalid.", Pref: 20},
+			},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+
+	// Clearnet MX should not be used as a fallback.
+	tgt.onionRequireTor = true
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Error("Error should be temporary:", err)
+	}
+	if len(be.Messages) != 0 {
+		t.Fatal("Message delivered over clearnet")
+	}
+
+	tgt.onionRequireTor = false
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+}
+
+func TestRemoteDelivery_OnionPolicy(t *testing.T) {
+	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: testOnionHost, Pref: 10}},
+		},
+	}
+
+	// Connection to the onion MX is not authenticated just because it is
+	// made via Tor.
+	tgt := testTarget(t, zones, nil, []module.MXAuthPolicy{
+		&localPolicy{minTLSLevel: module.TLSEncrypted},
+	})
+	defer tgt.Close()
+	tgt.torDialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, "127.0.0.1:"+smtpPort)
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestOnionTLSLevel(t *testing.T) {
+	for _, c := range []struct {
+		level    module.TLSLevel
+		dnssecOk bool
+		want     module.TLSLevel
+	}{
+		{module.TLSNone, false, module.TLSNone},
+		{module.TLSNone, true, module.TLSNone},
+		{module.TLSEncrypted, false, module.TLSEncrypted},
+		{module.TLSEncrypted, true, module.TLSAuthenticated},
+	} {
+		if got := onionTLSLevel(c.level, c.dnssecOk); got != c.want {
+			t.Errorf("onionTLSLevel(%v, %v) = %v, want %v", c.level, c.dnssecOk, got, c.want)
+		}
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"runtime/trace"
 	"strings"
 	"sync"
@@ -45,6 +46,7 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/smtpconn"
 	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/net/idna"
@@ -76,6 +78,14 @@ type Target struct {
 	pool           *pool.P
 	connReuseLimit int
 
+	preferFamily  string
+	disableIPv6   bool
+	familyCounter uint32
+
+	// Dialer used for onion MXs, nil if Tor is not configured.
+	torDialer       func(ctx context.Context, network, addr string) (net.Conn, error)
+	onionRequireTor bool
+
 	Log log.Logger
 
 	connectTimeout    time.Duration
@@ -99,7 +109,10 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 }
 
 func (rt *Target) Init(cfg *config.Map) error {
-	var err error
+	var (
+		err      error
+		torProxy *url.URL
+	)
 	rt.extResolver, err = dns.NewExtResolver()
 	if err != nil {
 		rt.Log.Error("cannot initialize DNSSEC-aware resolver, DNSSEC and DANE are not available", err)
@@ -135,6 +148,11 @@ func (rt *Target) Init(cfg *config.Map) error {
 	cfg.Bool("requiretls_override", false, true, &rt.allowSecOverride)
 	cfg.Bool("relaxed_requiretls", false, true, &rt.relaxedREQUIRETLS)
 	cfg.Int("conn_reuse_limit", false, false, 10, &rt.connReuseLimit)
+	cfg.Enum("prefer_family", false, false,
+		[]string{familySystem, familyIPv4, familyIPv6, familyRoundRobin}, familySystem, &rt.preferFamily)
+	cfg.Bool("disable_ipv6", false, false, &rt.disableIPv6)
+	cfg.Custom("tor_proxy", false, false, nil, smtpconn.ProxyDirective, &torProxy)
+	cfg.Bool("onion_require_tor", false, true, &rt.onionRequireTor)
 	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &rt.connectTimeout)
 	cfg.Duration("command_timeout", false, false, 5*time.Minute, &rt.commandTimeout)
 	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &rt.submissionTimeout)
@@ -169,6 +187,14 @@ func (rt *Target) Init(cfg *config.Map) error {
 		}).DialContext
 	}
 
+	if torProxy != nil {
+		// Onion addresses can be resolved only by Tor.
+		rt.torDialer, err = smtpconn.ProxyDialer(torProxy, rt.dialer, true, nil)
+		if err != nil {
+			return fmt.Errorf("remote: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -295,6 +321,19 @@ func (rd *remoteDelivery) AddRcpt(ctx context.Context, to string) error {
 		}
 	}
 
+	// Use the A-label form so MX lookups work and equivalent domains share
+	// the connection.
+	domain, err = dns.ToASCII(domain)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 2},
+			Message:      "Malformed recipient domain",
+			TargetName:   "remote",
+			Err:          err,
+		}
+	}
+
 	conn, err := rd.connectionForDomain(ctx, domain)
 	if err != nil {
 		return err
@@ -52,15 +52,16 @@ func testTarget(t *testing.T, zones map[string]mockdns.Zone, extResolver *dns.Ex
 	resolver := &mockdns.Resolver{Zones: zones}
 
 	tgt := Target{
-		name:        "remote",
-		hostname:    "mx.example.com",
-		resolver:    resolver,
-		dialer:      resolver.DialContext,
-		extResolver: extResolver,
-		tlsConfig:   &tls.Config{},
-		Log:         testutils.Logger(t, "remote"),
-		policies:    extraPolicies,
-		limits:      &limits.Group{},
+		name:         "remote",
+		hostname:     "mx.example.com",
+		resolver:     resolver,
+		dialer:       resolver.DialContext,
+		extResolver:  extResolver,
+		tlsConfig:    &tls.Config{},
+		Log:          testutils.Logger(t, "remote"),
+		policies:     extraPolicies,
+		limits:       &limits.Group{},
+		preferFamily: familySystem,
 		pool: pool.New(pool.Config{
 			MaxKeys:             20000,
 			MaxConnsPerKey:      10,     // basically, max. amount of idle connections in cache
@@ -0,0 +1,238 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sink implements target.sink module that accepts messages without
+// delivering them anywhere.
+//
+// It is intended for testing of the server configuration. Depending on the
+// mode, messages are discarded, kept in memory for inspection via the
+// control endpoint or rejected.
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.sink"
+
+const (
+	modeDiscard  = "discard"
+	modeCapture  = "capture"
+	modeFail     = "fail"
+	modeTempFail = "tempfail"
+)
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	mode     string
+	capacity int
+
+	capturedLock sync.Mutex
+	captured     []control.CapturedMessage
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	t := &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		t.mode = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: at most one argument accepted", modName)
+	}
+
+	return t, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	if t.mode == "" {
+		t.mode = modeDiscard
+	}
+
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Enum("mode", false, false,
+		[]string{modeDiscard, modeCapture, modeFail, modeTempFail}, t.mode, &t.mode)
+	cfg.Int("capacity", false, false, 100, &t.capacity)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	switch t.mode {
+	case modeDiscard, modeCapture, modeFail, modeTempFail:
+	default:
+		return fmt.Errorf("%s: unknown mode: %s", modName, t.mode)
+	}
+	if t.capacity <= 0 {
+		return fmt.Errorf("%s: capacity should be positive", modName)
+	}
+
+	if t.mode == modeCapture && t.instName != "" {
+		control.RegisterSink(t.instName, t)
+	}
+	return nil
+}
+
+func (t *Target) Close() error {
+	if t.mode == modeCapture && t.instName != "" {
+		control.UnregisterSink(t.instName)
+	}
+	return nil
+}
+
+// Captured returns messages stored in the capture mode.
+func (t *Target) Captured() []control.CapturedMessage {
+	t.capturedLock.Lock()
+	defer t.capturedLock.Unlock()
+	return append([]control.CapturedMessage(nil), t.captured...)
+}
+
+func (t *Target) ClearCaptured() int {
+	t.capturedLock.Lock()
+	defer t.capturedLock.Unlock()
+	n := len(t.captured)
+	t.captured = nil
+	return n
+}
+
+func (t *Target) capture(msg control.CapturedMessage) {
+	t.capturedLock.Lock()
+	defer t.capturedLock.Unlock()
+	// Oldest messages are dropped once the capacity is reached.
+	if len(t.captured) >= t.capacity {
+		t.captured = append(t.captured[:0], t.captured[len(t.captured)-t.capacity+1:]...)
+	}
+	t.captured = append(t.captured, msg)
+}
+
+type delivery struct {
+	t   *Target
+	log log.Logger
+
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	rcpts    []string
+	data     []byte
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	switch d.t.mode {
+	case modeFail:
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 0, 0},
+			Message:      "Recipient rejected by the sink target",
+			TargetName:   modName,
+		}
+	case modeTempFail:
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 0, 0},
+			Message:      "Recipient temporarily rejected by the sink target",
+			TargetName:   modName,
+		}
+	}
+
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if d.t.mode != modeCapture {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, header); err != nil {
+		return err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+	d.data = buf.Bytes()
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	if d.t.mode != modeCapture {
+		d.log.Msg("discarded", "rcpts", d.rcpts)
+		return nil
+	}
+
+	d.t.capture(control.CapturedMessage{
+		ID:       d.msgMeta.ID,
+		Received: time.Now(),
+		From:     d.mailFrom,
+		To:       d.rcpts,
+		Data:     string(d.data),
+	})
+	d.log.Msg("captured", "rcpts", d.rcpts)
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,128 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sink
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTarget(t *testing.T, mode string, capacity int) *Target {
+	t.Helper()
+
+	mod, err := New(modName, "test_sink", nil, []string{mode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt := mod.(*Target)
+	err = tgt.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "capacity", Args: []string{strconv.Itoa(capacity)}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tgt.Close() })
+	tgt.log = testutils.Logger(t, modName)
+	return tgt
+}
+
+func TestSink_Capture(t *testing.T) {
+	tgt := testTarget(t, modeCapture, 2)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+
+	msgs := tgt.Captured()
+	if len(msgs) != 1 {
+		t.Fatalf("wrong amount of captured messages: %d", len(msgs))
+	}
+	if msgs[0].From != "sender@example.org" || len(msgs[0].To) != 2 {
+		t.Fatalf("wrong envelope: %+v", msgs[0])
+	}
+	if msgs[0].Data != "A: 1\r\nB: 2\r\n\r\nfoobar\r\n" {
+		t.Fatalf("wrong message text: %q", msgs[0].Data)
+	}
+
+	sink, ok := control.GetSink("test_sink")
+	if !ok {
+		t.Fatal("sink is not registered")
+	}
+	if len(sink.Captured()) != 1 {
+		t.Fatal("wrong amount of messages returned via control registry")
+	}
+}
+
+func TestSink_CaptureCapacity(t *testing.T) {
+	tgt := testTarget(t, modeCapture, 2)
+
+	for _, rcpt := range []string{"rcpt1@example.org", "rcpt2@example.org", "rcpt3@example.org"} {
+		testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{rcpt})
+	}
+
+	msgs := tgt.Captured()
+	if len(msgs) != 2 {
+		t.Fatalf("wrong amount of captured messages: %d", len(msgs))
+	}
+	if msgs[0].To[0] != "rcpt2@example.org" || msgs[1].To[0] != "rcpt3@example.org" {
+		t.Fatalf("oldest message should be dropped: %+v", msgs)
+	}
+
+	if n := tgt.ClearCaptured(); n != 2 {
+		t.Fatal("wrong amount of cleared messages:", n)
+	}
+	if len(tgt.Captured()) != 0 {
+		t.Fatal("messages are not cleared")
+	}
+}
+
+func TestSink_Discard(t *testing.T) {
+	tgt := testTarget(t, modeDiscard, 1)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt@example.org"})
+
+	if len(tgt.Captured()) != 0 {
+		t.Fatal("message should not be captured")
+	}
+	if _, ok := control.GetSink("test_sink"); ok {
+		t.Fatal("discarding sink should not be registered")
+	}
+}
+
+func TestSink_Fail(t *testing.T) {
+	for mode, temporary := range map[string]bool{modeFail: false, modeTempFail: true} {
+		mode, temporary := mode, temporary
+		t.Run(mode, func(t *testing.T) {
+			tgt := testTarget(t, mode, 1)
+
+			_, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.org", []string{"rcpt@example.org"})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if exterrors.IsTemporary(err) != temporary {
+				t.Fatal("wrong temporary flag:", exterrors.IsTemporary(err))
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// connectProxy is a minimal HTTP CONNECT proxy that forwards all
+// connections to the fixed address.
+type connectProxy struct {
+	l      net.Listener
+	target string
+
+	lck       sync.Mutex
+	requested []string
+	auth      []string
+}
+
+func newConnectProxy(t *testing.T, target string) *connectProxy {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &connectProxy{l: l, target: target}
+	go p.serve()
+	return p
+}
+
+func (p *connectProxy) serve() {
+	for {
+		conn, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *connectProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	p.lck.Lock()
+	p.requested = append(p.requested, req.Host)
+	p.auth = append(p.auth, req.Header.Get("Proxy-Authorization"))
+	p.lck.Unlock()
+
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, br)
+		upstream.Close()
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+	<-done
+}
+
+func (p *connectProxy) Close() error {
+	return p.l.Close()
+}
+
+func TestDownstreamDelivery_HTTPProxy(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	p := newConnectProxy(t, "127.0.0.1:"+testPort)
+	defer p.Close()
+
+	resolver := &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"mx.example.invalid.": {A: []string{"127.0.0.1"}},
+	}}
+
+	for _, remoteDNS := range []bool{true, false} {
+		proxyURL := &url.URL{Scheme: "http", Host: p.l.Addr().String(), User: url.UserPassword("user", "pass")}
+		dialer, err := smtpconn.ProxyDialer(proxyURL, (&net.Dialer{}).DialContext, remoteDNS, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mod := &Downstream{
+			hostname: "mx.example.invalid",
+			endpoints: []config.Endpoint{
+				{
+					Scheme: "tcp",
+					Host:   "mx.example.invalid",
+					Port:   testPort,
+				},
+			},
+			dialer: dialer,
+			log:    testutils.Logger(t, "target.smtp"),
+		}
+
+		testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+		be.CheckMsg(t, len(be.Messages)-1, "test@example.invalid", []string{"rcpt@example.invalid"})
+	}
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	if len(p.requested) != 2 {
+		t.Fatal("Wrong amount of proxy requests:", p.requested)
+	}
+	if p.requested[0] != "mx.example.invalid:"+testPort {
+		t.Error("Host name is not passed to the proxy with remote DNS:", p.requested[0])
+	}
+	if p.requested[1] != "127.0.0.1:"+testPort {
+		t.Error("Host name is not resolved locally:", p.requested[1])
+	}
+	// "user:pass"
+	if p.auth[0] != "Basic dXNlcjpwYXNz" {
+		t.Error("Wrong Proxy-Authorization:", p.auth[0])
+	}
+}
@@ -32,7 +32,10 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"runtime/trace"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -40,10 +43,12 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/net/idna"
 )
@@ -60,14 +65,68 @@ type Downstream struct {
 	endpoints       []config.Endpoint
 	saslFactory     saslClientFactory
 	tlsConfig       tls.Config
+	downgrade8Bit   bool
 
 	connectTimeout    time.Duration
 	commandTimeout    time.Duration
 	submissionTimeout time.Duration
+	dialer            func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Connection reuse is disabled if pool is nil.
+	maxReuse int
+	pool     *pool.P
 
 	log log.Logger
 }
 
+// pooledConn is a connection that can be used for multiple transactions.
+type pooledConn struct {
+	*smtpconn.C
+
+	// Maximum amount of transactions, taking server limits into account.
+	maxTransactions int
+	transactions    int
+	errored         bool
+}
+
+func (c *pooledConn) exhausted() bool {
+	return c.C.Client() == nil || c.errored || c.transactions >= c.maxTransactions
+}
+
+// Usable is called by the pool before reusing the connection. Connections
+// that can't be used anymore are closed.
+func (c *pooledConn) Usable() bool {
+	if c.C.Client() == nil {
+		return false
+	}
+	if c.exhausted() || c.C.Client().Reset() != nil {
+		c.C.Close()
+		return false
+	}
+	return true
+}
+
+// serverMailMax returns the MAILMAX value from the LIMITS extension
+// (RFC 9422) advertised by the server, if any.
+func serverMailMax(c *smtpconn.C) int {
+	ok, params := c.Client().Extension("LIMITS")
+	if !ok {
+		return 0
+	}
+	for _, param := range strings.Fields(params) {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "MAILMAX") {
+			continue
+		}
+		val, err := strconv.Atoi(parts[1])
+		if err != nil || val <= 0 {
+			return 0
+		}
+		return val
+	}
+	return 0
+}
+
 func (u *Downstream) moduleError(err error) error {
 	if err == nil {
 		return nil
@@ -89,7 +148,17 @@ func NewDownstream(modName, instName string, _, inlineArgs []string) (module.Mod
 }
 
 func (u *Downstream) Init(cfg *config.Map) error {
-	var targetsArg []string
+	var (
+		targetsArg     []string
+		idleTimeout    time.Duration
+		happyEyeballs  bool
+		fallbackDelay  time.Duration
+		proxyURL       *url.URL
+		proxyRemoteDNS bool
+		fallback8Bit   string
+		maxIdleConns   int
+		perMsgAuth     bool
+	)
 	cfg.Bool("debug", true, false, &u.log.Debug)
 	cfg.Bool("require_tls", false, false, &u.requireTLS)
 	cfg.Bool("attempt_starttls", false, !u.lmtp, &u.attemptStartTLS)
@@ -97,17 +166,55 @@ func (u *Downstream) Init(cfg *config.Map) error {
 	cfg.StringList("targets", false, false, nil, &targetsArg)
 	cfg.Custom("auth", false, false, func() (interface{}, error) {
 		return nil, nil
-	}, saslAuthDirective, &u.saslFactory)
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		// Connections authenticated using the credentials of the message
+		// author can't be shared between messages.
+		perMsgAuth = len(node.Args) != 0 && node.Args[0] == "forward"
+		return saslAuthDirective(m, node)
+	}, &u.saslFactory)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return tls.Config{}, nil
 	}, tls2.TLSClientBlock, &u.tlsConfig)
 	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &u.connectTimeout)
 	cfg.Duration("command_timeout", false, false, 5*time.Minute, &u.commandTimeout)
 	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &u.submissionTimeout)
+	cfg.Int("max_reuse", false, false, 1, &u.maxReuse)
+	cfg.Int("conn_max_idle_count", false, false, 10, &maxIdleConns)
+	cfg.Duration("idle_timeout", false, false, 150*time.Second, &idleTimeout)
+	cfg.Bool("happy_eyeballs", false, true, &happyEyeballs)
+	cfg.Duration("fallback_delay", false, false, 300*time.Millisecond, &fallbackDelay)
+	cfg.Custom("proxy", false, false, nil, smtpconn.ProxyDirective, &proxyURL)
+	cfg.Bool("proxy_remote_dns", false, true, &proxyRemoteDNS)
+	cfg.Enum("8bitmime_fallback", false, false, []string{"downgrade", "defer"}, "downgrade", &fallback8Bit)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	u.downgrade8Bit = fallback8Bit == "downgrade"
+
+	// net.Dialer already races connections to IPv4 and IPv6 addresses of
+	// the server (RFC 8305) by default, the directives only allow to tune
+	// the delay or to disable it by using a negative FallbackDelay.
+	if !happyEyeballs {
+		fallbackDelay = -1
+	}
+	u.dialer = (&net.Dialer{FallbackDelay: fallbackDelay}).DialContext
+	if proxyURL != nil {
+		var err error
+		u.dialer, err = smtpconn.ProxyDialer(proxyURL, u.dialer, proxyRemoteDNS, dns.DefaultResolver())
+		if err != nil {
+			return fmt.Errorf("%s: %w", u.modName, err)
+		}
+	}
+
+	if u.maxReuse > 1 && !perMsgAuth {
+		u.pool = pool.New(pool.Config{
+			MaxKeys:             1,
+			MaxConnsPerKey:      maxIdleConns,
+			MaxConnLifetimeSec:  int64(idleTimeout / time.Second),
+			StaleKeyLifetimeSec: int64(idleTimeout/time.Second) * 2,
+		})
+	}
 
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	var err error
@@ -141,6 +248,13 @@ func (u *Downstream) InstanceName() string {
 	return u.instName
 }
 
+func (u *Downstream) Close() error {
+	if u.pool != nil {
+		u.pool.Close()
+	}
+	return nil
+}
+
 type delivery struct {
 	u   *Downstream
 	log log.Logger
@@ -149,7 +263,8 @@ type delivery struct {
 	mailFrom string
 	rcpts    []string
 
-	conn *smtpconn.C
+	conn   *pooledConn
+	reused bool
 }
 
 // lmtpDelivery implements module.PartialDelivery
@@ -166,13 +281,26 @@ func (u *Downstream) Start(ctx context.Context, msgMeta *module.MsgMetadata, mai
 		msgMeta:  msgMeta,
 		mailFrom: mailFrom,
 	}
-	if err := d.connect(ctx); err != nil {
+	if err := d.connect(ctx, true); err != nil {
 		return nil, err
 	}
 
 	if err := d.conn.Mail(ctx, mailFrom, msgMeta.SMTPOpts); err != nil {
 		d.conn.Close()
-		return nil, err
+		if !d.reused {
+			return nil, err
+		}
+
+		// Cached connection might have been closed by the server, try
+		// again using a new one.
+		d.log.Msg("cached connection failed, reconnecting", "reason", err)
+		if err := d.connect(ctx, false); err != nil {
+			return nil, err
+		}
+		if err := d.conn.Mail(ctx, mailFrom, msgMeta.SMTPOpts); err != nil {
+			d.conn.Close()
+			return nil, err
+		}
 	}
 
 	if u.lmtp {
@@ -182,14 +310,32 @@ func (u *Downstream) Start(ctx context.Context, msgMeta *module.MsgMetadata, mai
 	return d, nil
 }
 
-func (d *delivery) connect(ctx context.Context) error {
-	// TODO: Review possibility of connection pooling here.
+// connect sets d.conn to the connection to the downstream server. If
+// useCache is true, a cached connection is used if available.
+func (d *delivery) connect(ctx context.Context, useCache bool) error {
+	d.reused = false
+	if useCache && d.u.pool != nil {
+		cached, err := d.u.pool.Get(ctx, "")
+		if err != nil {
+			return err
+		}
+		if cached != nil {
+			d.conn = cached.(*pooledConn)
+			d.conn.Log = d.log
+			d.reused = true
+			d.log.DebugMsg("reusing cached connection", "downstream_server", d.conn.ServerName(),
+				"transactions_counter", d.conn.transactions)
+			return nil
+		}
+	}
+
 	var lastErr error
 
 	conn := smtpconn.New()
 	conn.Log = d.log
 	conn.Hostname = d.u.hostname
 	conn.AddrInSMTPMsg = false
+	conn.Downgrade8Bit = d.u.downgrade8Bit
 	if d.u.connectTimeout != 0 {
 		conn.ConnectTimeout = d.u.connectTimeout
 	}
@@ -199,6 +345,9 @@ func (d *delivery) connect(ctx context.Context) error {
 	if d.u.submissionTimeout != 0 {
 		conn.SubmissionTimeout = d.u.submissionTimeout
 	}
+	if d.u.dialer != nil {
+		conn.Dialer = d.u.dialer
+	}
 
 	for _, endp := range d.u.endpoints {
 		var (
@@ -246,7 +395,13 @@ func (d *delivery) connect(ctx context.Context) error {
 		}
 	}
 
-	d.conn = conn
+	d.conn = &pooledConn{
+		C:               conn,
+		maxTransactions: d.u.maxReuse,
+	}
+	if mailMax := serverMailMax(conn); mailMax != 0 && mailMax < d.conn.maxTransactions {
+		d.conn.maxTransactions = mailMax
+	}
 
 	return nil
 }
@@ -269,7 +424,12 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	}
 
 	defer r.Close()
-	return d.u.moduleError(d.conn.Data(ctx, header, r))
+	if err := d.conn.Data(ctx, header, r); err != nil {
+		// Connection may be in the middle of the message data stream.
+		d.conn.errored = true
+		return d.u.moduleError(err)
+	}
+	return nil
 }
 
 func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
@@ -298,6 +458,7 @@ func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollec
 		rcptIndx++
 	})
 	if err != nil {
+		d.conn.errored = true
 		modErr := d.u.moduleError(err)
 		for _, rcpt := range d.rcpts[rcptIndx:] {
 			sc.SetStatus(rcpt, modErr)
@@ -305,13 +466,26 @@ func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollec
 	}
 }
 
+// release returns the connection to the cache or closes it if it can't be
+// reused.
+func (d *delivery) release() error {
+	d.conn.transactions++
+	if d.u.pool == nil || d.conn.exhausted() {
+		return d.conn.Close()
+	}
+
+	d.log.DebugMsg("returning connection to cache", "downstream_server", d.conn.ServerName())
+	d.u.pool.Return("", d.conn)
+	return nil
+}
+
 func (d *delivery) Abort(ctx context.Context) error {
-	d.conn.Close()
+	d.release()
 	return nil
 }
 
 func (d *delivery) Commit(ctx context.Context) error {
-	return d.conn.Close()
+	return d.release()
 }
 
 func init() {
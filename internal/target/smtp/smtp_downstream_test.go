@@ -30,6 +30,7 @@ import (
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -301,6 +302,41 @@ func TestDownstreamDelivery_RequireTLS_Fail(t *testing.T) {
 	}
 }
 
+func TestDownstreamDelivery_Reuse(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		maxReuse: 2,
+		pool: pool.New(pool.Config{
+			MaxKeys:             1,
+			MaxConnsPerKey:      10,
+			MaxConnLifetimeSec:  150,
+			StaleKeyLifetimeSec: 300,
+		}),
+		log: testutils.Logger(t, "target.smtp"),
+	}
+	defer mod.Close()
+
+	for i := 0; i < 3; i++ {
+		testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt" + strconv.Itoa(i) + "@example.invalid"})
+		be.CheckMsg(t, i, "test@example.invalid", []string{"rcpt" + strconv.Itoa(i) + "@example.invalid"})
+	}
+
+	if len(be.SourceEndpoints) != 2 {
+		t.Fatal("Expected 2 connections to be used, got", len(be.SourceEndpoints))
+	}
+}
+
 func TestMain(m *testing.M) {
 	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
 	flag.Parse()
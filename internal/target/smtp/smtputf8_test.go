@@ -47,6 +47,7 @@ func TestDownstreamDelivery_EHLO_ALabel(t *testing.T) {
 
 	tgt := mod.(*Downstream)
 	tgt.log = testutils.Logger(t, "remote")
+	defer tgt.Close()
 
 	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
 
@@ -0,0 +1,400 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package webhook implements target.webhook module that delivers messages
+// to an HTTP endpoint as JSON documents.
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.webhook"
+
+// Payload is the JSON document sent to the webhook.
+type Payload struct {
+	ID       string   `json:"id"`
+	MailFrom string   `json:"mail_from"`
+	RcptTo   []string `json:"rcpt_to"`
+
+	From      []string   `json:"from,omitempty"`
+	To        []string   `json:"to,omitempty"`
+	Cc        []string   `json:"cc,omitempty"`
+	Subject   string     `json:"subject"`
+	Date      *time.Time `json:"date,omitempty"`
+	MessageID string     `json:"message_id,omitempty"`
+
+	Text string `json:"text,omitempty"`
+	HTML string `json:"html,omitempty"`
+
+	Attachments []Attachment `json:"attachments"`
+
+	// Base64-encoded message, only if include_raw is enabled.
+	Raw []byte `json:"raw,omitempty"`
+}
+
+// Attachment describes a message attachment. The attachment contents are
+// not included in the payload.
+type Attachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+type Target struct {
+	modName  string
+	instName string
+
+	url        string
+	authHeader string
+	maxTries   int
+	retryDelay time.Duration
+	includeRaw bool
+
+	cl  *http.Client
+	log log.Logger
+}
+
+func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	t := &Target{
+		modName:  modName,
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		t.url = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: at most one argument accepted", modName)
+	}
+
+	return t, nil
+}
+
+func (t *Target) Name() string {
+	return t.modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var timeout time.Duration
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.String("url", false, false, t.url, &t.url)
+	cfg.String("auth_header", false, false, "", &t.authHeader)
+	cfg.Duration("timeout", false, false, 30*time.Second, &timeout)
+	cfg.Int("max_tries", false, false, 3, &t.maxTries)
+	cfg.Duration("retry_delay", false, false, time.Second, &t.retryDelay)
+	cfg.Bool("include_raw", false, false, &t.includeRaw)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.url == "" {
+		return fmt.Errorf("%s: url is required", t.modName)
+	}
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return fmt.Errorf("%s: malformed url: %v", t.modName, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s: unsupported url scheme: %s", t.modName, u.Scheme)
+	}
+	if t.maxTries < 1 {
+		return fmt.Errorf("%s: max_tries should be at least 1", t.modName)
+	}
+
+	t.cl = &http.Client{
+		Timeout: timeout,
+	}
+
+	return nil
+}
+
+type delivery struct {
+	t   *Target
+	log log.Logger
+
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	rcpts    []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	payload, err := d.t.buildPayload(d.msgMeta, d.mailFrom, d.rcpts, header, body)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"target": d.t.modName})
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"target": d.t.modName})
+	}
+
+	delay := d.t.retryDelay
+	for i := 1; ; i++ {
+		err = d.t.post(ctx, payloadBytes)
+		if err == nil || !exterrors.IsTemporary(err) || i >= d.t.maxTries {
+			return err
+		}
+
+		d.log.Error("webhook request failed, retrying", err, "attempt", i)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (t *Target) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if t.authHeader != "" {
+		req.Header.Set("Authorization", t.authHeader)
+	}
+
+	resp, err := t.cl.Do(req)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 1},
+			Message:      "Webhook is unavailable",
+			TargetName:   t.modName,
+			Err:          err,
+		}
+	}
+	defer resp.Body.Close()
+	// Read some of the body to allow connection reuse.
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	return t.statusErr(resp)
+}
+
+// statusErr maps the webhook response status to the SMTP error.
+func (t *Target) statusErr(resp *http.Response) error {
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Webhook processing failed, try again later",
+			TargetName:   t.modName,
+			Err:          errors.New(resp.Status),
+			Misc:         map[string]interface{}{"http_status": resp.StatusCode},
+		}
+	default:
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 0},
+			Message:      "Message rejected by the webhook",
+			TargetName:   t.modName,
+			Err:          errors.New(resp.Status),
+			Misc:         map[string]interface{}{"http_status": resp.StatusCode},
+		}
+	}
+}
+
+func addressList(h mail.Header, key string) []string {
+	if !h.Has(key) {
+		return nil
+	}
+	addrs, err := h.AddressList(key)
+	if err != nil {
+		// Pass the field value as is.
+		return []string{h.Get(key)}
+	}
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, addr.String())
+	}
+	return list
+}
+
+func (t *Target) buildPayload(msgMeta *module.MsgMetadata, mailFrom string, rcpts []string, header textproto.Header, body buffer.Buffer) (*Payload, error) {
+	payload := &Payload{
+		ID:          msgMeta.ID,
+		MailFrom:    mailFrom,
+		RcptTo:      rcpts,
+		Attachments: []Attachment{},
+	}
+
+	mailHdr := mail.Header{Header: message.Header{Header: header}}
+	payload.From = addressList(mailHdr, "From")
+	payload.To = addressList(mailHdr, "To")
+	payload.Cc = addressList(mailHdr, "Cc")
+	payload.Subject, _ = mailHdr.Subject()
+	if mailHdr.Has("Date") {
+		if date, err := mailHdr.Date(); err == nil {
+			payload.Date = &date
+		}
+	}
+	payload.MessageID, _ = mailHdr.MessageID()
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, header); err != nil {
+		return nil, err
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyR.Close()
+
+	var raw bytes.Buffer
+	var msgR io.Reader = io.MultiReader(&hdrBuf, bodyR)
+	if t.includeRaw {
+		msgR = io.TeeReader(msgR, &raw)
+	}
+
+	if err := t.readParts(payload, msgR); err != nil {
+		// Body structure is not essential for delivery, send what we have.
+		t.log.Error("failed to parse message body", err, "msg_id", msgMeta.ID)
+	}
+
+	if t.includeRaw {
+		// Make sure the rest of message is read if parsing stopped early.
+		if _, err := io.Copy(ioutil.Discard, msgR); err != nil {
+			return nil, err
+		}
+		payload.Raw = raw.Bytes()
+	}
+
+	return payload, nil
+}
+
+func (t *Target) readParts(payload *Payload, msgR io.Reader) error {
+	mr, err := mail.CreateReader(msgR)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			return err
+		}
+
+		switch h := part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ := h.ContentType()
+			if contentType != "text/plain" && contentType != "text/html" && contentType != "" {
+				if err := addAttachment(payload, part.Body, "", contentType); err != nil {
+					return err
+				}
+				continue
+			}
+
+			text, err := ioutil.ReadAll(part.Body)
+			if err != nil {
+				return err
+			}
+			if contentType == "text/html" {
+				payload.HTML += string(text)
+			} else {
+				payload.Text += string(text)
+			}
+		case *mail.AttachmentHeader:
+			filename, _ := h.Filename()
+			contentType, _, _ := h.ContentType()
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			if err := addAttachment(payload, part.Body, filename, contentType); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func addAttachment(payload *Payload, body io.Reader, filename, contentType string) error {
+	size, err := io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return err
+	}
+	payload.Attachments = append(payload.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: strings.ToLower(contentType),
+		Size:        size,
+	})
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testMsg = "From: Tester <tester@example.org>\r\n" +
+	"To: a@example.com, b@example.com\r\n" +
+	"Subject: =?utf-8?q?Hello=2C_world?=\r\n" +
+	"Message-ID: <123@example.org>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=BOUNDARY\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi!\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=report.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAECAwQ=\r\n" +
+	"--BOUNDARY--\r\n"
+
+func testTarget(t *testing.T, url string, opts ...config.Node) *Target {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, []string{url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt := mod.(*Target)
+	if err := tgt.Init(config.NewMap(nil, config.Node{Children: opts})); err != nil {
+		t.Fatal(err)
+	}
+	tgt.log = testutils.Logger(t, modName)
+	return tgt
+}
+
+func deliver(t *testing.T, tgt *Target, rawMsg string) error {
+	t.Helper()
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(rawMsg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := rawMsg[strings.Index(rawMsg, "\r\n\r\n")+4:]
+
+	ctx := context.Background()
+	delivery, err := tgt.Start(ctx, &module.MsgMetadata{ID: "test"}, "tester@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"a@example.com", "b@example.com"} {
+		if err := delivery.AddRcpt(ctx, rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte(body)}); err != nil {
+		if err := delivery.Abort(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func TestWebhook_Payload(t *testing.T) {
+	var payload Payload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	tgt := testTarget(t, srv.URL,
+		config.Node{Name: "auth_header", Args: []string{"Bearer secret"}},
+		config.Node{Name: "include_raw", Args: []string{"yes"}})
+	if err := deliver(t, tgt, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.ID != "test" || payload.MailFrom != "tester@example.org" || len(payload.RcptTo) != 2 {
+		t.Errorf("wrong envelope: %+v", payload)
+	}
+	if len(payload.From) != 1 || payload.From[0] != `"Tester" <tester@example.org>` {
+		t.Errorf("wrong From: %v", payload.From)
+	}
+	if len(payload.To) != 2 {
+		t.Errorf("wrong To: %v", payload.To)
+	}
+	if payload.Subject != "Hello, world" || payload.MessageID != "123@example.org" {
+		t.Errorf("wrong Subject or Message-ID: %q, %q", payload.Subject, payload.MessageID)
+	}
+	if payload.Text != "Hi!" {
+		t.Errorf("wrong text: %q", payload.Text)
+	}
+	if len(payload.Attachments) != 1 {
+		t.Fatalf("wrong attachments: %+v", payload.Attachments)
+	}
+	if att := payload.Attachments[0]; att.Filename != "report.pdf" || att.ContentType != "application/pdf" || att.Size != 5 {
+		t.Errorf("wrong attachment: %+v", att)
+	}
+	if !bytes.Equal(payload.Raw, []byte(testMsg)) {
+		t.Errorf("wrong raw message: %q", payload.Raw)
+	}
+}
+
+func TestWebhook_Status(t *testing.T) {
+	var hits int32
+	status := int32(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	tgt := testTarget(t, srv.URL, config.Node{Name: "retry_delay", Args: []string{"1ms"}})
+
+	// Temporary errors are retried.
+	if err := deliver(t, tgt, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if hits != 3 {
+		t.Fatal("wrong amount of requests:", hits)
+	}
+
+	// Permanent errors are not.
+	atomic.StoreInt32(&hits, 0)
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	err := deliver(t, tgt, testMsg)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if exterrors.IsTemporary(err) {
+		t.Fatal("expected permanent error, got", err)
+	}
+	if hits != 1 {
+		t.Fatal("wrong amount of requests:", hits)
+	}
+
+	// Amount of attempts is limited.
+	atomic.StoreInt32(&hits, -10)
+	atomic.StoreInt32(&status, http.StatusTooManyRequests)
+	err = deliver(t, tgt, testMsg)
+	if err == nil || !exterrors.IsTemporary(err) {
+		t.Fatal("expected temporary error, got", err)
+	}
+	if hits != -7 {
+		t.Fatal("wrong amount of requests:", hits)
+	}
+}
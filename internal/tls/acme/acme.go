@@ -134,6 +134,11 @@ func (l *Loader) ConfigureTLS(c *tls.Config) error {
 }
 
 func (l *Loader) Close() error {
+	if l.cancelManage == nil {
+		// Not started due to module.NoRun.
+		l.cache.Stop()
+		return nil
+	}
 	l.cancelManage()
 	l.cache.Stop()
 	return nil
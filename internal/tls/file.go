@@ -55,35 +55,49 @@ func NewFileLoader(_, instName string, _, inlineArgs []string) (module.Module, e
 	}, nil
 }
 
-func (f *FileLoader) Init(cfg *config.Map) error {
-	cfg.StringList("certs", false, false, nil, &f.certPaths)
-	cfg.StringList("keys", false, false, nil, &f.keyPaths)
+func (f *FileLoader) readPaths(cfg *config.Map) (certPaths, keyPaths []string, err error) {
+	cfg.StringList("certs", false, false, nil, &certPaths)
+	cfg.StringList("keys", false, false, nil, &keyPaths)
 	if _, err := cfg.Process(); err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	if len(f.certPaths) != len(f.keyPaths) {
-		return errors.New("tls.loader.file: mismatch in certs and keys count")
+	if len(certPaths) != len(keyPaths) {
+		return nil, nil, errors.New("tls.loader.file: mismatch in certs and keys count")
 	}
 
 	if len(f.inlineArgs)%2 != 0 {
-		return errors.New("tls.loader.file: odd amount of arguments")
+		return nil, nil, errors.New("tls.loader.file: odd amount of arguments")
 	}
 	for i := 0; i < len(f.inlineArgs); i += 2 {
-		f.certPaths = append(f.certPaths, f.inlineArgs[i])
-		f.keyPaths = append(f.keyPaths, f.inlineArgs[i+1])
+		certPaths = append(certPaths, f.inlineArgs[i])
+		keyPaths = append(keyPaths, f.inlineArgs[i+1])
 	}
 
-	for _, certPath := range f.certPaths {
+	for _, certPath := range certPaths {
 		if !filepath.IsAbs(certPath) {
-			return fmt.Errorf("tls.loader.file: only absolute paths allowed in certificate paths: sorry :(")
+			return nil, nil, fmt.Errorf("tls.loader.file: only absolute paths allowed in certificate paths: sorry :(")
 		}
 	}
 
+	return certPaths, keyPaths, nil
+}
+
+func (f *FileLoader) Init(cfg *config.Map) error {
+	var err error
+	f.certPaths, f.keyPaths, err = f.readPaths(cfg)
+	if err != nil {
+		return err
+	}
+
 	if err := f.loadCerts(); err != nil {
 		return err
 	}
 
+	if module.NoRun {
+		return nil
+	}
+
 	hooks.AddHook(hooks.EventReload, func() {
 		f.log.Println("reloading certificates")
 		if err := f.loadCerts(); err != nil {
@@ -97,6 +111,9 @@ func (f *FileLoader) Init(cfg *config.Map) error {
 }
 
 func (f *FileLoader) Close() error {
+	if f.reloadTick == nil {
+		return nil
+	}
 	f.reloadTick.Stop()
 	f.stopTick <- struct{}{}
 	return nil
@@ -124,26 +141,36 @@ func (f *FileLoader) reloadTicker() {
 	}
 }
 
-func (f *FileLoader) loadCerts() error {
-	if len(f.certPaths) != len(f.keyPaths) {
-		return errors.New("mismatch in certs and keys count")
+// Reload replaces the set of used certificates. Previously loaded
+// certificates are kept if any of new ones can't be loaded.
+func (f *FileLoader) Reload(cfg *config.Map) error {
+	certPaths, keyPaths, err := f.readPaths(cfg)
+	if err != nil {
+		return err
 	}
 
-	if len(f.certPaths) == 0 {
-		return errors.New("tls.loader.file: at least one certificate required")
+	certs, err := loadCertsFrom(certPaths, keyPaths)
+	if err != nil {
+		return err
 	}
 
-	certs := make([]tls.Certificate, 0, len(f.certPaths))
+	f.certsLock.Lock()
+	defer f.certsLock.Unlock()
+	f.certPaths = certPaths
+	f.keyPaths = keyPaths
+	f.certs = certs
 
-	for i := range f.certPaths {
-		certPath := f.certPaths[i]
-		keyPath := f.keyPaths[i]
+	return nil
+}
 
-		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-		if err != nil {
-			return fmt.Errorf("failed to load %s and %s: %v", certPath, keyPath, err)
-		}
-		certs = append(certs, cert)
+func (f *FileLoader) loadCerts() error {
+	f.certsLock.RLock()
+	certPaths, keyPaths := f.certPaths, f.keyPaths
+	f.certsLock.RUnlock()
+
+	certs, err := loadCertsFrom(certPaths, keyPaths)
+	if err != nil {
+		return err
 	}
 
 	f.certsLock.Lock()
@@ -153,6 +180,31 @@ func (f *FileLoader) loadCerts() error {
 	return nil
 }
 
+func loadCertsFrom(certPaths, keyPaths []string) ([]tls.Certificate, error) {
+	if len(certPaths) != len(keyPaths) {
+		return nil, errors.New("mismatch in certs and keys count")
+	}
+
+	if len(certPaths) == 0 {
+		return nil, errors.New("tls.loader.file: at least one certificate required")
+	}
+
+	certs := make([]tls.Certificate, 0, len(certPaths))
+
+	for i := range certPaths {
+		certPath := certPaths[i]
+		keyPath := keyPaths[i]
+
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s and %s: %v", certPath, keyPath, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
 func (f *FileLoader) ConfigureTLS(c *tls.Config) error {
 	// Loader function replaces only the whole slice.
 	f.certsLock.RLock()
@@ -0,0 +1,109 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pubsub
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/lib/pq"
+)
+
+// PqPubSub implements PubSub using PostgreSQL LISTEN/NOTIFY.
+//
+// Payloads are limited to 8000 bytes by PostgreSQL.
+type PqPubSub struct {
+	Notify chan Msg
+
+	L      *pq.Listener
+	sender *sql.DB
+
+	Log log.Logger
+}
+
+// NewPQ creates the PqPubSub for the database specified by dsn.
+//
+// Logger is passed here since it is used by the listener goroutine started
+// by NewPQ.
+func NewPQ(dsn string, logger log.Logger) (*PqPubSub, error) {
+	l := &PqPubSub{
+		Log:    logger,
+		Notify: make(chan Msg),
+	}
+	l.L = pq.NewListener(dsn, 10*time.Second, time.Minute, l.eventHandler)
+	var err error
+	l.sender, err = sql.Open("postgres", dsn)
+	if err != nil {
+		l.L.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer close(l.Notify)
+		for n := range l.L.Notify {
+			if n == nil {
+				// Connection was re-established, notifications sent
+				// during the outage are lost.
+				continue
+			}
+
+			l.Notify <- Msg{Key: n.Channel, Payload: n.Extra}
+		}
+	}()
+
+	return l, nil
+}
+
+func (l *PqPubSub) Close() error {
+	l.sender.Close()
+	l.L.Close()
+	return nil
+}
+
+func (l *PqPubSub) eventHandler(ev pq.ListenerEventType, err error) {
+	switch ev {
+	case pq.ListenerEventConnected:
+		l.Log.DebugMsg("connected")
+	case pq.ListenerEventReconnected:
+		l.Log.Msg("connection reestablished, updates sent during the outage are lost")
+	case pq.ListenerEventConnectionAttemptFailed:
+		l.Log.Error("connection attempt failed", err)
+	case pq.ListenerEventDisconnected:
+		l.Log.Msg("connection closed", "err", err)
+	}
+}
+
+func (l *PqPubSub) Subscribe(_ context.Context, key string) error {
+	return l.L.Listen(key)
+}
+
+func (l *PqPubSub) Unsubscribe(_ context.Context, key string) error {
+	return l.L.Unlisten(key)
+}
+
+func (l *PqPubSub) Publish(key, payload string) error {
+	_, err := l.sender.Exec(`SELECT pg_notify($1, $2)`, key, payload)
+	return err
+}
+
+func (l *PqPubSub) Listener() chan Msg {
+	return l.Notify
+}
@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package updatepipe
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/updatepipe/pubsub"
+)
+
+// PubSubPipe implements the UpdatePipe interface on top of a
+// publish-subscribe transport (e.g. PostgreSQL LISTEN/NOTIFY), allowing
+// updates to be exchanged between multiple server instances sharing the
+// same storage.
+//
+// Messages use the same format as UnixSockPipe, the object ID includes the
+// host name so updates from different machines are not confused.
+type PubSubPipe struct {
+	PubSub pubsub.PubSub
+	Log    log.Logger
+
+	// Channel is the key used for updates, "maddy_imap_updates" is used if
+	// not set.
+	Channel string
+}
+
+var _ P = &PubSubPipe{}
+
+func (p *PubSubPipe) channel() string {
+	if p.Channel == "" {
+		return "maddy_imap_updates"
+	}
+	return p.Channel
+}
+
+func (p *PubSubPipe) myID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%p", hostname, os.Getpid(), p)
+}
+
+func (p *PubSubPipe) Listen(upds chan<- backend.Update) error {
+	if err := p.PubSub.Subscribe(context.Background(), p.channel()); err != nil {
+		return err
+	}
+
+	go func() {
+		for msg := range p.PubSub.Listener() {
+			if msg.Key != p.channel() {
+				continue
+			}
+
+			id, upd, err := parseUpdate(msg.Payload)
+			if err != nil {
+				p.Log.Error("malformed update received", err, "str", msg.Payload)
+				continue
+			}
+
+			// It is our own update, skip.
+			if id == p.myID() {
+				continue
+			}
+
+			upds <- upd
+		}
+	}()
+	return nil
+}
+
+func (p *PubSubPipe) InitPush() error {
+	return nil
+}
+
+func (p *PubSubPipe) Push(upd backend.Update) error {
+	updStr, err := formatUpdate(p.myID(), upd)
+	if err != nil {
+		return err
+	}
+
+	return p.PubSub.Publish(p.channel(), strings.TrimSuffix(updStr, "\n"))
+}
+
+func (p *PubSubPipe) Close() error {
+	return p.PubSub.Close()
+}
@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package updatepipe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/foxcpp/maddy/internal/updatepipe/pubsub"
+)
+
+// memBroker delivers published messages to all memPubSub instances
+// subscribed to the key.
+type memBroker struct {
+	subs []*memPubSub
+}
+
+type memPubSub struct {
+	b      *memBroker
+	keys   map[string]bool
+	notify chan pubsub.Msg
+}
+
+func (b *memBroker) New() *memPubSub {
+	ps := &memPubSub{b: b, keys: map[string]bool{}, notify: make(chan pubsub.Msg, 10)}
+	b.subs = append(b.subs, ps)
+	return ps
+}
+
+func (ps *memPubSub) Subscribe(_ context.Context, key string) error {
+	ps.keys[key] = true
+	return nil
+}
+
+func (ps *memPubSub) Unsubscribe(_ context.Context, key string) error {
+	delete(ps.keys, key)
+	return nil
+}
+
+func (ps *memPubSub) Publish(key, payload string) error {
+	for _, sub := range ps.b.subs {
+		if sub.keys[key] {
+			sub.notify <- pubsub.Msg{Key: key, Payload: payload}
+		}
+	}
+	return nil
+}
+
+func (ps *memPubSub) Listener() chan pubsub.Msg {
+	return ps.notify
+}
+
+func (ps *memPubSub) Close() error {
+	close(ps.notify)
+	return nil
+}
+
+func TestPubSubPipe(t *testing.T) {
+	b := &memBroker{}
+	node1 := &PubSubPipe{PubSub: b.New(), Log: testutils.Logger(t, "node1")}
+	node2 := &PubSubPipe{PubSub: b.New(), Log: testutils.Logger(t, "node2")}
+	defer node1.Close()
+	defer node2.Close()
+
+	upds1 := make(chan backend.Update, 10)
+	upds2 := make(chan backend.Update, 10)
+	if err := node1.Listen(upds1); err != nil {
+		t.Fatal(err)
+	}
+	if err := node2.Listen(upds2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node1.Push(&backend.ExpungeUpdate{
+		Update: backend.NewUpdate("test@example.org", imap.InboxName),
+		SeqNum: 3,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case upd := <-upds2:
+		expunge, ok := upd.(*backend.ExpungeUpdate)
+		if !ok || upd.Username() != "test@example.org" || upd.Mailbox() != imap.InboxName || expunge.SeqNum != 3 {
+			t.Fatalf("wrong update received: %#v", upd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("update is not received")
+	}
+
+	// Own updates should not be delivered back.
+	select {
+	case upd := <-upds1:
+		t.Fatalf("own update received: %#v", upd)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
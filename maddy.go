@@ -29,6 +29,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
@@ -37,6 +38,9 @@ import (
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netset"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/i18n"
 
 	// Import packages for side-effect of module registration.
 	_ "github.com/foxcpp/maddy/internal/auth/dovecot_sasl"
@@ -44,17 +48,31 @@ import (
 	_ "github.com/foxcpp/maddy/internal/auth/ldap"
 	_ "github.com/foxcpp/maddy/internal/auth/pam"
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
+	_ "github.com/foxcpp/maddy/internal/auth/perdomain"
 	_ "github.com/foxcpp/maddy/internal/auth/plain_separate"
 	_ "github.com/foxcpp/maddy/internal/auth/shadow"
+	_ "github.com/foxcpp/maddy/internal/check/address_syntax"
 	_ "github.com/foxcpp/maddy/internal/check/authorize_sender"
+	_ "github.com/foxcpp/maddy/internal/check/bayes"
+	_ "github.com/foxcpp/maddy/internal/check/block_attachments"
 	_ "github.com/foxcpp/maddy/internal/check/command"
 	_ "github.com/foxcpp/maddy/internal/check/dkim"
 	_ "github.com/foxcpp/maddy/internal/check/dns"
 	_ "github.com/foxcpp/maddy/internal/check/dnsbl"
+	_ "github.com/foxcpp/maddy/internal/check/geoip"
+	_ "github.com/foxcpp/maddy/internal/check/helo_syntax"
+	_ "github.com/foxcpp/maddy/internal/check/list_unsubscribe"
+	_ "github.com/foxcpp/maddy/internal/check/local_spoof"
 	_ "github.com/foxcpp/maddy/internal/check/milter"
+	_ "github.com/foxcpp/maddy/internal/check/prvs"
+	_ "github.com/foxcpp/maddy/internal/check/received_loop"
+	_ "github.com/foxcpp/maddy/internal/check/require_headers"
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
 	_ "github.com/foxcpp/maddy/internal/check/rspamd"
+	_ "github.com/foxcpp/maddy/internal/check/sample"
 	_ "github.com/foxcpp/maddy/internal/check/spf"
+	_ "github.com/foxcpp/maddy/internal/check/verify_sender"
+	_ "github.com/foxcpp/maddy/internal/endpoint/control"
 	_ "github.com/foxcpp/maddy/internal/endpoint/dovecot_sasld"
 	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
 	_ "github.com/foxcpp/maddy/internal/endpoint/openmetrics"
@@ -67,10 +85,16 @@ import (
 	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/s3"
 	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
+	_ "github.com/foxcpp/maddy/internal/storage/perdomain"
 	_ "github.com/foxcpp/maddy/internal/table"
+	_ "github.com/foxcpp/maddy/internal/target/dir"
+	_ "github.com/foxcpp/maddy/internal/target/failover"
+	_ "github.com/foxcpp/maddy/internal/target/mirror"
 	_ "github.com/foxcpp/maddy/internal/target/queue"
 	_ "github.com/foxcpp/maddy/internal/target/remote"
+	_ "github.com/foxcpp/maddy/internal/target/sink"
 	_ "github.com/foxcpp/maddy/internal/target/smtp"
+	_ "github.com/foxcpp/maddy/internal/target/webhook"
 	_ "github.com/foxcpp/maddy/internal/tls"
 	_ "github.com/foxcpp/maddy/internal/tls/acme"
 )
@@ -114,6 +138,7 @@ func Run() int {
 		configPath   = flag.String("config", filepath.Join(ConfigDirectory, "maddy.conf"), "path to configuration file")
 		logTargets   = flag.String("log", "stderr", "default logging target(s)")
 		printVersion = flag.Bool("v", false, "print version and build metadata, then exit")
+		checkOnly    = flag.Bool("check", false, "check the configuration and initialize modules without starting the server, then exit")
 	)
 
 	if enableDebugFlags {
@@ -161,7 +186,24 @@ func Run() int {
 		return 2
 	}
 
-	if err := moduleMain(cfg); err != nil {
+	if *checkOnly {
+		if err := checkConfig(cfg); err != nil {
+			log.Println(err)
+			return 2
+		}
+		log.Println("configuration is valid")
+		return 0
+	}
+
+	// Working directory is changed by InitDirs so the path is made absolute
+	// to be able to re-read the configuration later.
+	absConfigPath, err := filepath.Abs(*configPath)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if err := moduleMain(absConfigPath, cfg); err != nil {
 		systemdStatusErr(err)
 		log.Println(err)
 		return 2
@@ -248,6 +290,8 @@ func ensureDirectoryWritable(path string) error {
 }
 
 func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, error) {
+	var readOnly bool
+
 	globals := config.NewMap(nil, config.Node{Children: cfg})
 	globals.String("state_dir", false, false, DefaultStateDirectory, &config.StateDirectory)
 	globals.String("runtime_dir", false, false, DefaultRuntimeDirectory, &config.RuntimeDirectory)
@@ -259,12 +303,23 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.StringList("auth_domains", false, false, nil, nil)
 	globals.Custom("log", false, false, defaultLogOutput, logOutput, &log.DefaultLogger.Out)
 	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
+	globals.Duration("shutdown_grace", false, false, 30*time.Second, nil)
+	globals.Int("max_mime_depth", false, false, 0, nil)
+	globals.Int("max_parts", false, false, 0, nil)
+	globals.DataSize("max_decompressed_size", false, false, 0, nil)
+	globals.Enum("locale", false, false, i18n.Locales(), "", nil)
+	globals.Bool("read_only", false, false, &readOnly)
+	netset.GlobalDirectives(globals)
 	globals.AllowUnknown()
 	unknown, err := globals.Process()
-	return globals.Values, unknown, err
+	if err != nil {
+		return nil, nil, err
+	}
+	control.SetReadOnly(readOnly)
+	return globals.Values, unknown, nil
 }
 
-func moduleMain(cfg []config.Node) error {
+func moduleMain(configPath string, cfg []config.Node) error {
 	globals, modBlocks, err := ReadGlobals(cfg)
 	if err != nil {
 		return err
@@ -290,15 +345,51 @@ func moduleMain(cfg []config.Node) error {
 
 	systemdStatus(SDReady, "Listening for incoming connections...")
 
-	handleSignals()
+	globalNodes, _ := splitGlobals(cfg)
+	reloader := &reloadState{
+		configPath:  configPath,
+		globals:     globals,
+		globalNodes: globalNodes,
+		endpoints:   endpoints,
+		mods:        mods,
+	}
+	handleSignals(reloader.reload)
 
 	systemdStatus(SDStopping, "Waiting for running transactions to complete...")
 
+	cancel := module.BeginShutdown(globals["shutdown_grace"].(time.Duration))
 	hooks.RunHooks(hooks.EventShutdown)
+	cancel()
 
 	return nil
 }
 
+// checkConfig initializes all modules with module.NoRun set so they read
+// and verify their configuration but do not start serving anything.
+//
+// Note that some modules may still contact external services (e.g.
+// database servers) to make sure the configuration is usable.
+func checkConfig(cfg []config.Node) error {
+	globals, modBlocks, err := ReadGlobals(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := InitDirs(); err != nil {
+		return err
+	}
+
+	module.NoRun = true
+	defer hooks.RunHooks(hooks.EventShutdown)
+
+	endpoints, mods, err := RegisterModules(globals, modBlocks)
+	if err != nil {
+		return err
+	}
+
+	return initModules(globals, endpoints, mods)
+}
+
 type ModInfo struct {
 	Instance module.Module
 	Cfg      config.Node
@@ -370,11 +461,11 @@ func initModules(globals map[string]interface{}, endpoints, mods []ModInfo) erro
 			return err
 		}
 
-		if closer, ok := endp.Instance.(io.Closer); ok {
+		if _, ok := endp.Instance.(io.Closer); ok {
 			endp := endp
 			hooks.AddHook(hooks.EventShutdown, func() {
 				log.Debugf("close %s (%s)", endp.Instance.Name(), endp.Instance.InstanceName())
-				if err := closer.Close(); err != nil {
+				if err := module.Shutdown(endp.Instance); err != nil {
 					log.Printf("module %s (%s) close failed: %v", endp.Instance.Name(), endp.Instance.InstanceName(), err)
 				}
 			})
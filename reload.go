@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// reloadState contains information about the running configuration necessary
+// to apply the changed one.
+type reloadState struct {
+	configPath string
+	globals    map[string]interface{}
+
+	globalNodes []config.Node
+	endpoints   []ModInfo
+	mods        []ModInfo
+}
+
+// splitGlobals separates global directives from module configuration blocks.
+func splitGlobals(cfg []config.Node) (globalNodes, modBlocks []config.Node) {
+	for _, node := range cfg {
+		if module.GetEndpoint(node.Name) != nil || module.Get(node.Name) != nil {
+			modBlocks = append(modBlocks, node)
+			continue
+		}
+		globalNodes = append(globalNodes, node)
+	}
+	return
+}
+
+// moduleKey returns the string identifying the configuration block between
+// configuration versions.
+//
+// Endpoints are identified by their module name and listen addresses, so
+// changing the listening address is seen as removal of one endpoint and
+// addition of another one.
+func moduleKey(block config.Node) string {
+	if module.GetEndpoint(block.Name) != nil {
+		return "endpoint " + block.Name + " " + strings.Join(block.Args, " ")
+	}
+	if len(block.Args) == 0 {
+		return block.Name
+	}
+	return block.Args[0]
+}
+
+// nodesEqual reports whether the configuration blocks are equal ignoring
+// their location.
+func nodesEqual(a, b []config.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !reflect.DeepEqual(a[i].Args, b[i].Args) {
+			return false
+		}
+		if (a[i].Children == nil) != (b[i].Children == nil) {
+			return false
+		}
+		if !nodesEqual(a[i].Children, b[i].Children) {
+			return false
+		}
+	}
+	return true
+}
+
+// reload reads the configuration file and applies changes to modules that
+// support it (implement module.ReloadModule).
+//
+// Changes that can't be applied without the restart (e.g. listening
+// addresses or global directives) are logged and otherwise ignored.
+func (r *reloadState) reload() {
+	f, err := os.Open(r.configPath)
+	if err != nil {
+		log.Println("config reload failed:", err)
+		return
+	}
+	defer f.Close()
+
+	cfg, err := parser.Read(f, r.configPath)
+	if err != nil {
+		log.Println("config reload failed:", err)
+		return
+	}
+
+	globalNodes, modBlocks := splitGlobals(cfg)
+	if !nodesEqual(globalNodes, r.globalNodes) {
+		log.Println("config reload: global directives changed, restart is required to apply changes")
+	}
+
+	running := make(map[string]*ModInfo, len(r.endpoints)+len(r.mods))
+	for i := range r.endpoints {
+		running[moduleKey(r.endpoints[i].Cfg)] = &r.endpoints[i]
+	}
+	for i := range r.mods {
+		running[moduleKey(r.mods[i].Cfg)] = &r.mods[i]
+	}
+
+	seen := make(map[string]bool, len(modBlocks))
+	for _, block := range modBlocks {
+		key := moduleKey(block)
+		seen[key] = true
+
+		inst, ok := running[key]
+		if !ok {
+			log.Printf("config reload: %s:%d: new configuration block %s, restart is required to apply changes",
+				block.File, block.Line, key)
+			continue
+		}
+
+		if block.Name == inst.Cfg.Name && reflect.DeepEqual(block.Args, inst.Cfg.Args) &&
+			nodesEqual(block.Children, inst.Cfg.Children) {
+			continue
+		}
+
+		if err := r.reloadModule(inst, block); err != nil {
+			log.Printf("config reload: %v", err)
+			continue
+		}
+		inst.Cfg = block
+	}
+
+	for key := range running {
+		if !seen[key] {
+			log.Printf("config reload: configuration block %s removed, restart is required to apply changes", key)
+		}
+	}
+}
+
+func (r *reloadState) reloadModule(inst *ModInfo, block config.Node) error {
+	if block.Name != inst.Cfg.Name {
+		return config.NodeErr(block, "module changed for %s, restart is required to apply changes", moduleKey(block))
+	}
+
+	reloader, ok := inst.Instance.(module.ReloadModule)
+	if !ok {
+		return config.NodeErr(block, "%s (%s) does not support reload, restart is required to apply changes",
+			inst.Instance.Name(), moduleKey(block))
+	}
+
+	if err := reloader.Reload(config.NewMap(r.globals, block)); err != nil {
+		return fmt.Errorf("%s (%s) reload failed: %w", inst.Instance.Name(), moduleKey(block), err)
+	}
+
+	log.Printf("config reload: %s (%s) reloaded", inst.Instance.Name(), moduleKey(block))
+	return nil
+}
@@ -32,10 +32,13 @@ import (
 // handleSignals function creates and listens on OS signals channel.
 //
 // OS-specific signals that correspond to the program termination
-// (SIGTERM, SIGHUP, SIGINT) will cause this function to return.
+// (SIGTERM, SIGINT) will cause this function to return.
 //
 // SIGUSR1 will call reinitLogging without returning.
-func handleSignals() os.Signal {
+//
+// SIGHUP will call reloadCfg to apply the changed configuration and then
+// reload secondary files, like SIGUSR2 does.
+func handleSignals(reloadCfg func()) os.Signal {
 	sig := make(chan os.Signal, 5)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
 
@@ -46,6 +49,12 @@ func handleSignals() os.Signal {
 			systemdStatus(SDReloading, "Reopening logs...")
 			hooks.RunHooks(hooks.EventLogRotate)
 			systemdStatus(SDReady, "Listening for incoming connections...")
+		case syscall.SIGHUP:
+			log.Printf("signal received (%s), reloading configuration", s.String())
+			systemdStatus(SDReloading, "Reloading configuration...")
+			reloadCfg()
+			hooks.RunHooks(hooks.EventReload)
+			systemdStatus(SDReady, "Listening for incoming connections...")
 		case syscall.SIGUSR2:
 			log.Printf("signal received (%s), reloading state", s.String())
 			systemdStatus(SDReloading, "Reloading state...")
@@ -53,7 +62,7 @@ func handleSignals() os.Signal {
 			systemdStatus(SDReady, "Listening for incoming connections...")
 		default:
 			go func() {
-				s := handleSignals()
+				s := handleSignals(reloadCfg)
 				log.Printf("forced shutdown due to signal (%v)!", s)
 				os.Exit(1)
 			}()